@@ -0,0 +1,418 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Privilege is an access control privilege, as defined in RFC 3744 section 3.
+type Privilege string
+
+const (
+	PrivilegeAll                         Privilege = "all"
+	PrivilegeRead                        Privilege = "read"
+	PrivilegeWrite                       Privilege = "write"
+	PrivilegeWriteProperties             Privilege = "write-properties"
+	PrivilegeWriteContent                Privilege = "write-content"
+	PrivilegeBind                        Privilege = "bind"
+	PrivilegeUnbind                      Privilege = "unbind"
+	PrivilegeUnlock                      Privilege = "unlock"
+	PrivilegeReadACL                     Privilege = "read-acl"
+	PrivilegeReadCurrentUserPrivilegeSet Privilege = "read-current-user-privilege-set"
+	PrivilegeWriteACL                    Privilege = "write-acl"
+)
+
+// privilegeParents maps privileges to the aggregate privileges containing
+// them.
+var privilegeParents = map[Privilege]Privilege{
+	PrivilegeRead:                        PrivilegeAll,
+	PrivilegeWrite:                       PrivilegeAll,
+	PrivilegeUnlock:                      PrivilegeAll,
+	PrivilegeReadACL:                     PrivilegeAll,
+	PrivilegeWriteACL:                    PrivilegeAll,
+	PrivilegeWriteProperties:             PrivilegeWrite,
+	PrivilegeWriteContent:                PrivilegeWrite,
+	PrivilegeBind:                        PrivilegeWrite,
+	PrivilegeUnbind:                      PrivilegeWrite,
+	PrivilegeReadCurrentUserPrivilegeSet: PrivilegeReadACL,
+}
+
+// HasPrivilege reports whether a privilege is part of a set of privileges,
+// either directly or via an aggregate privilege such as PrivilegeWrite.
+func HasPrivilege(privileges []Privilege, p Privilege) bool {
+	for ; p != ""; p = privilegeParents[p] {
+		for _, granted := range privileges {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Special principals which can be used in ACEs, as defined in RFC 3744
+// section 5.5.1.
+const (
+	PrincipalAll             = "DAV:all"
+	PrincipalAuthenticated   = "DAV:authenticated"
+	PrincipalUnauthenticated = "DAV:unauthenticated"
+	PrincipalSelf            = "DAV:self"
+)
+
+// ACE is an access control entry, granting or denying privileges to a
+// principal.
+type ACE struct {
+	// Principal is the path of a principal, or one of the special principals
+	// such as PrincipalAll.
+	Principal  string
+	Privileges []Privilege
+	Deny       bool
+	// Protected ACEs can't be modified by clients.
+	Protected bool
+	// Inherited is the path of the resource the ACE is inherited from, if
+	// any. Inherited ACEs can't be modified by clients.
+	Inherited string
+}
+
+// PrivilegeChecker determines the privileges of the current user, e.g.
+// retrieved from the request context with the auth package. It's used by
+// Handler to check privileges before each operation.
+type PrivilegeChecker interface {
+	// CurrentUserPrivileges returns the privileges granted to the current
+	// user on a resource. Aggregate privileges such as PrivilegeWrite
+	// grant all of the privileges they contain.
+	CurrentUserPrivileges(ctx context.Context, name string) ([]Privilege, error)
+}
+
+// ACLStore is a PrivilegeChecker exposing access control lists to clients,
+// via the DAV:acl and DAV:owner properties and the ACL method.
+type ACLStore interface {
+	PrivilegeChecker
+	// Owner returns the path of the principal owning a resource, or an
+	// empty string if unknown.
+	Owner(ctx context.Context, name string) (string, error)
+	// ACL returns the access control list of a resource.
+	ACL(ctx context.Context, name string) ([]ACE, error)
+	// SetACL replaces the ACEs of a resource which aren't protected or
+	// inherited.
+	SetACL(ctx context.Context, name string, aces []ACE) error
+	// PrincipalCollectionSet returns the paths of the collections
+	// containing principals.
+	PrincipalCollectionSet(ctx context.Context) ([]string, error)
+}
+
+func newNeedPrivilegesError(name string, p Privilege) error {
+	raw, _ := internal.EncodeRawXMLElement(&needPrivileges{
+		Resources: []needPrivilegesResource{{
+			Href:      internal.Href{Path: name},
+			Privilege: newPrivilege(p),
+		}},
+	})
+	return &internal.HTTPError{
+		Code: http.StatusForbidden,
+		Err:  &internal.Error{Raw: []internal.RawXMLValue{*raw}},
+	}
+}
+
+func (b *backend) checkPrivilege(ctx context.Context, name string, p Privilege) error {
+	privileges, err := b.PrivilegeChecker.CurrentUserPrivileges(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !HasPrivilege(privileges, p) {
+		return newNeedPrivilegesError(name, p)
+	}
+	return nil
+}
+
+// canRead reports whether the current user can read a resource. Errors are
+// treated as a lack of privileges.
+func (b *backend) canRead(ctx context.Context, name string) bool {
+	return b.PrivilegeChecker == nil || b.checkPrivilege(ctx, name, PrivilegeRead) == nil
+}
+
+func parentPath(name string) string {
+	return path.Dir(strings.TrimSuffix(name, "/"))
+}
+
+// checkRequestPrivileges checks that the current user has the privileges
+// required by a request, as listed in RFC 3744 appendix B.
+func (b *backend) checkRequestPrivileges(r *http.Request) error {
+	ctx := r.Context()
+	name := r.URL.Path
+
+	var dest, destParent string
+	if h := r.Header.Get("Destination"); h != "" {
+		// Malformed headers are reported by the method handlers
+		if u, err := internal.ParseURL(h); err == nil {
+			dest, destParent = u.Path, parentPath(u.Path)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, "PROPFIND", "REPORT":
+		return b.checkPrivilege(ctx, name, PrivilegeRead)
+	case http.MethodPut, http.MethodPatch, "LOCK":
+		if _, err := b.FileSystem.Stat(ctx, name); internal.IsNotFound(err) {
+			return b.checkPrivilege(ctx, parentPath(name), PrivilegeBind)
+		}
+		return b.checkPrivilege(ctx, name, PrivilegeWriteContent)
+	case http.MethodDelete:
+		return b.checkPrivilege(ctx, parentPath(name), PrivilegeUnbind)
+	case "MKCOL":
+		return b.checkPrivilege(ctx, parentPath(name), PrivilegeBind)
+	case "PROPPATCH":
+		return b.checkPrivilege(ctx, name, PrivilegeWriteProperties)
+	case "COPY", "MOVE":
+		if r.Method == "COPY" {
+			if err := b.checkPrivilege(ctx, name, PrivilegeRead); err != nil {
+				return err
+			}
+		} else {
+			if err := b.checkPrivilege(ctx, parentPath(name), PrivilegeUnbind); err != nil {
+				return err
+			}
+		}
+		if destParent == "" {
+			return nil
+		}
+		if err := b.checkPrivilege(ctx, destParent, PrivilegeBind); err != nil {
+			return err
+		}
+		// An existing destination is removed before being replaced
+		if r.Header.Get("Overwrite") != "F" {
+			if _, err := b.FileSystem.Stat(ctx, dest); err == nil {
+				if err := b.checkPrivilege(ctx, destParent, PrivilegeUnbind); err != nil {
+					return err
+				}
+				return b.checkPrivilege(ctx, dest, PrivilegeWriteContent)
+			}
+		}
+	case "UNLOCK":
+		return b.checkPrivilege(ctx, name, PrivilegeUnlock)
+	case "ACL":
+		return b.checkPrivilege(ctx, name, PrivilegeWriteACL)
+	}
+	return nil
+}
+
+var supportedPrivileges = supportedPrivilegeSet{
+	SupportedPrivileges: []supportedPrivilege{{
+		Privilege:   newPrivilege(PrivilegeAll),
+		Abstract:    &struct{}{},
+		Description: "Any operation",
+		SupportedPrivileges: []supportedPrivilege{
+			{Privilege: newPrivilege(PrivilegeRead), Description: "Read any object"},
+			{
+				Privilege:   newPrivilege(PrivilegeWrite),
+				Description: "Write any object",
+				SupportedPrivileges: []supportedPrivilege{
+					{Privilege: newPrivilege(PrivilegeWriteProperties), Description: "Write properties"},
+					{Privilege: newPrivilege(PrivilegeWriteContent), Description: "Write resource content"},
+					{Privilege: newPrivilege(PrivilegeBind), Description: "Add new members to a collection"},
+					{Privilege: newPrivilege(PrivilegeUnbind), Description: "Remove members from a collection"},
+				},
+			},
+			{Privilege: newPrivilege(PrivilegeUnlock), Description: "Unlock resources"},
+			{
+				Privilege:   newPrivilege(PrivilegeReadACL),
+				Description: "Read access control lists",
+				SupportedPrivileges: []supportedPrivilege{
+					{Privilege: newPrivilege(PrivilegeReadCurrentUserPrivilegeSet), Description: "Read the current user's privileges"},
+				},
+			},
+			{Privilege: newPrivilege(PrivilegeWriteACL), Description: "Write access control lists"},
+		},
+	}},
+}
+
+func addACLProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, b *backend, name string) {
+	props[supportedPrivilegeSetName] = func(*internal.RawXMLValue) (interface{}, error) {
+		return &supportedPrivileges, nil
+	}
+
+	props[currentUserPrivilegeSetName] = func(*internal.RawXMLValue) (interface{}, error) {
+		if err := b.checkPrivilege(ctx, name, PrivilegeReadCurrentUserPrivilegeSet); err != nil {
+			return nil, err
+		}
+		privileges, err := b.PrivilegeChecker.CurrentUserPrivileges(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		set := &currentUserPrivilegeSet{}
+		for _, p := range privileges {
+			set.Privileges = append(set.Privileges, newPrivilege(p))
+		}
+		return set, nil
+	}
+
+	store, ok := b.PrivilegeChecker.(ACLStore)
+	if !ok {
+		return
+	}
+
+	props[ownerName] = func(*internal.RawXMLValue) (interface{}, error) {
+		p, err := store.Owner(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		elt := &owner{}
+		if p != "" {
+			elt.Href = &internal.Href{Path: p}
+		}
+		return elt, nil
+	}
+
+	props[aclName] = func(*internal.RawXMLValue) (interface{}, error) {
+		if err := b.checkPrivilege(ctx, name, PrivilegeReadACL); err != nil {
+			return nil, err
+		}
+		aces, err := store.ACL(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return encodeACL(aces), nil
+	}
+
+	props[principalCollectionSetName] = func(*internal.RawXMLValue) (interface{}, error) {
+		paths, err := store.PrincipalCollectionSet(ctx)
+		if err != nil {
+			return nil, err
+		}
+		set := &principalCollectionSet{}
+		for _, p := range paths {
+			set.Hrefs = append(set.Hrefs, internal.Href{Path: p})
+		}
+		return set, nil
+	}
+}
+
+func encodeACL(aces []ACE) *acl {
+	var out acl
+	for _, a := range aces {
+		var elt ace
+		switch a.Principal {
+		case PrincipalAll:
+			elt.Principal.All = &struct{}{}
+		case PrincipalAuthenticated:
+			elt.Principal.Authenticated = &struct{}{}
+		case PrincipalUnauthenticated:
+			elt.Principal.Unauthenticated = &struct{}{}
+		case PrincipalSelf:
+			elt.Principal.Self = &struct{}{}
+		default:
+			elt.Principal.Href = &internal.Href{Path: a.Principal}
+		}
+
+		list := &privilegeList{}
+		for _, p := range a.Privileges {
+			list.Privileges = append(list.Privileges, newPrivilege(p))
+		}
+		if a.Deny {
+			elt.Deny = list
+		} else {
+			elt.Grant = list
+		}
+
+		if a.Protected {
+			elt.Protected = &struct{}{}
+		}
+		if a.Inherited != "" {
+			elt.Inherited = &inherited{Href: internal.Href{Path: a.Inherited}}
+		}
+		out.ACEs = append(out.ACEs, elt)
+	}
+	return &out
+}
+
+func decodePrivileges(list *privilegeList) ([]Privilege, error) {
+	var privileges []Privilege
+	for _, priv := range list.Privileges {
+		for i := range priv.Raw {
+			name, ok := priv.Raw[i].XMLName()
+			if !ok {
+				continue
+			}
+			p := Privilege(name.Local)
+			if _, known := privilegeParents[p]; name.Space != "DAV:" || (!known && p != PrivilegeAll) {
+				return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: unsupported privilege %v", name)
+			}
+			privileges = append(privileges, p)
+		}
+	}
+	return privileges, nil
+}
+
+func decodeACL(in *acl) ([]ACE, error) {
+	var aces []ACE
+	for _, elt := range in.ACEs {
+		if elt.Protected != nil || elt.Inherited != nil {
+			// RFC 3744 section 8.1.1: protected and inherited ACEs must not
+			// be sent by clients
+			return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: protected and inherited ACEs can't be modified")
+		}
+
+		var a ACE
+		switch p := elt.Principal; {
+		case p.Href != nil:
+			a.Principal = p.Href.Path
+		case p.All != nil:
+			a.Principal = PrincipalAll
+		case p.Authenticated != nil:
+			a.Principal = PrincipalAuthenticated
+		case p.Unauthenticated != nil:
+			a.Principal = PrincipalUnauthenticated
+		case p.Self != nil:
+			a.Principal = PrincipalSelf
+		default:
+			return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: unsupported ACE principal")
+		}
+
+		list := elt.Grant
+		if elt.Deny != nil {
+			if elt.Grant != nil {
+				return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: ACE can't both grant and deny privileges")
+			}
+			list = elt.Deny
+			a.Deny = true
+		}
+		if list == nil {
+			return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: ACE missing grant or deny element")
+		}
+		privileges, err := decodePrivileges(list)
+		if err != nil {
+			return nil, err
+		}
+		a.Privileges = privileges
+
+		aces = append(aces, a)
+	}
+	return aces, nil
+}
+
+// handleACL handles ACL requests, as defined in RFC 3744 section 8.1.
+func (b *backend) handleACL(w http.ResponseWriter, r *http.Request, store ACLStore) error {
+	if _, err := b.FileSystem.Stat(r.Context(), r.URL.Path); err != nil {
+		return err
+	}
+
+	var in acl
+	if err := internal.DecodeXMLRequest(r, &in); err != nil {
+		return err
+	}
+	aces, err := decodeACL(&in)
+	if err != nil {
+		return err
+	}
+
+	if err := store.SetACL(r.Context(), r.URL.Path, aces); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
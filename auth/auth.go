@@ -0,0 +1,184 @@
+// Package auth provides HTTP authentication middlewares for WebDAV, CalDAV and
+// CardDAV servers.
+//
+// Authenticated identities are stored in the request context and can be
+// retrieved by backends with FromContext or PrincipalFromContext.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Identity describes an authenticated client.
+type Identity struct {
+	// Principal identifies the authenticated user.
+	Principal string
+	// Scope restricts the requests the client is allowed to make, e.g. for
+	// app-specific passwords. If nil, the client isn't restricted.
+	Scope *Scope
+	// AuthenticationInfo, if set, is sent to the client in the
+	// Authentication-Info header defined in RFC 7615, e.g. to complete a
+	// SCRAM exchange.
+	AuthenticationInfo string
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the authenticated identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the authenticated identity stored in ctx, if any.
+func FromContext(ctx context.Context) (id *Identity, ok bool) {
+	id, ok = ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+// PrincipalFromContext returns the authenticated principal stored in ctx, if
+// any.
+func PrincipalFromContext(ctx context.Context) (principal string, ok bool) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return id.Principal, true
+}
+
+// UserPrincipal reports the authenticated principal as the current user's
+// principal. It implements webdav.UserPrincipalBackend and can be embedded in
+// CalDAV and CardDAV backends, or set as webdav.Handler.UserPrincipal.
+type UserPrincipal struct {
+	// Path maps a principal to the path of its principal URL. If nil, the
+	// principal is used as is.
+	Path func(principal string) string
+}
+
+// CurrentUserPrincipal returns the path of the authenticated principal's
+// URL. Unauthenticated requests are rejected with a 401 Unauthorized error.
+func (up UserPrincipal) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return "", internal.HTTPErrorf(http.StatusUnauthorized, "webdav: unauthenticated request")
+	}
+	if up.Path != nil {
+		return up.Path(principal), nil
+	}
+	return principal, nil
+}
+
+// Authenticator authenticates HTTP requests.
+type Authenticator interface {
+	// Authenticate returns the identity of the client making the request.
+	// Errors created with webdav.NewHTTPError are sent with their status
+	// code, other errors result in a 500 Internal Server Error response.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Challenger is an optional interface which can be implemented by an
+// Authenticator to send a WWW-Authenticate challenge along with 401
+// Unauthorized responses.
+type Challenger interface {
+	Challenge() string
+}
+
+// ChallengeError is an authentication error sent to the client with a
+// specific challenge, e.g. to continue a multi-step exchange. It results in a
+// 401 Unauthorized response.
+type ChallengeError struct {
+	// Challenge is sent in the WWW-Authenticate header.
+	Challenge string
+	Err       error
+}
+
+func (err *ChallengeError) Error() string {
+	if err.Err == nil {
+		return "webdav: authentication challenge"
+	}
+	return err.Err.Error()
+}
+
+func (err *ChallengeError) Unwrap() error {
+	return err.Err
+}
+
+// Handler is an HTTP handler which authenticates requests before passing
+// them to the next handler. Requests outside of the identity's scope are
+// rejected.
+type Handler struct {
+	Authenticator Authenticator
+	Next          http.Handler
+
+	// AttemptTracker, if set, is notified of authentication attempts, e.g.
+	// to lock out clients after too many failures.
+	AttemptTracker AttemptTracker
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests without credentials are part of the regular
+	// challenge-response flow, they aren't tracked
+	var attempt *Attempt
+	tracked := h.AttemptTracker != nil && r.Header.Get("Authorization") != ""
+	if tracked {
+		attempt = newAttempt(r)
+		if err := h.AttemptTracker.Check(r.Context(), attempt); err != nil {
+			internal.ServeError(w, err)
+			return
+		}
+	}
+
+	id, err := h.Authenticator.Authenticate(r)
+	if err == nil && id == nil {
+		err = internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+	}
+	if err != nil {
+		var httpErr *internal.HTTPError
+		var challengeErr *ChallengeError
+		unauthorized := errors.As(err, &httpErr) && httpErr.Code == http.StatusUnauthorized
+		if errors.As(err, &challengeErr) {
+			// Part of the exchange, not a failed attempt
+			w.Header().Set("WWW-Authenticate", challengeErr.Challenge)
+			internal.ServeError(w, &internal.HTTPError{Code: http.StatusUnauthorized, Err: err})
+			return
+		}
+		if unauthorized && tracked {
+			h.AttemptTracker.Failed(r.Context(), attempt)
+		} else if tracked && (httpErr == nil || httpErr.Code/100 == 5) {
+			// Server errors, e.g. from a credential store, aren't failed
+			// attempts
+			if aborter, ok := h.AttemptTracker.(AttemptAborter); ok {
+				aborter.Aborted(r.Context(), attempt)
+			}
+		}
+		if c, ok := h.Authenticator.(Challenger); ok && unauthorized {
+			w.Header().Set("WWW-Authenticate", c.Challenge())
+		}
+		internal.ServeError(w, err)
+		return
+	}
+	if tracked {
+		h.AttemptTracker.Succeeded(r.Context(), attempt)
+	}
+
+	if !id.Scope.Allows(r) {
+		internal.ServeError(w, internal.HTTPErrorf(http.StatusForbidden, "webdav: request not allowed by credentials scope"))
+		return
+	}
+
+	if id.AuthenticationInfo != "" {
+		w.Header().Set("Authentication-Info", id.AuthenticationInfo)
+	}
+
+	ctx := NewContext(r.Context(), id)
+	if id.Scope != nil && len(id.Scope.Paths) > 0 {
+		// Hrefs in request bodies, e.g. in multiget reports, are checked
+		// by the CalDAV and CardDAV handlers
+		ctx = internal.WithPathFilter(ctx, id.Scope.allowsPath)
+	}
+	h.Next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,625 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+func newTestHandler(authenticator Authenticator) *Handler {
+	return &Handler{
+		Authenticator: authenticator,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := PrincipalFromContext(r.Context())
+			fmt.Fprint(w, principal)
+		}),
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	alice := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	bob := &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}
+
+	mapped := &TLSClientCertificate{
+		Principal: func(cert *x509.Certificate) (string, error) {
+			if cert.Subject.CommonName != "alice" {
+				return "", webdav.NewHTTPError(http.StatusForbidden, nil)
+			}
+			return "/principals/alice/", nil
+		},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authenticator *TLSClientCertificate
+		state         *tls.ConnectionState
+		code          int
+		principal     string
+	}{
+		{"no TLS", &TLSClientCertificate{}, nil, http.StatusForbidden, ""},
+		{"unverified", &TLSClientCertificate{}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{alice}}, http.StatusForbidden, ""},
+		{"common name", &TLSClientCertificate{}, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{alice}}}, http.StatusOK, "alice"},
+		{"mapped", mapped, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{alice}}}, http.StatusOK, "/principals/alice/"},
+		{"rejected", mapped, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{bob}}}, http.StatusForbidden, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tc.state
+			w := httptest.NewRecorder()
+			newTestHandler(tc.authenticator).ServeHTTP(w, req)
+
+			if w.Code != tc.code {
+				t.Errorf("status = %v, want %v", w.Code, tc.code)
+			} else if tc.code == http.StatusOK && w.Body.String() != tc.principal {
+				t.Errorf("principal = %q, want %q", w.Body.String(), tc.principal)
+			}
+		})
+	}
+}
+
+type testCredentialStore map[string][]Credential
+
+func (s testCredentialStore) LookupCredentials(ctx context.Context, username string) (string, []Credential, error) {
+	return "/principals/" + username + "/", s[username], nil
+}
+
+func compareTestHash(hash, password []byte) error {
+	if string(hash) != "hash:"+string(password) {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
+
+func TestBasic(t *testing.T) {
+	store := testCredentialStore{
+		"alice": []Credential{
+			{Hash: []byte("hash:primary")},
+			{Hash: []byte("hash:readonly"), Scope: &Scope{ReadOnly: true}},
+			{Hash: []byte("hash:calendar"), Scope: &Scope{Paths: []string{"/calendars/alice/"}}},
+		},
+	}
+	h := newTestHandler(&Basic{
+		Realm:   "DAV",
+		Checker: &HashChecker{Store: store, Compare: compareTestHash},
+	})
+
+	for _, tc := range []struct {
+		name, method, path, password string
+		depth                        string
+		code                         int
+	}{
+		{"no credentials", "PROPFIND", "/", "", "", http.StatusUnauthorized},
+		{"wrong password", "PROPFIND", "/", "wrong", "", http.StatusUnauthorized},
+		{"primary", "PUT", "/contacts/alice/a.vcf", "primary", "", http.StatusOK},
+		{"read-only read", "REPORT", "/contacts/alice/", "readonly", "", http.StatusOK},
+		{"read-only write", "PUT", "/contacts/alice/a.vcf", "readonly", "", http.StatusForbidden},
+		{"calendar-only in scope", "PUT", "/calendars/alice/work/a.ics", "calendar", "", http.StatusOK},
+		{"calendar-only out of scope", "GET", "/contacts/alice/a.vcf", "calendar", "", http.StatusForbidden},
+		{"calendar-only discovery", "PROPFIND", "/", "calendar", "0", http.StatusOK},
+		{"calendar-only listing", "PROPFIND", "/", "calendar", "1", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.password != "" {
+				req.SetBasicAuth("alice", tc.password)
+			}
+			if tc.depth != "" {
+				req.Header.Set("Depth", tc.depth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.code {
+				t.Errorf("status = %v, want %v", w.Code, tc.code)
+			}
+			if tc.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="DAV", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+			if tc.code == http.StatusOK && w.Body.String() != "/principals/alice/" {
+				t.Errorf("principal = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestScope_Allows_destination(t *testing.T) {
+	scope := &Scope{Paths: []string{"/calendars/alice/"}}
+
+	req := httptest.NewRequest("MOVE", "/calendars/alice/a/1.ics", nil)
+	req.Header.Set("Destination", "http://example.org/calendars/alice/b/1.ics")
+	if !scope.Allows(req) {
+		t.Errorf("MOVE inside scope not allowed")
+	}
+
+	req.Header.Set("Destination", "http://example.org/calendars/bob/1.ics")
+	if scope.Allows(req) {
+		t.Errorf("MOVE outside of scope allowed")
+	}
+}
+
+func TestHandler_scopePathFilter(t *testing.T) {
+	store := testCredentialStore{
+		"alice": []Credential{{Hash: []byte("hash:calendar"), Scope: &Scope{Paths: []string{"/calendars/alice/"}}}},
+	}
+	h := &Handler{
+		Authenticator: &Basic{Checker: &HashChecker{Store: store, Compare: compareTestHash}},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, internal.PathAllowed(r.Context(), "/calendars/alice/a.ics"), internal.PathAllowed(r.Context(), "/contacts/alice/a.vcf"))
+		}),
+	}
+
+	req := httptest.NewRequest("REPORT", "/calendars/alice/", nil)
+	req.SetBasicAuth("alice", "calendar")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "true false" {
+		t.Errorf("status = %v, paths allowed = %q, want true false", w.Code, w.Body.String())
+	}
+}
+
+type nilAuthenticator struct{}
+
+func (nilAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	return nil, nil
+}
+
+func TestHandler_nilIdentity(t *testing.T) {
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	w := httptest.NewRecorder()
+	newTestHandler(nilAuthenticator{}).ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	var failures []int
+	lockout := &Lockout{
+		MaxFailures: 3,
+		OnFailure: func(attempt *Attempt, ipFailures, userFailures int) {
+			failures = append(failures, userFailures)
+		},
+	}
+	h := newTestHandler(&Basic{
+		Checker: &HashChecker{
+			Store:   testCredentialStore{"alice": []Credential{{Hash: []byte("hash:secret")}}},
+			Compare: compareTestHash,
+		},
+	})
+	h.AttemptTracker = lockout
+
+	do := func(remoteAddr, password string) int {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if password != "" {
+			req.SetBasicAuth("alice", password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Challenges don't count as failures
+	for i := 0; i < 5; i++ {
+		if code := do("192.0.2.1:1234", ""); code != http.StatusUnauthorized {
+			t.Fatalf("status = %v, want %v", code, http.StatusUnauthorized)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := do("192.0.2.1:1234", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("status = %v, want %v", code, http.StatusUnauthorized)
+		}
+	}
+	if len(failures) != 3 || failures[2] != 3 {
+		t.Errorf("OnFailure calls = %v, want [1 2 3]", failures)
+	}
+
+	// Both the IP address and the username are locked out
+	if code := do("192.0.2.1:1234", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("status from locked out IP = %v, want %v", code, http.StatusTooManyRequests)
+	}
+	if code := do("198.51.100.1:1234", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("status for locked out username = %v, want %v", code, http.StatusTooManyRequests)
+	}
+}
+
+// brokenCredentialStore fails to look up the credentials of "broken".
+type brokenCredentialStore struct {
+	testCredentialStore
+}
+
+func (s brokenCredentialStore) LookupCredentials(ctx context.Context, username string) (string, []Credential, error) {
+	if username == "broken" {
+		return "", nil, errors.New("store unavailable")
+	}
+	return s.testCredentialStore.LookupCredentials(ctx, username)
+}
+
+func TestLockout_successAndServerErrors(t *testing.T) {
+	h := newTestHandler(&Basic{
+		Checker: &HashChecker{
+			Store: brokenCredentialStore{testCredentialStore{
+				"alice": []Credential{{Hash: []byte("hash:secret")}},
+				"bob":   []Credential{{Hash: []byte("hash:secret")}},
+			}},
+			Compare: compareTestHash,
+		},
+	})
+	h.AttemptTracker = &Lockout{MaxFailures: 3}
+
+	do := func(remoteAddr, username, password string) int {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Logging in with a valid account doesn't reset the failures of the IP
+	// address
+	for i := 0; i < 3; i++ {
+		if code := do("192.0.2.1:1234", "bob", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("status = %v, want %v", code, http.StatusUnauthorized)
+		}
+		do("192.0.2.1:1234", "alice", "secret")
+	}
+	if code := do("192.0.2.1:1234", "bob", "wrong"); code != http.StatusTooManyRequests {
+		t.Errorf("status after interleaved successes = %v, want %v", code, http.StatusTooManyRequests)
+	}
+
+	// Store errors aren't failed attempts
+	for i := 0; i < 5; i++ {
+		if code := do("198.51.100.1:1234", "broken", "secret"); code != http.StatusInternalServerError {
+			t.Fatalf("status with store error = %v, want %v", code, http.StatusInternalServerError)
+		}
+	}
+	if code := do("198.51.100.1:1234", "alice", "secret"); code != http.StatusOK {
+		t.Errorf("status after store errors = %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestLockout_concurrent(t *testing.T) {
+	lockout := &Lockout{MaxFailures: 3}
+	attempt := &Attempt{RemoteIP: "192.0.2.1", Username: "alice"}
+
+	// Attempts checked before the previous ones have failed are accounted
+	// for
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lockout.Check(context.Background(), attempt); err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("%v concurrent attempts allowed, want 3", allowed)
+	}
+
+	lockout.Succeeded(context.Background(), attempt)
+	if err := lockout.Check(context.Background(), attempt); err != nil {
+		t.Errorf("Check() after success = %v", err)
+	}
+}
+
+type testTokenChecker map[string]string
+
+func (c testTokenChecker) CheckToken(ctx context.Context, token string) (*Identity, error) {
+	principal, ok := c[token]
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusUnauthorized, nil)
+	}
+	return &Identity{Principal: principal}, nil
+}
+
+func TestBearer(t *testing.T) {
+	h := newTestHandler(&Bearer{
+		Realm:   "DAV",
+		Checker: testTokenChecker{"s3cr3t": "/principals/alice/"},
+	})
+
+	for _, tc := range []struct {
+		name, authorization string
+		code                int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"basic", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized},
+		{"invalid token", "Bearer wrong", http.StatusUnauthorized},
+		{"valid token", "Bearer s3cr3t", http.StatusOK},
+		{"lower-case scheme", "bearer s3cr3t", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("PROPFIND", "/", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.code {
+				t.Errorf("status = %v, want %v", w.Code, tc.code)
+			}
+			if tc.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Bearer realm="DAV"` {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+			if tc.code == http.StatusOK && w.Body.String() != "/principals/alice/" {
+				t.Errorf("principal = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+type testDigestStore map[string]string
+
+func (s testDigestStore) LookupDigest(ctx context.Context, username, realm, algorithm string) (string, string, error) {
+	password, ok := s[username]
+	if !ok {
+		return "", "", nil
+	}
+	return "/principals/" + username + "/", DigestHash(algorithm, username, realm, password), nil
+}
+
+func TestDigest(t *testing.T) {
+	for _, algorithm := range []string{DigestMD5, DigestSHA256} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := newTestHandler(&Digest{
+				Realm:     "DAV",
+				Store:     testDigestStore{"alice": "secret"},
+				Algorithm: algorithm,
+			})
+
+			req := httptest.NewRequest("PROPFIND", "/calendars/", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status without credentials = %v, want %v", w.Code, http.StatusUnauthorized)
+			}
+			scheme, challenge := internal.ParseAuthorization(w.Header().Get("WWW-Authenticate"))
+			params, err := internal.ParseAuthParams(challenge)
+			if err != nil || scheme != "Digest" {
+				t.Fatalf("invalid challenge %q: %v", w.Header().Get("WWW-Authenticate"), err)
+			}
+			if params["algorithm"] != algorithm || params["qop"] != "auth" || params["realm"] != "DAV" {
+				t.Errorf("unexpected challenge parameters: %v", params)
+			}
+
+			authorize := func(password, nonce, nc string) int {
+				ha1 := DigestHash(algorithm, "alice", "DAV", password)
+				ha2 := internal.DigestHash(algorithm, "PROPFIND:/calendars/")
+				response := internal.DigestHash(algorithm, ha1+":"+nonce+":"+nc+":0a4f113b:auth:"+ha2)
+				req := httptest.NewRequest("PROPFIND", "/calendars/", nil)
+				req.Header.Set("Authorization", fmt.Sprintf(`Digest username="alice", realm="DAV", nonce="%v", uri="/calendars/", algorithm=%v, qop=auth, nc=%v, cnonce="0a4f113b", response="%v"`, nonce, algorithm, nc, response))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code == http.StatusOK && w.Body.String() != "/principals/alice/" {
+					t.Errorf("principal = %q", w.Body.String())
+				}
+				return w.Code
+			}
+			if code := authorize("secret", params["nonce"], "00000001"); code != http.StatusOK {
+				t.Errorf("status with valid credentials = %v, want %v", code, http.StatusOK)
+			}
+			if code := authorize("wrong", params["nonce"], "00000002"); code != http.StatusUnauthorized {
+				t.Errorf("status with wrong password = %v, want %v", code, http.StatusUnauthorized)
+			}
+			if code := authorize("secret", params["nonce"], "00000001"); code != http.StatusUnauthorized {
+				t.Errorf("status with replayed nonce count = %v, want %v", code, http.StatusUnauthorized)
+			}
+			if code := authorize("secret", params["nonce"], "00000002"); code != http.StatusOK {
+				t.Errorf("status with incremented nonce count = %v, want %v", code, http.StatusOK)
+			}
+			if code := authorize("secret", "forged", "00000001"); code != http.StatusUnauthorized {
+				t.Errorf("status with forged nonce = %v, want %v", code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestDigest_staleNonce(t *testing.T) {
+	h := newTestHandler(&Digest{
+		Realm:         "DAV",
+		Store:         testDigestStore{"alice": "secret"},
+		NonceLifetime: time.Nanosecond,
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PROPFIND", "/", nil))
+	_, challenge := internal.ParseAuthorization(w.Header().Get("WWW-Authenticate"))
+	params, err := internal.ParseAuthParams(challenge)
+	if err != nil {
+		t.Fatalf("invalid challenge %q: %v", w.Header().Get("WWW-Authenticate"), err)
+	}
+
+	authorize := func(password string) *httptest.ResponseRecorder {
+		ha1 := DigestHash(DigestMD5, "alice", "DAV", password)
+		ha2 := internal.DigestHash(DigestMD5, "PROPFIND:/")
+		response := internal.DigestHash(DigestMD5, ha1+":"+params["nonce"]+":00000001:0a4f113b:auth:"+ha2)
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.Header.Set("Authorization", fmt.Sprintf(`Digest username="alice", realm="DAV", nonce="%v", uri="/", qop=auth, nc=00000001, cnonce="0a4f113b", response="%v"`, params["nonce"], response))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Valid credentials with an expired nonce get a stale challenge, so that
+	// clients don't prompt the user again
+	w = authorize("secret")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("expired nonce = %v, WWW-Authenticate %q, want stale challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	w = authorize("wrong")
+	if w.Code != http.StatusUnauthorized || strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("expired nonce with wrong password = %v, WWW-Authenticate %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestUserPrincipal(t *testing.T) {
+	h := &Handler{
+		Authenticator: &Bearer{Checker: testTokenChecker{"s3cr3t": "alice"}},
+		Next: &webdav.Handler{
+			FileSystem: webdav.LocalFileSystem(t.TempDir()),
+			UserPrincipal: UserPrincipal{Path: func(principal string) string {
+				return "/principals/" + principal + "/"
+			}},
+		},
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:current-user-principal/></d:prop></d:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if body := w.Body.String(); w.Code != http.StatusMultiStatus || !strings.Contains(body, "<href>/principals/alice/</href>") {
+		t.Errorf("PROPFIND current-user-principal = %v: %v", w.Code, body)
+	}
+}
+
+func TestDigest_client(t *testing.T) {
+	unauthorized := 0
+	h := &Handler{
+		Authenticator: &Digest{Realm: "DAV", Store: testDigestStore{"alice": "secret"}, Algorithm: DigestSHA256},
+		Next:          &webdav.Handler{FileSystem: webdav.LocalFileSystem(t.TempDir())},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			unauthorized++
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := webdav.NewClient(webdav.HTTPClientWithDigestAuth(nil, "alice", "secret"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// The body of Create can't be sent twice, so a challenge is fetched first
+	wc, err := c.Create(ctx, "/file.txt")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := wc.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if _, err := c.Stat(ctx, "/file.txt"); err != nil {
+		t.Errorf("Stat() = %v", err)
+	}
+	if unauthorized != 1 {
+		t.Errorf("%v unauthenticated requests, want 1", unauthorized)
+	}
+
+	c, err = webdav.NewClient(webdav.HTTPClientWithDigestAuth(nil, "alice", "wrong"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, "/file.txt"); err == nil {
+		t.Errorf("Stat() with wrong password succeeded")
+	}
+}
+
+type testSCRAMStore map[string]*SCRAMCredential
+
+func (s testSCRAMStore) LookupSCRAMCredential(ctx context.Context, username string) (string, *SCRAMCredential, error) {
+	return "/principals/" + username + "/", s[username], nil
+}
+
+func TestSCRAM(t *testing.T) {
+	// Test vector from RFC 7677 section 3
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	h := newTestHandler(&SCRAM{
+		Realm: "DAV",
+		Store: testSCRAMStore{"user": NewSCRAMCredential("pencil", salt, 4096)},
+	})
+
+	exchange := func(password string) (*httptest.ResponseRecorder, []byte) {
+		clientFirstBare := "n=user,r=rOprNGfwEbeRWgbNEkqO"
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.Header.Set("Authorization", "SCRAM-SHA-256 data="+base64.StdEncoding.EncodeToString([]byte("n,,"+clientFirstBare)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status after client-first-message = %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+		scheme, challenge := internal.ParseAuthorization(w.Header().Get("WWW-Authenticate"))
+		params, err := internal.ParseAuthParams(challenge)
+		if err != nil || scheme != "SCRAM-SHA-256" || params["sid"] == "" {
+			t.Fatalf("invalid challenge %q: %v", w.Header().Get("WWW-Authenticate"), err)
+		}
+		serverFirst, _ := base64.StdEncoding.DecodeString(params["data"])
+		attrs, err := parseSCRAMAttrs(string(serverFirst))
+		if err != nil || !strings.HasPrefix(attrs["r"], "rOprNGfwEbeRWgbNEkqO") || attrs["s"] != "W22ZaJ0SNY7soEsUEjb6gQ==" || attrs["i"] != "4096" {
+			t.Fatalf("invalid server-first-message %q: %v", serverFirst, err)
+		}
+
+		cred := NewSCRAMCredential(password, salt, 4096)
+		clientFinal := "c=biws,r=" + attrs["r"]
+		authMessage := clientFirstBare + "," + string(serverFirst) + "," + clientFinal
+		salted := scramHi([]byte(password), salt, 4096)
+		proof := scramHMAC(salted, "Client Key")
+		signature := scramHMAC(cred.StoredKey, authMessage)
+		for i := range proof {
+			proof[i] ^= signature[i]
+		}
+		clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+
+		req = httptest.NewRequest("PROPFIND", "/", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("SCRAM-SHA-256 sid=%v, data=%v", params["sid"], base64.StdEncoding.EncodeToString([]byte(clientFinal))))
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w, scramHMAC(cred.ServerKey, authMessage)
+	}
+
+	w, serverSignature := exchange("pencil")
+	if w.Code != http.StatusOK || w.Body.String() != "/principals/user/" {
+		t.Fatalf("status = %v, principal = %q", w.Code, w.Body.String())
+	}
+	params, err := internal.ParseAuthParams(w.Header().Get("Authentication-Info"))
+	if err != nil {
+		t.Fatalf("invalid Authentication-Info: %v", err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("v=" + base64.StdEncoding.EncodeToString(serverSignature))); params["data"] != want {
+		t.Errorf("server-final-message = %q, want %q", params["data"], want)
+	}
+
+	if w, _ := exchange("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with wrong password = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNewSCRAMCredential(t *testing.T) {
+	// Test vector from RFC 7677 section 3
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	cred := NewSCRAMCredential("pencil", salt, 4096)
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096,c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	if got, want := base64.StdEncoding.EncodeToString(scramHMAC(cred.ServerKey, authMessage)), "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="; got != want {
+		t.Errorf("server signature = %v, want %v", got, want)
+	}
+}
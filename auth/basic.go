@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// PasswordChecker checks username and password credentials.
+type PasswordChecker interface {
+	// CheckPassword returns the identity matching the credentials. Invalid
+	// credentials should be reported with a webdav.NewHTTPError error with
+	// status code 401.
+	CheckPassword(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// Basic authenticates requests with HTTP Basic authentication, as defined in
+// RFC 7617.
+type Basic struct {
+	// Realm is sent to clients in the authentication challenge.
+	Realm   string
+	Checker PasswordChecker
+}
+
+var (
+	_ Authenticator = (*Basic)(nil)
+	_ Challenger    = (*Basic)(nil)
+)
+
+// Authenticate implements Authenticator.
+func (a *Basic) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: missing credentials")
+	}
+	return a.Checker.CheckPassword(r.Context(), username, password)
+}
+
+// Challenge implements Challenger.
+func (a *Basic) Challenge() string {
+	return "Basic realm=" + strconv.Quote(a.Realm) + `, charset="UTF-8"`
+}
+
+// Credential is a stored credential of a user, e.g. their primary password or
+// an app-specific password.
+type Credential struct {
+	// Hash is the password hash, checked with HashChecker.Compare.
+	Hash []byte
+	// Scope restricts the requests allowed when authenticating with this
+	// credential. If nil, the credential grants full access.
+	Scope *Scope
+}
+
+// CredentialStore looks up stored credentials.
+type CredentialStore interface {
+	// LookupCredentials returns the principal and the credentials of a
+	// user. Unknown users should be reported with an empty list of
+	// credentials.
+	LookupCredentials(ctx context.Context, username string) (principal string, creds []Credential, err error)
+}
+
+// HashChecker is a PasswordChecker verifying passwords against hashed
+// credentials. Multiple credentials may be stored for a single user, e.g. to
+// issue scoped app-specific passwords. It can be used with bcrypt:
+//
+//	checker := &auth.HashChecker{
+//		Store:   store,
+//		Compare: bcrypt.CompareHashAndPassword,
+//	}
+type HashChecker struct {
+	Store CredentialStore
+	// Compare returns a nil error if the password matches the hash.
+	Compare func(hash, password []byte) error
+}
+
+var _ PasswordChecker = (*HashChecker)(nil)
+
+// CheckPassword implements PasswordChecker.
+func (c *HashChecker) CheckPassword(ctx context.Context, username, password string) (*Identity, error) {
+	principal, creds, err := c.Store.LookupCredentials(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cred := range creds {
+		if c.Compare(cred.Hash, []byte(password)) == nil {
+			return &Identity{Principal: principal, Scope: cred.Scope}, nil
+		}
+	}
+	return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TokenChecker checks bearer tokens, e.g. OAuth 2.0 access tokens.
+type TokenChecker interface {
+	// CheckToken returns the identity the token has been issued to. Invalid
+	// or expired tokens should be reported with a webdav.NewHTTPError error
+	// with status code 401.
+	CheckToken(ctx context.Context, token string) (*Identity, error)
+}
+
+// Bearer authenticates requests with bearer tokens, as defined in RFC 6750.
+type Bearer struct {
+	// Realm is sent to clients in the authentication challenge.
+	Realm   string
+	Checker TokenChecker
+}
+
+var (
+	_ Authenticator = (*Bearer)(nil)
+	_ Challenger    = (*Bearer)(nil)
+)
+
+// Authenticate implements Authenticator.
+func (a *Bearer) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, token := internal.ParseAuthorization(r.Header.Get("Authorization"))
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: missing bearer token")
+	}
+	return a.Checker.CheckToken(r.Context(), token)
+}
+
+// Challenge implements Challenger.
+func (a *Bearer) Challenge() string {
+	return "Bearer realm=" + strconv.Quote(a.Realm)
+}
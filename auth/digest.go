@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Digest algorithms, as defined in RFC 7616 section 3.3.
+const (
+	DigestMD5    = "MD5"
+	DigestSHA256 = "SHA-256"
+)
+
+const defaultNonceLifetime = time.Hour
+
+// DigestStore looks up the credentials of users authenticating with HTTP
+// Digest authentication.
+type DigestStore interface {
+	// LookupDigest returns the principal of a user and the hash of their
+	// credentials for the given realm and algorithm, as computed by
+	// DigestHash. Unknown users should be reported with an empty hash.
+	LookupDigest(ctx context.Context, username, realm, algorithm string) (principal, hash string, err error)
+}
+
+// DigestHash computes the hash of a user's credentials for HTTP Digest
+// authentication. It can be stored instead of the password.
+func DigestHash(algorithm, username, realm, password string) string {
+	return internal.DigestHash(algorithm, username+":"+realm+":"+password)
+}
+
+// Digest authenticates requests with HTTP Digest authentication, as defined
+// in RFC 7616. Only the "auth" quality of protection is supported.
+//
+// The highest nonce count used with each nonce is kept in memory, so that
+// replayed requests are rejected: clients must increment the nonce count for
+// each request reusing a nonce.
+type Digest struct {
+	// Realm is sent to clients in the authentication challenge.
+	Realm string
+	Store DigestStore
+	// Algorithm is either DigestMD5 or DigestSHA256. If empty, DigestMD5 is
+	// used, since it's supported by the most clients.
+	Algorithm string
+	// NonceLifetime is the duration for which a nonce is accepted. If zero,
+	// nonces expire after an hour.
+	NonceLifetime time.Duration
+
+	secretOnce sync.Once
+	secret     [32]byte
+	secretErr  error
+
+	mu          sync.Mutex
+	nonceCounts map[string]uint64
+	nextSweep   int
+}
+
+var (
+	_ Authenticator = (*Digest)(nil)
+	_ Challenger    = (*Digest)(nil)
+)
+
+func (a *Digest) algorithm() string {
+	if a.Algorithm == "" {
+		return DigestMD5
+	}
+	return a.Algorithm
+}
+
+// nonceMAC authenticates a nonce timestamp, so that nonces don't need to be
+// stored.
+func (a *Digest) nonceMAC(ts []byte) ([]byte, error) {
+	a.secretOnce.Do(func() {
+		_, a.secretErr = rand.Read(a.secret[:])
+	})
+	if a.secretErr != nil {
+		return nil, a.secretErr
+	}
+	mac := hmac.New(sha256.New, a.secret[:])
+	mac.Write(ts)
+	return mac.Sum(nil)[:16], nil
+}
+
+func (a *Digest) newNonce() (string, error) {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().Unix()))
+	mac, err := a.nonceMAC(ts[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(ts[:], mac...)), nil
+}
+
+// checkNonce reports whether a nonce has been issued by a, and whether it
+// has expired since.
+func (a *Digest) checkNonce(nonce string) (valid, expired bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+16 {
+		return false, false
+	}
+	mac, err := a.nonceMAC(b[:8])
+	if err != nil || !hmac.Equal(mac, b[8:]) {
+		return false, false
+	}
+
+	lifetime := a.NonceLifetime
+	if lifetime == 0 {
+		lifetime = defaultNonceLifetime
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return true, time.Since(t) >= lifetime
+}
+
+// useNonceCount records the nonce count of a request, and reports whether it's
+// higher than the nonce counts of the previous requests using the same nonce.
+func (a *Digest) useNonceCount(nonce, nc string) bool {
+	n, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || len(nc) != 8 {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nonceCounts == nil {
+		a.nonceCounts = make(map[string]uint64)
+	}
+	if len(a.nonceCounts) >= a.nextSweep {
+		for k := range a.nonceCounts {
+			if valid, expired := a.checkNonce(k); !valid || expired {
+				delete(a.nonceCounts, k)
+			}
+		}
+		a.nextSweep = 2*len(a.nonceCounts) + 1024
+	}
+	if prev, ok := a.nonceCounts[nonce]; ok && n <= prev {
+		return false
+	}
+	a.nonceCounts[nonce] = n
+	return true
+}
+
+// Authenticate implements Authenticator.
+func (a *Digest) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials := internal.ParseAuthorization(r.Header.Get("Authorization"))
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: missing credentials")
+	}
+	params, err := internal.ParseAuthParams(credentials)
+	if err != nil {
+		return nil, &internal.HTTPError{Code: http.StatusBadRequest, Err: err}
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = DigestMD5
+	}
+	validNonce, expiredNonce := a.checkNonce(params["nonce"])
+	switch {
+	case !strings.EqualFold(algorithm, a.algorithm()):
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: unsupported digest algorithm %q", algorithm)
+	case params["qop"] != "auth":
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: unsupported digest qop %q", params["qop"])
+	case params["realm"] != a.Realm:
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid digest realm")
+	case !validNonce:
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid digest nonce")
+	case params["uri"] != r.RequestURI:
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: digest URI doesn't match the request")
+	}
+
+	principal, ha1, err := a.Store.LookupDigest(r.Context(), params["username"], a.Realm, a.algorithm())
+	if err != nil {
+		return nil, err
+	} else if ha1 == "" {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+	}
+
+	ha2 := internal.DigestHash(algorithm, r.Method+":"+params["uri"])
+	want := internal.DigestHash(algorithm, strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(params["response"]))) != 1 {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+	}
+	if expiredNonce {
+		// RFC 7616 section 3.3: the credentials are valid, so the client
+		// can retry with a new nonce without prompting the user
+		return nil, &ChallengeError{
+			Challenge: a.challenge(true),
+			Err:       internal.HTTPErrorf(http.StatusUnauthorized, "webdav: expired digest nonce"),
+		}
+	}
+	// Checked last, so that requests with invalid credentials can't use up
+	// nonce counts
+	if !a.useNonceCount(params["nonce"], params["nc"]) {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: replayed digest nonce count")
+	}
+	return &Identity{Principal: principal}, nil
+}
+
+// Challenge implements Challenger.
+func (a *Digest) Challenge() string {
+	return a.challenge(false)
+}
+
+func (a *Digest) challenge(stale bool) string {
+	nonce, err := a.newNonce()
+	if err != nil {
+		// Clients can't authenticate without a nonce, fall back to an
+		// unusable one
+		nonce = ""
+	}
+	challenge := fmt.Sprintf(`Digest realm=%v, qop="auth", algorithm=%v, nonce=%v`, strconv.Quote(a.Realm), a.algorithm(), strconv.Quote(nonce))
+	if stale {
+		challenge += ", stale=true"
+	}
+	return challenge
+}
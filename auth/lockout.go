@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Attempt describes an authentication attempt.
+type Attempt struct {
+	// RemoteIP is the IP address of the client.
+	RemoteIP string
+	// Username is the username supplied by the client, if any.
+	Username string
+}
+
+func newAttempt(r *http.Request) *Attempt {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	username, _, ok := r.BasicAuth()
+	if scheme, credentials := internal.ParseAuthorization(r.Header.Get("Authorization")); !ok && strings.EqualFold(scheme, "Digest") {
+		params, _ := internal.ParseAuthParams(credentials)
+		username = params["username"]
+	}
+	return &Attempt{RemoteIP: ip, Username: username}
+}
+
+// AttemptTracker is notified of authentication attempts, e.g. to protect
+// against brute-force attacks.
+type AttemptTracker interface {
+	// Check is called before authenticating a request carrying credentials.
+	// Returning an error rejects the request.
+	Check(ctx context.Context, attempt *Attempt) error
+	// Failed is called when authentication fails because of invalid
+	// credentials.
+	Failed(ctx context.Context, attempt *Attempt)
+	// Succeeded is called when authentication succeeds.
+	Succeeded(ctx context.Context, attempt *Attempt)
+}
+
+// AttemptAborter is an optional interface which can be implemented by an
+// AttemptTracker to be notified of attempts which neither succeeded nor
+// failed, because of a server error, e.g. from a credential store.
+type AttemptAborter interface {
+	Aborted(ctx context.Context, attempt *Attempt)
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// Lockout is an in-memory AttemptTracker which locks out IP addresses and
+// usernames after too many consecutive failed authentication attempts.
+//
+// Attempts are counted as failures when they're checked and forgiven when
+// they succeed or abort because of a server error, so that concurrent attempts
+// can't exceed MaxFailures. A successful attempt only resets the failures of
+// its username: the failures of its IP address are kept, so that a client
+// holding valid credentials can't keep guessing other users' passwords.
+// Attempts failing for other reasons than invalid credentials, e.g. malformed
+// credentials, count as failures as well.
+type Lockout struct {
+	// MaxFailures is the number of consecutive failures after which an IP
+	// address or username is locked out. Zero disables lockouts.
+	MaxFailures int
+	// Duration is the time after which failures are forgotten. If zero, 15
+	// minutes is used.
+	Duration time.Duration
+	// Delay, if non-zero, slows down responses to failed attempts.
+	Delay time.Duration
+	// OnFailure, if set, is called after each failed attempt with the number
+	// of consecutive failures for the attempt's IP address and username.
+	OnFailure func(attempt *Attempt, ipFailures, userFailures int)
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry
+	nextSweep int
+}
+
+var (
+	_ AttemptTracker = (*Lockout)(nil)
+	_ AttemptAborter = (*Lockout)(nil)
+)
+
+func lockoutKeys(attempt *Attempt) (ipKey, userKey string) {
+	ipKey = "ip:" + attempt.RemoteIP
+	if attempt.Username != "" {
+		userKey = "user:" + attempt.Username
+	}
+	return ipKey, userKey
+}
+
+func (l *Lockout) duration() time.Duration {
+	if l.Duration == 0 {
+		return 15 * time.Minute
+	}
+	return l.Duration
+}
+
+// failures returns the number of recent consecutive failures for a key. The
+// lock must be held.
+func (l *Lockout) failures(key string, now time.Time) int {
+	if key == "" {
+		return 0
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(entry.lastFailure) > l.duration() {
+		delete(l.entries, key)
+		return 0
+	}
+	return entry.failures
+}
+
+// sweep removes expired entries. The lock must be held.
+func (l *Lockout) sweep(now time.Time) {
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastFailure) > l.duration() {
+			delete(l.entries, key)
+		}
+	}
+	l.nextSweep = 2*len(l.entries) + 1024
+}
+
+// Check implements AttemptTracker.
+func (l *Lockout) Check(ctx context.Context, attempt *Attempt) error {
+	ipKey, userKey := lockoutKeys(attempt)
+	now := time.Now()
+
+	// The failure count is checked and incremented under the same lock, so
+	// that concurrent attempts are all accounted for
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.MaxFailures > 0 && (l.failures(ipKey, now) >= l.MaxFailures || l.failures(userKey, now) >= l.MaxFailures) {
+		return internal.HTTPErrorf(http.StatusTooManyRequests, "webdav: too many failed authentication attempts")
+	}
+
+	if l.entries == nil {
+		l.entries = make(map[string]*lockoutEntry)
+	}
+	if len(l.entries) >= l.nextSweep {
+		l.sweep(now)
+	}
+	for _, key := range []string{ipKey, userKey} {
+		if key != "" {
+			l.entries[key] = &lockoutEntry{failures: l.failures(key, now) + 1, lastFailure: now}
+		}
+	}
+	return nil
+}
+
+// Failed implements AttemptTracker.
+func (l *Lockout) Failed(ctx context.Context, attempt *Attempt) {
+	ipKey, userKey := lockoutKeys(attempt)
+	now := time.Now()
+
+	// The failure has already been counted by Check
+	l.mu.Lock()
+	counts := [2]int{l.failures(ipKey, now), l.failures(userKey, now)}
+	l.mu.Unlock()
+
+	if l.OnFailure != nil {
+		l.OnFailure(attempt, counts[0], counts[1])
+	}
+
+	if l.Delay > 0 {
+		t := time.NewTimer(l.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Succeeded implements AttemptTracker.
+func (l *Lockout) Succeeded(ctx context.Context, attempt *Attempt) {
+	ipKey, userKey := lockoutKeys(attempt)
+
+	l.mu.Lock()
+	l.forgive(ipKey)
+	if userKey != "" {
+		delete(l.entries, userKey)
+	}
+	l.mu.Unlock()
+}
+
+// Aborted implements AttemptAborter.
+func (l *Lockout) Aborted(ctx context.Context, attempt *Attempt) {
+	ipKey, userKey := lockoutKeys(attempt)
+
+	l.mu.Lock()
+	l.forgive(ipKey)
+	l.forgive(userKey)
+	l.mu.Unlock()
+}
+
+// forgive cancels the failure counted by Check for a key. The lock must be
+// held.
+func (l *Lockout) forgive(key string) {
+	entry, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	if entry.failures--; entry.failures <= 0 {
+		delete(l.entries, key)
+	}
+}
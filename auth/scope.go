@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Scope restricts the requests a client is allowed to make. It's typically
+// attached to app-specific passwords, e.g. to grant read-only or
+// calendar-only access.
+type Scope struct {
+	// ReadOnly only allows safe methods: GET, HEAD, OPTIONS, PROPFIND and
+	// REPORT.
+	ReadOnly bool
+	// Paths, if non-empty, restricts access to the given collections and
+	// their members, e.g. a calendar home set. Depth 0 PROPFIND and OPTIONS
+	// requests on their ancestors are allowed for service discovery.
+	Paths []string
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+		return true
+	}
+	return false
+}
+
+// isPathInside reports whether p is dir or a member of dir.
+func isPathInside(p, dir string) bool {
+	p = path.Clean(p)
+	dir = path.Clean(dir)
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+func (s *Scope) allowsPath(p string) bool {
+	if len(s.Paths) == 0 {
+		return true
+	}
+	for _, dir := range s.Paths {
+		if isPathInside(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scope) isAncestor(p string) bool {
+	for _, dir := range s.Paths {
+		if isPathInside(dir, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the request is allowed by the scope. A nil scope
+// allows all requests.
+func (s *Scope) Allows(r *http.Request) bool {
+	if s == nil {
+		return true
+	}
+
+	if s.ReadOnly && !isSafeMethod(r.Method) {
+		return false
+	}
+
+	if dest := r.Header.Get("Destination"); dest != "" {
+		u, err := url.Parse(dest)
+		if err != nil || !s.allowsPath(u.Path) {
+			return false
+		}
+	}
+
+	if s.allowsPath(r.URL.Path) {
+		return true
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		return s.isAncestor(r.URL.Path)
+	case "PROPFIND":
+		return r.Header.Get("Depth") == "0" && s.isAncestor(r.URL.Path)
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+const (
+	scramMechanism      = "SCRAM-SHA-256"
+	scramSessionTimeout = time.Minute
+	scramMaxSessions    = 4096
+)
+
+// SCRAMCredential is the credential of a user authenticating with SCRAM. It
+// can be stored instead of the password, see NewSCRAMCredential.
+type SCRAMCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+	// Scope restricts the requests allowed when authenticating with this
+	// credential. If nil, the credential grants full access.
+	Scope *Scope
+}
+
+// NewSCRAMCredential derives a SCRAM-SHA-256 credential from a password, as
+// defined in RFC 5802 section 3. The password must already be normalized
+// with SASLprep, if required. The salt should be random and at least 16 bytes
+// long, and iterations at least 4096.
+func NewSCRAMCredential(password string, salt []byte, iterations int) *SCRAMCredential {
+	salted := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// SCRAMStore looks up the credentials of users authenticating with SCRAM.
+type SCRAMStore interface {
+	// LookupSCRAMCredential returns the principal and the credential of a
+	// user. Unknown users should be reported with a nil credential.
+	LookupSCRAMCredential(ctx context.Context, username string) (principal string, cred *SCRAMCredential, err error)
+}
+
+// SCRAM authenticates requests with the HTTP SCRAM-SHA-256 mechanism, as
+// defined in RFC 7804. Channel binding isn't supported.
+//
+// The exchange takes two round-trips. The state between them is kept in
+// memory for a minute, so all requests of an exchange must be served by the
+// same SCRAM value.
+type SCRAM struct {
+	// Realm is sent to clients in the authentication challenge.
+	Realm string
+	Store SCRAMStore
+
+	mu       sync.Mutex
+	sessions map[string]*scramSession
+}
+
+type scramSession struct {
+	principal       string
+	cred            *SCRAMCredential
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	expires         time.Time
+}
+
+var (
+	_ Authenticator = (*SCRAM)(nil)
+	_ Challenger    = (*SCRAM)(nil)
+)
+
+// Authenticate implements Authenticator.
+func (a *SCRAM) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials := internal.ParseAuthorization(r.Header.Get("Authorization"))
+	if !strings.EqualFold(scheme, scramMechanism) {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: missing credentials")
+	}
+	params, err := internal.ParseAuthParams(credentials)
+	if err != nil {
+		return nil, &internal.HTTPError{Code: http.StatusBadRequest, Err: err}
+	}
+	data, err := base64.StdEncoding.DecodeString(params["data"])
+	if err != nil {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM data: %v", err)
+	}
+
+	if sid, ok := params["sid"]; ok {
+		return a.finish(sid, string(data))
+	}
+	return nil, a.start(r.Context(), string(data))
+}
+
+// start handles the client-first-message, and returns the server-first-message
+// in a ChallengeError.
+func (a *SCRAM) start(ctx context.Context, msg string) error {
+	gs2Header, bare, err := splitSCRAMGS2Header(msg)
+	if err != nil {
+		return err
+	}
+	attrs, err := parseSCRAMAttrs(bare)
+	if err != nil {
+		return err
+	}
+	username, err := unescapeSCRAMName(attrs["n"])
+	if err != nil {
+		return err
+	}
+	clientNonce := attrs["r"]
+	if username == "" || clientNonce == "" {
+		return internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM client-first-message")
+	}
+
+	principal, cred, err := a.Store.LookupSCRAMCredential(ctx, username)
+	if err != nil {
+		return err
+	} else if cred == nil {
+		return internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+	}
+
+	serverNonce, err := scramRandom(18)
+	if err != nil {
+		return err
+	}
+	sid, err := scramRandom(12)
+	if err != nil {
+		return err
+	}
+	nonce := clientNonce + serverNonce
+	serverFirst := fmt.Sprintf("r=%v,s=%v,i=%v", nonce, base64.StdEncoding.EncodeToString(cred.Salt), cred.Iterations)
+
+	a.mu.Lock()
+	if a.sessions == nil {
+		a.sessions = make(map[string]*scramSession)
+	}
+	now := time.Now()
+	for k, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	full := len(a.sessions) >= scramMaxSessions
+	if !full {
+		a.sessions[sid] = &scramSession{
+			principal:       principal,
+			cred:            cred,
+			gs2Header:       gs2Header,
+			clientFirstBare: bare,
+			serverFirst:     serverFirst,
+			nonce:           nonce,
+			expires:         now.Add(scramSessionTimeout),
+		}
+	}
+	a.mu.Unlock()
+	if full {
+		return internal.HTTPErrorf(http.StatusServiceUnavailable, "webdav: too many pending SCRAM exchanges")
+	}
+
+	challenge := fmt.Sprintf("%v sid=%v, data=%v", scramMechanism, sid, base64.StdEncoding.EncodeToString([]byte(serverFirst)))
+	return &ChallengeError{Challenge: challenge}
+}
+
+// finish handles the client-final-message.
+func (a *SCRAM) finish(sid, msg string) (*Identity, error) {
+	a.mu.Lock()
+	s := a.sessions[sid]
+	// Sessions are single-use
+	delete(a.sessions, sid)
+	a.mu.Unlock()
+	if s == nil || time.Now().After(s.expires) {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: unknown or expired SCRAM session")
+	}
+
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM client-final-message")
+	}
+	withoutProof := msg[:i]
+	attrs, err := parseSCRAMAttrs(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM proof")
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs["r"] != s.nonce {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: SCRAM channel binding or nonce mismatch")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(s.cred.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.cred.StoredKey) != 1 {
+		return nil, internal.HTTPErrorf(http.StatusUnauthorized, "webdav: invalid credentials")
+	}
+
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(s.cred.ServerKey, authMessage))
+	return &Identity{
+		Principal:          s.principal,
+		Scope:              s.cred.Scope,
+		AuthenticationInfo: fmt.Sprintf("sid=%v, data=%v", sid, base64.StdEncoding.EncodeToString([]byte(serverFinal))),
+	}, nil
+}
+
+// Challenge implements Challenger.
+func (a *SCRAM) Challenge() string {
+	return scramMechanism + " realm=" + strconv.Quote(a.Realm)
+}
+
+// splitSCRAMGS2Header splits a client-first-message into its GS2 header and
+// the client-first-message-bare.
+func splitSCRAMGS2Header(msg string) (header, bare string, err error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return "", "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM client-first-message")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+		// No channel binding
+	case strings.HasPrefix(parts[0], "p="):
+		return "", "", internal.HTTPErrorf(http.StatusUnauthorized, "webdav: SCRAM channel binding is unsupported")
+	default:
+		return "", "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM GS2 header")
+	}
+	if parts[1] != "" {
+		return "", "", internal.HTTPErrorf(http.StatusUnauthorized, "webdav: SCRAM authorization identities are unsupported")
+	}
+	return parts[0] + "," + parts[1] + ",", parts[2], nil
+}
+
+func parseSCRAMAttrs(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM attribute %q", attr)
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+func unescapeSCRAMName(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			sb.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			sb.WriteByte('=')
+		default:
+			return "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: malformed SCRAM username")
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+func scramRandom(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func scramHMAC(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// scramHi is the Hi function defined in RFC 5802 section 2.2, i.e. PBKDF2
+// with a single output block.
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], 1)
+	mac.Write(salt)
+	mac.Write(idx[:])
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for n := 1; n < iterations; n++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range result {
+			result[i] ^= u[i]
+		}
+	}
+	return result
+}
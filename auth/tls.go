@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TLSClientCertificate authenticates requests with a verified TLS client
+// certificate. The TLS server must be configured to verify client
+// certificates, e.g. with tls.RequireAndVerifyClientCert: unverified
+// certificates are rejected.
+type TLSClientCertificate struct {
+	// Principal maps a verified client certificate to a principal. Unknown
+	// certificates should be rejected with a webdav.NewHTTPError error with
+	// status code 403. If nil, the certificate subject's common name is used.
+	Principal func(cert *x509.Certificate) (string, error)
+}
+
+var _ Authenticator = (*TLSClientCertificate)(nil)
+
+// Authenticate implements Authenticator.
+func (a *TLSClientCertificate) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: verified TLS client certificate required")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	if a.Principal == nil {
+		if cert.Subject.CommonName == "" {
+			return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: TLS client certificate has no common name")
+		}
+		return &Identity{Principal: cert.Subject.CommonName}, nil
+	}
+
+	principal, err := a.Principal(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Principal: principal}, nil
+}
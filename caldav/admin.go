@@ -0,0 +1,122 @@
+package caldav
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// AdminCalendar describes a calendar in an AdminReport.
+type AdminCalendar struct {
+	Path                  string   `json:"path"`
+	Name                  string   `json:"name,omitempty"`
+	Description           string   `json:"description,omitempty"`
+	SupportedComponentSet []string `json:"supported_component_set,omitempty"`
+	ObjectCount           int      `json:"object_count"`
+	// SyncToken is only reported if the backend implements SyncBackend.
+	SyncToken string `json:"sync_token,omitempty"`
+}
+
+// AdminReport describes the calendars of the current user principal.
+type AdminReport struct {
+	Principal           string          `json:"principal"`
+	CalendarHomeSetPath string          `json:"calendar_home_set"`
+	Calendars           []AdminCalendar `json:"calendars"`
+}
+
+// NewAdminReport inspects the calendars of the current user principal using
+// the backend.
+func NewAdminReport(ctx context.Context, backend Backend) (*AdminReport, error) {
+	principal, err := backend.CurrentUserPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	homeSet, err := backend.CalendarHomeSetPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cals, err := backend.ListCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AdminReport{
+		Principal:           principal,
+		CalendarHomeSetPath: homeSet,
+		Calendars:           make([]AdminCalendar, 0, len(cals)),
+	}
+	for _, cal := range cals {
+		objs, err := backend.ListCalendarObjects(ctx, cal.Path, &CalendarCompRequest{})
+		if err != nil {
+			return nil, err
+		}
+		var syncToken string
+		if sb, ok := optionalBackend(backend).(SyncBackend); ok {
+			if syncToken, err = sb.CalendarSyncToken(ctx, cal.Path); err != nil {
+				return nil, err
+			}
+		}
+		report.Calendars = append(report.Calendars, AdminCalendar{
+			Path:                  cal.Path,
+			Name:                  cal.Name,
+			Description:           cal.Description,
+			SupportedComponentSet: cal.SupportedComponentSet,
+			ObjectCount:           len(objs),
+			SyncToken:             syncToken,
+		})
+	}
+	return report, nil
+}
+
+// AdminHandler serves a read-only JSON report of the calendars of the current
+// user principal, to let operators inspect the state of a backend.
+//
+// The backend is queried with the request context, so AdminHandler should be
+// wrapped with the same authentication middleware as Handler and must not be
+// exposed to untrusted users.
+//
+// Backends can't enumerate principals, so the report only covers the principal
+// of the request. The calendars of other principals can be inspected by
+// authenticating as them. Handler doesn't support locks, so none are reported.
+type AdminHandler struct {
+	Backend Backend
+	// ErrorLog and ErrorVerbosity are used like the Handler fields of the
+	// same name.
+	ErrorLog       *log.Logger
+	ErrorVerbosity webdav.ErrorVerbosity
+}
+
+func (h *AdminHandler) errorReporter() *internal.ErrorReporter {
+	return &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(h.ErrorVerbosity),
+		Logger:    h.ErrorLog,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	errs := h.errorReporter()
+	if h.Backend == nil {
+		errs.ServeError(w, r, internal.HTTPErrorf(http.StatusInternalServerError, "caldav: no backend available"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		errs.ServeError(w, r, internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: unsupported method"))
+		return
+	}
+
+	report, err := NewAdminReport(r.Context(), h.Backend)
+	if err != nil {
+		errs.ServeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
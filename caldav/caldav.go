@@ -69,6 +69,62 @@ type Calendar struct {
 	Description           string
 	MaxResourceSize       int64
 	SupportedComponentSet []string
+	// Color is the color of the calendar in user interfaces, e.g.
+	// "#FF0000" or "#FF0000FF".
+	Color string
+	// Order is the position of the calendar in user interfaces, lower
+	// values first. Zero means unspecified.
+	Order int
+	// Timezone is an iCalendar object containing the VTIMEZONE of the
+	// calendar, as defined in RFC 4791 section 5.2.2.
+	Timezone string
+	// SupportedCalendarData lists the media types accepted for calendar
+	// objects. It defaults to iCalendar 2.0.
+	SupportedCalendarData []CalendarDataType
+	// Encrypted marks a calendar whose objects are end-to-end encrypted by
+	// clients: they only carry minimal metadata, such as a UID, along with
+	// an opaque payload. Objects must still be valid iCalendar data wrapping
+	// the payload, e.g. in an extended property, but they are stored as is:
+	// Transforms, MaintainSequence and scheduling don't apply, and
+	// calendar-query filters aren't evaluated, all objects are returned
+	// instead. Backends implementing RawBackend store them byte-exactly.
+	// Clients can set it when creating a calendar.
+	Encrypted bool
+	// CTag is the CalendarServer collection tag, which changes whenever a
+	// calendar object is created, updated or deleted. Clients use it to
+	// check whether a calendar changed since they last fetched it. If
+	// empty and the Backend implements SyncBackend, Handler uses the sync
+	// token instead.
+	CTag string
+}
+
+// CalendarUpdate describes changes to the properties of a calendar. Nil
+// fields are left unchanged, empty values remove the property.
+type CalendarUpdate struct {
+	Name        *string
+	Description *string
+	Color       *string
+}
+
+// CalendarDataType is a media type of calendar objects, as defined in RFC
+// 4791 section 9.6, e.g. iCalendar 2.0.
+type CalendarDataType struct {
+	ContentType string
+	Version     string
+}
+
+// SupportsCalendarData reports whether objects of the given media type can be
+// stored in the calendar.
+func (cal *Calendar) SupportsCalendarData(contentType, version string) bool {
+	if len(cal.SupportedCalendarData) == 0 {
+		return contentType == ical.MIMEType && version == "2.0"
+	}
+	for _, t := range cal.SupportedCalendarData {
+		if t.ContentType == contentType && t.Version == version {
+			return true
+		}
+	}
+	return false
 }
 
 type CalendarCompRequest struct {
@@ -79,6 +135,17 @@ type CalendarCompRequest struct {
 
 	AllComps bool
 	Comps    []CalendarCompRequest
+
+	// Expand requests recurring components to be expanded into their
+	// instances. It's only used at the top level.
+	Expand *CalendarExpandRequest
+}
+
+// CalendarExpandRequest requests recurring components to be expanded into
+// the instances overlapping a time range, as defined in RFC 4791 section
+// 9.6.5.
+type CalendarExpandRequest struct {
+	Start, End time.Time
 }
 
 type CompFilter struct {
@@ -106,6 +173,7 @@ type PropFilter struct {
 type TextMatch struct {
 	Text            string
 	NegateCondition bool
+	Collation       string // defaults to "i;ascii-casemap"
 }
 
 type CalendarQuery struct {
@@ -118,10 +186,45 @@ type CalendarMultiGet struct {
 	CompRequest CalendarCompRequest
 }
 
+// SyncQuery is a sync-collection request, as defined in RFC 6578.
+type SyncQuery struct {
+	// CompRequest, if its Name is set, requests the calendar data of updated
+	// objects. Otherwise, only their metadata is returned.
+	CompRequest CalendarCompRequest
+	SyncToken   string
+	Limit       int // <= 0 means unlimited
+}
+
+// SyncResponse contains the changes returned by a sync-collection request.
+type SyncResponse struct {
+	// SyncToken is the sync token to use for the next request.
+	SyncToken string
+	Updated   []CalendarObject
+	Deleted   []string
+	// Truncated is set if the server didn't return all changes, e.g. because
+	// of the query limit. The remaining changes can be fetched by repeating
+	// the query with the returned SyncToken.
+	Truncated bool
+}
+
 type CalendarObject struct {
 	Path          string
 	ModTime       time.Time
 	ContentLength int64
 	ETag          string
 	Data          *ical.Calendar
+
+	// DownloadName is an optional file name suggested to user agents
+	// downloading the object, sent in the Content-Disposition header.
+	DownloadName string
+}
+
+// RawCalendarObject is a calendar object as raw iCalendar data, e.g. for proxies and
+// backup tools which need to round-trip objects byte-exactly.
+type RawCalendarObject struct {
+	Path        string
+	ModTime     time.Time
+	ETag        string
+	ContentType string
+	Data        []byte
 }
@@ -0,0 +1,54 @@
+package caldav
+
+import (
+	"github.com/emersion/go-webdav"
+)
+
+// Capabilities describes the features enabled by the Handler's configuration
+// and the optional interfaces implemented by its Backend.
+func (h *Handler) Capabilities() *webdav.Capabilities {
+	caps := webdav.NewCapabilities()
+	caps.Compliance = append(caps.Compliance, "calendar-access")
+
+	_, hasScheduling := h.Backend.(SchedulingBackend)
+	_, hasSync := optionalBackend(h.Backend).(SyncBackend)
+	_, hasSharing := optionalBackend(h.Backend).(SharingBackend)
+	_, hasTimezones := optionalBackend(h.Backend).(TimezoneBackend)
+	_, hasTransactions := h.Backend.(TransactionBackend)
+	_, hasRaw := h.Backend.(RawBackend)
+	_, hasCreator := calendarCreator(h.Backend)
+	_, hasResolver := optionalBackend(h.Backend).(ObjectPathResolver)
+	if hasScheduling {
+		caps.Compliance = append(caps.Compliance, "calendar-auto-schedule")
+	}
+	caps.AddFeature(hasScheduling, "scheduling")
+	caps.AddFeature(hasSync, "sync-collection")
+	caps.AddFeature(hasSharing, "sharing")
+	caps.AddFeature(hasTimezones, "timezone-service")
+	caps.AddFeature(hasTransactions, "transactions")
+	caps.AddFeature(hasRaw, "raw-objects")
+	caps.AddFeature(hasCreator, "mkcalendar")
+	// MOVE falls back to copying and deleting objects without MoveBackend
+	caps.AddFeature(true, "move")
+	caps.AddFeature(hasResolver, "object-path-resolver")
+	caps.AddFeature(h.IdempotencyStore != nil, "idempotency")
+	caps.AddFeature(h.AuditSink != nil, "audit")
+	caps.AddFeature(h.Visibility != nil, "visibility")
+	caps.AddFeature(h.Listing != nil, "listing")
+	caps.AddFeature(len(h.Overrides) > 0, "overrides")
+	caps.AddFeature(len(h.Transforms) > 0, "transforms")
+	caps.AddFeature(h.MaintainSequence, "maintain-sequence")
+	caps.AddFeature(h.SortResponses, "sorted-responses")
+
+	caps.AddLimit("max-instances", maxRecurrenceInstances)
+
+	caps.Reports = append(caps.Reports, "calendar-query", "calendar-multiget", "free-busy-query")
+	if hasSync {
+		caps.Reports = append(caps.Reports, "sync-collection")
+	}
+
+	caps.AddBackend("Backend", h.Backend, h.Prefix)
+	caps.AddBackend("IdempotencyStore", h.IdempotencyStore, "")
+	caps.AddBackend("AuditSink", h.AuditSink, "")
+	return caps
+}
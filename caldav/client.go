@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
@@ -13,20 +14,35 @@ import (
 
 	"github.com/emersion/go-ical"
 	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/discovery"
 	"github.com/emersion/go-webdav/internal"
 )
 
-// DiscoverContextURL performs a DNS-based CardDAV service discovery as
-// described in RFC 6352 section 11. It returns the URL to the CardDAV server.
+// DiscoverContextURL performs a DNS-based CalDAV service discovery as
+// described in RFC 6764 section 6. It returns the URL to the CalDAV server.
+//
+// To also follow redirects and find the current user principal, use
+// discovery.Discoverer.
 func DiscoverContextURL(ctx context.Context, domain string) (string, error) {
-	return internal.DiscoverContextURL(ctx, "caldavs", domain)
+	u, err := discovery.ContextURL(ctx, nil, discovery.CalDAV, domain)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
 }
 
 // Client provides access to a remote CardDAV server.
 type Client struct {
 	*webdav.Client
 
+	// AllowOtherHosts allows DiscoverCalendars to follow a calendar home set
+	// hosted on another host than the endpoint of the client. The HTTP
+	// client, including any credentials it adds to requests, is then used
+	// for that host too. Downgrades from HTTPS to HTTP are always refused.
+	AllowOtherHosts bool
+
 	ic *internal.Client
+	hc webdav.HTTPClient
 }
 
 func NewClient(c webdav.HTTPClient, endpoint string) (*Client, error) {
@@ -38,22 +54,41 @@ func NewClient(c webdav.HTTPClient, endpoint string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{wc, ic}, nil
+	return &Client{Client: wc, ic: ic, hc: c}, nil
 }
 
 func (c *Client) FindCalendarHomeSet(ctx context.Context, principal string) (string, error) {
+	u, err := c.calendarHomeSetURL(ctx, principal)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+// calendarHomeSetURL returns the URL of the calendar home set, which may
+// be on another host.
+func (c *Client) calendarHomeSetURL(ctx context.Context, principal string) (*url.URL, error) {
 	propfind := internal.NewPropNamePropFind(calendarHomeSetName)
 	resp, err := c.ic.PropFindFlat(ctx, principal, propfind)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var prop calendarHomeSet
 	if err := resp.DecodeProp(&prop); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return prop.Href.Path, nil
+	u := url.URL(prop.Href)
+	return &u, nil
+}
+
+func decodeSupportedCalendarData(supported *supportedCalendarData) []CalendarDataType {
+	l := make([]CalendarDataType, len(supported.Types))
+	for i, t := range supported.Types {
+		l[i] = CalendarDataType{t.ContentType, t.Version}
+	}
+	return l
 }
 
 func (c *Client) FindCalendars(ctx context.Context, calendarHomeSet string) ([]Calendar, error) {
@@ -63,6 +98,12 @@ func (c *Client) FindCalendars(ctx context.Context, calendarHomeSet string) ([]C
 		calendarDescriptionName,
 		maxResourceSizeName,
 		supportedCalendarComponentSetName,
+		supportedCalendarDataName,
+		calendarColorName,
+		calendarOrderName,
+		calendarTimezoneName,
+		encryptedCollectionName,
+		internal.GetCTagName,
 	)
 	ms, err := c.ic.PropFind(ctx, calendarHomeSet, internal.DepthOne, propfind)
 	if err != nil {
@@ -112,18 +153,183 @@ func (c *Client) FindCalendars(ctx context.Context, calendarHomeSet string) ([]C
 			compNames = append(compNames, comp.Name)
 		}
 
+		var supportedData supportedCalendarData
+		if err := resp.DecodeProp(&supportedData); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
+		var color calendarColor
+		if err := resp.DecodeProp(&color); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
+		var order calendarOrder
+		if err := resp.DecodeProp(&order); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
+		var tz calendarTimezone
+		if err := resp.DecodeProp(&tz); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
+		var encrypted encryptedCollection
+		isEncrypted := true
+		if err := resp.DecodeProp(&encrypted); internal.IsNotFound(err) {
+			isEncrypted = false
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ctag internal.GetCTag
+		if err := resp.DecodeProp(&ctag); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
 		l = append(l, Calendar{
 			Path:                  path,
 			Name:                  dispName.Name,
 			Description:           desc.Description,
 			MaxResourceSize:       maxResSize.Size,
 			SupportedComponentSet: compNames,
+			Color:                 color.Color,
+			Order:                 order.Order,
+			Timezone:              tz.Data,
+			SupportedCalendarData: decodeSupportedCalendarData(&supportedData),
+			Encrypted:             isEncrypted,
+			CTag:                  ctag.CTag,
 		})
 	}
 
 	return l, nil
 }
 
+// findCurrentUserPrincipal is like FindCurrentUserPrincipal, but falls back
+// to the well-known URI and the server root for servers which don't expose the
+// principal at the context path.
+func (c *Client) findCurrentUserPrincipal(ctx context.Context) (string, error) {
+	principal, err := c.FindCurrentUserPrincipal(ctx)
+	if err == nil {
+		return principal, nil
+	}
+	for _, p := range []string{"/.well-known/caldav", "/"} {
+		if principal, fallbackErr := c.ic.FindCurrentUserPrincipal(ctx, p); fallbackErr == nil {
+			return principal, nil
+		}
+	}
+	return "", err
+}
+
+// findCalendarHomeSet is like FindCalendarHomeSet, but falls back to the
+// context path for servers which only expose the home set there.
+func (c *Client) findCalendarHomeSet(ctx context.Context, principal string) (*url.URL, error) {
+	homeSet, err := c.calendarHomeSetURL(ctx, principal)
+	if err == nil {
+		return homeSet, nil
+	}
+	if homeSet, fallbackErr := c.calendarHomeSetURL(ctx, ""); fallbackErr == nil {
+		return homeSet, nil
+	}
+	return nil, err
+}
+
+// CalendarDiscovery is the result of Client.DiscoverCalendars.
+type CalendarDiscovery struct {
+	Principal       string
+	CalendarHomeSet string
+	Calendars       []Calendar
+	// Client gives access to the calendars. It's a new client if the
+	// home set is hosted on another server than the principal.
+	Client *Client
+}
+
+// DiscoverCalendars finds the current user principal, its calendar home set
+// and the calendars it contains. Servers exposing the principal only at the
+// well-known URI or the server root, and the home set only at the context
+// path, are supported. A home set on another host is only followed with
+// AllowOtherHosts.
+//
+// If a step fails, a *webdav.DiscoveryError is returned along with the
+// results of the previous steps.
+func (c *Client) DiscoverCalendars(ctx context.Context) (*CalendarDiscovery, error) {
+	var (
+		d   CalendarDiscovery
+		err error
+	)
+	if d.Principal, err = c.findCurrentUserPrincipal(ctx); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "current-user-principal", Err: err}
+	}
+	homeSet, err := c.findCalendarHomeSet(ctx, d.Principal)
+	if err != nil {
+		return &d, &webdav.DiscoveryError{Step: "calendar-home-set", Err: err}
+	}
+	d.CalendarHomeSet = homeSet.Path
+	if d.Client, err = c.clientForHost(homeSet); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "calendar-home-set", Err: err}
+	}
+	if d.Calendars, err = d.Client.FindCalendars(ctx, d.CalendarHomeSet); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "calendars", Err: err}
+	}
+	return &d, nil
+}
+
+// clientForHost returns a client for the host of u, or c if u is on the same
+// host or relative. Other hosts are only allowed with AllowOtherHosts.
+func (c *Client) clientForHost(u *url.URL) (*Client, error) {
+	endpoint := c.ic.ResolveHref("/")
+	if u.Host == "" || u.Host == endpoint.Host {
+		return c, nil
+	}
+	if !c.AllowOtherHosts {
+		return nil, fmt.Errorf("caldav: refusing to follow calendar home set on other host %q", u.Host)
+	}
+	if u.Scheme != "" {
+		if endpoint.Scheme == "https" && u.Scheme != "https" {
+			return nil, fmt.Errorf("caldav: refusing to downgrade from https to %v for calendar home set on host %q", u.Scheme, u.Host)
+		}
+		endpoint.Scheme = u.Scheme
+	}
+	endpoint.Host = u.Host
+	client, err := NewClient(c.hc, endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+	client.AllowOtherHosts = true
+	return client, nil
+}
+
+// DiscoverOptions contains options for DiscoverCalendars.
+type DiscoverOptions struct {
+	// AllowOtherHosts sets Client.AllowOtherHosts.
+	AllowOtherHosts bool
+}
+
+// DiscoverCalendars creates a client and discovers calendars with
+// Client.DiscoverCalendars. endpoint is either the URL of the server, or an
+// email address or a domain for which the server is looked up with
+// discovery.Discover first. opts can be nil.
+//
+// As with Client.DiscoverCalendars, the results of the successful steps are
+// returned along with errors.
+func DiscoverCalendars(ctx context.Context, c webdav.HTTPClient, endpoint string, opts *DiscoverOptions) (*CalendarDiscovery, error) {
+	if opts == nil {
+		opts = &DiscoverOptions{}
+	}
+	if !strings.Contains(endpoint, "://") {
+		result, err := discovery.Discover(ctx, c, discovery.CalDAV, endpoint)
+		if err != nil {
+			return &CalendarDiscovery{}, err
+		}
+		endpoint = result.ContextURL.String()
+	}
+	client, err := NewClient(c, endpoint)
+	if err != nil {
+		return &CalendarDiscovery{}, err
+	}
+	client.AllowOtherHosts = opts.AllowOtherHosts
+	return client.DiscoverCalendars(ctx)
+}
+
 func encodeCalendarCompReq(c *CalendarCompRequest) (*comp, error) {
 	encoded := comp{Name: c.Name}
 
@@ -155,6 +361,12 @@ func encodeCalendarReq(c *CalendarCompRequest) (*internal.Prop, error) {
 	}
 
 	calDataReq := calendarDataReq{Comp: compReq}
+	if c.Expand != nil {
+		calDataReq.Expand = &expand{
+			Start: dateWithUTCTime(c.Expand.Start),
+			End:   dateWithUTCTime(c.Expand.End),
+		}
+	}
 
 	getLastModReq := internal.NewRawXMLElement(internal.GetLastModifiedName, nil, nil)
 	getETagReq := internal.NewRawXMLElement(internal.GetETagName, nil, nil)
@@ -175,52 +387,75 @@ func encodeCompFilter(filter *CompFilter) *compFilter {
 	return &encoded
 }
 
-func decodeCalendarObjectList(ms *internal.MultiStatus) ([]CalendarObject, error) {
-	addrs := make([]CalendarObject, 0, len(ms.Responses))
-	for _, resp := range ms.Responses {
-		path, err := resp.Path()
-		if err != nil {
-			return nil, err
-		}
+func decodeCalendarObject(resp *internal.Response) (*CalendarObject, error) {
+	path, err := resp.Path()
+	if err != nil {
+		return nil, err
+	}
 
-		var calData calendarDataResp
-		if err := resp.DecodeProp(&calData); err != nil {
-			return nil, err
-		}
+	var calData calendarDataResp
+	if err := resp.DecodeProp(&calData); err != nil {
+		return nil, err
+	}
 
-		var getLastMod internal.GetLastModified
-		if err := resp.DecodeProp(&getLastMod); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getLastMod internal.GetLastModified
+	if err := resp.DecodeProp(&getLastMod); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		var getETag internal.GetETag
-		if err := resp.DecodeProp(&getETag); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getETag internal.GetETag
+	if err := resp.DecodeProp(&getETag); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		var getContentLength internal.GetContentLength
-		if err := resp.DecodeProp(&getContentLength); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getContentLength internal.GetContentLength
+	if err := resp.DecodeProp(&getContentLength); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		r := bytes.NewReader(calData.Data)
-		data, err := ical.NewDecoder(r).Decode()
-		if err != nil {
-			return nil, err
-		}
+	r := bytes.NewReader(calData.Data)
+	data, err := ical.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, &webdav.ResponseError{Path: path, Err: err, Data: calData.Data}
+	}
 
-		addrs = append(addrs, CalendarObject{
-			Path:          path,
-			ModTime:       time.Time(getLastMod.LastModified),
-			ContentLength: getContentLength.Length,
-			ETag:          string(getETag.ETag),
-			Data:          data,
-		})
+	return &CalendarObject{
+		Path:          path,
+		ModTime:       time.Time(getLastMod.LastModified),
+		ContentLength: getContentLength.Length,
+		ETag:          string(getETag.ETag),
+		Data:          data,
+	}, nil
+}
+
+func decodeCalendarObjectList(ms *internal.MultiStatus) ([]CalendarObject, error) {
+	l := make([]CalendarObject, 0, len(ms.Responses))
+	var partialErr webdav.PartialError
+	for i := range ms.Responses {
+		resp := &ms.Responses[i]
+		obj, err := decodeCalendarObject(resp)
+		if respErr, ok := err.(*webdav.ResponseError); ok {
+			partialErr.Errors = append(partialErr.Errors, *respErr)
+			continue
+		} else if err != nil {
+			path, _ := resp.Path()
+			partialErr.Errors = append(partialErr.Errors, webdav.ResponseError{Path: path, Err: err})
+			continue
+		}
+		l = append(l, *obj)
 	}
 
-	return addrs, nil
+	if len(partialErr.Errors) > 0 {
+		return l, &partialErr
+	}
+	return l, nil
 }
 
+// QueryCalendar performs a calendar-query REPORT request.
+//
+// If some objects can't be retrieved or decoded, a *webdav.PartialError is
+// returned along with the other objects. The raw payload of objects which
+// can't be parsed is available in the PartialError.
 func (c *Client) QueryCalendar(ctx context.Context, calendar string, query *CalendarQuery) ([]CalendarObject, error) {
 	propReq, err := encodeCalendarReq(&query.CompRequest)
 	if err != nil {
@@ -229,13 +464,13 @@ func (c *Client) QueryCalendar(ctx context.Context, calendar string, query *Cale
 
 	calendarQuery := calendarQuery{Prop: propReq}
 	calendarQuery.Filter.CompFilter = *encodeCompFilter(&query.CompFilter)
-	req, err := c.ic.NewXMLRequest("REPORT", calendar, &calendarQuery)
+	req, err := c.ic.NewXMLRequest(ctx, "REPORT", calendar, &calendarQuery)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Depth", "1")
 
-	ms, err := c.ic.DoMultiStatus(req.WithContext(ctx))
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
@@ -243,6 +478,11 @@ func (c *Client) QueryCalendar(ctx context.Context, calendar string, query *Cale
 	return decodeCalendarObjectList(ms)
 }
 
+// MultiGetCalendar performs a calendar-multiget REPORT request.
+//
+// If some objects can't be retrieved or decoded, a *webdav.PartialError is
+// returned along with the other objects. The raw payload of objects which
+// can't be parsed is available in the PartialError.
 func (c *Client) MultiGetCalendar(ctx context.Context, path string, multiGet *CalendarMultiGet) ([]CalendarObject, error) {
 	propReq, err := encodeCalendarReq(&multiGet.CompRequest)
 	if err != nil {
@@ -261,13 +501,13 @@ func (c *Client) MultiGetCalendar(ctx context.Context, path string, multiGet *Ca
 		}
 	}
 
-	req, err := c.ic.NewXMLRequest("REPORT", path, &calendarMultiget)
+	req, err := c.ic.NewXMLRequest(ctx, "REPORT", path, &calendarMultiget)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Depth", "1")
 
-	ms, err := c.ic.DoMultiStatus(req.WithContext(ctx))
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
@@ -308,20 +548,119 @@ func populateCalendarObject(co *CalendarObject, h http.Header) error {
 	return nil
 }
 
-func (c *Client) GetCalendarObject(ctx context.Context, path string) (*CalendarObject, error) {
-	req, err := c.ic.NewRequest(http.MethodGet, path, nil)
+// CreateCalendar creates a calendar with a MKCALENDAR request. The name,
+// description, maximum resource size and supported component set of the
+// calendar are set, if any.
+func (c *Client) CreateCalendar(ctx context.Context, calendar *Calendar) error {
+	var values []interface{}
+	if calendar.Name != "" {
+		values = append(values, &internal.DisplayName{Name: calendar.Name})
+	}
+	if calendar.Description != "" {
+		values = append(values, &calendarDescription{Description: calendar.Description})
+	}
+	if calendar.MaxResourceSize > 0 {
+		values = append(values, &maxResourceSize{Size: calendar.MaxResourceSize})
+	}
+	if len(calendar.SupportedComponentSet) > 0 {
+		compSet := supportedCalendarComponentSet{}
+		for _, name := range calendar.SupportedComponentSet {
+			compSet.Comp = append(compSet.Comp, comp{Name: name})
+		}
+		values = append(values, &compSet)
+	}
+	if calendar.Color != "" {
+		values = append(values, &calendarColor{Color: calendar.Color})
+	}
+	if calendar.Order != 0 {
+		values = append(values, &calendarOrder{Order: calendar.Order})
+	}
+	if calendar.Timezone != "" {
+		values = append(values, &calendarTimezone{Data: calendar.Timezone})
+	}
+	if calendar.Encrypted {
+		values = append(values, &encryptedCollection{})
+	}
+
+	var m mkcalendarReq
+	if len(values) > 0 {
+		prop, err := internal.EncodeProp(values...)
+		if err != nil {
+			return err
+		}
+		m.Set = &internal.Set{Prop: *prop}
+	}
+
+	req, err := c.ic.NewXMLRequest(ctx, "MKCALENDAR", calendar.Path, &m)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("Accept", ical.MIMEType)
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+// UpdateCalendar changes the properties of a calendar with a PROPPATCH
+// request.
+func (c *Client) UpdateCalendar(ctx context.Context, path string, update *CalendarUpdate) error {
+	var set, remove []interface{}
+	add := func(value string, v interface{}) {
+		if value == "" {
+			remove = append(remove, v)
+		} else {
+			set = append(set, v)
+		}
+	}
+	if update.Name != nil {
+		add(*update.Name, &internal.DisplayName{Name: *update.Name})
+	}
+	if update.Description != nil {
+		add(*update.Description, &calendarDescription{Description: *update.Description})
+	}
+	if update.Color != nil {
+		add(*update.Color, &calendarColor{Color: *update.Color})
+	}
+
+	var pu internal.PropertyUpdate
+	if len(set) > 0 {
+		prop, err := internal.EncodeProp(set...)
+		if err != nil {
+			return err
+		}
+		pu.Set = []internal.Set{{Prop: *prop}}
+	}
+	if len(remove) > 0 {
+		prop, err := internal.EncodeProp(remove...)
+		if err != nil {
+			return err
+		}
+		pu.Remove = []internal.Remove{{Prop: *prop}}
+	}
+	if len(pu.Set) == 0 && len(pu.Remove) == 0 {
+		return nil
+	}
+	return c.ic.PropPatch(ctx, path, &pu)
+}
+
+// DeleteCalendar deletes a calendar and all of its calendar objects.
+func (c *Client) DeleteCalendar(ctx context.Context, path string) error {
+	return c.Client.RemoveAll(ctx, path)
+}
+
+// GetCalendarObject fetches a calendar object.
+//
+// If the calendar object can't be parsed, a *webdav.ResponseError carrying
+// its raw payload is returned.
+func (c *Client) GetCalendarObject(ctx context.Context, path string) (*CalendarObject, error) {
+	raw, err := c.GetCalendarObjectRaw(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	mediaType, _, err := mime.ParseMediaType(raw.ContentType)
 	if err != nil {
 		return nil, err
 	}
@@ -329,24 +668,62 @@ func (c *Client) GetCalendarObject(ctx context.Context, path string) (*CalendarO
 		return nil, fmt.Errorf("caldav: expected Content-Type %q, got %q", ical.MIMEType, mediaType)
 	}
 
-	cal, err := ical.NewDecoder(resp.Body).Decode()
+	cal, err := ical.NewDecoder(bytes.NewReader(raw.Data)).Decode()
+	if err != nil {
+		return nil, &webdav.ResponseError{Path: raw.Path, Err: err, Data: raw.Data}
+	}
+
+	return &CalendarObject{
+		Path:          raw.Path,
+		ModTime:       raw.ModTime,
+		ContentLength: int64(len(raw.Data)),
+		ETag:          raw.ETag,
+		Data:          cal,
+	}, nil
+}
+
+// GetCalendarObjectRaw fetches a calendar object without parsing it.
+func (c *Client) GetCalendarObjectRaw(ctx context.Context, path string) (*RawCalendarObject, error) {
+	req, err := c.ic.NewRequest(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Accept", ical.MIMEType)
+
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	co := &CalendarObject{
-		Path: resp.Request.URL.Path,
-		Data: cal,
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	if err := populateCalendarObject(co, resp.Header); err != nil {
+
+	co := CalendarObject{Path: resp.Request.URL.Path}
+	if err := populateCalendarObject(&co, resp.Header); err != nil {
 		return nil, err
 	}
-	return co, nil
+	return &RawCalendarObject{
+		Path:        co.Path,
+		ModTime:     co.ModTime,
+		ETag:        co.ETag,
+		ContentType: resp.Header.Get("Content-Type"),
+		Data:        data,
+	}, nil
 }
 
+// PutCalendarObject uploads a calendar object.
 func (c *Client) PutCalendarObject(ctx context.Context, path string, cal *ical.Calendar) (*CalendarObject, error) {
-	// TODO: add support for If-None-Match and If-Match
+	return c.PutCalendarObjectWithOptions(ctx, path, cal, nil)
+}
 
+// PutCalendarObjectWithOptions uploads a calendar object. opts can be nil.
+// The IfMatch and IfNoneMatch options make the request conditional, e.g.
+// IfNoneMatch "*" only creates new objects. DryRun asks the server to only
+// validate the object.
+func (c *Client) PutCalendarObjectWithOptions(ctx context.Context, path string, cal *ical.Calendar, opts *PutCalendarObjectOptions) (*CalendarObject, error) {
 	// TODO: some servers want a Content-Length header, so we can't stream the
 	// request body here. See the Radicale issue:
 	// https://github.com/Kozea/Radicale/issues/1016
@@ -356,21 +733,137 @@ func (c *Client) PutCalendarObject(ctx context.Context, path string, cal *ical.C
 		return nil, err
 	}
 
-	req, err := c.ic.NewRequest(http.MethodPut, path, &buf)
+	raw, err := c.PutCalendarObjectRawWithOptions(ctx, path, buf.Bytes(), ical.MIMEType, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &CalendarObject{
+		Path:    raw.Path,
+		ModTime: raw.ModTime,
+		ETag:    raw.ETag,
+	}, nil
+}
+
+// PutCalendarObjectRaw uploads a calendar object as-is. The returned object
+// doesn't carry any data.
+func (c *Client) PutCalendarObjectRaw(ctx context.Context, path string, data []byte, contentType string) (*RawCalendarObject, error) {
+	return c.PutCalendarObjectRawWithOptions(ctx, path, data, contentType, nil)
+}
+
+// PutCalendarObjectRawWithOptions uploads a calendar object as-is, like
+// PutCalendarObjectWithOptions. The returned object doesn't carry any data.
+// opts can be nil.
+func (c *Client) PutCalendarObjectRawWithOptions(ctx context.Context, path string, data []byte, contentType string, opts *PutCalendarObjectOptions) (*RawCalendarObject, error) {
+	req, err := c.ic.NewRequest(ctx, http.MethodPut, path, bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", ical.MIMEType)
+	req.Header.Set("Content-Type", contentType)
+	if opts != nil {
+		internal.SetConditional(req, string(opts.IfMatch), string(opts.IfNoneMatch))
+		if opts.DryRun {
+			req.Header.Set("Prefer", internal.PreferDryRun)
+		}
+	}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	resp.Body.Close()
 
-	co := &CalendarObject{Path: path}
-	if err := populateCalendarObject(co, resp.Header); err != nil {
+	co := CalendarObject{Path: path}
+	if err := populateCalendarObject(&co, resp.Header); err != nil {
+		return nil, err
+	}
+	return &RawCalendarObject{
+		Path:        co.Path,
+		ModTime:     co.ModTime,
+		ETag:        co.ETag,
+		ContentType: contentType,
+	}, nil
+}
+
+// SyncCollection performs a collection synchronization operation on the
+// specified calendar, as defined in RFC 6578.
+func (c *Client) SyncCollection(ctx context.Context, path string, query *SyncQuery) (*SyncResponse, error) {
+	var limit *internal.Limit
+	if query.Limit > 0 {
+		limit = &internal.Limit{NResults: uint(query.Limit)}
+	}
+
+	var propReq *internal.Prop
+	var err error
+	if query.CompRequest.Name != "" {
+		propReq, err = encodeCalendarReq(&query.CompRequest)
+	} else {
+		getLastModReq := internal.NewRawXMLElement(internal.GetLastModifiedName, nil, nil)
+		getETagReq := internal.NewRawXMLElement(internal.GetETagName, nil, nil)
+		propReq, err = internal.EncodeProp(getLastModReq, getETagReq)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := c.ic.SyncCollection(ctx, path, query.SyncToken, internal.DepthOne, limit, propReq)
+	if err != nil {
 		return nil, err
 	}
-	return co, nil
+
+	ret := &SyncResponse{SyncToken: ms.SyncToken}
+	for i := range ms.Responses {
+		resp := &ms.Responses[i]
+		if resp.IsTruncated() {
+			ret.Truncated = true
+			continue
+		}
+
+		p, err := resp.Path()
+		if internal.IsNotFound(err) {
+			ret.Deleted = append(ret.Deleted, p)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if p == path || path == p+"/" {
+			continue
+		}
+
+		var co *CalendarObject
+		if query.CompRequest.Name != "" {
+			co, err = decodeCalendarObject(resp)
+		} else {
+			co, err = decodeCalendarObjectMetadata(resp)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret.Updated = append(ret.Updated, *co)
+	}
+
+	return ret, nil
+}
+
+func decodeCalendarObjectMetadata(resp *internal.Response) (*CalendarObject, error) {
+	path, err := resp.Path()
+	if err != nil {
+		return nil, err
+	}
+
+	var getLastMod internal.GetLastModified
+	if err := resp.DecodeProp(&getLastMod); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
+
+	var getETag internal.GetETag
+	if err := resp.DecodeProp(&getETag); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
+
+	return &CalendarObject{
+		Path:    path,
+		ModTime: time.Time(getLastMod.LastModified),
+		ETag:    string(getETag.ETag),
+	}, nil
 }
@@ -8,7 +8,12 @@ import (
 	"github.com/emersion/go-webdav/internal"
 )
 
-const namespace = "urn:ietf:params:xml:ns:caldav"
+const (
+	namespace               = "urn:ietf:params:xml:ns:caldav"
+	calendarServerNamespace = "http://calendarserver.org/ns/"
+	goWebDAVNamespace       = "https://github.com/emersion/go-webdav"
+	appleICalNamespace      = "http://apple.com/ns/ical/"
+)
 
 var (
 	calendarHomeSetName = xml.Name{namespace, "calendar-home-set"}
@@ -17,12 +22,36 @@ var (
 	supportedCalendarDataName         = xml.Name{namespace, "supported-calendar-data"}
 	supportedCalendarComponentSetName = xml.Name{namespace, "supported-calendar-component-set"}
 	maxResourceSizeName               = xml.Name{namespace, "max-resource-size"}
+	supportedCollationSetName         = xml.Name{namespace, "supported-collation-set"}
+	calendarTimezoneIDName            = xml.Name{namespace, "calendar-timezone-id"}
+	calendarTimezoneName              = xml.Name{namespace, "calendar-timezone"}
+
+	calendarColorName = xml.Name{appleICalNamespace, "calendar-color"}
+	calendarOrderName = xml.Name{appleICalNamespace, "calendar-order"}
 
 	calendarQueryName    = xml.Name{namespace, "calendar-query"}
 	calendarMultigetName = xml.Name{namespace, "calendar-multiget"}
+	freeBusyQueryName    = xml.Name{namespace, "free-busy-query"}
+
+	mkcalendarResponseName = xml.Name{namespace, "mkcalendar-response"}
+	mkcolResponseName      = xml.Name{"DAV:", "mkcol-response"}
 
 	calendarName     = xml.Name{namespace, "calendar"}
 	calendarDataName = xml.Name{namespace, "calendar-data"}
+
+	scheduleInboxName          = xml.Name{namespace, "schedule-inbox"}
+	scheduleOutboxName         = xml.Name{namespace, "schedule-outbox"}
+	scheduleInboxURLName       = xml.Name{namespace, "schedule-inbox-URL"}
+	scheduleOutboxURLName      = xml.Name{namespace, "schedule-outbox-URL"}
+	calendarUserAddressSetName = xml.Name{namespace, "calendar-user-address-set"}
+
+	sourceName     = xml.Name{calendarServerNamespace, "source"}
+	feedStatusName = xml.Name{goWebDAVNamespace, "feed-status"}
+
+	encryptedCollectionName = xml.Name{goWebDAVNamespace, "encrypted-collection"}
+
+	transactionPutName    = xml.Name{goWebDAVNamespace, "put"}
+	transactionDeleteName = xml.Name{goWebDAVNamespace, "delete"}
 )
 
 // https://tools.ietf.org/html/rfc4791#section-6.2.1
@@ -35,12 +64,57 @@ func (a *calendarHomeSet) GetXMLName() xml.Name {
 	return calendarHomeSetName
 }
 
+// https://datatracker.ietf.org/doc/html/rfc6638#section-2.2
+type scheduleInboxURL struct {
+	XMLName xml.Name      `xml:"urn:ietf:params:xml:ns:caldav schedule-inbox-URL"`
+	Href    internal.Href `xml:"DAV: href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6638#section-2.1
+type scheduleOutboxURL struct {
+	XMLName xml.Name      `xml:"urn:ietf:params:xml:ns:caldav schedule-outbox-URL"`
+	Href    internal.Href `xml:"DAV: href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6638#section-2.4.1
+type calendarUserAddressSet struct {
+	XMLName xml.Name        `xml:"urn:ietf:params:xml:ns:caldav calendar-user-address-set"`
+	Hrefs   []internal.Href `xml:"DAV: href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6638#section-10.1
+type scheduleResponse struct {
+	XMLName   xml.Name                `xml:"urn:ietf:params:xml:ns:caldav schedule-response"`
+	Responses []scheduleResponseEntry `xml:"response"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6638#section-10.2
+type scheduleResponseEntry struct {
+	XMLName       xml.Name          `xml:"urn:ietf:params:xml:ns:caldav response"`
+	Recipient     internal.Href     `xml:"recipient>href"`
+	RequestStatus string            `xml:"request-status"`
+	CalendarData  *calendarDataResp `xml:"calendar-data,omitempty"`
+}
+
 // https://tools.ietf.org/html/rfc4791#section-5.2.1
 type calendarDescription struct {
 	XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-description"`
 	Description string   `xml:",chardata"`
 }
 
+// https://github.com/apple/ccs-calendarserver/blob/master/doc/Extensions/caldav-pubsubdiscovery.txt
+type source struct {
+	XMLName xml.Name      `xml:"http://calendarserver.org/ns/ source"`
+	Href    internal.Href `xml:"DAV: href"`
+}
+
+type feedStatus struct {
+	XMLName     xml.Name       `xml:"https://github.com/emersion/go-webdav feed-status"`
+	LastRefresh *internal.Time `xml:"last-refresh,omitempty"`
+	LastSuccess *internal.Time `xml:"last-success,omitempty"`
+	Error       string         `xml:"error,omitempty"`
+}
+
 // https://tools.ietf.org/html/rfc4791#section-5.2.4
 type supportedCalendarData struct {
 	XMLName xml.Name           `xml:"urn:ietf:params:xml:ns:caldav supported-calendar-data"`
@@ -53,6 +127,12 @@ type supportedCalendarComponentSet struct {
 	Comp    []comp   `xml:"comp"`
 }
 
+// https://tools.ietf.org/html/rfc4791#section-7.5.1
+type supportedCollationSet struct {
+	XMLName    xml.Name `xml:"urn:ietf:params:xml:ns:caldav supported-collation-set"`
+	Collations []string `xml:"supported-collation"`
+}
+
 // https://tools.ietf.org/html/rfc4791#section-9.6
 type calendarDataType struct {
 	XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
@@ -66,6 +146,46 @@ type maxResourceSize struct {
 	Size    int64    `xml:",chardata"`
 }
 
+// https://tools.ietf.org/html/rfc4791#section-5.3.1.2
+type mkcalendarReq struct {
+	XMLName xml.Name      `xml:"urn:ietf:params:xml:ns:caldav mkcalendar"`
+	Set     *internal.Set `xml:"DAV: set,omitempty"`
+}
+
+// https://tools.ietf.org/html/rfc5689#section-5.1
+type mkcolReq struct {
+	XMLName xml.Name      `xml:"DAV: mkcol"`
+	Set     *internal.Set `xml:"DAV: set,omitempty"`
+}
+
+// https://github.com/apple/ccs-calendarserver/blob/master/doc/Extensions/caldav-sharing.txt
+type calendarColor struct {
+	XMLName xml.Name `xml:"http://apple.com/ns/ical/ calendar-color"`
+	Color   string   `xml:",chardata"`
+}
+
+type calendarOrder struct {
+	XMLName xml.Name `xml:"http://apple.com/ns/ical/ calendar-order"`
+	Order   int      `xml:",chardata"`
+}
+
+// encryptedCollection marks collections holding end-to-end encrypted objects.
+type encryptedCollection struct {
+	XMLName xml.Name `xml:"https://github.com/emersion/go-webdav encrypted-collection"`
+}
+
+// https://tools.ietf.org/html/rfc4791#section-5.2.2
+type calendarTimezone struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-timezone"`
+	Data    string   `xml:",chardata"`
+}
+
+// https://tools.ietf.org/html/rfc7809#section-5.2
+type calendarTimezoneID struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-timezone-id"`
+	TZID    string   `xml:",chardata"`
+}
+
 // https://tools.ietf.org/html/rfc4791#section-9.5
 type calendarQuery struct {
 	XMLName  xml.Name       `xml:"urn:ietf:params:xml:ns:caldav calendar-query"`
@@ -171,7 +291,7 @@ func (t *dateWithUTCTime) UnmarshalText(b []byte) error {
 }
 
 func (t *dateWithUTCTime) MarshalText() ([]byte, error) {
-	s := time.Time(*t).Format(dateWithUTCTimeLayout)
+	s := time.Time(*t).UTC().Format(dateWithUTCTimeLayout)
 	return []byte(s), nil
 }
 
@@ -179,7 +299,15 @@ func (t *dateWithUTCTime) MarshalText() ([]byte, error) {
 type calendarDataReq struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
 	Comp    *comp    `xml:"comp,omitempty"`
-	// TODO: expand, limit-recurrence-set, limit-freebusy-set
+	Expand  *expand  `xml:"expand,omitempty"`
+	// TODO: limit-recurrence-set, limit-freebusy-set
+}
+
+// https://tools.ietf.org/html/rfc4791#section-9.6.5
+type expand struct {
+	XMLName xml.Name        `xml:"urn:ietf:params:xml:ns:caldav expand"`
+	Start   dateWithUTCTime `xml:"start,attr"`
+	End     dateWithUTCTime `xml:"end,attr"`
 }
 
 // https://tools.ietf.org/html/rfc4791#section-9.6.1
@@ -201,16 +329,40 @@ type prop struct {
 	// TODO: novalue
 }
 
+// https://tools.ietf.org/html/rfc4791#section-7.10
+type freeBusyQuery struct {
+	XMLName   xml.Name  `xml:"urn:ietf:params:xml:ns:caldav free-busy-query"`
+	TimeRange timeRange `xml:"time-range"`
+}
+
 // Response variant of https://tools.ietf.org/html/rfc4791#section-9.6
 type calendarDataResp struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
-	Data    []byte   `xml:",chardata"`
+	XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	ContentType string   `xml:"content-type,attr,omitempty"`
+	Data        []byte   `xml:",chardata"`
+}
+
+// transaction is a go-webdav extension applying several changes to calendar
+// objects atomically.
+type transaction struct {
+	XMLName xml.Name        `xml:"https://github.com/emersion/go-webdav transaction"`
+	Ops     []transactionOp `xml:",any"`
+}
+
+// transactionOp is either a put or a delete element.
+type transactionOp struct {
+	XMLName      xml.Name          `xml:""`
+	Href         internal.Href     `xml:"DAV: href"`
+	IfMatch      string            `xml:"https://github.com/emersion/go-webdav if-match,omitempty"`
+	IfNoneMatch  string            `xml:"https://github.com/emersion/go-webdav if-none-match,omitempty"`
+	CalendarData *calendarDataResp `xml:"urn:ietf:params:xml:ns:caldav calendar-data,omitempty"`
 }
 
 type reportReq struct {
-	Query    *calendarQuery
-	Multiget *calendarMultiget
-	// TODO: CALDAV:free-busy-query
+	Query          *calendarQuery
+	Multiget       *calendarMultiget
+	FreeBusyQuery  *freeBusyQuery
+	SyncCollection *internal.SyncCollectionQuery
 }
 
 func (r *reportReq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -222,6 +374,12 @@ func (r *reportReq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	case calendarMultigetName:
 		r.Multiget = &calendarMultiget{}
 		v = r.Multiget
+	case freeBusyQueryName:
+		r.FreeBusyQuery = &freeBusyQuery{}
+		v = r.FreeBusyQuery
+	case internal.SyncCollectionName:
+		r.SyncCollection = &internal.SyncCollectionQuery{}
+		v = r.SyncCollection
 	default:
 		return fmt.Errorf("caldav: unsupported REPORT root %q %q", start.Name.Space, start.Name.Local)
 	}
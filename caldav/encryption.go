@@ -0,0 +1,247 @@
+package caldav
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+type encryptedBackend struct {
+	Backend
+	keys  webdav.KeyProvider
+	props map[string]bool
+	opts  webdav.EncryptionOptions
+}
+
+// NewEncryptedBackend returns a Backend encrypting the values of the given
+// properties, e.g. SUMMARY and DESCRIPTION, before calendar objects are
+// stored in backend. Values are decrypted when objects are retrieved. Unless
+// opts.RejectPlaintext is set, values which aren't encrypted are returned as
+// is.
+//
+// Encrypted values are bound to the path of their calendar object, so backend
+// must store objects at the path they're created with. Only text properties
+// should be encrypted: the backend can't interpret encrypted values. Queries
+// filtering on encrypted properties are evaluated after decrypting all the
+// objects of the calendar.
+//
+// The optional interfaces of backend which don't handle calendar data, such as
+// SyncBackend or webdav.DeadPropertyStore, are forwarded. DryRunBackend,
+// MoveBackend and CalendarObjectStreamer are supported if backend supports
+// them, decrypting objects as needed. Moved objects are re-encrypted for their
+// new path. RawBackend, SchedulingBackend and TransactionBackend aren't
+// exposed, since they would bypass encryption.
+func NewEncryptedBackend(backend Backend, keys webdav.KeyProvider, props []string, opts *webdav.EncryptionOptions) Backend {
+	if opts == nil {
+		opts = &webdav.EncryptionOptions{}
+	}
+	m := make(map[string]bool, len(props))
+	for _, name := range props {
+		m[strings.ToUpper(name)] = true
+	}
+	return &encryptedBackend{backend, keys, m, *opts}
+}
+
+// mapProps returns a copy of comp where the values of the encrypted
+// properties have been replaced with f.
+func (b *encryptedBackend) mapProps(comp *ical.Component, f func(string) (string, error)) (*ical.Component, error) {
+	out := &ical.Component{
+		Name:  comp.Name,
+		Props: make(ical.Props, len(comp.Props)),
+	}
+	for name, props := range comp.Props {
+		if !b.props[name] {
+			out.Props[name] = props
+			continue
+		}
+		l := make([]ical.Prop, len(props))
+		for i, prop := range props {
+			v, err := f(prop.Value)
+			if err != nil {
+				return nil, err
+			}
+			prop.Value = v
+			l[i] = prop
+		}
+		out.Props[name] = l
+	}
+	for _, child := range comp.Children {
+		c, err := b.mapProps(child, f)
+		if err != nil {
+			return nil, err
+		}
+		out.Children = append(out.Children, c)
+	}
+	return out, nil
+}
+
+func (b *encryptedBackend) decryptObject(ctx context.Context, co *CalendarObject) error {
+	if co.Data == nil || co.Data.Component == nil {
+		return nil
+	}
+	comp, err := b.mapProps(co.Data.Component, func(v string) (string, error) {
+		return internal.DecryptText(ctx, b.keys, v, []byte(co.Path), b.opts.RejectPlaintext)
+	})
+	if err != nil {
+		return err
+	}
+	co.Data = &ical.Calendar{Component: comp}
+	return nil
+}
+
+func (b *encryptedBackend) decryptObjects(ctx context.Context, l []CalendarObject) error {
+	for i := range l {
+		if err := b.decryptObject(ctx, &l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filtersEncryptedProps reports whether a filter needs to inspect the value of
+// encrypted properties.
+func (b *encryptedBackend) filtersEncryptedProps(cf *CompFilter) bool {
+	for _, pf := range cf.Props {
+		if b.props[strings.ToUpper(pf.Name)] {
+			return true
+		}
+	}
+	for i := range cf.Comps {
+		if b.filtersEncryptedProps(&cf.Comps[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ DryRunBackend          = (*encryptedBackend)(nil)
+	_ MoveBackend            = (*encryptedBackend)(nil)
+	_ CalendarObjectStreamer = (*encryptedBackend)(nil)
+)
+
+func (b *encryptedBackend) unwrapBackend() Backend {
+	return b.Backend
+}
+
+func (b *encryptedBackend) GetCalendarObject(ctx context.Context, path string, req *CalendarCompRequest) (*CalendarObject, error) {
+	co, err := b.Backend.GetCalendarObject(ctx, path, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.decryptObject(ctx, co); err != nil {
+		return nil, err
+	}
+	return co, nil
+}
+
+func (b *encryptedBackend) ListCalendarObjects(ctx context.Context, path string, req *CalendarCompRequest) ([]CalendarObject, error) {
+	l, err := b.Backend.ListCalendarObjects(ctx, path, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.decryptObjects(ctx, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (b *encryptedBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
+	if query == nil || !b.filtersEncryptedProps(&query.CompFilter) {
+		l, err := b.Backend.QueryCalendarObjects(ctx, path, query)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.decryptObjects(ctx, l); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	l, err := b.ListCalendarObjects(ctx, path, &CalendarCompRequest{AllProps: true, AllComps: true})
+	if err != nil {
+		return nil, err
+	}
+	return Filter(query, l)
+}
+
+func (b *encryptedBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (loc string, err error) {
+	comp, err := b.mapProps(calendar.Component, func(v string) (string, error) {
+		return internal.EncryptText(ctx, b.keys, v, []byte(path))
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.Backend.PutCalendarObject(ctx, path, &ical.Calendar{Component: comp}, opts)
+}
+
+func (b *encryptedBackend) SupportsDryRun() bool {
+	drb, ok := b.Backend.(DryRunBackend)
+	return ok && drb.SupportsDryRun()
+}
+
+// MoveCalendarObject moves an object with the MoveBackend of the wrapped
+// Backend, and then re-encrypts it for dest.
+func (b *encryptedBackend) MoveCalendarObject(ctx context.Context, src, dest string) error {
+	mb, ok := b.Backend.(MoveBackend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusNotImplemented, "caldav: backend doesn't support moving calendar objects")
+	}
+	co, err := b.GetCalendarObject(ctx, src, &CalendarCompRequest{AllProps: true, AllComps: true})
+	if err != nil {
+		return err
+	}
+	if err := mb.MoveCalendarObject(ctx, src, dest); err != nil {
+		return err
+	}
+	_, err = b.PutCalendarObject(ctx, dest, co.Data, nil)
+	return err
+}
+
+func (b *encryptedBackend) ListCalendarObjectsStream(ctx context.Context, path string, req *CalendarCompRequest, fn func(co *CalendarObject) error) error {
+	streamer, ok := b.Backend.(CalendarObjectStreamer)
+	if !ok {
+		l, err := b.ListCalendarObjects(ctx, path, req)
+		if err != nil {
+			return err
+		}
+		return forEachCalendarObject(l, fn)
+	}
+	return streamer.ListCalendarObjectsStream(ctx, path, req, b.decryptFunc(ctx, fn))
+}
+
+func (b *encryptedBackend) QueryCalendarObjectsStream(ctx context.Context, path string, query *CalendarQuery, fn func(co *CalendarObject) error) error {
+	streamer, ok := b.Backend.(CalendarObjectStreamer)
+	if !ok || (query != nil && b.filtersEncryptedProps(&query.CompFilter)) {
+		l, err := b.QueryCalendarObjects(ctx, path, query)
+		if err != nil {
+			return err
+		}
+		return forEachCalendarObject(l, fn)
+	}
+	return streamer.QueryCalendarObjectsStream(ctx, path, query, b.decryptFunc(ctx, fn))
+}
+
+// decryptFunc returns a function decrypting calendar objects before passing
+// them to fn.
+func (b *encryptedBackend) decryptFunc(ctx context.Context, fn func(co *CalendarObject) error) func(co *CalendarObject) error {
+	return func(co *CalendarObject) error {
+		if err := b.decryptObject(ctx, co); err != nil {
+			return err
+		}
+		return fn(co)
+	}
+}
+
+func forEachCalendarObject(l []CalendarObject, fn func(co *CalendarObject) error) error {
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,499 @@
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Feed is a read-only calendar mirroring an external iCalendar feed, e.g. a
+// public holiday calendar or a webcal subscription. Feeds are served by a
+// FeedBackend.
+type Feed struct {
+	// URL is the address of the iCalendar feed.
+	URL string
+	// Open, if set, opens the iCalendar data instead of fetching URL, e.g. to
+	// serve a file bundled with the application. See OpenFeedFile.
+	Open func(ctx context.Context) (io.ReadCloser, error)
+	// Calendar describes the calendar collection serving the feed.
+	Calendar Calendar
+	// RefreshInterval is the delay between refreshes in Run. Zero or
+	// negative means 1 hour.
+	RefreshInterval time.Duration
+	// MaxSize is the maximum size of the iCalendar data, in bytes. Larger
+	// feeds fail to refresh. Zero means 10 MiB.
+	MaxSize int64
+	// HTTPClient is used to fetch the feed. If nil, http.DefaultClient is
+	// used.
+	HTTPClient webdav.HTTPClient
+
+	mu           sync.Mutex
+	objects      []CalendarObject
+	etag         string
+	lastModified string
+	status       FeedStatus
+}
+
+// FeedStatus describes the result of the last refresh of a Feed.
+type FeedStatus struct {
+	// LastRefresh is the time of the last refresh attempt.
+	LastRefresh time.Time
+	// LastSuccess is the time of the last successful refresh.
+	LastSuccess time.Time
+	// Err is the error returned by the last refresh attempt, if any.
+	Err error
+}
+
+// Status returns the status of the feed.
+func (f *Feed) Status() FeedStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Refresh fetches the feed. Unchanged feeds are revalidated with the
+// If-None-Match and If-Modified-Since headers. On error, the objects fetched
+// by the last successful refresh are kept.
+func (f *Feed) Refresh(ctx context.Context) error {
+	err := f.refresh(ctx)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.LastRefresh = time.Now()
+	f.status.Err = err
+	if err == nil {
+		f.status.LastSuccess = f.status.LastRefresh
+	}
+	return err
+}
+
+func (f *Feed) refresh(ctx context.Context) error {
+	if f.Open != nil {
+		return f.load(ctx)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ical.MIMEType)
+
+	f.mu.Lock()
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	f.mu.Unlock()
+
+	c := f.HTTPClient
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("caldav: failed to fetch feed: HTTP %v", resp.Status)
+	}
+
+	data, err := f.readAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	cal, err := ical.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return fmt.Errorf("caldav: failed to parse feed: %w", err)
+	}
+	objects, err := splitFeed(f.Calendar.Path, cal, resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects = objects
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// load reads the feed with Open. Unchanged feeds are detected by comparing
+// their contents with the last successful load.
+func (f *Feed) load(ctx context.Context) error {
+	rc, err := f.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := f.readAll(rc)
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	f.mu.Lock()
+	unchanged := f.etag == etag
+	f.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	var lastModified string
+	if st, ok := rc.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil {
+			lastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+		}
+	}
+
+	cal, err := ical.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return fmt.Errorf("caldav: failed to parse feed: %w", err)
+	}
+	objects, err := splitFeed(f.Calendar.Path, cal, lastModified)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects = objects
+	f.etag = etag
+	f.lastModified = lastModified
+	return nil
+}
+
+// readAll reads the feed data, up to MaxSize bytes.
+func (f *Feed) readAll(r io.Reader) ([]byte, error) {
+	maxSize := f.MaxSize
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("caldav: feed is larger than %v bytes", maxSize)
+	}
+	return data, nil
+}
+
+// OpenFeedFile returns a Feed.Open function reading a file. fs can be an
+// http.Dir to read files from disk, or wrap a file system embedded in the
+// application.
+func OpenFeedFile(fs http.FileSystem, name string) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return fs.Open(name)
+	}
+}
+
+// NewFileFeeds creates a Feed for each ".ics" file in the directory dir of fs,
+// e.g. a bundle of public holiday calendars. Each feed is served as a
+// calendar in homeSetPath, named after the file. The feeds need to be
+// refreshed before use, and pick up changes to the files when refreshed
+// again.
+func NewFileFeeds(fs http.FileSystem, dir, homeSetPath string) ([]*Feed, error) {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	fis, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].Name() < fis[j].Name()
+	})
+
+	var feeds []*Feed
+	for _, fi := range fis {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".ics" {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".ics")
+		feeds = append(feeds, &Feed{
+			Open: OpenFeedFile(fs, path.Join(dir, fi.Name())),
+			Calendar: Calendar{
+				Path:                  path.Join(homeSetPath, name) + "/",
+				Name:                  name,
+				SupportedComponentSet: []string{ical.CompEvent},
+			},
+		})
+	}
+	return feeds, nil
+}
+
+// splitFeed splits a feed into one calendar object per UID. Time zones are
+// copied into each object.
+func splitFeed(calPath string, cal *ical.Calendar, lastModified string) ([]CalendarObject, error) {
+	modTime, _ := http.ParseTime(lastModified)
+
+	var (
+		timezones []*ical.Component
+		uids      []string
+		byUID     = make(map[string]*ical.Calendar)
+	)
+	for _, child := range cal.Children {
+		if child.Name == ical.CompTimezone {
+			timezones = append(timezones, child)
+			continue
+		}
+		uid, err := child.Props.Text(ical.PropUID)
+		if err != nil || uid == "" {
+			continue
+		}
+		obj, ok := byUID[uid]
+		if !ok {
+			obj = ical.NewCalendar()
+			obj.Props = cal.Props
+			uids = append(uids, uid)
+			byUID[uid] = obj
+		}
+		obj.Children = append(obj.Children, child)
+	}
+
+	objects := make([]CalendarObject, 0, len(uids))
+	for _, uid := range uids {
+		obj := byUID[uid]
+		obj.Children = append(append([]*ical.Component(nil), timezones...), obj.Children...)
+
+		var buf bytes.Buffer
+		if err := ical.NewEncoder(&buf).Encode(obj); err != nil {
+			return nil, fmt.Errorf("caldav: failed to encode feed object %q: %w", uid, err)
+		}
+		uidSum := sha1.Sum([]byte(uid))
+		dataSum := sha1.Sum(buf.Bytes())
+		objects = append(objects, CalendarObject{
+			Path:          path.Join(calPath, hex.EncodeToString(uidSum[:])+".ics"),
+			ModTime:       modTime,
+			ContentLength: int64(buf.Len()),
+			ETag:          hex.EncodeToString(dataSum[:]),
+			Data:          obj,
+		})
+	}
+	return objects, nil
+}
+
+func addFeedProps(props map[xml.Name]internal.PropFindFunc, f *Feed) {
+	if f.URL != "" {
+		props[sourceName] = func(*internal.RawXMLValue) (interface{}, error) {
+			href, err := internal.ParseURL(f.URL)
+			if err != nil {
+				return nil, err
+			}
+			return &source{Href: internal.Href(*href)}, nil
+		}
+	}
+	props[feedStatusName] = func(*internal.RawXMLValue) (interface{}, error) {
+		status := f.Status()
+		var prop feedStatus
+		if !status.LastRefresh.IsZero() {
+			t := internal.Time(status.LastRefresh)
+			prop.LastRefresh = &t
+		}
+		if !status.LastSuccess.IsZero() {
+			t := internal.Time(status.LastSuccess)
+			prop.LastSuccess = &t
+		}
+		if status.Err != nil {
+			prop.Error = status.Err.Error()
+		}
+		return &prop, nil
+	}
+}
+
+// Run refreshes the feed periodically, until the context is cancelled.
+// Errors are recorded in the feed status.
+func (f *Feed) Run(ctx context.Context) {
+	interval := f.RefreshInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f.Refresh(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listObjects returns a copy of the feed objects, so that callers can't
+// modify the objects served to other requests.
+func (f *Feed) listObjects() []CalendarObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l := make([]CalendarObject, len(f.objects))
+	for i := range f.objects {
+		l[i] = cloneCalendarObject(&f.objects[i])
+	}
+	return l
+}
+
+// getObject returns a copy of a feed object, or nil if it doesn't exist.
+func (f *Feed) getObject(p string) *CalendarObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.objects {
+		if f.objects[i].Path == p {
+			co := cloneCalendarObject(&f.objects[i])
+			return &co
+		}
+	}
+	return nil
+}
+
+func cloneCalendarObject(co *CalendarObject) CalendarObject {
+	clone := *co
+	clone.Data = &ical.Calendar{Component: cloneComponent(co.Data.Component)}
+	return clone
+}
+
+func cloneComponent(comp *ical.Component) *ical.Component {
+	clone := &ical.Component{
+		Name:     comp.Name,
+		Props:    make(ical.Props, len(comp.Props)),
+		Children: make([]*ical.Component, len(comp.Children)),
+	}
+	for name, props := range comp.Props {
+		l := make([]ical.Prop, len(props))
+		for i, prop := range props {
+			l[i] = prop
+			l[i].Params = make(ical.Params, len(prop.Params))
+			for k, v := range prop.Params {
+				l[i].Params[k] = append([]string(nil), v...)
+			}
+		}
+		clone.Props[name] = l
+	}
+	for i, child := range comp.Children {
+		clone.Children[i] = cloneComponent(child)
+	}
+	return clone
+}
+
+// FeedBackend is a Backend serving feeds next to the calendars of another
+// Backend. Feed calendars are read-only.
+//
+// Optional interfaces implemented by the wrapped Backend are not exposed by
+// FeedBackend, except CalendarCreator: Handler only serves MKCALENDAR if the
+// wrapped Backend implements it.
+type FeedBackend struct {
+	Backend
+	Feeds []*Feed
+}
+
+var (
+	_ Backend         = (*FeedBackend)(nil)
+	_ CalendarCreator = (*FeedBackend)(nil)
+)
+
+func (b *FeedBackend) feed(p string) *Feed {
+	for _, f := range b.Feeds {
+		calPath := strings.TrimSuffix(f.Calendar.Path, "/")
+		if p == calPath || p == calPath+"/" || path.Dir(p) == calPath {
+			return f
+		}
+	}
+	return nil
+}
+
+func (b *FeedBackend) ListCalendars(ctx context.Context) ([]Calendar, error) {
+	cals, err := b.Backend.ListCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range b.Feeds {
+		cals = append(cals, f.Calendar)
+	}
+	return cals, nil
+}
+
+func (b *FeedBackend) GetCalendar(ctx context.Context, path string) (*Calendar, error) {
+	if f := b.feed(path); f != nil {
+		cal := f.Calendar
+		return &cal, nil
+	}
+	return b.Backend.GetCalendar(ctx, path)
+}
+
+func (b *FeedBackend) CreateCalendar(ctx context.Context, calendar Calendar) error {
+	if b.feed(calendar.Path) != nil {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: calendar already exists")
+	}
+	creator, ok := b.Backend.(CalendarCreator)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: creating calendars isn't supported")
+	}
+	return creator.CreateCalendar(ctx, calendar)
+}
+
+func (b *FeedBackend) GetCalendarObject(ctx context.Context, path string, req *CalendarCompRequest) (*CalendarObject, error) {
+	f := b.feed(path)
+	if f == nil {
+		return b.Backend.GetCalendarObject(ctx, path, req)
+	}
+	if co := f.getObject(path); co != nil {
+		return co, nil
+	}
+	return nil, &internal.HTTPError{Code: http.StatusNotFound}
+}
+
+func (b *FeedBackend) ListCalendarObjects(ctx context.Context, path string, req *CalendarCompRequest) ([]CalendarObject, error) {
+	if f := b.feed(path); f != nil {
+		return f.listObjects(), nil
+	}
+	return b.Backend.ListCalendarObjects(ctx, path, req)
+}
+
+func (b *FeedBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
+	if f := b.feed(path); f != nil {
+		return Filter(query, f.listObjects())
+	}
+	return b.Backend.QueryCalendarObjects(ctx, path, query)
+}
+
+func (b *FeedBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (string, error) {
+	if b.feed(path) != nil {
+		return "", internal.HTTPErrorf(http.StatusForbidden, "caldav: feed calendars are read-only")
+	}
+	return b.Backend.PutCalendarObject(ctx, path, calendar, opts)
+}
+
+func (b *FeedBackend) DeleteCalendarObject(ctx context.Context, path string) error {
+	if b.feed(path) != nil {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: feed calendars are read-only")
+	}
+	return b.Backend.DeleteCalendarObject(ctx, path)
+}
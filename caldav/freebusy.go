@@ -0,0 +1,178 @@
+package caldav
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/internal"
+)
+
+const productID = "-//emersion//go-webdav//EN"
+
+// Free/busy types, as defined in RFC 5545 section 3.2.9.
+const (
+	freeBusyTypeBusy          = "BUSY"
+	freeBusyTypeBusyTentative = "BUSY-TENTATIVE"
+)
+
+// freeBusyEventProps lists the VEVENT properties kept in a free/busy view of
+// a calendar object. Everything else (SUMMARY, DESCRIPTION, LOCATION,
+// ATTENDEE and so on) is stripped.
+var freeBusyEventProps = []string{
+	ical.PropUID,
+	ical.PropDateTimeStamp,
+	ical.PropDateTimeStart,
+	ical.PropDateTimeEnd,
+	ical.PropDuration,
+	ical.PropRecurrenceID,
+	ical.PropRecurrenceRule,
+	ical.PropRecurrenceDates,
+	ical.PropExceptionDates,
+	ical.PropTransparency,
+	ical.PropStatus,
+}
+
+var freeBusyCalendarProps = []string{
+	ical.PropVersion,
+	ical.PropProductID,
+	ical.PropCalendarScale,
+}
+
+func copyProps(dst, src ical.Props, names []string) {
+	for _, name := range names {
+		if props, ok := src[name]; ok {
+			dst[name] = append([]ical.Prop(nil), props...)
+		}
+	}
+}
+
+// freeBusyCalendar returns a copy of cal which only contains opaque busy
+// blocks: events are reduced to their timing information, time zones are
+// kept and all other components are dropped.
+func freeBusyCalendar(cal *ical.Calendar) *ical.Calendar {
+	out := ical.NewCalendar()
+	copyProps(out.Props, cal.Props, freeBusyCalendarProps)
+
+	for _, child := range cal.Children {
+		switch child.Name {
+		case ical.CompTimezone, ical.CompFreeBusy:
+			out.Children = append(out.Children, child)
+		case ical.CompEvent:
+			event := ical.NewComponent(ical.CompEvent)
+			copyProps(event.Props, child.Props, freeBusyEventProps)
+			out.Children = append(out.Children, event)
+		}
+	}
+
+	return out
+}
+
+// busyPeriod is a period of time [start, end).
+type busyPeriod struct {
+	start, end time.Time
+}
+
+// mergeBusyPeriods sorts periods and merges the ones overlapping or adjacent.
+func mergeBusyPeriods(l []busyPeriod) []busyPeriod {
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].start.Before(l[j].start)
+	})
+	var merged []busyPeriod
+	for _, p := range l {
+		if n := len(merged); n > 0 && !p.start.After(merged[n-1].end) {
+			if p.end.After(merged[n-1].end) {
+				merged[n-1].end = p.end
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// eventFreeBusyType returns the free/busy type of an event, or an empty
+// string if the event doesn't take up time.
+func eventFreeBusyType(event *ical.Component) string {
+	if transp, _ := event.Props.Text(ical.PropTransparency); strings.EqualFold(transp, "TRANSPARENT") {
+		return ""
+	}
+	status, _ := event.Props.Text(ical.PropStatus)
+	switch strings.ToUpper(status) {
+	case "CANCELLED":
+		return ""
+	case "TENTATIVE":
+		return freeBusyTypeBusyTentative
+	default:
+		return freeBusyTypeBusy
+	}
+}
+
+// freeBusyReport returns a calendar with a single VFREEBUSY component listing
+// the periods of the time range [start, end) taken up by the events of cals,
+// as defined in RFC 4791 section 7.10.
+func freeBusyReport(cals []*ical.Calendar, start, end time.Time) (*ical.Calendar, error) {
+	periods := make(map[string][]busyPeriod)
+	for _, cal := range cals {
+		expanded, err := expandCalendar(cal, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range expanded.Children {
+			if event.Name != ical.CompEvent {
+				continue
+			}
+			fbType := eventFreeBusyType(event)
+			if fbType == "" {
+				continue
+			}
+
+			dur, err := componentDuration(event, time.UTC)
+			if err != nil {
+				return nil, err
+			}
+			instStart, err := event.Props.DateTime(ical.PropDateTimeStart, time.UTC)
+			if err != nil {
+				return nil, err
+			}
+			if dur == 0 || !overlapsTimeRange(start, end, instStart, dur) {
+				continue
+			}
+
+			p := busyPeriod{start: instStart, end: instStart.Add(dur)}
+			if p.start.Before(start) {
+				p.start = start
+			}
+			if p.end.After(end) {
+				p.end = end
+			}
+			periods[fbType] = append(periods[fbType], p)
+		}
+	}
+
+	uid, err := internal.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	fb := ical.NewComponent(ical.CompFreeBusy)
+	fb.Props.SetText(ical.PropUID, uid)
+	fb.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+	fb.Props.SetDateTime(ical.PropDateTimeStart, start.UTC())
+	fb.Props.SetDateTime(ical.PropDateTimeEnd, end.UTC())
+	for _, fbType := range []string{freeBusyTypeBusy, freeBusyTypeBusyTentative} {
+		for _, p := range mergeBusyPeriods(periods[fbType]) {
+			prop := ical.NewProp(ical.PropFreeBusy)
+			prop.Params.Set(ical.ParamFreeBusyType, fbType)
+			prop.Value = p.start.UTC().Format(dateWithUTCTimeLayout) + "/" + p.end.UTC().Format(dateWithUTCTimeLayout)
+			fb.Props.Add(prop)
+		}
+	}
+
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, productID)
+	cal.Children = []*ical.Component{fb}
+	return cal, nil
+}
@@ -0,0 +1,18 @@
+package caldav
+
+import (
+	"context"
+
+	"github.com/emersion/go-webdav"
+)
+
+// BackendProbe returns a webdav.HealthProbe which lists the calendars of a
+// Backend. The probe is called with the context of the health check request:
+// backends which need an authenticated user should be wrapped in a probe
+// adding one to the context.
+func BackendProbe(b Backend) webdav.HealthProbe {
+	return func(ctx context.Context) error {
+		_, err := b.ListCalendars(ctx)
+		return err
+	}
+}
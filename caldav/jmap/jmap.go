@@ -0,0 +1,254 @@
+// Package jmap provides helpers to expose CalDAV backends via JMAP for
+// Calendars.
+//
+// JMAP calendar events are JSCalendar events, see the jscalendar package.
+// Object paths are mapped to JMAP IDs with ID and Path, so that a server
+// offering both protocols can share one caldav.Backend.
+package jmap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/emersion/go-webdav/caldav/jscalendar"
+)
+
+// ProductID is the PRODID of iCalendar objects created from JMAP events.
+const ProductID = "-//emersion//go-webdav//EN"
+
+// ID returns the JMAP ID of a calendar or calendar object path.
+func ID(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+// Path returns the path of a calendar or calendar object from its JMAP ID.
+func Path(id string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", fmt.Errorf("jmap: invalid ID %q", id)
+	}
+	return string(b), nil
+}
+
+// Calendar is a JMAP Calendar object.
+type Calendar struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	SortOrder    uint   `json:"sortOrder"`
+	IsSubscribed bool   `json:"isSubscribed"`
+	IsVisible    bool   `json:"isVisible"`
+}
+
+// NewCalendar converts a CalDAV calendar to a JMAP calendar.
+func NewCalendar(cal *caldav.Calendar) *Calendar {
+	return &Calendar{
+		ID:           ID(cal.Path),
+		Name:         cal.Name,
+		Description:  cal.Description,
+		IsSubscribed: true,
+		IsVisible:    true,
+	}
+}
+
+// CalendarEvent is a JMAP CalendarEvent object.
+type CalendarEvent struct {
+	ID          string          `json:"id"`
+	CalendarIDs map[string]bool `json:"calendarIds"`
+	jscalendar.Event
+}
+
+// NewCalendarEvent converts a CalDAV calendar object containing an event to a
+// JMAP calendar event. Overridden instances are converted to recurrence
+// overrides.
+func NewCalendarEvent(calendarPath string, co *caldav.CalendarObject) (*CalendarEvent, error) {
+	var (
+		master    *ical.Component
+		overrides []*ical.Component
+	)
+	for _, child := range co.Data.Children {
+		switch {
+		case child.Name != ical.CompEvent:
+			continue
+		case child.Props.Get(ical.PropRecurrenceID) != nil:
+			overrides = append(overrides, child)
+		case master == nil:
+			master = child
+		}
+	}
+	if master == nil {
+		return nil, fmt.Errorf("jmap: calendar object %q doesn't contain an event", co.Path)
+	}
+
+	event, err := jscalendar.FromEvents(master, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return &CalendarEvent{
+		ID:          ID(co.Path),
+		CalendarIDs: map[string]bool{ID(calendarPath): true},
+		Event:       *event,
+	}, nil
+}
+
+// NewCalendarData converts a JMAP calendar event to a new iCalendar object,
+// e.g. to be stored with caldav.Backend.PutCalendarObject. Existing calendar
+// objects should be updated with UpdateCalendarData instead.
+func NewCalendarData(event *CalendarEvent) (*ical.Calendar, error) {
+	comps, err := jscalendar.ToEvents(&event.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, ProductID)
+	cal.Children = comps
+	return cal, nil
+}
+
+// eventPropGroups maps JSCalendar event properties to the iCalendar
+// properties they are converted to.
+var eventPropGroups = []struct {
+	fields []string
+	props  []string
+}{
+	{[]string{"uid"}, []string{ical.PropUID}},
+	{[]string{"updated"}, []string{ical.PropLastModified, ical.PropDateTimeStamp}},
+	{[]string{"title"}, []string{ical.PropSummary}},
+	{[]string{"description"}, []string{ical.PropDescription}},
+	{[]string{"locations"}, []string{ical.PropLocation}},
+	{[]string{"keywords"}, []string{ical.PropCategories}},
+	{[]string{"status"}, []string{ical.PropStatus}},
+	{
+		[]string{"start", "timeZone", "showWithoutTime", "duration"},
+		[]string{ical.PropDateTimeStart, ical.PropDateTimeEnd, ical.PropDuration},
+	},
+	{
+		[]string{"recurrenceRules", "excludedRecurrenceRules", "recurrenceOverrides"},
+		[]string{ical.PropRecurrenceRule, "EXRULE", ical.PropRecurrenceDates, ical.PropExceptionDates},
+	},
+}
+
+// UpdateCalendarData applies a JMAP calendar event to the iCalendar object it
+// was converted from. Only the iCalendar properties whose JSCalendar
+// counterpart changed are replaced: other properties and components, e.g.
+// attendees, alarms, time zones and non-standard properties, are preserved.
+func UpdateCalendarData(data *ical.Calendar, event *CalendarEvent) (*ical.Calendar, error) {
+	comps, err := jscalendar.ToEvents(&event.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	cal := ical.NewCalendar()
+	cal.Props = copyProps(data.Props)
+	var master *ical.Component
+	overrides := make(map[int64]*ical.Component)
+	for _, child := range data.Children {
+		switch {
+		case child.Name != ical.CompEvent:
+			cal.Children = append(cal.Children, child)
+		case child.Props.Get(ical.PropRecurrenceID) != nil:
+			t, err := child.Props.DateTime(ical.PropRecurrenceID, time.UTC)
+			if err != nil {
+				return nil, err
+			}
+			overrides[t.Unix()] = child
+		case master == nil:
+			master = child
+		}
+	}
+	if master == nil {
+		return nil, fmt.Errorf("jmap: calendar data doesn't contain an event")
+	}
+
+	for i, comp := range comps {
+		orig := master
+		if i > 0 {
+			t, err := comp.Props.DateTime(ical.PropRecurrenceID, time.UTC)
+			if err != nil {
+				return nil, err
+			}
+			if orig = overrides[t.Unix()]; orig == nil {
+				cal.Children = append(cal.Children, comp)
+				continue
+			}
+		}
+
+		comp, err := patchComponent(orig, comp)
+		if err != nil {
+			return nil, err
+		}
+		cal.Children = append(cal.Children, comp)
+	}
+
+	return cal, nil
+}
+
+// patchComponent returns a copy of orig with the properties which differ in
+// their JSCalendar representation replaced by the ones of updated.
+func patchComponent(orig, updated *ical.Component) (*ical.Component, error) {
+	before, err := eventObject(orig)
+	if err != nil {
+		return nil, err
+	}
+	after, err := eventObject(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := &ical.Component{
+		Name:     orig.Name,
+		Props:    copyProps(orig.Props),
+		Children: orig.Children,
+	}
+	for _, g := range eventPropGroups {
+		changed := false
+		for _, k := range g.fields {
+			if !reflect.DeepEqual(before[k], after[k]) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		for _, name := range g.props {
+			delete(comp.Props, name)
+			if l := updated.Props[name]; len(l) > 0 {
+				comp.Props[name] = l
+			}
+		}
+	}
+	return comp, nil
+}
+
+// eventObject returns the JSON object of the JSCalendar event a VEVENT
+// component is converted to.
+func eventObject(comp *ical.Component) (map[string]interface{}, error) {
+	event, err := jscalendar.FromEvent(comp)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func copyProps(props ical.Props) ical.Props {
+	c := make(ical.Props, len(props))
+	for name, l := range props {
+		c[name] = append([]ical.Prop(nil), l...)
+	}
+	return c
+}
@@ -0,0 +1,96 @@
+package jmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+const testCalendarData = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+X-WR-CALNAME:Work
+BEGIN:VEVENT
+UID:weekly@example.com
+DTSTAMP:20200101T090000Z
+DTSTART;TZID=Europe/Paris:20200106T100000
+DTEND;TZID=Europe/Paris:20200106T110000
+SUMMARY:Weekly meeting
+LOCATION;ALTREP="http://example.com/room":Room 1
+RRULE:FREQ=WEEKLY;COUNT=10
+ATTENDEE;CN=Alice:mailto:alice@example.com
+X-CUSTOM:foo
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:-PT15M
+DESCRIPTION:Reminder
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly@example.com
+DTSTAMP:20200101T090000Z
+RECURRENCE-ID:20200113T090000Z
+DTSTART;TZID=Europe/Paris:20200113T110000
+DTEND;TZID=Europe/Paris:20200113T120000
+SUMMARY:Weekly meeting
+ATTENDEE;CN=Bob:mailto:bob@example.com
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestUpdateCalendarData(t *testing.T) {
+	data, err := ical.NewDecoder(strings.NewReader(strings.ReplaceAll(testCalendarData, "\n", "\r\n"))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := NewCalendarEvent("/cal/", &caldav.CalendarObject{Path: "/cal/weekly.ics", Data: data})
+	if err != nil {
+		t.Fatalf("NewCalendarEvent() = %v", err)
+	}
+	if len(event.RecurrenceRules) != 1 || len(event.RecurrenceOverrides) != 1 {
+		t.Fatalf("NewCalendarEvent() = %+v", event)
+	}
+	event.Title = "Team meeting"
+
+	updated, err := UpdateCalendarData(data, event)
+	if err != nil {
+		t.Fatalf("UpdateCalendarData() = %v", err)
+	}
+	if len(updated.Children) != 2 {
+		t.Fatalf("UpdateCalendarData() returned %v components, want 2", len(updated.Children))
+	}
+	if name, _ := updated.Props.Text("X-WR-CALNAME"); name != "Work" {
+		t.Errorf("UpdateCalendarData() X-WR-CALNAME = %q", name)
+	}
+
+	master := updated.Children[0]
+	if summary, _ := master.Props.Text(ical.PropSummary); summary != "Team meeting" {
+		t.Errorf("UpdateCalendarData() SUMMARY = %q", summary)
+	}
+	for _, name := range []string{ical.PropAttendee, "X-CUSTOM", ical.PropDateTimeEnd, ical.PropRecurrenceRule} {
+		if master.Props.Get(name) == nil {
+			t.Errorf("UpdateCalendarData() dropped %v", name)
+		}
+	}
+	if prop := master.Props.Get(ical.PropLocation); prop == nil || prop.Params.Get("ALTREP") == "" {
+		t.Errorf("UpdateCalendarData() LOCATION = %+v", prop)
+	}
+	if len(master.Children) != 1 || master.Children[0].Name != ical.CompAlarm {
+		t.Errorf("UpdateCalendarData() dropped VALARM")
+	}
+
+	override := updated.Children[1]
+	if summary, _ := override.Props.Text(ical.PropSummary); summary != "Team meeting" {
+		t.Errorf("UpdateCalendarData() override SUMMARY = %q", summary)
+	}
+	if prop := override.Props.Get(ical.PropAttendee); prop == nil || prop.Value != "mailto:bob@example.com" {
+		t.Errorf("UpdateCalendarData() override ATTENDEE = %+v", prop)
+	}
+
+	if summary, _ := data.Children[0].Props.Text(ical.PropSummary); summary != "Weekly meeting" {
+		t.Errorf("UpdateCalendarData() modified the original calendar data")
+	}
+}
@@ -0,0 +1,620 @@
+// Package jscalendar converts between iCalendar and JSCalendar events and
+// tasks.
+//
+// JSCalendar is defined in RFC 8984. Only the most common properties are
+// converted. Recurring events are converted with FromEvents and ToEvents, to
+// account for overridden instances.
+package jscalendar
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+const (
+	localDateTimeLayout = "2006-01-02T15:04:05"
+	utcDateTimeLayout   = "2006-01-02T15:04:05Z"
+
+	icalDateLayout     = "20060102"
+	icalDateTimeLayout = "20060102T150405"
+)
+
+// UTCTimeZone is the time zone of events with UTC date-times.
+const UTCTimeZone = "Etc/UTC"
+
+// Location is a JSCalendar location.
+type Location struct {
+	Type string `json:"@type"`
+	Name string `json:"name,omitempty"`
+}
+
+// Event is a JSCalendar event.
+type Event struct {
+	Type        string              `json:"@type"`
+	UID         string              `json:"uid"`
+	Updated     string              `json:"updated,omitempty"`
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Locations   map[string]Location `json:"locations,omitempty"`
+	Keywords    map[string]bool     `json:"keywords,omitempty"`
+	Status      string              `json:"status,omitempty"`
+
+	// Start is a local date-time, e.g. "2006-01-02T15:04:05".
+	Start string `json:"start"`
+	// TimeZone is the IANA time zone of Start. Empty means floating time.
+	TimeZone        string `json:"timeZone,omitempty"`
+	Duration        string `json:"duration,omitempty"`
+	ShowWithoutTime bool   `json:"showWithoutTime,omitempty"`
+
+	RecurrenceRules         []RecurrenceRule `json:"recurrenceRules,omitempty"`
+	ExcludedRecurrenceRules []RecurrenceRule `json:"excludedRecurrenceRules,omitempty"`
+	// RecurrenceOverrides is keyed by recurrence ID, i.e. the local start
+	// date-time of an instance. Empty patches add instances, and patches
+	// setting "excluded" remove them.
+	RecurrenceOverrides map[string]PatchObject `json:"recurrenceOverrides,omitempty"`
+}
+
+// FromEvent converts an iCalendar VEVENT component to a JSCalendar event.
+func FromEvent(comp *ical.Component) (*Event, error) {
+	if comp.Name != ical.CompEvent {
+		return nil, fmt.Errorf("jscalendar: expected %v component, got %v", ical.CompEvent, comp.Name)
+	}
+
+	uid, err := comp.Props.Text(ical.PropUID)
+	if err != nil {
+		return nil, err
+	}
+	event := &Event{Type: "Event", UID: uid}
+
+	if event.Title, err = comp.Props.Text(ical.PropSummary); err != nil {
+		return nil, err
+	}
+	if event.Description, err = comp.Props.Text(ical.PropDescription); err != nil {
+		return nil, err
+	}
+	if loc, err := comp.Props.Text(ical.PropLocation); err != nil {
+		return nil, err
+	} else if loc != "" {
+		event.Locations = map[string]Location{"1": {Type: "Location", Name: loc}}
+	}
+	if event.Keywords, err = keywordsFromComponent(comp); err != nil {
+		return nil, err
+	}
+	if status := comp.Props.Get(ical.PropStatus); status != nil {
+		event.Status = strings.ToLower(status.Value)
+	}
+
+	if event.Updated, err = updatedFromComponent(comp); err != nil {
+		return nil, err
+	}
+
+	dtstart := comp.Props.Get(ical.PropDateTimeStart)
+	if dtstart == nil {
+		return nil, fmt.Errorf("jscalendar: missing %v", ical.PropDateTimeStart)
+	}
+	start, err := parseICalDateTime(dtstart)
+	if err != nil {
+		return nil, err
+	}
+	event.Start = start.Format(localDateTimeLayout)
+	event.ShowWithoutTime = dtstart.ValueType() == ical.ValueDate
+	if !event.ShowWithoutTime {
+		if tzid := dtstart.Params.Get(ical.PropTimezoneID); tzid != "" {
+			event.TimeZone = tzid
+		} else if strings.HasSuffix(dtstart.Value, "Z") {
+			event.TimeZone = UTCTimeZone
+		}
+	}
+
+	if dur := comp.Props.Get(ical.PropDuration); dur != nil {
+		d, err := dur.Duration()
+		if err != nil {
+			return nil, err
+		}
+		event.Duration = FormatDuration(d)
+	} else if dtend := comp.Props.Get(ical.PropDateTimeEnd); dtend != nil {
+		var end time.Time
+		if dtend.Params.Get(ical.PropTimezoneID) == dtstart.Params.Get(ical.PropTimezoneID) {
+			end, err = parseICalDateTime(dtend)
+		} else {
+			// Compare absolute times when time zones differ
+			start, err = dtstart.DateTime(time.UTC)
+			if err == nil {
+				end, err = dtend.DateTime(time.UTC)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		event.Duration = FormatDuration(end.Sub(start))
+	}
+
+	rec, err := recurrenceFromComponent(comp, event.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	event.RecurrenceRules = rec.rules
+	event.ExcludedRecurrenceRules = rec.excludedRules
+	event.RecurrenceOverrides = rec.overrides
+
+	return event, nil
+}
+
+// FromEvents converts a recurring iCalendar VEVENT component and the VEVENT
+// components overriding some of its instances, identified by their
+// RECURRENCE-ID property, to a JSCalendar event.
+func FromEvents(master *ical.Component, overrides []*ical.Component) (*Event, error) {
+	event, err := FromEvent(master)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comp := range overrides {
+		prop := comp.Props.Get(ical.PropRecurrenceID)
+		if prop == nil {
+			return nil, fmt.Errorf("jscalendar: missing %v in overridden instance", ical.PropRecurrenceID)
+		}
+		id, err := recurrenceIDFromProp(prop, prop.Value, event.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+
+		instance, err := FromEvent(comp)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := instancePatch(event, instance, id)
+		if err != nil {
+			return nil, err
+		}
+		if event.RecurrenceOverrides == nil {
+			event.RecurrenceOverrides = make(map[string]PatchObject)
+		}
+		event.RecurrenceOverrides[id] = patch
+	}
+
+	return event, nil
+}
+
+// ToEvent converts a JSCalendar event to an iCalendar VEVENT component. Events
+// with modified instances need to be converted with ToEvents.
+func ToEvent(event *Event) (*ical.Component, error) {
+	for id, patch := range event.RecurrenceOverrides {
+		if patch.modified() {
+			return nil, fmt.Errorf("jscalendar: event has a modified instance at %v", id)
+		}
+	}
+	return toEvent(event)
+}
+
+// ToEvents converts a JSCalendar event to iCalendar VEVENT components. The
+// first component is the event itself, followed by one component per modified
+// instance.
+func ToEvents(event *Event) ([]*ical.Component, error) {
+	master, err := toEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	comps := []*ical.Component{master}
+
+	ids := make([]string, 0, len(event.RecurrenceOverrides))
+	for id, patch := range event.RecurrenceOverrides {
+		if patch.modified() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		instance, err := applyPatch(event, id, event.RecurrenceOverrides[id])
+		if err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(localDateTimeLayout, id)
+		if err != nil {
+			return nil, fmt.Errorf("jscalendar: invalid recurrence ID: %w", err)
+		}
+
+		comp, err := toEvent(instance)
+		if err != nil {
+			return nil, err
+		}
+		comp.Props.Set(dateTimeProp(ical.PropRecurrenceID, t, event.TimeZone, event.ShowWithoutTime))
+		comps = append(comps, comp)
+	}
+
+	return comps, nil
+}
+
+func toEvent(event *Event) (*ical.Component, error) {
+	start, err := time.Parse(localDateTimeLayout, event.Start)
+	if err != nil {
+		return nil, fmt.Errorf("jscalendar: invalid start: %w", err)
+	}
+
+	comp := ical.NewComponent(ical.CompEvent)
+	comp.Props.SetText(ical.PropUID, event.UID)
+
+	if err := setCommonProps(comp, event.Updated, event.Title, event.Description, event.Keywords); err != nil {
+		return nil, err
+	}
+	for _, loc := range event.Locations {
+		if loc.Name != "" {
+			comp.Props.SetText(ical.PropLocation, loc.Name)
+			break
+		}
+	}
+	if event.Status != "" {
+		prop := ical.NewProp(ical.PropStatus)
+		prop.Value = strings.ToUpper(event.Status)
+		comp.Props.Set(prop)
+	}
+
+	comp.Props.Set(dateTimeProp(ical.PropDateTimeStart, start, event.TimeZone, event.ShowWithoutTime))
+
+	if event.Duration != "" {
+		d, err := ParseDuration(event.Duration)
+		if err != nil {
+			return nil, err
+		}
+		comp.Props.Set(durationProp(d))
+	}
+
+	rec := &recurrence{
+		rules:         event.RecurrenceRules,
+		excludedRules: event.ExcludedRecurrenceRules,
+		overrides:     event.RecurrenceOverrides,
+	}
+	if err := setRecurrenceProps(comp, rec, event.TimeZone, event.ShowWithoutTime); err != nil {
+		return nil, err
+	}
+
+	return comp, nil
+}
+
+// Task is a JSCalendar task.
+type Task struct {
+	Type            string          `json:"@type"`
+	UID             string          `json:"uid"`
+	Updated         string          `json:"updated,omitempty"`
+	Title           string          `json:"title,omitempty"`
+	Description     string          `json:"description,omitempty"`
+	Keywords        map[string]bool `json:"keywords,omitempty"`
+	Progress        string          `json:"progress,omitempty"`
+	PercentComplete int             `json:"percentComplete,omitempty"`
+
+	// Start and Due are local date-times, e.g. "2006-01-02T15:04:05".
+	Start string `json:"start,omitempty"`
+	Due   string `json:"due,omitempty"`
+	// TimeZone is the IANA time zone of Start and Due. Empty means floating
+	// time.
+	TimeZone          string `json:"timeZone,omitempty"`
+	EstimatedDuration string `json:"estimatedDuration,omitempty"`
+	ShowWithoutTime   bool   `json:"showWithoutTime,omitempty"`
+
+	RecurrenceRules         []RecurrenceRule `json:"recurrenceRules,omitempty"`
+	ExcludedRecurrenceRules []RecurrenceRule `json:"excludedRecurrenceRules,omitempty"`
+	// RecurrenceOverrides is keyed by recurrence ID, see Event. Modified
+	// instances aren't supported for tasks.
+	RecurrenceOverrides map[string]PatchObject `json:"recurrenceOverrides,omitempty"`
+}
+
+// FromTask converts an iCalendar VTODO component to a JSCalendar task.
+func FromTask(comp *ical.Component) (*Task, error) {
+	if comp.Name != ical.CompToDo {
+		return nil, fmt.Errorf("jscalendar: expected %v component, got %v", ical.CompToDo, comp.Name)
+	}
+
+	uid, err := comp.Props.Text(ical.PropUID)
+	if err != nil {
+		return nil, err
+	}
+	task := &Task{Type: "Task", UID: uid}
+
+	if task.Title, err = comp.Props.Text(ical.PropSummary); err != nil {
+		return nil, err
+	}
+	if task.Description, err = comp.Props.Text(ical.PropDescription); err != nil {
+		return nil, err
+	}
+	if task.Keywords, err = keywordsFromComponent(comp); err != nil {
+		return nil, err
+	}
+	if task.Updated, err = updatedFromComponent(comp); err != nil {
+		return nil, err
+	}
+	if status := comp.Props.Get(ical.PropStatus); status != nil {
+		// VTODO statuses have the same names as JSCalendar progress values
+		task.Progress = strings.ToLower(status.Value)
+	}
+	if prop := comp.Props.Get(ical.PropPercentComplete); prop != nil {
+		if task.PercentComplete, err = prop.Int(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{
+		{ical.PropDateTimeStart, &task.Start},
+		{ical.PropDue, &task.Due},
+	} {
+		prop := comp.Props.Get(p.name)
+		if prop == nil {
+			continue
+		}
+		t, err := parseICalDateTime(prop)
+		if err != nil {
+			return nil, err
+		}
+		*p.dst = t.Format(localDateTimeLayout)
+		task.ShowWithoutTime = prop.ValueType() == ical.ValueDate
+		if tzid := prop.Params.Get(ical.PropTimezoneID); tzid != "" {
+			task.TimeZone = tzid
+		} else if strings.HasSuffix(prop.Value, "Z") {
+			task.TimeZone = UTCTimeZone
+		}
+	}
+
+	if dur := comp.Props.Get(ical.PropDuration); dur != nil {
+		d, err := dur.Duration()
+		if err != nil {
+			return nil, err
+		}
+		task.EstimatedDuration = FormatDuration(d)
+	}
+
+	rec, err := recurrenceFromComponent(comp, task.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	task.RecurrenceRules = rec.rules
+	task.ExcludedRecurrenceRules = rec.excludedRules
+	task.RecurrenceOverrides = rec.overrides
+
+	return task, nil
+}
+
+// ToTask converts a JSCalendar task to an iCalendar VTODO component.
+func ToTask(task *Task) (*ical.Component, error) {
+	comp := ical.NewComponent(ical.CompToDo)
+	comp.Props.SetText(ical.PropUID, task.UID)
+
+	if err := setCommonProps(comp, task.Updated, task.Title, task.Description, task.Keywords); err != nil {
+		return nil, err
+	}
+	if task.Progress != "" && task.Progress != "failed" {
+		prop := ical.NewProp(ical.PropStatus)
+		prop.Value = strings.ToUpper(task.Progress)
+		comp.Props.Set(prop)
+	}
+	if task.PercentComplete > 0 {
+		prop := ical.NewProp(ical.PropPercentComplete)
+		prop.Value = strconv.Itoa(task.PercentComplete)
+		comp.Props.Set(prop)
+	}
+
+	for _, p := range []struct {
+		name  string
+		value string
+	}{
+		{ical.PropDateTimeStart, task.Start},
+		{ical.PropDue, task.Due},
+	} {
+		if p.value == "" {
+			continue
+		}
+		t, err := time.Parse(localDateTimeLayout, p.value)
+		if err != nil {
+			return nil, fmt.Errorf("jscalendar: invalid %v: %w", strings.ToLower(p.name), err)
+		}
+		comp.Props.Set(dateTimeProp(p.name, t, task.TimeZone, task.ShowWithoutTime))
+	}
+
+	// DUE and DURATION are mutually exclusive in VTODO
+	if task.EstimatedDuration != "" && task.Due == "" && task.Start != "" {
+		d, err := ParseDuration(task.EstimatedDuration)
+		if err != nil {
+			return nil, err
+		}
+		comp.Props.Set(durationProp(d))
+	}
+
+	rec := &recurrence{
+		rules:         task.RecurrenceRules,
+		excludedRules: task.ExcludedRecurrenceRules,
+		overrides:     task.RecurrenceOverrides,
+	}
+	for id, patch := range rec.overrides {
+		if patch.modified() {
+			return nil, fmt.Errorf("jscalendar: unsupported modified task instance at %v", id)
+		}
+	}
+	if err := setRecurrenceProps(comp, rec, task.TimeZone, task.ShowWithoutTime); err != nil {
+		return nil, err
+	}
+
+	return comp, nil
+}
+
+func updatedFromComponent(comp *ical.Component) (string, error) {
+	updated := comp.Props.Get(ical.PropLastModified)
+	if updated == nil {
+		updated = comp.Props.Get(ical.PropDateTimeStamp)
+	}
+	if updated == nil {
+		return "", nil
+	}
+	t, err := updated.DateTime(time.UTC)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(utcDateTimeLayout), nil
+}
+
+func keywordsFromComponent(comp *ical.Component) (map[string]bool, error) {
+	prop := comp.Props.Get(ical.PropCategories)
+	if prop == nil {
+		return nil, nil
+	}
+	l, err := prop.TextList()
+	if err != nil {
+		return nil, err
+	}
+	keywords := make(map[string]bool, len(l))
+	for _, k := range l {
+		keywords[k] = true
+	}
+	return keywords, nil
+}
+
+func setCommonProps(comp *ical.Component, updated, title, description string, keywords map[string]bool) error {
+	stamp := time.Now().UTC()
+	if updated != "" {
+		var err error
+		stamp, err = time.Parse(utcDateTimeLayout, updated)
+		if err != nil {
+			return fmt.Errorf("jscalendar: invalid updated: %w", err)
+		}
+		comp.Props.SetDateTime(ical.PropLastModified, stamp)
+	}
+	comp.Props.SetDateTime(ical.PropDateTimeStamp, stamp)
+
+	if title != "" {
+		comp.Props.SetText(ical.PropSummary, title)
+	}
+	if description != "" {
+		comp.Props.SetText(ical.PropDescription, description)
+	}
+	if len(keywords) > 0 {
+		var l []string
+		for k, ok := range keywords {
+			if ok {
+				l = append(l, k)
+			}
+		}
+		sort.Strings(l)
+		prop := ical.NewProp(ical.PropCategories)
+		prop.SetTextList(l)
+		comp.Props.Set(prop)
+	}
+	return nil
+}
+
+func dateTimeProp(name string, t time.Time, timeZone string, withoutTime bool) *ical.Prop {
+	prop := ical.NewProp(name)
+	switch {
+	case withoutTime:
+		prop.SetValueType(ical.ValueDate)
+		prop.Value = t.Format(icalDateLayout)
+	case timeZone == UTCTimeZone:
+		prop.Value = t.Format(icalDateTimeLayout) + "Z"
+	default:
+		prop.Value = t.Format(icalDateTimeLayout)
+		if timeZone != "" {
+			prop.Params.Set(ical.PropTimezoneID, timeZone)
+		}
+	}
+	return prop
+}
+
+func durationProp(d time.Duration) *ical.Prop {
+	prop := ical.NewProp(ical.PropDuration)
+	prop.SetDuration(d)
+	return prop
+}
+
+// parseICalDateTime parses a DATE or DATE-TIME value as a local date-time,
+// ignoring its time zone.
+func parseICalDateTime(prop *ical.Prop) (time.Time, error) {
+	if prop.ValueType() == ical.ValueDate {
+		return time.Parse(icalDateLayout, prop.Value)
+	}
+	return time.Parse(icalDateTimeLayout, strings.TrimSuffix(prop.Value, "Z"))
+}
+
+// FormatDuration formats a duration as an ISO 8601 duration, e.g. "PT1H30M".
+// Negative durations are formatted as zero.
+func FormatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "PT0S"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("P")
+	if days := d / (24 * time.Hour); days > 0 {
+		sb.WriteString(strconv.FormatInt(int64(days), 10) + "D")
+		d -= days * 24 * time.Hour
+	}
+	if d > 0 {
+		sb.WriteString("T")
+		if h := d / time.Hour; h > 0 {
+			sb.WriteString(strconv.FormatInt(int64(h), 10) + "H")
+			d -= h * time.Hour
+		}
+		if m := d / time.Minute; m > 0 {
+			sb.WriteString(strconv.FormatInt(int64(m), 10) + "M")
+			d -= m * time.Minute
+		}
+		if s := d / time.Second; s > 0 {
+			sb.WriteString(strconv.FormatInt(int64(s), 10) + "S")
+		}
+	}
+	return sb.String()
+}
+
+// ParseDuration parses an ISO 8601 duration such as "P1DT2H", as used by
+// JSCalendar.
+func ParseDuration(s string) (time.Duration, error) {
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, fmt.Errorf("jscalendar: invalid duration %q", s)
+	}
+
+	var (
+		d      time.Duration
+		inTime bool
+		num    string
+	)
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		case c == 'T' && !inTime && num == "":
+			inTime = true
+			continue
+		}
+
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("jscalendar: invalid duration %q", s)
+		}
+		num = ""
+
+		var unit time.Duration
+		switch {
+		case c == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case c == 'H' && inTime:
+			unit = time.Hour
+		case c == 'M' && inTime:
+			unit = time.Minute
+		case c == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("jscalendar: invalid duration %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	if num != "" {
+		return 0, fmt.Errorf("jscalendar: invalid duration %q", s)
+	}
+	return d, nil
+}
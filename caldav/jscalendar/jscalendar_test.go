@@ -0,0 +1,233 @@
+package jscalendar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+const testEvent = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:19970901T130000Z-123401@example.com
+DTSTAMP:19970901T130000Z
+DTSTART;TZID=Europe/Paris:19970903T163000
+DTEND;TZID=Europe/Paris:19970903T190000
+SUMMARY:Annual Employee Review
+LOCATION:Room 1
+CATEGORIES:BUSINESS,HUMAN RESOURCES
+STATUS:CONFIRMED
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestFromEvent(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(strings.ReplaceAll(testEvent, "\n", "\r\n"))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := FromEvent(cal.Children[0])
+	if err != nil {
+		t.Fatalf("FromEvent() = %v", err)
+	}
+	if event.Start != "1997-09-03T16:30:00" || event.TimeZone != "Europe/Paris" || event.Duration != "PT2H30M" {
+		t.Errorf("FromEvent() start = %q %q %q", event.Start, event.TimeZone, event.Duration)
+	}
+	if event.Title != "Annual Employee Review" || event.Status != "confirmed" || event.Updated != "1997-09-01T13:00:00Z" {
+		t.Errorf("FromEvent() = %+v", event)
+	}
+	if event.Locations["1"].Name != "Room 1" || !event.Keywords["HUMAN RESOURCES"] {
+		t.Errorf("FromEvent() locations = %v, keywords = %v", event.Locations, event.Keywords)
+	}
+
+	comp, err := ToEvent(event)
+	if err != nil {
+		t.Fatalf("ToEvent() = %v", err)
+	}
+	roundTrip, err := FromEvent(comp)
+	if err != nil {
+		t.Fatalf("FromEvent() = %v", err)
+	}
+	if roundTrip.Start != event.Start || roundTrip.TimeZone != event.TimeZone || roundTrip.Duration != event.Duration || roundTrip.Title != event.Title {
+		t.Errorf("round trip = %+v, want %+v", roundTrip, event)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		d time.Duration
+	}{
+		{"PT0S", 0},
+		{"PT1H30M", 90 * time.Minute},
+		{"P1DT2H", 26 * time.Hour},
+		{"P1W", 7 * 24 * time.Hour},
+	} {
+		d, err := ParseDuration(tc.s)
+		if err != nil || d != tc.d {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", tc.s, d, err, tc.d)
+		}
+		if tc.s != "P1W" && FormatDuration(tc.d) != tc.s {
+			t.Errorf("FormatDuration(%v) = %q, want %q", tc.d, FormatDuration(tc.d), tc.s)
+		}
+	}
+
+	for _, s := range []string{"", "P", "PT", "1H", "PT1D", "P1H", "PT1"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Errorf("ParseDuration(%q) succeeded", s)
+		}
+	}
+}
+
+func TestTask(t *testing.T) {
+	comp := ical.NewComponent(ical.CompToDo)
+	comp.Props.SetText(ical.PropUID, "task-1")
+	comp.Props.SetText(ical.PropSummary, "Submit report")
+	due := ical.NewProp(ical.PropDue)
+	due.SetValueType(ical.ValueDate)
+	due.Value = "20200115"
+	comp.Props.Set(due)
+	status := ical.NewProp(ical.PropStatus)
+	status.Value = "IN-PROCESS"
+	comp.Props.Set(status)
+
+	task, err := FromTask(comp)
+	if err != nil {
+		t.Fatalf("FromTask() = %v", err)
+	}
+	if task.Due != "2020-01-15T00:00:00" || !task.ShowWithoutTime || task.Progress != "in-process" || task.Title != "Submit report" {
+		t.Errorf("FromTask() = %+v", task)
+	}
+
+	comp, err = ToTask(task)
+	if err != nil {
+		t.Fatalf("ToTask() = %v", err)
+	}
+	if prop := comp.Props.Get(ical.PropDue); prop == nil || prop.Value != "20200115" || prop.ValueType() != ical.ValueDate {
+		t.Errorf("ToTask() DUE = %+v", prop)
+	}
+	if prop := comp.Props.Get(ical.PropStatus); prop == nil || prop.Value != "IN-PROCESS" {
+		t.Errorf("ToTask() STATUS = %+v", prop)
+	}
+}
+
+const testRecurringEvent = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:weekly@example.com
+DTSTAMP:20200101T090000Z
+DTSTART;TZID=Europe/Paris:20200106T100000
+DURATION:PT1H
+SUMMARY:Weekly meeting
+RRULE:FREQ=WEEKLY;COUNT=10;BYDAY=MO,-1FR
+RDATE;TZID=Europe/Paris:20200108T100000
+EXDATE:20200113T090000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly@example.com
+DTSTAMP:20200101T090000Z
+RECURRENCE-ID;TZID=Europe/Paris:20200120T100000
+DTSTART;TZID=Europe/Paris:20200120T110000
+DURATION:PT1H
+SUMMARY:Weekly meeting (moved)
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestRecurringEvent(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(strings.ReplaceAll(testRecurringEvent, "\n", "\r\n"))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ToEvent(&Event{Start: "2020-01-06T10:00:00", RecurrenceOverrides: map[string]PatchObject{
+		"2020-01-13T10:00:00": {"title": "Other"},
+	}}); err == nil {
+		t.Errorf("ToEvent() with a modified instance succeeded")
+	}
+
+	event, err := FromEvents(cal.Children[0], cal.Children[1:])
+	if err != nil {
+		t.Fatalf("FromEvents() = %v", err)
+	}
+	if len(event.RecurrenceRules) != 1 {
+		t.Fatalf("FromEvents() recurrence rules = %+v", event.RecurrenceRules)
+	}
+	rule := event.RecurrenceRules[0]
+	if rule.Frequency != "weekly" || rule.Count != 10 || len(rule.ByDay) != 2 || rule.ByDay[1] != (NDay{Type: "NDay", Day: "fr", NthOfPeriod: -1}) {
+		t.Errorf("FromEvents() recurrence rule = %+v", rule)
+	}
+	wantOverrides := map[string]PatchObject{
+		"2020-01-08T10:00:00": {},
+		"2020-01-13T10:00:00": {"excluded": true},
+		"2020-01-20T10:00:00": {"start": "2020-01-20T11:00:00", "title": "Weekly meeting (moved)"},
+	}
+	if !reflect.DeepEqual(event.RecurrenceOverrides, wantOverrides) {
+		t.Errorf("FromEvents() recurrence overrides = %v, want %v", event.RecurrenceOverrides, wantOverrides)
+	}
+
+	comps, err := ToEvents(event)
+	if err != nil {
+		t.Fatalf("ToEvents() = %v", err)
+	}
+	if len(comps) != 2 {
+		t.Fatalf("ToEvents() returned %v components, want 2", len(comps))
+	}
+	if prop := comps[0].Props.Get(ical.PropRecurrenceRule); prop == nil || prop.Value != "FREQ=WEEKLY;COUNT=10;BYDAY=MO,-1FR" {
+		t.Errorf("ToEvents() RRULE = %+v", prop)
+	}
+	if l := comps[0].Props[ical.PropRecurrenceDates]; len(l) != 1 || l[0].Value != "20200108T100000" {
+		t.Errorf("ToEvents() RDATE = %+v", l)
+	}
+	if prop := comps[0].Props.Get(ical.PropExceptionDates); prop == nil || prop.Value != "20200113T100000" || prop.Params.Get(ical.PropTimezoneID) != "Europe/Paris" {
+		t.Errorf("ToEvents() EXDATE = %+v", prop)
+	}
+	if prop := comps[1].Props.Get(ical.PropRecurrenceID); prop == nil || prop.Value != "20200120T100000" {
+		t.Errorf("ToEvents() RECURRENCE-ID = %+v", prop)
+	}
+	if prop := comps[1].Props.Get(ical.PropDateTimeStart); prop == nil || prop.Value != "20200120T110000" {
+		t.Errorf("ToEvents() override DTSTART = %+v", prop)
+	}
+
+	roundTrip, err := FromEvents(comps[0], comps[1:])
+	if err != nil {
+		t.Fatalf("FromEvents() = %v", err)
+	}
+	if !reflect.DeepEqual(roundTrip.RecurrenceOverrides, wantOverrides) || !reflect.DeepEqual(roundTrip.RecurrenceRules, event.RecurrenceRules) {
+		t.Errorf("round trip = %+v, want %+v", roundTrip, event)
+	}
+}
+
+func TestRecurrenceUntil(t *testing.T) {
+	comp := ical.NewComponent(ical.CompEvent)
+	comp.Props.SetText(ical.PropUID, "daily")
+	dtstart := ical.NewProp(ical.PropDateTimeStart)
+	dtstart.Params.Set(ical.PropTimezoneID, "America/New_York")
+	dtstart.Value = "20200601T090000"
+	comp.Props.Set(dtstart)
+	rrule := ical.NewProp(ical.PropRecurrenceRule)
+	rrule.Value = "FREQ=DAILY;UNTIL=20200610T130000Z"
+	comp.Props.Set(rrule)
+
+	event, err := FromEvent(comp)
+	if err != nil {
+		t.Fatalf("FromEvent() = %v", err)
+	}
+	if until := event.RecurrenceRules[0].Until; until != "2020-06-10T09:00:00" {
+		t.Errorf("FromEvent() until = %q", until)
+	}
+
+	comp, err = ToEvent(event)
+	if err != nil {
+		t.Fatalf("ToEvent() = %v", err)
+	}
+	if prop := comp.Props.Get(ical.PropRecurrenceRule); prop == nil || prop.Value != rrule.Value {
+		t.Errorf("ToEvent() RRULE = %+v", prop)
+	}
+}
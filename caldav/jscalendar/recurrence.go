@@ -0,0 +1,538 @@
+package jscalendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/teambition/rrule-go"
+)
+
+// propExceptionRule is the EXRULE property, deprecated by RFC 5545 but still
+// equivalent to JSCalendar excluded recurrence rules.
+const propExceptionRule = "EXRULE"
+
+// RecurrenceRule is a JSCalendar recurrence rule, equivalent to an iCalendar
+// RRULE.
+type RecurrenceRule struct {
+	Type           string   `json:"@type"`
+	Frequency      string   `json:"frequency"`
+	Interval       int      `json:"interval,omitempty"`
+	FirstDayOfWeek string   `json:"firstDayOfWeek,omitempty"`
+	ByDay          []NDay   `json:"byDay,omitempty"`
+	ByMonthDay     []int    `json:"byMonthDay,omitempty"`
+	ByMonth        []string `json:"byMonth,omitempty"`
+	ByYearDay      []int    `json:"byYearDay,omitempty"`
+	ByWeekNo       []int    `json:"byWeekNo,omitempty"`
+	ByHour         []int    `json:"byHour,omitempty"`
+	ByMinute       []int    `json:"byMinute,omitempty"`
+	BySecond       []int    `json:"bySecond,omitempty"`
+	BySetPosition  []int    `json:"bySetPosition,omitempty"`
+	Count          int      `json:"count,omitempty"`
+	// Until is a local date-time in the time zone of the event.
+	Until string `json:"until,omitempty"`
+}
+
+// NDay is a day of the week in a JSCalendar recurrence rule, e.g. the second
+// Monday of the month.
+type NDay struct {
+	Type        string `json:"@type"`
+	Day         string `json:"day"`
+	NthOfPeriod int    `json:"nthOfPeriod,omitempty"`
+}
+
+// PatchObject is a JSCalendar patch object, as used by recurrence overrides.
+// Keys are property names and a nil value removes a property. Patches of
+// nested properties, i.e. keys containing a "/", aren't supported.
+type PatchObject map[string]interface{}
+
+func (patch PatchObject) excluded() bool {
+	excluded, _ := patch["excluded"].(bool)
+	return excluded
+}
+
+// modified reports whether the patch changes the properties of an instance,
+// as opposed to just adding or excluding it.
+func (patch PatchObject) modified() bool {
+	for k := range patch {
+		if k != "excluded" {
+			return !patch.excluded()
+		}
+	}
+	return false
+}
+
+// recurrence contains the recurrence properties shared by events and tasks.
+type recurrence struct {
+	rules         []RecurrenceRule
+	excludedRules []RecurrenceRule
+	overrides     map[string]PatchObject
+}
+
+// recurrenceFromComponent converts the RRULE, EXRULE, RDATE and EXDATE
+// properties of a component. Recurrence IDs are local date-times in timeZone.
+func recurrenceFromComponent(comp *ical.Component, timeZone string) (*recurrence, error) {
+	rec := &recurrence{}
+	for _, p := range []struct {
+		name string
+		dst  *[]RecurrenceRule
+	}{
+		{ical.PropRecurrenceRule, &rec.rules},
+		{propExceptionRule, &rec.excludedRules},
+	} {
+		for _, prop := range comp.Props[p.name] {
+			rule, err := parseRecurrenceRule(prop.Value, timeZone)
+			if err != nil {
+				return nil, err
+			}
+			*p.dst = append(*p.dst, *rule)
+		}
+	}
+
+	for _, p := range []struct {
+		name     string
+		excluded bool
+	}{
+		{ical.PropRecurrenceDates, false},
+		{ical.PropExceptionDates, true},
+	} {
+		for i := range comp.Props[p.name] {
+			prop := &comp.Props[p.name][i]
+			if prop.ValueType() == ical.ValuePeriod {
+				return nil, fmt.Errorf("jscalendar: unsupported %v value type %v", p.name, ical.ValuePeriod)
+			}
+			for _, v := range strings.Split(prop.Value, ",") {
+				id, err := recurrenceIDFromProp(prop, v, timeZone)
+				if err != nil {
+					return nil, err
+				}
+				if rec.overrides == nil {
+					rec.overrides = make(map[string]PatchObject)
+				}
+				if p.excluded {
+					rec.overrides[id] = PatchObject{"excluded": true}
+				} else if _, ok := rec.overrides[id]; !ok {
+					rec.overrides[id] = PatchObject{}
+				}
+			}
+		}
+	}
+
+	return rec, nil
+}
+
+// setRecurrenceProps sets the RRULE, EXRULE, RDATE and EXDATE properties of a
+// component. DTSTART must already be set. Modified instances are added as
+// RDATEs if the recurrence rules don't generate them, but their overriding
+// components are left to the caller.
+func setRecurrenceProps(comp *ical.Component, rec *recurrence, timeZone string, withoutTime bool) error {
+	if len(rec.rules) == 0 && len(rec.excludedRules) == 0 && len(rec.overrides) == 0 {
+		return nil
+	}
+	dtstart := comp.Props.Get(ical.PropDateTimeStart)
+	if dtstart == nil {
+		return fmt.Errorf("jscalendar: recurrence requires a start")
+	}
+	start, err := parseICalDateTime(dtstart)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []struct {
+		name  string
+		rules []RecurrenceRule
+	}{
+		{ical.PropRecurrenceRule, rec.rules},
+		{propExceptionRule, rec.excludedRules},
+	} {
+		for i := range p.rules {
+			rule := &p.rules[i]
+			var until string
+			if rule.Until != "" {
+				until, err = untilToICal(rule.Until, timeZone, withoutTime)
+				if err != nil {
+					return err
+				}
+			}
+			value, err := formatRecurrenceRule(rule, until)
+			if err != nil {
+				return err
+			}
+			prop := ical.NewProp(p.name)
+			prop.SetValueType(ical.ValueRecurrence)
+			prop.Value = value
+			comp.Props.Add(prop)
+		}
+	}
+
+	ids := make([]string, 0, len(rec.overrides))
+	for id := range rec.overrides {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t, err := time.Parse(localDateTimeLayout, id)
+		if err != nil {
+			return fmt.Errorf("jscalendar: invalid recurrence ID: %w", err)
+		}
+
+		patch := rec.overrides[id]
+		name := ical.PropRecurrenceDates
+		switch {
+		case patch.excluded():
+			name = ical.PropExceptionDates
+		case patch.modified():
+			if ok, err := isRuleInstance(rec.rules, start, t); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+		}
+		comp.Props.Add(dateTimeProp(name, t, timeZone, withoutTime))
+	}
+
+	return nil
+}
+
+// instancePatch returns the patch turning the instance of master at the
+// recurrence ID id into instance.
+func instancePatch(master, instance *Event, id string) (PatchObject, error) {
+	base, err := instanceObject(master, id)
+	if err != nil {
+		return nil, err
+	}
+	overridden, err := toJSONObject(withoutRecurrence(instance))
+	if err != nil {
+		return nil, err
+	}
+
+	patch := make(PatchObject)
+	for k, v := range overridden {
+		if k != "@type" && k != "uid" && !reflect.DeepEqual(base[k], v) {
+			patch[k] = v
+		}
+	}
+	for k := range base {
+		if _, ok := overridden[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch, nil
+}
+
+// applyPatch returns the instance of master at the recurrence ID id, with
+// patch applied.
+func applyPatch(master *Event, id string, patch PatchObject) (*Event, error) {
+	obj, err := instanceObject(master, id)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range patch {
+		switch {
+		case k == "excluded":
+			continue
+		case strings.Contains(k, "/"):
+			return nil, fmt.Errorf("jscalendar: unsupported patch of nested property %q", k)
+		case k == "@type" || k == "uid" || strings.HasPrefix(k, "recurrence") || k == "excludedRecurrenceRules":
+			return nil, fmt.Errorf("jscalendar: invalid patch of property %q", k)
+		}
+		if v == nil {
+			delete(obj, k)
+		} else {
+			obj[k] = v
+		}
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var instance Event
+	if err := json.Unmarshal(b, &instance); err != nil {
+		return nil, fmt.Errorf("jscalendar: invalid patch for recurrence ID %q: %v", id, err)
+	}
+	return &instance, nil
+}
+
+// instanceObject returns the JSON object of the unmodified instance of master
+// at the recurrence ID id.
+func instanceObject(master *Event, id string) (map[string]interface{}, error) {
+	base := withoutRecurrence(master)
+	base.Start = id
+	return toJSONObject(base)
+}
+
+func withoutRecurrence(event *Event) *Event {
+	e := *event
+	e.RecurrenceRules = nil
+	e.ExcludedRecurrenceRules = nil
+	e.RecurrenceOverrides = nil
+	return &e
+}
+
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// isRuleInstance reports whether the recurrence rules of an event starting at
+// start generate an instance at t. Both are local date-times, so the rules are
+// evaluated in UTC.
+func isRuleInstance(rules []RecurrenceRule, start, t time.Time) (bool, error) {
+	for i := range rules {
+		var until string
+		if rules[i].Until != "" {
+			u, err := time.Parse(localDateTimeLayout, rules[i].Until)
+			if err != nil {
+				return false, fmt.Errorf("jscalendar: invalid until: %w", err)
+			}
+			until = u.Format(icalDateTimeLayout) + "Z"
+		}
+		value, err := formatRecurrenceRule(&rules[i], until)
+		if err != nil {
+			return false, err
+		}
+		opt, err := rrule.StrToROption(value)
+		if err != nil {
+			return false, fmt.Errorf("jscalendar: invalid recurrence rule %q: %v", value, err)
+		}
+		opt.Dtstart = start
+		r, err := rrule.NewRRule(*opt)
+		if err != nil {
+			return false, fmt.Errorf("jscalendar: invalid recurrence rule %q: %v", value, err)
+		}
+		if len(r.Between(t, t, true)) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseRecurrenceRule(value, timeZone string) (*RecurrenceRule, error) {
+	rule := &RecurrenceRule{Type: "RecurrenceRule"}
+	intLists := map[string]*[]int{
+		"BYMONTHDAY": &rule.ByMonthDay,
+		"BYYEARDAY":  &rule.ByYearDay,
+		"BYWEEKNO":   &rule.ByWeekNo,
+		"BYHOUR":     &rule.ByHour,
+		"BYMINUTE":   &rule.ByMinute,
+		"BYSECOND":   &rule.BySecond,
+		"BYSETPOS":   &rule.BySetPosition,
+	}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("jscalendar: invalid recurrence rule %q", value)
+		}
+		k, v := strings.ToUpper(kv[0]), kv[1]
+
+		var err error
+		switch k {
+		case "FREQ":
+			rule.Frequency = strings.ToLower(v)
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(v)
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(v)
+		case "UNTIL":
+			rule.Until, err = untilFromICal(v, timeZone)
+		case "WKST":
+			rule.FirstDayOfWeek = strings.ToLower(v)
+		case "BYDAY":
+			for _, day := range strings.Split(v, ",") {
+				i := len(day) - 2
+				if i < 0 {
+					err = fmt.Errorf("invalid day %q", day)
+					break
+				}
+				nday := NDay{Type: "NDay", Day: strings.ToLower(day[i:])}
+				if i > 0 {
+					if nday.NthOfPeriod, err = strconv.Atoi(day[:i]); err != nil {
+						break
+					}
+				}
+				rule.ByDay = append(rule.ByDay, nday)
+			}
+		case "BYMONTH":
+			rule.ByMonth = strings.Split(v, ",")
+		default:
+			dst, ok := intLists[k]
+			if !ok {
+				return nil, fmt.Errorf("jscalendar: unsupported recurrence rule part %q", k)
+			}
+			for _, s := range strings.Split(v, ",") {
+				var n int
+				if n, err = strconv.Atoi(s); err != nil {
+					break
+				}
+				*dst = append(*dst, n)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jscalendar: invalid recurrence rule %q: %v", value, err)
+		}
+	}
+
+	if rule.Frequency == "" {
+		return nil, fmt.Errorf("jscalendar: recurrence rule %q has no frequency", value)
+	}
+	return rule, nil
+}
+
+// formatRecurrenceRule formats a recurrence rule as an RRULE value. until is
+// the already formatted UNTIL value, if any.
+func formatRecurrenceRule(rule *RecurrenceRule, until string) (string, error) {
+	if rule.Frequency == "" {
+		return "", fmt.Errorf("jscalendar: recurrence rule has no frequency")
+	}
+
+	parts := []string{"FREQ=" + strings.ToUpper(rule.Frequency)}
+	if rule.Interval > 0 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if rule.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rule.Count))
+	}
+	if until != "" {
+		parts = append(parts, "UNTIL="+until)
+	}
+	if rule.FirstDayOfWeek != "" {
+		parts = append(parts, "WKST="+strings.ToUpper(rule.FirstDayOfWeek))
+	}
+	if len(rule.ByDay) > 0 {
+		l := make([]string, len(rule.ByDay))
+		for i, nday := range rule.ByDay {
+			l[i] = strings.ToUpper(nday.Day)
+			if nday.NthOfPeriod != 0 {
+				l[i] = strconv.Itoa(nday.NthOfPeriod) + l[i]
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(l, ","))
+	}
+	if len(rule.ByMonth) > 0 {
+		parts = append(parts, "BYMONTH="+strings.Join(rule.ByMonth, ","))
+	}
+	for _, p := range []struct {
+		name string
+		l    []int
+	}{
+		{"BYMONTHDAY", rule.ByMonthDay},
+		{"BYYEARDAY", rule.ByYearDay},
+		{"BYWEEKNO", rule.ByWeekNo},
+		{"BYHOUR", rule.ByHour},
+		{"BYMINUTE", rule.ByMinute},
+		{"BYSECOND", rule.BySecond},
+		{"BYSETPOS", rule.BySetPosition},
+	} {
+		if len(p.l) == 0 {
+			continue
+		}
+		l := make([]string, len(p.l))
+		for i, n := range p.l {
+			l[i] = strconv.Itoa(n)
+		}
+		parts = append(parts, p.name+"="+strings.Join(l, ","))
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// untilFromICal converts an RRULE UNTIL value to a local date-time in
+// timeZone.
+func untilFromICal(v, timeZone string) (string, error) {
+	var (
+		t   time.Time
+		err error
+	)
+	switch {
+	case len(v) == len(icalDateLayout):
+		t, err = time.Parse(icalDateLayout, v)
+	case strings.HasSuffix(v, "Z") && timeZone != "":
+		if t, err = time.Parse(icalDateTimeLayout+"Z", v); err != nil {
+			break
+		}
+		var loc *time.Location
+		if loc, err = loadLocation(timeZone); err == nil {
+			t = t.In(loc)
+		}
+	default:
+		t, err = time.Parse(icalDateTimeLayout, strings.TrimSuffix(v, "Z"))
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.Format(localDateTimeLayout), nil
+}
+
+// untilToICal converts a local date-time in timeZone to an RRULE UNTIL value.
+// As required by RFC 5545, UNTIL is in UTC unless the event is floating or
+// all-day.
+func untilToICal(until, timeZone string, withoutTime bool) (string, error) {
+	t, err := time.Parse(localDateTimeLayout, until)
+	if err != nil {
+		return "", fmt.Errorf("jscalendar: invalid until: %w", err)
+	}
+	switch {
+	case withoutTime:
+		return t.Format(icalDateLayout), nil
+	case timeZone == "":
+		return t.Format(icalDateTimeLayout), nil
+	}
+	loc, err := loadLocation(timeZone)
+	if err != nil {
+		return "", err
+	}
+	t, err = time.ParseInLocation(localDateTimeLayout, until, loc)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(icalDateTimeLayout) + "Z", nil
+}
+
+// recurrenceIDFromProp converts a RECURRENCE-ID, RDATE or EXDATE value to a
+// local date-time in timeZone.
+func recurrenceIDFromProp(prop *ical.Prop, value, timeZone string) (string, error) {
+	p := ical.NewProp(prop.Name)
+	p.Params = prop.Params
+	p.Value = value
+
+	t, err := parseICalDateTime(p)
+	if err != nil {
+		return "", err
+	}
+	utc := strings.HasSuffix(value, "Z")
+	if p.ValueType() == ical.ValueDate || timeZone == "" ||
+		(utc && timeZone == UTCTimeZone) ||
+		(!utc && p.Params.Get(ical.PropTimezoneID) == timeZone) {
+		return t.Format(localDateTimeLayout), nil
+	}
+
+	// The value isn't in the time zone of the event
+	if t, err = p.DateTime(time.UTC); err != nil {
+		return "", err
+	}
+	loc, err := loadLocation(timeZone)
+	if err != nil {
+		return "", err
+	}
+	return t.In(loc).Format(localDateTimeLayout), nil
+}
+
+func loadLocation(timeZone string) (*time.Location, error) {
+	if timeZone == UTCTimeZone {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(timeZone)
+}
@@ -0,0 +1,509 @@
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/internal"
+)
+
+const localObjectExt = ".ics"
+
+// LocalBackend is a Backend storing calendars in a local directory. It uses
+// the vdir layout supported by vdirsyncer: each calendar is a sub-directory
+// and each calendar object is an ".ics" file.
+//
+// The name, description, color and order of calendars are stored in the
+// "displayname", "description", "color" and "order" vdir metadata files.
+// Other calendar properties are stored in a sidecar file. ETags and CTags are
+// derived from the contents of the files.
+//
+// LocalBackend is safe for concurrent use, but the directory must not be
+// modified by other processes while a PUT request is handled.
+type LocalBackend struct {
+	// ErrorLog specifies an optional logger for object files which can't be
+	// parsed, e.g. because they were written by another vdir client. Such
+	// files are skipped when listing objects. If nil, logging is done via the
+	// log package's standard logger.
+	ErrorLog *log.Logger
+
+	dir                        string
+	principalPath, homeSetPath string
+
+	mu sync.Mutex // serializes writes
+}
+
+// localCalendarMetadata contains the calendar properties stored in the
+// sidecar file.
+type localCalendarMetadata struct {
+	MaxResourceSize       int64              `json:"max_resource_size,omitempty"`
+	SupportedComponentSet []string           `json:"supported_component_set,omitempty"`
+	Timezone              string             `json:"timezone,omitempty"`
+	SupportedCalendarData []CalendarDataType `json:"supported_calendar_data,omitempty"`
+	Encrypted             bool               `json:"encrypted,omitempty"`
+}
+
+var (
+	_ Backend                = (*LocalBackend)(nil)
+	_ CalendarCreator        = (*LocalBackend)(nil)
+	_ DryRunBackend          = (*LocalBackend)(nil)
+	_ MoveBackend            = (*LocalBackend)(nil)
+	_ CalendarObjectStreamer = (*LocalBackend)(nil)
+)
+
+// NewLocalBackend creates a backend storing calendars in dir, which is the
+// calendar home set. The paths must follow the layout expected by Handler,
+// e.g. "/user/" and "/user/calendars/".
+func NewLocalBackend(dir, principalPath, homeSetPath string) *LocalBackend {
+	return &LocalBackend{
+		dir:           dir,
+		principalPath: principalPath,
+		homeSetPath:   strings.TrimSuffix(homeSetPath, "/") + "/",
+	}
+}
+
+// calendarDir returns the directory of the calendar at a path, with or
+// without a trailing slash, checking that it exists.
+func (b *LocalBackend) calendarDir(p string) (string, error) {
+	p = strings.TrimSuffix(p, "/")
+	name := path.Base(p)
+	if path.Dir(p)+"/" != b.homeSetPath || internal.CheckVdirName(name, "") != nil {
+		return "", internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar %q not found", p)
+	}
+	dir := filepath.Join(b.dir, name)
+	if fi, err := os.Stat(dir); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return "", internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar %q not found", p)
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// objectFile returns the file of the calendar object at a path. The calendar
+// must exist, the file may not.
+func (b *LocalBackend) objectFile(p string) (string, error) {
+	dir, err := b.calendarDir(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(p)
+	if err := internal.CheckVdirName(name, localObjectExt); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func (b *LocalBackend) readCalendar(dir string) (*Calendar, error) {
+	cal := &Calendar{Path: b.homeSetPath + filepath.Base(dir) + "/"}
+
+	var err error
+	if cal.Name, err = internal.ReadVdirMetadata(dir, "displayname"); err != nil {
+		return nil, err
+	}
+	if cal.Description, err = internal.ReadVdirMetadata(dir, "description"); err != nil {
+		return nil, err
+	}
+	if cal.Color, err = internal.ReadVdirMetadata(dir, "color"); err != nil {
+		return nil, err
+	}
+	order, err := internal.ReadVdirMetadata(dir, "order")
+	if err != nil {
+		return nil, err
+	}
+	// Ignore invalid orders, other vdir clients may store arbitrary values
+	cal.Order, _ = strconv.Atoi(order)
+
+	var md localCalendarMetadata
+	if err := internal.ReadVdirSidecar(dir, &md); err != nil {
+		return nil, err
+	}
+	cal.MaxResourceSize = md.MaxResourceSize
+	cal.SupportedComponentSet = md.SupportedComponentSet
+	cal.Timezone = md.Timezone
+	cal.SupportedCalendarData = md.SupportedCalendarData
+	cal.Encrypted = md.Encrypted
+
+	if cal.CTag, err = internal.VdirCTag(dir, localObjectExt); err != nil {
+		return nil, err
+	}
+	return cal, nil
+}
+
+func readLocalObject(p, filename string) (*CalendarObject, error) {
+	data, fi, err := readLocalFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalObject(p, data, fi)
+}
+
+func readLocalFile(filename string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, fi, nil
+}
+
+// newLocalObject parses the data of an object file. Only parse errors are
+// returned.
+func newLocalObject(p string, data []byte, fi os.FileInfo) (*CalendarObject, error) {
+	cal, err := ical.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &CalendarObject{
+		Path:          p,
+		ModTime:       fi.ModTime(),
+		ContentLength: int64(len(data)),
+		ETag:          internal.VdirETag(data),
+		Data:          cal,
+	}, nil
+}
+
+func (b *LocalBackend) logf(format string, args ...interface{}) {
+	if b.ErrorLog != nil {
+		b.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (b *LocalBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.principalPath, nil
+}
+
+func (b *LocalBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return b.homeSetPath, nil
+}
+
+func (b *LocalBackend) ListCalendars(ctx context.Context) ([]Calendar, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var l []Calendar
+	for _, fi := range entries {
+		if !fi.IsDir() || internal.CheckVdirName(fi.Name(), "") != nil {
+			continue
+		}
+		cal, err := b.readCalendar(filepath.Join(b.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *cal)
+	}
+	return l, nil
+}
+
+func (b *LocalBackend) GetCalendar(ctx context.Context, p string) (*Calendar, error) {
+	dir, err := b.calendarDir(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.readCalendar(dir)
+}
+
+func (b *LocalBackend) CreateCalendar(ctx context.Context, calendar Calendar) error {
+	p := strings.TrimSuffix(calendar.Path, "/")
+	if path.Dir(p)+"/" != b.homeSetPath {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: calendars must be created in the calendar home set")
+	}
+	name := path.Base(p)
+	if err := internal.CheckVdirName(name, ""); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(b.dir, name)
+	if err := os.Mkdir(dir, 0755); os.IsExist(err) {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: calendar %q already exists", calendar.Path)
+	} else if err != nil {
+		return err
+	}
+
+	err := writeLocalCalendar(dir, &calendar)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+func writeLocalCalendar(dir string, cal *Calendar) error {
+	var order string
+	if cal.Order != 0 {
+		order = strconv.Itoa(cal.Order)
+	}
+	for _, md := range []struct{ key, value string }{
+		{"displayname", cal.Name},
+		{"description", cal.Description},
+		{"color", cal.Color},
+		{"order", order},
+	} {
+		if err := internal.WriteVdirMetadata(dir, md.key, md.value); err != nil {
+			return err
+		}
+	}
+	return internal.WriteVdirSidecar(dir, &localCalendarMetadata{
+		MaxResourceSize:       cal.MaxResourceSize,
+		SupportedComponentSet: cal.SupportedComponentSet,
+		Timezone:              cal.Timezone,
+		SupportedCalendarData: cal.SupportedCalendarData,
+		Encrypted:             cal.Encrypted,
+	})
+}
+
+func (b *LocalBackend) GetCalendarObject(ctx context.Context, p string, req *CalendarCompRequest) (*CalendarObject, error) {
+	filename, err := b.objectFile(p)
+	if _, ok := err.(*internal.HTTPError); ok {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	} else if err != nil {
+		return nil, err
+	}
+	co, err := readLocalObject(p, filename)
+	if os.IsNotExist(err) {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	}
+	return co, err
+}
+
+func (b *LocalBackend) ListCalendarObjects(ctx context.Context, p string, req *CalendarCompRequest) ([]CalendarObject, error) {
+	var l []CalendarObject
+	err := b.ListCalendarObjectsStream(ctx, p, req, func(co *CalendarObject) error {
+		l = append(l, *co)
+		return nil
+	})
+	return l, err
+}
+
+// ListCalendarObjectsStream implements CalendarObjectStreamer. Objects are
+// listed in the order of their paths.
+func (b *LocalBackend) ListCalendarObjectsStream(ctx context.Context, p string, req *CalendarCompRequest, fn func(co *CalendarObject) error) error {
+	dir, err := b.calendarDir(p)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts entries by name
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	calPath := strings.TrimSuffix(p, "/") + "/"
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || internal.CheckVdirName(fi.Name(), localObjectExt) != nil {
+			continue
+		}
+		filename := filepath.Join(dir, fi.Name())
+		data, info, err := readLocalFile(filename)
+		if os.IsNotExist(err) {
+			continue // removed in the meantime
+		} else if err != nil {
+			return err
+		}
+		co, err := newLocalObject(calPath+fi.Name(), data, info)
+		if err != nil {
+			// The file may have been written by another vdir client
+			b.logf("caldav: skipping invalid calendar object file %q: %v", filename, err)
+			continue
+		}
+		if err := fn(co); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) QueryCalendarObjects(ctx context.Context, p string, query *CalendarQuery) ([]CalendarObject, error) {
+	var l []CalendarObject
+	err := b.QueryCalendarObjectsStream(ctx, p, query, func(co *CalendarObject) error {
+		l = append(l, *co)
+		return nil
+	})
+	return l, err
+}
+
+// QueryCalendarObjectsStream implements CalendarObjectStreamer.
+func (b *LocalBackend) QueryCalendarObjectsStream(ctx context.Context, p string, query *CalendarQuery, fn func(co *CalendarObject) error) error {
+	return b.ListCalendarObjectsStream(ctx, p, &query.CompRequest, func(co *CalendarObject) error {
+		if ok, err := Match(query.CompFilter, co); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		return fn(co)
+	})
+}
+
+func (b *LocalBackend) SupportsDryRun() bool {
+	return true
+}
+
+func (b *LocalBackend) PutCalendarObject(ctx context.Context, p string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (loc string, err error) {
+	if opts == nil {
+		opts = &PutCalendarObjectOptions{}
+	}
+	_, uid, err := ValidateCalendarObject(calendar)
+	if err != nil {
+		return "", NewPreconditionError(PreconditionValidCalendarObjectResource)
+	}
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(calendar); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.calendarDir(path.Dir(p)); err != nil {
+		return "", internal.HTTPErrorf(http.StatusConflict, "caldav: calendar %q not found", path.Dir(p))
+	}
+	filename, err := b.objectFile(p)
+	if err != nil {
+		return "", err
+	}
+
+	var etag string
+	data, err := ioutil.ReadFile(filename)
+	exists := err == nil
+	if exists {
+		etag = internal.VdirETag(data)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := checkPutConditions(opts, etag, exists); err != nil {
+		return "", err
+	}
+
+	if err := b.checkUID(path.Dir(p), uid, p); err != nil {
+		return "", err
+	}
+	if opts.DryRun {
+		return p, nil
+	}
+
+	if err := internal.WriteFileAtomic(filename, buf.Bytes()); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// checkUID checks that no object of a calendar other than the excluded ones
+// has the given UID. Files which can't contain the UID aren't parsed.
+func (b *LocalBackend) checkUID(calPath, uid string, exclude ...string) error {
+	if uid == "" {
+		return nil
+	}
+	dir, err := b.calendarDir(calPath)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	calPath = strings.TrimSuffix(calPath, "/") + "/"
+entries:
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || internal.CheckVdirName(fi.Name(), localObjectExt) != nil {
+			continue
+		}
+		for _, p := range exclude {
+			if calPath+fi.Name() == p {
+				continue entries
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !internal.VdirMayContainText(data, uid) {
+			continue
+		}
+		cal, err := ical.NewDecoder(bytes.NewReader(data)).Decode()
+		if err != nil {
+			continue
+		}
+		if _, otherUID, err := ValidateCalendarObject(cal); err == nil && otherUID == uid {
+			return NewPreconditionError(PreconditionNoUIDConflict)
+		}
+	}
+	return nil
+}
+
+// MoveCalendarObject implements MoveBackend. The file is renamed, so its
+// contents and ETag are left unchanged.
+func (b *LocalBackend) MoveCalendarObject(ctx context.Context, src, dest string) error {
+	srcFile, err := b.objectFile(src)
+	if _, ok := err.(*internal.HTTPError); ok {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", src)
+	} else if err != nil {
+		return err
+	}
+	if _, err := b.calendarDir(path.Dir(dest)); err != nil {
+		return internal.HTTPErrorf(http.StatusConflict, "caldav: calendar %q not found", path.Dir(dest))
+	}
+	destFile, err := b.objectFile(dest)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	co, err := readLocalObject(src, srcFile)
+	if os.IsNotExist(err) {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", src)
+	} else if err != nil {
+		return err
+	}
+	_, uid, err := ValidateCalendarObject(co.Data)
+	if err != nil {
+		return NewPreconditionError(PreconditionValidCalendarObjectResource)
+	}
+	if err := b.checkUID(path.Dir(dest), uid, src, dest); err != nil {
+		return err
+	}
+	return os.Rename(srcFile, destFile)
+}
+
+func (b *LocalBackend) DeleteCalendarObject(ctx context.Context, p string) error {
+	filename, err := b.objectFile(p)
+	if _, ok := err.(*internal.HTTPError); ok {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	} else if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.Remove(filename); os.IsNotExist(err) {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,14 +1,18 @@
 package caldav
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/internal"
 )
 
 // Filter returns the filtered list of calendar objects matching the provided query.
-// A nil query will return the full list of calendar objects.
+// A nil query will return the full list of calendar objects. The objects
+// aren't pruned to the query's CompRequest: Handler strips unrequested
+// properties and components once the query filter has been evaluated.
 func Filter(query *CalendarQuery, cos []CalendarObject) ([]CalendarObject, error) {
 	if query == nil {
 		// FIXME: should we always return a copy of the provided slice?
@@ -25,7 +29,6 @@ func Filter(query *CalendarQuery, cos []CalendarObject) ([]CalendarObject, error
 			continue
 		}
 
-		// TODO properties are not currently filtered even if requested
 		out = append(out, co)
 	}
 	return out, nil
@@ -36,17 +39,20 @@ func Match(query CompFilter, co *CalendarObject) (matched bool, err error) {
 	if co.Data == nil || co.Data.Component == nil {
 		panic("request to process empty calendar object")
 	}
-	return match(query, co.Data.Component)
+	return match(query, co.Data.Component, nil, nil, nil)
 }
 
-func match(filter CompFilter, comp *ical.Component) (bool, error) {
+// match matches a component against a filter. parent is the component
+// containing comp, if any. overrides and parentOverrides record the
+// overridden instances of comp and parent.
+func match(filter CompFilter, comp, parent *ical.Component, overrides, parentOverrides recurrenceOverrides) (bool, error) {
 	if comp.Name != filter.Name {
 		return filter.IsNotDefined, nil
 	}
 
 	var zeroDate time.Time
 	if filter.Start != zeroDate {
-		match, err := matchCompTimeRange(filter.Start, filter.End, comp)
+		match, err := matchCompTimeRange(filter.Start, filter.End, comp, parent, overrides, parentOverrides)
 		if err != nil {
 			return false, err
 		}
@@ -55,7 +61,7 @@ func match(filter CompFilter, comp *ical.Component) (bool, error) {
 		}
 	}
 	for _, compFilter := range filter.Comps {
-		match, err := matchCompFilter(compFilter, comp)
+		match, err := matchCompFilter(compFilter, comp, overrides)
 		if err != nil {
 			return false, err
 		}
@@ -75,11 +81,21 @@ func match(filter CompFilter, comp *ical.Component) (bool, error) {
 	return true, nil
 }
 
-func matchCompFilter(filter CompFilter, comp *ical.Component) (bool, error) {
-	var matches []*ical.Component
+func matchCompFilter(filter CompFilter, comp *ical.Component, compOverrides recurrenceOverrides) (bool, error) {
+	// Overrides are needed by the time ranges of the children, and by the
+	// time ranges of their alarms
+	var overrides recurrenceOverrides
+	if !filter.Start.IsZero() || len(filter.Comps) > 0 {
+		var err error
+		overrides, err = newRecurrenceOverrides(comp.Children, filter.Start.Location())
+		if err != nil {
+			return false, err
+		}
+	}
 
+	var matches []*ical.Component
 	for _, child := range comp.Children {
-		match, err := match(filter, child)
+		match, err := match(filter, child, comp, overrides, compOverrides)
 		if err != nil {
 			return false, err
 		} else if match {
@@ -93,55 +109,140 @@ func matchCompFilter(filter CompFilter, comp *ical.Component) (bool, error) {
 }
 
 func matchPropFilter(filter PropFilter, comp *ical.Component) (bool, error) {
-	// TODO: this only matches first field, there can be multiple
-	field := comp.Props.Get(filter.Name)
-	if field == nil {
+	fields := comp.Props.Values(filter.Name)
+	if len(fields) == 0 {
 		return filter.IsNotDefined, nil
+	} else if filter.IsNotDefined {
+		return false, nil
 	}
 
-	for _, paramFilter := range filter.ParamFilter {
-		if !matchParamFilter(paramFilter, field) {
-			return false, nil
+	// The filter matches if any of the property instances matches all of
+	// its conditions, e.g. a single ATTENDEE with both the right CN and the
+	// right PARTSTAT
+	for i := range fields {
+		match, err := matchProp(filter, &fields[i])
+		if err != nil || match {
+			return match, err
 		}
 	}
+	if strings.EqualFold(filter.Name, ical.PropAttendee) {
+		return matchGroupMembers(filter, fields)
+	}
+	return false, nil
+}
 
-	var zeroDate time.Time
-	if filter.Start != zeroDate {
-		match, err := matchPropTimeRange(filter.Start, filter.End, field)
-		if err != nil {
+// matchGroupMembers expands the ATTENDEE properties of groups (CUTYPE=GROUP)
+// whose address matches the text-match of filter to the attendees listing
+// them in their MEMBER parameter. The filter matches if one of these members
+// matches its param-filters, e.g. to find events where a member of an invited
+// group has accepted.
+func matchGroupMembers(filter PropFilter, attendees []ical.Prop) (bool, error) {
+	if filter.TextMatch == nil || filter.TextMatch.NegateCondition {
+		return false, nil
+	}
+	for i := range attendees {
+		group := &attendees[i]
+		if !strings.EqualFold(group.Params.Get(ical.ParamCalendarUserType), "GROUP") {
+			continue
+		}
+		if match, err := matchTextMatch(*filter.TextMatch, group.Value); err != nil {
 			return false, err
+		} else if !match {
+			continue
 		}
-		if !match {
-			return false, nil
+
+		for j := range attendees {
+			isMember := false
+			for _, addr := range paramValues(attendees[j].Params, "MEMBER") {
+				isMember = isMember || strings.EqualFold(addr, group.Value)
+			}
+			if !isMember {
+				continue
+			}
+			if match, err := matchParamFilters(filter.ParamFilter, &attendees[j]); err != nil || match {
+				return match, err
+			}
 		}
-	} else if filter.TextMatch != nil {
-		if !matchTextMatch(*filter.TextMatch, field.Value) {
-			return false, nil
+	}
+	return false, nil
+}
+
+func matchParamFilters(filters []ParamFilter, field *ical.Prop) (bool, error) {
+	for _, paramFilter := range filters {
+		match, err := matchParamFilter(paramFilter, field)
+		if err != nil || !match {
+			return false, err
 		}
-		return true, nil
+	}
+	return true, nil
+}
+
+func matchProp(filter PropFilter, field *ical.Prop) (bool, error) {
+	if match, err := matchParamFilters(filter.ParamFilter, field); err != nil || !match {
+		return false, err
+	}
+
+	var zeroDate time.Time
+	if filter.Start != zeroDate {
+		return matchPropTimeRange(filter.Start, filter.End, field)
+	} else if filter.TextMatch != nil {
+		return matchTextMatch(*filter.TextMatch, field.Value)
 	}
 	// empty prop-filter, property exists
 	return true, nil
 }
 
-func matchCompTimeRange(start, end time.Time, comp *ical.Component) (bool, error) {
+func matchCompTimeRange(start, end time.Time, comp, parent *ical.Component, overrides, parentOverrides recurrenceOverrides) (bool, error) {
 	// See https://datatracker.ietf.org/doc/html/rfc4791#section-9.9
 
 	// evaluate recurring components
-	rset, err := comp.RecurrenceSet(start.Location())
+	rset, err := componentRecurrenceSet(comp, start.Location())
 	if err != nil {
 		return false, err
 	}
 	if rset != nil {
-		// TODO we can only set inclusive to true or false, but really the
-		// start time is inclusive while the end time is not :/
-		return len(rset.Between(start, end, true)) > 0, nil
+		return matchRecurrenceTimeRange(start, end, comp, rset, overrides)
 	}
 
-	// TODO handle more than just events
-	if comp.Name != ical.CompEvent {
-		return false, nil
+	switch comp.Name {
+	case ical.CompEvent:
+		return matchEventTimeRange(start, end, comp)
+	case ical.CompToDo:
+		return matchToDoTimeRange(start, end, comp)
+	case ical.CompJournal:
+		return matchJournalTimeRange(start, end, comp)
+	case ical.CompFreeBusy:
+		return matchFreeBusyTimeRange(start, end, comp)
+	case ical.CompAlarm:
+		return matchAlarmTimeRange(start, end, comp, parent, parentOverrides)
 	}
+	return false, nil
+}
+
+// The following helpers compare t with the bounds of a time range. A zero
+// start or end means the time range is unbounded on that side.
+
+// startsBefore reports whether start < t.
+func startsBefore(start, t time.Time) bool {
+	return start.IsZero() || start.Before(t)
+}
+
+// startsNotAfter reports whether start <= t.
+func startsNotAfter(start, t time.Time) bool {
+	return start.IsZero() || !start.After(t)
+}
+
+// endsAfter reports whether end > t.
+func endsAfter(end, t time.Time) bool {
+	return end.IsZero() || end.After(t)
+}
+
+// endsNotBefore reports whether end >= t.
+func endsNotBefore(end, t time.Time) bool {
+	return end.IsZero() || !end.Before(t)
+}
+
+func matchEventTimeRange(start, end time.Time, comp *ical.Component) (bool, error) {
 	event := ical.Event{comp}
 
 	eventStart, err := event.DateTimeStart(start.Location())
@@ -168,6 +269,244 @@ func matchCompTimeRange(start, end time.Time, comp *ical.Component) (bool, error
 	return false, nil
 }
 
+func matchToDoTimeRange(start, end time.Time, comp *ical.Component) (bool, error) {
+	loc := start.Location()
+	dtstart, err := comp.Props.DateTime(ical.PropDateTimeStart, loc)
+	if err != nil {
+		return false, err
+	}
+	due, err := comp.Props.DateTime(ical.PropDue, loc)
+	if err != nil {
+		return false, err
+	}
+	completed, err := comp.Props.DateTime(ical.PropCompleted, loc)
+	if err != nil {
+		return false, err
+	}
+	created, err := comp.Props.DateTime(ical.PropCreated, loc)
+	if err != nil {
+		return false, err
+	}
+	var dur time.Duration
+	durProp := comp.Props.Get(ical.PropDuration)
+	if durProp != nil {
+		if dur, err = durProp.Duration(); err != nil {
+			return false, err
+		}
+	}
+
+	switch {
+	case !dtstart.IsZero() && durProp != nil:
+		dtend := dtstart.Add(dur)
+		return startsNotAfter(start, dtend) && (endsAfter(end, dtstart) || endsNotBefore(end, dtend)), nil
+	case !dtstart.IsZero() && !due.IsZero():
+		return (startsBefore(start, due) || startsNotAfter(start, dtstart)) && (endsAfter(end, dtstart) || endsNotBefore(end, due)), nil
+	case !dtstart.IsZero():
+		return startsNotAfter(start, dtstart) && endsAfter(end, dtstart), nil
+	case !due.IsZero():
+		return startsBefore(start, due) && endsNotBefore(end, due), nil
+	case !completed.IsZero() && !created.IsZero():
+		return (startsNotAfter(start, created) || startsNotAfter(start, completed)) && (endsNotBefore(end, created) || endsNotBefore(end, completed)), nil
+	case !completed.IsZero():
+		return startsNotAfter(start, completed) && endsNotBefore(end, completed), nil
+	case !created.IsZero():
+		return endsAfter(end, created), nil
+	}
+	return true, nil
+}
+
+func matchJournalTimeRange(start, end time.Time, comp *ical.Component) (bool, error) {
+	prop := comp.Props.Get(ical.PropDateTimeStart)
+	if prop == nil {
+		return false, nil
+	}
+	dtstart, err := prop.DateTime(start.Location())
+	if err != nil {
+		return false, err
+	}
+	if prop.ValueType() == ical.ValueDate {
+		return startsBefore(start, dtstart.AddDate(0, 0, 1)) && endsAfter(end, dtstart), nil
+	}
+	return startsNotAfter(start, dtstart) && endsAfter(end, dtstart), nil
+}
+
+func matchFreeBusyTimeRange(start, end time.Time, comp *ical.Component) (bool, error) {
+	dtstart, err := comp.Props.DateTime(ical.PropDateTimeStart, start.Location())
+	if err != nil {
+		return false, err
+	}
+	dtend, err := comp.Props.DateTime(ical.PropDateTimeEnd, start.Location())
+	if err != nil {
+		return false, err
+	}
+	if !dtstart.IsZero() && !dtend.IsZero() {
+		return startsNotAfter(start, dtend) && endsAfter(end, dtstart), nil
+	}
+
+	for _, prop := range comp.Props[ical.PropFreeBusy] {
+		for _, s := range strings.Split(prop.Value, ",") {
+			periodStart, periodEnd, err := parsePeriod(s)
+			if err != nil {
+				return false, err
+			}
+			if startsBefore(start, periodEnd) && endsAfter(end, periodStart) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// parsePeriod parses a UTC period of time, as defined in RFC 5545 section
+// 3.3.9.
+func parsePeriod(s string) (start, end time.Time, err error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("caldav: invalid period %q", s)
+	}
+	start, err = time.Parse(dateWithUTCTimeLayout, s[:i])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if v := strings.TrimLeft(s[i+1:], "+-"); strings.HasPrefix(v, "P") {
+		prop := ical.NewProp(ical.PropDuration)
+		prop.Value = s[i+1:]
+		dur, err := prop.Duration()
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return start, start.Add(dur), nil
+	}
+	end, err = time.Parse(dateWithUTCTimeLayout, s[i+1:])
+	return start, end, err
+}
+
+// matchAlarmTimeRange reports whether an alarm triggers in the time range
+// [start, end). Alarms of recurring components trigger for each instance,
+// except for instances overridden by another component.
+func matchAlarmTimeRange(start, end time.Time, alarm, parent *ical.Component, overrides recurrenceOverrides) (bool, error) {
+	loc := start.Location()
+	triggers, err := alarmTriggers(alarm, parent, loc)
+	if err != nil || len(triggers) == 0 {
+		return false, err
+	}
+
+	var rset recurrenceSet
+	if prop := alarm.Props.Get(ical.PropTrigger); prop.ValueType() != ical.ValueDateTime {
+		if rset, err = componentRecurrenceSet(parent, loc); err != nil {
+			return false, err
+		}
+	}
+	if rset == nil {
+		for _, t := range triggers {
+			if triggersIn(start, end, t) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// The triggers of the first instance give the offsets of the triggers
+	// from the start of each instance
+	dtstart, err := parent.Props.DateTime(ical.PropDateTimeStart, loc)
+	if err != nil {
+		return false, err
+	}
+	offsets := make([]time.Duration, len(triggers))
+	minOffset, maxOffset := triggers[0].Sub(dtstart), triggers[0].Sub(dtstart)
+	for i, t := range triggers {
+		offsets[i] = t.Sub(dtstart)
+		if offsets[i] < minOffset {
+			minOffset = offsets[i]
+		}
+		if offsets[i] > maxOffset {
+			maxOffset = offsets[i]
+		}
+	}
+
+	t, inc := start.Add(-maxOffset), true
+	for n := 0; ; n++ {
+		instStart := rset.After(t, inc)
+		if instStart.IsZero() || (!end.IsZero() && !instStart.Add(minOffset).Before(end)) {
+			return false, nil
+		}
+		if n == maxRecurrenceInstances {
+			return false, NewPreconditionError(PreconditionMaxInstances)
+		}
+		t, inc = instStart, false
+
+		if overrides.isOverridden(parent, instStart) {
+			continue
+		}
+		for _, offset := range offsets {
+			if triggersIn(start, end, instStart.Add(offset)) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// triggersIn reports whether a trigger at t is in the time range [start, end).
+func triggersIn(start, end, t time.Time) bool {
+	return startsNotAfter(start, t) && endsAfter(end, t)
+}
+
+// alarmTriggers returns the times an alarm triggers at, including
+// repetitions.
+func alarmTriggers(alarm, parent *ical.Component, loc *time.Location) ([]time.Time, error) {
+	prop := alarm.Props.Get(ical.PropTrigger)
+	if prop == nil {
+		return nil, nil
+	}
+
+	var trigger time.Time
+	if prop.ValueType() == ical.ValueDateTime {
+		var err error
+		if trigger, err = prop.DateTime(loc); err != nil {
+			return nil, err
+		}
+	} else {
+		offset, err := prop.Duration()
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			return nil, nil
+		}
+		var ref time.Time
+		if strings.EqualFold(prop.Params.Get(ical.ParamRelated), "END") {
+			ref, err = componentEnd(parent, loc)
+		} else {
+			ref, err = parent.Props.DateTime(ical.PropDateTimeStart, loc)
+		}
+		if err != nil {
+			return nil, err
+		} else if ref.IsZero() {
+			return nil, nil
+		}
+		trigger = ref.Add(offset)
+	}
+
+	triggers := []time.Time{trigger}
+	repeatProp := alarm.Props.Get(ical.PropRepeat)
+	durProp := alarm.Props.Get(ical.PropDuration)
+	if repeatProp != nil && durProp != nil {
+		repeat, err := repeatProp.Int()
+		if err != nil {
+			return nil, err
+		}
+		interval, err := durProp.Duration()
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i <= repeat; i++ {
+			triggers = append(triggers, trigger.Add(time.Duration(i)*interval))
+		}
+	}
+	return triggers, nil
+}
+
 func matchPropTimeRange(start, end time.Time, field *ical.Prop) (bool, error) {
 	// See https://datatracker.ietf.org/doc/html/rfc4791#section-9.9
 
@@ -181,25 +520,50 @@ func matchPropTimeRange(start, end time.Time, field *ical.Prop) (bool, error) {
 	return false, nil
 }
 
-func matchParamFilter(filter ParamFilter, field *ical.Prop) bool {
-	// TODO there can be multiple values
-	value := field.Params.Get(filter.Name)
-	if value == "" {
-		return filter.IsNotDefined
+// paramValues returns all values of a parameter, e.g. the addresses of a
+// MEMBER parameter. Parameter names are case-insensitive.
+func paramValues(params ical.Params, name string) []string {
+	var values []string
+	for k, l := range params {
+		if strings.EqualFold(k, name) {
+			values = append(values, l...)
+		}
+	}
+	return values
+}
+
+func matchParamFilter(filter ParamFilter, field *ical.Prop) (bool, error) {
+	values := paramValues(field.Params, filter.Name)
+	if len(values) == 0 {
+		return filter.IsNotDefined, nil
 	} else if filter.IsNotDefined {
-		return false
+		return false, nil
+	}
+	if filter.TextMatch == nil {
+		return true, nil
 	}
-	if filter.TextMatch != nil {
-		return matchTextMatch(*filter.TextMatch, value)
+
+	// The filter matches if any of the values matches
+	for _, value := range values {
+		ok, err := matchTextMatch(*filter.TextMatch, value)
+		if err != nil || ok {
+			return ok, err
+		}
 	}
-	return true
+	return false, nil
 }
 
-func matchTextMatch(txt TextMatch, value string) bool {
-	// TODO: handle text-match collation attribute
-	match := strings.Contains(value, txt.Text)
+func matchTextMatch(txt TextMatch, value string) (bool, error) {
+	collation := txt.Collation
+	if collation == "" {
+		collation = internal.CollationASCIICasemap
+	}
+	match, err := internal.MatchText(collation, "contains", txt.Text, value)
+	if err != nil {
+		return false, err
+	}
 	if txt.NegateCondition {
 		match = !match
 	}
-	return match
+	return match, nil
 }
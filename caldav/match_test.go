@@ -160,6 +160,118 @@ ACTION:AUDIO
 TRIGGER;RELATED=START:-PT10M
 END:VALARM
 END:VTODO
+END:VCALENDAR`)
+
+	event4 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T100000Z
+DURATION:PT1H
+RRULE:FREQ=DAILY;COUNT=5
+EXDATE:20060103T100000Z
+SUMMARY:Event #4
+UID:4A3D3F9C2B1E4C0D8E7F6A5B@example.com
+END:VEVENT
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060110T100000Z
+DURATION:PT1H
+RECURRENCE-ID:20060104T100000Z
+SUMMARY:Event #4 bis
+UID:4A3D3F9C2B1E4C0D8E7F6A5B@example.com
+END:VEVENT
+END:VCALENDAR`)
+
+	event5 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060201T100000Z
+DURATION:PT1H
+RDATE:20060301T100000Z,20060401T100000Z
+SUMMARY:Event #5
+UID:5B4E4A0D3C2F5D1E9F8A7B6C@example.com
+END:VEVENT
+END:VCALENDAR`)
+
+	event6 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T000000Z
+DTEND:20060104T000000Z
+RRULE:FREQ=WEEKLY;COUNT=3
+SUMMARY:Event #6
+UID:6C5F5B1E4D3A6E2F0A9B8C7D@example.com
+END:VEVENT
+END:VCALENDAR`)
+
+	todo2 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VTODO
+DTSTAMP:20060205T235335Z
+DTSTART:20060106T090000Z
+DUE:20060107T000000Z
+SUMMARY:Task #2
+UID:E3A4B5C6D7E8F9A0B1C2D3E4@example.com
+BEGIN:VALARM
+ACTION:DISPLAY
+DESCRIPTION:Task #2 is due
+TRIGGER;RELATED=END:-PT1H
+END:VALARM
+END:VTODO
+END:VCALENDAR`)
+
+	event7 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T100000Z
+DURATION:PT1H
+RRULE:FREQ=DAILY;COUNT=5
+SUMMARY:Event #7
+UID:7D6A6C2F5E4B7F3A1B0C9D8E@example.com
+BEGIN:VALARM
+ACTION:DISPLAY
+DESCRIPTION:Event #7 starts soon
+TRIGGER:-PT15M
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060105T140000Z
+DURATION:PT1H
+RECURRENCE-ID:20060105T100000Z
+SUMMARY:Event #7 bis
+UID:7D6A6C2F5E4B7F3A1B0C9D8E@example.com
+END:VEVENT
+END:VCALENDAR`)
+
+	journal1 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VJOURNAL
+DTSTAMP:20060206T001121Z
+DTSTART;VALUE=DATE:20060105
+SUMMARY:Journal #1
+UID:F4B5C6D7E8F9A0B1C2D3E4F5@example.com
+END:VJOURNAL
+END:VCALENDAR`)
+
+	freebusy1 := newCO(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VFREEBUSY
+DTSTAMP:20060206T001121Z
+UID:A5C6D7E8F9A0B1C2D3E4F5A6@example.com
+FREEBUSY:20060102T080000Z/20060102T090000Z,20060103T080000Z/PT2H
+END:VFREEBUSY
 END:VCALENDAR`)
 
 	for _, tc := range []struct {
@@ -226,6 +338,81 @@ END:VCALENDAR`)
 			addrs: []CalendarObject{event1, event2, event3, todo1},
 			want:  []CalendarObject{event2, event3},
 		},
+		{
+			// https://datatracker.ietf.org/doc/html/rfc4791#section-7.8.5
+			name: "todos in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VTODO",
+							Start: toDate(t, "20060103T000000Z"),
+							End:   toDate(t, "20060105T000000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, todo1, todo2, journal1, freebusy1},
+			want:  []CalendarObject{todo1},
+		},
+		{
+			name: "journals in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VJOURNAL",
+							Start: toDate(t, "20060105T120000Z"),
+							End:   toDate(t, "20060106T000000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, todo1, todo2, journal1, freebusy1},
+			want:  []CalendarObject{journal1},
+		},
+		{
+			name: "free-busy in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VFREEBUSY",
+							Start: toDate(t, "20060103T090000Z"),
+							End:   toDate(t, "20060103T100000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, todo1, todo2, journal1, freebusy1},
+			want:  []CalendarObject{freebusy1},
+		},
+		{
+			// https://datatracker.ietf.org/doc/html/rfc4791#section-7.8.5
+			name: "alarms in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name: "VTODO",
+							Comps: []CompFilter{
+								CompFilter{
+									Name:  "VALARM",
+									Start: toDate(t, "20060106T230000Z"),
+									End:   toDate(t, "20060107T000000Z"),
+								},
+							},
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, todo1, todo2, journal1, freebusy1},
+			want:  []CalendarObject{todo2},
+		},
 		{
 			// https://datatracker.ietf.org/doc/html/rfc4791#section-7.8.6
 			name: "events by UID",
@@ -270,6 +457,49 @@ END:VCALENDAR`)
 			addrs: []CalendarObject{event1, event2, event3, todo1},
 			want:  []CalendarObject{event1},
 		},
+		{
+			name: "events by description substring with default collation",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name: "VEVENT",
+							Props: []PropFilter{{
+								Name: "Description",
+								TextMatch: &TextMatch{
+									Text: "steelers",
+								},
+							}},
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, event2, event3, todo1},
+			want:  []CalendarObject{event1},
+		},
+		{
+			name: "events by description substring with octet collation",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name: "VEVENT",
+							Props: []PropFilter{{
+								Name: "Description",
+								TextMatch: &TextMatch{
+									Text:      "steelers",
+									Collation: "i;octet",
+								},
+							}},
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, event2, event3, todo1},
+			want:  nil,
+		},
 		{
 			// Query a time range that only returns a result if recurrence is properly evaluated.
 			name: "recurring events in time range",
@@ -288,6 +518,118 @@ END:VCALENDAR`)
 			addrs: []CalendarObject{event1, event2, event3, todo1},
 			want:  []CalendarObject{event2},
 		},
+		{
+			name: "recurring events with excluded and overridden instances",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VEVENT",
+							Start: toDate(t, "20060103T000000Z"),
+							End:   toDate(t, "20060105T000000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event4},
+			want:  nil,
+		},
+		{
+			name: "overridden recurrence instance in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VEVENT",
+							Start: toDate(t, "20060110T000000Z"),
+							End:   toDate(t, "20060111T000000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event4},
+			want:  []CalendarObject{event4},
+		},
+		{
+			name: "recurrence dates in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VEVENT",
+							Start: toDate(t, "20060301T000000Z"),
+							End:   toDate(t, "20060302T000000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event5},
+			want:  []CalendarObject{event5},
+		},
+		{
+			name: "recurring event overlapping time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name:  "VEVENT",
+							Start: toDate(t, "20060110T120000Z"),
+							End:   toDate(t, "20060110T130000Z"),
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event6},
+			want:  []CalendarObject{event6},
+		},
+		{
+			name: "alarms of recurring event in time range",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name: "VEVENT",
+							Comps: []CompFilter{
+								CompFilter{
+									Name:  "VALARM",
+									Start: toDate(t, "20060104T094000Z"),
+									End:   toDate(t, "20060104T095000Z"),
+								},
+							},
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event1, event7},
+			want:  []CalendarObject{event7},
+		},
+		{
+			name: "alarms of overridden instance",
+			query: &CalendarQuery{
+				CompFilter: CompFilter{
+					Name: "VCALENDAR",
+					Comps: []CompFilter{
+						CompFilter{
+							Name: "VEVENT",
+							Comps: []CompFilter{
+								CompFilter{
+									Name:  "VALARM",
+									Start: toDate(t, "20060105T094000Z"),
+									End:   toDate(t, "20060105T095000Z"),
+								},
+							},
+						},
+					},
+				},
+			},
+			addrs: []CalendarObject{event7},
+			want:  nil,
+		},
 		// TODO add more examples
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -309,3 +651,130 @@ END:VCALENDAR`)
 		})
 	}
 }
+
+func TestComponentRecurrenceSet(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example Corp.//CalDAV Client//EN
+BEGIN:VEVENT
+DTSTAMP:20060206T001121Z
+DTSTART:20060102T100000Z
+DURATION:PT1H
+RRULE:FREQ=DAILY;COUNT=4
+RDATE:20060110T100000Z,20060111T100000Z
+EXDATE:20060103T100000Z,20060111T100000Z
+UID:7D6A6C2F5E4B7F3A1B0C9D8E@example.com
+END:VEVENT
+END:VCALENDAR
+`)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rset, err := componentRecurrenceSet(cal.Children[0], time.UTC)
+	if err != nil {
+		t.Fatalf("componentRecurrenceSet() = %v", err)
+	}
+
+	var got []string
+	for dt := rset.After(time.Time{}, true); !dt.IsZero(); dt = rset.After(dt, false) {
+		got = append(got, dt.UTC().Format("20060102"))
+	}
+	want := []string{"20060102", "20060104", "20060105", "20060110"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("instances = %v, want %v", got, want)
+	}
+}
+
+func TestMatchParamFilter(t *testing.T) {
+	prop := ical.NewProp(ical.PropAttendee)
+	prop.Value = "mailto:carla@example.com"
+	prop.Params["MEMBER"] = []string{"mailto:team-a@example.com", "mailto:team-b@example.com"}
+
+	for _, tc := range []struct {
+		filter ParamFilter
+		want   bool
+	}{
+		{ParamFilter{Name: "MEMBER", TextMatch: &TextMatch{Text: "team-b"}}, true},
+		{ParamFilter{Name: "member", TextMatch: &TextMatch{Text: "team-a"}}, true},
+		{ParamFilter{Name: "MEMBER", TextMatch: &TextMatch{Text: "team-c"}}, false},
+		{ParamFilter{Name: "member"}, true},
+		{ParamFilter{Name: "member", IsNotDefined: true}, false},
+		{ParamFilter{Name: "ROLE", IsNotDefined: true}, true},
+	} {
+		ok, err := matchParamFilter(tc.filter, prop)
+		if err != nil {
+			t.Errorf("matchParamFilter(%+v) = %v", tc.filter, err)
+		} else if ok != tc.want {
+			t.Errorf("matchParamFilter(%+v) = %v, want %v", tc.filter, ok, tc.want)
+		}
+	}
+}
+
+func TestMatchPropFilter(t *testing.T) {
+	event := ical.NewEvent()
+	for _, attendee := range []struct {
+		cn, partStat, cuType string
+		member               []string
+	}{
+		{"Alice", "ACCEPTED", "", nil},
+		{"Bob", "DECLINED", "", []string{"mailto:team-a@example.com"}},
+		{"Carla", "NEEDS-ACTION", "", []string{"mailto:team-a@example.com", "mailto:team-b@example.com"}},
+		{"Team-A", "NEEDS-ACTION", "GROUP", nil},
+	} {
+		prop := ical.NewProp(ical.PropAttendee)
+		prop.Value = "mailto:" + strings.ToLower(attendee.cn) + "@example.com"
+		prop.Params.Set(ical.ParamCommonName, attendee.cn)
+		prop.Params.Set(ical.ParamParticipationStatus, attendee.partStat)
+		if attendee.cuType != "" {
+			prop.Params.Set(ical.ParamCalendarUserType, attendee.cuType)
+		}
+		if attendee.member != nil {
+			prop.Params["MEMBER"] = attendee.member
+		}
+		event.Props.Add(prop)
+	}
+
+	cn := func(s string) ParamFilter {
+		return ParamFilter{Name: ical.ParamCommonName, TextMatch: &TextMatch{Text: s}}
+	}
+	partStat := func(s string) ParamFilter {
+		return ParamFilter{Name: ical.ParamParticipationStatus, TextMatch: &TextMatch{Text: s}}
+	}
+	member := func(s string) ParamFilter {
+		return ParamFilter{Name: "MEMBER", TextMatch: &TextMatch{Text: s}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter PropFilter
+		want   bool
+	}{
+		{"first CN", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("alice")}}, true},
+		{"last CN", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("carla")}}, true},
+		{"missing CN", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("dave")}}, false},
+		{"same instance", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("bob"), partStat("DECLINED")}}, true},
+		{"different instances", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("alice"), partStat("DECLINED")}}, false},
+		{"group member", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{member("team-b"), cn("carla")}}, true},
+		{"other group member", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{member("team-b"), cn("bob")}}, false},
+		{"param and value", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("bob")}, TextMatch: &TextMatch{Text: "bob@"}}, true},
+		{"param and other value", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{cn("bob")}, TextMatch: &TextMatch{Text: "alice@"}}, false},
+		{"group", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{partStat("NEEDS-ACTION")}, TextMatch: &TextMatch{Text: "team-a@"}}, true},
+		{"group-expanded", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{partStat("DECLINED")}, TextMatch: &TextMatch{Text: "team-a@"}}, true},
+		{"group-expanded non-member", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{partStat("ACCEPTED")}, TextMatch: &TextMatch{Text: "team-a@"}}, false},
+		{"member of uninvited group", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{partStat("NEEDS-ACTION")}, TextMatch: &TextMatch{Text: "team-b@"}}, false},
+		{"negated value", PropFilter{Name: "ATTENDEE", TextMatch: &TextMatch{Text: "alice@", NegateCondition: true}}, true},
+		{"param not defined", PropFilter{Name: "ATTENDEE", ParamFilter: []ParamFilter{{Name: "MEMBER", IsNotDefined: true}}}, true},
+		{"defined", PropFilter{Name: "ATTENDEE"}, true},
+		{"not defined", PropFilter{Name: "ATTENDEE", IsNotDefined: true}, false},
+		{"other prop not defined", PropFilter{Name: "ORGANIZER", IsNotDefined: true}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := matchPropFilter(tc.filter, event.Component)
+			if err != nil {
+				t.Fatalf("matchPropFilter() = %v", err)
+			} else if ok != tc.want {
+				t.Errorf("matchPropFilter() = %v, want %v", ok, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// MemBackend is an in-memory Backend, e.g. for tests. It's safe for
+// concurrent use.
+//
+// ETags and sync tokens are derived from a change counter, so they change
+// whenever an object is written.
+type MemBackend struct {
+	principalPath, homeSetPath string
+
+	mu        sync.Mutex
+	calendars map[string]*memCalendar
+	seq       uint64
+}
+
+type memCalendar struct {
+	cal     Calendar
+	seq     uint64 // latest change
+	objects map[string]*memObject
+	removed map[string]uint64 // change sequence numbers by path
+}
+
+type memObject struct {
+	data              []byte
+	uid               string
+	modTime           time.Time
+	created, modified uint64
+}
+
+var (
+	_ Backend         = (*MemBackend)(nil)
+	_ CalendarCreator = (*MemBackend)(nil)
+	_ SyncBackend     = (*MemBackend)(nil)
+	_ DryRunBackend   = (*MemBackend)(nil)
+	_ MoveBackend     = (*MemBackend)(nil)
+)
+
+// NewMemBackend creates an in-memory backend without calendars. The paths
+// must follow the layout expected by Handler, e.g. "/user/" and
+// "/user/calendars/".
+func NewMemBackend(principalPath, homeSetPath string) *MemBackend {
+	return &MemBackend{
+		principalPath: principalPath,
+		homeSetPath:   strings.TrimSuffix(homeSetPath, "/") + "/",
+		calendars:     make(map[string]*memCalendar),
+	}
+}
+
+func (o *memObject) calendarObject(p string) (*CalendarObject, error) {
+	data, err := ical.NewDecoder(bytes.NewReader(o.data)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &CalendarObject{
+		Path:          p,
+		ModTime:       o.modTime,
+		ContentLength: int64(len(o.data)),
+		ETag:          strconv.FormatUint(o.modified, 16),
+		Data:          data,
+	}, nil
+}
+
+// calendar returns the calendar at a path, with or without a trailing slash.
+// The lock must be held.
+func (b *MemBackend) calendar(p string) (*memCalendar, error) {
+	c := b.calendars[strings.TrimSuffix(p, "/")+"/"]
+	if c == nil {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar %q not found", p)
+	}
+	return c, nil
+}
+
+func (b *MemBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.principalPath, nil
+}
+
+func (b *MemBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return b.homeSetPath, nil
+}
+
+func (b *MemBackend) ListCalendars(ctx context.Context) ([]Calendar, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := make([]Calendar, 0, len(b.calendars))
+	for _, c := range b.calendars {
+		l = append(l, c.cal)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+	return l, nil
+}
+
+func (b *MemBackend) GetCalendar(ctx context.Context, p string) (*Calendar, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(p)
+	if err != nil {
+		return nil, err
+	}
+	cal := c.cal
+	return &cal, nil
+}
+
+func (b *MemBackend) CreateCalendar(ctx context.Context, calendar Calendar) error {
+	p := strings.TrimSuffix(calendar.Path, "/") + "/"
+	if path.Dir(strings.TrimSuffix(p, "/"))+"/" != b.homeSetPath {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: calendars must be created in the calendar home set")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.calendars[p]; ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: calendar %q already exists", p)
+	}
+	calendar.Path = p
+	b.seq++
+	b.calendars[p] = &memCalendar{
+		cal:     calendar,
+		seq:     b.seq,
+		objects: make(map[string]*memObject),
+		removed: make(map[string]uint64),
+	}
+	return nil
+}
+
+func (b *MemBackend) GetCalendarObject(ctx context.Context, p string, req *CalendarCompRequest) (*CalendarObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	o := c.objects[p]
+	if o == nil {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	}
+	return o.calendarObject(p)
+}
+
+func (b *MemBackend) ListCalendarObjects(ctx context.Context, p string, req *CalendarCompRequest) ([]CalendarObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(p)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]CalendarObject, 0, len(c.objects))
+	for objPath, o := range c.objects {
+		co, err := o.calendarObject(objPath)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *co)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+	return l, nil
+}
+
+func (b *MemBackend) QueryCalendarObjects(ctx context.Context, p string, query *CalendarQuery) ([]CalendarObject, error) {
+	l, err := b.ListCalendarObjects(ctx, p, &query.CompRequest)
+	if err != nil {
+		return nil, err
+	}
+	return Filter(query, l)
+}
+
+// checkPutConditions checks the If-Match and If-None-Match preconditions of
+// a PUT request against the ETag of the current object, if any.
+func checkPutConditions(opts *PutCalendarObjectOptions, etag string, exists bool) error {
+	if opts.IfNoneMatch.IsSet() && exists {
+		if opts.IfNoneMatch.IsWildcard() {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "caldav: calendar object already exists")
+		}
+		if v, err := opts.IfNoneMatch.ETag(); err == nil && v == etag {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "caldav: calendar object ETag matches")
+		}
+	}
+	if opts.IfMatch.IsSet() {
+		if !exists {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "caldav: calendar object doesn't exist")
+		}
+		if v, err := opts.IfMatch.ETag(); !opts.IfMatch.IsWildcard() && (err != nil || v != etag) {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "caldav: calendar object ETag doesn't match")
+		}
+	}
+	return nil
+}
+
+func (b *MemBackend) SupportsDryRun() bool {
+	return true
+}
+
+func (b *MemBackend) PutCalendarObject(ctx context.Context, p string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (loc string, err error) {
+	if opts == nil {
+		opts = &PutCalendarObjectOptions{}
+	}
+	_, uid, err := ValidateCalendarObject(calendar)
+	if err != nil {
+		return "", NewPreconditionError(PreconditionValidCalendarObjectResource)
+	}
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(calendar); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(path.Dir(p))
+	if err != nil {
+		return "", internal.HTTPErrorf(http.StatusConflict, "caldav: calendar %q not found", path.Dir(p))
+	}
+
+	o := c.objects[p]
+	var etag string
+	if o != nil {
+		etag = strconv.FormatUint(o.modified, 16)
+	}
+	if err := checkPutConditions(opts, etag, o != nil); err != nil {
+		return "", err
+	}
+	if err := c.checkUID(uid, p); err != nil {
+		return "", err
+	}
+	if opts.DryRun {
+		return p, nil
+	}
+
+	b.seq++
+	c.seq = b.seq
+	if o == nil {
+		o = &memObject{created: c.seq}
+		c.objects[p] = o
+	}
+	o.data = buf.Bytes()
+	o.uid = uid
+	o.modTime = time.Now()
+	o.modified = c.seq
+	return p, nil
+}
+
+// checkUID checks that no object other than the excluded ones has the given
+// UID. The lock must be held.
+func (c *memCalendar) checkUID(uid string, exclude ...string) error {
+	if uid == "" {
+		return nil
+	}
+objects:
+	for objPath, o := range c.objects {
+		for _, p := range exclude {
+			if objPath == p {
+				continue objects
+			}
+		}
+		if o.uid == uid {
+			return NewPreconditionError(PreconditionNoUIDConflict)
+		}
+	}
+	return nil
+}
+
+// MoveCalendarObject implements MoveBackend.
+func (b *MemBackend) MoveCalendarObject(ctx context.Context, src, dest string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	srcCal, err := b.calendar(path.Dir(src))
+	if err != nil {
+		return err
+	}
+	o := srcCal.objects[src]
+	if o == nil {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", src)
+	}
+	destCal, err := b.calendar(path.Dir(dest))
+	if err != nil {
+		return internal.HTTPErrorf(http.StatusConflict, "caldav: calendar %q not found", path.Dir(dest))
+	}
+	if err := destCal.checkUID(o.uid, src, dest); err != nil {
+		return err
+	}
+
+	b.seq++
+	delete(srcCal.objects, src)
+	srcCal.removed[src] = b.seq
+	srcCal.seq = b.seq
+	destCal.objects[dest] = &memObject{
+		data:     o.data,
+		uid:      o.uid,
+		modTime:  o.modTime,
+		created:  b.seq,
+		modified: b.seq,
+	}
+	destCal.seq = b.seq
+	return nil
+}
+
+func (b *MemBackend) DeleteCalendarObject(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if _, ok := c.objects[p]; !ok {
+		return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+	}
+	b.seq++
+	c.seq = b.seq
+	delete(c.objects, p)
+	c.removed[p] = c.seq
+	return nil
+}
+
+func (b *MemBackend) CalendarSyncToken(ctx context.Context, p string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(p)
+	if err != nil {
+		return "", err
+	}
+	return internal.FormatSyncToken(c.seq), nil
+}
+
+func (b *MemBackend) CalendarChanges(ctx context.Context, p, syncToken string) (*webdav.SyncChanges, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.calendar(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var since uint64
+	var removed map[string]uint64
+	if syncToken != "" {
+		if since, err = internal.ParseSyncToken(syncToken, c.seq); err != nil {
+			return nil, err
+		}
+		removed = c.removed
+	}
+
+	members := make([]internal.MemberVersion, 0, len(c.objects))
+	for objPath, o := range c.objects {
+		members = append(members, internal.MemberVersion{
+			Path:     objPath,
+			Created:  o.created,
+			Modified: o.modified,
+		})
+	}
+
+	changes := webdav.SyncChanges{SyncToken: internal.FormatSyncToken(c.seq)}
+	changes.Added, changes.Modified, changes.Deleted = internal.ChangesSince(members, removed, since)
+	return &changes, nil
+}
@@ -0,0 +1,126 @@
+package caldav
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/emersion/go-webdav"
+)
+
+// MigrateOptions contains options for Migrate.
+type MigrateOptions struct {
+	// CalendarPath maps a source calendar to the path of the destination
+	// calendar. If nil, the base name of the source calendar path is joined
+	// to the destination calendar home set.
+	CalendarPath func(cal *Calendar) string
+	// State, if set, is used to skip objects migrated by a previous call.
+	State webdav.MigrationState
+	// Progress, if set, is called after each object is processed.
+	Progress func(progress *webdav.MigrationProgress)
+}
+
+// Migrate copies all calendar objects in a calendar home set of a CalDAV
+// server into a backend. Missing destination calendars are created, which
+// requires the backend to implement CalendarCreator.
+//
+// The backend is called with ctx, which should carry the identity of the
+// destination user.
+func Migrate(ctx context.Context, src *Client, calendarHomeSet string, dst Backend, opts *MigrateOptions) error {
+	if opts == nil {
+		opts = new(MigrateOptions)
+	}
+
+	cals, err := src.FindCalendars(ctx, calendarHomeSet)
+	if err != nil {
+		return err
+	}
+
+	var dstHomeSet string
+	if opts.CalendarPath == nil {
+		dstHomeSet, err = dst.CalendarHomeSetPath(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range cals {
+		cal := &cals[i]
+
+		var dstPath string
+		if opts.CalendarPath != nil {
+			dstPath = opts.CalendarPath(cal)
+		} else {
+			dstPath = path.Join(dstHomeSet, path.Base(cal.Path)) + "/"
+		}
+		if _, err := dst.GetCalendar(ctx, dstPath); err != nil {
+			dstCal := *cal
+			dstCal.Path = dstPath
+			creator, ok := calendarCreator(dst)
+			if !ok {
+				return fmt.Errorf("caldav: destination calendar %q doesn't exist and the backend can't create calendars", dstPath)
+			}
+			if err := creator.CreateCalendar(ctx, dstCal); err != nil {
+				return fmt.Errorf("caldav: failed to create destination calendar %q: %w", dstPath, err)
+			}
+		}
+
+		if err := migrateCalendar(ctx, src, cal, dst, dstPath, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateCalendar(ctx context.Context, src *Client, cal *Calendar, dst Backend, dstPath string, opts *MigrateOptions) error {
+	objs, err := queryAllCalendarObjects(ctx, src, cal.Path)
+	if err != nil {
+		return fmt.Errorf("caldav: failed to list calendar %q: %w", cal.Path, err)
+	}
+
+	for i, obj := range objs {
+		progress := webdav.MigrationProgress{
+			Collection: cal.Path,
+			Path:       obj.Path,
+			Done:       i + 1,
+			Total:      len(objs),
+		}
+
+		if opts.State != nil {
+			progress.Skipped, err = opts.State.IsMigrated(ctx, obj.Path, obj.ETag)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !progress.Skipped {
+			p := path.Join(dstPath, path.Base(obj.Path))
+			if _, err := dst.PutCalendarObject(ctx, p, obj.Data, &PutCalendarObjectOptions{}); err != nil {
+				return fmt.Errorf("caldav: failed to migrate calendar object %q: %w", obj.Path, err)
+			}
+			if opts.State != nil {
+				if err := opts.State.SetMigrated(ctx, obj.Path, obj.ETag); err != nil {
+					return err
+				}
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(&progress)
+		}
+	}
+
+	return nil
+}
+
+func queryAllCalendarObjects(ctx context.Context, c *Client, calendar string) ([]CalendarObject, error) {
+	return c.QueryCalendar(ctx, calendar, &CalendarQuery{
+		CompRequest: CalendarCompRequest{
+			Name:     "VCALENDAR",
+			AllProps: true,
+			AllComps: true,
+		},
+		CompFilter: CompFilter{Name: "VCALENDAR"},
+	})
+}
@@ -0,0 +1,101 @@
+package caldav
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// MirrorOptions contains options for Mirror.
+type MirrorOptions struct {
+	// State maps "<calendar>/<object>" base names to the ETags of the source
+	// calendar objects as of the last mirror. It's updated in place and
+	// should be persisted between calls: objects whose ETag hasn't changed
+	// are skipped. If nil, all objects are copied.
+	State map[string]string
+	// Delete removes destination calendar objects missing from the source.
+	Delete bool
+}
+
+// Mirror copies the calendars of the current user principal from a CalDAV
+// server to another one, overwriting modified objects. Calendars are matched
+// by the base name of their path and must exist on the destination.
+func Mirror(ctx context.Context, src, dst *Client, opts *MirrorOptions) error {
+	if opts == nil {
+		opts = new(MirrorOptions)
+	}
+
+	srcDiscovery, err := src.DiscoverCalendars(ctx)
+	if err != nil {
+		return fmt.Errorf("caldav: failed to list mirror source calendars: %w", err)
+	}
+	dstDiscovery, err := dst.DiscoverCalendars(ctx)
+	if err != nil {
+		return fmt.Errorf("caldav: failed to list mirror destination calendars: %w", err)
+	}
+	dstCalPaths := make(map[string]string, len(dstDiscovery.Calendars))
+	for _, cal := range dstDiscovery.Calendars {
+		dstCalPaths[path.Base(cal.Path)] = cal.Path
+	}
+
+	seen := make(map[string]bool)
+	for _, cal := range srcDiscovery.Calendars {
+		calName := path.Base(cal.Path)
+		dstCalPath, ok := dstCalPaths[calName]
+		if !ok {
+			return fmt.Errorf("caldav: mirror destination calendar %q doesn't exist", calName)
+		}
+
+		objs, err := queryAllCalendarObjects(ctx, src, cal.Path)
+		if err != nil {
+			return fmt.Errorf("caldav: failed to list calendar %q: %w", cal.Path, err)
+		}
+		dstObjs, err := dst.ReadDir(ctx, dstCalPath, false)
+		if err != nil {
+			return fmt.Errorf("caldav: failed to list calendar %q: %w", dstCalPath, err)
+		}
+		dstPaths := make(map[string]string, len(dstObjs))
+		for _, fi := range dstObjs {
+			if !fi.IsDir {
+				dstPaths[path.Base(fi.Path)] = fi.Path
+			}
+		}
+
+		srcNames := make(map[string]bool, len(objs))
+		for _, obj := range objs {
+			name := path.Base(obj.Path)
+			key := calName + "/" + name
+			srcNames[name] = true
+			seen[key] = true
+
+			if _, ok := dstPaths[name]; ok && opts.State != nil && obj.ETag != "" && opts.State[key] == obj.ETag {
+				continue
+			}
+			if _, err := dst.PutCalendarObject(ctx, path.Join(dstCalPath, name), obj.Data); err != nil {
+				return fmt.Errorf("caldav: failed to mirror calendar object %q: %w", obj.Path, err)
+			}
+			if opts.State != nil {
+				opts.State[key] = obj.ETag
+			}
+		}
+
+		if opts.Delete {
+			for name, p := range dstPaths {
+				if srcNames[name] {
+					continue
+				}
+				if err := dst.RemoveAll(ctx, p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for key := range opts.State {
+		if !seen[key] {
+			delete(opts.State, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package caldav
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/teambition/rrule-go"
+)
+
+// maxRecurrenceInstances is the maximum number of instances of a recurring
+// component enumerated to match or expand it. Beyond it, requests fail with
+// the CALDAV:max-instances precondition: a frequent rule over a long time
+// range would otherwise keep the server busy.
+const maxRecurrenceInstances = 3500
+
+// recurrenceSet is the set of start times of the instances of a recurring
+// component.
+type recurrenceSet interface {
+	// After returns the first instance after t, or the zero time if there is
+	// none. If inc is true, an instance equal to t is included.
+	After(t time.Time, inc bool) time.Time
+}
+
+// dateList is a finite recurrenceSet.
+type dateList []time.Time
+
+func (l dateList) After(t time.Time, inc bool) time.Time {
+	for _, dt := range l {
+		if dt.After(t) || (inc && dt.Equal(t)) {
+			return dt
+		}
+	}
+	return time.Time{}
+}
+
+// parseDateTimeList parses all values of a list of DATE or DATE-TIME
+// properties, e.g. RDATE or EXDATE.
+func parseDateTimeList(props []ical.Prop, loc *time.Location) ([]time.Time, error) {
+	var l []time.Time
+	for _, prop := range props {
+		for _, v := range strings.Split(prop.Value, ",") {
+			p := prop
+			p.Value = v
+			t, err := p.DateTime(loc)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, t)
+		}
+	}
+	return l, nil
+}
+
+// componentRecurrenceSet returns the recurrence set defined by the RRULE,
+// RDATE and EXDATE properties of a component. It returns nil if the component
+// isn't recurring.
+//
+// Component.RecurrenceSet isn't used since it ignores RDATE and doesn't
+// support lists of comma-separated dates.
+func componentRecurrenceSet(comp *ical.Component, loc *time.Location) (recurrenceSet, error) {
+	roption, err := comp.Props.RecurrenceRule()
+	if err != nil {
+		return nil, fmt.Errorf("caldav: failed to parse RRULE: %v", err)
+	}
+	if roption == nil && comp.Props.Get(ical.PropRecurrenceDates) == nil {
+		return nil, nil
+	}
+
+	dtstart, err := comp.Props.DateTime(ical.PropDateTimeStart, loc)
+	if err != nil {
+		return nil, err
+	}
+	rdates, err := parseDateTimeList(comp.Props[ical.PropRecurrenceDates], loc)
+	if err != nil {
+		return nil, err
+	}
+	exdates, err := parseDateTimeList(comp.Props[ical.PropExceptionDates], loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if roption != nil {
+		rule, err := rrule.NewRRule(*roption)
+		if err != nil {
+			return nil, fmt.Errorf("caldav: failed to build RRULE: %v", err)
+		}
+		var rset rrule.Set
+		rset.RRule(rule)
+		rset.DTStart(dtstart)
+		for _, t := range rdates {
+			rset.RDate(t)
+		}
+		for _, t := range exdates {
+			rset.ExDate(t)
+		}
+		return &rset, nil
+	}
+
+	// RDATE without RRULE: the instances are DTSTART and the listed dates
+	var l dateList
+	for _, t := range append([]time.Time{dtstart}, rdates...) {
+		excluded := false
+		for _, exdate := range exdates {
+			if t.Equal(exdate) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			l = append(l, t)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Before(l[j])
+	})
+	return l, nil
+}
+
+// recurrenceOverrides records the instances of recurring components which are
+// overridden by another component with a RECURRENCE-ID property.
+type recurrenceOverrides map[string]bool
+
+func overrideKey(uid string, t time.Time) string {
+	return uid + "\x00" + t.UTC().Format(time.RFC3339Nano)
+}
+
+func newRecurrenceOverrides(comps []*ical.Component, loc *time.Location) (recurrenceOverrides, error) {
+	var overrides recurrenceOverrides
+	for _, comp := range comps {
+		prop := comp.Props.Get(ical.PropRecurrenceID)
+		if prop == nil {
+			continue
+		}
+		t, err := prop.DateTime(loc)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := comp.Props.Text(ical.PropUID)
+		if overrides == nil {
+			overrides = make(recurrenceOverrides)
+		}
+		overrides[overrideKey(uid, t)] = true
+	}
+	return overrides, nil
+}
+
+// isOverridden reports whether the instance of comp starting at t is
+// overridden by another component.
+func (overrides recurrenceOverrides) isOverridden(comp *ical.Component, t time.Time) bool {
+	if len(overrides) == 0 {
+		return false
+	}
+	uid, _ := comp.Props.Text(ical.PropUID)
+	return overrides[overrideKey(uid, t)]
+}
+
+// componentEnd returns the end of an event, or the due date of a to-do. A
+// zero time is returned if there is none.
+func componentEnd(comp *ical.Component, loc *time.Location) (time.Time, error) {
+	switch comp.Name {
+	case ical.CompEvent:
+		event := ical.Event{comp}
+		return event.DateTimeEnd(loc)
+	case ical.CompToDo:
+		if comp.Props.Get(ical.PropDue) != nil {
+			return comp.Props.DateTime(ical.PropDue, loc)
+		}
+		durProp := comp.Props.Get(ical.PropDuration)
+		start, err := comp.Props.DateTime(ical.PropDateTimeStart, loc)
+		if err != nil || durProp == nil || start.IsZero() {
+			return time.Time{}, err
+		}
+		dur, err := durProp.Duration()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return start.Add(dur), nil
+	}
+	return time.Time{}, nil
+}
+
+// componentDuration returns the duration of each instance of a component.
+func componentDuration(comp *ical.Component, loc *time.Location) (time.Duration, error) {
+	start, err := comp.Props.DateTime(ical.PropDateTimeStart, loc)
+	if err != nil {
+		return 0, err
+	}
+	end, err := componentEnd(comp, loc)
+	if err != nil {
+		return 0, err
+	}
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0, nil
+	}
+	return end.Sub(start), nil
+}
+
+// overlapsTimeRange reports whether an instance starting at instStart and
+// lasting dur overlaps the time range [start, end), as defined in RFC 4791
+// section 9.9. A zero end means an unbounded time range.
+func overlapsTimeRange(start, end, instStart time.Time, dur time.Duration) bool {
+	if !end.IsZero() && !instStart.Before(end) {
+		return false
+	}
+	if dur == 0 {
+		return !instStart.Before(start)
+	}
+	return instStart.Add(dur).After(start)
+}
+
+// matchRecurrenceTimeRange reports whether an instance of a recurring
+// component overlaps the time range [start, end). Instances overridden by
+// another component are skipped.
+func matchRecurrenceTimeRange(start, end time.Time, comp *ical.Component, rset recurrenceSet, overrides recurrenceOverrides) (bool, error) {
+	dur, err := componentDuration(comp, start.Location())
+	if err != nil {
+		return false, err
+	}
+
+	t, inc := start.Add(-dur), true
+	for n := 0; ; n++ {
+		instStart := rset.After(t, inc)
+		if instStart.IsZero() || (!end.IsZero() && !instStart.Before(end)) {
+			return false, nil
+		}
+		if n == maxRecurrenceInstances {
+			return false, NewPreconditionError(PreconditionMaxInstances)
+		}
+		t, inc = instStart, false
+
+		if overrides.isOverridden(comp, instStart) {
+			continue
+		}
+		if overlapsTimeRange(start, end, instStart, dur) {
+			return true, nil
+		}
+	}
+}
+
+// expandCalendar expands the recurring components of a calendar into the
+// instances overlapping the time range [start, end), as defined in RFC 4791
+// section 9.6.5. Times are converted to UTC and time zones are removed.
+func expandCalendar(cal *ical.Calendar, start, end time.Time) (*ical.Calendar, error) {
+	overrides, err := newRecurrenceOverrides(cal.Children, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := ical.NewCalendar()
+	expanded.Props = cal.Props
+	for _, comp := range cal.Children {
+		if comp.Name == ical.CompTimezone {
+			continue
+		}
+
+		rset, err := componentRecurrenceSet(comp, time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		if rset == nil {
+			if comp.Props.Get(ical.PropRecurrenceID) != nil {
+				// Overridden instance: only keep it if it's in the time range
+				dur, err := componentDuration(comp, time.UTC)
+				if err != nil {
+					return nil, err
+				}
+				instStart, err := comp.Props.DateTime(ical.PropDateTimeStart, time.UTC)
+				if err != nil {
+					return nil, err
+				}
+				if !overlapsTimeRange(start, end, instStart, dur) {
+					continue
+				}
+			}
+			inst, err := utcComponent(comp)
+			if err != nil {
+				return nil, err
+			}
+			expanded.Children = append(expanded.Children, inst)
+			continue
+		}
+
+		instances, err := expandComponent(comp, rset, start, end, overrides)
+		if err != nil {
+			return nil, err
+		}
+		expanded.Children = append(expanded.Children, instances...)
+	}
+	return expanded, nil
+}
+
+// expandComponent returns the instances of a recurring component overlapping
+// the time range [start, end). Instances overridden by another component are
+// skipped.
+func expandComponent(comp *ical.Component, rset recurrenceSet, start, end time.Time, overrides recurrenceOverrides) ([]*ical.Component, error) {
+	dur, err := componentDuration(comp, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	dtstart := comp.Props.Get(ical.PropDateTimeStart)
+	isDate := dtstart != nil && dtstart.ValueType() == ical.ValueDate
+
+	var l []*ical.Component
+	t, inc := start.Add(-dur), true
+	for n := 0; ; n++ {
+		instStart := rset.After(t, inc)
+		if instStart.IsZero() || !instStart.Before(end) {
+			return l, nil
+		}
+		if n == maxRecurrenceInstances {
+			return nil, NewPreconditionError(PreconditionMaxInstances)
+		}
+		t, inc = instStart, false
+
+		if overrides.isOverridden(comp, instStart) || !overlapsTimeRange(start, end, instStart, dur) {
+			continue
+		}
+
+		inst, err := utcComponent(comp)
+		if err != nil {
+			return nil, err
+		}
+		inst.Props.Del(ical.PropRecurrenceRule)
+		inst.Props.Del(ical.PropRecurrenceDates)
+		inst.Props.Del(ical.PropExceptionDates)
+		setInstanceTime(inst.Props, ical.PropRecurrenceID, instStart, isDate)
+		setInstanceTime(inst.Props, ical.PropDateTimeStart, instStart, isDate)
+		if inst.Props.Get(ical.PropDateTimeEnd) != nil {
+			setInstanceTime(inst.Props, ical.PropDateTimeEnd, instStart.Add(dur), isDate)
+		}
+		l = append(l, inst)
+	}
+}
+
+func setInstanceTime(props ical.Props, name string, t time.Time, isDate bool) {
+	if isDate {
+		props.SetDate(name, t)
+	} else {
+		props.SetDateTime(name, t.UTC())
+	}
+}
+
+// utcComponent returns a copy of a component whose DATE-TIME properties
+// relevant to recurrences are converted to UTC.
+func utcComponent(comp *ical.Component) (*ical.Component, error) {
+	dup := ical.NewComponent(comp.Name)
+	for name, props := range comp.Props {
+		dup.Props[name] = append([]ical.Prop(nil), props...)
+	}
+	dup.Children = comp.Children
+
+	for _, name := range []string{ical.PropDateTimeStart, ical.PropDateTimeEnd, ical.PropDue, ical.PropRecurrenceID} {
+		prop := dup.Props.Get(name)
+		if prop == nil || prop.ValueType() == ical.ValueDate {
+			continue
+		}
+		t, err := prop.DateTime(time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		dup.Props.SetDateTime(name, t.UTC())
+	}
+	return dup, nil
+}
@@ -0,0 +1,475 @@
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// iTIP methods, as defined in RFC 5546 section 1.4.
+const (
+	SchedulingMethodRequest = "REQUEST"
+	SchedulingMethodReply   = "REPLY"
+	SchedulingMethodCancel  = "CANCEL"
+)
+
+// paramScheduleAgent is defined in RFC 6638 section 7.1.
+const paramScheduleAgent = "SCHEDULE-AGENT"
+
+// SchedulingMessage is an iTIP message, as defined in RFC 5546.
+type SchedulingMessage struct {
+	// Method is the iTIP method, e.g. SchedulingMethodRequest.
+	Method string
+	// Originator and Recipient are calendar user addresses, e.g.
+	// "mailto:alice@example.org".
+	Originator string
+	Recipient  string
+	// Data contains the iTIP message. Its METHOD property is set.
+	Data *ical.Calendar
+}
+
+// SchedulingBackend is an optional interface which can be implemented by a
+// Backend to support CalDAV scheduling, as defined in RFC 6638.
+//
+// When the current user creates, updates or deletes a calendar object they
+// organize, invitations and cancellations are sent to the attendees. When
+// they change their participation status in a calendar object organized by
+// someone else, a reply is sent to the organizer. Messages are handed over to
+// DeliverSchedulingMessage, which can e.g. store them in the recipient's
+// scheduling inbox or send them by email.
+//
+// The scheduling inbox and outbox must be located in the calendar home set.
+// Messages stored in the inbox are listed with ListCalendarObjects.
+type SchedulingBackend interface {
+	ScheduleInboxPath(ctx context.Context) (string, error)
+	ScheduleOutboxPath(ctx context.Context) (string, error)
+	// CalendarUserAddresses returns the calendar user addresses of the
+	// current user.
+	CalendarUserAddresses(ctx context.Context) ([]string, error)
+	// DeliverSchedulingMessage delivers an iTIP message to its recipient.
+	DeliverSchedulingMessage(ctx context.Context, msg *SchedulingMessage) error
+	// QueryFreeBusy returns the calendar objects of a calendar user which
+	// may overlap the time range [start, end), to answer free/busy requests.
+	// An HTTP 404 error should be returned for unknown calendar users.
+	QueryFreeBusy(ctx context.Context, calendarUser string, start, end time.Time) ([]CalendarObject, error)
+}
+
+func hasAddress(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// schedulingComponents returns the components of a calendar which can carry
+// scheduling information.
+func schedulingComponents(cal *ical.Calendar) []*ical.Component {
+	if cal == nil {
+		return nil
+	}
+	var l []*ical.Component
+	for _, comp := range cal.Children {
+		switch comp.Name {
+		case ical.CompEvent, ical.CompToDo, ical.CompJournal:
+			l = append(l, comp)
+		}
+	}
+	return l
+}
+
+func calendarOrganizer(cal *ical.Calendar) string {
+	for _, comp := range schedulingComponents(cal) {
+		if prop := comp.Props.Get(ical.PropOrganizer); prop != nil {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+// calendarAttendee returns the ATTENDEE property of a calendar user, or nil.
+func calendarAttendee(cal *ical.Calendar, addr string) *ical.Prop {
+	for _, comp := range schedulingComponents(cal) {
+		for i, prop := range comp.Props[ical.PropAttendee] {
+			if strings.EqualFold(prop.Value, addr) {
+				return &comp.Props[ical.PropAttendee][i]
+			}
+		}
+	}
+	return nil
+}
+
+// calendarAttendees returns the addresses of the attendees to which the
+// server delivers scheduling messages, excluding the organizer.
+func calendarAttendees(cal *ical.Calendar, organizer string) []string {
+	var l []string
+	for _, comp := range schedulingComponents(cal) {
+		for _, prop := range comp.Props[ical.PropAttendee] {
+			switch strings.ToUpper(prop.Params.Get(paramScheduleAgent)) {
+			case "CLIENT", "NONE":
+				continue
+			}
+			if !strings.EqualFold(prop.Value, organizer) && !hasAddress(l, prop.Value) {
+				l = append(l, prop.Value)
+			}
+		}
+	}
+	return l
+}
+
+// schedulingMessageData returns a copy of cal with its METHOD set. If
+// attendee is not empty, other attendees are removed, as required for replies.
+func schedulingMessageData(cal *ical.Calendar, method, attendee string) *ical.Calendar {
+	out := ical.NewCalendar()
+	for name, props := range cal.Props {
+		out.Props[name] = props
+	}
+	out.Props.SetText(ical.PropMethod, method)
+
+	for _, comp := range cal.Children {
+		if attendee == "" || comp.Props.Get(ical.PropAttendee) == nil {
+			out.Children = append(out.Children, comp)
+			continue
+		}
+		dup := ical.NewComponent(comp.Name)
+		for name, props := range comp.Props {
+			dup.Props[name] = props
+		}
+		dup.Props[ical.PropAttendee] = nil
+		for _, prop := range comp.Props[ical.PropAttendee] {
+			if strings.EqualFold(prop.Value, attendee) {
+				dup.Props[ical.PropAttendee] = append(dup.Props[ical.PropAttendee], prop)
+			}
+		}
+		dup.Children = comp.Children
+		out.Children = append(out.Children, dup)
+	}
+	return out
+}
+
+// schedulingMessages returns the iTIP messages to send when the current user
+// changes a calendar object from prev to cur. prev is nil for new objects and
+// cur is nil for deleted objects.
+func schedulingMessages(addrs []string, prev, cur *ical.Calendar) []SchedulingMessage {
+	cal := cur
+	if cal == nil {
+		cal = prev
+	}
+	organizer := calendarOrganizer(cal)
+	if organizer == "" {
+		return nil
+	}
+
+	var msgs []SchedulingMessage
+	if hasAddress(addrs, organizer) {
+		var attendees []string
+		if cur != nil {
+			attendees = calendarAttendees(cur, organizer)
+			for _, attendee := range attendees {
+				msgs = append(msgs, SchedulingMessage{
+					Method:     SchedulingMethodRequest,
+					Originator: organizer,
+					Recipient:  attendee,
+					Data:       schedulingMessageData(cur, SchedulingMethodRequest, ""),
+				})
+			}
+		}
+		if prev != nil {
+			for _, attendee := range calendarAttendees(prev, organizer) {
+				if hasAddress(attendees, attendee) {
+					continue
+				}
+				msgs = append(msgs, SchedulingMessage{
+					Method:     SchedulingMethodCancel,
+					Originator: organizer,
+					Recipient:  attendee,
+					Data:       schedulingMessageData(prev, SchedulingMethodCancel, ""),
+				})
+			}
+		}
+		return msgs
+	}
+
+	for _, addr := range addrs {
+		prevStatus, curStatus := "", "DECLINED"
+		if prop := calendarAttendee(prev, addr); prop != nil {
+			prevStatus = prop.Params.Get(ical.ParamParticipationStatus)
+		}
+		if cur != nil {
+			prop := calendarAttendee(cur, addr)
+			if prop == nil {
+				continue
+			}
+			curStatus = prop.Params.Get(ical.ParamParticipationStatus)
+		} else if prevStatus == "" {
+			continue
+		}
+		if strings.EqualFold(prevStatus, curStatus) {
+			continue
+		}
+
+		data := schedulingMessageData(cal, SchedulingMethodReply, addr)
+		if cur == nil {
+			// Don't modify the parameters shared with prev
+			prop := calendarAttendee(data, addr)
+			params := make(ical.Params, len(prop.Params))
+			for k, v := range prop.Params {
+				params[k] = v
+			}
+			params.Set(ical.ParamParticipationStatus, curStatus)
+			prop.Params = params
+		}
+		msgs = append(msgs, SchedulingMessage{
+			Method:     SchedulingMethodReply,
+			Originator: addr,
+			Recipient:  organizer,
+			Data:       data,
+		})
+	}
+	return msgs
+}
+
+// prevSchedulingObject returns the current version of a calendar object
+// before it's changed, if the backend supports scheduling.
+func (b *backend) prevSchedulingObject(ctx context.Context, objPath string) (*ical.Calendar, error) {
+	if _, ok := b.Backend.(SchedulingBackend); !ok {
+		return nil, nil
+	}
+	return b.prevObject(ctx, objPath)
+}
+
+// prevObject returns the calendar object currently stored at a path, if any.
+func (b *backend) prevObject(ctx context.Context, objPath string) (*ical.Calendar, error) {
+	co, err := b.Backend.GetCalendarObject(ctx, objPath, &CalendarCompRequest{AllProps: true, AllComps: true})
+	if internal.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return co.Data, nil
+}
+
+// schedule delivers the iTIP messages generated by a change to a calendar
+// object. Delivery errors are logged: the change has already been applied.
+func (b *backend) schedule(ctx context.Context, prev, cur *ical.Calendar) {
+	sb, ok := b.Backend.(SchedulingBackend)
+	if !ok {
+		return
+	}
+	addrs, err := sb.CalendarUserAddresses(ctx)
+	if err != nil {
+		b.ErrorReporter.Logf("caldav: failed to get calendar user addresses: %v", err)
+		return
+	}
+	msgs := schedulingMessages(addrs, prev, cur)
+	for i := range msgs {
+		if err := sb.DeliverSchedulingMessage(ctx, &msgs[i]); err != nil {
+			b.ErrorReporter.Logf("caldav: failed to deliver %v message to %v: %v", msgs[i].Method, msgs[i].Recipient, err)
+		}
+	}
+}
+
+func (b *backend) propFindScheduleCollection(ctx context.Context, propfind *internal.PropFind, p string, name xml.Name) (*internal.Response, error) {
+	props := map[xml.Name]internal.PropFindFunc{
+		internal.CurrentUserPrincipalName: func(*internal.RawXMLValue) (interface{}, error) {
+			path, err := b.Backend.CurrentUserPrincipal(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &internal.CurrentUserPrincipal{Href: internal.Href{Path: path}}, nil
+		},
+		internal.ResourceTypeName: func(*internal.RawXMLValue) (interface{}, error) {
+			return internal.NewResourceType(internal.CollectionName, name), nil
+		},
+	}
+	return internal.NewPropFindResponse(p, propfind, props)
+}
+
+// propFindSchedule handles PROPFIND requests on the scheduling inbox and
+// outbox. It returns false if the request path is neither.
+func (b *backend) propFindSchedule(ctx context.Context, propfind *internal.PropFind, reqPath string, depth internal.Depth, fn func(resp *internal.Response) error) (bool, error) {
+	sb, ok := b.Backend.(SchedulingBackend)
+	if !ok {
+		return false, nil
+	}
+
+	outboxPath, err := sb.ScheduleOutboxPath(ctx)
+	if err != nil {
+		return false, err
+	}
+	if reqPath == outboxPath {
+		resp, err := b.propFindScheduleCollection(ctx, propfind, outboxPath, scheduleOutboxName)
+		if err != nil {
+			return false, err
+		}
+		return true, fn(resp)
+	}
+
+	inboxPath, err := sb.ScheduleInboxPath(ctx)
+	if err != nil {
+		return false, err
+	}
+	if reqPath != inboxPath {
+		return false, nil
+	}
+	resp, err := b.propFindScheduleCollection(ctx, propfind, inboxPath, scheduleInboxName)
+	if err != nil {
+		return false, err
+	}
+	if err := fn(resp); err != nil {
+		return true, err
+	}
+	if depth != internal.DepthZero {
+		return true, b.propFindAllCalendarObjects(ctx, propfind, &Calendar{Path: inboxPath}, fn)
+	}
+	return true, nil
+}
+
+func addSchedulingPrincipalProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, sb SchedulingBackend) {
+	props[scheduleInboxURLName] = func(*internal.RawXMLValue) (interface{}, error) {
+		p, err := sb.ScheduleInboxPath(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &scheduleInboxURL{Href: internal.Href{Path: p}}, nil
+	}
+	props[scheduleOutboxURLName] = func(*internal.RawXMLValue) (interface{}, error) {
+		p, err := sb.ScheduleOutboxPath(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &scheduleOutboxURL{Href: internal.Href{Path: p}}, nil
+	}
+	props[calendarUserAddressSetName] = func(*internal.RawXMLValue) (interface{}, error) {
+		addrs, err := sb.CalendarUserAddresses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var set calendarUserAddressSet
+		for _, addr := range addrs {
+			u, err := internal.ParseURL(addr)
+			if err != nil {
+				return nil, err
+			}
+			set.Hrefs = append(set.Hrefs, internal.Href(*u))
+		}
+		return &set, nil
+	}
+}
+
+// handleSchedulePost handles POST requests on the scheduling outbox, as
+// defined in RFC 6638 section 5. Only free/busy requests are supported: other
+// scheduling messages are sent implicitly when calendar objects are changed.
+func (h *Handler) handleSchedulePost(w http.ResponseWriter, r *http.Request) error {
+	sb, ok := h.Backend.(SchedulingBackend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: unsupported method")
+	}
+	outboxPath, err := sb.ScheduleOutboxPath(r.Context())
+	if err != nil {
+		return err
+	}
+	if r.URL.Path != outboxPath {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: POST is only supported on the scheduling outbox")
+	}
+
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || t != ical.MIMEType {
+		return internal.HTTPErrorf(http.StatusUnsupportedMediaType, "caldav: expected %v request body", ical.MIMEType)
+	}
+	cal, err := ical.NewDecoder(r.Body).Decode()
+	if err != nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: failed to parse iCalendar: %v", err)
+	}
+	if method, _ := cal.Props.Text(ical.PropMethod); method != SchedulingMethodRequest {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: unsupported scheduling method %q", method)
+	}
+	var req *ical.Component
+	for _, comp := range cal.Children {
+		if comp.Name == ical.CompFreeBusy {
+			req = comp
+			break
+		}
+	}
+	if req == nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: only VFREEBUSY requests are supported")
+	}
+
+	addrs, err := sb.CalendarUserAddresses(r.Context())
+	if err != nil {
+		return err
+	}
+	organizer := req.Props.Get(ical.PropOrganizer)
+	if organizer == nil || !hasAddress(addrs, organizer.Value) {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: ORGANIZER doesn't match the current user")
+	}
+	start, err := req.Props.DateTime(ical.PropDateTimeStart, time.UTC)
+	if err != nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: invalid DTSTART: %v", err)
+	}
+	end, err := req.Props.DateTime(ical.PropDateTimeEnd, time.UTC)
+	if err != nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: invalid DTEND: %v", err)
+	}
+	if start.IsZero() || !start.Before(end) {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: invalid free/busy time range")
+	}
+
+	var resp scheduleResponse
+	for _, attendee := range req.Props[ical.PropAttendee] {
+		entry, err := h.freeBusyResponse(r.Context(), sb, req, &attendee, start, end)
+		if err != nil {
+			return err
+		}
+		resp.Responses = append(resp.Responses, *entry)
+	}
+	return internal.ServeXML(w).Encode(&resp)
+}
+
+func (h *Handler) freeBusyResponse(ctx context.Context, sb SchedulingBackend, req *ical.Component, attendee *ical.Prop, start, end time.Time) (*scheduleResponseEntry, error) {
+	u, err := internal.ParseURL(attendee.Value)
+	if err != nil {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: invalid ATTENDEE: %v", err)
+	}
+	entry := &scheduleResponseEntry{Recipient: internal.Href(*u)}
+
+	cos, err := sb.QueryFreeBusy(ctx, attendee.Value, start, end)
+	if internal.IsNotFound(err) {
+		entry.RequestStatus = "3.7;Invalid calendar user"
+		return entry, nil
+	} else if err != nil {
+		h.errorReporter().Logf("caldav: failed to query free/busy of %v: %v", attendee.Value, err)
+		entry.RequestStatus = "5.1;Service unavailable"
+		return entry, nil
+	}
+
+	var cals []*ical.Calendar
+	for _, co := range cos {
+		cals = append(cals, co.Data)
+	}
+	reply, err := freeBusyReport(cals, start, end)
+	if err != nil {
+		return nil, err
+	}
+	reply.Props.SetText(ical.PropMethod, SchedulingMethodReply)
+	fb := reply.Children[0]
+	copyProps(fb.Props, req.Props, []string{ical.PropUID, ical.PropOrganizer})
+	fb.Props.Set(attendee)
+
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(reply); err != nil {
+		return nil, fmt.Errorf("caldav: failed to encode free/busy reply: %w", err)
+	}
+	entry.RequestStatus = "2.0;Success"
+	entry.CalendarData = &calendarDataResp{Data: buf.Bytes()}
+	return entry, nil
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"mime"
 	"net/http"
 	"path"
@@ -25,6 +28,12 @@ type PutCalendarObjectOptions struct {
 	// IfMatch provides the ETag of the resource that the client intends
 	// to overwrite, can be ""
 	IfMatch webdav.ConditionalMatch
+	// DryRun indicates that the client only wants to validate the request.
+	// The backend should check the same preconditions as for a regular PUT
+	// (e.g. ETags, UID conflicts and maximum resource size) but must not
+	// store the object. It's only set for backends implementing
+	// DryRunBackend.
+	DryRun bool
 }
 
 // Backend is a CalDAV server backend.
@@ -41,24 +50,236 @@ type Backend interface {
 	webdav.UserPrincipalBackend
 }
 
+// CalendarAccess is the level of access a user has to a calendar object.
+type CalendarAccess int
+
+const (
+	// CalendarAccessFull grants access to the whole calendar object.
+	CalendarAccessFull CalendarAccess = iota
+	// CalendarAccessFreeBusy only grants access to free/busy information:
+	// event details such as SUMMARY, DESCRIPTION, LOCATION and attendees are
+	// stripped and only opaque busy blocks are returned.
+	CalendarAccessFreeBusy
+)
+
+// SharingBackend is an optional interface which can be implemented by a
+// Backend to restrict the current user to a limited view of some calendar
+// objects, e.g. for calendars shared with free/busy permissions only.
+type SharingBackend interface {
+	CalendarAccess(ctx context.Context, path string) (CalendarAccess, error)
+}
+
+// SyncBackend is an optional interface which can be implemented by a Backend
+// to support collection synchronization (RFC 6578) of calendars via the
+// sync-collection REPORT.
+type SyncBackend interface {
+	// CalendarSyncToken returns the current sync token of a calendar.
+	CalendarSyncToken(ctx context.Context, path string) (string, error)
+	// CalendarChanges returns the changes to the objects of a calendar since a
+	// sync token. An empty sync token requests an initial synchronization:
+	// all objects are reported as added. webdav.ErrInvalidSyncToken is
+	// returned if the sync token isn't valid anymore.
+	CalendarChanges(ctx context.Context, path, syncToken string) (*webdav.SyncChanges, error)
+}
+
+// DryRunBackend is an optional interface which can be implemented by a Backend
+// honoring PutCalendarObjectOptions.DryRun. Without it, or if SupportsDryRun
+// returns false, the "Prefer: dry-run" preference of PUT requests is ignored
+// and the objects are stored.
+type DryRunBackend interface {
+	SupportsDryRun() bool
+}
+
+// RawBackend is an optional interface which can be implemented by a Backend
+// storing calendar objects as raw iCalendar data. GET and PUT requests on
+// calendar objects are then served byte-exactly, without normalizing the data.
+type RawBackend interface {
+	GetCalendarObjectRaw(ctx context.Context, path string) (*RawCalendarObject, error)
+	// PutCalendarObjectRaw is called with data which has been validated by the
+	// server.
+	PutCalendarObjectRaw(ctx context.Context, path string, obj *RawCalendarObject, opts *PutCalendarObjectOptions) (loc string, err error)
+}
+
+// CalendarCreator is an optional interface which can be implemented by a
+// Backend to support creating calendars with MKCALENDAR and extended MKCOL
+// requests. Without it, these requests fail with 405 Method Not Allowed.
+type CalendarCreator interface {
+	CreateCalendar(ctx context.Context, calendar Calendar) error
+}
+
+// backendWrapper is implemented by Backends wrapping another Backend, such as
+// the one returned by NewEncryptedBackend.
+type backendWrapper interface {
+	unwrapBackend() Backend
+}
+
+// optionalBackend returns the Backend implementing the optional interfaces of
+// b which don't handle calendar data: SyncBackend, SharingBackend,
+// ObjectPathResolver, TimezoneBackend, CalendarCreator and
+// webdav.DeadPropertyStore. Wrapped Backends forward these as is.
+func optionalBackend(b Backend) Backend {
+	for {
+		w, ok := b.(backendWrapper)
+		if !ok {
+			return b
+		}
+		b = w.unwrapBackend()
+	}
+}
+
+// calendarCreator returns the CalendarCreator implemented by a Backend, if
+// any. A FeedBackend only creates calendars if the Backend it wraps does.
+func calendarCreator(b Backend) (CalendarCreator, bool) {
+	b = optionalBackend(b)
+	if fb, ok := b.(*FeedBackend); ok {
+		if _, ok := calendarCreator(fb.Backend); !ok {
+			return nil, false
+		}
+	}
+	creator, ok := b.(CalendarCreator)
+	return creator, ok
+}
+
+// MoveBackend is an optional interface which can be implemented by a Backend
+// to move calendar objects between calendars, e.g. atomically or without
+// copying their data. The object is left unchanged and keeps its UID. Backends
+// implementing SyncBackend must report the object as deleted from the source
+// calendar and added to the destination calendar.
+//
+// Without MoveBackend, MOVE requests are handled with ApplyTransaction if the
+// Backend implements TransactionBackend, or else by storing the object at
+// the destination before deleting the source.
+type MoveBackend interface {
+	MoveCalendarObject(ctx context.Context, src, dest string) error
+}
+
+// objectMover returns the MoveBackend implemented by a Backend, if any. An
+// encrypted Backend only moves objects if the Backend it wraps does.
+func objectMover(b Backend) (MoveBackend, bool) {
+	if eb, ok := b.(*encryptedBackend); ok {
+		if _, ok := objectMover(eb.Backend); !ok {
+			return nil, false
+		}
+	}
+	mb, ok := b.(MoveBackend)
+	return mb, ok
+}
+
+// CalendarObjectStreamer is an optional interface which can be implemented by
+// a Backend to list calendar objects one at a time instead of building them
+// all in memory. The multi-status responses of PROPFIND and calendar-query
+// REPORT requests are then streamed, unless Handler.SortResponses is set.
+type CalendarObjectStreamer interface {
+	// ListCalendarObjectsStream is like Backend.ListCalendarObjects, but calls
+	// fn for each calendar object. Errors returned by fn must be returned as
+	// is.
+	ListCalendarObjectsStream(ctx context.Context, path string, req *CalendarCompRequest, fn func(co *CalendarObject) error) error
+	// QueryCalendarObjectsStream is like Backend.QueryCalendarObjects, but
+	// calls fn for each matching calendar object. Errors returned by fn must
+	// be returned as is.
+	QueryCalendarObjectsStream(ctx context.Context, path string, query *CalendarQuery, fn func(co *CalendarObject) error) error
+}
+
+// ObjectPathResolver is an optional interface which can be implemented by a
+// Backend whose calendar object paths are server-generated identifiers
+// decoupled from the names chosen by clients in PUT requests (and from UIDs).
+type ObjectPathResolver interface {
+	// ResolveObjectPath maps a path requested by a client (e.g. the one used
+	// in an earlier PUT request) to the path of the calendar object. If the path
+	// doesn't map to a known calendar object, it should be returned unchanged.
+	ResolveObjectPath(ctx context.Context, path string) (string, error)
+}
+
 // Handler handles CalDAV HTTP requests. It can be used to create a CalDAV
 // server.
 type Handler struct {
 	Backend Backend
 	Prefix  string
+
+	// IdempotencyStore, if set, is used to deduplicate retried PUT requests
+	// carrying an Idempotency-Key header.
+	IdempotencyStore webdav.IdempotencyStore
+	// Visibility, if set, is used to hide collections and objects from GET,
+	// HEAD, PROPFIND and REPORT requests.
+	Visibility webdav.VisibilityFunc
+	// AuditSink, if set, is notified of each successful mutating request.
+	AuditSink webdav.AuditSink
+	// ErrorLog specifies an optional logger for errors, e.g. panics in the
+	// backend. If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+	// ErrorVerbosity controls how much error detail is sent to clients.
+	// Server errors are always logged to ErrorLog.
+	ErrorVerbosity webdav.ErrorVerbosity
+	// TimeLayout, if set, overrides the layout used to format timestamps
+	// such as DAV:getlastmodified in generated XML, e.g. time.RFC3339 for
+	// clients expecting Z-suffixed UTC timestamps. Timestamps are always
+	// converted to UTC. By default, the HTTP-date format mandated by RFC 4918
+	// is used.
+	TimeLayout string
+	// Listing, if set, enables browser-friendly listings of calendar home
+	// sets and calendars in response to GET requests.
+	Listing *webdav.ListingOptions
+	// Overrides intercept requests before they're handled, e.g. to serve
+	// custom endpoints. The first matching override is used.
+	Overrides []webdav.Override
+	// Transforms, if set, rewrite calendar objects received via PUT before
+	// they're stored, in order. Objects are re-encoded for RawBackend
+	// implementations, which normalizes line endings. The ETag sent back to
+	// the client reflects the stored form.
+	Transforms []TransformFunc
+	// MaintainSequence, if set, updates the DTSTAMP and LAST-MODIFIED
+	// properties of events, to-dos and journal entries stored via PUT, and
+	// increments the SEQUENCE of the ones which have been rescheduled. See
+	// UpdateSequence.
+	MaintainSequence bool
+	// SortResponses sorts the responses of PROPFIND and REPORT requests by
+	// href. Otherwise, resources are listed in the order of the Backend.
+	SortResponses bool
+}
+
+func (h *Handler) errorReporter() *internal.ErrorReporter {
+	return &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(h.ErrorVerbosity),
+		Logger:    h.ErrorLog,
+	}
+}
+
+func (h *Handler) serveMultiStatus(w http.ResponseWriter, resps []internal.Response) error {
+	if h.SortResponses {
+		internal.SortResponses(resps)
+	}
+	return internal.ServeMultiStatus(w, internal.NewMultiStatus(resps...))
 }
 
 // ServeHTTP implements http.Handler.
+//
+// Panics in the backend are recovered from and result in a 500 Internal
+// Server Error response.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	internal.ServeRecover(w, r, h.ErrorLog, http.HandlerFunc(h.serveHTTP))
+}
+
+func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.Backend == nil {
-		http.Error(w, "caldav: no backend available", http.StatusInternalServerError)
+		h.errorReporter().ServeError(w, r, internal.HTTPErrorf(http.StatusInternalServerError, "caldav: no backend available"))
+		return
+	}
+
+	r, err := internal.SanitizeRequest(r)
+	if err != nil {
+		h.errorReporter().ServeError(w, r, err)
 		return
 	}
 
+	webdav.WithRequestInfo(webdav.WithOverrides(h.Overrides, http.HandlerFunc(h.serveDAV))).ServeHTTP(w, r)
+}
+
+func (h *Handler) serveDAV(w http.ResponseWriter, r *http.Request) {
+	errs := h.errorReporter()
 	if r.URL.Path == "/.well-known/caldav" {
 		principalPath, err := h.Backend.CurrentUserPrincipal(r.Context())
 		if err != nil {
-			http.Error(w, "caldav: failed to determine current user principal", http.StatusInternalServerError)
+			errs.ServeError(w, r, fmt.Errorf("caldav: failed to determine current user principal: %w", err))
 			return
 		}
 
@@ -70,18 +291,66 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "REPORT":
 		err = h.handleReport(w, r)
+	case http.MethodPost:
+		if internal.IsContentXML(r.Header) {
+			err = h.handleTransaction(w, r)
+		} else {
+			err = h.handleSchedulePost(w, r)
+		}
+	case "MKCALENDAR":
+		err = h.handleMkcalendar(w, r)
 	default:
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+		hh := internal.Handler{
+			Backend:          h.newBackend(),
+			IdempotencyStore: h.IdempotencyStore,
+			ErrorReporter:    errs,
+			SortResponses:    h.SortResponses,
+		}
+		if h.AuditSink != nil {
+			hh.Audit = func(ctx context.Context, event *internal.AuditEvent) {
+				h.AuditSink.Audit(ctx, (*webdav.AuditEvent)(event))
+			}
 		}
-		hh := internal.Handler{&b}
 		hh.ServeHTTP(w, r)
 	}
 
 	if err != nil {
-		internal.ServeError(w, err)
+		errs.ServeError(w, r, err)
+	}
+}
+
+func (h *Handler) newBackend() *backend {
+	return &backend{
+		Backend:          h.Backend,
+		Prefix:           strings.TrimSuffix(h.Prefix, "/"),
+		Visibility:       h.Visibility,
+		TimeLayout:       h.TimeLayout,
+		Listing:          h.Listing,
+		ErrorReporter:    h.errorReporter(),
+		Transforms:       h.Transforms,
+		MaintainSequence: h.MaintainSequence,
+	}
+}
+
+func (h *Handler) handleMkcalendar(w http.ResponseWriter, r *http.Request) error {
+	var m mkcalendarReq
+	if err := decodeMkcolRequest(r, &m); err != nil {
+		return err
+	}
+	if err := h.newBackend().createCalendar(r.Context(), r.URL.Path, m.Set, mkcalendarResponseName); err != nil {
+		return err
+	}
+
+	if h.AuditSink != nil {
+		principal, _ := h.Backend.CurrentUserPrincipal(r.Context())
+		h.AuditSink.Audit(r.Context(), &webdav.AuditEvent{
+			Method:    r.Method,
+			Principal: principal,
+			Path:      r.URL.Path,
+		})
 	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
 }
 
 func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) error {
@@ -94,8 +363,12 @@ func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) error {
 		return h.handleQuery(r, w, report.Query)
 	} else if report.Multiget != nil {
 		return h.handleMultiget(r.Context(), w, report.Multiget)
+	} else if report.FreeBusyQuery != nil {
+		return h.handleFreeBusyQuery(r, w, report.FreeBusyQuery)
+	} else if report.SyncCollection != nil {
+		return h.handleSyncCollection(r, w, report.SyncCollection)
 	}
-	return internal.HTTPErrorf(http.StatusBadRequest, "caldav: expected calendar-query or calendar-multiget element in REPORT request")
+	return internal.HTTPErrorf(http.StatusBadRequest, "caldav: expected calendar-query, calendar-multiget, free-busy-query or sync-collection element in REPORT request")
 }
 
 func decodeParamFilter(el *paramFilter) (*ParamFilter, error) {
@@ -107,11 +380,26 @@ func decodeParamFilter(el *paramFilter) (*ParamFilter, error) {
 		pf.IsNotDefined = true
 	}
 	if el.TextMatch != nil {
-		pf.TextMatch = &TextMatch{Text: el.TextMatch.Text}
+		txt, err := decodeTextMatch(el.TextMatch)
+		if err != nil {
+			return nil, err
+		}
+		pf.TextMatch = txt
 	}
 	return pf, nil
 }
 
+func decodeTextMatch(el *textMatch) (*TextMatch, error) {
+	if el.Collation != "" && !internal.IsSupportedCollation(el.Collation) {
+		return nil, NewPreconditionError(PreconditionSupportedCollation)
+	}
+	return &TextMatch{
+		Text:            el.Text,
+		NegateCondition: bool(el.NegateCondition),
+		Collation:       el.Collation,
+	}, nil
+}
+
 func decodePropFilter(el *propFilter) (*PropFilter, error) {
 	pf := &PropFilter{Name: el.Name}
 	if el.IsNotDefined != nil {
@@ -121,7 +409,11 @@ func decodePropFilter(el *propFilter) (*PropFilter, error) {
 		pf.IsNotDefined = true
 	}
 	if el.TextMatch != nil {
-		pf.TextMatch = &TextMatch{Text: el.TextMatch.Text}
+		txt, err := decodeTextMatch(el.TextMatch)
+		if err != nil {
+			return nil, err
+		}
+		pf.TextMatch = txt
 	}
 	if el.TimeRange != nil {
 		pf.Start = time.Time(el.TimeRange.Start)
@@ -178,6 +470,7 @@ func decodeComp(comp *comp) (*CalendarCompRequest, error) {
 	}
 
 	req := &CalendarCompRequest{
+		Name:     comp.Name,
 		AllProps: comp.Allprop != nil,
 		AllComps: comp.Allcomp != nil,
 	}
@@ -195,79 +488,228 @@ func decodeComp(comp *comp) (*CalendarCompRequest, error) {
 }
 
 func decodeCalendarDataReq(calendarData *calendarDataReq) (*CalendarCompRequest, error) {
-	if calendarData.Comp == nil {
-		return &CalendarCompRequest{
-			AllProps: true,
-			AllComps: true,
-		}, nil
+	req := &CalendarCompRequest{
+		AllProps: true,
+		AllComps: true,
+	}
+	if calendarData.Comp != nil {
+		var err error
+		req, err = decodeComp(calendarData.Comp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if calendarData.Expand != nil {
+		start, end := time.Time(calendarData.Expand.Start), time.Time(calendarData.Expand.End)
+		if start.IsZero() || end.IsZero() || !start.Before(end) {
+			return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: invalid time range in expand element")
+		}
+		req.Expand = &CalendarExpandRequest{Start: start, End: end}
 	}
-	return decodeComp(calendarData.Comp)
+
+	return req, nil
 }
 
 func (h *Handler) handleQuery(r *http.Request, w http.ResponseWriter, query *calendarQuery) error {
 	var q CalendarQuery
-	// TODO: calendar-data in query.Prop
+	if query.Prop != nil {
+		var calendarData calendarDataReq
+		if err := query.Prop.Decode(&calendarData); err != nil && !internal.IsNotFound(err) {
+			return err
+		}
+		dataReq, err := decodeCalendarDataReq(&calendarData)
+		if err != nil {
+			return err
+		}
+		q.CompRequest = *dataReq
+	}
 	cf, err := decodeCompFilter(&query.Filter.CompFilter)
 	if err != nil {
 		return err
 	}
 	q.CompFilter = *cf
 
-	cos, err := h.Backend.QueryCalendarObjects(r.Context(), r.URL.Path, &q)
+	loc, err := h.defaultLocation(r.Context())
 	if err != nil {
 		return err
-	}
+	} else if loc != nil {
+		setFilterLocation(&q.CompFilter, loc)
+	}
+
+	b := h.newBackend()
+	propfind := internal.PropFind{
+		Prop:     query.Prop,
+		AllProp:  query.AllProp,
+		PropName: query.PropName,
+	}
+	// Filters can't be evaluated on end-to-end encrypted objects, so all of
+	// them are returned as is
+	encrypted := b.resourceTypeAtPath(r.URL.Path) == resourceTypeCalendar && b.isEncryptedCalendar(r.Context(), r.URL.Path)
+	return internal.StreamMultiStatus(w, r, h.errorReporter(), h.SortResponses, func(fn func(resp *internal.Response) error) error {
+		objectFn := func(co *CalendarObject) error {
+			if !b.Visibility.IsVisible(r.Context(), co.Path) {
+				return nil
+			}
 
-	var resps []internal.Response
-	for _, co := range cos {
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+			limited, ok, err := b.limitCalendarObject(r.Context(), co)
+			if err != nil {
+				return err
+			}
+			if ok && !encrypted {
+				// Don't leak stripped details through the query filter
+				matched, err := Match(q.CompFilter, limited)
+				if err != nil {
+					return err
+				} else if !matched {
+					return nil
+				}
+			}
+			if q.CompRequest.Expand != nil && !encrypted {
+				limited, err = expandCalendarObject(limited, q.CompRequest.Expand)
+				if err != nil {
+					return err
+				}
+			}
+			limited = pruneCalendarObject(limited, &q.CompRequest)
+
+			resp, err := b.propFindCalendarObject(r.Context(), &propfind, limited)
+			if err != nil {
+				return err
+			}
+			return fn(resp)
 		}
-		propfind := internal.PropFind{
-			Prop:     query.Prop,
-			AllProp:  query.AllProp,
-			PropName: query.PropName,
+		if encrypted {
+			return b.listCalendarObjects(r.Context(), r.URL.Path, &q.CompRequest, objectFn)
 		}
-		resp, err := b.propFindCalendarObject(r.Context(), &propfind, &co)
+		return b.queryCalendarObjects(r.Context(), r.URL.Path, &q, objectFn)
+	})
+}
+
+func (h *Handler) handleFreeBusyQuery(r *http.Request, w http.ResponseWriter, query *freeBusyQuery) error {
+	start, end := time.Time(query.TimeRange.Start), time.Time(query.TimeRange.End)
+	if start.IsZero() || end.IsZero() || !start.Before(end) {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: free-busy-query requires a bounded time-range")
+	}
+	if loc, err := h.defaultLocation(r.Context()); err != nil {
+		return err
+	} else if loc != nil {
+		start, end = start.In(loc), end.In(loc)
+	}
+
+	q := CalendarQuery{
+		CompFilter: CompFilter{
+			Name:  ical.CompCalendar,
+			Comps: []CompFilter{{Name: ical.CompEvent, Start: start, End: end}},
+		},
+	}
+	b := h.newBackend()
+	var cos []CalendarObject
+	// End-to-end encrypted objects carry no free/busy information
+	if b.resourceTypeAtPath(r.URL.Path) != resourceTypeCalendar || !b.isEncryptedCalendar(r.Context(), r.URL.Path) {
+		var err error
+		cos, err = h.Backend.QueryCalendarObjects(r.Context(), r.URL.Path, &q)
 		if err != nil {
 			return err
 		}
-		resps = append(resps, *resp)
 	}
 
-	ms := internal.NewMultiStatus(resps...)
+	var cals []*ical.Calendar
+	for _, co := range cos {
+		if b.Visibility.IsVisible(r.Context(), co.Path) {
+			cals = append(cals, co.Data)
+		}
+	}
 
-	return internal.ServeMultiStatus(w, ms)
+	cal, err := freeBusyReport(cals, start, end)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ical.MIMEType)
+	_, err = w.Write(buf.Bytes())
+	return err
 }
 
 func (h *Handler) handleMultiget(ctx context.Context, w http.ResponseWriter, multiget *calendarMultiget) error {
+	resps, err := h.multigetResponses(ctx, multiget)
+	if err != nil {
+		return err
+	}
+	return h.serveMultiStatus(w, resps)
+}
+
+// multigetResponses returns the responses for the calendar objects requested
+// by a calendar-multiget report. Objects which can't be retrieved are
+// reported with an error status.
+func (h *Handler) multigetResponses(ctx context.Context, multiget *calendarMultiget) ([]internal.Response, error) {
 	var dataReq CalendarCompRequest
 	if multiget.Prop != nil {
 		var calendarData calendarDataReq
 		if err := multiget.Prop.Decode(&calendarData); err != nil && !internal.IsNotFound(err) {
-			return err
+			return nil, err
 		}
 		decoded, err := decodeCalendarDataReq(&calendarData)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		dataReq = *decoded
 	}
 
+	b := h.newBackend()
 	var resps []internal.Response
 	for _, href := range multiget.Hrefs {
-		co, err := h.Backend.GetCalendarObject(ctx, href.Path, &dataReq)
+		p, err := internal.SanitizeURLPath(href.Path)
+		if err != nil {
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+
+		objPath, err := b.objectPath(ctx, p)
 		if err != nil {
 			resp := internal.NewErrorResponse(href.Path, err)
 			resps = append(resps, *resp)
 			continue
 		}
+		if !b.Visibility.IsVisible(ctx, objPath) {
+			err := &internal.HTTPError{Code: http.StatusNotFound}
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		if !internal.PathAllowed(ctx, objPath) {
+			err := &internal.HTTPError{Code: http.StatusForbidden}
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
 
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+		co, err := h.Backend.GetCalendarObject(ctx, objPath, &dataReq)
+		if err != nil {
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		co, _, err = b.limitCalendarObject(ctx, co)
+		if err != nil {
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		if dataReq.Expand != nil {
+			co, err = expandCalendarObject(co, dataReq.Expand)
+			if err != nil {
+				resp := internal.NewErrorResponse(href.Path, err)
+				resps = append(resps, *resp)
+				continue
+			}
 		}
+		co = pruneCalendarObject(co, &dataReq)
+
 		propfind := internal.PropFind{
 			Prop:     multiget.Prop,
 			AllProp:  multiget.AllProp,
@@ -275,18 +717,62 @@ func (h *Handler) handleMultiget(ctx context.Context, w http.ResponseWriter, mul
 		}
 		resp, err := b.propFindCalendarObject(ctx, &propfind, co)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		resps = append(resps, *resp)
 	}
 
-	ms := internal.NewMultiStatus(resps...)
-	return internal.ServeMultiStatus(w, ms)
+	return resps, nil
+}
+
+func (h *Handler) handleSyncCollection(r *http.Request, w http.ResponseWriter, query *internal.SyncCollectionQuery) error {
+	sb, ok := optionalBackend(h.Backend).(SyncBackend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: sync-collection REPORT is unsupported")
+	}
+	if recursive, err := query.IsRecursive(); err != nil {
+		return err
+	} else if recursive {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: infinite sync-level is unsupported")
+	}
+	if h.newBackend().resourceTypeAtPath(r.URL.Path) != resourceTypeCalendar {
+		return internal.HTTPErrorf(http.StatusForbidden, "caldav: sync-collection REPORT is only supported on calendars")
+	}
+
+	page, err := query.Page(func(syncToken string) (string, []string, []string, error) {
+		changes, err := sb.CalendarChanges(r.Context(), r.URL.Path, syncToken)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return changes.SyncToken, append(changes.Added, changes.Modified...), changes.Deleted, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	multiget := calendarMultiget{Prop: query.Prop}
+	for _, p := range page.Updated {
+		multiget.Hrefs = append(multiget.Hrefs, internal.Href{Path: p})
+	}
+	if multiget.Prop == nil {
+		multiget.Prop = &internal.Prop{}
+	}
+	resps, err := h.multigetResponses(r.Context(), &multiget)
+	if err != nil {
+		return err
+	}
+	return internal.ServeSyncCollection(w, r.URL.Path, page, resps, page.Deleted, h.SortResponses)
 }
 
 type backend struct {
-	Backend Backend
-	Prefix  string
+	Backend          Backend
+	Prefix           string
+	Visibility       webdav.VisibilityFunc
+	TimeLayout       string
+	Listing          *webdav.ListingOptions
+	ErrorReporter    *internal.ErrorReporter
+	Transforms       []TransformFunc
+	MaintainSequence bool
 }
 
 type resourceType int
@@ -311,11 +797,38 @@ func (b *backend) resourceTypeAtPath(reqPath string) resourceType {
 	return resourceType(len(strings.Split(p, "/")) - 1)
 }
 
+func (b *backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.Backend.CurrentUserPrincipal(ctx)
+}
+
 func (b *backend) Options(r *http.Request) (caps []string, allow []string, err error) {
 	caps = []string{"calendar-access"}
+	sb, scheduling := b.Backend.(SchedulingBackend)
+	if scheduling {
+		caps = append(caps, "calendar-auto-schedule")
+	}
 
 	if b.resourceTypeAtPath(r.URL.Path) != resourceTypeCalendarObject {
-		return caps, []string{http.MethodOptions, "PROPFIND", "REPORT", "DELETE", "MKCOL"}, nil
+		allow = []string{http.MethodOptions, "PROPFIND", "REPORT", "DELETE"}
+		if _, ok := calendarCreator(b.Backend); ok {
+			allow = append(allow, "MKCOL", "MKCALENDAR")
+		}
+		if scheduling {
+			outboxPath, err := sb.ScheduleOutboxPath(r.Context())
+			if err != nil {
+				return nil, nil, err
+			}
+			if r.URL.Path == outboxPath {
+				allow = append(allow, http.MethodPost)
+			}
+		}
+		if _, ok := b.Backend.(TransactionBackend); ok && allow[len(allow)-1] != http.MethodPost {
+			allow = append(allow, http.MethodPost)
+		}
+		if rt := b.resourceTypeAtPath(r.URL.Path); b.Listing != nil && (rt == resourceTypeCalendarHomeSet || rt == resourceTypeCalendar) {
+			allow = append(allow, http.MethodGet, http.MethodHead)
+		}
+		return caps, allow, nil
 	}
 
 	var dataReq CalendarCompRequest
@@ -333,26 +846,77 @@ func (b *backend) Options(r *http.Request) (caps []string, allow []string, err e
 		http.MethodPut,
 		http.MethodDelete,
 		"PROPFIND",
+		"MOVE",
 	}, nil
 }
 
+// objectPath returns the path of the calendar object requested by the client.
+func (b *backend) objectPath(ctx context.Context, p string) (string, error) {
+	if resolver, ok := optionalBackend(b.Backend).(ObjectPathResolver); ok {
+		return resolver.ResolveObjectPath(ctx, p)
+	}
+	return p, nil
+}
+
 func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
+	if b.Listing != nil {
+		switch b.resourceTypeAtPath(r.URL.Path) {
+		case resourceTypeCalendarHomeSet, resourceTypeCalendar:
+			return b.serveListing(w, r)
+		}
+	}
+
+	objPath, err := b.objectPath(r.Context(), r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !b.Visibility.IsVisible(r.Context(), objPath) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	if rb, ok := b.Backend.(RawBackend); ok {
+		// Free-busy access requires the object data to be limited
+		if freeBusy, err := b.isFreeBusyOnly(r.Context(), objPath); err != nil {
+			return err
+		} else if !freeBusy {
+			raw, err := rb.GetCalendarObjectRaw(r.Context(), objPath)
+			if err != nil {
+				return err
+			}
+			if raw.ContentType == "" {
+				raw.ContentType = ical.MIMEType
+			}
+			internal.ServeRawObject(w, r, raw.ContentType, raw.ETag, raw.ModTime, raw.Data)
+			return nil
+		}
+	}
+
 	var dataReq CalendarCompRequest
 	if r.Method != http.MethodHead {
 		dataReq.AllProps = true
 	}
-	co, err := b.Backend.GetCalendarObject(r.Context(), r.URL.Path, &dataReq)
+	co, err := b.Backend.GetCalendarObject(r.Context(), objPath, &dataReq)
+	if err != nil {
+		return err
+	}
+	co, _, err = b.limitCalendarObject(r.Context(), co)
 	if err != nil {
 		return err
 	}
 
 	w.Header().Set("Content-Type", ical.MIMEType)
+	// The object is re-encoded on each request, so byte ranges can't be
+	// served reliably
+	w.Header().Set("Accept-Ranges", "none")
 	if co.ContentLength > 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(co.ContentLength, 10))
 	}
 	if co.ETag != "" {
 		w.Header().Set("ETag", internal.ETag(co.ETag).String())
 	}
+	if co.DownloadName != "" {
+		w.Header().Set("Content-Disposition", internal.FormatContentDisposition(co.DownloadName))
+	}
 	if !co.ModTime.IsZero() {
 		w.Header().Set("Last-Modified", co.ModTime.UTC().Format(http.TimeFormat))
 	}
@@ -363,96 +927,179 @@ func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (b *backend) serveListing(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	if !b.Visibility.IsVisible(ctx, r.URL.Path) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	listing := webdav.Listing{Path: r.URL.Path}
+	if b.resourceTypeAtPath(r.URL.Path) == resourceTypeCalendarHomeSet {
+		cals, err := b.Backend.ListCalendars(ctx)
+		if err != nil {
+			return err
+		}
+		for _, cal := range cals {
+			p := strings.TrimSuffix(cal.Path, "/")
+			if path.Dir(p) != path.Clean(r.URL.Path) || !b.Visibility.IsVisible(ctx, cal.Path) {
+				continue
+			}
+			name := cal.Name
+			if name == "" {
+				name = path.Base(p)
+			}
+			listing.Entries = append(listing.Entries, webdav.ListingEntry{
+				Name:         name,
+				Path:         cal.Path,
+				IsCollection: true,
+			})
+		}
+	} else {
+		cal, err := b.Backend.GetCalendar(ctx, r.URL.Path)
+		if err != nil {
+			return err
+		}
+		objs, err := b.Backend.ListCalendarObjects(ctx, cal.Path, &CalendarCompRequest{})
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if !b.Visibility.IsVisible(ctx, obj.Path) {
+				continue
+			}
+			listing.Entries = append(listing.Entries, webdav.ListingEntry{
+				Name:        path.Base(obj.Path),
+				Path:        obj.Path,
+				Size:        obj.ContentLength,
+				ModTime:     obj.ModTime,
+				ContentType: ical.MIMEType,
+			})
+		}
+	}
+
+	return b.Listing.ServeListing(w, r, &listing)
+}
+
 func (b *backend) PropFind(r *http.Request, propfind *internal.PropFind, depth internal.Depth) (*internal.MultiStatus, error) {
+	var resps []internal.Response
+	err := b.PropFindStream(r, propfind, depth, func(resp *internal.Response) error {
+		resps = append(resps, *resp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewMultiStatus(resps...), nil
+}
+
+// PropFindStream implements internal.PropFindStreamer.
+func (b *backend) PropFindStream(r *http.Request, propfind *internal.PropFind, depth internal.Depth, fn func(resp *internal.Response) error) error {
 	resType := b.resourceTypeAtPath(r.URL.Path)
 
+	reqPath := r.URL.Path
+	if resType == resourceTypeCalendarObject {
+		var err error
+		reqPath, err = b.objectPath(r.Context(), reqPath)
+		if err != nil {
+			return err
+		}
+	}
+	if (resType == resourceTypeCalendar || resType == resourceTypeCalendarObject) && !b.Visibility.IsVisible(r.Context(), reqPath) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	if resType == resourceTypeCalendar {
+		if ok, err := b.propFindSchedule(r.Context(), propfind, r.URL.Path, depth, fn); err != nil || ok {
+			return err
+		}
+	}
+
 	var dataReq CalendarCompRequest
-	var resps []internal.Response
 
 	switch resType {
 	case resourceTypeRoot:
 		resp, err := b.propFindRoot(r.Context(), propfind)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resps = append(resps, *resp)
+		return fn(resp)
 	case resourceTypeUserPrincipal:
 		principalPath, err := b.Backend.CurrentUserPrincipal(r.Context())
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if r.URL.Path == principalPath {
 			resp, err := b.propFindUserPrincipal(r.Context(), propfind)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if err := fn(resp); err != nil {
+				return err
 			}
-			resps = append(resps, *resp)
 			if depth != internal.DepthZero {
 				resp, err := b.propFindHomeSet(r.Context(), propfind)
 				if err != nil {
-					return nil, err
+					return err
+				}
+				if err := fn(resp); err != nil {
+					return err
 				}
-				resps = append(resps, *resp)
 				if depth == internal.DepthInfinity {
-					resps_, err := b.propFindAllCalendars(r.Context(), propfind, true)
-					if err != nil {
-						return nil, err
-					}
-					resps = append(resps, resps_...)
+					return b.propFindAllCalendars(r.Context(), propfind, true, fn)
 				}
 			}
 		}
 	case resourceTypeCalendarHomeSet:
 		homeSetPath, err := b.Backend.CalendarHomeSetPath(r.Context())
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if r.URL.Path == homeSetPath {
 			resp, err := b.propFindHomeSet(r.Context(), propfind)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if err := fn(resp); err != nil {
+				return err
 			}
-			resps = append(resps, *resp)
 			if depth != internal.DepthZero {
 				recurse := depth == internal.DepthInfinity
-				resps_, err := b.propFindAllCalendars(r.Context(), propfind, recurse)
-				if err != nil {
-					return nil, err
-				}
-				resps = append(resps, resps_...)
+				return b.propFindAllCalendars(r.Context(), propfind, recurse, fn)
 			}
 		}
 	case resourceTypeCalendar:
 		ab, err := b.Backend.GetCalendar(r.Context(), r.URL.Path)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		resp, err := b.propFindCalendar(r.Context(), propfind, ab)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 		if depth != internal.DepthZero {
-			resps_, err := b.propFindAllCalendarObjects(r.Context(), propfind, ab)
-			if err != nil {
-				return nil, err
-			}
-			resps = append(resps, resps_...)
+			return b.propFindAllCalendarObjects(r.Context(), propfind, ab, fn)
 		}
 	case resourceTypeCalendarObject:
-		ao, err := b.Backend.GetCalendarObject(r.Context(), r.URL.Path, &dataReq)
+		ao, err := b.Backend.GetCalendarObject(r.Context(), reqPath, &dataReq)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		ao, _, err = b.limitCalendarObject(r.Context(), ao)
+		if err != nil {
+			return err
 		}
 
 		resp, err := b.propFindCalendarObject(r.Context(), propfind, ao)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resps = append(resps, *resp)
+		return fn(resp)
 	}
 
-	return internal.NewMultiStatus(resps...), nil
+	return nil
 }
 
 func (b *backend) propFindRoot(ctx context.Context, propfind *internal.PropFind) (*internal.Response, error) {
@@ -493,6 +1140,12 @@ func (b *backend) propFindUserPrincipal(ctx context.Context, propfind *internal.
 			return internal.NewResourceType(internal.CollectionName), nil
 		},
 	}
+	if sb, ok := b.Backend.(SchedulingBackend); ok {
+		addSchedulingPrincipalProps(ctx, props, sb)
+	}
+	if tb, ok := optionalBackend(b.Backend).(TimezoneBackend); ok {
+		addTimezonePrincipalProps(ctx, props, tb)
+	}
 	return internal.NewPropFindResponse(principalPath, propfind, props)
 }
 
@@ -515,6 +1168,9 @@ func (b *backend) propFindHomeSet(ctx context.Context, propfind *internal.PropFi
 			return internal.NewResourceType(internal.CollectionName), nil
 		},
 	}
+	if tb, ok := optionalBackend(b.Backend).(TimezoneBackend); ok {
+		addTimezonePrincipalProps(ctx, props, tb)
+	}
 	return internal.NewPropFindResponse(homeSetPath, propfind, props)
 }
 
@@ -537,11 +1193,14 @@ func (b *backend) propFindCalendar(ctx context.Context, propfind *internal.PropF
 			return &calendarDescription{Description: cal.Description}, nil
 		},
 		supportedCalendarDataName: func(*internal.RawXMLValue) (interface{}, error) {
-			return &supportedCalendarData{
-				Types: []calendarDataType{
-					{ContentType: ical.MIMEType, Version: "2.0"},
-				},
-			}, nil
+			types := []calendarDataType{{ContentType: ical.MIMEType, Version: "2.0"}}
+			if len(cal.SupportedCalendarData) > 0 {
+				types = make([]calendarDataType, len(cal.SupportedCalendarData))
+				for i, t := range cal.SupportedCalendarData {
+					types[i] = calendarDataType{ContentType: t.ContentType, Version: t.Version}
+				}
+			}
+			return &supportedCalendarData{Types: types}, nil
 		},
 		supportedCalendarComponentSetName: func(*internal.RawXMLValue) (interface{}, error) {
 			components := []comp{}
@@ -556,6 +1215,9 @@ func (b *backend) propFindCalendar(ctx context.Context, propfind *internal.PropF
 				Comp: components,
 			}, nil
 		},
+		supportedCollationSetName: func(*internal.RawXMLValue) (interface{}, error) {
+			return &supportedCollationSet{Collations: internal.SupportedCollations}, nil
+		},
 	}
 
 	if cal.Description != "" {
@@ -570,33 +1232,219 @@ func (b *backend) propFindCalendar(ctx context.Context, propfind *internal.PropF
 		}
 	}
 
-	// TODO: CALDAV:calendar-timezone, CALDAV:supported-calendar-component-set, CALDAV:min-date-time, CALDAV:max-date-time, CALDAV:max-instances, CALDAV:max-attendees-per-instance
+	if cal.Color != "" {
+		props[calendarColorName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &calendarColor{Color: cal.Color}, nil
+		}
+	}
+	if cal.Order != 0 {
+		props[calendarOrderName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &calendarOrder{Order: cal.Order}, nil
+		}
+	}
+	if cal.Timezone != "" {
+		props[calendarTimezoneName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &calendarTimezone{Data: cal.Timezone}, nil
+		}
+	}
+	if cal.Encrypted {
+		props[encryptedCollectionName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &encryptedCollection{}, nil
+		}
+	}
+
+	if cal.CTag != "" {
+		props[internal.GetCTagName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &internal.GetCTag{CTag: cal.CTag}, nil
+		}
+	}
+	if sb, ok := optionalBackend(b.Backend).(SyncBackend); ok {
+		props[internal.SyncTokenName] = func(*internal.RawXMLValue) (interface{}, error) {
+			token, err := sb.CalendarSyncToken(ctx, cal.Path)
+			if err != nil {
+				return nil, err
+			}
+			return &internal.SyncToken{Token: token}, nil
+		}
+		if cal.CTag == "" {
+			// The sync token changes whenever the calendar changes
+			props[internal.GetCTagName] = func(*internal.RawXMLValue) (interface{}, error) {
+				token, err := sb.CalendarSyncToken(ctx, cal.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &internal.GetCTag{CTag: token}, nil
+			}
+		}
+	}
+
+	if fb, ok := b.Backend.(*FeedBackend); ok {
+		if f := fb.feed(cal.Path); f != nil {
+			addFeedProps(props, f)
+		}
+	}
+
+	// TODO: CALDAV:supported-calendar-component-set, CALDAV:min-date-time, CALDAV:max-date-time, CALDAV:max-instances, CALDAV:max-attendees-per-instance
+
+	if store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore); ok {
+		if err := internal.AddDeadProps(ctx, props, store, cal.Path, isLiveProp); err != nil {
+			return nil, err
+		}
+	}
 
 	return internal.NewPropFindResponse(cal.Path, propfind, props)
 }
 
-func (b *backend) propFindAllCalendars(ctx context.Context, propfind *internal.PropFind, recurse bool) ([]internal.Response, error) {
+func (b *backend) propFindAllCalendars(ctx context.Context, propfind *internal.PropFind, recurse bool, fn func(resp *internal.Response) error) error {
 	abs, err := b.Backend.ListCalendars(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var resps []internal.Response
 	for _, ab := range abs {
+		if !b.Visibility.IsVisible(ctx, ab.Path) {
+			continue
+		}
+
 		resp, err := b.propFindCalendar(ctx, propfind, &ab)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 		if recurse {
-			resps_, err := b.propFindAllCalendarObjects(ctx, propfind, &ab)
-			if err != nil {
-				return nil, err
+			if err := b.propFindAllCalendarObjects(ctx, propfind, &ab, fn); err != nil {
+				return err
 			}
-			resps = append(resps, resps_...)
 		}
 	}
-	return resps, nil
+	return nil
+}
+
+// isFreeBusyOnly reports whether the current user only has free-busy access
+// to a calendar object.
+func (b *backend) isFreeBusyOnly(ctx context.Context, path string) (bool, error) {
+	sb, ok := optionalBackend(b.Backend).(SharingBackend)
+	if !ok {
+		return false, nil
+	}
+	access, err := sb.CalendarAccess(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	return access == CalendarAccessFreeBusy, nil
+}
+
+// limitCalendarObject applies the access level returned by the backend to a
+// calendar object. It returns true if the object has been limited. Objects
+// without data, e.g. listed without calendar-data, are returned as is.
+func (b *backend) limitCalendarObject(ctx context.Context, co *CalendarObject) (*CalendarObject, bool, error) {
+	if co.Data == nil {
+		return co, false, nil
+	}
+	if freeBusy, err := b.isFreeBusyOnly(ctx, co.Path); err != nil {
+		return nil, false, err
+	} else if !freeBusy {
+		return co, false, nil
+	}
+
+	limited := *co
+	limited.Data = freeBusyCalendar(co.Data)
+	limited.ContentLength = 0
+	return &limited, true, nil
+}
+
+// expandCalendarObject returns a copy of a calendar object whose recurring
+// components are expanded.
+func expandCalendarObject(co *CalendarObject, req *CalendarExpandRequest) (*CalendarObject, error) {
+	cal, err := expandCalendar(co.Data, req.Start, req.End)
+	if err != nil {
+		return nil, err
+	}
+	expanded := *co
+	expanded.Data = cal
+	expanded.ContentLength = 0
+	return &expanded, nil
+}
+
+// pruneCalendarObject strips the properties and components which haven't
+// been requested from a calendar object, as defined in RFC 4791 section
+// 9.6.1. Requests without a component name are ignored.
+func pruneCalendarObject(co *CalendarObject, req *CalendarCompRequest) *CalendarObject {
+	if req.Name == "" || co.Data == nil || !strings.EqualFold(req.Name, co.Data.Name) {
+		return co
+	}
+	pruned := *co
+	pruned.Data = &ical.Calendar{Component: pruneComponent(co.Data.Component, req)}
+	pruned.ContentLength = 0
+	return &pruned
+}
+
+// requiredProps lists the properties kept in pruned components, so that
+// calendar-data remains valid iCalendar which can be encoded by ical.Encoder.
+var requiredProps = map[string][]string{
+	ical.CompCalendar:         {ical.PropVersion, ical.PropProductID},
+	ical.CompEvent:            {ical.PropDateTimeStamp, ical.PropUID},
+	ical.CompToDo:             {ical.PropDateTimeStamp, ical.PropUID},
+	ical.CompJournal:          {ical.PropDateTimeStamp, ical.PropUID},
+	ical.CompFreeBusy:         {ical.PropDateTimeStamp, ical.PropUID},
+	ical.CompTimezone:         {ical.PropTimezoneID},
+	ical.CompTimezoneStandard: {ical.PropDateTimeStart, ical.PropTimezoneOffsetTo, ical.PropTimezoneOffsetFrom},
+	ical.CompTimezoneDaylight: {ical.PropDateTimeStart, ical.PropTimezoneOffsetTo, ical.PropTimezoneOffsetFrom},
+}
+
+// pruneComponent returns a copy of a component only containing the requested
+// properties and sub-components, along with the required ones. An empty
+// request selects the whole component.
+func pruneComponent(comp *ical.Component, req *CalendarCompRequest) *ical.Component {
+	if !req.AllProps && len(req.Props) == 0 && !req.AllComps && len(req.Comps) == 0 {
+		return comp
+	}
+
+	pruned := ical.NewComponent(comp.Name)
+	if req.AllProps {
+		for name, props := range comp.Props {
+			pruned.Props[name] = props
+		}
+	}
+	keep := append(append([]string(nil), req.Props...), requiredProps[comp.Name]...)
+	if comp.Name == ical.CompToDo && len(comp.Props[ical.PropDuration]) > 0 {
+		// DURATION is only valid along with DTSTART
+		keep = append(keep, ical.PropDateTimeStart)
+	}
+	for _, name := range keep {
+		name = strings.ToUpper(name)
+		if props, ok := comp.Props[name]; ok {
+			pruned.Props[name] = props
+		}
+	}
+
+	for _, child := range comp.Children {
+		if req.AllComps {
+			pruned.Children = append(pruned.Children, child)
+			continue
+		}
+		for i := range req.Comps {
+			if strings.EqualFold(req.Comps[i].Name, child.Name) {
+				pruned.Children = append(pruned.Children, pruneComponent(child, &req.Comps[i]))
+				break
+			}
+		}
+	}
+
+	// Calendars and time zones can't be empty, keep the required parts of
+	// their sub-components
+	if len(pruned.Children) == 0 && (comp.Name == ical.CompCalendar || comp.Name == ical.CompTimezone) {
+		for _, child := range comp.Children {
+			childReq := CalendarCompRequest{Name: child.Name, Props: requiredProps[child.Name]}
+			if len(childReq.Props) == 0 {
+				continue
+			}
+			pruned.Children = append(pruned.Children, pruneComponent(child, &childReq))
+		}
+	}
+	return pruned
 }
 
 func (b *backend) propFindCalendarObject(ctx context.Context, propfind *internal.PropFind, co *CalendarObject) (*internal.Response, error) {
@@ -629,7 +1477,10 @@ func (b *backend) propFindCalendarObject(ctx context.Context, propfind *internal
 	}
 	if !co.ModTime.IsZero() {
 		props[internal.GetLastModifiedName] = func(*internal.RawXMLValue) (interface{}, error) {
-			return &internal.GetLastModified{LastModified: internal.Time(co.ModTime)}, nil
+			return &internal.GetLastModified{
+				LastModified: internal.Time(co.ModTime),
+				Layout:       b.TimeLayout,
+			}, nil
 		}
 	}
 
@@ -639,70 +1490,468 @@ func (b *backend) propFindCalendarObject(ctx context.Context, propfind *internal
 		}
 	}
 
+	if store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore); ok {
+		if err := internal.AddDeadProps(ctx, props, store, co.Path, isLiveProp); err != nil {
+			return nil, err
+		}
+	}
+
 	return internal.NewPropFindResponse(co.Path, propfind, props)
 }
 
-func (b *backend) propFindAllCalendarObjects(ctx context.Context, propfind *internal.PropFind, cal *Calendar) ([]internal.Response, error) {
+func (b *backend) propFindAllCalendarObjects(ctx context.Context, propfind *internal.PropFind, cal *Calendar, fn func(resp *internal.Response) error) error {
 	var dataReq CalendarCompRequest
-	aos, err := b.Backend.ListCalendarObjects(ctx, cal.Path, &dataReq)
+	return b.listCalendarObjects(ctx, cal.Path, &dataReq, func(ao *CalendarObject) error {
+		if !b.Visibility.IsVisible(ctx, ao.Path) {
+			return nil
+		}
+
+		co, _, err := b.limitCalendarObject(ctx, ao)
+		if err != nil {
+			return err
+		}
+
+		resp, err := b.propFindCalendarObject(ctx, propfind, co)
+		if err != nil {
+			return err
+		}
+		return fn(resp)
+	})
+}
+
+// listCalendarObjects calls fn for each object of a calendar. Objects are
+// streamed if the Backend implements CalendarObjectStreamer.
+func (b *backend) listCalendarObjects(ctx context.Context, path string, req *CalendarCompRequest, fn func(co *CalendarObject) error) error {
+	if streamer, ok := b.Backend.(CalendarObjectStreamer); ok {
+		return streamer.ListCalendarObjectsStream(ctx, path, req, fn)
+	}
+	l, err := b.Backend.ListCalendarObjects(ctx, path, req)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var resps []internal.Response
-	for _, ao := range aos {
-		resp, err := b.propFindCalendarObject(ctx, propfind, &ao)
-		if err != nil {
-			return nil, err
+// queryCalendarObjects calls fn for each object of a calendar matching a
+// query. Objects are streamed if the Backend implements
+// CalendarObjectStreamer.
+func (b *backend) queryCalendarObjects(ctx context.Context, path string, query *CalendarQuery, fn func(co *CalendarObject) error) error {
+	if streamer, ok := b.Backend.(CalendarObjectStreamer); ok {
+		return streamer.QueryCalendarObjectsStream(ctx, path, query, fn)
+	}
+	l, err := b.Backend.QueryCalendarObjects(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 	}
-	return resps, nil
+	return nil
 }
 
 func (b *backend) PropPatch(r *http.Request, update *internal.PropertyUpdate) (*internal.Response, error) {
-	panic("TODO")
+	if tb, ok := optionalBackend(b.Backend).(TimezoneBackend); ok {
+		if rt := b.resourceTypeAtPath(r.URL.Path); rt == resourceTypeUserPrincipal || rt == resourceTypeCalendarHomeSet {
+			return patchDefaultTimezone(r.Context(), tb, r.URL.Path, update)
+		}
+	}
+	store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore)
+	if !ok {
+		return nil, internal.HTTPErrorf(http.StatusForbidden, "caldav: PROPPATCH is unsupported")
+	}
+	if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return nil, &internal.HTTPError{Code: http.StatusNotFound}
+	}
+	return internal.PatchDeadProperties(r.Context(), store, r.URL.Path, update, isLiveProp)
 }
 
-func (b *backend) Put(r *http.Request) (*internal.Href, error) {
+// isLiveProp reports whether a property is computed by the server. Other
+// properties, e.g. DAV:displayname or CALDAV:calendar-description, can be
+// changed with PROPPATCH.
+func isLiveProp(name xml.Name) bool {
+	switch name {
+	case internal.ResourceTypeName, internal.GetContentLengthName,
+		internal.GetLastModifiedName, internal.GetContentTypeName,
+		internal.GetETagName, internal.SyncTokenName, internal.GetCTagName,
+		internal.CurrentUserPrincipalName, calendarHomeSetName,
+		supportedCalendarDataName, supportedCalendarComponentSetName,
+		supportedCollationSetName, maxResourceSizeName, calendarDataName,
+		scheduleInboxURLName, scheduleOutboxURLName,
+		calendarUserAddressSetName, encryptedCollectionName, sourceName,
+		feedStatusName:
+		return true
+	}
+	return false
+}
+
+func (b *backend) SupportsDryRun(r *http.Request) bool {
+	drb, ok := b.Backend.(DryRunBackend)
+	return ok && drb.SupportsDryRun()
+}
+
+func (b *backend) Put(r *http.Request) (*internal.PutResult, error) {
 	ifNoneMatch := webdav.ConditionalMatch(r.Header.Get("If-None-Match"))
 	ifMatch := webdav.ConditionalMatch(r.Header.Get("If-Match"))
 
 	opts := PutCalendarObjectOptions{
 		IfNoneMatch: ifNoneMatch,
 		IfMatch:     ifMatch,
+		DryRun:      internal.IsDryRun(r.Header) && b.SupportsDryRun(r),
 	}
 
-	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	objPath, err := b.objectPath(r.Context(), r.URL.Path)
 	if err != nil {
-		return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: malformed Content-Type: %v", err)
-	}
-	if t != ical.MIMEType {
-		// TODO: send CALDAV:supported-calendar-data error
-		return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: unsupported Content-Type %q", t)
+		return nil, err
 	}
+	parent := b.parentCalendar(r.Context(), path.Dir(objPath))
+	encrypted := parent != nil && parent.Encrypted
 
-	// TODO: check CALDAV:max-resource-size precondition
-	cal, err := ical.NewDecoder(r.Body).Decode()
+	if err := checkObjectContentType(parent, r.Header.Get("Content-Type")); err != nil {
+		return nil, err
+	}
+	data, err := readObject(r, parent)
 	if err != nil {
-		// TODO: send CALDAV:valid-calendar-data error
-		return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: failed to parse iCalendar: %v", err)
+		return nil, err
+	}
+	cal, err := decodeObject(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.Transforms) > 0 && !encrypted {
+		if err := transform(r.Context(), b.Transforms, objPath, cal); err != nil {
+			return nil, err
+		}
+	}
+
+	_, scheduling := b.Backend.(SchedulingBackend)
+	scheduling = scheduling && !encrypted
+	maintainSequence := b.MaintainSequence && !encrypted
+	var prev *ical.Calendar
+	if (scheduling && !opts.DryRun) || maintainSequence {
+		prev, err = b.prevObject(r.Context(), objPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if maintainSequence {
+		UpdateSequence(prev, cal, time.Now())
 	}
 
-	loc, err := b.Backend.PutCalendarObject(r.Context(), r.URL.Path, cal, &opts)
+	verbatim := true
+	if (len(b.Transforms) > 0 && !encrypted) || maintainSequence {
+		var buf bytes.Buffer
+		if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+			return nil, err
+		}
+		verbatim = bytes.Equal(buf.Bytes(), data)
+		data = buf.Bytes()
+	}
+
+	var loc string
+	if rb, ok := b.Backend.(RawBackend); ok {
+		loc, err = rb.PutCalendarObjectRaw(r.Context(), objPath, &RawCalendarObject{
+			Path:        objPath,
+			ContentType: r.Header.Get("Content-Type"),
+			Data:        data,
+		}, &opts)
+	} else {
+		loc, err = b.Backend.PutCalendarObject(r.Context(), objPath, cal, &opts)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if opts.DryRun {
+		return nil, nil
+	}
+	if scheduling {
+		b.schedule(r.Context(), prev, cal)
+	}
+
+	res := &internal.PutResult{Href: &internal.Href{Path: loc}}
+	if verbatim {
+		res.ETag = b.objectETag(r.Context(), loc)
+	}
+	return res, nil
+}
+
+// objectETag returns the ETag of the calendar object at p, or an empty string
+// if it can't be found.
+func (b *backend) objectETag(ctx context.Context, p string) string {
+	if rb, ok := b.Backend.(RawBackend); ok {
+		if obj, err := rb.GetCalendarObjectRaw(ctx, p); err == nil {
+			return obj.ETag
+		}
+		return ""
+	}
+	if co, err := b.Backend.GetCalendarObject(ctx, p, &CalendarCompRequest{}); err == nil {
+		return co.ETag
+	}
+	return ""
+}
+
+// isEncryptedCalendar reports whether a calendar holds end-to-end encrypted
+// objects. Calendars which can't be found are handled as regular calendars:
+// the backend reports the error when objects are accessed.
+func (b *backend) isEncryptedCalendar(ctx context.Context, p string) bool {
+	cal := b.parentCalendar(ctx, p)
+	return cal != nil && cal.Encrypted
+}
+
+// parentCalendar returns the calendar at p, or nil if there is none.
+func (b *backend) parentCalendar(ctx context.Context, p string) *Calendar {
+	cal, err := b.Backend.GetCalendar(ctx, strings.TrimSuffix(p, "/")+"/")
+	if err != nil {
+		cal, err = b.Backend.GetCalendar(ctx, strings.TrimSuffix(p, "/"))
+	}
+	if err != nil {
+		return nil
+	}
+	return cal
+}
 
-	return &internal.Href{Path: loc}, nil
+// checkObjectContentType checks the media type of a calendar object stored
+// in cal, which may be nil, against the CALDAV:supported-calendar-data
+// precondition. The version defaults to 2.0 if the media type has no version
+// parameter.
+func checkObjectContentType(cal *Calendar, contentType string) error {
+	t, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: malformed Content-Type: %v", err)
+	}
+	version := params["version"]
+	if version == "" {
+		version = "2.0"
+	}
+	if cal == nil {
+		cal = &Calendar{}
+	}
+	// Objects are parsed as iCalendar data, whatever the calendar lists
+	if t != ical.MIMEType || !cal.SupportsCalendarData(t, version) {
+		return NewPreconditionError(PreconditionSupportedCalendarData)
+	}
+	return nil
+}
+
+// readObject reads the body of a PUT request, checking the
+// CALDAV:max-resource-size precondition of the parent calendar.
+func readObject(r *http.Request, cal *Calendar) ([]byte, error) {
+	data, err := internal.ReadBody(r, maxObjectSize(cal))
+	if err == internal.ErrBodyTooLarge {
+		return nil, NewPreconditionError(PreconditionMaxResourceSize)
+	}
+	return data, err
+}
+
+// maxObjectSize returns the maximum size of the objects of a calendar, which
+// may be nil. Zero means unlimited.
+func maxObjectSize(cal *Calendar) int64 {
+	if cal == nil {
+		return 0
+	}
+	return cal.MaxResourceSize
+}
+
+// decodeObject parses the data of a calendar object.
+func decodeObject(data []byte) (*ical.Calendar, error) {
+	cal, err := ical.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		// TODO: send CALDAV:valid-calendar-data error
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "caldav: failed to parse iCalendar: %v", err)
+	}
+	return cal, nil
 }
 
 func (b *backend) Delete(r *http.Request) error {
-	return b.Backend.DeleteCalendarObject(r.Context(), r.URL.Path)
+	objPath, err := b.objectPath(r.Context(), r.URL.Path)
+	if err != nil {
+		return err
+	}
+	prev, err := b.prevSchedulingObject(r.Context(), objPath)
+	if err != nil {
+		return err
+	}
+	if err := b.Backend.DeleteCalendarObject(r.Context(), objPath); err != nil {
+		return err
+	}
+	if prev != nil {
+		b.schedule(r.Context(), prev, nil)
+	}
+	return nil
 }
 
 func (b *backend) Mkcol(r *http.Request) error {
-	panic("TODO")
+	var m mkcolReq
+	if err := decodeMkcolRequest(r, &m); err != nil {
+		return err
+	}
+	if m.Set != nil {
+		var resourceType internal.ResourceType
+		if err := m.Set.Prop.Decode(&resourceType); err != nil && !internal.IsNotFound(err) {
+			return err
+		}
+		if !resourceType.Is(internal.CollectionName) || !resourceType.Is(calendarName) {
+			return internal.HTTPErrorf(http.StatusForbidden, "caldav: only calendars can be created")
+		}
+	}
+	return b.createCalendar(r.Context(), r.URL.Path, m.Set, mkcolResponseName)
+}
+
+// decodeMkcolRequest decodes the optional body of a MKCOL or MKCALENDAR
+// request.
+func decodeMkcolRequest(r *http.Request, v interface{}) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	if err := internal.DecodeXMLRequest(r, v); errors.Is(err, io.EOF) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// createCalendar creates a calendar with the properties set in a MKCOL or
+// MKCALENDAR request. Properties which can't be set are reported in a
+// response named respName.
+func (b *backend) createCalendar(ctx context.Context, p string, set *internal.Set, respName xml.Name) error {
+	creator, ok := calendarCreator(b.Backend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: creating calendars isn't supported")
+	}
+	if b.resourceTypeAtPath(p) != resourceTypeCalendar {
+		return NewPreconditionError(PreconditionCalendarCollectionLocationOk)
+	}
+	if _, err := b.Backend.GetCalendar(ctx, p); err == nil {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: calendar already exists")
+	}
+
+	cal := Calendar{Path: p}
+	if set != nil {
+		if err := checkCalendarProps(&set.Prop, respName); err != nil {
+			return err
+		}
+		if err := decodeCalendarProps(&set.Prop, &cal); err != nil {
+			return err
+		}
+	}
+	return creator.CreateCalendar(ctx, cal)
+}
+
+// decodeCalendarProps decodes the calendar properties which can be set by
+// clients.
+// calendarPropNames lists the properties which can be set when creating a
+// calendar, see decodeCalendarProps.
+var calendarPropNames = map[xml.Name]bool{
+	internal.ResourceTypeName:         true,
+	internal.DisplayNameName:          true,
+	calendarDescriptionName:           true,
+	supportedCalendarComponentSetName: true,
+	maxResourceSizeName:               true,
+	calendarColorName:                 true,
+	calendarOrderName:                 true,
+	calendarTimezoneName:              true,
+	encryptedCollectionName:           true,
+}
+
+// checkCalendarProps fails if some properties can't be set when creating a
+// calendar. As defined in RFC 5689 section 3.3, they are listed with the 403
+// status, and the other properties with the 424 status.
+func checkCalendarProps(prop *internal.Prop, respName xml.Name) error {
+	var failed, dependent internal.Prop
+	for _, raw := range prop.Raw {
+		name, ok := raw.XMLName()
+		if !ok {
+			continue
+		}
+		empty := internal.NewRawXMLElement(name, nil, nil)
+		if calendarPropNames[name] {
+			dependent.Raw = append(dependent.Raw, *empty)
+		} else {
+			failed.Raw = append(failed.Raw, *empty)
+		}
+	}
+	if len(failed.Raw) == 0 {
+		return nil
+	}
+
+	propStats := []internal.PropStat{{Prop: failed, Status: internal.Status{Code: http.StatusForbidden}}}
+	if len(dependent.Raw) > 0 {
+		propStats = append(propStats, internal.PropStat{Prop: dependent, Status: internal.Status{Code: http.StatusFailedDependency}})
+	}
+	return &internal.HTTPError{
+		Code: http.StatusForbidden,
+		Err:  &internal.PropStatError{XMLName: respName, PropStats: propStats},
+	}
+}
+
+func decodeCalendarProps(prop *internal.Prop, cal *Calendar) error {
+	var displayName internal.DisplayName
+	if err := prop.Decode(&displayName); err == nil {
+		cal.Name = displayName.Name
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var desc calendarDescription
+	if err := prop.Decode(&desc); err == nil {
+		cal.Description = desc.Description
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var compSet supportedCalendarComponentSet
+	if err := prop.Decode(&compSet); err == nil {
+		for _, comp := range compSet.Comp {
+			cal.SupportedComponentSet = append(cal.SupportedComponentSet, comp.Name)
+		}
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var maxSize maxResourceSize
+	if err := prop.Decode(&maxSize); err == nil {
+		cal.MaxResourceSize = maxSize.Size
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var color calendarColor
+	if err := prop.Decode(&color); err == nil {
+		cal.Color = color.Color
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var order calendarOrder
+	if err := prop.Decode(&order); err == nil {
+		cal.Order = order.Order
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var tz calendarTimezone
+	if err := prop.Decode(&tz); err == nil {
+		cal.Timezone = tz.Data
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	var encrypted encryptedCollection
+	if err := prop.Decode(&encrypted); err == nil {
+		cal.Encrypted = true
+	} else if !internal.IsNotFound(err) {
+		return err
+	}
+
+	return nil
 }
 
 func (b *backend) Copy(r *http.Request, dest *internal.Href, recursive, overwrite bool) (created bool, err error) {
@@ -710,7 +1959,80 @@ func (b *backend) Copy(r *http.Request, dest *internal.Href, recursive, overwrit
 }
 
 func (b *backend) Move(r *http.Request, dest *internal.Href, overwrite bool) (created bool, err error) {
-	panic("TODO")
+	ctx := r.Context()
+	if b.resourceTypeAtPath(r.URL.Path) != resourceTypeCalendarObject {
+		return false, internal.HTTPErrorf(http.StatusForbidden, "caldav: only calendar objects can be moved")
+	}
+	if b.resourceTypeAtPath(dest.Path) != resourceTypeCalendarObject {
+		return false, internal.HTTPErrorf(http.StatusForbidden, "caldav: calendar objects can only be moved into calendars")
+	}
+	srcPath, err := b.objectPath(ctx, r.URL.Path)
+	if err != nil {
+		return false, err
+	}
+	destPath, err := b.objectPath(ctx, dest.Path)
+	if err != nil {
+		return false, err
+	}
+	if !b.Visibility.IsVisible(ctx, srcPath) {
+		return false, &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	src, err := b.Backend.GetCalendarObject(ctx, srcPath, &CalendarCompRequest{})
+	if err != nil {
+		return false, err
+	}
+	prevDest, err := b.Backend.GetCalendarObject(ctx, destPath, &CalendarCompRequest{})
+	if internal.IsNotFound(err) {
+		prevDest = nil
+	} else if err != nil {
+		return false, err
+	} else if !overwrite {
+		return false, internal.HTTPErrorf(http.StatusPreconditionFailed, "caldav: destination %q already exists", dest.Path)
+	}
+	created = prevDest == nil
+
+	if mb, ok := objectMover(b.Backend); ok {
+		return created, mb.MoveCalendarObject(ctx, srcPath, destPath)
+	}
+	if tb, ok := b.Backend.(TransactionBackend); ok {
+		return created, tb.ApplyTransaction(ctx, []TransactionOp{
+			{Path: destPath, Data: src.Data},
+			{Path: srcPath},
+		})
+	}
+
+	if err := b.copyObject(ctx, srcPath, destPath, src); err != nil {
+		return false, err
+	}
+	if err := b.Backend.DeleteCalendarObject(ctx, srcPath); err != nil {
+		// Roll back to avoid duplicating the object
+		if prevDest != nil {
+			b.copyObject(ctx, destPath, destPath, prevDest)
+		} else {
+			b.Backend.DeleteCalendarObject(ctx, destPath)
+		}
+		return false, err
+	}
+	return created, nil
+}
+
+// copyObject stores a calendar object read from srcPath at destPath. Raw
+// objects are copied byte-exactly.
+func (b *backend) copyObject(ctx context.Context, srcPath, destPath string, co *CalendarObject) error {
+	var err error
+	if rb, ok := b.Backend.(RawBackend); ok && srcPath != destPath {
+		var raw *RawCalendarObject
+		if raw, err = rb.GetCalendarObjectRaw(ctx, srcPath); err != nil {
+			return err
+		}
+		obj := *raw
+		obj.Path = destPath
+		_, err = rb.PutCalendarObjectRaw(ctx, destPath, &obj, &PutCalendarObjectOptions{})
+	} else {
+		_, err = b.Backend.PutCalendarObject(ctx, destPath, co.Data, &PutCalendarObjectOptions{})
+	}
+	return err
 }
 
 // https://datatracker.ietf.org/doc/html/rfc4791#section-5.3.2.1
@@ -728,6 +2050,7 @@ const (
 	PreconditionMaxDateTime                  PreconditionType = "max-date-time"
 	PreconditionMaxInstances                 PreconditionType = "max-instances"
 	PreconditionMaxAttendeesPerInstance      PreconditionType = "max-attendees-per-instance"
+	PreconditionSupportedCollation           PreconditionType = "supported-collation"
 )
 
 func NewPreconditionError(err PreconditionType) error {
@@ -1,16 +1,28 @@
 package caldav
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
 )
 
 var propFindSupportedCalendarComponentRequest = `
@@ -52,6 +64,68 @@ func TestPropFindSupportedCalendarComponent(t *testing.T) {
 	}
 }
 
+func TestPropFindSupportedCalendarData(t *testing.T) {
+	calendar := Calendar{
+		Path:                  "/user/calendars/cal",
+		SupportedCalendarData: []CalendarDataType{{ContentType: "application/calendar+json", Version: "2.0"}},
+	}
+	ts := httptest.NewServer(&Handler{Backend: testBackend{calendars: []Calendar{calendar}}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cals, err := c.FindCalendars(context.Background(), "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	}
+	if len(cals) != 1 || !reflect.DeepEqual(cals[0].SupportedCalendarData, calendar.SupportedCalendarData) {
+		t.Errorf("FindCalendars() = %+v", cals)
+	}
+	if !cals[0].SupportsCalendarData("application/calendar+json", "2.0") || cals[0].SupportsCalendarData(ical.MIMEType, "2.0") {
+		t.Errorf("SupportsCalendarData() doesn't match the declared types")
+	}
+}
+
+func TestCollations(t *testing.T) {
+	calendar := Calendar{Path: "/user/calendars/cal"}
+	handler := Handler{Backend: testBackend{calendars: []Calendar{calendar}}}
+
+	req := httptest.NewRequest("PROPFIND", calendar.Path, strings.NewReader(`
+<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><c:supported-collation-set/></d:prop>
+</d:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	for _, collation := range []string{"i;ascii-casemap", "i;octet", "i;unicode-casemap"} {
+		if !strings.Contains(w.Body.String(), collation) {
+			t.Errorf("Expected collation %v in response:\n%v", collation, w.Body.String())
+		}
+	}
+
+	req = httptest.NewRequest("REPORT", calendar.Path, strings.NewReader(`
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><d:getetag/></d:prop>
+  <c:filter>
+    <c:comp-filter name="VCALENDAR">
+      <c:comp-filter name="VEVENT">
+        <c:prop-filter name="SUMMARY">
+          <c:text-match collation="i;basic">meeting</c:text-match>
+        </c:prop-filter>
+      </c:comp-filter>
+    </c:comp-filter>
+  </c:filter>
+</c:calendar-query>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "supported-collation") {
+		t.Errorf("REPORT with unsupported collation = %v:\n%v", w.Code, w.Body.String())
+	}
+}
+
 var propFindUserPrincipal = `
 <?xml version="1.0" encoding="UTF-8"?>
 <A:propfind xmlns:A="DAV:">
@@ -177,6 +251,33 @@ func TestMultiCalendarBackend(t *testing.T) {
 	}
 }
 
+func TestMultigetPathFilter(t *testing.T) {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//go-webdav//test//EN")
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "a")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	cal.Children = append(cal.Children, event.Component)
+	handler := Handler{Backend: testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/a"}, {Path: "/user/calendars/b"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/b": {{Path: "/user/calendars/b/secret.ics", Data: cal}},
+		},
+	}}
+
+	req := httptest.NewRequest("REPORT", "/user/calendars/a", strings.NewReader(fmt.Sprintf(reportCalendarData, "/user/calendars/b/secret.ics")))
+	req.Header.Set("Content-Type", "application/xml")
+	req = req.WithContext(internal.WithPathFilter(req.Context(), func(p string) bool {
+		return strings.HasPrefix(p, "/user/calendars/a/")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "BEGIN:VCALENDAR") || !strings.Contains(w.Body.String(), "403") {
+		t.Errorf("multiget outside of the path filter = %v:\n%v", w.Code, w.Body.String())
+	}
+}
+
 type testBackend struct {
 	calendars []Calendar
 	objectMap map[string][]CalendarObject
@@ -229,3 +330,2607 @@ func (t testBackend) ListCalendarObjects(ctx context.Context, path string, req *
 func (t testBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
 	return nil, nil
 }
+
+type freeBusySharingBackend struct {
+	testBackend
+}
+
+func (freeBusySharingBackend) CalendarAccess(ctx context.Context, path string) (CalendarAccess, error) {
+	return CalendarAccessFreeBusy, nil
+}
+
+func TestFreeBusyAccess(t *testing.T) {
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "b7a2c1a6-4a3e-4c55-9d3a-2f1e2e6b4f8d")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	event.Props.SetDateTime(ical.PropDateTimeStart, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC))
+	event.Props.SetDateTime(ical.PropDateTimeEnd, time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC))
+	event.Props.SetText(ical.PropSummary, "Secret meeting")
+	event.Props.SetText(ical.PropLocation, "Secret place")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = []*ical.Component{event.Component}
+
+	calendar := Calendar{Path: "/user/calendars/shared"}
+	object := CalendarObject{Path: "/user/calendars/shared/test.ics", Data: cal}
+	handler := Handler{Backend: freeBusySharingBackend{testBackend{
+		calendars: []Calendar{calendar},
+		objectMap: map[string][]CalendarObject{
+			calendar.Path: []CalendarObject{object},
+		},
+	}}}
+
+	req := httptest.NewRequest("REPORT", calendar.Path, strings.NewReader(fmt.Sprintf(reportCalendarData, object.Path)))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Body.String()
+	if !strings.Contains(resp, "DTSTART:20200101T100000Z") {
+		t.Errorf("Busy block not returned in response:\n%v", resp)
+	}
+	for _, s := range []string{"Secret meeting", "Secret place"} {
+		if strings.Contains(resp, s) {
+			t.Errorf("Event details %q leaked in response:\n%v", s, resp)
+		}
+	}
+
+	req = httptest.NewRequest("GET", object.Path, nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp = w.Body.String()
+	if strings.Contains(resp, "Secret meeting") {
+		t.Errorf("Event details leaked in GET response:\n%v", resp)
+	}
+
+	// Objects listed without data are left as is
+	handler.Backend = freeBusySharingBackend{testBackend{
+		calendars: []Calendar{calendar},
+		objectMap: map[string][]CalendarObject{
+			calendar.Path: []CalendarObject{{Path: object.Path, ETag: "abc"}},
+		},
+	}}
+	req = httptest.NewRequest("PROPFIND", calendar.Path, strings.NewReader(`<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "abc") {
+		t.Errorf("PROPFIND of objects without data = %v:\n%v", w.Code, w.Body.String())
+	}
+}
+
+type resolvingBackend struct {
+	testBackend
+	paths map[string]string
+}
+
+func (b resolvingBackend) ResolveObjectPath(ctx context.Context, path string) (string, error) {
+	if p, ok := b.paths[path]; ok {
+		return p, nil
+	}
+	return path, nil
+}
+
+func TestObjectPathResolver(t *testing.T) {
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "2f0d8e46-5a8a-4c8e-8b35-1d6c9b0e7f21")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	event.Props.SetText(ical.PropSummary, "Opaque")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = []*ical.Component{event.Component}
+
+	calendar := Calendar{Path: "/user/calendars/a"}
+	object := CalendarObject{Path: "/user/calendars/a/8c1d2e", Data: cal}
+	clientPath := "/user/calendars/a/2f0d8e46-5a8a-4c8e-8b35-1d6c9b0e7f21.ics"
+	handler := Handler{Backend: resolvingBackend{
+		testBackend: testBackend{
+			calendars: []Calendar{calendar},
+			objectMap: map[string][]CalendarObject{
+				calendar.Path: []CalendarObject{object},
+			},
+		},
+		paths: map[string]string{clientPath: object.Path},
+	}}
+
+	req := httptest.NewRequest("REPORT", calendar.Path, strings.NewReader(fmt.Sprintf(reportCalendarData, clientPath)))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Body.String()
+	if !strings.Contains(resp, "SUMMARY:Opaque") {
+		t.Errorf("Calendar object not resolved in multiget response:\n%v", resp)
+	}
+	if !strings.Contains(resp, "<href>"+object.Path+"</href>") {
+		t.Errorf("Resolved path not returned in multiget response:\n%v", resp)
+	}
+
+	req = httptest.NewRequest("GET", clientPath, nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "SUMMARY:Opaque") {
+		t.Errorf("Calendar object not resolved in GET response:\n%v", w.Body.String())
+	}
+}
+
+func TestHandler_capabilities(t *testing.T) {
+	h := Handler{Backend: testBackend{}, Prefix: "/dav"}
+	caps := h.Capabilities()
+	if caps.Compliance[len(caps.Compliance)-1] != "calendar-access" {
+		t.Errorf("Compliance = %v", caps.Compliance)
+	}
+	if len(caps.Reports) < 3 || caps.Reports[0] != "calendar-query" {
+		t.Errorf("Reports = %v", caps.Reports)
+	}
+	if len(caps.Backends) != 1 || caps.Backends[0].Type != "caldav.testBackend" || caps.Backends[0].Prefix != "/dav" {
+		t.Errorf("Backends = %+v", caps.Backends)
+	}
+	features := make(map[string]bool)
+	for _, f := range caps.Features {
+		features[f] = true
+	}
+	if !features["move"] || features["mkcalendar"] {
+		t.Errorf("Features = %v, want move without mkcalendar", caps.Features)
+	}
+	if caps.Limits["max-instances"] != maxRecurrenceInstances {
+		t.Errorf("Limits = %v", caps.Limits)
+	}
+
+	caps = (&Handler{Backend: NewMemBackend("/user/", "/user/calendars/")}).Capabilities()
+	found := false
+	for _, f := range caps.Features {
+		found = found || f == "mkcalendar"
+	}
+	if !found {
+		t.Errorf("Features = %v, want mkcalendar", caps.Features)
+	}
+}
+
+func TestBackendProbe(t *testing.T) {
+	h := webdav.HealthHandler{
+		Probes: map[string]webdav.HealthProbe{"caldav": BackendProbe(testBackend{})},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "caldav: ok\n" {
+		t.Errorf("GET /healthz = %v %q, want %v", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	calendars := []Calendar{
+		{Path: "/user/calendars/a", Name: "A"},
+		{Path: "/user/calendars/b", Name: "B"},
+	}
+	objectMap := map[string][]CalendarObject{
+		calendars[0].Path: {{Path: "/user/calendars/a/1.ics"}, {Path: "/user/calendars/a/2.ics"}},
+	}
+	h := AdminHandler{Backend: testBackend{calendars: calendars, objectMap: objectMap}}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != 200 {
+		t.Fatalf("GET /admin = %v:\n%v", w.Code, w.Body.String())
+	}
+
+	var report AdminReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if report.Principal != "/user/" || report.CalendarHomeSetPath != "/user/calendars/" {
+		t.Errorf("report = %+v, want principal and home set", report)
+	}
+	if len(report.Calendars) != 2 || report.Calendars[0].ObjectCount != 2 || report.Calendars[1].ObjectCount != 0 {
+		t.Errorf("report calendars = %+v, want object counts 2 and 0", report.Calendars)
+	}
+
+	// Sync tokens are reported for backends supporting them
+	syncReport, err := NewAdminReport(context.Background(), syncBackend{testBackend{calendars: calendars, objectMap: objectMap}})
+	if err != nil {
+		t.Fatalf("NewAdminReport() = %v", err)
+	}
+	if len(syncReport.Calendars) != 2 || syncReport.Calendars[0].SyncToken != "t1" {
+		t.Errorf("report calendars = %+v, want sync tokens", syncReport.Calendars)
+	}
+
+	// Server errors are hidden according to ErrorVerbosity
+	h = AdminHandler{
+		Backend:        failingPrincipalBackend{},
+		ErrorLog:       log.New(ioutil.Discard, "", 0),
+		ErrorVerbosity: webdav.ErrorVerbosityClientErrors,
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("GET /admin with a failing backend = %v:\n%v", w.Code, w.Body.String())
+	}
+}
+
+type failingPrincipalBackend struct {
+	testBackend
+}
+
+func (failingPrincipalBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return "", errors.New("secret database error")
+}
+
+type queryBackend struct {
+	testBackend
+}
+
+func (t queryBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
+	return t.objectMap[path], nil
+}
+
+type putRecorderBackend struct {
+	testBackend
+	puts map[string]*ical.Calendar
+}
+
+func (t putRecorderBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (string, error) {
+	t.puts[path] = calendar
+	return path, nil
+}
+
+type memoryMigrationState map[string]string
+
+func (s memoryMigrationState) IsMigrated(ctx context.Context, path, etag string) (bool, error) {
+	v, ok := s[path]
+	return ok && v == etag, nil
+}
+
+func (s memoryMigrationState) SetMigrated(ctx context.Context, path, etag string) error {
+	s[path] = etag
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "46bbf47a-1861-41a3-ae06-8d8268c6d41e")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = []*ical.Component{event.Component}
+
+	src := queryBackend{testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/work/"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/work/": {{Path: "/user/calendars/work/a.ics", ETag: "1", Data: cal}},
+		},
+	}}
+	ts := httptest.NewServer(&Handler{Backend: src})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := putRecorderBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/work/"}}},
+		puts:        make(map[string]*ical.Calendar),
+	}
+	state := make(memoryMigrationState)
+	var progress []webdav.MigrationProgress
+	opts := &MigrateOptions{
+		State: state,
+		Progress: func(p *webdav.MigrationProgress) {
+			progress = append(progress, *p)
+		},
+	}
+	if err := Migrate(context.Background(), c, "/user/calendars/", dst, opts); err != nil {
+		t.Fatalf("Migrate() = %v", err)
+	}
+	if _, ok := dst.puts["/user/calendars/work/a.ics"]; !ok || len(dst.puts) != 1 {
+		t.Errorf("Migrate() put %v, want /user/calendars/work/a.ics", dst.puts)
+	}
+	if len(progress) != 1 || progress[0].Skipped || progress[0].Total != 1 {
+		t.Errorf("Migrate() progress = %+v", progress)
+	}
+
+	// Resuming skips objects which have already been migrated
+	delete(dst.puts, "/user/calendars/work/a.ics")
+	progress = nil
+	if err := Migrate(context.Background(), c, "/user/calendars/", dst, opts); err != nil {
+		t.Fatalf("Migrate() = %v", err)
+	}
+	if len(dst.puts) != 0 || len(progress) != 1 || !progress[0].Skipped {
+		t.Errorf("resumed Migrate() put %v, progress %+v", dst.puts, progress)
+	}
+}
+
+const testFeed = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:holiday-1
+DTSTAMP:20200101T000000Z
+DTSTART;VALUE=DATE:20200101
+SUMMARY:New Year
+END:VEVENT
+BEGIN:VEVENT
+UID:holiday-2
+DTSTAMP:20200101T000000Z
+DTSTART;VALUE=DATE:20201225
+SUMMARY:Christmas
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestFeedBackend(t *testing.T) {
+	var fetches, notModified int
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, strings.ReplaceAll(testFeed, "\n", "\r\n"))
+	}))
+	defer feedServer.Close()
+
+	feed := &Feed{
+		URL:      feedServer.URL,
+		Calendar: Calendar{Path: "/user/calendars/holidays/", Name: "Holidays"},
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := feed.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh() = %v", err)
+		}
+	}
+	if fetches != 2 || notModified != 1 {
+		t.Errorf("fetches = %v, not modified = %v, want 2 and 1", fetches, notModified)
+	}
+
+	b := &FeedBackend{Backend: testBackend{}, Feeds: []*Feed{feed}}
+	objs, err := b.ListCalendarObjects(ctx, "/user/calendars/holidays/", nil)
+	if err != nil || len(objs) != 2 {
+		t.Fatalf("ListCalendarObjects() = %v, %v, want 2 objects", objs, err)
+	}
+	if _, err := b.PutCalendarObject(ctx, objs[0].Path, objs[0].Data, nil); err == nil {
+		t.Errorf("PutCalendarObject() on feed succeeded")
+	}
+
+	// Objects are copied, so that requests can't modify each other's data
+	objs[0].Data.Children[0].Props.SetText(ical.PropSummary, "Modified")
+	if co, err := b.GetCalendarObject(ctx, objs[0].Path, nil); err != nil {
+		t.Fatalf("GetCalendarObject() = %v", err)
+	} else if summary, _ := co.Data.Children[0].Props.Text(ical.PropSummary); summary == "Modified" {
+		t.Errorf("feed object was modified through a returned copy")
+	}
+
+	small := &Feed{URL: feedServer.URL, MaxSize: 16}
+	if err := small.Refresh(ctx); err == nil {
+		t.Errorf("Refresh() of feed larger than MaxSize succeeded")
+	}
+
+	// Invalid intervals fall back to the default
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	(&Feed{URL: feedServer.URL, RefreshInterval: -time.Second}).Run(canceled)
+
+	req := httptest.NewRequest("PROPFIND", "/user/calendars/holidays/", strings.NewReader(`
+<d:propfind xmlns:d="DAV:" xmlns:cs="http://calendarserver.org/ns/" xmlns:g="https://github.com/emersion/go-webdav">
+  <d:prop><cs:source/><g:feed-status/></d:prop>
+</d:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w := httptest.NewRecorder()
+	(&Handler{Backend: b}).ServeHTTP(w, req)
+	resp := w.Body.String()
+	if !strings.Contains(resp, feedServer.URL) || !strings.Contains(resp, "last-success") {
+		t.Errorf("PROPFIND doesn't contain feed source and status:\n%v", resp)
+	}
+}
+
+func TestFileFeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caldav-feeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "holidays.ics")
+	if err := ioutil.WriteFile(file, []byte(strings.ReplaceAll(testFeed, "\n", "\r\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a feed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds, err := NewFileFeeds(http.Dir(dir), "/", "/user/calendars/")
+	if err != nil {
+		t.Fatalf("NewFileFeeds() = %v", err)
+	}
+	if len(feeds) != 1 || feeds[0].Calendar.Path != "/user/calendars/holidays/" {
+		t.Fatalf("NewFileFeeds() = %+v, want a single holidays feed", feeds)
+	}
+	feed := feeds[0]
+	ctx := context.Background()
+	if err := feed.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+
+	b := &FeedBackend{Backend: testBackend{}, Feeds: feeds}
+	objs, err := b.ListCalendarObjects(ctx, "/user/calendars/holidays/", nil)
+	if err != nil || len(objs) != 2 || objs[0].ModTime.IsZero() {
+		t.Fatalf("ListCalendarObjects() = %v, %v, want 2 objects", objs, err)
+	}
+
+	data := strings.Replace(testFeed, "SUMMARY:Christmas", "SUMMARY:Christmas Day", 1)
+	if err := ioutil.WriteFile(file, []byte(strings.ReplaceAll(data, "\n", "\r\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := feed.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	updated, err := b.ListCalendarObjects(ctx, "/user/calendars/holidays/", nil)
+	if err != nil || len(updated) != 2 {
+		t.Fatalf("ListCalendarObjects() = %v, %v, want 2 objects", updated, err)
+	}
+	if updated[0].ETag != objs[0].ETag || updated[1].ETag == objs[1].ETag {
+		t.Errorf("ETags after refresh = %q, %q, want only the second one to change", updated[0].ETag, updated[1].ETag)
+	}
+}
+
+func TestListing(t *testing.T) {
+	calendars := []Calendar{{Path: "/user/calendars/work/", Name: "Work"}}
+	objectMap := map[string][]CalendarObject{
+		"/user/calendars/work/": {{Path: "/user/calendars/work/meeting.ics", ContentLength: 42}},
+	}
+	handler := Handler{
+		Backend: testBackend{calendars: calendars, objectMap: objectMap},
+		Listing: &webdav.ListingOptions{},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/user/calendars/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="/user/calendars/work/"`) {
+		t.Errorf("GET home set = %v:\n%v", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/user/calendars/work/", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var listing webdav.Listing
+	if err := json.NewDecoder(w.Body).Decode(&listing); err != nil {
+		t.Fatalf("failed to decode listing: %v", err)
+	}
+	if len(listing.Entries) != 1 || listing.Entries[0].Path != "/user/calendars/work/meeting.ics" || listing.Entries[0].Size != 42 {
+		t.Errorf("listing entries = %+v", listing.Entries)
+	}
+
+	handler.Listing = nil
+	req = httptest.NewRequest(http.MethodGet, "/user/calendars/work/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Errorf("GET calendar without listing = %v", w.Code)
+	}
+}
+
+type noHomeSetBackend struct {
+	testBackend
+}
+
+func (noHomeSetBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return "", webdav.NewHTTPError(http.StatusNotFound, nil)
+}
+
+func TestDiscoverCalendars(t *testing.T) {
+	calendars := []Calendar{{Path: "/user/calendars/work/", Name: "Work"}}
+	ts := httptest.NewServer(&Handler{Backend: testBackend{calendars: calendars}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.DiscoverCalendars(context.Background())
+	if err != nil {
+		t.Fatalf("DiscoverCalendars() = %v", err)
+	}
+	if d.Principal != "/user/" || d.CalendarHomeSet != "/user/calendars/" || len(d.Calendars) != 1 || d.Calendars[0].Name != "Work" {
+		t.Errorf("DiscoverCalendars() = %+v", d)
+	}
+
+	ts = httptest.NewServer(&Handler{Backend: noHomeSetBackend{testBackend{calendars: calendars}}})
+	defer ts.Close()
+
+	c, err = NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = c.DiscoverCalendars(context.Background())
+	var discoveryErr *webdav.DiscoveryError
+	if !errors.As(err, &discoveryErr) || discoveryErr.Step != "calendar-home-set" {
+		t.Fatalf("DiscoverCalendars() = %v, want calendar-home-set discovery error", err)
+	}
+	if d.Principal != "/user/" {
+		t.Errorf("DiscoverCalendars() principal = %q, want %q", d.Principal, "/user/")
+	}
+}
+
+func TestDiscoverCalendars_otherHost(t *testing.T) {
+	calendars := []Calendar{{Path: "/user/calendars/work/", Name: "Work"}}
+	calServer := httptest.NewServer(&Handler{Backend: testBackend{calendars: calendars}})
+	defer calServer.Close()
+
+	// The principal is served by another host than the calendars
+	principalHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:response>
+    <d:href>%v</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:current-user-principal><d:href>/user/</d:href></d:current-user-principal>
+        <c:calendar-home-set><d:href>%v/user/calendars/</d:href></c:calendar-home-set>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`, r.URL.Path, calServer.URL)
+	})
+	ts := httptest.NewServer(principalHandler)
+	defer ts.Close()
+
+	d, err := DiscoverCalendars(context.Background(), nil, ts.URL, nil)
+	if err == nil {
+		t.Errorf("DiscoverCalendars() followed the home set to another host without AllowOtherHosts")
+	} else if d == nil || d.Principal != "/user/" {
+		t.Errorf("DiscoverCalendars() = %+v, want principal", d)
+	}
+
+	opts := &DiscoverOptions{AllowOtherHosts: true}
+	d, err = DiscoverCalendars(context.Background(), nil, ts.URL, opts)
+	if err != nil {
+		t.Fatalf("DiscoverCalendars() = %v", err)
+	}
+	if d.CalendarHomeSet != "/user/calendars/" || len(d.Calendars) != 1 || d.Calendars[0].Name != "Work" {
+		t.Errorf("DiscoverCalendars() = %+v", d)
+	}
+	if u := d.Client.ic.ResolveHref("/"); "http://"+u.Host != calServer.URL {
+		t.Errorf("DiscoverCalendars() client host = %v, want %v", u.Host, calServer.URL)
+	}
+
+	tlsServer := httptest.NewTLSServer(principalHandler)
+	defer tlsServer.Close()
+	if _, err := DiscoverCalendars(context.Background(), tlsServer.Client(), tlsServer.URL, opts); err == nil {
+		t.Errorf("DiscoverCalendars() downgraded from HTTPS to HTTP")
+	}
+}
+
+func TestQueryCalendarPartialError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:response>
+    <d:href>/user/calendars/work/good.ics</d:href>
+    <d:propstat>
+      <d:prop><c:calendar-data>%v</c:calendar-data></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/user/calendars/work/broken.ics</d:href>
+    <d:propstat>
+      <d:prop><c:calendar-data>BEGIN:VCALENDAR</c:calendar-data></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`, strings.ReplaceAll(testFeed, "\n", "\r\n"))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := c.QueryCalendar(context.Background(), "/user/calendars/work/", &CalendarQuery{})
+	var partialErr *webdav.PartialError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("QueryCalendar() = %v, want partial error", err)
+	}
+	if len(partialErr.Errors) != 1 || partialErr.Errors[0].Path != "/user/calendars/work/broken.ics" {
+		t.Fatalf("partial errors = %+v", partialErr.Errors)
+	}
+	if got := string(partialErr.Errors[0].Data); got != "BEGIN:VCALENDAR" {
+		t.Errorf("quarantined data = %q, want %q", got, "BEGIN:VCALENDAR")
+	}
+	if len(objs) != 1 || objs[0].Path != "/user/calendars/work/good.ics" {
+		t.Errorf("QueryCalendar() objects = %+v", objs)
+	}
+}
+
+type rawBackend struct {
+	testBackend
+	objects map[string][]byte
+}
+
+func (b rawBackend) GetCalendarObjectRaw(ctx context.Context, path string) (*RawCalendarObject, error) {
+	data, ok := b.objects[path]
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, nil)
+	}
+	return &RawCalendarObject{Path: path, ETag: "raw", Data: data}, nil
+}
+
+func (b rawBackend) PutCalendarObjectRaw(ctx context.Context, path string, obj *RawCalendarObject, opts *PutCalendarObjectOptions) (string, error) {
+	b.objects[path] = obj.Data
+	return path, nil
+}
+
+func TestRawBackend(t *testing.T) {
+	b := rawBackend{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(&Handler{Backend: b})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowercase parameter names would be normalized by a parse/serialize
+	// round-trip
+	data := strings.ReplaceAll(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:raw-1
+DTSTAMP:20200101T000000Z
+DTSTART;value=DATE:20200101
+SUMMARY:New Year
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n")
+	p := "/user/calendars/work/raw.ics"
+	if _, err := c.PutCalendarObjectRaw(context.Background(), p, []byte(data), ical.MIMEType); err != nil {
+		t.Fatalf("PutCalendarObjectRaw() = %v", err)
+	}
+	if got := string(b.objects[p]); got != data {
+		t.Errorf("stored data = %q, want %q", got, data)
+	}
+
+	raw, err := c.GetCalendarObjectRaw(context.Background(), p)
+	if err != nil {
+		t.Fatalf("GetCalendarObjectRaw() = %v", err)
+	}
+	if string(raw.Data) != data || raw.ETag != "raw" || raw.ContentType != ical.MIMEType {
+		t.Errorf("GetCalendarObjectRaw() = %+v", raw)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-14")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "BEGIN:VCALENDAR" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("GET with Range = %v %q, Accept-Ranges: %q", resp.StatusCode, body, resp.Header.Get("Accept-Ranges"))
+	}
+
+	if _, err := c.PutCalendarObjectRaw(context.Background(), p, []byte("BEGIN:VCALENDAR"), ical.MIMEType); err == nil {
+		t.Errorf("PutCalendarObjectRaw() with invalid data succeeded")
+	}
+}
+
+const testRecurringEvent = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:daily
+DTSTAMP:20200101T000000Z
+DTSTART:20200101T100000Z
+DTEND:20200101T110000Z
+RRULE:FREQ=DAILY;COUNT=5
+SUMMARY:Stand-up
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestQueryExpand(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(testRecurringEvent)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := queryBackend{testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/work/"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/work/": {{Path: "/user/calendars/work/daily.ics", Data: cal}},
+		},
+	}}
+	ts := httptest.NewServer(&Handler{Backend: backend})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := c.QueryCalendar(context.Background(), "/user/calendars/work/", &CalendarQuery{
+		CompRequest: CalendarCompRequest{
+			Name:     "VCALENDAR",
+			AllProps: true,
+			AllComps: true,
+			Expand: &CalendarExpandRequest{
+				Start: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2020, 1, 4, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryCalendar() = %v", err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("QueryCalendar() returned %v objects, want 1", len(objs))
+	}
+
+	var recurrenceIDs []string
+	for _, comp := range objs[0].Data.Children {
+		if comp.Props.Get(ical.PropRecurrenceRule) != nil {
+			t.Errorf("expanded instance has an RRULE")
+		}
+		recurrenceIDs = append(recurrenceIDs, comp.Props.Get(ical.PropRecurrenceID).Value)
+	}
+	want := []string{"20200102T100000Z", "20200103T100000Z"}
+	if !reflect.DeepEqual(recurrenceIDs, want) {
+		t.Errorf("expanded RECURRENCE-IDs = %v, want %v", recurrenceIDs, want)
+	}
+}
+
+func TestExpandMaxInstances(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(strings.Replace(testRecurringEvent, "FREQ=DAILY;COUNT=5", "FREQ=MINUTELY", 1))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+
+	_, err = expandCalendar(cal, start, end)
+	if httpErr, ok := err.(*internal.HTTPError); !ok || httpErr.Code != http.StatusConflict || !strings.Contains(err.Error(), string(PreconditionMaxInstances)) {
+		t.Errorf("expandCalendar() = %v, want max-instances precondition error", err)
+	}
+
+}
+
+func TestPartialCalendarData(t *testing.T) {
+	alarm := ical.NewComponent(ical.CompAlarm)
+	alarm.Props.SetText(ical.PropAction, "DISPLAY")
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "5e8f2a1c-3b4d-4e6f-8a9b-0c1d2e3f4a5b")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	event.Props.SetText(ical.PropSummary, "Meeting")
+	event.Props.SetText(ical.PropLocation, "Office")
+	event.Children = []*ical.Component{alarm}
+	todo := ical.NewComponent(ical.CompToDo)
+	todo.Props.SetText(ical.PropUID, "5e8f2a1c-3b4d-4e6f-8a9b-0c1d2e3f4a5c")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Props.SetText(ical.PropCalendarScale, "GREGORIAN")
+	cal.Children = []*ical.Component{event.Component, todo}
+
+	calendar := Calendar{Path: "/user/calendars/a"}
+	object := CalendarObject{Path: "/user/calendars/a/event.ics", Data: cal}
+	ts := httptest.NewServer(&Handler{Backend: testBackend{
+		calendars: []Calendar{calendar},
+		objectMap: map[string][]CalendarObject{calendar.Path: {object}},
+	}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := c.MultiGetCalendar(context.Background(), calendar.Path, &CalendarMultiGet{
+		Paths: []string{object.Path},
+		CompRequest: CalendarCompRequest{
+			Name: ical.CompCalendar,
+			Comps: []CalendarCompRequest{{
+				Name:  ical.CompEvent,
+				Props: []string{"UID", "SUMMARY"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("MultiGetCalendar() = %v", err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("MultiGetCalendar() returned %v objects, want 1", len(objs))
+	}
+
+	got := objs[0].Data
+	if got.Props.Get(ical.PropCalendarScale) != nil || got.Props.Get(ical.PropVersion) == nil {
+		t.Errorf("calendar properties not pruned: %v", got.Props)
+	}
+	if len(got.Children) != 1 || got.Children[0].Name != ical.CompEvent {
+		t.Fatalf("calendar components not pruned: %v", got.Children)
+	}
+	comp := got.Children[0]
+	// DTSTAMP is required, and kept so that the event remains valid
+	if len(comp.Props) != 3 || comp.Props.Get(ical.PropSummary) == nil || comp.Props.Get(ical.PropUID) == nil || comp.Props.Get(ical.PropDateTimeStamp) == nil {
+		t.Errorf("event properties not pruned: %v", comp.Props)
+	}
+	if len(comp.Children) != 0 {
+		t.Errorf("event components not pruned: %v", comp.Children)
+	}
+	if len(cal.Children[0].Props) != 4 {
+		t.Errorf("stored calendar object was modified")
+	}
+}
+
+const freeBusyQueryRequest = `<?xml version="1.0" encoding="utf-8"?>
+<c:free-busy-query xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <c:time-range start="20200102T000000Z" end="20200104T000000Z"/>
+</c:free-busy-query>`
+
+func TestFreeBusyQuery(t *testing.T) {
+	recurring, err := ical.NewDecoder(strings.NewReader(testRecurringEvent)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cal, err := ical.NewDecoder(strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:tentative
+DTSTAMP:20200101T000000Z
+DTSTART:20200102T120000Z
+DTEND:20200102T130000Z
+STATUS:TENTATIVE
+END:VEVENT
+BEGIN:VEVENT
+UID:transparent
+DTSTAMP:20200101T000000Z
+DTSTART:20200102T140000Z
+DTEND:20200102T150000Z
+TRANSP:TRANSPARENT
+END:VEVENT
+END:VCALENDAR
+`)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Handler{Backend: queryBackend{testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/work/"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/work/": {
+				{Path: "/user/calendars/work/daily.ics", Data: recurring},
+				{Path: "/user/calendars/work/other.ics", Data: cal},
+			},
+		},
+	}}}
+
+	req := httptest.NewRequest("REPORT", "/user/calendars/work/", strings.NewReader(freeBusyQueryRequest))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("REPORT free-busy-query = %v", res.Status)
+	}
+	fb, err := ical.NewDecoder(res.Body).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prop := range fb.Children[0].Props[ical.PropFreeBusy] {
+		got = append(got, prop.Params.Get(ical.ParamFreeBusyType)+" "+prop.Value)
+	}
+	want := []string{
+		"BUSY 20200102T100000Z/20200102T110000Z",
+		"BUSY 20200103T100000Z/20200103T110000Z",
+		"BUSY-TENTATIVE 20200102T120000Z/20200102T130000Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FREEBUSY = %v, want %v", got, want)
+	}
+}
+
+type schedulingBackend struct {
+	testBackend
+	delivered []SchedulingMessage
+}
+
+func (b *schedulingBackend) GetCalendarObject(ctx context.Context, path string, req *CalendarCompRequest) (*CalendarObject, error) {
+	co, err := b.testBackend.GetCalendarObject(ctx, path, req)
+	if err != nil {
+		return nil, &internal.HTTPError{Code: http.StatusNotFound, Err: err}
+	}
+	return co, nil
+}
+
+func (b *schedulingBackend) ScheduleInboxPath(ctx context.Context) (string, error) {
+	return "/user/calendars/inbox/", nil
+}
+
+func (b *schedulingBackend) ScheduleOutboxPath(ctx context.Context) (string, error) {
+	return "/user/calendars/outbox/", nil
+}
+
+func (b *schedulingBackend) CalendarUserAddresses(ctx context.Context) ([]string, error) {
+	return []string{"mailto:alice@example.org"}, nil
+}
+
+func (b *schedulingBackend) DeliverSchedulingMessage(ctx context.Context, msg *SchedulingMessage) error {
+	b.delivered = append(b.delivered, *msg)
+	return nil
+}
+
+func (b *schedulingBackend) QueryFreeBusy(ctx context.Context, calendarUser string, start, end time.Time) ([]CalendarObject, error) {
+	if calendarUser != "mailto:bob@example.org" {
+		return nil, &internal.HTTPError{Code: http.StatusNotFound}
+	}
+	return b.objectMap["/user/calendars/work/"], nil
+}
+
+const testInvitation = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:meeting
+DTSTAMP:20200101T000000Z
+DTSTART:20200102T100000Z
+DTEND:20200102T110000Z
+ORGANIZER:mailto:alice@example.org
+ATTENDEE;PARTSTAT=ACCEPTED:mailto:alice@example.org
+ATTENDEE;PARTSTAT=NEEDS-ACTION:mailto:bob@example.org
+END:VEVENT
+END:VCALENDAR
+`
+
+const testFreeBusyRequest = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+METHOD:REQUEST
+BEGIN:VFREEBUSY
+UID:fb-request
+DTSTAMP:20200101T000000Z
+DTSTART:20200102T000000Z
+DTEND:20200104T000000Z
+ORGANIZER:mailto:alice@example.org
+ATTENDEE:mailto:bob@example.org
+ATTENDEE:mailto:carol@example.org
+END:VFREEBUSY
+END:VCALENDAR
+`
+
+func TestScheduling(t *testing.T) {
+	recurring, err := ical.NewDecoder(strings.NewReader(testRecurringEvent)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &schedulingBackend{testBackend: testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/work/"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/work/": {{Path: "/user/calendars/work/daily.ics", Data: recurring}},
+		},
+	}}
+	handler := Handler{Backend: backend}
+
+	// Creating an event with attendees sends invitations
+	req := httptest.NewRequest(http.MethodPut, "/user/calendars/work/meeting.ics", strings.NewReader(strings.ReplaceAll(testInvitation, "\n", "\r\n")))
+	req.Header.Set("Content-Type", ical.MIMEType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code/100 != 2 {
+		t.Fatalf("PUT = %v: %v", w.Code, w.Body.String())
+	}
+	if len(backend.delivered) != 1 {
+		t.Fatalf("delivered %v messages, want 1", len(backend.delivered))
+	}
+	if msg := backend.delivered[0]; msg.Method != SchedulingMethodRequest || msg.Recipient != "mailto:bob@example.org" {
+		t.Errorf("delivered %v message to %v, want REQUEST to bob", msg.Method, msg.Recipient)
+	}
+
+	// Free/busy requests are answered for each recipient
+	req = httptest.NewRequest(http.MethodPost, "/user/calendars/outbox/", strings.NewReader(strings.ReplaceAll(testFreeBusyRequest, "\n", "\r\n")))
+	req.Header.Set("Content-Type", ical.MIMEType)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST outbox = %v: %v", w.Code, w.Body.String())
+	}
+	var resp scheduleResponse
+	if err := xml.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Responses) != 2 {
+		t.Fatalf("schedule-response has %v entries, want 2", len(resp.Responses))
+	}
+	if bob := resp.Responses[0]; bob.RequestStatus != "2.0;Success" || bob.CalendarData == nil || !strings.Contains(string(bob.CalendarData.Data), "20200103T100000Z/20200103T110000Z") {
+		t.Errorf("free/busy response for bob = %+v", bob)
+	}
+	if carol := resp.Responses[1]; !strings.HasPrefix(carol.RequestStatus, "3.7;") {
+		t.Errorf("free/busy request status for carol = %q, want 3.7", carol.RequestStatus)
+	}
+
+	req = httptest.NewRequest("PROPFIND", "/user/", strings.NewReader(`<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><c:schedule-inbox-URL/></d:prop>
+</d:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "/user/calendars/inbox/") {
+		t.Errorf("principal PROPFIND doesn't list the scheduling inbox:\n%v", w.Body.String())
+	}
+}
+
+func TestSchedulingMessages(t *testing.T) {
+	parse := func(s string) *ical.Calendar {
+		cal, err := ical.NewDecoder(strings.NewReader(strings.ReplaceAll(s, "\n", "\r\n"))).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cal
+	}
+	prev := parse(strings.Replace(testInvitation, "END:VEVENT", "ATTENDEE:mailto:carol@example.org\nEND:VEVENT", 1))
+	cur := parse(testInvitation)
+
+	// The organizer removes an attendee
+	msgs := schedulingMessages([]string{"mailto:alice@example.org"}, prev, cur)
+	if len(msgs) != 2 || msgs[0].Method != SchedulingMethodRequest || msgs[1].Method != SchedulingMethodCancel || msgs[1].Recipient != "mailto:carol@example.org" {
+		t.Errorf("organizer messages = %+v", msgs)
+	}
+
+	// An attendee accepts the invitation
+	accepted := parse(strings.Replace(testInvitation, "PARTSTAT=NEEDS-ACTION", "PARTSTAT=ACCEPTED", 1))
+	msgs = schedulingMessages([]string{"mailto:bob@example.org"}, cur, accepted)
+	if len(msgs) != 1 || msgs[0].Method != SchedulingMethodReply || msgs[0].Recipient != "mailto:alice@example.org" {
+		t.Fatalf("attendee messages = %+v", msgs)
+	}
+	if attendees := msgs[0].Data.Children[0].Props[ical.PropAttendee]; len(attendees) != 1 || attendees[0].Value != "mailto:bob@example.org" {
+		t.Errorf("reply attendees = %+v", attendees)
+	}
+}
+
+type syncBackend struct {
+	testBackend
+}
+
+func (syncBackend) CalendarSyncToken(ctx context.Context, path string) (string, error) {
+	return "t1", nil
+}
+
+func (syncBackend) CalendarChanges(ctx context.Context, path, syncToken string) (*webdav.SyncChanges, error) {
+	if syncToken != "" {
+		return nil, webdav.ErrInvalidSyncToken
+	}
+	return &webdav.SyncChanges{
+		SyncToken: "t1",
+		Added:     []string{"/user/calendars/a/event.ics"},
+		Deleted:   []string{"/user/calendars/a/removed.ics"},
+	}, nil
+}
+
+func TestSyncCollection(t *testing.T) {
+	cal, err := ical.NewDecoder(strings.NewReader(testRecurringEvent)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calendars := []Calendar{{Path: "/user/calendars/a"}}
+	objects := map[string][]CalendarObject{
+		"/user/calendars/a": {{Path: "/user/calendars/a/event.ics", ETag: "1", Data: cal}},
+	}
+	h := Handler{Backend: syncBackend{testBackend{calendars: calendars, objectMap: objects}}}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	resp, err := c.SyncCollection(ctx, "/user/calendars/a", &SyncQuery{})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	}
+	if resp.SyncToken != "t1" || len(resp.Updated) != 1 || resp.Updated[0].Path != "/user/calendars/a/event.ics" || resp.Updated[0].ETag != "1" {
+		t.Errorf("SyncCollection() = %+v", resp)
+	}
+	if !reflect.DeepEqual(resp.Deleted, []string{"/user/calendars/a/removed.ics"}) {
+		t.Errorf("SyncCollection() deleted = %v", resp.Deleted)
+	}
+
+	resp, err = c.SyncCollection(ctx, "/user/calendars/a", &SyncQuery{
+		CompRequest: CalendarCompRequest{Name: ical.CompCalendar, AllProps: true, AllComps: true},
+	})
+	if err != nil {
+		t.Fatalf("SyncCollection() with calendar data = %v", err)
+	}
+	if len(resp.Updated) != 1 || resp.Updated[0].Data == nil || len(resp.Updated[0].Data.Events()) != 1 {
+		t.Errorf("SyncCollection() with calendar data = %+v", resp)
+	}
+
+	if _, err := c.SyncCollection(ctx, "/user/calendars/a", &SyncQuery{SyncToken: "t0"}); err == nil {
+		t.Errorf("SyncCollection() with invalid token succeeded")
+	}
+}
+
+type deadPropBackend struct {
+	testBackend
+	props map[xml.Name]string
+}
+
+func (b *deadPropBackend) GetDeadProperties(ctx context.Context, path string) (map[xml.Name]string, error) {
+	return b.props, nil
+}
+
+func (b *deadPropBackend) SetDeadProperties(ctx context.Context, path string, props map[xml.Name]string) error {
+	for k, v := range props {
+		b.props[k] = v
+	}
+	return nil
+}
+
+func (b *deadPropBackend) RemoveDeadProperties(ctx context.Context, path string, names []xml.Name) error {
+	for _, k := range names {
+		delete(b.props, k)
+	}
+	return nil
+}
+
+func TestPropPatchDeadProperties(t *testing.T) {
+	calendars := []Calendar{{Path: "/user/calendars/a", Name: "Old name", Description: "Old description"}}
+	b := &deadPropBackend{testBackend{calendars: calendars}, make(map[xml.Name]string)}
+	h := Handler{Backend: b}
+
+	req := httptest.NewRequest("PROPPATCH", "/user/calendars/a", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:A="http://apple.com/ns/ical/">
+	<D:set><D:prop>
+		<A:calendar-color>#FF0000</A:calendar-color>
+		<D:displayname>New name</D:displayname>
+		<C:calendar-description>New description</C:calendar-description>
+	</D:prop></D:set>
+</D:propertyupdate>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPPATCH: expected status 207, got %v: %v", w.Code, w.Body.String())
+	}
+	colorName := xml.Name{"http://apple.com/ns/ical/", "calendar-color"}
+	if v := b.props[colorName]; v != "#FF0000" {
+		t.Errorf("stored property = %q, want %q", v, "#FF0000")
+	}
+
+	req = httptest.NewRequest("PROPFIND", "/user/calendars/a", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:A="http://apple.com/ns/ical/">
+	<D:prop><A:calendar-color/><D:displayname/><C:calendar-description/></D:prop>
+</D:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	for _, v := range []string{"#FF0000", "New name", "New description"} {
+		if !strings.Contains(w.Body.String(), v) {
+			t.Errorf("PROPFIND: patched property %q missing from response: %v", v, w.Body.String())
+		}
+	}
+
+	req = httptest.NewRequest("PROPPATCH", "/user/calendars/a", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:">
+	<D:set><D:prop><D:getetag>"forged"</D:getetag></D:prop></D:set>
+</D:propertyupdate>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "403") || b.props[internal.GetETagName] != "" {
+		t.Errorf("PROPPATCH of a live property: %v", w.Body.String())
+	}
+}
+
+type storeBackend struct {
+	testBackend
+	objects map[string]*ical.Calendar
+}
+
+func (b *storeBackend) GetCalendarObject(ctx context.Context, path string, req *CalendarCompRequest) (*CalendarObject, error) {
+	cal, ok := b.objects[path]
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, nil)
+	}
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return nil, err
+	}
+	return &CalendarObject{Path: path, ETag: fmt.Sprintf("%x", sha1.Sum(buf.Bytes())), Data: cal}, nil
+}
+
+func (b *storeBackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *PutCalendarObjectOptions) (string, error) {
+	b.objects[path] = calendar
+	return path, nil
+}
+
+func TestPutDryRun(t *testing.T) {
+	data := strings.ReplaceAll(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:dry-run-1
+DTSTAMP:20200101T000000Z
+SUMMARY:Dry run
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n")
+	const p = "/user/calendars/a/event.ics"
+	put := func(h http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(data))
+		req.Header.Set("Content-Type", ical.MIMEType)
+		req.Header.Set("Prefer", "dry-run")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	mb := NewMemBackend("/user/", "/user/calendars/")
+	if err := mb.CreateCalendar(context.Background(), Calendar{Path: "/user/calendars/a/"}); err != nil {
+		t.Fatal(err)
+	}
+	w := put(&Handler{Backend: mb})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("PUT = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Preference-Applied"); got != "dry-run" {
+		t.Errorf("Preference-Applied = %q, want %q", got, "dry-run")
+	}
+	if _, err := mb.GetCalendarObject(context.Background(), p, nil); err == nil {
+		t.Errorf("dry-run PUT stored the object")
+	}
+
+	// Backends which don't support dry-run get a regular PUT
+	sb := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}},
+		objects:     make(map[string]*ical.Calendar),
+	}
+	w = put(&Handler{Backend: sb})
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if got := w.Header().Get("Preference-Applied"); got != "" {
+		t.Errorf("Preference-Applied = %q, want none", got)
+	}
+	if _, ok := sb.objects[p]; !ok {
+		t.Errorf("PUT didn't store the object")
+	}
+}
+
+func TestPutETag(t *testing.T) {
+	data := strings.ReplaceAll(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:etag-1
+DTSTAMP:20200101T000000Z
+SUMMARY:Stored verbatim
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n")
+	const p = "/user/calendars/a/event.ics"
+
+	mb := NewMemBackend("/user/", "/user/calendars/")
+	if err := mb.CreateCalendar(context.Background(), Calendar{Path: "/user/calendars/a/"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(data))
+	req.Header.Set("Content-Type", ical.MIMEType)
+	w := httptest.NewRecorder()
+	(&Handler{Backend: mb}).ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %v, want %v", w.Code, http.StatusCreated)
+	}
+
+	co, err := mb.GetCalendarObject(context.Background(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Header().Get("ETag"), internal.ETag(co.ETag).String(); got != want {
+		t.Errorf("ETag = %q, want %q", got, want)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	b := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}},
+		objects:     make(map[string]*ical.Calendar),
+	}
+	var gotPath string
+	h := Handler{Backend: b, Transforms: []TransformFunc{
+		StripExtendedProperties,
+		DefaultSequence,
+		func(ctx context.Context, calendarPath string, cal *ical.Calendar) error {
+			gotPath = calendarPath
+			return nil
+		},
+	}}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "6b3d9a2e-0c6f-4f1e-9b8a-1d2c3e4f5a6b")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	event.Props.SetText("X-CLIENT-STATE", "private")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Props.SetText("X-WR-CALNAME", "Work")
+	cal.Children = []*ical.Component{event.Component}
+
+	const p = "/user/calendars/a/event.ics"
+	co, err := c.PutCalendarObject(context.Background(), p, cal)
+	if err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	}
+
+	if gotPath != "/user/calendars/a" {
+		t.Errorf("transform got calendar path %q, want %q", gotPath, "/user/calendars/a")
+	}
+	stored, ok := b.objects[p]
+	if !ok {
+		t.Fatalf("object wasn't stored")
+	}
+	if stored.Props.Get("X-WR-CALNAME") != nil || stored.Children[0].Props.Get("X-CLIENT-STATE") != nil {
+		t.Errorf("extended properties weren't stripped")
+	}
+	if prop := stored.Children[0].Props.Get(ical.PropSequence); prop == nil || prop.Value != "0" {
+		t.Errorf("SEQUENCE = %v, want 0", prop)
+	}
+
+	// The stored object differs from the request body, so the server must
+	// not send its ETag
+	if co.ETag != "" {
+		t.Errorf("PUT returned ETag %q for a transformed object", co.ETag)
+	}
+}
+
+func TestPutMaxResourceSize(t *testing.T) {
+	b := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a", MaxResourceSize: 64}}},
+		objects:     make(map[string]*ical.Calendar),
+	}
+	h := Handler{Backend: b}
+
+	const p = "/user/calendars/a/event.ics"
+	for _, contentLength := range []int64{int64(len(testRecurringEvent)), -1} {
+		req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(testRecurringEvent))
+		req.Header.Set("Content-Type", ical.MIMEType)
+		req.ContentLength = contentLength
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "max-resource-size") {
+			t.Errorf("PUT with Content-Length %v: expected max-resource-size error, got %v: %v", contentLength, w.Code, w.Body.String())
+		}
+	}
+	if len(b.objects) != 0 {
+		t.Errorf("oversized calendar object has been stored")
+	}
+}
+
+func TestPutSupportedCalendarData(t *testing.T) {
+	b := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{
+			{Path: "/user/calendars/a/"},
+			{Path: "/user/calendars/b/", SupportedCalendarData: []CalendarDataType{{"text/calendar", "3.0"}}},
+		}},
+		objects: make(map[string]*ical.Calendar),
+	}
+	h := Handler{Backend: b}
+
+	for _, tc := range []struct {
+		path, contentType string
+		ok                bool
+	}{
+		{"/user/calendars/a/event.ics", "text/calendar; charset=utf-8", true},
+		{"/user/calendars/a/event.ics", "text/calendar; version=3.0", false},
+		{"/user/calendars/a/event.ics", "application/calendar+json", false},
+		{"/user/calendars/b/event.ics", "text/calendar", false},
+	} {
+		req := httptest.NewRequest(http.MethodPut, tc.path, strings.NewReader(testRecurringEvent))
+		req.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if tc.ok && w.Code/100 != 2 {
+			t.Errorf("PUT %v with %q = %v: %v", tc.path, tc.contentType, w.Code, w.Body.String())
+		} else if !tc.ok && !strings.Contains(w.Body.String(), "supported-calendar-data") {
+			t.Errorf("PUT %v with %q: expected supported-calendar-data error, got %v: %v", tc.path, tc.contentType, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAssignUID(t *testing.T) {
+	b := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}},
+		objects:     make(map[string]*ical.Calendar),
+	}
+	h := Handler{Backend: b, Transforms: []TransformFunc{AssignUID}}
+
+	const p = "/user/calendars/a/event.ics"
+	req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+DTSTAMP:20200101T000000Z
+DTSTART:20200101T100000Z
+SUMMARY:No UID
+END:VEVENT
+END:VCALENDAR
+`))
+	req.Header.Set("Content-Type", ical.MIMEType)
+	req.Header.Set("Prefer", "return=representation")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: expected status 201, got %v: %v", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Preference-Applied"); got != "return=representation" {
+		t.Errorf("Preference-Applied = %q, want %q", got, "return=representation")
+	}
+
+	prop := b.objects[p].Children[0].Props.Get(ical.PropUID)
+	if prop == nil || prop.Value == "" {
+		t.Fatalf("UID wasn't assigned")
+	}
+	if !strings.Contains(w.Body.String(), "UID:"+prop.Value) {
+		t.Errorf("PUT response doesn't contain the assigned UID %q:\n%v", prop.Value, w.Body.String())
+	}
+}
+
+type createCalendarBackend struct {
+	testBackend
+	created []Calendar
+}
+
+func (b *createCalendarBackend) CreateCalendar(ctx context.Context, calendar Calendar) error {
+	b.created = append(b.created, calendar)
+	return nil
+}
+
+func TestMkcalendar(t *testing.T) {
+	b := &createCalendarBackend{testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}}}
+	h := Handler{Backend: b}
+
+	req := httptest.NewRequest("MKCALENDAR", "/user/calendars/b", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+	<D:set><D:prop>
+		<D:displayname>Tasks</D:displayname>
+		<C:calendar-description>Things to do</C:calendar-description>
+		<C:supported-calendar-component-set><C:comp name="VTODO"/></C:supported-calendar-component-set>
+	</D:prop></D:set>
+</C:mkcalendar>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MKCALENDAR: expected status 201, got %v: %v", w.Code, w.Body.String())
+	}
+	want := Calendar{
+		Path:                  "/user/calendars/b",
+		Name:                  "Tasks",
+		Description:           "Things to do",
+		SupportedComponentSet: []string{"VTODO"},
+	}
+	if len(b.created) != 1 || !reflect.DeepEqual(b.created[0], want) {
+		t.Errorf("MKCALENDAR created %+v, want %+v", b.created, want)
+	}
+
+	req = httptest.NewRequest("MKCOL", "/user/calendars/c", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:mkcol xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+	<D:set><D:prop>
+		<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>
+		<D:displayname>Work</D:displayname>
+	</D:prop></D:set>
+</D:mkcol>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: expected status 201, got %v: %v", w.Code, w.Body.String())
+	}
+	if len(b.created) != 2 || b.created[1].Path != "/user/calendars/c" || b.created[1].Name != "Work" {
+		t.Errorf("MKCOL created %+v", b.created)
+	}
+
+	for _, p := range []string{"/user/calendars/a", "/user/calendars/a/b"} {
+		req = httptest.NewRequest("MKCALENDAR", p, nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code/100 != 4 {
+			t.Errorf("MKCALENDAR %v: expected client error, got %v", p, w.Code)
+		}
+	}
+	if len(b.created) != 2 {
+		t.Errorf("MKCALENDAR created %+v", b.created)
+	}
+
+	// Unknown properties are reported
+	req = httptest.NewRequest("MKCALENDAR", "/user/calendars/e", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:X="urn:example">
+	<D:set><D:prop>
+		<D:displayname>Tasks</D:displayname>
+		<X:unknown>x</X:unknown>
+	</D:prop></D:set>
+</C:mkcalendar>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("MKCALENDAR with unknown property: expected status 403, got %v", w.Code)
+	}
+	var resp struct {
+		XMLName   xml.Name            `xml:"urn:ietf:params:xml:ns:caldav mkcalendar-response"`
+		PropStats []internal.PropStat `xml:"DAV: propstat"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("MKCALENDAR with unknown property: %v: %v", err, w.Body.String())
+	}
+	if len(resp.PropStats) != 2 || resp.PropStats[0].Status.Code != http.StatusForbidden || resp.PropStats[0].Prop.Get(xml.Name{"urn:example", "unknown"}) == nil || resp.PropStats[1].Status.Code != http.StatusFailedDependency {
+		t.Errorf("MKCALENDAR with unknown property: unexpected response: %v", w.Body.String())
+	}
+	if len(b.created) != 2 {
+		t.Errorf("MKCALENDAR with unknown property created %+v", b.created)
+	}
+
+	// Backends which don't implement CalendarCreator
+	for _, backend := range []Backend{b.testBackend, &FeedBackend{Backend: b.testBackend}} {
+		h = Handler{Backend: backend}
+		for _, method := range []string{"MKCALENDAR", "MKCOL"} {
+			req = httptest.NewRequest(method, "/user/calendars/d", nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%v with %T without CalendarCreator: expected status 405, got %v", method, backend, w.Code)
+			}
+		}
+
+		req = httptest.NewRequest(http.MethodOptions, "/user/calendars/", nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if strings.Contains(w.Header().Get("Allow"), "MKCALENDAR") {
+			t.Errorf("OPTIONS with %T without CalendarCreator allows MKCALENDAR", backend)
+		}
+	}
+}
+
+func TestMaintainSequence(t *testing.T) {
+	b := &storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}},
+		objects:     make(map[string]*ical.Calendar),
+	}
+	h := Handler{Backend: b, MaintainSequence: true}
+
+	const p = "/user/calendars/a/event.ics"
+	put := func(summary, dtstart string) *ical.Component {
+		req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN
+BEGIN:VEVENT
+UID:7d4c2b1a-9e8f-4a3b-8c7d-6e5f4a3b2c1d
+DTSTAMP:20200101T000000Z
+DTSTART:`+dtstart+`
+SUMMARY:`+summary+`
+END:VEVENT
+END:VCALENDAR
+`))
+		req.Header.Set("Content-Type", ical.MIMEType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("PUT: expected status 201, got %v: %v", w.Code, w.Body.String())
+		}
+		return b.objects[p].Children[0]
+	}
+
+	event := put("Meeting", "20200101T100000Z")
+	if prop := event.Props.Get(ical.PropDateTimeStamp); prop == nil || prop.Value == "20200101T000000Z" {
+		t.Errorf("DTSTAMP of new event wasn't refreshed: %v", prop)
+	}
+	if event.Props.Get(ical.PropLastModified) == nil {
+		t.Errorf("LAST-MODIFIED of new event wasn't set")
+	}
+	if event.Props.Get(ical.PropSequence) != nil {
+		t.Errorf("SEQUENCE of new event was set")
+	}
+
+	event = put("Meeting", "20200101T100000Z")
+	if prop := event.Props.Get(ical.PropSequence); prop != nil {
+		t.Errorf("SEQUENCE of unchanged event = %v, want none", prop.Value)
+	}
+
+	event = put("Renamed meeting", "20200101T100000Z")
+	if prop := event.Props.Get(ical.PropSequence); prop != nil {
+		t.Errorf("SEQUENCE of event with a new summary = %v, want none", prop.Value)
+	}
+	if prop := event.Props.Get(ical.PropDateTimeStamp); prop == nil || prop.Value == "20200101T000000Z" {
+		t.Errorf("DTSTAMP of event with a new summary wasn't refreshed: %v", prop)
+	}
+
+	event = put("Renamed meeting", "20200102T100000Z")
+	if prop := event.Props.Get(ical.PropSequence); prop == nil || prop.Value != "1" {
+		t.Errorf("SEQUENCE of rescheduled event = %v, want 1", prop)
+	}
+}
+
+func TestClientManageCalendars(t *testing.T) {
+	b := &createCalendarBackend{testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a"}}}}
+	ts := httptest.NewServer(&Handler{Backend: b})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Calendar{
+		Path:                  "/user/calendars/b",
+		Name:                  "Tasks",
+		Description:           "Things to do",
+		SupportedComponentSet: []string{"VTODO"},
+		Color:                 "#FF8000",
+		Order:                 2,
+	}
+	if err := c.CreateCalendar(context.Background(), &want); err != nil {
+		t.Fatalf("CreateCalendar() = %v", err)
+	}
+	if len(b.created) != 1 || !reflect.DeepEqual(b.created[0], want) {
+		t.Errorf("CreateCalendar() created %+v, want %+v", b.created, want)
+	}
+	if err := c.CreateCalendar(context.Background(), &Calendar{Path: "/user/calendars/a"}); err == nil {
+		t.Errorf("CreateCalendar() on existing calendar succeeded")
+	}
+
+	db := &deadPropBackend{testBackend{calendars: b.calendars}, make(map[xml.Name]string)}
+	ts.Config.Handler = &Handler{Backend: db}
+	color := "#00FF00"
+	if err := c.UpdateCalendar(context.Background(), "/user/calendars/a", &CalendarUpdate{Color: &color}); err != nil {
+		t.Fatalf("UpdateCalendar() = %v", err)
+	}
+	if v := db.props[xml.Name{"http://apple.com/ns/ical/", "calendar-color"}]; v != color {
+		t.Errorf("calendar-color = %q, want %q", v, color)
+	}
+	name := "Renamed"
+	if err := c.UpdateCalendar(context.Background(), "/user/calendars/a", &CalendarUpdate{Name: &name}); err != nil {
+		t.Fatalf("UpdateCalendar() = %v", err)
+	}
+	cals, err := c.FindCalendars(context.Background(), "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	}
+	if len(cals) != 1 || cals[0].Name != name || cals[0].Color != color {
+		t.Errorf("FindCalendars() after UpdateCalendar() = %+v", cals)
+	}
+}
+
+type timezoneBackend struct {
+	testBackend
+	tzid string
+}
+
+func (b *timezoneBackend) DefaultTimezone(ctx context.Context) (string, error) {
+	return b.tzid, nil
+}
+
+func (b *timezoneBackend) SetDefaultTimezone(ctx context.Context, tzid string) error {
+	b.tzid = tzid
+	return nil
+}
+
+func (b *timezoneBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
+	return Filter(query, b.objectMap[path])
+}
+
+func TestDefaultTimezone(t *testing.T) {
+	if _, err := time.LoadLocation("Europe/Paris"); err != nil {
+		t.Skip(err)
+	}
+
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "c6d3b1a4-7f0e-4a8e-9a52-3e0c1b9f6d21")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now())
+	// Floating times
+	event.Props.Set(&ical.Prop{Name: ical.PropDateTimeStart, Params: make(ical.Params), Value: "20240101T230000"})
+	event.Props.Set(&ical.Prop{Name: ical.PropDateTimeEnd, Params: make(ical.Params), Value: "20240101T233000"})
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, event.Component)
+
+	b := &timezoneBackend{testBackend: testBackend{
+		calendars: []Calendar{{Path: "/user/calendars/a"}},
+		objectMap: map[string][]CalendarObject{
+			"/user/calendars/a": {{Path: "/user/calendars/a/1.ics", Data: cal}},
+		},
+	}}
+	h := Handler{Backend: b}
+
+	query := func() string {
+		req := httptest.NewRequest("REPORT", "/user/calendars/a", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+	<D:prop><D:getetag/></D:prop>
+	<C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+		<C:time-range start="20240101T214500Z" end="20240101T221500Z"/>
+	</C:comp-filter></C:comp-filter></C:filter>
+</C:calendar-query>`))
+		req.Header.Set("Content-Type", "application/xml")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	if body := query(); strings.Contains(body, "1.ics") {
+		t.Errorf("floating event matched in UTC: %v", body)
+	}
+
+	req := httptest.NewRequest("PROPPATCH", "/user/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+	<D:set><D:prop><C:calendar-timezone-id>Europe/Paris</C:calendar-timezone-id></D:prop></D:set>
+</D:propertyupdate>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus || b.tzid != "Europe/Paris" {
+		t.Fatalf("PROPPATCH: got status %v and TZID %q: %v", w.Code, b.tzid, w.Body.String())
+	}
+
+	req = httptest.NewRequest("PROPFIND", "/user/calendars/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><C:calendar-timezone-id/></D:prop></D:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "Europe/Paris") {
+		t.Errorf("PROPFIND: default timezone missing from response: %v", w.Body.String())
+	}
+
+	if body := query(); !strings.Contains(body, "1.ics") {
+		t.Errorf("floating event didn't match in default timezone: %v", body)
+	}
+
+	req = httptest.NewRequest("PROPPATCH", "/user/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+	<D:set><D:prop><C:calendar-timezone-id>Nowhere/Special</C:calendar-timezone-id></D:prop></D:set>
+</D:propertyupdate>`))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if b.tzid != "Europe/Paris" {
+		t.Errorf("PROPPATCH: invalid TZID %q was stored", b.tzid)
+	}
+}
+
+func TestFindCalendarsDisplayProps(t *testing.T) {
+	tz := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Example//EN\r\nBEGIN:VTIMEZONE\r\nTZID:Europe/Paris\r\nEND:VTIMEZONE\r\nEND:VCALENDAR\r\n"
+	want := []Calendar{
+		{Path: "/user/calendars/a/", Name: "Home", Color: "#FF0000FF", Order: 1, Timezone: tz},
+		{Path: "/user/calendars/b/", Name: "Work"},
+	}
+	ts := httptest.NewServer(&Handler{Backend: testBackend{calendars: want}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cals, err := c.FindCalendars(context.Background(), "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	}
+	for i := range cals {
+		cals[i].SupportedComponentSet = nil
+		cals[i].SupportedCalendarData = nil
+	}
+	if !reflect.DeepEqual(cals, want) {
+		t.Errorf("FindCalendars() = %+v, want %+v", cals, want)
+	}
+}
+
+type transactionBackend struct {
+	storeBackend
+}
+
+func (b *transactionBackend) ApplyTransaction(ctx context.Context, ops []TransactionOp) error {
+	objects := make(map[string]*ical.Calendar)
+	for k, v := range b.objects {
+		objects[k] = v
+	}
+	for _, op := range ops {
+		if op.IfMatch.IsSet() {
+			co, err := b.GetCalendarObject(ctx, op.Path, nil)
+			if err != nil {
+				return err
+			}
+			if etag, _ := op.IfMatch.ETag(); etag != co.ETag {
+				return webdav.NewHTTPError(http.StatusPreconditionFailed, nil)
+			}
+		}
+		if op.Data != nil {
+			objects[op.Path] = op.Data
+		} else {
+			delete(objects, op.Path)
+		}
+	}
+	b.objects = objects
+	return nil
+}
+
+func TestTransaction(t *testing.T) {
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "0f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	event.Props.SetDateTime(ical.PropDateTimeStart, time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC))
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, event.Component)
+
+	b := &transactionBackend{storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a/", MaxResourceSize: 64}, {Path: "/user/calendars/b/"}}},
+		objects:     map[string]*ical.Calendar{"/user/calendars/a/event.ics": cal},
+	}}
+	ts := httptest.NewServer(&Handler{Backend: b, Transforms: []TransformFunc{DefaultSequence}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	prev, err := b.GetCalendarObject(ctx, "/user/calendars/a/event.ics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	move := []TransactionOp{
+		{Path: "/user/calendars/b/event.ics", Data: cal, IfNoneMatch: "*"},
+		{Path: "/user/calendars/a/event.ics", IfMatch: webdav.ConditionalMatch(`"stale"`)},
+	}
+	if _, err := c.ApplyTransaction(ctx, "/user/calendars/", move); err == nil {
+		t.Errorf("ApplyTransaction() with stale ETag succeeded")
+	}
+	if len(b.objects) != 1 {
+		t.Fatalf("failed transaction was partially applied: %v objects", len(b.objects))
+	}
+
+	move[1].IfMatch = webdav.ConditionalMatch(internal.ETag(prev.ETag).String())
+	cos, err := c.ApplyTransaction(ctx, "/user/calendars/", move)
+	if err != nil {
+		t.Fatalf("ApplyTransaction() = %v", err)
+	}
+	moved, ok := b.objects["/user/calendars/b/event.ics"]
+	if !ok || len(b.objects) != 1 {
+		t.Fatalf("objects after move = %v", b.objects)
+	}
+	if moved.Children[0].Props.Get(ical.PropSequence) == nil {
+		t.Errorf("transforms weren't applied")
+	}
+	if len(cos) != 1 || cos[0].Path != "/user/calendars/b/event.ics" || cos[0].ETag == "" {
+		t.Errorf("ApplyTransaction() = %+v, want the moved object and its ETag", cos)
+	}
+
+	if _, err := c.ApplyTransaction(ctx, "/user/calendars/a/", move); err == nil {
+		t.Errorf("ApplyTransaction() outside of the collection succeeded")
+	}
+	escape := []TransactionOp{{Path: "/user/calendars/a/../b/escape.ics", Data: cal}}
+	if _, err := c.ApplyTransaction(ctx, "/user/calendars/a/", escape); err == nil {
+		t.Errorf("ApplyTransaction() escaping the collection succeeded")
+	}
+	tooLarge := []TransactionOp{{Path: "/user/calendars/a/large.ics", Data: cal}}
+	if _, err := c.ApplyTransaction(ctx, "/user/calendars/", tooLarge); err == nil {
+		t.Errorf("ApplyTransaction() exceeding max-resource-size succeeded")
+	}
+	if _, ok := b.objects["/user/calendars/b/escape.ics"]; ok || len(b.objects) != 1 {
+		t.Errorf("objects after rejected transactions = %v", b.objects)
+	}
+}
+
+type moveBackend struct {
+	storeBackend
+}
+
+func (b *moveBackend) DeleteCalendarObject(ctx context.Context, path string) error {
+	if _, ok := b.objects[path]; !ok {
+		return webdav.NewHTTPError(http.StatusNotFound, nil)
+	}
+	delete(b.objects, path)
+	return nil
+}
+
+func TestMove(t *testing.T) {
+	newCal := func(uid string) *ical.Calendar {
+		event := ical.NewEvent()
+		event.Props.SetText(ical.PropUID, uid)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cal := ical.NewCalendar()
+		cal.Props.SetText(ical.PropVersion, "2.0")
+		cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+		cal.Children = append(cal.Children, event.Component)
+		return cal
+	}
+	event, other := newCal("first"), newCal("second")
+	b := &moveBackend{storeBackend{
+		testBackend: testBackend{calendars: []Calendar{{Path: "/user/calendars/a/"}, {Path: "/user/calendars/b/"}}},
+		objects: map[string]*ical.Calendar{
+			"/user/calendars/a/event.ics": event,
+			"/user/calendars/b/other.ics": other,
+		},
+	}}
+	h := Handler{Backend: b}
+
+	move := func(src, dest, overwrite string) int {
+		req := httptest.NewRequest("MOVE", src, nil)
+		req.Header.Set("Destination", dest)
+		if overwrite != "" {
+			req.Header.Set("Overwrite", overwrite)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := move("/user/calendars/a/event.ics", "/user/calendars/b/other.ics", "F"); code != http.StatusPreconditionFailed {
+		t.Errorf("MOVE onto existing object without overwrite = %v, want %v", code, http.StatusPreconditionFailed)
+	}
+	if code := move("/user/calendars/a/event.ics", "/user/calendars/b/", ""); code != http.StatusForbidden {
+		t.Errorf("MOVE onto calendar = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := move("/user/calendars/a/event.ics", "/user/calendars/b/event.ics", ""); code != http.StatusCreated {
+		t.Fatalf("MOVE = %v, want %v", code, http.StatusCreated)
+	}
+	if _, ok := b.objects["/user/calendars/a/event.ics"]; ok {
+		t.Errorf("source object still exists after MOVE")
+	}
+	if b.objects["/user/calendars/b/event.ics"] != event {
+		t.Errorf("destination object doesn't match source after MOVE")
+	}
+	if code := move("/user/calendars/b/event.ics", "/user/calendars/b/other.ics", ""); code != http.StatusNoContent {
+		t.Errorf("MOVE onto existing object = %v, want %v", code, http.StatusNoContent)
+	}
+	if len(b.objects) != 1 || b.objects["/user/calendars/b/other.ics"] != event {
+		t.Errorf("objects after overwriting MOVE = %v", b.objects)
+	}
+}
+
+func TestMoveBackend(t *testing.T) {
+	newCal := func(uid string) *ical.Calendar {
+		event := ical.NewEvent()
+		event.Props.SetText(ical.PropUID, uid)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cal := ical.NewCalendar()
+		cal.Props.SetText(ical.PropVersion, "2.0")
+		cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+		cal.Children = append(cal.Children, event.Component)
+		return cal
+	}
+
+	backends := map[string]interface {
+		Backend
+		CalendarCreator
+	}{
+		"mem":   NewMemBackend("/user/", "/user/calendars/"),
+		"local": NewLocalBackend(t.TempDir(), "/user/", "/user/calendars/"),
+	}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, p := range []string{"/user/calendars/a/", "/user/calendars/b/"} {
+				if err := b.CreateCalendar(ctx, Calendar{Path: p}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			objects := map[string]string{
+				"/user/calendars/a/event.ics": "first",
+				"/user/calendars/a/dup.ics":   "second",
+				"/user/calendars/b/other.ics": "second",
+			}
+			for p, uid := range objects {
+				if _, err := b.PutCalendarObject(ctx, p, newCal(uid), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := Handler{Backend: b}
+
+			move := func(src, dest string) int {
+				req := httptest.NewRequest("MOVE", src, nil)
+				req.Header.Set("Destination", dest)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			// Renaming an object doesn't conflict with its own UID
+			if code := move("/user/calendars/a/event.ics", "/user/calendars/a/renamed.ics"); code != http.StatusCreated {
+				t.Errorf("MOVE within a calendar = %v, want %v", code, http.StatusCreated)
+			}
+			if code := move("/user/calendars/a/renamed.ics", "/user/calendars/b/renamed.ics"); code != http.StatusCreated {
+				t.Errorf("MOVE between calendars = %v, want %v", code, http.StatusCreated)
+			}
+			if code := move("/user/calendars/a/dup.ics", "/user/calendars/b/dup.ics"); code != http.StatusConflict {
+				t.Errorf("MOVE with a conflicting UID = %v, want %v", code, http.StatusConflict)
+			}
+
+			if _, err := b.GetCalendarObject(ctx, "/user/calendars/b/renamed.ics", nil); err != nil {
+				t.Errorf("GetCalendarObject() after MOVE = %v", err)
+			}
+			for _, p := range []string{"/user/calendars/a/event.ics", "/user/calendars/a/renamed.ics", "/user/calendars/b/dup.ics"} {
+				if _, err := b.GetCalendarObject(ctx, p, nil); err == nil {
+					t.Errorf("GetCalendarObject(%q) after MOVE succeeded", p)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConditionalPut(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("/user/", "/user/calendars/")
+	if err := b.CreateCalendar(ctx, Calendar{Path: "/user/calendars/a/"}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(&Handler{Backend: b})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "3c1d2e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, event.Component)
+
+	p := "/user/calendars/a/event.ics"
+	createOnly := &PutCalendarObjectOptions{IfNoneMatch: "*"}
+	co, err := c.PutCalendarObjectWithOptions(ctx, p, cal, createOnly)
+	if err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	} else if co.ETag == "" {
+		t.Errorf("PutCalendarObject() didn't return an ETag")
+	}
+	if _, err := c.PutCalendarObjectWithOptions(ctx, p, cal, createOnly); err == nil {
+		t.Errorf("PutCalendarObject() with If-None-Match on existing object succeeded")
+	}
+	if _, err := c.PutCalendarObjectWithOptions(ctx, p, cal, &PutCalendarObjectOptions{IfMatch: webdav.MatchETag("stale")}); err == nil {
+		t.Errorf("PutCalendarObject() with stale If-Match succeeded")
+	}
+	if _, err := c.PutCalendarObjectWithOptions(ctx, p, cal, &PutCalendarObjectOptions{IfMatch: webdav.MatchETag(co.ETag)}); err != nil {
+		t.Errorf("PutCalendarObject() with matching If-Match = %v", err)
+	}
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	store := &storeBackend{objects: make(map[string]*ical.Calendar)}
+	keys := webdav.StaticKey(bytes.Repeat([]byte{42}, 32))
+	b := NewEncryptedBackend(store, keys, []string{"summary"}, nil)
+	ctx := context.Background()
+
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "6b3d9a2e-0c6f-4f1e-9b8a-1d2c3e4f5a6b")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	event.Props.SetText(ical.PropSummary, "Doctor's appointment")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, event.Component)
+
+	p := "/user/calendars/a/event.ics"
+	if _, err := b.PutCalendarObject(ctx, p, cal, nil); err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	}
+	if v := event.Props.Get(ical.PropSummary).Value; v != "Doctor's appointment" {
+		t.Errorf("PutCalendarObject() modified the calendar: SUMMARY = %q", v)
+	}
+
+	stored := store.objects[p].Children[0]
+	if v := stored.Props.Get(ical.PropSummary).Value; strings.Contains(v, "Doctor") {
+		t.Errorf("stored SUMMARY = %q, want encrypted value", v)
+	}
+	if v := stored.Props.Get(ical.PropUID).Value; v != "6b3d9a2e-0c6f-4f1e-9b8a-1d2c3e4f5a6b" {
+		t.Errorf("stored UID = %q, want plaintext", v)
+	}
+
+	co, err := b.GetCalendarObject(ctx, p, &CalendarCompRequest{})
+	if err != nil {
+		t.Fatalf("GetCalendarObject() = %v", err)
+	}
+	if v := co.Data.Children[0].Props.Get(ical.PropSummary).Value; v != "Doctor's appointment" {
+		t.Errorf("GetCalendarObject() SUMMARY = %q, want decrypted value", v)
+	}
+
+	// Encrypted values are bound to the object path
+	store.objects["/user/calendars/a/other.ics"] = store.objects[p]
+	if _, err := b.GetCalendarObject(ctx, "/user/calendars/a/other.ics", &CalendarCompRequest{}); err == nil {
+		t.Errorf("GetCalendarObject() of a copied object = nil, want error")
+	}
+
+	plaintext := ical.NewEvent()
+	plaintext.Props.SetText(ical.PropUID, "4c2a1d3e-5f6a-4b7c-8d9e-0f1a2b3c4d5e")
+	plaintext.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	plaintext.Props.SetText(ical.PropSummary, "Plaintext")
+	plainCal := ical.NewCalendar()
+	plainCal.Props.SetText(ical.PropVersion, "2.0")
+	plainCal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	plainCal.Children = append(plainCal.Children, plaintext.Component)
+	store.objects["/user/calendars/a/plain.ics"] = plainCal
+	if _, err := b.GetCalendarObject(ctx, "/user/calendars/a/plain.ics", &CalendarCompRequest{}); err != nil {
+		t.Errorf("GetCalendarObject() of a plaintext object = %v", err)
+	}
+	strict := NewEncryptedBackend(store, keys, []string{"summary"}, &webdav.EncryptionOptions{RejectPlaintext: true})
+	if _, err := strict.GetCalendarObject(ctx, "/user/calendars/a/plain.ics", &CalendarCompRequest{}); err == nil {
+		t.Errorf("GetCalendarObject() of a plaintext object with RejectPlaintext = nil, want error")
+	}
+	if _, err := strict.GetCalendarObject(ctx, p, &CalendarCompRequest{}); err != nil {
+		t.Errorf("GetCalendarObject() with RejectPlaintext = %v", err)
+	}
+}
+
+func TestEncryptedBackend_optionalInterfaces(t *testing.T) {
+	mb := NewMemBackend("/user/", "/user/calendars/")
+	keys := webdav.StaticKey(bytes.Repeat([]byte{42}, 32))
+	b := NewEncryptedBackend(mb, keys, []string{"SUMMARY"}, nil)
+	ctx := context.Background()
+	for _, p := range []string{"/user/calendars/a/", "/user/calendars/b/"} {
+		if err := mb.CreateCalendar(ctx, Calendar{Path: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caps := (&Handler{Backend: b}).Capabilities()
+	for _, feature := range []string{"sync-collection", "move"} {
+		found := false
+		for _, f := range caps.Features {
+			found = found || f == feature
+		}
+		if !found {
+			t.Errorf("Features = %v, want %q", caps.Features, feature)
+		}
+	}
+	if _, ok := calendarCreator(b); !ok {
+		t.Errorf("calendarCreator() = false, want true")
+	}
+	if drb, ok := b.(DryRunBackend); !ok || !drb.SupportsDryRun() {
+		t.Errorf("SupportsDryRun() = false, want true")
+	}
+
+	event := ical.NewEvent()
+	event.Props.SetText(ical.PropUID, "8d4e2f1a-3b5c-4d6e-9f0a-1b2c3d4e5f6a")
+	event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	event.Props.SetText(ical.PropSummary, "Doctor's appointment")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, event.Component)
+	if _, err := b.PutCalendarObject(ctx, "/user/calendars/a/event.ics", cal, nil); err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	}
+
+	// Prop-filter names are case-insensitive
+	query := &CalendarQuery{CompFilter: CompFilter{
+		Name: "VCALENDAR",
+		Comps: []CompFilter{{
+			Name:  "VEVENT",
+			Props: []PropFilter{{Name: "summary", TextMatch: &TextMatch{Text: "doctor"}}},
+		}},
+	}}
+	if l, err := b.QueryCalendarObjects(ctx, "/user/calendars/a/", query); err != nil {
+		t.Fatalf("QueryCalendarObjects() = %v", err)
+	} else if len(l) != 1 {
+		t.Errorf("QueryCalendarObjects() returned %v objects, want 1", len(l))
+	}
+
+	// Moved objects are re-encrypted for their new path
+	if err := b.(MoveBackend).MoveCalendarObject(ctx, "/user/calendars/a/event.ics", "/user/calendars/b/event.ics"); err != nil {
+		t.Fatalf("MoveCalendarObject() = %v", err)
+	}
+	co, err := b.GetCalendarObject(ctx, "/user/calendars/b/event.ics", &CalendarCompRequest{})
+	if err != nil {
+		t.Fatalf("GetCalendarObject() = %v", err)
+	}
+	if v := co.Data.Children[0].Props.Get(ical.PropSummary).Value; v != "Doctor's appointment" {
+		t.Errorf("GetCalendarObject() SUMMARY = %q, want decrypted value", v)
+	}
+}
+
+func TestEncryptedCalendar(t *testing.T) {
+	payload := ical.NewEvent()
+	payload.Props.SetText(ical.PropUID, "e2ee-1")
+	payload.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	payload.Props.SetText("X-ENCRYPTED-PAYLOAD", "b3BhcXVl")
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Children = append(cal.Children, payload.Component)
+
+	b := rawBackend{
+		testBackend: testBackend{
+			calendars: []Calendar{{Path: "/user/calendars/secret/", Encrypted: true}},
+			objectMap: map[string][]CalendarObject{
+				"/user/calendars/secret/": {{Path: "/user/calendars/secret/e2ee-1.ics", Data: cal}},
+			},
+		},
+		objects: make(map[string][]byte),
+	}
+	h := Handler{Backend: b, Transforms: []TransformFunc{StripExtendedProperties}, MaintainSequence: true}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	cals, err := c.FindCalendars(ctx, "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || !cals[0].Encrypted {
+		t.Errorf("FindCalendars() = %+v, want an encrypted calendar", cals)
+	}
+
+	// Payloads must be wrapped in iCalendar data
+	blob := []byte("\x00opaque encrypted blob")
+	if _, err := c.PutCalendarObjectRaw(ctx, "/user/calendars/secret/blob.ics", blob, "application/octet-stream"); err == nil {
+		t.Errorf("PutCalendarObjectRaw() with an unwrapped payload succeeded")
+	}
+	if _, ok := b.objects["/user/calendars/secret/blob.ics"]; ok {
+		t.Errorf("unwrapped payload has been stored")
+	}
+
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutCalendarObjectRaw(ctx, "/user/calendars/secret/e2ee-1.ics", buf.Bytes(), ical.MIMEType); err != nil {
+		t.Fatalf("PutCalendarObjectRaw() = %v", err)
+	}
+	if got := b.objects["/user/calendars/secret/e2ee-1.ics"]; !bytes.Equal(got, buf.Bytes()) {
+		t.Errorf("stored object has been modified: %q", got)
+	}
+
+	query := &CalendarQuery{
+		CompFilter: CompFilter{
+			Name: ical.CompCalendar,
+			Comps: []CompFilter{{
+				Name:  ical.CompEvent,
+				Start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+			}},
+		},
+	}
+	objs, err := c.QueryCalendar(ctx, "/user/calendars/secret/", query)
+	if err != nil {
+		t.Fatalf("QueryCalendar() = %v", err)
+	} else if len(objs) != 1 || objs[0].Path != "/user/calendars/secret/e2ee-1.ics" {
+		t.Errorf("QueryCalendar() = %+v, want all objects", objs)
+	}
+}
+
+func TestMemBackend(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(&Handler{Backend: NewMemBackend("/user/", "/user/calendars/")})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateCalendar(ctx, &Calendar{Path: "/user/calendars/work/", Name: "Work"}); err != nil {
+		t.Fatalf("CreateCalendar() = %v", err)
+	}
+	cals, err := c.FindCalendars(ctx, "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || cals[0].Path != "/user/calendars/work/" || cals[0].Name != "Work" {
+		t.Fatalf("FindCalendars() = %+v", cals)
+	}
+
+	newCal := func(uid, summary string) *ical.Calendar {
+		event := ical.NewEvent()
+		event.Props.SetText(ical.PropUID, uid)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		event.Props.SetText(ical.PropSummary, summary)
+		cal := ical.NewCalendar()
+		cal.Props.SetText(ical.PropVersion, "2.0")
+		cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+		cal.Children = append(cal.Children, event.Component)
+		return cal
+	}
+	var etag string
+	for _, name := range []string{"a", "b"} {
+		p := "/user/calendars/work/" + name + ".ics"
+		co, err := c.PutCalendarObject(ctx, p, newCal(name, "Meeting "+name))
+		if err != nil {
+			t.Fatalf("PutCalendarObject(%q) = %v", p, err)
+		} else if name == "a" {
+			etag = co.ETag
+		}
+	}
+	if _, err := c.PutCalendarObject(ctx, "/user/calendars/work/c.ics", newCal("a", "Duplicate")); err == nil {
+		t.Errorf("PutCalendarObject() with conflicting UID succeeded")
+	}
+
+	initial, err := c.SyncCollection(ctx, "/user/calendars/work/", &SyncQuery{})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	} else if len(initial.Updated) != 2 {
+		t.Fatalf("SyncCollection() returned %v updated objects, want 2", len(initial.Updated))
+	}
+
+	first, err := c.SyncCollection(ctx, "/user/calendars/work/", &SyncQuery{Limit: 1})
+	if err != nil {
+		t.Fatalf("SyncCollection() with limit = %v", err)
+	} else if !first.Truncated || len(first.Updated) != 1 {
+		t.Fatalf("SyncCollection() with limit = %+v, want 1 updated object, truncated", first)
+	}
+	second, err := c.SyncCollection(ctx, "/user/calendars/work/", &SyncQuery{SyncToken: first.SyncToken, Limit: 1})
+	if err != nil {
+		t.Fatalf("SyncCollection() with intermediate token = %v", err)
+	} else if second.Truncated || len(second.Updated) != 1 || second.Updated[0].Path == first.Updated[0].Path || second.SyncToken != initial.SyncToken {
+		t.Errorf("SyncCollection() with intermediate token = %+v", second)
+	}
+
+	if _, err := c.PutCalendarObject(ctx, "/user/calendars/work/a.ics", newCal("a", "Updated")); err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	}
+	if err := c.RemoveAll(ctx, "/user/calendars/work/b.ics"); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+	resp, err := c.SyncCollection(ctx, "/user/calendars/work/", &SyncQuery{SyncToken: initial.SyncToken})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	}
+	if len(resp.Updated) != 1 || resp.Updated[0].Path != "/user/calendars/work/a.ics" || resp.Updated[0].ETag == etag {
+		t.Errorf("SyncCollection() updated = %+v", resp.Updated)
+	}
+	if len(resp.Deleted) != 1 || resp.Deleted[0] != "/user/calendars/work/b.ics" {
+		t.Errorf("SyncCollection() deleted = %v", resp.Deleted)
+	}
+
+	objs, err := c.QueryCalendar(ctx, "/user/calendars/work/", &CalendarQuery{
+		CompFilter: CompFilter{
+			Name: "VCALENDAR",
+			Comps: []CompFilter{{
+				Name:  "VEVENT",
+				Props: []PropFilter{{Name: "SUMMARY", TextMatch: &TextMatch{Text: "updated"}}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryCalendar() = %v", err)
+	} else if len(objs) != 1 || objs[0].Path != "/user/calendars/work/a.ics" {
+		t.Errorf("QueryCalendar() = %+v", objs)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := NewLocalBackend(dir, "/user/", "/user/calendars/")
+	var logBuf bytes.Buffer
+	backend.ErrorLog = log.New(&logBuf, "", 0)
+	ts := httptest.NewServer(&Handler{Backend: backend})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateCalendar(ctx, &Calendar{Path: "/user/calendars/work/", Name: "Work", Color: "#FF0000"}); err != nil {
+		t.Fatalf("CreateCalendar() = %v", err)
+	}
+	cals, err := c.FindCalendars(ctx, "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || cals[0].Path != "/user/calendars/work/" || cals[0].Name != "Work" || cals[0].Color != "#FF0000" {
+		t.Fatalf("FindCalendars() = %+v", cals)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "work", "displayname")); err != nil || string(b) != "Work" {
+		t.Errorf("displayname metadata = %q, %v", b, err)
+	}
+
+	newCal := func(uid, summary string) *ical.Calendar {
+		event := ical.NewEvent()
+		event.Props.SetText(ical.PropUID, uid)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		event.Props.SetText(ical.PropSummary, summary)
+		cal := ical.NewCalendar()
+		cal.Props.SetText(ical.PropVersion, "2.0")
+		cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+		cal.Children = append(cal.Children, event.Component)
+		return cal
+	}
+	co, err := c.PutCalendarObject(ctx, "/user/calendars/work/a.ics", newCal("a", "Meeting"))
+	if err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "work", "a.ics")); err != nil {
+		t.Errorf("object file: %v", err)
+	}
+	if _, err := c.PutCalendarObject(ctx, "/user/calendars/work/b.ics", newCal("a", "Duplicate")); err == nil {
+		t.Errorf("PutCalendarObject() with conflicting UID succeeded")
+	}
+	if _, err := c.PutCalendarObject(ctx, "/user/calendars/work/b", newCal("b", "No extension")); err == nil {
+		t.Errorf("PutCalendarObject() without file extension succeeded")
+	}
+
+	// Files written by other vdir clients which don't parse are skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, "work", "broken.ics"), []byte("BEGIN:VCALENDAR\r\nUID:a\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutCalendarObject(ctx, "/user/calendars/work/c.ics", newCal("c", "Other")); err != nil {
+		t.Errorf("PutCalendarObject() with an unparsable file = %v", err)
+	}
+	if objs, err := backend.ListCalendarObjects(ctx, "/user/calendars/work/", nil); err != nil {
+		t.Errorf("ListCalendarObjects() = %v", err)
+	} else if len(objs) != 2 {
+		t.Errorf("ListCalendarObjects() = %+v, want 2 objects", objs)
+	}
+	if !strings.Contains(logBuf.String(), "broken.ics") {
+		t.Errorf("unparsable file wasn't logged: %q", logBuf.String())
+	}
+	if err := os.Remove(filepath.Join(dir, "work", "broken.ics")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveAll(ctx, "/user/calendars/work/c.ics"); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+
+	updated, err := c.PutCalendarObject(ctx, "/user/calendars/work/a.ics", newCal("a", "Updated"))
+	if err != nil {
+		t.Fatalf("PutCalendarObject() = %v", err)
+	} else if updated.ETag == co.ETag {
+		t.Errorf("ETag didn't change after update")
+	}
+
+	objs, err := c.QueryCalendar(ctx, "/user/calendars/work/", &CalendarQuery{
+		CompFilter: CompFilter{
+			Name: "VCALENDAR",
+			Comps: []CompFilter{{
+				Name:  "VEVENT",
+				Props: []PropFilter{{Name: "SUMMARY", TextMatch: &TextMatch{Text: "updated"}}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryCalendar() = %v", err)
+	} else if len(objs) != 1 || objs[0].Path != "/user/calendars/work/a.ics" || objs[0].ETag != updated.ETag {
+		t.Errorf("QueryCalendar() = %+v", objs)
+	}
+
+	cals, err = c.FindCalendars(ctx, "/user/calendars/")
+	if err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || cals[0].CTag == "" {
+		t.Fatalf("FindCalendars() = %+v, want a CTag", cals)
+	}
+	ctag := cals[0].CTag
+
+	// A same-size write within the mtime granularity changes the CTag
+	objPath := filepath.Join(dir, "work", "a.ics")
+	fi, err := os.Stat(objPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(objPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(objPath, bytes.Replace(b, []byte("Updated"), []byte("Changed"), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(objPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if cals, err := c.FindCalendars(ctx, "/user/calendars/"); err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || cals[0].CTag == ctag {
+		t.Errorf("CTag didn't change after a same-size write: %+v", cals)
+	} else {
+		ctag = cals[0].CTag
+	}
+
+	if err := c.RemoveAll(ctx, "/user/calendars/work/a.ics"); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+	if cals, err := c.FindCalendars(ctx, "/user/calendars/"); err != nil {
+		t.Fatalf("FindCalendars() = %v", err)
+	} else if len(cals) != 1 || cals[0].CTag == ctag {
+		t.Errorf("CTag didn't change after removing an object: %+v", cals)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "work", "a.ics")); !os.IsNotExist(err) {
+		t.Errorf("object file wasn't removed: %v", err)
+	}
+}
+
+// streamOnlyBackend fails if calendar objects aren't listed via
+// CalendarObjectStreamer.
+type streamOnlyBackend struct {
+	*LocalBackend
+}
+
+func (b streamOnlyBackend) ListCalendarObjects(ctx context.Context, path string, req *CalendarCompRequest) ([]CalendarObject, error) {
+	return nil, fmt.Errorf("ListCalendarObjects called")
+}
+
+func (b streamOnlyBackend) QueryCalendarObjects(ctx context.Context, path string, query *CalendarQuery) ([]CalendarObject, error) {
+	return nil, fmt.Errorf("QueryCalendarObjects called")
+}
+
+func TestCalendarObjectStreamer(t *testing.T) {
+	ctx := context.Background()
+	b := streamOnlyBackend{NewLocalBackend(t.TempDir(), "/user/", "/user/calendars/")}
+	if err := b.CreateCalendar(ctx, Calendar{Path: "/user/calendars/a/"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"first", "second"} {
+		event := ical.NewEvent()
+		event.Props.SetText(ical.PropUID, uid)
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		event.Props.SetDateTime(ical.PropDateTimeStart, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC))
+		cal := ical.NewCalendar()
+		cal.Props.SetText(ical.PropVersion, "2.0")
+		cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+		cal.Children = append(cal.Children, event.Component)
+		if _, err := b.PutCalendarObject(ctx, "/user/calendars/a/"+uid+".ics", cal, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := Handler{Backend: b}
+
+	for _, tc := range []struct {
+		method, body string
+	}{
+		{"PROPFIND", `<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`},
+		{"REPORT", `<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><d:getetag/></d:prop>
+  <c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT"/></c:comp-filter></c:filter>
+</c:calendar-query>`},
+	} {
+		req := httptest.NewRequest(tc.method, "/user/calendars/a/", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		body := w.Body.String()
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%v = %v: %v", tc.method, w.Code, body)
+			continue
+		}
+		for _, p := range []string{"/user/calendars/a/first.ics", "/user/calendars/a/second.ics"} {
+			if !strings.Contains(body, p) {
+				t.Errorf("%v response doesn't contain %v: %v", tc.method, p, body)
+			}
+		}
+		if !strings.HasSuffix(strings.TrimSpace(body), "</multistatus>") {
+			t.Errorf("%v response isn't terminated: %v", tc.method, body)
+		}
+	}
+}
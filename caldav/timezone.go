@@ -0,0 +1,138 @@
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TimezoneBackend is an optional interface for backends storing a default
+// timezone for the current user principal. It's exposed as the
+// CALDAV:calendar-timezone-id property, defined in RFC 7809 section 5.2, on
+// the principal and the calendar home set, where it can be changed via
+// PROPPATCH.
+//
+// Floating times in queries are interpreted in the default timezone instead
+// of UTC.
+type TimezoneBackend interface {
+	// DefaultTimezone returns the TZID of the default timezone, or an empty
+	// string if none is set.
+	DefaultTimezone(ctx context.Context) (string, error)
+	// SetDefaultTimezone sets the TZID of the default timezone. An empty TZID
+	// removes it. TZIDs are validated with time.LoadLocation beforehand.
+	SetDefaultTimezone(ctx context.Context, tzid string) error
+}
+
+func addTimezonePrincipalProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, tb TimezoneBackend) {
+	props[calendarTimezoneIDName] = func(*internal.RawXMLValue) (interface{}, error) {
+		tzid, err := tb.DefaultTimezone(ctx)
+		if err != nil {
+			return nil, err
+		} else if tzid == "" {
+			return nil, &internal.HTTPError{Code: http.StatusNotFound}
+		}
+		return &calendarTimezoneID{TZID: tzid}, nil
+	}
+}
+
+// patchDefaultTimezone handles a PROPPATCH request on the principal or the
+// calendar home set. Only CALDAV:calendar-timezone-id can be changed.
+func patchDefaultTimezone(ctx context.Context, tb TimezoneBackend, p string, update *internal.PropertyUpdate) (*internal.Response, error) {
+	var names []xml.Name
+	failed := make(map[xml.Name]int)
+	var tzid *string
+
+	for _, s := range update.Set {
+		for i := range s.Prop.Raw {
+			raw := &s.Prop.Raw[i]
+			name, ok := raw.XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+			if name != calendarTimezoneIDName {
+				failed[name] = http.StatusForbidden
+				continue
+			}
+			var v calendarTimezoneID
+			if err := raw.Decode(&v); err != nil {
+				failed[name] = http.StatusBadRequest
+				continue
+			}
+			if _, err := time.LoadLocation(v.TZID); err != nil || v.TZID == "" {
+				failed[name] = http.StatusConflict
+				continue
+			}
+			tzid = &v.TZID
+		}
+	}
+
+	for _, rm := range update.Remove {
+		for i := range rm.Prop.Raw {
+			name, ok := rm.Prop.Raw[i].XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+			if name != calendarTimezoneIDName {
+				failed[name] = http.StatusForbidden
+				continue
+			}
+			empty := ""
+			tzid = &empty
+		}
+	}
+
+	if len(failed) == 0 && tzid != nil {
+		if err := tb.SetDefaultTimezone(ctx, *tzid); err != nil {
+			return nil, err
+		}
+	}
+
+	return internal.NewPropPatchResponse(p, names, failed)
+}
+
+// defaultLocation returns the location of the current user principal's
+// default timezone, or nil if there is none.
+func (h *Handler) defaultLocation(ctx context.Context) (*time.Location, error) {
+	tb, ok := optionalBackend(h.Backend).(TimezoneBackend)
+	if !ok {
+		return nil, nil
+	}
+	tzid, err := tb.DefaultTimezone(ctx)
+	if err != nil || tzid == "" {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(tzid)
+	if err != nil {
+		// The timezone database may have changed since the TZID was stored
+		return nil, nil
+	}
+	return loc, nil
+}
+
+// setFilterLocation sets the location of the time ranges of a filter, which is
+// used to interpret floating times.
+func setFilterLocation(cf *CompFilter, loc *time.Location) {
+	if !cf.Start.IsZero() {
+		cf.Start = cf.Start.In(loc)
+	}
+	if !cf.End.IsZero() {
+		cf.End = cf.End.In(loc)
+	}
+	for i := range cf.Props {
+		pf := &cf.Props[i]
+		if !pf.Start.IsZero() {
+			pf.Start = pf.Start.In(loc)
+		}
+		if !pf.End.IsZero() {
+			pf.End = pf.End.In(loc)
+		}
+	}
+	for i := range cf.Comps {
+		setFilterLocation(&cf.Comps[i], loc)
+	}
+}
@@ -0,0 +1,226 @@
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TransactionBackend is an optional interface for backends applying several
+// changes to calendar objects atomically, e.g. to move an event between
+// calendars without a visible intermediate state.
+//
+// Transactions are submitted with a POST request to a collection containing
+// all the calendar objects involved, usually the calendar home set. The
+// request body is a transaction element in the go-webdav XML namespace. See
+// Client.ApplyTransaction.
+//
+// Transforms and MaintainSequence apply to the objects stored by a
+// transaction, but no scheduling messages are sent.
+type TransactionBackend interface {
+	// ApplyTransaction applies the operations in order. If an error is
+	// returned, none of the operations must have been applied.
+	ApplyTransaction(ctx context.Context, ops []TransactionOp) error
+}
+
+// TransactionOp is an operation of a transaction.
+type TransactionOp struct {
+	// Path is the path of the calendar object.
+	Path string
+	// Data is the new calendar object. If nil, the object is deleted.
+	Data *ical.Calendar
+	// IfMatch and IfNoneMatch are preconditions on the current ETag of the
+	// object, as in PutCalendarObjectOptions. Backends must fail the
+	// transaction with HTTP 412 if a precondition isn't met.
+	IfMatch     webdav.ConditionalMatch
+	IfNoneMatch webdav.ConditionalMatch
+}
+
+func (h *Handler) handleTransaction(w http.ResponseWriter, r *http.Request) error {
+	tb, ok := h.Backend.(TransactionBackend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "caldav: transactions are unsupported")
+	}
+
+	var t transaction
+	if err := internal.DecodeXMLRequest(r, &t); err != nil {
+		return err
+	}
+	if len(t.Ops) == 0 {
+		return internal.HTTPErrorf(http.StatusBadRequest, "caldav: empty transaction")
+	}
+
+	ctx := r.Context()
+	b := h.newBackend()
+	prefix := strings.TrimSuffix(r.URL.Path, "/") + "/"
+	ops := make([]TransactionOp, len(t.Ops))
+	for i, el := range t.Ops {
+		// Cleaned paths can't escape the collection with ".." segments
+		p, err := internal.SanitizePath(el.Href.Path)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(p, prefix) || b.resourceTypeAtPath(p) != resourceTypeCalendarObject {
+			return internal.HTTPErrorf(http.StatusBadRequest, "caldav: %q isn't a calendar object in %q", p, r.URL.Path)
+		}
+		objPath, err := b.objectPath(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !internal.PathAllowed(ctx, objPath) {
+			return internal.HTTPErrorf(http.StatusForbidden, "caldav: %q isn't allowed by the credentials scope", p)
+		}
+		if !b.Visibility.IsVisible(ctx, objPath) {
+			return internal.HTTPErrorf(http.StatusNotFound, "caldav: calendar object %q not found", p)
+		}
+
+		op := TransactionOp{
+			Path:        objPath,
+			IfMatch:     webdav.ConditionalMatch(el.IfMatch),
+			IfNoneMatch: webdav.ConditionalMatch(el.IfNoneMatch),
+		}
+		switch el.XMLName {
+		case transactionPutName:
+			if el.CalendarData == nil {
+				return internal.HTTPErrorf(http.StatusBadRequest, "caldav: missing calendar-data for %q", p)
+			}
+			cal, err := b.prepareTransactionObject(ctx, objPath, el.CalendarData)
+			if err != nil {
+				return err
+			}
+			op.Data = cal
+		case transactionDeleteName:
+			// No data
+		default:
+			return internal.HTTPErrorf(http.StatusBadRequest, "caldav: unknown transaction operation %v", el.XMLName.Local)
+		}
+		ops[i] = op
+	}
+
+	if err := tb.ApplyTransaction(ctx, ops); err != nil {
+		return err
+	}
+
+	var principal string
+	if h.AuditSink != nil {
+		principal, _ = h.Backend.CurrentUserPrincipal(ctx)
+	}
+	resps := make([]internal.Response, 0, len(ops))
+	for _, op := range ops {
+		event := webdav.AuditEvent{Method: http.MethodDelete, Principal: principal, Path: op.Path}
+		resp := internal.NewOKResponse(op.Path)
+		if op.Data != nil {
+			event.Method = http.MethodPut
+			co, err := h.Backend.GetCalendarObject(ctx, op.Path, &CalendarCompRequest{})
+			if err == nil {
+				event.ETagAfter = co.ETag
+				resp, err = b.propFindCalendarObject(ctx, internal.NewPropNamePropFind(internal.GetETagName), co)
+			} else if internal.IsNotFound(err) {
+				// Deleted by a later operation
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if h.AuditSink != nil {
+			h.AuditSink.Audit(ctx, &event)
+		}
+		resps = append(resps, *resp)
+	}
+
+	return internal.ServeMultiStatus(w, internal.NewMultiStatus(resps...))
+}
+
+// prepareTransactionObject validates a calendar object stored by a
+// transaction and applies the same changes as PUT.
+func (b *backend) prepareTransactionObject(ctx context.Context, objPath string, data *calendarDataResp) (*ical.Calendar, error) {
+	parent := b.parentCalendar(ctx, path.Dir(objPath))
+	contentType := data.ContentType
+	if contentType == "" {
+		contentType = ical.MIMEType
+	}
+	if err := checkObjectContentType(parent, contentType); err != nil {
+		return nil, err
+	}
+	if max := maxObjectSize(parent); max > 0 && int64(len(data.Data)) > max {
+		return nil, NewPreconditionError(PreconditionMaxResourceSize)
+	}
+	cal, err := decodeObject(data.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent != nil && parent.Encrypted {
+		return cal, nil
+	}
+	if len(b.Transforms) > 0 {
+		if err := transform(ctx, b.Transforms, objPath, cal); err != nil {
+			return nil, err
+		}
+	}
+	if b.MaintainSequence {
+		prev, err := b.prevObject(ctx, objPath)
+		if err != nil {
+			return nil, err
+		}
+		UpdateSequence(prev, cal, time.Now())
+	}
+	return cal, nil
+}
+
+// ApplyTransaction applies several changes to calendar objects atomically,
+// on servers whose backend implements TransactionBackend. path is a
+// collection containing all the calendar objects, usually the calendar home
+// set. The returned objects contain the path and ETag of each object stored by
+// the transaction.
+func (c *Client) ApplyTransaction(ctx context.Context, path string, ops []TransactionOp) ([]CalendarObject, error) {
+	var t transaction
+	for _, op := range ops {
+		el := transactionOp{
+			XMLName:     transactionDeleteName,
+			Href:        internal.Href{Path: op.Path},
+			IfMatch:     string(op.IfMatch),
+			IfNoneMatch: string(op.IfNoneMatch),
+		}
+		if op.Data != nil {
+			var buf bytes.Buffer
+			if err := ical.NewEncoder(&buf).Encode(op.Data); err != nil {
+				return nil, err
+			}
+			el.XMLName = transactionPutName
+			el.CalendarData = &calendarDataResp{Data: buf.Bytes()}
+		}
+		t.Ops = append(t.Ops, el)
+	}
+
+	req, err := c.ic.NewXMLRequest(ctx, http.MethodPost, path, &t)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := c.ic.DoMultiStatus(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []CalendarObject
+	for i := range ms.Responses {
+		resp := &ms.Responses[i]
+		if len(resp.PropStats) == 0 {
+			continue
+		}
+		co, err := decodeCalendarObjectMetadata(resp)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *co)
+	}
+	return l, nil
+}
@@ -0,0 +1,211 @@
+package caldav
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TransformFunc rewrites a calendar object received via PUT before it's
+// stored. calendarPath is the path of the calendar containing the object,
+// which allows transformations to be applied per calendar.
+type TransformFunc func(ctx context.Context, calendarPath string, cal *ical.Calendar) error
+
+// StripExtendedProperties is a TransformFunc removing non-standard "X-"
+// properties from all components.
+func StripExtendedProperties(ctx context.Context, calendarPath string, cal *ical.Calendar) error {
+	stripExtendedProps(cal.Component)
+	return nil
+}
+
+func stripExtendedProps(comp *ical.Component) {
+	for name := range comp.Props {
+		if strings.HasPrefix(name, "X-") {
+			delete(comp.Props, name)
+		}
+	}
+	for _, child := range comp.Children {
+		stripExtendedProps(child)
+	}
+}
+
+// DefaultSequence is a TransformFunc adding "SEQUENCE:0" to events, to-dos and
+// journal entries lacking a SEQUENCE property.
+func DefaultSequence(ctx context.Context, calendarPath string, cal *ical.Calendar) error {
+	for _, child := range cal.Children {
+		switch child.Name {
+		case ical.CompEvent, ical.CompToDo, ical.CompJournal:
+		default:
+			continue
+		}
+		if child.Props.Get(ical.PropSequence) == nil {
+			prop := ical.NewProp(ical.PropSequence)
+			prop.Value = "0"
+			child.Props.Set(prop)
+		}
+	}
+	return nil
+}
+
+// AssignUID is a TransformFunc generating a UID for events, to-dos and
+// journal entries lacking one, which some clients omit.
+func AssignUID(ctx context.Context, calendarPath string, cal *ical.Calendar) error {
+	var uid string
+	var missing []*ical.Component
+	for _, child := range cal.Children {
+		switch child.Name {
+		case ical.CompEvent, ical.CompToDo, ical.CompJournal:
+		default:
+			continue
+		}
+		if prop := child.Props.Get(ical.PropUID); prop != nil {
+			uid = prop.Value
+		} else {
+			missing = append(missing, child)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if uid == "" {
+		var err error
+		if uid, err = internal.NewUUID(); err != nil {
+			return err
+		}
+	}
+	for _, comp := range missing {
+		comp.Props.SetText(ical.PropUID, uid)
+	}
+	return nil
+}
+
+// UpdateSequence maintains the properties tracking the revisions of the
+// events, to-dos and journal entries of a calendar object replacing prev,
+// which is nil for new objects. Components which are new or have changed get
+// their DTSTAMP and LAST-MODIFIED properties set to now. The SEQUENCE of
+// components whose significant properties have changed, as defined in RFC
+// 5546 section 2.1.4, is incremented, unless the client already did so.
+func UpdateSequence(prev, cal *ical.Calendar, now time.Time) {
+	prevComps := make(map[string]*ical.Component)
+	if prev != nil {
+		for _, child := range prev.Children {
+			if hasRevisions(child) {
+				prevComps[revisionID(child)] = child
+			}
+		}
+	}
+
+	now = now.UTC()
+	for _, child := range cal.Children {
+		if !hasRevisions(child) {
+			continue
+		}
+		prevComp := prevComps[revisionID(child)]
+		if prevComp != nil && sameRevision(prevComp, child) {
+			continue
+		}
+
+		child.Props.SetDateTime(ical.PropDateTimeStamp, now)
+		child.Props.SetDateTime(ical.PropLastModified, now)
+		if prevComp == nil || !significantChange(prevComp, child) {
+			continue
+		}
+		if seq := sequence(prevComp); sequence(child) <= seq {
+			prop := ical.NewProp(ical.PropSequence)
+			prop.Value = strconv.Itoa(seq + 1)
+			child.Props.Set(prop)
+		}
+	}
+}
+
+func hasRevisions(comp *ical.Component) bool {
+	switch comp.Name {
+	case ical.CompEvent, ical.CompToDo, ical.CompJournal:
+		return true
+	}
+	return false
+}
+
+// revisionID identifies a component across revisions of a calendar object.
+func revisionID(comp *ical.Component) string {
+	var uid, recurrenceID string
+	if prop := comp.Props.Get(ical.PropUID); prop != nil {
+		uid = prop.Value
+	}
+	if prop := comp.Props.Get(ical.PropRecurrenceID); prop != nil {
+		recurrenceID = prop.Value
+	}
+	return uid + "\x00" + recurrenceID
+}
+
+func sequence(comp *ical.Component) int {
+	prop := comp.Props.Get(ical.PropSequence)
+	if prop == nil {
+		return 0
+	}
+	seq, err := prop.Int()
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// sameRevision reports whether two components only differ by the properties
+// tracking revisions.
+func sameRevision(a, b *ical.Component) bool {
+	return reflect.DeepEqual(contentProps(a), contentProps(b)) && reflect.DeepEqual(a.Children, b.Children)
+}
+
+// significantProps are the properties whose changes require incrementing
+// the SEQUENCE, as defined in RFC 5546 section 2.1.4.
+var significantProps = []string{
+	ical.PropDateTimeStart,
+	ical.PropDateTimeEnd,
+	ical.PropDue,
+	ical.PropDuration,
+	ical.PropRecurrenceRule,
+	ical.PropRecurrenceDates,
+	ical.PropExceptionDates,
+	ical.PropStatus,
+}
+
+// significantChange reports whether the significant properties of two
+// components differ.
+func significantChange(a, b *ical.Component) bool {
+	for _, name := range significantProps {
+		if !reflect.DeepEqual(a.Props[name], b.Props[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func contentProps(comp *ical.Component) ical.Props {
+	props := make(ical.Props)
+	for name, l := range comp.Props {
+		switch name {
+		case ical.PropDateTimeStamp, ical.PropLastModified, ical.PropSequence:
+		default:
+			props[name] = l
+		}
+	}
+	return props
+}
+
+// transform applies transformations to a calendar object about to be stored
+// at objPath.
+func transform(ctx context.Context, transforms []TransformFunc, objPath string, cal *ical.Calendar) error {
+	for _, f := range transforms {
+		if err := f(ctx, path.Dir(objPath), cal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package webdav
+
+import (
+	"fmt"
+)
+
+// Capabilities describes the features enabled by the configuration of a
+// handler, e.g. for admin interfaces or test harnesses deciding which checks
+// to run. It can be encoded to JSON.
+type Capabilities struct {
+	// Compliance lists the compliance classes advertised in the DAV header
+	// of OPTIONS responses.
+	Compliance []string `json:"compliance"`
+	// Features lists the enabled optional features, e.g. "locking" or
+	// "sync-collection".
+	Features []string `json:"features"`
+	// Reports lists the local names of the supported REPORT types, e.g.
+	// "sync-collection".
+	Reports []string `json:"reports"`
+	// Limits lists the configured limits by name, e.g. "propfind-page-size".
+	// Unlimited values are omitted.
+	Limits map[string]int `json:"limits"`
+	// Backends lists the backends used by the handler.
+	Backends []CapabilityBackend `json:"backends"`
+}
+
+// CapabilityBackend describes a backend in Capabilities.
+type CapabilityBackend struct {
+	// Role is the name of the handler field holding the backend, e.g.
+	// "FileSystem".
+	Role string `json:"role"`
+	// Type is the Go type of the backend, e.g. "webdav.LocalFileSystem".
+	Type string `json:"type"`
+	// Prefix is the path the backend is mounted at, if any.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// NewCapabilities creates an empty capability description. It's intended to
+// be used by handlers in other packages, e.g. caldav.Handler.
+func NewCapabilities() *Capabilities {
+	return &Capabilities{
+		Compliance: []string{"1", "3"},
+		Features:   []string{},
+		Reports:    []string{},
+		Limits:     make(map[string]int),
+		Backends:   []CapabilityBackend{},
+	}
+}
+
+// AddFeature adds a feature if enabled is true.
+func (caps *Capabilities) AddFeature(enabled bool, feature string) {
+	if enabled {
+		caps.Features = append(caps.Features, feature)
+	}
+}
+
+// AddLimit adds a limit if it's non-zero.
+func (caps *Capabilities) AddLimit(name string, limit int) {
+	if limit != 0 {
+		caps.Limits[name] = limit
+	}
+}
+
+// AddBackend adds a backend if it's not nil. prefix is the path the backend
+// is mounted at, if any.
+func (caps *Capabilities) AddBackend(role string, backend interface{}, prefix string) {
+	if backend != nil {
+		caps.Backends = append(caps.Backends, CapabilityBackend{
+			Role:   role,
+			Type:   fmt.Sprintf("%T", backend),
+			Prefix: prefix,
+		})
+	}
+}
+
+// Capabilities describes the features enabled by the Handler's configuration
+// and the optional interfaces implemented by its FileSystem.
+func (h *Handler) Capabilities() *Capabilities {
+	caps := NewCapabilities()
+	hasLocks := h.LockSystem != nil || h.WindowsCompat || h.Finder != nil
+	if hasLocks {
+		caps.Compliance = append(caps.Compliance, "2")
+	}
+	if h.PrivilegeChecker != nil {
+		caps.Compliance = append(caps.Compliance, "access-control")
+	}
+
+	_, hasWalk := h.FileSystem.(WalkFileSystem)
+	_, hasStore := optionalFileSystem(h.FileSystem).(DeadPropertyStore)
+	_, hasSync := optionalFileSystem(h.FileSystem).(SyncFileSystem)
+	_, hasAppend := h.FileSystem.(AppendFileSystem)
+	_, hasPosix := optionalFileSystem(h.FileSystem).(PosixFileSystem)
+	_, hasQuota := optionalFileSystem(h.FileSystem).(QuotaProvider)
+	_, hasACLStore := h.PrivilegeChecker.(ACLStore)
+	caps.AddFeature(hasLocks, "locking")
+	caps.AddFeature(hasStore, "dead-properties")
+	caps.AddFeature(hasWalk, "streaming-propfind")
+	caps.AddFeature(hasSync, "sync-collection")
+	caps.AddFeature(hasAppend, "append")
+	caps.AddFeature(hasPosix, "posix-metadata")
+	caps.AddFeature(hasQuota, "quota")
+	caps.AddFeature(h.PrivilegeChecker != nil, "access-control")
+	caps.AddFeature(hasACLStore, "acl")
+	caps.AddFeature(h.IdempotencyStore != nil, "idempotency")
+	caps.AddFeature(h.AuditSink != nil, "audit")
+	caps.AddFeature(h.Visibility != nil, "visibility")
+	caps.AddFeature(h.Listing != nil, "listing")
+	caps.AddFeature(len(h.Overrides) > 0, "overrides")
+	caps.AddFeature(h.Throttle != nil, "throttle")
+	caps.AddFeature(!h.InfiniteDepth.Disabled, "infinite-depth")
+	caps.AddFeature(h.PropFindPageSize > 0, "propfind-paging")
+	caps.AddFeature(h.UserPrincipal != nil, "current-user-principal")
+	caps.AddFeature(h.WindowsCompat, "windows-compat")
+	caps.AddFeature(h.Finder != nil, "finder-compat")
+	caps.AddFeature(h.SortResponses, "sorted-responses")
+
+	if hasSync {
+		caps.Reports = append(caps.Reports, "sync-collection")
+	}
+
+	if !h.InfiniteDepth.Disabled {
+		caps.AddLimit("infinite-depth-max-resources", h.InfiniteDepth.MaxResources)
+		caps.AddLimit("infinite-depth-max-depth", h.InfiniteDepth.MaxDepth)
+	}
+	caps.AddLimit("propfind-page-size", h.PropFindPageSize)
+
+	caps.AddBackend("FileSystem", h.FileSystem, "")
+	caps.AddBackend("LockSystem", h.LockSystem, "")
+	caps.AddBackend("PrivilegeChecker", h.PrivilegeChecker, "")
+	caps.AddBackend("IdempotencyStore", h.IdempotencyStore, "")
+	caps.AddBackend("AuditSink", h.AuditSink, "")
+	caps.AddBackend("UserPrincipal", h.UserPrincipal, "")
+	return caps
+}
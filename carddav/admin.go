@@ -0,0 +1,120 @@
+package carddav
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// AdminAddressBook describes an address book in an AdminReport.
+type AdminAddressBook struct {
+	Path        string `json:"path"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	ObjectCount int    `json:"object_count"`
+	// SyncToken is only reported if the backend implements SyncBackend.
+	SyncToken string `json:"sync_token,omitempty"`
+}
+
+// AdminReport describes the address books of the current user principal.
+type AdminReport struct {
+	Principal              string             `json:"principal"`
+	AddressBookHomeSetPath string             `json:"addressbook_home_set"`
+	AddressBooks           []AdminAddressBook `json:"addressbooks"`
+}
+
+// NewAdminReport inspects the address books of the current user principal
+// using the backend.
+func NewAdminReport(ctx context.Context, backend Backend) (*AdminReport, error) {
+	principal, err := backend.CurrentUserPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	homeSet, err := backend.AddressBookHomeSetPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := backend.ListAddressBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AdminReport{
+		Principal:              principal,
+		AddressBookHomeSetPath: homeSet,
+		AddressBooks:           make([]AdminAddressBook, 0, len(abs)),
+	}
+	for _, ab := range abs {
+		objs, err := backend.ListAddressObjects(ctx, ab.Path, &AddressDataRequest{})
+		if err != nil {
+			return nil, err
+		}
+		var syncToken string
+		if sb, ok := optionalBackend(backend).(SyncBackend); ok {
+			if syncToken, err = sb.AddressBookSyncToken(ctx, ab.Path); err != nil {
+				return nil, err
+			}
+		}
+		report.AddressBooks = append(report.AddressBooks, AdminAddressBook{
+			Path:        ab.Path,
+			Name:        ab.Name,
+			Description: ab.Description,
+			ObjectCount: len(objs),
+			SyncToken:   syncToken,
+		})
+	}
+	return report, nil
+}
+
+// AdminHandler serves a read-only JSON report of the address books of the
+// current user principal, to let operators inspect the state of a backend.
+//
+// The backend is queried with the request context, so AdminHandler should be
+// wrapped with the same authentication middleware as Handler and must not be
+// exposed to untrusted users.
+//
+// Backends can't enumerate principals, so the report only covers the principal
+// of the request. The address books of other principals can be inspected by
+// authenticating as them. Handler doesn't support locks, so none are reported.
+type AdminHandler struct {
+	Backend Backend
+	// ErrorLog and ErrorVerbosity are used like the Handler fields of the
+	// same name.
+	ErrorLog       *log.Logger
+	ErrorVerbosity webdav.ErrorVerbosity
+}
+
+func (h *AdminHandler) errorReporter() *internal.ErrorReporter {
+	return &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(h.ErrorVerbosity),
+		Logger:    h.ErrorLog,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	errs := h.errorReporter()
+	if h.Backend == nil {
+		errs.ServeError(w, r, internal.HTTPErrorf(http.StatusInternalServerError, "carddav: no backend available"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		errs.ServeError(w, r, internal.HTTPErrorf(http.StatusMethodNotAllowed, "carddav: unsupported method"))
+		return
+	}
+
+	report, err := NewAdminReport(r.Context(), h.Backend)
+	if err != nil {
+		errs.ServeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,36 @@
+package carddav
+
+import (
+	"github.com/emersion/go-webdav"
+)
+
+// Capabilities describes the features enabled by the Handler's configuration
+// and the optional interfaces implemented by its Backend.
+func (h *Handler) Capabilities() *webdav.Capabilities {
+	caps := webdav.NewCapabilities()
+	caps.Compliance = append(caps.Compliance, "addressbook")
+
+	_, hasSync := optionalBackend(h.Backend).(SyncBackend)
+	_, hasRaw := h.Backend.(RawBackend)
+	_, hasResolver := optionalBackend(h.Backend).(ObjectPathResolver)
+	caps.AddFeature(hasSync, "sync-collection")
+	caps.AddFeature(hasRaw, "raw-objects")
+	caps.AddFeature(hasResolver, "object-path-resolver")
+	caps.AddFeature(h.IdempotencyStore != nil, "idempotency")
+	caps.AddFeature(h.AuditSink != nil, "audit")
+	caps.AddFeature(h.Visibility != nil, "visibility")
+	caps.AddFeature(h.Listing != nil, "listing")
+	caps.AddFeature(len(h.Overrides) > 0, "overrides")
+	caps.AddFeature(len(h.Transforms) > 0, "transforms")
+	caps.AddFeature(h.SortResponses, "sorted-responses")
+
+	caps.Reports = append(caps.Reports, "addressbook-query", "addressbook-multiget")
+	if hasSync {
+		caps.Reports = append(caps.Reports, "sync-collection")
+	}
+
+	caps.AddBackend("Backend", h.Backend, h.Prefix)
+	caps.AddBackend("IdempotencyStore", h.IdempotencyStore, "")
+	caps.AddBackend("AuditSink", h.AuditSink, "")
+	return caps
+}
@@ -28,6 +28,28 @@ type AddressBook struct {
 	Description          string
 	MaxResourceSize      int64
 	SupportedAddressData []AddressDataType
+	// Encrypted marks an address book whose objects are end-to-end
+	// encrypted by clients: they only carry minimal metadata, such as a UID,
+	// along with an opaque payload. Objects must still be valid vCard data
+	// wrapping the payload, e.g. in an extended property, but they are
+	// stored as is: Transforms don't apply, and addressbook-query filters
+	// aren't evaluated, all objects are returned instead. Backends
+	// implementing RawBackend store them byte-exactly. Clients can set it
+	// when creating an address book.
+	Encrypted bool
+	// CTag is the CalendarServer collection tag, which changes whenever an
+	// address object is created, updated or deleted. Clients use it to check
+	// whether an address book changed since they last fetched it. If empty
+	// and the Backend implements SyncBackend, Handler uses the sync token
+	// instead.
+	CTag string
+}
+
+// AddressBookUpdate describes changes to the properties of an address book.
+// Nil fields are left unchanged, empty values remove the property.
+type AddressBookUpdate struct {
+	Name        *string
+	Description *string
 }
 
 func (ab *AddressBook) SupportsAddressData(contentType, version string) bool {
@@ -78,6 +100,19 @@ type TextMatch struct {
 	Text            string
 	NegateCondition bool
 	MatchType       MatchType // defaults to MatchContains
+	Collation       string    // defaults to "i;unicode-casemap"
+
+	// Component, if set, matches the text against a component of a
+	// structured property value instead of the whole value, e.g. the family
+	// name of N. The text matches if the component or any of its
+	// comma-separated values matches. Components are named after the xCard
+	// elements defined in RFC 6351: "surname", "given", "additional",
+	// "prefix" and "suffix" for N, "pobox", "ext", "street", "locality",
+	// "region", "code" and "country" for ADR, and "sex" and "identity" for
+	// GENDER. It's only used in property filters.
+	//
+	// This is a go-webdav extension: other servers match the whole value.
+	Component string
 }
 
 type FilterTest string
@@ -107,6 +142,20 @@ type AddressObject struct {
 	ContentLength int64
 	ETag          string
 	Card          vcard.Card
+
+	// DownloadName is an optional file name suggested to user agents
+	// downloading the object, sent in the Content-Disposition header.
+	DownloadName string
+}
+
+// RawAddressObject is an address object as raw vCard data, e.g. for proxies and
+// backup tools which need to round-trip objects byte-exactly.
+type RawAddressObject struct {
+	Path        string
+	ModTime     time.Time
+	ETag        string
+	ContentType string
+	Data        []byte
 }
 
 // SyncQuery is the query struct represents a sync-collection request
@@ -121,4 +170,8 @@ type SyncResponse struct {
 	SyncToken string
 	Updated   []AddressObject
 	Deleted   []string
+	// Truncated is set if the server didn't return all changes, e.g. because
+	// of the query limit. The remaining changes can be fetched by repeating
+	// the query with the returned SyncToken.
+	Truncated bool
 }
@@ -1,15 +1,23 @@
 package carddav
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/emersion/go-vcard"
 	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
 )
 
 type testBackend struct{}
@@ -116,6 +124,22 @@ func (*testBackend) DeleteAddressObject(ctx context.Context, path string) error
 	panic("TODO: implement")
 }
 
+func TestBackendProbe(t *testing.T) {
+	probe := BackendProbe(new(testBackend))
+	h := webdav.HealthHandler{
+		Probes: map[string]webdav.HealthProbe{
+			"carddav": func(ctx context.Context) error {
+				return probe(context.WithValue(ctx, addressBookPathKey, "/contacts/"))
+			},
+		},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "carddav: ok\n" {
+		t.Errorf("GET /healthz = %v %q, want %v", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
+
 func TestAddressBookDiscovery(t *testing.T) {
 	for _, tc := range []struct {
 		name                 string
@@ -142,7 +166,7 @@ func TestAddressBookDiscovery(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			ctx := context.Background()
 
-			h := Handler{&testBackend{}, tc.prefix}
+			h := Handler{Backend: &testBackend{}, Prefix: tc.prefix}
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				ctx := r.Context()
 				ctx = context.WithValue(ctx, currentUserPrincipalKey, tc.currentUserPrincipal)
@@ -187,6 +211,557 @@ func TestAddressBookDiscovery(t *testing.T) {
 			if abs[0].Path != tc.addressBookPath {
 				t.Fatalf("Found address book at %s, expected %s", abs[0].Path, tc.addressBookPath)
 			}
+
+			// one-shot discovery falls back to .well-known when the context
+			// path doesn't expose the principal
+			client, err = NewClient(nil, ts.URL+"/unknown/")
+			if err != nil {
+				t.Fatalf("error creating client: %s", err)
+			}
+			d, err := client.DiscoverAddressBooks(ctx)
+			if err != nil {
+				t.Fatalf("error discovering address books: %s", err)
+			}
+			if d.Principal != tc.currentUserPrincipal || d.AddressBookHomeSet != tc.homeSetPath {
+				t.Fatalf("Discovered principal '%s' and home set '%s', expected '%s' and '%s'", d.Principal, d.AddressBookHomeSet, tc.currentUserPrincipal, tc.homeSetPath)
+			}
+			if len(d.AddressBooks) != 1 || d.AddressBooks[0].Description != "Default address book" {
+				t.Fatalf("Discovered address books %+v", d.AddressBooks)
+			}
 		})
 	}
 }
+
+type syncTestBackend struct {
+	testBackend
+}
+
+const syncAlicePath = "/test/contacts/private/alice.vcf"
+
+func (b *syncTestBackend) GetAddressObject(ctx context.Context, path string, req *AddressDataRequest) (*AddressObject, error) {
+	if path != syncAlicePath {
+		return nil, webdav.NewHTTPError(404, fmt.Errorf("Not found"))
+	}
+	ao, err := b.testBackend.GetAddressObject(ctx, alicePath, req)
+	if err != nil {
+		return nil, err
+	}
+	ao.Path = path
+	return ao, nil
+}
+
+func (*syncTestBackend) AddressBookSyncToken(ctx context.Context, path string) (string, error) {
+	return "t2", nil
+}
+
+func (*syncTestBackend) AddressBookChanges(ctx context.Context, path, syncToken string) (*webdav.SyncChanges, error) {
+	switch syncToken {
+	case "":
+		return &webdav.SyncChanges{SyncToken: "t1", Added: []string{syncAlicePath}}, nil
+	case "t1":
+		return &webdav.SyncChanges{SyncToken: "t2", Deleted: []string{"/test/contacts/private/bob.vcf"}}, nil
+	default:
+		return nil, webdav.ErrInvalidSyncToken
+	}
+}
+
+func TestSyncCollection(t *testing.T) {
+	h := Handler{Backend: &syncTestBackend{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, currentUserPrincipalKey, "/test/")
+		ctx = context.WithValue(ctx, homeSetPathKey, "/test/contacts/")
+		ctx = context.WithValue(ctx, addressBookPathKey, "/test/contacts/private")
+		(&h).ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	propfind := internal.NewPropNamePropFind(internal.SyncTokenName)
+	propResp, err := client.ic.PropFindFlat(ctx, "/test/contacts/private", propfind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var syncToken internal.SyncToken
+	if err := propResp.DecodeProp(&syncToken); err != nil || syncToken.Token != "t2" {
+		t.Errorf("sync-token = %q, %v, want %q", syncToken.Token, err, "t2")
+	}
+
+	resp, err := client.SyncCollection(ctx, "/test/contacts/private", &SyncQuery{})
+	if err != nil {
+		t.Fatalf("initial SyncCollection() = %v", err)
+	}
+	if resp.SyncToken != "t1" || len(resp.Updated) != 1 || resp.Updated[0].Path != syncAlicePath || len(resp.Deleted) != 0 {
+		t.Errorf("initial SyncCollection() = %+v", resp)
+	}
+
+	resp, err = client.SyncCollection(ctx, "/test/contacts/private", &SyncQuery{SyncToken: "t1"})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	}
+	if resp.SyncToken != "t2" || len(resp.Updated) != 0 || len(resp.Deleted) != 1 || resp.Deleted[0] != "/test/contacts/private/bob.vcf" {
+		t.Errorf("SyncCollection() = %+v", resp)
+	}
+
+	_, err = client.SyncCollection(ctx, "/test/contacts/private", &SyncQuery{SyncToken: "expired"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("SyncCollection() with invalid token = %v, want 403 error", err)
+	}
+}
+
+func TestMultiGetPartialAddressData(t *testing.T) {
+	h := Handler{Backend: &syncTestBackend{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, currentUserPrincipalKey, "/test/")
+		ctx = context.WithValue(ctx, homeSetPathKey, "/test/contacts/")
+		ctx = context.WithValue(ctx, addressBookPathKey, "/test/contacts/private")
+		(&h).ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aos, err := client.MultiGetAddressBook(context.Background(), "/test/contacts/private", &AddressBookMultiGet{
+		Paths:       []string{syncAlicePath},
+		DataRequest: AddressDataRequest{Props: []string{vcard.FieldFormattedName, "email"}},
+	})
+	if err != nil {
+		t.Fatalf("MultiGetAddressBook() = %v", err)
+	}
+	if len(aos) != 1 {
+		t.Fatalf("MultiGetAddressBook() returned %v objects, want 1", len(aos))
+	}
+
+	card := aos[0].Card
+	if len(card) != 3 || card.Value(vcard.FieldFormattedName) != "Alice Gopher" || card.Value(vcard.FieldEmail) != "alice@example.com" || card.Value(vcard.FieldVersion) != "4.0" {
+		t.Errorf("MultiGetAddressBook() returned card %v, want VERSION, FN and EMAIL", card)
+	}
+}
+
+type putRecorderBackend struct {
+	testBackend
+	puts map[string]vcard.Card
+}
+
+func (b *putRecorderBackend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *PutAddressObjectOptions) (loc string, err error) {
+	b.puts[path] = card
+	return path, nil
+}
+
+func TestTransforms(t *testing.T) {
+	b := &putRecorderBackend{puts: make(map[string]vcard.Card)}
+	h := Handler{Backend: b, Transforms: []TransformFunc{StripExtendedFields}}
+
+	const p = "/test/contacts/private/alice.vcf"
+	req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(strings.Replace(aliceData, "END:VCARD", "X-CLIENT-STATE:private\nEND:VCARD", 1)))
+	req.Header.Set("Content-Type", vcard.MIMEType)
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, currentUserPrincipalKey, "/test/")
+	ctx = context.WithValue(ctx, homeSetPathKey, "/test/contacts/")
+	ctx = context.WithValue(ctx, addressBookPathKey, "/test/contacts/private")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req.WithContext(ctx))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: expected status 201, got %v: %v", w.Code, w.Body.String())
+	}
+
+	card, ok := b.puts[p]
+	if !ok {
+		t.Fatalf("address object wasn't stored")
+	}
+	if card.Get("X-CLIENT-STATE") != nil {
+		t.Errorf("extended field wasn't stripped")
+	}
+	if card.Value(vcard.FieldFormattedName) != "Alice Gopher" {
+		t.Errorf("FN = %q, want %q", card.Value(vcard.FieldFormattedName), "Alice Gopher")
+	}
+}
+
+type createAddressBookBackend struct {
+	testBackend
+	created []AddressBook
+}
+
+func (b *createAddressBookBackend) CreateAddressBook(ctx context.Context, ab AddressBook) error {
+	b.created = append(b.created, ab)
+	return nil
+}
+
+func TestClientCreateAddressBook(t *testing.T) {
+	b := &createAddressBookBackend{}
+	h := Handler{Backend: b}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, currentUserPrincipalKey, "/test/")
+		ctx = context.WithValue(ctx, homeSetPathKey, "/test/contacts/")
+		ctx = context.WithValue(ctx, addressBookPathKey, "/test/contacts/private")
+		(&h).ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := AddressBook{
+		Path:        "/test/contacts/work",
+		Name:        "Work",
+		Description: "Colleagues",
+	}
+	if err := client.CreateAddressBook(context.Background(), &want); err != nil {
+		t.Fatalf("CreateAddressBook() = %v", err)
+	}
+	if len(b.created) != 1 || !reflect.DeepEqual(b.created[0], want) {
+		t.Errorf("CreateAddressBook() created %+v, want %+v", b.created, want)
+	}
+	if err := client.CreateAddressBook(context.Background(), &AddressBook{Path: "/test/contacts/private"}); err == nil {
+		t.Errorf("CreateAddressBook() on existing address book succeeded")
+	}
+}
+
+type deadPropBackend struct {
+	testBackend
+	props map[xml.Name]string
+}
+
+func (b *deadPropBackend) GetDeadProperties(ctx context.Context, path string) (map[xml.Name]string, error) {
+	return b.props, nil
+}
+
+func (b *deadPropBackend) SetDeadProperties(ctx context.Context, path string, props map[xml.Name]string) error {
+	for k, v := range props {
+		b.props[k] = v
+	}
+	return nil
+}
+
+func (b *deadPropBackend) RemoveDeadProperties(ctx context.Context, path string, names []xml.Name) error {
+	for _, k := range names {
+		delete(b.props, k)
+	}
+	return nil
+}
+
+func TestPropPatchDeadProperties(t *testing.T) {
+	b := &deadPropBackend{props: make(map[xml.Name]string)}
+	h := Handler{Backend: b}
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/test/contacts/private", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("Depth", "0")
+		ctx := req.Context()
+		ctx = context.WithValue(ctx, currentUserPrincipalKey, "/test/")
+		ctx = context.WithValue(ctx, homeSetPathKey, "/test/contacts/")
+		ctx = context.WithValue(ctx, addressBookPathKey, "/test/contacts/private")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	w := do("PROPPATCH", `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:set><D:prop>
+		<D:displayname>Friends</D:displayname>
+		<C:addressbook-description>Close friends</C:addressbook-description>
+	</D:prop></D:set>
+</D:propertyupdate>`)
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "403") {
+		t.Fatalf("PROPPATCH = %v: %v", w.Code, w.Body.String())
+	}
+
+	w = do("PROPFIND", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop><D:displayname/><C:addressbook-description/></D:prop>
+</D:propfind>`)
+	for _, v := range []string{"Friends", "Close friends"} {
+		if !strings.Contains(w.Body.String(), v) {
+			t.Errorf("PROPFIND: patched property %q missing from response: %v", v, w.Body.String())
+		}
+	}
+}
+
+func TestMemBackend(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(&Handler{Backend: NewMemBackend("/test/", "/test/contacts/")})
+	defer ts.Close()
+
+	client, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateAddressBook(ctx, &AddressBook{Path: "/test/contacts/work/", Name: "Work"}); err != nil {
+		t.Fatalf("CreateAddressBook() = %v", err)
+	}
+	abs, err := client.FindAddressBooks(ctx, "/test/contacts/")
+	if err != nil {
+		t.Fatalf("FindAddressBooks() = %v", err)
+	} else if len(abs) != 1 || abs[0].Path != "/test/contacts/work/" || abs[0].Name != "Work" {
+		t.Fatalf("FindAddressBooks() = %+v", abs)
+	}
+
+	alice, err := vcard.NewDecoder(strings.NewReader(aliceData)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := "/test/contacts/work/" + alicePath
+	ao, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfNoneMatch: "*"})
+	if err != nil {
+		t.Fatalf("PutAddressObject() = %v", err)
+	}
+	if _, err := client.PutAddressObject(ctx, "/test/contacts/work/alice.vcf", alice); err == nil {
+		t.Errorf("PutAddressObject() with conflicting UID succeeded")
+	}
+
+	initial, err := client.SyncCollection(ctx, "/test/contacts/work/", &SyncQuery{})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	} else if len(initial.Updated) != 1 {
+		t.Fatalf("SyncCollection() returned %v updated objects, want 1", len(initial.Updated))
+	}
+
+	alice.SetValue(vcard.FieldNickname, "gopher")
+	if _, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfMatch: webdav.MatchETag(ao.ETag)}); err != nil {
+		t.Fatalf("PutAddressObject() with matching If-Match = %v", err)
+	}
+	if _, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfMatch: webdav.MatchETag(ao.ETag)}); err == nil {
+		t.Errorf("PutAddressObject() with stale If-Match succeeded")
+	}
+	resp, err := client.SyncCollection(ctx, "/test/contacts/work/", &SyncQuery{SyncToken: initial.SyncToken})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	} else if len(resp.Updated) != 1 || resp.Updated[0].ETag == ao.ETag {
+		t.Errorf("SyncCollection() updated = %+v", resp.Updated)
+	}
+	// The CTag falls back to the sync token
+	if abs, err := client.FindAddressBooks(ctx, "/test/contacts/"); err != nil {
+		t.Fatalf("FindAddressBooks() = %v", err)
+	} else if len(abs) != 1 || abs[0].CTag != resp.SyncToken {
+		t.Errorf("FindAddressBooks() = %+v, want CTag %q", abs, resp.SyncToken)
+	}
+
+	objs, err := client.QueryAddressBook(ctx, "/test/contacts/work/", &AddressBookQuery{
+		PropFilters: []PropFilter{
+			{Name: vcard.FieldNickname, TextMatches: []TextMatch{{Text: "gopher"}}},
+			{Name: vcard.FieldName, TextMatches: []TextMatch{{Text: "gopher", MatchType: MatchEquals, Component: "surname"}}},
+		},
+		FilterTest: FilterAllOf,
+	})
+	if err != nil {
+		t.Fatalf("QueryAddressBook() = %v", err)
+	} else if len(objs) != 1 || objs[0].Path != p {
+		t.Errorf("QueryAddressBook() = %+v", objs)
+	}
+
+	if err := client.RemoveAll(ctx, p); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+	resp, err = client.SyncCollection(ctx, "/test/contacts/work/", &SyncQuery{SyncToken: resp.SyncToken})
+	if err != nil {
+		t.Fatalf("SyncCollection() = %v", err)
+	} else if len(resp.Updated) != 0 || len(resp.Deleted) != 1 || resp.Deleted[0] != p {
+		t.Errorf("SyncCollection() = %+v", resp)
+	}
+	if err := client.DeleteAddressBook(ctx, "/test/contacts/work/"); err != nil {
+		t.Fatalf("DeleteAddressBook() = %v", err)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := NewLocalBackend(dir, "/test/", "/test/contacts/")
+	var logBuf bytes.Buffer
+	backend.ErrorLog = log.New(&logBuf, "", 0)
+	ts := httptest.NewServer(&Handler{Backend: backend})
+	defer ts.Close()
+
+	client, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateAddressBook(ctx, &AddressBook{Path: "/test/contacts/work/", Name: "Work", Description: "Colleagues"}); err != nil {
+		t.Fatalf("CreateAddressBook() = %v", err)
+	}
+	abs, err := client.FindAddressBooks(ctx, "/test/contacts/")
+	if err != nil {
+		t.Fatalf("FindAddressBooks() = %v", err)
+	} else if len(abs) != 1 || abs[0].Path != "/test/contacts/work/" || abs[0].Name != "Work" || abs[0].Description != "Colleagues" {
+		t.Fatalf("FindAddressBooks() = %+v", abs)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "work", "displayname")); err != nil || string(b) != "Work" {
+		t.Errorf("displayname metadata = %q, %v", b, err)
+	}
+
+	alice, err := vcard.NewDecoder(strings.NewReader(aliceData)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := "/test/contacts/work/alice.vcf"
+	ao, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfNoneMatch: "*"})
+	if err != nil {
+		t.Fatalf("PutAddressObject() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "work", "alice.vcf")); err != nil {
+		t.Errorf("object file: %v", err)
+	}
+	if _, err := client.PutAddressObject(ctx, "/test/contacts/work/other.vcf", alice); err == nil {
+		t.Errorf("PutAddressObject() with conflicting UID succeeded")
+	}
+
+	alice.SetValue(vcard.FieldNickname, "gopher")
+	if _, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfMatch: webdav.MatchETag(ao.ETag)}); err != nil {
+		t.Fatalf("PutAddressObject() with matching If-Match = %v", err)
+	}
+	if _, err := client.PutAddressObjectWithOptions(ctx, p, alice, &PutAddressObjectOptions{IfMatch: webdav.MatchETag(ao.ETag)}); err == nil {
+		t.Errorf("PutAddressObject() with stale If-Match succeeded")
+	}
+
+	// Files written by other vdir clients which don't parse are skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, "work", "broken.vcf"), []byte("BEGIN:VCARD\r\nUID:"+alice.Value(vcard.FieldUID)+"\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PutAddressObject(ctx, p, alice); err != nil {
+		t.Errorf("PutAddressObject() with an unparsable file = %v", err)
+	}
+
+	objs, err := client.QueryAddressBook(ctx, "/test/contacts/work/", &AddressBookQuery{
+		PropFilters: []PropFilter{{Name: vcard.FieldNickname, TextMatches: []TextMatch{{Text: "gopher"}}}},
+	})
+	if err != nil {
+		t.Fatalf("QueryAddressBook() = %v", err)
+	} else if len(objs) != 1 || objs[0].Path != p {
+		t.Errorf("QueryAddressBook() = %+v", objs)
+	}
+	if !strings.Contains(logBuf.String(), "broken.vcf") {
+		t.Errorf("unparsable file wasn't logged: %q", logBuf.String())
+	}
+
+	if err := client.DeleteAddressBook(ctx, "/test/contacts/work/"); err != nil {
+		t.Fatalf("DeleteAddressBook() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "work")); !os.IsNotExist(err) {
+		t.Errorf("address book directory wasn't removed: %v", err)
+	}
+}
+
+// streamOnlyBackend fails if address objects aren't listed via
+// AddressObjectStreamer.
+type streamOnlyBackend struct {
+	*LocalBackend
+}
+
+func (b streamOnlyBackend) ListAddressObjects(ctx context.Context, path string, req *AddressDataRequest) ([]AddressObject, error) {
+	return nil, fmt.Errorf("ListAddressObjects called")
+}
+
+func (b streamOnlyBackend) QueryAddressObjects(ctx context.Context, path string, query *AddressBookQuery) ([]AddressObject, error) {
+	return nil, fmt.Errorf("QueryAddressObjects called")
+}
+
+func TestAddressObjectStreamer(t *testing.T) {
+	ctx := context.Background()
+	b := streamOnlyBackend{NewLocalBackend(t.TempDir(), "/test/", "/test/contacts/")}
+	if err := b.CreateAddressBook(ctx, AddressBook{Path: "/test/contacts/work/"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		card := make(vcard.Card)
+		card.SetValue(vcard.FieldVersion, "4.0")
+		card.SetValue(vcard.FieldUID, name)
+		card.SetValue(vcard.FieldFormattedName, name)
+		if _, err := b.PutAddressObject(ctx, "/test/contacts/work/"+name+".vcf", card, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := Handler{Backend: b}
+
+	for _, tc := range []struct {
+		method, body string
+		want         []string
+	}{
+		{"PROPFIND", `<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`, []string{"alice", "bob", "carol"}},
+		{"REPORT", `<c:addressbook-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav">
+  <d:prop><d:getetag/></d:prop>
+  <c:filter><c:prop-filter name="FN"/></c:filter>
+  <c:limit><c:nresults>2</c:nresults></c:limit>
+</c:addressbook-query>`, []string{"alice", "bob"}},
+	} {
+		req := httptest.NewRequest(tc.method, "/test/contacts/work/", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		body := w.Body.String()
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%v = %v: %v", tc.method, w.Code, body)
+			continue
+		}
+		if n := strings.Count(body, ".vcf</"); n != len(tc.want) {
+			t.Errorf("%v response contains %v objects, want %v: %v", tc.method, n, len(tc.want), body)
+		}
+		for _, name := range tc.want {
+			if !strings.Contains(body, "/test/contacts/work/"+name+".vcf") {
+				t.Errorf("%v response doesn't contain %v: %v", tc.method, name, body)
+			}
+		}
+	}
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	mb := NewMemBackend("/test/", "/test/contacts/")
+	keys := webdav.StaticKey(bytes.Repeat([]byte{42}, 32))
+	b := NewEncryptedBackend(mb, keys, []string{"EMAIL"}, nil)
+	ctx := context.Background()
+	if err := mb.CreateAddressBook(ctx, AddressBook{Path: "/test/contacts/work/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := (&Handler{Backend: b}).Capabilities()
+	found := false
+	for _, f := range caps.Features {
+		found = found || f == "sync-collection"
+	}
+	if !found {
+		t.Errorf("Features = %v, want %q", caps.Features, "sync-collection")
+	}
+	if drb, ok := b.(DryRunBackend); !ok || !drb.SupportsDryRun() {
+		t.Errorf("SupportsDryRun() = false, want true")
+	}
+
+	alice, err := vcard.NewDecoder(strings.NewReader(aliceData)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := "/test/contacts/work/" + alicePath
+	if _, err := b.PutAddressObject(ctx, p, alice, nil); err != nil {
+		t.Fatalf("PutAddressObject() = %v", err)
+	}
+	if ao, err := mb.GetAddressObject(ctx, p, &AddressDataRequest{AllProp: true}); err != nil {
+		t.Fatal(err)
+	} else if v := ao.Card.Value(vcard.FieldEmail); strings.Contains(v, "alice") {
+		t.Errorf("stored EMAIL = %q, want encrypted value", v)
+	}
+
+	// Prop-filter names are case-insensitive
+	query := &AddressBookQuery{
+		DataRequest: AddressDataRequest{AllProp: true},
+		PropFilters: []PropFilter{{
+			Name:        "email",
+			TextMatches: []TextMatch{{Text: "alice@"}},
+		}},
+	}
+	if l, err := b.QueryAddressObjects(ctx, "/test/contacts/work/", query); err != nil {
+		t.Fatalf("QueryAddressObjects() = %v", err)
+	} else if len(l) != 1 {
+		t.Errorf("QueryAddressObjects() returned %v objects, want 1", len(l))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
@@ -13,20 +14,36 @@ import (
 
 	"github.com/emersion/go-vcard"
 	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/discovery"
 	"github.com/emersion/go-webdav/internal"
 )
 
 // DiscoverContextURL performs a DNS-based CardDAV service discovery as
 // described in RFC 6352 section 11. It returns the URL to the CardDAV server.
+//
+// To also follow redirects and find the current user principal, use
+// discovery.Discoverer.
 func DiscoverContextURL(ctx context.Context, domain string) (string, error) {
-	return internal.DiscoverContextURL(ctx, "carddavs", domain)
+	u, err := discovery.ContextURL(ctx, nil, discovery.CardDAV, domain)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
 }
 
 // Client provides access to a remote CardDAV server.
 type Client struct {
 	*webdav.Client
 
+	// AllowOtherHosts allows DiscoverAddressBooks to follow an address book
+	// home set hosted on another host than the endpoint of the client. The
+	// HTTP client, including any credentials it adds to requests, is then
+	// used for that host too. Downgrades from HTTPS to HTTP are always
+	// refused.
+	AllowOtherHosts bool
+
 	ic *internal.Client
+	hc webdav.HTTPClient
 }
 
 func NewClient(c webdav.HTTPClient, endpoint string) (*Client, error) {
@@ -38,7 +55,7 @@ func NewClient(c webdav.HTTPClient, endpoint string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{wc, ic}, nil
+	return &Client{Client: wc, ic: ic, hc: c}, nil
 }
 
 func (c *Client) HasSupport(ctx context.Context) error {
@@ -54,18 +71,155 @@ func (c *Client) HasSupport(ctx context.Context) error {
 }
 
 func (c *Client) FindAddressBookHomeSet(ctx context.Context, principal string) (string, error) {
+	u, err := c.addressBookHomeSetURL(ctx, principal)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+// addressBookHomeSetURL returns the URL of the address book home set, which
+// may be on another host.
+func (c *Client) addressBookHomeSetURL(ctx context.Context, principal string) (*url.URL, error) {
 	propfind := internal.NewPropNamePropFind(addressBookHomeSetName)
 	resp, err := c.ic.PropFindFlat(ctx, principal, propfind)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var prop addressbookHomeSet
 	if err := resp.DecodeProp(&prop); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	u := url.URL(prop.Href)
+	return &u, nil
+}
+
+// findCurrentUserPrincipal is like FindCurrentUserPrincipal, but falls back
+// to the well-known URI and the server root for servers which don't expose the
+// principal at the context path.
+func (c *Client) findCurrentUserPrincipal(ctx context.Context) (string, error) {
+	principal, err := c.FindCurrentUserPrincipal(ctx)
+	if err == nil {
+		return principal, nil
+	}
+	for _, p := range []string{"/.well-known/carddav", "/"} {
+		if principal, fallbackErr := c.ic.FindCurrentUserPrincipal(ctx, p); fallbackErr == nil {
+			return principal, nil
+		}
+	}
+	return "", err
+}
+
+// findAddressBookHomeSet is like FindAddressBookHomeSet, but falls back to the
+// context path for servers which only expose the home set there.
+func (c *Client) findAddressBookHomeSet(ctx context.Context, principal string) (*url.URL, error) {
+	homeSet, err := c.addressBookHomeSetURL(ctx, principal)
+	if err == nil {
+		return homeSet, nil
+	}
+	if homeSet, fallbackErr := c.addressBookHomeSetURL(ctx, ""); fallbackErr == nil {
+		return homeSet, nil
+	}
+	return nil, err
+}
+
+// AddressBookDiscovery is the result of Client.DiscoverAddressBooks.
+type AddressBookDiscovery struct {
+	Principal          string
+	AddressBookHomeSet string
+	AddressBooks       []AddressBook
+	// Client gives access to the address books. It's a new client if the
+	// home set is hosted on another server than the principal.
+	Client *Client
+}
+
+// DiscoverAddressBooks finds the current user principal, its address book
+// home set and the address books it contains. Servers exposing the principal
+// only at the well-known URI or the server root, and the home set only at the
+// context path, are supported. A home set on another host is only followed
+// with AllowOtherHosts.
+//
+// If a step fails, a *webdav.DiscoveryError is returned along with the
+// results of the previous steps.
+func (c *Client) DiscoverAddressBooks(ctx context.Context) (*AddressBookDiscovery, error) {
+	var (
+		d   AddressBookDiscovery
+		err error
+	)
+	if d.Principal, err = c.findCurrentUserPrincipal(ctx); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "current-user-principal", Err: err}
+	}
+	homeSet, err := c.findAddressBookHomeSet(ctx, d.Principal)
+	if err != nil {
+		return &d, &webdav.DiscoveryError{Step: "addressbook-home-set", Err: err}
+	}
+	d.AddressBookHomeSet = homeSet.Path
+	if d.Client, err = c.clientForHost(homeSet); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "addressbook-home-set", Err: err}
+	}
+	if d.AddressBooks, err = d.Client.FindAddressBooks(ctx, d.AddressBookHomeSet); err != nil {
+		return &d, &webdav.DiscoveryError{Step: "addressbooks", Err: err}
+	}
+	return &d, nil
+}
+
+// clientForHost returns a client for the host of u, or c if u is on the same
+// host or relative. Other hosts are only allowed with AllowOtherHosts.
+func (c *Client) clientForHost(u *url.URL) (*Client, error) {
+	endpoint := c.ic.ResolveHref("/")
+	if u.Host == "" || u.Host == endpoint.Host {
+		return c, nil
+	}
+	if !c.AllowOtherHosts {
+		return nil, fmt.Errorf("carddav: refusing to follow address book home set on other host %q", u.Host)
+	}
+	if u.Scheme != "" {
+		if endpoint.Scheme == "https" && u.Scheme != "https" {
+			return nil, fmt.Errorf("carddav: refusing to downgrade from https to %v for address book home set on host %q", u.Scheme, u.Host)
+		}
+		endpoint.Scheme = u.Scheme
+	}
+	endpoint.Host = u.Host
+	client, err := NewClient(c.hc, endpoint.String())
+	if err != nil {
+		return nil, err
 	}
+	client.AllowOtherHosts = true
+	return client, nil
+}
 
-	return prop.Href.Path, nil
+// DiscoverOptions contains options for DiscoverAddressBooks.
+type DiscoverOptions struct {
+	// AllowOtherHosts sets Client.AllowOtherHosts.
+	AllowOtherHosts bool
+}
+
+// DiscoverAddressBooks creates a client and discovers address books with
+// Client.DiscoverAddressBooks. endpoint is either the URL of the server, or an
+// email address or a domain for which the server is looked up with
+// discovery.Discover first. opts can be nil.
+//
+// As with Client.DiscoverAddressBooks, the results of the successful steps are
+// returned along with errors.
+func DiscoverAddressBooks(ctx context.Context, c webdav.HTTPClient, endpoint string, opts *DiscoverOptions) (*AddressBookDiscovery, error) {
+	if opts == nil {
+		opts = &DiscoverOptions{}
+	}
+	if !strings.Contains(endpoint, "://") {
+		result, err := discovery.Discover(ctx, c, discovery.CardDAV, endpoint)
+		if err != nil {
+			return &AddressBookDiscovery{}, err
+		}
+		endpoint = result.ContextURL.String()
+	}
+	client, err := NewClient(c, endpoint)
+	if err != nil {
+		return &AddressBookDiscovery{}, err
+	}
+	client.AllowOtherHosts = opts.AllowOtherHosts
+	return client.DiscoverAddressBooks(ctx)
 }
 
 func decodeSupportedAddressData(supported *supportedAddressData) []AddressDataType {
@@ -83,6 +237,8 @@ func (c *Client) FindAddressBooks(ctx context.Context, addressBookHomeSet string
 		addressBookDescriptionName,
 		maxResourceSizeName,
 		supportedAddressDataName,
+		encryptedCollectionName,
+		internal.GetCTagName,
 	)
 	ms, err := c.ic.PropFind(ctx, addressBookHomeSet, internal.DepthOne, propfind)
 	if err != nil {
@@ -127,12 +283,27 @@ func (c *Client) FindAddressBooks(ctx context.Context, addressBookHomeSet string
 			return nil, err
 		}
 
+		var encrypted encryptedCollection
+		isEncrypted := true
+		if err := resp.DecodeProp(&encrypted); internal.IsNotFound(err) {
+			isEncrypted = false
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ctag internal.GetCTag
+		if err := resp.DecodeProp(&ctag); err != nil && !internal.IsNotFound(err) {
+			return nil, err
+		}
+
 		l = append(l, AddressBook{
 			Path:                 path,
 			Name:                 dispName.Name,
 			Description:          desc.Description,
 			MaxResourceSize:      maxResSize.Size,
 			SupportedAddressData: decodeSupportedAddressData(&supported),
+			Encrypted:            isEncrypted,
+			CTag:                 ctag.CTag,
 		})
 	}
 
@@ -194,55 +365,80 @@ func encodeTextMatch(tm *TextMatch) *textMatch {
 		Text:            tm.Text,
 		NegateCondition: negateCondition(tm.NegateCondition),
 		MatchType:       matchType(tm.MatchType),
+		Collation:       tm.Collation,
+		Component:       tm.Component,
 	}
 }
 
-func decodeAddressList(ms *internal.MultiStatus) ([]AddressObject, error) {
-	addrs := make([]AddressObject, 0, len(ms.Responses))
-	for _, resp := range ms.Responses {
-		path, err := resp.Path()
-		if err != nil {
-			return nil, err
-		}
+func decodeAddressObject(resp *internal.Response) (*AddressObject, error) {
+	path, err := resp.Path()
+	if err != nil {
+		return nil, err
+	}
 
-		var addrData addressDataResp
-		if err := resp.DecodeProp(&addrData); err != nil {
-			return nil, err
-		}
+	var addrData addressDataResp
+	if err := resp.DecodeProp(&addrData); err != nil {
+		return nil, err
+	}
 
-		var getLastMod internal.GetLastModified
-		if err := resp.DecodeProp(&getLastMod); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getLastMod internal.GetLastModified
+	if err := resp.DecodeProp(&getLastMod); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		var getETag internal.GetETag
-		if err := resp.DecodeProp(&getETag); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getETag internal.GetETag
+	if err := resp.DecodeProp(&getETag); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		var getContentLength internal.GetContentLength
-		if err := resp.DecodeProp(&getContentLength); err != nil && !internal.IsNotFound(err) {
-			return nil, err
-		}
+	var getContentLength internal.GetContentLength
+	if err := resp.DecodeProp(&getContentLength); err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
 
-		r := bytes.NewReader(addrData.Data)
-		card, err := vcard.NewDecoder(r).Decode()
-		if err != nil {
-			return nil, err
-		}
+	r := bytes.NewReader(addrData.Data)
+	card, err := vcard.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, &webdav.ResponseError{Path: path, Err: err, Data: addrData.Data}
+	}
 
-		addrs = append(addrs, AddressObject{
-			Path:          path,
-			ModTime:       time.Time(getLastMod.LastModified),
-			ContentLength: getContentLength.Length,
-			ETag:          string(getETag.ETag),
-			Card:          card,
-		})
+	return &AddressObject{
+		Path:          path,
+		ModTime:       time.Time(getLastMod.LastModified),
+		ContentLength: getContentLength.Length,
+		ETag:          string(getETag.ETag),
+		Card:          card,
+	}, nil
+}
+
+func decodeAddressList(ms *internal.MultiStatus) ([]AddressObject, error) {
+	l := make([]AddressObject, 0, len(ms.Responses))
+	var partialErr webdav.PartialError
+	for i := range ms.Responses {
+		resp := &ms.Responses[i]
+		obj, err := decodeAddressObject(resp)
+		if respErr, ok := err.(*webdav.ResponseError); ok {
+			partialErr.Errors = append(partialErr.Errors, *respErr)
+			continue
+		} else if err != nil {
+			path, _ := resp.Path()
+			partialErr.Errors = append(partialErr.Errors, webdav.ResponseError{Path: path, Err: err})
+			continue
+		}
+		l = append(l, *obj)
 	}
 
-	return addrs, nil
+	if len(partialErr.Errors) > 0 {
+		return l, &partialErr
+	}
+	return l, nil
 }
 
+// QueryAddressBook performs an addressbook-query REPORT request.
+//
+// If some objects can't be retrieved or decoded, a *webdav.PartialError is
+// returned along with the other objects. The raw payload of objects which
+// can't be parsed is available in the PartialError.
 func (c *Client) QueryAddressBook(ctx context.Context, addressBook string, query *AddressBookQuery) ([]AddressObject, error) {
 	propReq, err := encodeAddressPropReq(&query.DataRequest)
 	if err != nil {
@@ -262,14 +458,14 @@ func (c *Client) QueryAddressBook(ctx context.Context, addressBook string, query
 		addressbookQuery.Limit = &limit{NResults: uint(query.Limit)}
 	}
 
-	req, err := c.ic.NewXMLRequest("REPORT", addressBook, &addressbookQuery)
+	req, err := c.ic.NewXMLRequest(ctx, "REPORT", addressBook, &addressbookQuery)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Depth", "1")
 
-	ms, err := c.ic.DoMultiStatus(req.WithContext(ctx))
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
@@ -277,6 +473,11 @@ func (c *Client) QueryAddressBook(ctx context.Context, addressBook string, query
 	return decodeAddressList(ms)
 }
 
+// MultiGetAddressBook performs an addressbook-multiget REPORT request.
+//
+// If some objects can't be retrieved or decoded, a *webdav.PartialError is
+// returned along with the other objects. The raw payload of objects which
+// can't be parsed is available in the PartialError.
 func (c *Client) MultiGetAddressBook(ctx context.Context, path string, multiGet *AddressBookMultiGet) ([]AddressObject, error) {
 	propReq, err := encodeAddressPropReq(&multiGet.DataRequest)
 	if err != nil {
@@ -295,14 +496,14 @@ func (c *Client) MultiGetAddressBook(ctx context.Context, path string, multiGet
 		}
 	}
 
-	req, err := c.ic.NewXMLRequest("REPORT", path, &addressbookMultiget)
+	req, err := c.ic.NewXMLRequest(ctx, "REPORT", path, &addressbookMultiget)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Depth", "1")
 
-	ms, err := c.ic.DoMultiStatus(req.WithContext(ctx))
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
@@ -343,20 +544,95 @@ func populateAddressObject(ao *AddressObject, h http.Header) error {
 	return nil
 }
 
-func (c *Client) GetAddressObject(ctx context.Context, path string) (*AddressObject, error) {
-	req, err := c.ic.NewRequest(http.MethodGet, path, nil)
+// CreateAddressBook creates an address book with an extended MKCOL request,
+// as defined in RFC 5689. The name and description of the address book are
+// set, if any.
+func (c *Client) CreateAddressBook(ctx context.Context, addressBook *AddressBook) error {
+	values := []interface{}{
+		internal.NewResourceType(internal.CollectionName, addressBookName),
+	}
+	if addressBook.Name != "" {
+		values = append(values, &internal.DisplayName{Name: addressBook.Name})
+	}
+	if addressBook.Description != "" {
+		values = append(values, &addressbookDescription{Description: addressBook.Description})
+	}
+	if addressBook.Encrypted {
+		values = append(values, &encryptedCollection{})
+	}
+	prop, err := internal.EncodeProp(values...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("Accept", vcard.MIMEType)
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	m := mkcolReq{Set: &internal.Set{Prop: *prop}}
+	req, err := c.ic.NewXMLRequest(ctx, "MKCOL", addressBook.Path, &m)
+	if err != nil {
+		return err
+	}
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// UpdateAddressBook changes the properties of an address book with a
+// PROPPATCH request.
+func (c *Client) UpdateAddressBook(ctx context.Context, path string, update *AddressBookUpdate) error {
+	var set, remove []interface{}
+	add := func(value string, v interface{}) {
+		if value == "" {
+			remove = append(remove, v)
+		} else {
+			set = append(set, v)
+		}
+	}
+	if update.Name != nil {
+		add(*update.Name, &internal.DisplayName{Name: *update.Name})
+	}
+	if update.Description != nil {
+		add(*update.Description, &addressbookDescription{Description: *update.Description})
+	}
+
+	var pu internal.PropertyUpdate
+	if len(set) > 0 {
+		prop, err := internal.EncodeProp(set...)
+		if err != nil {
+			return err
+		}
+		pu.Set = []internal.Set{{Prop: *prop}}
+	}
+	if len(remove) > 0 {
+		prop, err := internal.EncodeProp(remove...)
+		if err != nil {
+			return err
+		}
+		pu.Remove = []internal.Remove{{Prop: *prop}}
+	}
+	if len(pu.Set) == 0 && len(pu.Remove) == 0 {
+		return nil
+	}
+	return c.ic.PropPatch(ctx, path, &pu)
+}
+
+// DeleteAddressBook deletes an address book and all of its address objects.
+func (c *Client) DeleteAddressBook(ctx context.Context, path string) error {
+	return c.Client.RemoveAll(ctx, path)
+}
+
+// GetAddressObject fetches an address object.
+//
+// If the address object can't be parsed, a *webdav.ResponseError carrying
+// its raw payload is returned.
+func (c *Client) GetAddressObject(ctx context.Context, path string) (*AddressObject, error) {
+	raw, err := c.GetAddressObjectRaw(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	mediaType, _, err := mime.ParseMediaType(raw.ContentType)
 	if err != nil {
 		return nil, err
 	}
@@ -364,24 +640,62 @@ func (c *Client) GetAddressObject(ctx context.Context, path string) (*AddressObj
 		return nil, fmt.Errorf("carddav: expected Content-Type %q, got %q", vcard.MIMEType, mediaType)
 	}
 
-	card, err := vcard.NewDecoder(resp.Body).Decode()
+	card, err := vcard.NewDecoder(bytes.NewReader(raw.Data)).Decode()
+	if err != nil {
+		return nil, &webdav.ResponseError{Path: raw.Path, Err: err, Data: raw.Data}
+	}
+
+	return &AddressObject{
+		Path:          raw.Path,
+		ModTime:       raw.ModTime,
+		ContentLength: int64(len(raw.Data)),
+		ETag:          raw.ETag,
+		Card:          card,
+	}, nil
+}
+
+// GetAddressObjectRaw fetches an address object without parsing it.
+func (c *Client) GetAddressObjectRaw(ctx context.Context, path string) (*RawAddressObject, error) {
+	req, err := c.ic.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", vcard.MIMEType)
+
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	ao := &AddressObject{
-		Path: resp.Request.URL.Path,
-		Card: card,
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	if err := populateAddressObject(ao, resp.Header); err != nil {
+
+	ao := AddressObject{Path: resp.Request.URL.Path}
+	if err := populateAddressObject(&ao, resp.Header); err != nil {
 		return nil, err
 	}
-	return ao, nil
+	return &RawAddressObject{
+		Path:        ao.Path,
+		ModTime:     ao.ModTime,
+		ETag:        ao.ETag,
+		ContentType: resp.Header.Get("Content-Type"),
+		Data:        data,
+	}, nil
 }
 
+// PutAddressObject uploads an address object.
 func (c *Client) PutAddressObject(ctx context.Context, path string, card vcard.Card) (*AddressObject, error) {
-	// TODO: add support for If-None-Match and If-Match
+	return c.PutAddressObjectWithOptions(ctx, path, card, nil)
+}
 
+// PutAddressObjectWithOptions uploads an address object. opts can be nil.
+// The IfMatch and IfNoneMatch options make the request conditional, e.g.
+// IfNoneMatch "*" only creates new objects. DryRun asks the server to only
+// validate the object.
+func (c *Client) PutAddressObjectWithOptions(ctx context.Context, path string, card vcard.Card, opts *PutAddressObjectOptions) (*AddressObject, error) {
 	// TODO: some servers want a Content-Length header, so we can't stream the
 	// request body here. See the Radicale issue:
 	// https://github.com/Kozea/Radicale/issues/1016
@@ -397,24 +711,55 @@ func (c *Client) PutAddressObject(ctx context.Context, path string, card vcard.C
 		return nil, err
 	}
 
-	req, err := c.ic.NewRequest(http.MethodPut, path, &buf)
+	raw, err := c.PutAddressObjectRawWithOptions(ctx, path, buf.Bytes(), vcard.MIMEType, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &AddressObject{
+		Path:    raw.Path,
+		ModTime: raw.ModTime,
+		ETag:    raw.ETag,
+	}, nil
+}
+
+// PutAddressObjectRaw uploads an address object as-is. The returned object
+// doesn't carry any data.
+func (c *Client) PutAddressObjectRaw(ctx context.Context, path string, data []byte, contentType string) (*RawAddressObject, error) {
+	return c.PutAddressObjectRawWithOptions(ctx, path, data, contentType, nil)
+}
+
+// PutAddressObjectRawWithOptions uploads an address object as-is, like
+// PutAddressObjectWithOptions. The returned object doesn't carry any data.
+// opts can be nil.
+func (c *Client) PutAddressObjectRawWithOptions(ctx context.Context, path string, data []byte, contentType string, opts *PutAddressObjectOptions) (*RawAddressObject, error) {
+	req, err := c.ic.NewRequest(ctx, http.MethodPut, path, bytes.NewReader(data))
 	if err != nil {
-		//pr.Close()
 		return nil, err
 	}
-	req.Header.Set("Content-Type", vcard.MIMEType)
+	req.Header.Set("Content-Type", contentType)
+	if opts != nil {
+		internal.SetConditional(req, string(opts.IfMatch), string(opts.IfNoneMatch))
+		if opts.DryRun {
+			req.Header.Set("Prefer", internal.PreferDryRun)
+		}
+	}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	resp.Body.Close()
 
-	ao := &AddressObject{Path: path}
-	if err := populateAddressObject(ao, resp.Header); err != nil {
+	ao := AddressObject{Path: path}
+	if err := populateAddressObject(&ao, resp.Header); err != nil {
 		return nil, err
 	}
-	return ao, nil
+	return &RawAddressObject{
+		Path:        ao.Path,
+		ModTime:     ao.ModTime,
+		ETag:        ao.ETag,
+		ContentType: contentType,
+	}, nil
 }
 
 // SyncCollection performs a collection synchronization operation on the
@@ -437,6 +782,11 @@ func (c *Client) SyncCollection(ctx context.Context, path string, query *SyncQue
 
 	ret := &SyncResponse{SyncToken: ms.SyncToken}
 	for _, resp := range ms.Responses {
+		if resp.IsTruncated() {
+			ret.Truncated = true
+			continue
+		}
+
 		p, err := resp.Path()
 		if err != nil {
 			if err, ok := err.(*internal.HTTPError); ok && err.Code == http.StatusNotFound {
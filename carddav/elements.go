@@ -7,7 +7,10 @@ import (
 	"github.com/emersion/go-webdav/internal"
 )
 
-const namespace = "urn:ietf:params:xml:ns:carddav"
+const (
+	namespace         = "urn:ietf:params:xml:ns:carddav"
+	goWebDAVNamespace = "https://github.com/emersion/go-webdav"
+)
 
 var (
 	addressBookHomeSetName = xml.Name{namespace, "addressbook-home-set"}
@@ -16,11 +19,14 @@ var (
 	addressBookDescriptionName = xml.Name{namespace, "addressbook-description"}
 	supportedAddressDataName   = xml.Name{namespace, "supported-address-data"}
 	maxResourceSizeName        = xml.Name{namespace, "max-resource-size"}
+	supportedCollationSetName  = xml.Name{namespace, "supported-collation-set"}
 
 	addressBookQueryName    = xml.Name{namespace, "addressbook-query"}
 	addressBookMultigetName = xml.Name{namespace, "addressbook-multiget"}
 
 	addressDataName = xml.Name{namespace, "address-data"}
+
+	encryptedCollectionName = xml.Name{goWebDAVNamespace, "encrypted-collection"}
 )
 
 // https://tools.ietf.org/html/rfc6352#section-6.2.3
@@ -33,6 +39,11 @@ func (a *addressbookHomeSet) GetXMLName() xml.Name {
 	return addressBookHomeSetName
 }
 
+// encryptedCollection marks collections holding end-to-end encrypted objects.
+type encryptedCollection struct {
+	XMLName xml.Name `xml:"https://github.com/emersion/go-webdav encrypted-collection"`
+}
+
 type addressbookDescription struct {
 	XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:carddav addressbook-description"`
 	Description string   `xml:",chardata"`
@@ -56,6 +67,12 @@ type maxResourceSize struct {
 	Size    int64    `xml:",chardata"`
 }
 
+// https://tools.ietf.org/html/rfc6352#section-8.3.1
+type supportedCollationSet struct {
+	XMLName    xml.Name `xml:"urn:ietf:params:xml:ns:carddav supported-collation-set"`
+	Collations []string `xml:"supported-collation"`
+}
+
 // https://tools.ietf.org/html/rfc6352#section-10.3
 type addressbookQuery struct {
 	XMLName  xml.Name       `xml:"urn:ietf:params:xml:ns:carddav addressbook-query"`
@@ -103,6 +120,7 @@ type textMatch struct {
 	Collation       string          `xml:"collation,attr,omitempty"`
 	NegateCondition negateCondition `xml:"negate-condition,attr,omitempty"`
 	MatchType       matchType       `xml:"match-type,attr,omitempty"`
+	Component       string          `xml:"https://github.com/emersion/go-webdav component,attr,omitempty"`
 }
 
 type negateCondition bool
@@ -192,8 +210,9 @@ type addressDataResp struct {
 }
 
 type reportReq struct {
-	Query    *addressbookQuery
-	Multiget *addressbookMultiget
+	Query          *addressbookQuery
+	Multiget       *addressbookMultiget
+	SyncCollection *internal.SyncCollectionQuery
 }
 
 func (r *reportReq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -205,6 +224,9 @@ func (r *reportReq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	case addressBookMultigetName:
 		r.Multiget = &addressbookMultiget{}
 		v = r.Multiget
+	case internal.SyncCollectionName:
+		r.SyncCollection = &internal.SyncCollectionQuery{}
+		v = r.SyncCollection
 	default:
 		return fmt.Errorf("carddav: unsupported REPORT root %q %q", start.Name.Space, start.Name.Local)
 	}
@@ -212,10 +234,8 @@ func (r *reportReq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return d.DecodeElement(v, &start)
 }
 
+// https://tools.ietf.org/html/rfc5689#section-5.1
 type mkcolReq struct {
-	XMLName      xml.Name               `xml:"DAV: mkcol"`
-	ResourceType internal.ResourceType  `xml:"set>prop>resourcetype"`
-	DisplayName  string                 `xml:"set>prop>displayname"`
-	Description  addressbookDescription `xml:"set>prop>addressbook-description"`
-	// TODO this could theoretically contain all addressbook properties?
+	XMLName xml.Name      `xml:"DAV: mkcol"`
+	Set     *internal.Set `xml:"DAV: set,omitempty"`
 }
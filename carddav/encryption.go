@@ -0,0 +1,206 @@
+package carddav
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+type encryptedBackend struct {
+	Backend
+	keys  webdav.KeyProvider
+	props map[string]bool
+	opts  webdav.EncryptionOptions
+}
+
+// NewEncryptedBackend returns a Backend encrypting the values of the given
+// properties, e.g. NOTE and ADR, before address objects are stored in
+// backend. Values are decrypted when objects are retrieved. Unless
+// opts.RejectPlaintext is set, values which aren't encrypted are returned as
+// is.
+//
+// Encrypted values are bound to the path of their address object, so backend
+// must store objects at the path they're created with. The backend can't
+// interpret encrypted values. Queries filtering on encrypted properties are
+// evaluated after decrypting all the objects of the address book.
+//
+// The optional interfaces of backend which don't handle address data, such as
+// SyncBackend or webdav.DeadPropertyStore, are forwarded. DryRunBackend and
+// AddressObjectStreamer are supported if backend supports them, decrypting
+// objects as needed. RawBackend isn't exposed, since it would bypass
+// encryption.
+func NewEncryptedBackend(backend Backend, keys webdav.KeyProvider, props []string, opts *webdav.EncryptionOptions) Backend {
+	if opts == nil {
+		opts = &webdav.EncryptionOptions{}
+	}
+	m := make(map[string]bool, len(props))
+	for _, name := range props {
+		m[strings.ToUpper(name)] = true
+	}
+	return &encryptedBackend{backend, keys, m, *opts}
+}
+
+// mapFields returns a copy of card where the values of the encrypted
+// properties have been replaced with f.
+func (b *encryptedBackend) mapFields(card vcard.Card, f func(string) (string, error)) (vcard.Card, error) {
+	out := make(vcard.Card, len(card))
+	for name, fields := range card {
+		if !b.props[name] {
+			out[name] = fields
+			continue
+		}
+		l := make([]*vcard.Field, len(fields))
+		for i, field := range fields {
+			v, err := f(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			encField := *field
+			encField.Value = v
+			l[i] = &encField
+		}
+		out[name] = l
+	}
+	return out, nil
+}
+
+func (b *encryptedBackend) decryptObjects(ctx context.Context, l []AddressObject) error {
+	for i := range l {
+		card, err := b.mapFields(l[i].Card, func(v string) (string, error) {
+			return internal.DecryptText(ctx, b.keys, v, []byte(l[i].Path), b.opts.RejectPlaintext)
+		})
+		if err != nil {
+			return err
+		}
+		l[i].Card = card
+	}
+	return nil
+}
+
+var (
+	_ DryRunBackend         = (*encryptedBackend)(nil)
+	_ AddressObjectStreamer = (*encryptedBackend)(nil)
+)
+
+func (b *encryptedBackend) unwrapBackend() Backend {
+	return b.Backend
+}
+
+// filtersEncryptedProps reports whether a query needs to inspect the value of
+// encrypted properties.
+func (b *encryptedBackend) filtersEncryptedProps(query *AddressBookQuery) bool {
+	if query == nil {
+		return false
+	}
+	for _, pf := range query.PropFilters {
+		if b.props[strings.ToUpper(pf.Name)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *encryptedBackend) GetAddressObject(ctx context.Context, path string, req *AddressDataRequest) (*AddressObject, error) {
+	ao, err := b.Backend.GetAddressObject(ctx, path, req)
+	if err != nil {
+		return nil, err
+	}
+	l := []AddressObject{*ao}
+	if err := b.decryptObjects(ctx, l); err != nil {
+		return nil, err
+	}
+	return &l[0], nil
+}
+
+func (b *encryptedBackend) ListAddressObjects(ctx context.Context, path string, req *AddressDataRequest) ([]AddressObject, error) {
+	l, err := b.Backend.ListAddressObjects(ctx, path, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.decryptObjects(ctx, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (b *encryptedBackend) QueryAddressObjects(ctx context.Context, path string, query *AddressBookQuery) ([]AddressObject, error) {
+	if !b.filtersEncryptedProps(query) {
+		l, err := b.Backend.QueryAddressObjects(ctx, path, query)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.decryptObjects(ctx, l); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	l, err := b.ListAddressObjects(ctx, path, &AddressDataRequest{AllProp: true})
+	if err != nil {
+		return nil, err
+	}
+	return Filter(query, l)
+}
+
+func (b *encryptedBackend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *PutAddressObjectOptions) (loc string, err error) {
+	card, err = b.mapFields(card, func(v string) (string, error) {
+		return internal.EncryptText(ctx, b.keys, v, []byte(path))
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.Backend.PutAddressObject(ctx, path, card, opts)
+}
+
+func (b *encryptedBackend) SupportsDryRun() bool {
+	drb, ok := b.Backend.(DryRunBackend)
+	return ok && drb.SupportsDryRun()
+}
+
+func (b *encryptedBackend) ListAddressObjectsStream(ctx context.Context, path string, req *AddressDataRequest, fn func(ao *AddressObject) error) error {
+	streamer, ok := b.Backend.(AddressObjectStreamer)
+	if !ok {
+		l, err := b.ListAddressObjects(ctx, path, req)
+		if err != nil {
+			return err
+		}
+		return forEachAddressObject(l, fn)
+	}
+	return streamer.ListAddressObjectsStream(ctx, path, req, b.decryptFunc(ctx, fn))
+}
+
+func (b *encryptedBackend) QueryAddressObjectsStream(ctx context.Context, path string, query *AddressBookQuery, fn func(ao *AddressObject) error) error {
+	streamer, ok := b.Backend.(AddressObjectStreamer)
+	if !ok || b.filtersEncryptedProps(query) {
+		l, err := b.QueryAddressObjects(ctx, path, query)
+		if err != nil {
+			return err
+		}
+		return forEachAddressObject(l, fn)
+	}
+	return streamer.QueryAddressObjectsStream(ctx, path, query, b.decryptFunc(ctx, fn))
+}
+
+// decryptFunc returns a function decrypting address objects before passing
+// them to fn.
+func (b *encryptedBackend) decryptFunc(ctx context.Context, fn func(ao *AddressObject) error) func(ao *AddressObject) error {
+	return func(ao *AddressObject) error {
+		l := []AddressObject{*ao}
+		if err := b.decryptObjects(ctx, l); err != nil {
+			return err
+		}
+		return fn(&l[0])
+	}
+}
+
+func forEachAddressObject(l []AddressObject, fn func(ao *AddressObject) error) error {
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
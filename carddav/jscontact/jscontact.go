@@ -0,0 +1,369 @@
+// Package jscontact converts between vCard and JSContact.
+//
+// JSContact is defined in RFC 9553. Only the most common properties are
+// converted.
+package jscontact
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+)
+
+const utcDateTimeLayout = "2006-01-02T15:04:05Z"
+
+// Component is a name or address component.
+type Component struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Name is a JSContact name.
+type Name struct {
+	Components []Component `json:"components,omitempty"`
+	Full       string      `json:"full,omitempty"`
+}
+
+// EmailAddress is a JSContact email address.
+type EmailAddress struct {
+	Address  string          `json:"address"`
+	Contexts map[string]bool `json:"contexts,omitempty"`
+	Pref     int             `json:"pref,omitempty"`
+}
+
+// Phone is a JSContact phone number.
+type Phone struct {
+	Number   string          `json:"number"`
+	Features map[string]bool `json:"features,omitempty"`
+	Contexts map[string]bool `json:"contexts,omitempty"`
+	Pref     int             `json:"pref,omitempty"`
+}
+
+// Address is a JSContact address.
+type Address struct {
+	Components []Component     `json:"components,omitempty"`
+	Contexts   map[string]bool `json:"contexts,omitempty"`
+	Pref       int             `json:"pref,omitempty"`
+}
+
+// Organization is a JSContact organization.
+type Organization struct {
+	Name string `json:"name"`
+}
+
+// Title is a JSContact title.
+type Title struct {
+	Name string `json:"name"`
+}
+
+// Note is a JSContact note.
+type Note struct {
+	Note string `json:"note"`
+}
+
+// Card is a JSContact card.
+type Card struct {
+	Type          string                  `json:"@type"`
+	Version       string                  `json:"version"`
+	UID           string                  `json:"uid"`
+	Kind          string                  `json:"kind,omitempty"`
+	Updated       string                  `json:"updated,omitempty"`
+	Name          *Name                   `json:"name,omitempty"`
+	Emails        map[string]EmailAddress `json:"emails,omitempty"`
+	Phones        map[string]Phone        `json:"phones,omitempty"`
+	Addresses     map[string]Address      `json:"addresses,omitempty"`
+	Organizations map[string]Organization `json:"organizations,omitempty"`
+	Titles        map[string]Title        `json:"titles,omitempty"`
+	Notes         map[string]Note         `json:"notes,omitempty"`
+	Keywords      map[string]bool         `json:"keywords,omitempty"`
+}
+
+// vCard N components, in order.
+var nameKinds = []string{"surname", "given", "given2", "title", "credential"}
+
+// vCard ADR components, in order. The extended address is mapped to the
+// apartment component.
+var addressKinds = []string{"postOfficeBox", "apartment", "name", "locality", "region", "postcode", "country"}
+
+// vCard TEL types mapped to JSContact phone features.
+var phoneFeatures = []string{"voice", "fax", "cell", "video", "pager", "text", "textphone"}
+
+// FromCard converts a vCard to a JSContact card.
+func FromCard(card vcard.Card) (*Card, error) {
+	uid := card.Value(vcard.FieldUID)
+	if uid == "" {
+		return nil, fmt.Errorf("jscontact: missing %v", vcard.FieldUID)
+	}
+
+	c := &Card{
+		Type:    "Card",
+		Version: "1.0",
+		UID:     uid,
+		Kind:    strings.ToLower(card.Value(vcard.FieldKind)),
+	}
+
+	rev, err := card.Revision()
+	if err != nil {
+		return nil, err
+	}
+	if !rev.IsZero() {
+		c.Updated = rev.UTC().Format(utcDateTimeLayout)
+	}
+
+	if fn, n := card.Value(vcard.FieldFormattedName), card.Name(); fn != "" || n != nil {
+		c.Name = &Name{Full: fn}
+		if n != nil {
+			values := []string{n.FamilyName, n.GivenName, n.AdditionalName, n.HonorificPrefix, n.HonorificSuffix}
+			c.Name.Components = components(nameKinds, values)
+		}
+	}
+
+	for i, f := range card[vcard.FieldEmail] {
+		if c.Emails == nil {
+			c.Emails = make(map[string]EmailAddress)
+		}
+		c.Emails["e"+strconv.Itoa(i+1)] = EmailAddress{
+			Address:  f.Value,
+			Contexts: contexts(f.Params),
+			Pref:     pref(f.Params),
+		}
+	}
+
+	for i, f := range card[vcard.FieldTelephone] {
+		if c.Phones == nil {
+			c.Phones = make(map[string]Phone)
+		}
+		phone := Phone{
+			Number:   f.Value,
+			Contexts: contexts(f.Params),
+			Pref:     pref(f.Params),
+		}
+		for _, feature := range phoneFeatures {
+			if f.Params.HasType(feature) {
+				if phone.Features == nil {
+					phone.Features = make(map[string]bool)
+				}
+				phone.Features[feature] = true
+			}
+		}
+		c.Phones["p"+strconv.Itoa(i+1)] = phone
+	}
+
+	for i, adr := range card.Addresses() {
+		if c.Addresses == nil {
+			c.Addresses = make(map[string]Address)
+		}
+		values := []string{adr.PostOfficeBox, adr.ExtendedAddress, adr.StreetAddress, adr.Locality, adr.Region, adr.PostalCode, adr.Country}
+		c.Addresses["a"+strconv.Itoa(i+1)] = Address{
+			Components: components(addressKinds, values),
+			Contexts:   contexts(adr.Params),
+			Pref:       pref(adr.Params),
+		}
+	}
+
+	for i, f := range card[vcard.FieldOrganization] {
+		if c.Organizations == nil {
+			c.Organizations = make(map[string]Organization)
+		}
+		// Organizational units are dropped
+		name := strings.SplitN(f.Value, ";", 2)[0]
+		c.Organizations["o"+strconv.Itoa(i+1)] = Organization{Name: name}
+	}
+
+	for i, f := range card[vcard.FieldTitle] {
+		if c.Titles == nil {
+			c.Titles = make(map[string]Title)
+		}
+		c.Titles["t"+strconv.Itoa(i+1)] = Title{Name: f.Value}
+	}
+
+	for i, f := range card[vcard.FieldNote] {
+		if c.Notes == nil {
+			c.Notes = make(map[string]Note)
+		}
+		c.Notes["n"+strconv.Itoa(i+1)] = Note{Note: f.Value}
+	}
+
+	for _, f := range card[vcard.FieldCategories] {
+		for _, k := range strings.Split(f.Value, ",") {
+			if k == "" {
+				continue
+			}
+			if c.Keywords == nil {
+				c.Keywords = make(map[string]bool)
+			}
+			c.Keywords[k] = true
+		}
+	}
+
+	return c, nil
+}
+
+// ToCard converts a JSContact card to a vCard 4.0.
+func ToCard(c *Card) (vcard.Card, error) {
+	if c.UID == "" {
+		return nil, fmt.Errorf("jscontact: missing uid")
+	}
+
+	card := make(vcard.Card)
+	card.SetValue(vcard.FieldVersion, "4.0")
+	card.SetValue(vcard.FieldUID, c.UID)
+	if c.Kind != "" {
+		card.SetValue(vcard.FieldKind, c.Kind)
+	}
+	if c.Updated != "" {
+		t, err := time.Parse(utcDateTimeLayout, c.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("jscontact: invalid updated: %w", err)
+		}
+		card.SetRevision(t)
+	}
+
+	// FN is required in vCard 4.0
+	var fn string
+	if c.Name != nil {
+		fn = c.Name.Full
+		if len(c.Name.Components) > 0 {
+			values := componentValues(nameKinds, c.Name.Components)
+			card.Set(vcard.FieldName, &vcard.Field{Value: strings.Join(values, ";")})
+			if fn == "" {
+				fn = strings.Join(strings.Fields(values[3]+" "+values[1]+" "+values[2]+" "+values[0]+" "+values[4]), " ")
+			}
+		}
+	}
+	card.SetValue(vcard.FieldFormattedName, fn)
+
+	for _, k := range sortedKeys(c.Emails) {
+		email := c.Emails[k]
+		card.Add(vcard.FieldEmail, &vcard.Field{
+			Value:  email.Address,
+			Params: params(email.Contexts, nil, email.Pref),
+		})
+	}
+
+	for _, k := range sortedKeys(c.Phones) {
+		phone := c.Phones[k]
+		card.Add(vcard.FieldTelephone, &vcard.Field{
+			Value:  phone.Number,
+			Params: params(phone.Contexts, phone.Features, phone.Pref),
+		})
+	}
+
+	for _, k := range sortedKeys(c.Addresses) {
+		adr := c.Addresses[k]
+		values := componentValues(addressKinds, adr.Components)
+		card.Add(vcard.FieldAddress, &vcard.Field{
+			Value:  strings.Join(values, ";"),
+			Params: params(adr.Contexts, nil, adr.Pref),
+		})
+	}
+
+	for _, k := range sortedKeys(c.Organizations) {
+		card.Add(vcard.FieldOrganization, &vcard.Field{Value: c.Organizations[k].Name})
+	}
+	for _, k := range sortedKeys(c.Titles) {
+		card.Add(vcard.FieldTitle, &vcard.Field{Value: c.Titles[k].Name})
+	}
+	for _, k := range sortedKeys(c.Notes) {
+		card.Add(vcard.FieldNote, &vcard.Field{Value: c.Notes[k].Note})
+	}
+
+	if len(c.Keywords) > 0 {
+		var l []string
+		for k, ok := range c.Keywords {
+			if ok {
+				l = append(l, k)
+			}
+		}
+		sort.Strings(l)
+		card.SetValue(vcard.FieldCategories, strings.Join(l, ","))
+	}
+
+	return card, nil
+}
+
+func components(kinds, values []string) []Component {
+	var l []Component
+	for i, v := range values {
+		if v != "" {
+			l = append(l, Component{Kind: kinds[i], Value: v})
+		}
+	}
+	return l
+}
+
+// componentValues returns the values of components, in the order of kinds.
+// Multiple components of the same kind are joined with a space.
+func componentValues(kinds []string, l []Component) []string {
+	values := make([]string, len(kinds))
+	for i, kind := range kinds {
+		values[i] = componentValue(l, kind)
+	}
+	return values
+}
+
+func componentValue(l []Component, kind string) string {
+	var values []string
+	for _, c := range l {
+		if c.Kind == kind {
+			values = append(values, c.Value)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+func contexts(params vcard.Params) map[string]bool {
+	var m map[string]bool
+	add := func(ctx string) {
+		if m == nil {
+			m = make(map[string]bool)
+		}
+		m[ctx] = true
+	}
+	if params.HasType("work") {
+		add("work")
+	}
+	if params.HasType("home") {
+		add("private")
+	}
+	return m
+}
+
+func pref(params vcard.Params) int {
+	p, _ := strconv.Atoi(params.Get(vcard.ParamPreferred))
+	return p
+}
+
+func params(contexts, features map[string]bool, pref int) vcard.Params {
+	params := make(vcard.Params)
+	if contexts["work"] {
+		params.Add(vcard.ParamType, "work")
+	}
+	if contexts["private"] {
+		params.Add(vcard.ParamType, "home")
+	}
+	for _, feature := range phoneFeatures {
+		if features[feature] {
+			params.Add(vcard.ParamType, feature)
+		}
+	}
+	if pref > 0 {
+		params.Set(vcard.ParamPreferred, strconv.Itoa(pref))
+	}
+	return params
+}
+
+// sortedKeys returns the sorted keys of a map with string keys.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package jscontact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+)
+
+const testCard = `BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1
+FN:J. Doe
+N:Doe;J.;;;
+EMAIL;TYPE=work;PREF=1:jdoe@example.com
+TEL;TYPE=home,voice:+1-555-555-5555
+ADR;TYPE=work:;;123 Main Street;Any Town;CA;91921;USA
+ORG:ABC\, Inc.;North American Division
+CATEGORIES:friends,colleagues
+REV:20200101T000000Z
+END:VCARD
+`
+
+func TestFromCard(t *testing.T) {
+	card, err := vcard.NewDecoder(strings.NewReader(strings.ReplaceAll(testCard, "\n", "\r\n"))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := FromCard(card)
+	if err != nil {
+		t.Fatalf("FromCard() = %v", err)
+	}
+	if c.UID != "urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1" || c.Updated != "2020-01-01T00:00:00Z" {
+		t.Errorf("FromCard() = %+v", c)
+	}
+	if c.Name == nil || c.Name.Full != "J. Doe" || len(c.Name.Components) != 2 {
+		t.Errorf("FromCard() name = %+v", c.Name)
+	}
+	if email := c.Emails["e1"]; email.Address != "jdoe@example.com" || !email.Contexts["work"] || email.Pref != 1 {
+		t.Errorf("FromCard() email = %+v", email)
+	}
+	if phone := c.Phones["p1"]; !phone.Contexts["private"] || !phone.Features["voice"] {
+		t.Errorf("FromCard() phone = %+v", phone)
+	}
+	if adr := c.Addresses["a1"]; len(adr.Components) != 5 || adr.Components[1].Kind != "locality" {
+		t.Errorf("FromCard() address = %+v", adr)
+	}
+	if !c.Keywords["friends"] || !c.Keywords["colleagues"] {
+		t.Errorf("FromCard() keywords = %v", c.Keywords)
+	}
+
+	card, err = ToCard(c)
+	if err != nil {
+		t.Fatalf("ToCard() = %v", err)
+	}
+	roundTrip, err := FromCard(card)
+	if err != nil {
+		t.Fatalf("FromCard() = %v", err)
+	}
+	if roundTrip.Name.Full != c.Name.Full || roundTrip.Emails["e1"].Address != c.Emails["e1"].Address || len(roundTrip.Addresses["a1"].Components) != 5 {
+		t.Errorf("round trip = %+v, want %+v", roundTrip, c)
+	}
+}
@@ -0,0 +1,464 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/internal"
+)
+
+const localObjectExt = ".vcf"
+
+// LocalBackend is a Backend storing address books in a local directory. It
+// uses the vdir layout supported by vdirsyncer: each address book is a
+// sub-directory and each address object is a ".vcf" file.
+//
+// The name and description of address books are stored in the "displayname"
+// and "description" vdir metadata files. Other address book properties are
+// stored in a sidecar file. ETags and CTags are derived from the contents of
+// the files.
+//
+// LocalBackend is safe for concurrent use, but the directory must not be
+// modified by other processes while a PUT request is handled.
+type LocalBackend struct {
+	// ErrorLog specifies an optional logger for object files which can't be
+	// parsed, e.g. because they were written by another vdir client. Such
+	// files are skipped when listing objects. If nil, logging is done via the
+	// log package's standard logger.
+	ErrorLog *log.Logger
+
+	dir                        string
+	principalPath, homeSetPath string
+
+	mu sync.Mutex // serializes writes
+}
+
+// localAddressBookMetadata contains the address book properties stored in
+// the sidecar file.
+type localAddressBookMetadata struct {
+	MaxResourceSize      int64             `json:"max_resource_size,omitempty"`
+	SupportedAddressData []AddressDataType `json:"supported_address_data,omitempty"`
+	Encrypted            bool              `json:"encrypted,omitempty"`
+}
+
+var (
+	_ Backend               = (*LocalBackend)(nil)
+	_ DryRunBackend         = (*LocalBackend)(nil)
+	_ AddressObjectStreamer = (*LocalBackend)(nil)
+)
+
+// NewLocalBackend creates a backend storing address books in dir, which is
+// the address book home set. The paths must follow the layout expected by
+// Handler, e.g. "/user/" and "/user/contacts/".
+func NewLocalBackend(dir, principalPath, homeSetPath string) *LocalBackend {
+	return &LocalBackend{
+		dir:           dir,
+		principalPath: principalPath,
+		homeSetPath:   strings.TrimSuffix(homeSetPath, "/") + "/",
+	}
+}
+
+// addressBookDir returns the directory of the address book at a path, with
+// or without a trailing slash, checking that it exists.
+func (b *LocalBackend) addressBookDir(p string) (string, error) {
+	p = strings.TrimSuffix(p, "/")
+	name := path.Base(p)
+	if path.Dir(p)+"/" != b.homeSetPath || internal.CheckVdirName(name, "") != nil {
+		return "", internal.HTTPErrorf(http.StatusNotFound, "carddav: address book %q not found", p)
+	}
+	dir := filepath.Join(b.dir, name)
+	if fi, err := os.Stat(dir); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return "", internal.HTTPErrorf(http.StatusNotFound, "carddav: address book %q not found", p)
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// objectFile returns the file of the address object at a path. The address
+// book must exist, the file may not.
+func (b *LocalBackend) objectFile(p string) (string, error) {
+	dir, err := b.addressBookDir(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(p)
+	if err := internal.CheckVdirName(name, localObjectExt); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func (b *LocalBackend) readAddressBook(dir string) (*AddressBook, error) {
+	ab := &AddressBook{Path: b.homeSetPath + filepath.Base(dir) + "/"}
+
+	var err error
+	if ab.Name, err = internal.ReadVdirMetadata(dir, "displayname"); err != nil {
+		return nil, err
+	}
+	if ab.Description, err = internal.ReadVdirMetadata(dir, "description"); err != nil {
+		return nil, err
+	}
+
+	var md localAddressBookMetadata
+	if err := internal.ReadVdirSidecar(dir, &md); err != nil {
+		return nil, err
+	}
+	ab.MaxResourceSize = md.MaxResourceSize
+	ab.SupportedAddressData = md.SupportedAddressData
+	ab.Encrypted = md.Encrypted
+
+	if ab.CTag, err = internal.VdirCTag(dir, localObjectExt); err != nil {
+		return nil, err
+	}
+	return ab, nil
+}
+
+func readLocalObject(p, filename string) (*AddressObject, error) {
+	data, fi, err := readLocalFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalObject(p, data, fi)
+}
+
+func readLocalFile(filename string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, fi, nil
+}
+
+// newLocalObject parses the data of an object file. Only parse errors are
+// returned.
+func newLocalObject(p string, data []byte, fi os.FileInfo) (*AddressObject, error) {
+	card, err := vcard.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &AddressObject{
+		Path:          p,
+		ModTime:       fi.ModTime(),
+		ContentLength: int64(len(data)),
+		ETag:          internal.VdirETag(data),
+		Card:          card,
+	}, nil
+}
+
+func (b *LocalBackend) logf(format string, args ...interface{}) {
+	if b.ErrorLog != nil {
+		b.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (b *LocalBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.principalPath, nil
+}
+
+func (b *LocalBackend) AddressBookHomeSetPath(ctx context.Context) (string, error) {
+	return b.homeSetPath, nil
+}
+
+func (b *LocalBackend) ListAddressBooks(ctx context.Context) ([]AddressBook, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var l []AddressBook
+	for _, fi := range entries {
+		if !fi.IsDir() || internal.CheckVdirName(fi.Name(), "") != nil {
+			continue
+		}
+		ab, err := b.readAddressBook(filepath.Join(b.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *ab)
+	}
+	return l, nil
+}
+
+func (b *LocalBackend) GetAddressBook(ctx context.Context, p string) (*AddressBook, error) {
+	dir, err := b.addressBookDir(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.readAddressBook(dir)
+}
+
+func (b *LocalBackend) CreateAddressBook(ctx context.Context, addressBook AddressBook) error {
+	p := strings.TrimSuffix(addressBook.Path, "/")
+	if path.Dir(p)+"/" != b.homeSetPath {
+		return internal.HTTPErrorf(http.StatusForbidden, "carddav: address books must be created in the address book home set")
+	}
+	name := path.Base(p)
+	if err := internal.CheckVdirName(name, ""); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(b.dir, name)
+	if err := os.Mkdir(dir, 0755); os.IsExist(err) {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "carddav: address book %q already exists", addressBook.Path)
+	} else if err != nil {
+		return err
+	}
+
+	err := writeLocalAddressBook(dir, &addressBook)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+func writeLocalAddressBook(dir string, ab *AddressBook) error {
+	if err := internal.WriteVdirMetadata(dir, "displayname", ab.Name); err != nil {
+		return err
+	}
+	if err := internal.WriteVdirMetadata(dir, "description", ab.Description); err != nil {
+		return err
+	}
+	return internal.WriteVdirSidecar(dir, &localAddressBookMetadata{
+		MaxResourceSize:      ab.MaxResourceSize,
+		SupportedAddressData: ab.SupportedAddressData,
+		Encrypted:            ab.Encrypted,
+	})
+}
+
+func (b *LocalBackend) DeleteAddressBook(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dir, err := b.addressBookDir(p)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (b *LocalBackend) GetAddressObject(ctx context.Context, p string, req *AddressDataRequest) (*AddressObject, error) {
+	filename, err := b.objectFile(p)
+	if _, ok := err.(*internal.HTTPError); ok {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	} else if err != nil {
+		return nil, err
+	}
+	ao, err := readLocalObject(p, filename)
+	if os.IsNotExist(err) {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	}
+	return ao, err
+}
+
+func (b *LocalBackend) ListAddressObjects(ctx context.Context, p string, req *AddressDataRequest) ([]AddressObject, error) {
+	var l []AddressObject
+	err := b.ListAddressObjectsStream(ctx, p, req, func(ao *AddressObject) error {
+		l = append(l, *ao)
+		return nil
+	})
+	return l, err
+}
+
+// ListAddressObjectsStream implements AddressObjectStreamer. Objects are
+// listed in the order of their paths.
+func (b *LocalBackend) ListAddressObjectsStream(ctx context.Context, p string, req *AddressDataRequest, fn func(ao *AddressObject) error) error {
+	dir, err := b.addressBookDir(p)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts entries by name
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	abPath := strings.TrimSuffix(p, "/") + "/"
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || internal.CheckVdirName(fi.Name(), localObjectExt) != nil {
+			continue
+		}
+		filename := filepath.Join(dir, fi.Name())
+		data, info, err := readLocalFile(filename)
+		if os.IsNotExist(err) {
+			continue // removed in the meantime
+		} else if err != nil {
+			return err
+		}
+		ao, err := newLocalObject(abPath+fi.Name(), data, info)
+		if err != nil {
+			// The file may have been written by another vdir client
+			b.logf("carddav: skipping invalid address object file %q: %v", filename, err)
+			continue
+		}
+		if err := fn(ao); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) QueryAddressObjects(ctx context.Context, p string, query *AddressBookQuery) ([]AddressObject, error) {
+	var l []AddressObject
+	err := b.QueryAddressObjectsStream(ctx, p, query, func(ao *AddressObject) error {
+		l = append(l, *ao)
+		return nil
+	})
+	return l, err
+}
+
+// QueryAddressObjectsStream implements AddressObjectStreamer.
+func (b *LocalBackend) QueryAddressObjectsStream(ctx context.Context, p string, query *AddressBookQuery, fn func(ao *AddressObject) error) error {
+	n := 0
+	err := b.ListAddressObjectsStream(ctx, p, &query.DataRequest, func(ao *AddressObject) error {
+		if ok, err := Match(query, ao); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		filtered := filterProperties(query.DataRequest, *ao)
+		if err := fn(&filtered); err != nil {
+			return err
+		}
+		if n++; query.Limit > 0 && n >= query.Limit {
+			return errQueryLimitReached
+		}
+		return nil
+	})
+	if err == errQueryLimitReached {
+		err = nil
+	}
+	return err
+}
+
+func (b *LocalBackend) SupportsDryRun() bool {
+	return true
+}
+
+func (b *LocalBackend) PutAddressObject(ctx context.Context, p string, card vcard.Card, opts *PutAddressObjectOptions) (loc string, err error) {
+	if opts == nil {
+		opts = &PutAddressObjectOptions{}
+	}
+	var buf bytes.Buffer
+	if err := vcard.NewEncoder(&buf).Encode(card); err != nil {
+		return "", NewPreconditionError(PreconditionValidAddressData)
+	}
+	uid := card.Value(vcard.FieldUID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.addressBookDir(path.Dir(p)); err != nil {
+		return "", internal.HTTPErrorf(http.StatusConflict, "carddav: address book %q not found", path.Dir(p))
+	}
+	filename, err := b.objectFile(p)
+	if err != nil {
+		return "", err
+	}
+
+	var etag string
+	data, err := ioutil.ReadFile(filename)
+	exists := err == nil
+	if exists {
+		etag = internal.VdirETag(data)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := checkPutConditions(opts, etag, exists); err != nil {
+		return "", err
+	}
+
+	if err := b.checkUID(path.Dir(p), uid, p); err != nil {
+		return "", err
+	}
+	if opts.DryRun {
+		return p, nil
+	}
+
+	if err := internal.WriteFileAtomic(filename, buf.Bytes()); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// checkUID checks that no object of an address book other than the excluded
+// ones has the given UID. Files which can't contain the UID aren't parsed.
+func (b *LocalBackend) checkUID(abPath, uid string, exclude ...string) error {
+	if uid == "" {
+		return nil
+	}
+	dir, err := b.addressBookDir(abPath)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	abPath = strings.TrimSuffix(abPath, "/") + "/"
+entries:
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || internal.CheckVdirName(fi.Name(), localObjectExt) != nil {
+			continue
+		}
+		for _, p := range exclude {
+			if abPath+fi.Name() == p {
+				continue entries
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !internal.VdirMayContainText(data, uid) {
+			continue
+		}
+		card, err := vcard.NewDecoder(bytes.NewReader(data)).Decode()
+		if err == nil && card.Value(vcard.FieldUID) == uid {
+			return NewPreconditionError(PreconditionNoUIDConflict)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) DeleteAddressObject(ctx context.Context, p string) error {
+	filename, err := b.objectFile(p)
+	if _, ok := err.(*internal.HTTPError); ok {
+		return internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	} else if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.Remove(filename); os.IsNotExist(err) {
+		return internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 	"strings"
 
 	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/internal"
 )
 
+// filterProperties strips the properties which haven't been requested from an
+// address object, as defined in RFC 6352 section 10.4.
 func filterProperties(req AddressDataRequest, ao AddressObject) AddressObject {
 	if req.AllProp || len(req.Props) == 0 {
 		return ao
@@ -16,16 +19,13 @@ func filterProperties(req AddressDataRequest, ao AddressObject) AddressObject {
 		panic("request to process empty vCard")
 	}
 
-	result := AddressObject{
-		Path:    ao.Path,
-		ModTime: ao.ModTime,
-		ETag:    ao.ETag,
-	}
-
+	result := ao
+	result.ContentLength = 0
 	result.Card = make(vcard.Card)
 	// result would be invalid w/o version
 	result.Card[vcard.FieldVersion] = ao.Card[vcard.FieldVersion]
 	for _, prop := range req.Props {
+		prop = strings.ToUpper(prop)
 		value, ok := ao.Card[prop]
 		if ok {
 			result.Card[prop] = value
@@ -102,69 +102,192 @@ func Match(query *AddressBookQuery, ao *AddressObject) (matched bool, err error)
 }
 
 func matchPropFilter(prop PropFilter, ao *AddressObject) (bool, error) {
-	// TODO: this only matches first field, there could be multiple
-	field := ao.Card.Get(prop.Name)
-	if field == nil {
+	fields := ao.Card[strings.ToUpper(prop.Name)]
+	if len(fields) == 0 {
 		return prop.IsNotDefined, nil
 	} else if prop.IsNotDefined {
 		return false, nil
 	}
 
-	// TODO: handle carddav.PropFilter.Params.
-	if len(prop.TextMatches) == 0 {
+	if len(prop.TextMatches) == 0 && len(prop.Params) == 0 {
 		return true, nil
 	}
 
+	// The filter matches if any of the property instances matches
+	for _, field := range fields {
+		ok, err := matchField(prop, field)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchField matches the text-match and param-filter elements of a property
+// filter against a single property instance.
+func matchField(prop PropFilter, field *vcard.Field) (bool, error) {
+	var anyOf bool
 	switch prop.Test {
 	default:
 		return false, fmt.Errorf("unknown property filter test %q", prop.Test)
-
 	case FilterAnyOf, "":
-		for _, txt := range prop.TextMatches {
-			ok, err := matchTextMatch(txt, field)
-			if err != nil {
-				return false, err
-			}
-			if ok {
-				return true, nil
-			}
+		anyOf = true
+	case FilterAllOf:
+		anyOf = false
+	}
+
+	// With anyof, the first match is decisive. With allof, the first
+	// mismatch is.
+	for _, txt := range prop.TextMatches {
+		ok, err := matchFieldText(prop.Name, txt, field)
+		if err != nil {
+			return false, err
 		}
-		return false, nil
+		if ok == anyOf {
+			return ok, nil
+		}
+	}
+	for _, param := range prop.Params {
+		ok, err := matchParamFilter(param, field)
+		if err != nil {
+			return false, err
+		}
+		if ok == anyOf {
+			return ok, nil
+		}
+	}
+	return !anyOf, nil
+}
 
-	case FilterAllOf:
-		for _, txt := range prop.TextMatches {
-			ok, err := matchTextMatch(txt, field)
-			if err != nil {
-				return false, err
-			}
-			if !ok {
-				return false, nil
-			}
+// structuredComponents lists the components of structured property values,
+// named after the xCard elements defined in RFC 6351.
+var structuredComponents = map[string][]string{
+	vcard.FieldName:    {"surname", "given", "additional", "prefix", "suffix"},
+	vcard.FieldAddress: {"pobox", "ext", "street", "locality", "region", "code", "country"},
+	vcard.FieldGender:  {"sex", "identity"},
+}
+
+// componentIndex returns the position of a component in a structured
+// property value.
+func componentIndex(propName, component string) (int, error) {
+	for i, name := range structuredComponents[strings.ToUpper(propName)] {
+		if strings.EqualFold(name, component) {
+			return i, nil
 		}
-		return true, nil
 	}
+	return -1, fmt.Errorf("carddav: unknown component %q of property %q", component, propName)
 }
 
-func matchTextMatch(txt TextMatch, field *vcard.Field) (bool, error) {
-	// TODO: handle text-match collation attribute
-	var ok bool
-	switch txt.MatchType {
-	default:
-		return false, fmt.Errorf("unknown textmatch type %q", txt.MatchType)
+// splitComponents splits a structured property value into its components.
+// The decoder unescapes all characters except semicolons.
+func splitComponents(v string) []string {
+	var l []string
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case ';':
+			l = append(l, strings.ReplaceAll(v[start:i], `\;`, ";"))
+			start = i + 1
+		}
+	}
+	return append(l, strings.ReplaceAll(v[start:], `\;`, ";"))
+}
+
+// matchFieldText matches a text-match against a property instance.
+func matchFieldText(propName string, txt TextMatch, field *vcard.Field) (bool, error) {
+	if txt.Component == "" {
+		return matchTextMatch(txt, field.Value)
+	}
+	i, err := componentIndex(propName, txt.Component)
+	if err != nil {
+		return false, err
+	}
+	var component string
+	if components := splitComponents(field.Value); i < len(components) {
+		component = components[i]
+	}
+
+	// Escaped commas can't be told apart from list separators once decoded,
+	// so the whole component is matched as well as each of its values
+	values := []string{component}
+	if strings.Contains(component, ",") {
+		values = append(values, strings.Split(component, ",")...)
+	}
+
+	// The condition is negated after matching all values, so that a negated
+	// text-match only matches if none of the values contain the text
+	negate := txt.NegateCondition
+	txt.NegateCondition = false
+	matched := false
+	for _, v := range values {
+		ok, err := matchTextMatch(txt, v)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched = true
+			break
+		}
+	}
+	return matched != negate, nil
+}
 
-	case MatchEquals:
-		ok = txt.Text == field.Value
+// paramValues returns all values of a parameter. Parameter names are
+// case-insensitive. TYPE values set as a single comma-separated list, e.g.
+// via Params.Set, are split like the decoder does.
+func paramValues(params vcard.Params, name string) []string {
+	var values []string
+	for k, l := range params {
+		if !strings.EqualFold(k, name) {
+			continue
+		}
+		for _, v := range l {
+			if strings.EqualFold(k, vcard.ParamType) {
+				values = append(values, strings.Split(v, ",")...)
+			} else {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
 
-	case MatchContains, "":
-		ok = strings.Contains(field.Value, txt.Text)
+func matchParamFilter(param ParamFilter, field *vcard.Field) (bool, error) {
+	values := paramValues(field.Params, param.Name)
+	if len(values) == 0 {
+		return param.IsNotDefined, nil
+	} else if param.IsNotDefined {
+		return false, nil
+	}
+	if param.TextMatch == nil {
+		return true, nil
+	}
 
-	case MatchStartsWith:
-		ok = strings.HasPrefix(field.Value, txt.Text)
+	for _, value := range values {
+		ok, err := matchTextMatch(*param.TextMatch, value)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
 
-	case MatchEndsWith:
-		ok = strings.HasSuffix(field.Value, txt.Text)
+func matchTextMatch(txt TextMatch, value string) (bool, error) {
+	matchType := txt.MatchType
+	if matchType == "" {
+		matchType = MatchContains
+	}
+	collation := txt.Collation
+	if collation == "" {
+		collation = internal.CollationUnicodeCasemap
 	}
 
+	ok, err := internal.MatchText(collation, string(matchType), txt.Text, value)
+	if err != nil {
+		return false, err
+	}
 	if txt.NegateCondition {
 		ok = !ok
 	}
@@ -46,6 +46,26 @@ N:Gopher;Carla;;;
 EMAIL;PID=1.1:carla@example.com
 CLIENTPIDMAP:1;urn:uuid:53e374d9-337e-4727-8803-a1e9c14e0553
 END:VCARD`)
+	dave := newAO(`BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b4
+FN:Dave Gopher
+EMAIL;TYPE=work:dave@example.com
+EMAIL;TYPE=home:d.gopher@example.org
+END:VCARD`)
+	eve := newAO(`BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b5
+FN:Eve Gopher
+TEL;TYPE=home,voice:+1-555-0100
+END:VCARD`)
+	frank := newAO(`BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b6
+FN:Frank Gopher
+TEL:+1-555-0101
+END:VCARD`)
+	frank.Card[vcard.FieldTelephone][0].Params = vcard.Params{vcard.ParamType: {"cell,voice"}}
 	carlaFiltered := newAO(`BEGIN:VCARD
 VERSION:4.0
 UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b3
@@ -182,6 +202,112 @@ END:VCARD`)
 			addrs: []AddressObject{alice, bob, carla},
 			want:  []AddressObject{},
 		},
+		{
+			name: "email-starts-with-any-instance",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name:        vcard.FieldEmail,
+						TextMatches: []TextMatch{{Text: "d.go", MatchType: MatchStartsWith}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, bob, carla, dave},
+			want:  []AddressObject{dave},
+		},
+		{
+			name: "email-param-filter",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name: vcard.FieldEmail,
+						Test: FilterAllOf,
+						TextMatches: []TextMatch{
+							{Text: ".com", MatchType: MatchEndsWith},
+						},
+						Params: []ParamFilter{{
+							Name:      vcard.ParamType,
+							TextMatch: &TextMatch{Text: "home", MatchType: MatchEquals},
+						}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, bob, carla, dave},
+			want:  []AddressObject{},
+		},
+		{
+			name: "tel-param-filter-multiple-values",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name: vcard.FieldTelephone,
+						Params: []ParamFilter{{
+							Name:      "type",
+							TextMatch: &TextMatch{Text: "voice", MatchType: MatchEquals},
+						}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, eve, frank},
+			want:  []AddressObject{eve, frank},
+		},
+		{
+			name: "fn-match-unicode-casemap",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name:        vcard.FieldFormattedName,
+						TextMatches: []TextMatch{{Text: "CARLA", MatchType: MatchStartsWith}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, bob, carla},
+			want:  []AddressObject{carla},
+		},
+		{
+			name: "fn-match-octet",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name:        vcard.FieldFormattedName,
+						TextMatches: []TextMatch{{Text: "CARLA", MatchType: MatchStartsWith, Collation: "i;octet"}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, bob, carla},
+			want:  []AddressObject{},
+		},
+		{
+			name: "fn-match-unsupported-collation",
+			query: &AddressBookQuery{
+				DataRequest: AddressDataRequest{
+					AllProp: true,
+				},
+				PropFilters: []PropFilter{
+					{
+						Name:        vcard.FieldFormattedName,
+						TextMatches: []TextMatch{{Text: "Carla", Collation: "i;basic"}},
+					},
+				},
+			},
+			addrs: []AddressObject{alice, bob, carla},
+			err:   fmt.Errorf("webdav: unsupported collation \"i;basic\""),
+		},
 		{
 			name: "email-match-filter-properties",
 			query: &AddressBookQuery{
@@ -260,6 +386,13 @@ FN;PID=1.1:Alice Gopher
 N:Gopher;Alice;;;
 EMAIL;PID=1.1:alice@example.com
 CLIENTPIDMAP:1;urn:uuid:53e374d9-337e-4727-8803-a1e9c14e0556
+END:VCARD`)
+	cyrus := newAO(`BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b7
+FN:Cyrus Daboo
+N:Daboo;Cyrus;Lucas,Marie;;
+ADR;TYPE=work:;Suite 3\, Floor 2;123 Main Street;Any Town;CA;91921-1234;USA
 END:VCARD`)
 
 	for _, tc := range []struct {
@@ -590,6 +723,101 @@ END:VCARD`)
 			addr: alice,
 			want: true,
 		},
+		{
+			name: "match-name-component",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "daboo", MatchType: MatchEquals, Component: "surname"}},
+				}},
+			},
+			addr: cyrus,
+			want: true,
+		},
+		{
+			name: "match-name-component-other",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "cyrus", Component: "surname"}},
+				}},
+			},
+			addr: cyrus,
+			want: false,
+		},
+		{
+			name: "match-name-component-list",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "marie", MatchType: MatchEquals, Component: "additional"}},
+				}},
+			},
+			addr: cyrus,
+			want: true,
+		},
+		{
+			name: "match-name-component-list-not",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "marie", MatchType: MatchEquals, Component: "additional", NegateCondition: true}},
+				}},
+			},
+			addr: cyrus,
+			want: false,
+		},
+		{
+			name: "match-adr-components",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name: vcard.FieldAddress,
+					Test: FilterAllOf,
+					TextMatches: []TextMatch{
+						{Text: "any town", MatchType: MatchEquals, Component: "locality"},
+						{Text: "usa", MatchType: MatchEquals, Component: "country"},
+						{Text: "suite 3, floor 2", MatchType: MatchEquals, Component: "ext"},
+					},
+				}},
+			},
+			addr: cyrus,
+			want: true,
+		},
+		{
+			name: "match-escaped-component",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "gopher;jr", MatchType: MatchEquals, Component: "surname"}},
+				}},
+			},
+			addr: AddressObject{Card: vcard.Card{
+				vcard.FieldName: {{Value: `Gopher\;Jr;Alice;;;`}},
+			}},
+			want: true,
+		},
+		{
+			name: "match-missing-component",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldName,
+					TextMatches: []TextMatch{{Text: "gopher", Component: "suffix"}},
+				}},
+			},
+			addr: alice,
+			want: false,
+		},
+		{
+			name: "unknown-component",
+			query: &AddressBookQuery{
+				PropFilters: []PropFilter{{
+					Name:        vcard.FieldEmail,
+					TextMatches: []TextMatch{{Text: "example.com", Component: "domain"}},
+				}},
+			},
+			addr: alice,
+			err:  fmt.Errorf("carddav: unknown component \"domain\" of property \"EMAIL\""),
+		},
 		{
 			name: "invalid-query-filter",
 			query: &AddressBookQuery{
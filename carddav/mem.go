@@ -0,0 +1,324 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// MemBackend is an in-memory Backend, e.g. for tests. It's safe for
+// concurrent use.
+//
+// ETags and sync tokens are derived from a change counter, so they change
+// whenever an object is written.
+type MemBackend struct {
+	principalPath, homeSetPath string
+
+	mu           sync.Mutex
+	addressBooks map[string]*memAddressBook
+	seq          uint64
+}
+
+type memAddressBook struct {
+	ab      AddressBook
+	seq     uint64 // latest change
+	objects map[string]*memObject
+	removed map[string]uint64 // change sequence numbers by path
+}
+
+type memObject struct {
+	data              []byte
+	uid               string
+	modTime           time.Time
+	created, modified uint64
+}
+
+var (
+	_ Backend       = (*MemBackend)(nil)
+	_ SyncBackend   = (*MemBackend)(nil)
+	_ DryRunBackend = (*MemBackend)(nil)
+)
+
+// NewMemBackend creates an in-memory backend without address books. The
+// paths must follow the layout expected by Handler, e.g. "/user/" and
+// "/user/contacts/".
+func NewMemBackend(principalPath, homeSetPath string) *MemBackend {
+	return &MemBackend{
+		principalPath: principalPath,
+		homeSetPath:   strings.TrimSuffix(homeSetPath, "/") + "/",
+		addressBooks:  make(map[string]*memAddressBook),
+	}
+}
+
+func (o *memObject) addressObject(p string) (*AddressObject, error) {
+	card, err := vcard.NewDecoder(bytes.NewReader(o.data)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &AddressObject{
+		Path:          p,
+		ModTime:       o.modTime,
+		ContentLength: int64(len(o.data)),
+		ETag:          strconv.FormatUint(o.modified, 16),
+		Card:          card,
+	}, nil
+}
+
+// addressBook returns the address book at a path, with or without a trailing
+// slash. The lock must be held.
+func (b *MemBackend) addressBook(p string) (*memAddressBook, error) {
+	ab := b.addressBooks[strings.TrimSuffix(p, "/")+"/"]
+	if ab == nil {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "carddav: address book %q not found", p)
+	}
+	return ab, nil
+}
+
+func (b *MemBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.principalPath, nil
+}
+
+func (b *MemBackend) AddressBookHomeSetPath(ctx context.Context) (string, error) {
+	return b.homeSetPath, nil
+}
+
+func (b *MemBackend) ListAddressBooks(ctx context.Context) ([]AddressBook, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := make([]AddressBook, 0, len(b.addressBooks))
+	for _, ab := range b.addressBooks {
+		l = append(l, ab.ab)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+	return l, nil
+}
+
+func (b *MemBackend) GetAddressBook(ctx context.Context, p string) (*AddressBook, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(p)
+	if err != nil {
+		return nil, err
+	}
+	addressBook := ab.ab
+	return &addressBook, nil
+}
+
+func (b *MemBackend) CreateAddressBook(ctx context.Context, addressBook AddressBook) error {
+	p := strings.TrimSuffix(addressBook.Path, "/") + "/"
+	if path.Dir(strings.TrimSuffix(p, "/"))+"/" != b.homeSetPath {
+		return internal.HTTPErrorf(http.StatusForbidden, "carddav: address books must be created in the address book home set")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.addressBooks[p]; ok {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "carddav: address book %q already exists", p)
+	}
+	addressBook.Path = p
+	b.seq++
+	b.addressBooks[p] = &memAddressBook{
+		ab:      addressBook,
+		seq:     b.seq,
+		objects: make(map[string]*memObject),
+		removed: make(map[string]uint64),
+	}
+	return nil
+}
+
+func (b *MemBackend) DeleteAddressBook(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(p)
+	if err != nil {
+		return err
+	}
+	delete(b.addressBooks, ab.ab.Path)
+	return nil
+}
+
+func (b *MemBackend) GetAddressObject(ctx context.Context, p string, req *AddressDataRequest) (*AddressObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	o := ab.objects[p]
+	if o == nil {
+		return nil, internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	}
+	return o.addressObject(p)
+}
+
+func (b *MemBackend) ListAddressObjects(ctx context.Context, p string, req *AddressDataRequest) ([]AddressObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(p)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]AddressObject, 0, len(ab.objects))
+	for objPath, o := range ab.objects {
+		ao, err := o.addressObject(objPath)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *ao)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+	return l, nil
+}
+
+func (b *MemBackend) QueryAddressObjects(ctx context.Context, p string, query *AddressBookQuery) ([]AddressObject, error) {
+	l, err := b.ListAddressObjects(ctx, p, &query.DataRequest)
+	if err != nil {
+		return nil, err
+	}
+	return Filter(query, l)
+}
+
+// checkPutConditions checks the If-Match and If-None-Match preconditions of
+// a PUT request against the ETag of the current object, if any.
+func checkPutConditions(opts *PutAddressObjectOptions, etag string, exists bool) error {
+	if opts.IfNoneMatch.IsSet() && exists {
+		if opts.IfNoneMatch.IsWildcard() {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "carddav: address object already exists")
+		}
+		if v, err := opts.IfNoneMatch.ETag(); err == nil && v == etag {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "carddav: address object ETag matches")
+		}
+	}
+	if opts.IfMatch.IsSet() {
+		if !exists {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "carddav: address object doesn't exist")
+		}
+		if v, err := opts.IfMatch.ETag(); !opts.IfMatch.IsWildcard() && (err != nil || v != etag) {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "carddav: address object ETag doesn't match")
+		}
+	}
+	return nil
+}
+
+func (b *MemBackend) SupportsDryRun() bool {
+	return true
+}
+
+func (b *MemBackend) PutAddressObject(ctx context.Context, p string, card vcard.Card, opts *PutAddressObjectOptions) (loc string, err error) {
+	if opts == nil {
+		opts = &PutAddressObjectOptions{}
+	}
+	var buf bytes.Buffer
+	if err := vcard.NewEncoder(&buf).Encode(card); err != nil {
+		return "", NewPreconditionError(PreconditionValidAddressData)
+	}
+	uid := card.Value(vcard.FieldUID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(path.Dir(p))
+	if err != nil {
+		return "", internal.HTTPErrorf(http.StatusConflict, "carddav: address book %q not found", path.Dir(p))
+	}
+
+	o := ab.objects[p]
+	var etag string
+	if o != nil {
+		etag = strconv.FormatUint(o.modified, 16)
+	}
+	if err := checkPutConditions(opts, etag, o != nil); err != nil {
+		return "", err
+	}
+	for objPath, other := range ab.objects {
+		if uid != "" && objPath != p && other.uid == uid {
+			return "", NewPreconditionError(PreconditionNoUIDConflict)
+		}
+	}
+	if opts.DryRun {
+		return p, nil
+	}
+
+	b.seq++
+	ab.seq = b.seq
+	if o == nil {
+		o = &memObject{created: ab.seq}
+		ab.objects[p] = o
+	}
+	o.data = buf.Bytes()
+	o.uid = uid
+	o.modTime = time.Now()
+	o.modified = ab.seq
+	return p, nil
+}
+
+func (b *MemBackend) DeleteAddressObject(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if _, ok := ab.objects[p]; !ok {
+		return internal.HTTPErrorf(http.StatusNotFound, "carddav: address object %q not found", p)
+	}
+	b.seq++
+	ab.seq = b.seq
+	delete(ab.objects, p)
+	ab.removed[p] = ab.seq
+	return nil
+}
+
+func (b *MemBackend) AddressBookSyncToken(ctx context.Context, p string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(p)
+	if err != nil {
+		return "", err
+	}
+	return internal.FormatSyncToken(ab.seq), nil
+}
+
+func (b *MemBackend) AddressBookChanges(ctx context.Context, p, syncToken string) (*webdav.SyncChanges, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ab, err := b.addressBook(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var since uint64
+	var removed map[string]uint64
+	if syncToken != "" {
+		if since, err = internal.ParseSyncToken(syncToken, ab.seq); err != nil {
+			return nil, err
+		}
+		removed = ab.removed
+	}
+
+	members := make([]internal.MemberVersion, 0, len(ab.objects))
+	for objPath, o := range ab.objects {
+		members = append(members, internal.MemberVersion{
+			Path:     objPath,
+			Created:  o.created,
+			Modified: o.modified,
+		})
+	}
+
+	changes := webdav.SyncChanges{SyncToken: internal.FormatSyncToken(ab.seq)}
+	changes.Added, changes.Modified, changes.Deleted = internal.ChangesSince(members, removed, since)
+	return &changes, nil
+}
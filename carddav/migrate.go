@@ -0,0 +1,117 @@
+package carddav
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/emersion/go-webdav"
+)
+
+// MigrateOptions contains options for Migrate.
+type MigrateOptions struct {
+	// AddressBookPath maps a source address book to the path of the
+	// destination address book. If nil, the base name of the source address
+	// book path is joined to the destination address book home set.
+	AddressBookPath func(ab *AddressBook) string
+	// State, if set, is used to skip objects migrated by a previous call.
+	State webdav.MigrationState
+	// Progress, if set, is called after each object is processed.
+	Progress func(progress *webdav.MigrationProgress)
+}
+
+// Migrate copies all address objects in an address book home set of a
+// CardDAV server into a backend. Missing destination address books are
+// created.
+//
+// The backend is called with ctx, which should carry the identity of the
+// destination user.
+func Migrate(ctx context.Context, src *Client, addressBookHomeSet string, dst Backend, opts *MigrateOptions) error {
+	if opts == nil {
+		opts = new(MigrateOptions)
+	}
+
+	abs, err := src.FindAddressBooks(ctx, addressBookHomeSet)
+	if err != nil {
+		return err
+	}
+
+	var dstHomeSet string
+	if opts.AddressBookPath == nil {
+		dstHomeSet, err = dst.AddressBookHomeSetPath(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range abs {
+		ab := &abs[i]
+
+		var dstPath string
+		if opts.AddressBookPath != nil {
+			dstPath = opts.AddressBookPath(ab)
+		} else {
+			dstPath = path.Join(dstHomeSet, path.Base(ab.Path)) + "/"
+		}
+		if _, err := dst.GetAddressBook(ctx, dstPath); err != nil {
+			dstAB := *ab
+			dstAB.Path = dstPath
+			if err := dst.CreateAddressBook(ctx, dstAB); err != nil {
+				return fmt.Errorf("carddav: failed to create destination address book %q: %w", dstPath, err)
+			}
+		}
+
+		if err := migrateAddressBook(ctx, src, ab, dst, dstPath, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateAddressBook(ctx context.Context, src *Client, ab *AddressBook, dst Backend, dstPath string, opts *MigrateOptions) error {
+	objs, err := queryAllAddressObjects(ctx, src, ab.Path)
+	if err != nil {
+		return fmt.Errorf("carddav: failed to list address book %q: %w", ab.Path, err)
+	}
+
+	for i, obj := range objs {
+		progress := webdav.MigrationProgress{
+			Collection: ab.Path,
+			Path:       obj.Path,
+			Done:       i + 1,
+			Total:      len(objs),
+		}
+
+		if opts.State != nil {
+			progress.Skipped, err = opts.State.IsMigrated(ctx, obj.Path, obj.ETag)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !progress.Skipped {
+			p := path.Join(dstPath, path.Base(obj.Path))
+			if _, err := dst.PutAddressObject(ctx, p, obj.Card, &PutAddressObjectOptions{}); err != nil {
+				return fmt.Errorf("carddav: failed to migrate address object %q: %w", obj.Path, err)
+			}
+			if opts.State != nil {
+				if err := opts.State.SetMigrated(ctx, obj.Path, obj.ETag); err != nil {
+					return err
+				}
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(&progress)
+		}
+	}
+
+	return nil
+}
+
+func queryAllAddressObjects(ctx context.Context, c *Client, addressBook string) ([]AddressObject, error) {
+	return c.QueryAddressBook(ctx, addressBook, &AddressBookQuery{
+		DataRequest: AddressDataRequest{AllProp: true},
+	})
+}
@@ -0,0 +1,102 @@
+package carddav
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// MirrorOptions contains options for Mirror.
+type MirrorOptions struct {
+	// State maps "<address book>/<object>" base names to the ETags of the
+	// source address objects as of the last mirror. It's updated in place
+	// and should be persisted between calls: objects whose ETag hasn't
+	// changed are skipped. If nil, all objects are copied.
+	State map[string]string
+	// Delete removes destination address objects missing from the source.
+	Delete bool
+}
+
+// Mirror copies the address books of the current user principal from a
+// CardDAV server to another one, overwriting modified objects. Address books
+// are matched by the base name of their path and must exist on the
+// destination.
+func Mirror(ctx context.Context, src, dst *Client, opts *MirrorOptions) error {
+	if opts == nil {
+		opts = new(MirrorOptions)
+	}
+
+	srcDiscovery, err := src.DiscoverAddressBooks(ctx)
+	if err != nil {
+		return fmt.Errorf("carddav: failed to list mirror source address books: %w", err)
+	}
+	dstDiscovery, err := dst.DiscoverAddressBooks(ctx)
+	if err != nil {
+		return fmt.Errorf("carddav: failed to list mirror destination address books: %w", err)
+	}
+	dstABPaths := make(map[string]string, len(dstDiscovery.AddressBooks))
+	for _, ab := range dstDiscovery.AddressBooks {
+		dstABPaths[path.Base(ab.Path)] = ab.Path
+	}
+
+	seen := make(map[string]bool)
+	for _, ab := range srcDiscovery.AddressBooks {
+		abName := path.Base(ab.Path)
+		dstABPath, ok := dstABPaths[abName]
+		if !ok {
+			return fmt.Errorf("carddav: mirror destination address book %q doesn't exist", abName)
+		}
+
+		objs, err := queryAllAddressObjects(ctx, src, ab.Path)
+		if err != nil {
+			return fmt.Errorf("carddav: failed to list address book %q: %w", ab.Path, err)
+		}
+		dstObjs, err := dst.ReadDir(ctx, dstABPath, false)
+		if err != nil {
+			return fmt.Errorf("carddav: failed to list address book %q: %w", dstABPath, err)
+		}
+		dstPaths := make(map[string]string, len(dstObjs))
+		for _, fi := range dstObjs {
+			if !fi.IsDir {
+				dstPaths[path.Base(fi.Path)] = fi.Path
+			}
+		}
+
+		srcNames := make(map[string]bool, len(objs))
+		for _, obj := range objs {
+			name := path.Base(obj.Path)
+			key := abName + "/" + name
+			srcNames[name] = true
+			seen[key] = true
+
+			if _, ok := dstPaths[name]; ok && opts.State != nil && obj.ETag != "" && opts.State[key] == obj.ETag {
+				continue
+			}
+			if _, err := dst.PutAddressObject(ctx, path.Join(dstABPath, name), obj.Card); err != nil {
+				return fmt.Errorf("carddav: failed to mirror address object %q: %w", obj.Path, err)
+			}
+			if opts.State != nil {
+				opts.State[key] = obj.ETag
+			}
+		}
+
+		if opts.Delete {
+			for name, p := range dstPaths {
+				if srcNames[name] {
+					continue
+				}
+				if err := dst.RemoveAll(ctx, p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for key := range opts.State {
+		if !seen[key] {
+			delete(opts.State, key)
+		}
+	}
+
+	return nil
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"net/http"
 	"path"
@@ -24,6 +26,12 @@ type PutAddressObjectOptions struct {
 	// IfMatch provides the ETag of the resource that the client intends
 	// to overwrite, can be ""
 	IfMatch webdav.ConditionalMatch
+	// DryRun indicates that the client only wants to validate the request.
+	// The backend should check the same preconditions as for a regular PUT
+	// (e.g. ETags, UID conflicts and maximum resource size) but must not
+	// store the object. It's only set for backends implementing
+	// DryRunBackend.
+	DryRun bool
 }
 
 // Backend is a CardDAV server backend.
@@ -42,24 +50,167 @@ type Backend interface {
 	webdav.UserPrincipalBackend
 }
 
+// AddressObjectStreamer is an optional interface which can be implemented by a
+// Backend to list address objects one at a time instead of building them all
+// in memory. The multi-status responses of PROPFIND and addressbook-query
+// REPORT requests are then streamed, unless Handler.SortResponses is set.
+type AddressObjectStreamer interface {
+	// ListAddressObjectsStream is like Backend.ListAddressObjects, but calls
+	// fn for each address object. Errors returned by fn must be returned as
+	// is.
+	ListAddressObjectsStream(ctx context.Context, path string, req *AddressDataRequest, fn func(ao *AddressObject) error) error
+	// QueryAddressObjectsStream is like Backend.QueryAddressObjects, but
+	// calls fn for each matching address object. Errors returned by fn must
+	// be returned as is.
+	QueryAddressObjectsStream(ctx context.Context, path string, query *AddressBookQuery, fn func(ao *AddressObject) error) error
+}
+
+// ObjectPathResolver is an optional interface which can be implemented by a
+// Backend whose address object paths are server-generated identifiers
+// decoupled from the names chosen by clients in PUT requests (and from UIDs).
+type ObjectPathResolver interface {
+	// ResolveObjectPath maps a path requested by a client (e.g. the one used
+	// in an earlier PUT request) to the path of the address object. If the path
+	// doesn't map to a known address object, it should be returned unchanged.
+	ResolveObjectPath(ctx context.Context, path string) (string, error)
+}
+
+// SyncBackend is an optional interface which can be implemented by a Backend
+// to support collection synchronization (RFC 6578) of address books via the
+// sync-collection REPORT.
+type SyncBackend interface {
+	// AddressBookSyncToken returns the current sync token of an address book.
+	AddressBookSyncToken(ctx context.Context, path string) (string, error)
+	// AddressBookChanges returns the changes to the objects of an address
+	// book since a sync token. An empty sync token requests an initial
+	// synchronization: all objects are reported as added.
+	// webdav.ErrInvalidSyncToken is returned if the sync token isn't valid
+	// anymore.
+	AddressBookChanges(ctx context.Context, path, syncToken string) (*webdav.SyncChanges, error)
+}
+
+// DryRunBackend is an optional interface which can be implemented by a Backend
+// honoring PutAddressObjectOptions.DryRun. Without it, or if SupportsDryRun
+// returns false, the "Prefer: dry-run" preference of PUT requests is ignored
+// and the objects are stored.
+type DryRunBackend interface {
+	SupportsDryRun() bool
+}
+
+// RawBackend is an optional interface which can be implemented by a Backend
+// storing address objects as raw vCard data. GET and PUT requests on
+// address objects are then served byte-exactly, without normalizing the data.
+type RawBackend interface {
+	GetAddressObjectRaw(ctx context.Context, path string) (*RawAddressObject, error)
+	// PutAddressObjectRaw is called with data which has been validated by the
+	// server.
+	PutAddressObjectRaw(ctx context.Context, path string, obj *RawAddressObject, opts *PutAddressObjectOptions) (loc string, err error)
+}
+
+// backendWrapper is implemented by Backends wrapping another Backend, such as
+// the one returned by NewEncryptedBackend.
+type backendWrapper interface {
+	unwrapBackend() Backend
+}
+
+// optionalBackend returns the Backend implementing the optional interfaces of
+// b which don't handle address data: SyncBackend, ObjectPathResolver and
+// webdav.DeadPropertyStore. Wrapped Backends forward these as is.
+func optionalBackend(b Backend) Backend {
+	for {
+		w, ok := b.(backendWrapper)
+		if !ok {
+			return b
+		}
+		b = w.unwrapBackend()
+	}
+}
+
 // Handler handles CardDAV HTTP requests. It can be used to create a CardDAV
 // server.
 type Handler struct {
 	Backend Backend
 	Prefix  string
+
+	// IdempotencyStore, if set, is used to deduplicate retried PUT requests
+	// carrying an Idempotency-Key header.
+	IdempotencyStore webdav.IdempotencyStore
+	// Visibility, if set, is used to hide collections and objects from GET,
+	// HEAD, PROPFIND and REPORT requests.
+	Visibility webdav.VisibilityFunc
+	// AuditSink, if set, is notified of each successful mutating request.
+	AuditSink webdav.AuditSink
+	// ErrorLog specifies an optional logger for errors, e.g. panics in the
+	// backend. If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+	// ErrorVerbosity controls how much error detail is sent to clients.
+	// Server errors are always logged to ErrorLog.
+	ErrorVerbosity webdav.ErrorVerbosity
+	// TimeLayout, if set, overrides the layout used to format timestamps
+	// such as DAV:getlastmodified in generated XML, e.g. time.RFC3339 for
+	// clients expecting Z-suffixed UTC timestamps. Timestamps are always
+	// converted to UTC. By default, the HTTP-date format mandated by RFC 4918
+	// is used.
+	TimeLayout string
+	// Listing, if set, enables browser-friendly listings of address book
+	// home sets and address books in response to GET requests.
+	Listing *webdav.ListingOptions
+	// Overrides intercept requests before they're handled, e.g. to serve
+	// custom endpoints. The first matching override is used.
+	Overrides []webdav.Override
+	// Transforms, if set, rewrite address objects received via PUT before
+	// they're stored, in order. Objects are re-encoded for RawBackend
+	// implementations, which normalizes line endings. The ETag sent back to
+	// the client reflects the stored form.
+	Transforms []TransformFunc
+	// SortResponses sorts the responses of PROPFIND and REPORT requests by
+	// href. Otherwise, resources are listed in the order of the Backend.
+	SortResponses bool
+}
+
+func (h *Handler) errorReporter() *internal.ErrorReporter {
+	return &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(h.ErrorVerbosity),
+		Logger:    h.ErrorLog,
+	}
+}
+
+func (h *Handler) serveMultiStatus(w http.ResponseWriter, resps []internal.Response) error {
+	if h.SortResponses {
+		internal.SortResponses(resps)
+	}
+	return internal.ServeMultiStatus(w, internal.NewMultiStatus(resps...))
 }
 
 // ServeHTTP implements http.Handler.
+//
+// Panics in the backend are recovered from and result in a 500 Internal
+// Server Error response.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	internal.ServeRecover(w, r, h.ErrorLog, http.HandlerFunc(h.serveHTTP))
+}
+
+func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.Backend == nil {
-		http.Error(w, "carddav: no backend available", http.StatusInternalServerError)
+		h.errorReporter().ServeError(w, r, internal.HTTPErrorf(http.StatusInternalServerError, "carddav: no backend available"))
 		return
 	}
 
+	r, err := internal.SanitizeRequest(r)
+	if err != nil {
+		h.errorReporter().ServeError(w, r, err)
+		return
+	}
+
+	webdav.WithRequestInfo(webdav.WithOverrides(h.Overrides, http.HandlerFunc(h.serveDAV))).ServeHTTP(w, r)
+}
+
+func (h *Handler) serveDAV(w http.ResponseWriter, r *http.Request) {
+	errs := h.errorReporter()
 	if r.URL.Path == "/.well-known/carddav" {
 		principalPath, err := h.Backend.CurrentUserPrincipal(r.Context())
 		if err != nil {
-			http.Error(w, "carddav: failed to determine current user principal", http.StatusInternalServerError)
+			errs.ServeError(w, r, fmt.Errorf("carddav: failed to determine current user principal: %w", err))
 			return
 		}
 
@@ -72,16 +223,33 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "REPORT":
 		err = h.handleReport(w, r)
 	default:
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+		hh := internal.Handler{
+			Backend:          h.newBackend(),
+			IdempotencyStore: h.IdempotencyStore,
+			ErrorReporter:    errs,
+			SortResponses:    h.SortResponses,
+		}
+		if h.AuditSink != nil {
+			hh.Audit = func(ctx context.Context, event *internal.AuditEvent) {
+				h.AuditSink.Audit(ctx, (*webdav.AuditEvent)(event))
+			}
 		}
-		hh := internal.Handler{&b}
 		hh.ServeHTTP(w, r)
 	}
 
 	if err != nil {
-		internal.ServeError(w, err)
+		errs.ServeError(w, r, err)
+	}
+}
+
+func (h *Handler) newBackend() *backend {
+	return &backend{
+		Backend:    h.Backend,
+		Prefix:     strings.TrimSuffix(h.Prefix, "/"),
+		Visibility: h.Visibility,
+		TimeLayout: h.TimeLayout,
+		Listing:    h.Listing,
+		Transforms: h.Transforms,
 	}
 }
 
@@ -95,8 +263,10 @@ func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) error {
 		return h.handleQuery(r, w, report.Query)
 	} else if report.Multiget != nil {
 		return h.handleMultiget(r.Context(), w, report.Multiget)
+	} else if report.SyncCollection != nil {
+		return h.handleSyncCollection(r, w, report.SyncCollection)
 	}
-	return internal.HTTPErrorf(http.StatusBadRequest, "carddav: expected addressbook-query or addressbook-multiget element in REPORT request")
+	return internal.HTTPErrorf(http.StatusBadRequest, "carddav: expected addressbook-query, addressbook-multiget or sync-collection element in REPORT request")
 }
 
 func decodePropFilter(el *propFilter) (*PropFilter, error) {
@@ -108,7 +278,16 @@ func decodePropFilter(el *propFilter) (*PropFilter, error) {
 		pf.IsNotDefined = true
 	}
 	for _, tm := range el.TextMatches {
-		pf.TextMatches = append(pf.TextMatches, *decodeTextMatch(&tm))
+		txt, err := decodeTextMatch(&tm)
+		if err != nil {
+			return nil, err
+		}
+		if txt.Component != "" {
+			if _, err := componentIndex(pf.Name, txt.Component); err != nil {
+				return nil, &internal.HTTPError{Code: http.StatusBadRequest, Err: err}
+			}
+		}
+		pf.TextMatches = append(pf.TextMatches, *txt)
 	}
 	for _, paramEl := range el.Params {
 		param, err := decodeParamFilter(&paramEl)
@@ -129,17 +308,26 @@ func decodeParamFilter(el *paramFilter) (*ParamFilter, error) {
 		pf.IsNotDefined = true
 	}
 	if el.TextMatch != nil {
-		pf.TextMatch = decodeTextMatch(el.TextMatch)
+		txt, err := decodeTextMatch(el.TextMatch)
+		if err != nil {
+			return nil, err
+		}
+		pf.TextMatch = txt
 	}
 	return pf, nil
 }
 
-func decodeTextMatch(tm *textMatch) *TextMatch {
+func decodeTextMatch(tm *textMatch) (*TextMatch, error) {
+	if tm.Collation != "" && !internal.IsSupportedCollation(tm.Collation) {
+		return nil, NewPreconditionError(PreconditionSupportedCollation)
+	}
 	return &TextMatch{
 		Text:            tm.Text,
 		NegateCondition: bool(tm.NegateCondition),
 		MatchType:       MatchType(tm.MatchType),
-	}
+		Collation:       tm.Collation,
+		Component:       tm.Component,
+	}, nil
 }
 
 func decodeAddressDataReq(addressData *addressDataReq) (*AddressDataRequest, error) {
@@ -182,60 +370,113 @@ func (h *Handler) handleQuery(r *http.Request, w http.ResponseWriter, query *add
 		}
 	}
 
-	aos, err := h.Backend.QueryAddressObjects(r.Context(), r.URL.Path, &q)
-	if err != nil {
-		return err
+	b := h.newBackend()
+	propfind := internal.PropFind{
+		Prop:     query.Prop,
+		AllProp:  query.AllProp,
+		PropName: query.PropName,
 	}
+	return internal.StreamMultiStatus(w, r, h.errorReporter(), h.SortResponses, func(fn func(resp *internal.Response) error) error {
+		n := 0
+		objectFn := func(ao *AddressObject) error {
+			if q.Limit > 0 && n >= q.Limit {
+				return errQueryLimitReached
+			}
+			n++
+			if !b.Visibility.IsVisible(r.Context(), ao.Path) {
+				return nil
+			}
 
-	var resps []internal.Response
-	for _, ao := range aos {
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+			filtered := filterProperties(q.DataRequest, *ao)
+			resp, err := b.propFindAddressObject(r.Context(), &propfind, &filtered)
+			if err != nil {
+				return err
+			}
+			return fn(resp)
 		}
-		propfind := internal.PropFind{
-			Prop:     query.Prop,
-			AllProp:  query.AllProp,
-			PropName: query.PropName,
+
+		var err error
+		if b.resourceTypeAtPath(r.URL.Path) == resourceTypeAddressBook && b.isEncryptedAddressBook(r.Context(), r.URL.Path) {
+			// Filters can't be evaluated on end-to-end encrypted objects, so
+			// all of them are returned
+			err = b.listAddressObjects(r.Context(), r.URL.Path, &q.DataRequest, objectFn)
+		} else {
+			err = b.queryAddressObjects(r.Context(), r.URL.Path, &q, objectFn)
 		}
-		resp, err := b.propFindAddressObject(r.Context(), &propfind, &ao)
-		if err != nil {
-			return err
+		if err == errQueryLimitReached {
+			err = nil
 		}
-		resps = append(resps, *resp)
-	}
-
-	ms := internal.NewMultiStatus(resps...)
-	return internal.ServeMultiStatus(w, ms)
+		return err
+	})
 }
 
+// errQueryLimitReached is used to stop listing address objects once the
+// limit of an addressbook-query REPORT has been reached.
+var errQueryLimitReached = errors.New("carddav: query limit reached")
+
 func (h *Handler) handleMultiget(ctx context.Context, w http.ResponseWriter, multiget *addressbookMultiget) error {
+	resps, err := h.multigetResponses(ctx, multiget)
+	if err != nil {
+		return err
+	}
+	return h.serveMultiStatus(w, resps)
+}
+
+// multigetResponses returns the responses for the address objects requested
+// by an addressbook-multiget report. Objects which can't be retrieved are
+// reported with an error status.
+func (h *Handler) multigetResponses(ctx context.Context, multiget *addressbookMultiget) ([]internal.Response, error) {
 	var dataReq AddressDataRequest
 	if multiget.Prop != nil {
 		var addressData addressDataReq
 		if err := multiget.Prop.Decode(&addressData); err != nil && !internal.IsNotFound(err) {
-			return err
+			return nil, err
 		}
 		decoded, err := decodeAddressDataReq(&addressData)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		dataReq = *decoded
 	}
 
+	b := h.newBackend()
 	var resps []internal.Response
 	for _, href := range multiget.Hrefs {
-		ao, err := h.Backend.GetAddressObject(ctx, href.Path, &dataReq)
+		p, err := internal.SanitizeURLPath(href.Path)
 		if err != nil {
 			resp := internal.NewErrorResponse(href.Path, err)
 			resps = append(resps, *resp)
 			continue
 		}
 
-		b := backend{
-			Backend: h.Backend,
-			Prefix:  strings.TrimSuffix(h.Prefix, "/"),
+		objPath, err := b.objectPath(ctx, p)
+		if err != nil {
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		if !b.Visibility.IsVisible(ctx, objPath) {
+			err := &internal.HTTPError{Code: http.StatusNotFound}
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		if !internal.PathAllowed(ctx, objPath) {
+			err := &internal.HTTPError{Code: http.StatusForbidden}
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
 		}
+
+		ao, err := h.Backend.GetAddressObject(ctx, objPath, &dataReq)
+		if err != nil {
+			resp := internal.NewErrorResponse(href.Path, err)
+			resps = append(resps, *resp)
+			continue
+		}
+		filtered := filterProperties(dataReq, *ao)
+		ao = &filtered
+
 		propfind := internal.PropFind{
 			Prop:     multiget.Prop,
 			AllProp:  multiget.AllProp,
@@ -243,18 +484,60 @@ func (h *Handler) handleMultiget(ctx context.Context, w http.ResponseWriter, mul
 		}
 		resp, err := b.propFindAddressObject(ctx, &propfind, ao)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		resps = append(resps, *resp)
 	}
 
-	ms := internal.NewMultiStatus(resps...)
-	return internal.ServeMultiStatus(w, ms)
+	return resps, nil
+}
+
+func (h *Handler) handleSyncCollection(r *http.Request, w http.ResponseWriter, query *internal.SyncCollectionQuery) error {
+	sb, ok := optionalBackend(h.Backend).(SyncBackend)
+	if !ok {
+		return internal.HTTPErrorf(http.StatusForbidden, "carddav: sync-collection REPORT is unsupported")
+	}
+	if recursive, err := query.IsRecursive(); err != nil {
+		return err
+	} else if recursive {
+		return internal.HTTPErrorf(http.StatusForbidden, "carddav: infinite sync-level is unsupported")
+	}
+	if h.newBackend().resourceTypeAtPath(r.URL.Path) != resourceTypeAddressBook {
+		return internal.HTTPErrorf(http.StatusForbidden, "carddav: sync-collection REPORT is only supported on address books")
+	}
+
+	page, err := query.Page(func(syncToken string) (string, []string, []string, error) {
+		changes, err := sb.AddressBookChanges(r.Context(), r.URL.Path, syncToken)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return changes.SyncToken, append(changes.Added, changes.Modified...), changes.Deleted, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	multiget := addressbookMultiget{Prop: query.Prop}
+	for _, p := range page.Updated {
+		multiget.Hrefs = append(multiget.Hrefs, internal.Href{Path: p})
+	}
+	if multiget.Prop == nil {
+		multiget.Prop = &internal.Prop{}
+	}
+	resps, err := h.multigetResponses(r.Context(), &multiget)
+	if err != nil {
+		return err
+	}
+	return internal.ServeSyncCollection(w, r.URL.Path, page, resps, page.Deleted, h.SortResponses)
 }
 
 type backend struct {
-	Backend Backend
-	Prefix  string
+	Backend    Backend
+	Prefix     string
+	Visibility webdav.VisibilityFunc
+	TimeLayout string
+	Listing    *webdav.ListingOptions
+	Transforms []TransformFunc
 }
 
 type resourceType int
@@ -279,13 +562,21 @@ func (b *backend) resourceTypeAtPath(reqPath string) resourceType {
 	return resourceType(len(strings.Split(p, "/")) - 1)
 }
 
+func (b *backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.Backend.CurrentUserPrincipal(ctx)
+}
+
 func (b *backend) Options(r *http.Request) (caps []string, allow []string, err error) {
 	caps = []string{"addressbook"}
 
 	if b.resourceTypeAtPath(r.URL.Path) != resourceTypeAddressObject {
 		// Note: some clients assume the address book is read-only when
 		// DELETE/MKCOL are missing
-		return caps, []string{http.MethodOptions, "PROPFIND", "REPORT", "DELETE", "MKCOL"}, nil
+		allow = []string{http.MethodOptions, "PROPFIND", "REPORT", "DELETE", "MKCOL"}
+		if rt := b.resourceTypeAtPath(r.URL.Path); b.Listing != nil && (rt == resourceTypeAddressBookHomeSet || rt == resourceTypeAddressBook) {
+			allow = append(allow, http.MethodGet, http.MethodHead)
+		}
+		return caps, allow, nil
 	}
 
 	var dataReq AddressDataRequest
@@ -306,23 +597,64 @@ func (b *backend) Options(r *http.Request) (caps []string, allow []string, err e
 	}, nil
 }
 
+// objectPath returns the path of the address object requested by the client.
+func (b *backend) objectPath(ctx context.Context, p string) (string, error) {
+	if resolver, ok := optionalBackend(b.Backend).(ObjectPathResolver); ok {
+		return resolver.ResolveObjectPath(ctx, p)
+	}
+	return p, nil
+}
+
 func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
+	if b.Listing != nil {
+		switch b.resourceTypeAtPath(r.URL.Path) {
+		case resourceTypeAddressBookHomeSet, resourceTypeAddressBook:
+			return b.serveListing(w, r)
+		}
+	}
+
+	objPath, err := b.objectPath(r.Context(), r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !b.Visibility.IsVisible(r.Context(), objPath) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	if rb, ok := b.Backend.(RawBackend); ok {
+		raw, err := rb.GetAddressObjectRaw(r.Context(), objPath)
+		if err != nil {
+			return err
+		}
+		if raw.ContentType == "" {
+			raw.ContentType = vcard.MIMEType
+		}
+		internal.ServeRawObject(w, r, raw.ContentType, raw.ETag, raw.ModTime, raw.Data)
+		return nil
+	}
+
 	var dataReq AddressDataRequest
 	if r.Method != http.MethodHead {
 		dataReq.AllProp = true
 	}
-	ao, err := b.Backend.GetAddressObject(r.Context(), r.URL.Path, &dataReq)
+	ao, err := b.Backend.GetAddressObject(r.Context(), objPath, &dataReq)
 	if err != nil {
 		return err
 	}
 
 	w.Header().Set("Content-Type", vcard.MIMEType)
+	// The object is re-encoded on each request, so byte ranges can't be
+	// served reliably
+	w.Header().Set("Accept-Ranges", "none")
 	if ao.ContentLength > 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(ao.ContentLength, 10))
 	}
 	if ao.ETag != "" {
 		w.Header().Set("ETag", internal.ETag(ao.ETag).String())
 	}
+	if ao.DownloadName != "" {
+		w.Header().Set("Content-Disposition", internal.FormatContentDisposition(ao.DownloadName))
+	}
 	if !ao.ModTime.IsZero() {
 		w.Header().Set("Last-Modified", ao.ModTime.UTC().Format(http.TimeFormat))
 	}
@@ -333,96 +665,169 @@ func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (b *backend) serveListing(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	if !b.Visibility.IsVisible(ctx, r.URL.Path) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	listing := webdav.Listing{Path: r.URL.Path}
+	if b.resourceTypeAtPath(r.URL.Path) == resourceTypeAddressBookHomeSet {
+		abs, err := b.Backend.ListAddressBooks(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ab := range abs {
+			p := strings.TrimSuffix(ab.Path, "/")
+			if path.Dir(p) != path.Clean(r.URL.Path) || !b.Visibility.IsVisible(ctx, ab.Path) {
+				continue
+			}
+			name := ab.Name
+			if name == "" {
+				name = path.Base(p)
+			}
+			listing.Entries = append(listing.Entries, webdav.ListingEntry{
+				Name:         name,
+				Path:         ab.Path,
+				IsCollection: true,
+			})
+		}
+	} else {
+		ab, err := b.Backend.GetAddressBook(ctx, r.URL.Path)
+		if err != nil {
+			return err
+		}
+		objs, err := b.Backend.ListAddressObjects(ctx, ab.Path, &AddressDataRequest{})
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if !b.Visibility.IsVisible(ctx, obj.Path) {
+				continue
+			}
+			listing.Entries = append(listing.Entries, webdav.ListingEntry{
+				Name:        path.Base(obj.Path),
+				Path:        obj.Path,
+				Size:        obj.ContentLength,
+				ModTime:     obj.ModTime,
+				ContentType: vcard.MIMEType,
+			})
+		}
+	}
+
+	return b.Listing.ServeListing(w, r, &listing)
+}
+
 func (b *backend) PropFind(r *http.Request, propfind *internal.PropFind, depth internal.Depth) (*internal.MultiStatus, error) {
+	var resps []internal.Response
+	err := b.PropFindStream(r, propfind, depth, func(resp *internal.Response) error {
+		resps = append(resps, *resp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewMultiStatus(resps...), nil
+}
+
+// PropFindStream implements internal.PropFindStreamer.
+func (b *backend) PropFindStream(r *http.Request, propfind *internal.PropFind, depth internal.Depth, fn func(resp *internal.Response) error) error {
 	resType := b.resourceTypeAtPath(r.URL.Path)
 
+	reqPath := r.URL.Path
+	if resType == resourceTypeAddressObject {
+		var err error
+		reqPath, err = b.objectPath(r.Context(), reqPath)
+		if err != nil {
+			return err
+		}
+	}
+	if (resType == resourceTypeAddressBook || resType == resourceTypeAddressObject) && !b.Visibility.IsVisible(r.Context(), reqPath) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
 	var dataReq AddressDataRequest
-	var resps []internal.Response
 
 	switch resType {
 	case resourceTypeRoot:
 		resp, err := b.propFindRoot(r.Context(), propfind)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resps = append(resps, *resp)
+		return fn(resp)
 	case resourceTypeUserPrincipal:
 		principalPath, err := b.Backend.CurrentUserPrincipal(r.Context())
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if r.URL.Path == principalPath {
 			resp, err := b.propFindUserPrincipal(r.Context(), propfind)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if err := fn(resp); err != nil {
+				return err
 			}
-			resps = append(resps, *resp)
 			if depth != internal.DepthZero {
 				resp, err := b.propFindHomeSet(r.Context(), propfind)
 				if err != nil {
-					return nil, err
+					return err
+				}
+				if err := fn(resp); err != nil {
+					return err
 				}
-				resps = append(resps, *resp)
 				if depth == internal.DepthInfinity {
-					resps_, err := b.propFindAllAddressBooks(r.Context(), propfind, true)
-					if err != nil {
-						return nil, err
-					}
-					resps = append(resps, resps_...)
+					return b.propFindAllAddressBooks(r.Context(), propfind, true, fn)
 				}
 			}
 		}
 	case resourceTypeAddressBookHomeSet:
 		homeSetPath, err := b.Backend.AddressBookHomeSetPath(r.Context())
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if r.URL.Path == homeSetPath {
 			resp, err := b.propFindHomeSet(r.Context(), propfind)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if err := fn(resp); err != nil {
+				return err
 			}
-			resps = append(resps, *resp)
 			if depth != internal.DepthZero {
 				recurse := depth == internal.DepthInfinity
-				resps_, err := b.propFindAllAddressBooks(r.Context(), propfind, recurse)
-				if err != nil {
-					return nil, err
-				}
-				resps = append(resps, resps_...)
+				return b.propFindAllAddressBooks(r.Context(), propfind, recurse, fn)
 			}
 		}
 	case resourceTypeAddressBook:
 		ab, err := b.Backend.GetAddressBook(r.Context(), r.URL.Path)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		resp, err := b.propFindAddressBook(r.Context(), propfind, ab)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 		if depth != internal.DepthZero {
-			resps_, err := b.propFindAllAddressObjects(r.Context(), propfind, ab)
-			if err != nil {
-				return nil, err
-			}
-			resps = append(resps, resps_...)
+			return b.propFindAllAddressObjects(r.Context(), propfind, ab, fn)
 		}
 	case resourceTypeAddressObject:
-		ao, err := b.Backend.GetAddressObject(r.Context(), r.URL.Path, &dataReq)
+		ao, err := b.Backend.GetAddressObject(r.Context(), reqPath, &dataReq)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		resp, err := b.propFindAddressObject(r.Context(), propfind, ao)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resps = append(resps, *resp)
+		return fn(resp)
 	}
 
-	return internal.NewMultiStatus(resps...), nil
+	return nil
 }
 
 func (b *backend) propFindRoot(ctx context.Context, propfind *internal.PropFind) (*internal.Response, error) {
@@ -507,12 +912,20 @@ func (b *backend) propFindAddressBook(ctx context.Context, propfind *internal.Pr
 			return &addressbookDescription{Description: ab.Description}, nil
 		},
 		supportedAddressDataName: func(*internal.RawXMLValue) (interface{}, error) {
-			return &supportedAddressData{
-				Types: []addressDataType{
-					{ContentType: vcard.MIMEType, Version: "3.0"},
-					{ContentType: vcard.MIMEType, Version: "4.0"},
-				},
-			}, nil
+			types := []addressDataType{
+				{ContentType: vcard.MIMEType, Version: "3.0"},
+				{ContentType: vcard.MIMEType, Version: "4.0"},
+			}
+			if len(ab.SupportedAddressData) > 0 {
+				types = make([]addressDataType, len(ab.SupportedAddressData))
+				for i, t := range ab.SupportedAddressData {
+					types[i] = addressDataType{ContentType: t.ContentType, Version: t.Version}
+				}
+			}
+			return &supportedAddressData{Types: types}, nil
+		},
+		supportedCollationSetName: func(*internal.RawXMLValue) (interface{}, error) {
+			return &supportedCollationSet{Collations: internal.SupportedCollations}, nil
 		},
 	}
 
@@ -521,32 +934,71 @@ func (b *backend) propFindAddressBook(ctx context.Context, propfind *internal.Pr
 			return &maxResourceSize{Size: ab.MaxResourceSize}, nil
 		}
 	}
+	if ab.Encrypted {
+		props[encryptedCollectionName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &encryptedCollection{}, nil
+		}
+	}
+
+	if ab.CTag != "" {
+		props[internal.GetCTagName] = func(*internal.RawXMLValue) (interface{}, error) {
+			return &internal.GetCTag{CTag: ab.CTag}, nil
+		}
+	}
+	if sb, ok := optionalBackend(b.Backend).(SyncBackend); ok {
+		props[internal.SyncTokenName] = func(*internal.RawXMLValue) (interface{}, error) {
+			token, err := sb.AddressBookSyncToken(ctx, ab.Path)
+			if err != nil {
+				return nil, err
+			}
+			return &internal.SyncToken{Token: token}, nil
+		}
+		if ab.CTag == "" {
+			// The sync token changes whenever the address book changes
+			props[internal.GetCTagName] = func(*internal.RawXMLValue) (interface{}, error) {
+				token, err := sb.AddressBookSyncToken(ctx, ab.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &internal.GetCTag{CTag: token}, nil
+			}
+		}
+	}
+
+	if store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore); ok {
+		if err := internal.AddDeadProps(ctx, props, store, ab.Path, isLiveProp); err != nil {
+			return nil, err
+		}
+	}
 
 	return internal.NewPropFindResponse(ab.Path, propfind, props)
 }
 
-func (b *backend) propFindAllAddressBooks(ctx context.Context, propfind *internal.PropFind, recurse bool) ([]internal.Response, error) {
+func (b *backend) propFindAllAddressBooks(ctx context.Context, propfind *internal.PropFind, recurse bool, fn func(resp *internal.Response) error) error {
 	abs, err := b.Backend.ListAddressBooks(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var resps []internal.Response
 	for _, ab := range abs {
+		if !b.Visibility.IsVisible(ctx, ab.Path) {
+			continue
+		}
+
 		resp, err := b.propFindAddressBook(ctx, propfind, &ab)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 		if recurse {
-			resps_, err := b.propFindAllAddressObjects(ctx, propfind, &ab)
-			if err != nil {
-				return nil, err
+			if err := b.propFindAllAddressObjects(ctx, propfind, &ab, fn); err != nil {
+				return err
 			}
-			resps = append(resps, resps_...)
 		}
 	}
-	return resps, nil
+	return nil
 }
 
 func (b *backend) propFindAddressObject(ctx context.Context, propfind *internal.PropFind, ao *AddressObject) (*internal.Response, error) {
@@ -579,7 +1031,10 @@ func (b *backend) propFindAddressObject(ctx context.Context, propfind *internal.
 	}
 	if !ao.ModTime.IsZero() {
 		props[internal.GetLastModifiedName] = func(*internal.RawXMLValue) (interface{}, error) {
-			return &internal.GetLastModified{LastModified: internal.Time(ao.ModTime)}, nil
+			return &internal.GetLastModified{
+				LastModified: internal.Time(ao.ModTime),
+				Layout:       b.TimeLayout,
+			}, nil
 		}
 	}
 
@@ -589,28 +1044,75 @@ func (b *backend) propFindAddressObject(ctx context.Context, propfind *internal.
 		}
 	}
 
+	if store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore); ok {
+		if err := internal.AddDeadProps(ctx, props, store, ao.Path, isLiveProp); err != nil {
+			return nil, err
+		}
+	}
+
 	return internal.NewPropFindResponse(ao.Path, propfind, props)
 }
 
-func (b *backend) propFindAllAddressObjects(ctx context.Context, propfind *internal.PropFind, ab *AddressBook) ([]internal.Response, error) {
+func (b *backend) propFindAllAddressObjects(ctx context.Context, propfind *internal.PropFind, ab *AddressBook, fn func(resp *internal.Response) error) error {
 	var dataReq AddressDataRequest
-	aos, err := b.Backend.ListAddressObjects(ctx, ab.Path, &dataReq)
+	return b.listAddressObjects(ctx, ab.Path, &dataReq, func(ao *AddressObject) error {
+		if !b.Visibility.IsVisible(ctx, ao.Path) {
+			return nil
+		}
+
+		resp, err := b.propFindAddressObject(ctx, propfind, ao)
+		if err != nil {
+			return err
+		}
+		return fn(resp)
+	})
+}
+
+// listAddressObjects calls fn for each object of an address book. Objects are
+// streamed if the Backend implements AddressObjectStreamer.
+func (b *backend) listAddressObjects(ctx context.Context, path string, req *AddressDataRequest, fn func(ao *AddressObject) error) error {
+	if streamer, ok := b.Backend.(AddressObjectStreamer); ok {
+		return streamer.ListAddressObjectsStream(ctx, path, req, fn)
+	}
+	l, err := b.Backend.ListAddressObjects(ctx, path, req)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var resps []internal.Response
-	for _, ao := range aos {
-		resp, err := b.propFindAddressObject(ctx, propfind, &ao)
-		if err != nil {
-			return nil, err
+// queryAddressObjects calls fn for each object of an address book matching a
+// query. Objects are streamed if the Backend implements
+// AddressObjectStreamer.
+func (b *backend) queryAddressObjects(ctx context.Context, path string, query *AddressBookQuery, fn func(ao *AddressObject) error) error {
+	if streamer, ok := b.Backend.(AddressObjectStreamer); ok {
+		return streamer.QueryAddressObjectsStream(ctx, path, query, fn)
+	}
+	l, err := b.Backend.QueryAddressObjects(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
 		}
-		resps = append(resps, *resp)
 	}
-	return resps, nil
+	return nil
 }
 
 func (b *backend) PropPatch(r *http.Request, update *internal.PropertyUpdate) (*internal.Response, error) {
+	if store, ok := optionalBackend(b.Backend).(webdav.DeadPropertyStore); ok {
+		if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+			return nil, &internal.HTTPError{Code: http.StatusNotFound}
+		}
+		return internal.PatchDeadProperties(r.Context(), store, r.URL.Path, update, isLiveProp)
+	}
+
 	homeSetPath, err := b.Backend.AddressBookHomeSetPath(r.Context())
 	if err != nil {
 		return nil, err
@@ -650,14 +1152,44 @@ func (b *backend) PropPatch(r *http.Request, update *internal.PropertyUpdate) (*
 	return resp, nil
 }
 
-func (b *backend) Put(r *http.Request) (*internal.Href, error) {
+// isLiveProp reports whether a property is computed by the server. Other
+// properties, e.g. DAV:displayname or CARDDAV:addressbook-description, can be
+// changed with PROPPATCH.
+func isLiveProp(name xml.Name) bool {
+	switch name {
+	case internal.ResourceTypeName, internal.GetContentLengthName,
+		internal.GetLastModifiedName, internal.GetContentTypeName,
+		internal.GetETagName, internal.SyncTokenName, internal.GetCTagName,
+		internal.CurrentUserPrincipalName, addressBookHomeSetName,
+		supportedAddressDataName, supportedCollationSetName,
+		maxResourceSizeName, addressDataName, encryptedCollectionName:
+		return true
+	}
+	return false
+}
+
+func (b *backend) SupportsDryRun(r *http.Request) bool {
+	drb, ok := b.Backend.(DryRunBackend)
+	return ok && drb.SupportsDryRun()
+}
+
+func (b *backend) Put(r *http.Request) (*internal.PutResult, error) {
 	ifNoneMatch := webdav.ConditionalMatch(r.Header.Get("If-None-Match"))
 	ifMatch := webdav.ConditionalMatch(r.Header.Get("If-Match"))
 
 	opts := PutAddressObjectOptions{
 		IfNoneMatch: ifNoneMatch,
 		IfMatch:     ifMatch,
+		DryRun:      internal.IsDryRun(r.Header) && b.SupportsDryRun(r),
+	}
+
+	// TODO: add support for the CARDDAV:no-uid-conflict error
+	objPath, err := b.objectPath(r.Context(), r.URL.Path)
+	if err != nil {
+		return nil, err
 	}
+	parent := b.parentAddressBook(r.Context(), path.Dir(objPath))
+	encrypted := parent != nil && parent.Encrypted
 
 	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
@@ -668,20 +1200,100 @@ func (b *backend) Put(r *http.Request) (*internal.Href, error) {
 		return nil, internal.HTTPErrorf(http.StatusBadRequest, "carddav: unsupporetd Content-Type %q", t)
 	}
 
-	// TODO: check CARDDAV:max-resource-size precondition
-	card, err := vcard.NewDecoder(r.Body).Decode()
+	data, err := readObject(r, parent)
+	if err != nil {
+		return nil, err
+	}
+	card, err := vcard.NewDecoder(bytes.NewReader(data)).Decode()
 	if err != nil {
 		// TODO: send CARDDAV:valid-address-data error
 		return nil, internal.HTTPErrorf(http.StatusBadRequest, "carddav: failed to parse vCard: %v", err)
 	}
 
-	// TODO: add support for the CARDDAV:no-uid-conflict error
-	loc, err := b.Backend.PutAddressObject(r.Context(), r.URL.Path, card, &opts)
+	verbatim := true
+	if len(b.Transforms) > 0 && !encrypted {
+		if err := transform(r.Context(), b.Transforms, objPath, card); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := vcard.NewEncoder(&buf).Encode(card); err != nil {
+			return nil, err
+		}
+		verbatim = bytes.Equal(buf.Bytes(), data)
+		data = buf.Bytes()
+	}
+
+	var loc string
+	if rb, ok := b.Backend.(RawBackend); ok {
+		loc, err = rb.PutAddressObjectRaw(r.Context(), objPath, &RawAddressObject{
+			Path:        objPath,
+			ContentType: r.Header.Get("Content-Type"),
+			Data:        data,
+		}, &opts)
+	} else {
+		loc, err = b.Backend.PutAddressObject(r.Context(), objPath, card, &opts)
+	}
 	if err != nil {
 		return nil, err
+	} else if opts.DryRun {
+		return nil, nil
 	}
 
-	return &internal.Href{Path: loc}, nil
+	res := &internal.PutResult{Href: &internal.Href{Path: loc}}
+	if verbatim {
+		res.ETag = b.objectETag(r.Context(), loc)
+	}
+	return res, nil
+}
+
+// objectETag returns the ETag of the address object at p, or an empty string
+// if it can't be found.
+func (b *backend) objectETag(ctx context.Context, p string) string {
+	if rb, ok := b.Backend.(RawBackend); ok {
+		if obj, err := rb.GetAddressObjectRaw(ctx, p); err == nil {
+			return obj.ETag
+		}
+		return ""
+	}
+	if ao, err := b.Backend.GetAddressObject(ctx, p, &AddressDataRequest{}); err == nil {
+		return ao.ETag
+	}
+	return ""
+}
+
+// isEncryptedAddressBook reports whether an address book holds end-to-end
+// encrypted objects. Address books which can't be found are handled as
+// regular address books: the backend reports the error when objects are
+// accessed.
+func (b *backend) isEncryptedAddressBook(ctx context.Context, p string) bool {
+	ab := b.parentAddressBook(ctx, p)
+	return ab != nil && ab.Encrypted
+}
+
+// parentAddressBook returns the address book at p, or nil if there is none.
+func (b *backend) parentAddressBook(ctx context.Context, p string) *AddressBook {
+	ab, err := b.Backend.GetAddressBook(ctx, strings.TrimSuffix(p, "/")+"/")
+	if err != nil {
+		ab, err = b.Backend.GetAddressBook(ctx, strings.TrimSuffix(p, "/"))
+	}
+	if err != nil {
+		return nil
+	}
+	return ab
+}
+
+// readObject reads the body of a PUT request, checking the
+// CARDDAV:max-resource-size precondition of the parent address book.
+func readObject(r *http.Request, ab *AddressBook) ([]byte, error) {
+	var maxSize int64
+	if ab != nil {
+		maxSize = ab.MaxResourceSize
+	}
+	data, err := internal.ReadBody(r, maxSize)
+	if err == internal.ErrBodyTooLarge {
+		return nil, NewPreconditionError(PreconditionMaxResourceSize)
+	}
+	return data, err
 }
 
 func (b *backend) Delete(r *http.Request) error {
@@ -689,7 +1301,11 @@ func (b *backend) Delete(r *http.Request) error {
 	case resourceTypeAddressBook:
 		return b.Backend.DeleteAddressBook(r.Context(), r.URL.Path)
 	case resourceTypeAddressObject:
-		return b.Backend.DeleteAddressObject(r.Context(), r.URL.Path)
+		objPath, err := b.objectPath(r.Context(), r.URL.Path)
+		if err != nil {
+			return err
+		}
+		return b.Backend.DeleteAddressObject(r.Context(), objPath)
 	}
 	return internal.HTTPErrorf(http.StatusForbidden, "carddav: cannot delete resource at given location")
 }
@@ -699,6 +1315,10 @@ func (b *backend) Mkcol(r *http.Request) error {
 		return internal.HTTPErrorf(http.StatusForbidden, "carddav: address book creation not allowed at given location")
 	}
 
+	if _, err := b.Backend.GetAddressBook(r.Context(), r.URL.Path); err == nil {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "carddav: address book already exists")
+	}
+
 	ab := AddressBook{
 		Path: r.URL.Path,
 	}
@@ -715,11 +1335,36 @@ func (b *backend) Mkcol(r *http.Request) error {
 			return internal.HTTPErrorf(http.StatusBadRequest, "carddav: error parsing mkcol request: %s", err.Error())
 		}
 
-		if !m.ResourceType.Is(internal.CollectionName) || !m.ResourceType.Is(addressBookName) {
+		var prop internal.Prop
+		if m.Set != nil {
+			prop = m.Set.Prop
+		}
+		var resourceType internal.ResourceType
+		if err := prop.Decode(&resourceType); err != nil && !internal.IsNotFound(err) {
+			return err
+		}
+		if !resourceType.Is(internal.CollectionName) || !resourceType.Is(addressBookName) {
 			return internal.HTTPErrorf(http.StatusBadRequest, "carddav: unexpected resource type")
 		}
-		ab.Name = m.DisplayName
-		ab.Description = m.Description.Description
+
+		var displayName internal.DisplayName
+		if err := prop.Decode(&displayName); err == nil {
+			ab.Name = displayName.Name
+		} else if !internal.IsNotFound(err) {
+			return err
+		}
+		var desc addressbookDescription
+		if err := prop.Decode(&desc); err == nil {
+			ab.Description = desc.Description
+		} else if !internal.IsNotFound(err) {
+			return err
+		}
+		var encrypted encryptedCollection
+		if err := prop.Decode(&encrypted); err == nil {
+			ab.Encrypted = true
+		} else if !internal.IsNotFound(err) {
+			return err
+		}
 		// TODO ...
 	}
 	return b.Backend.CreateAddressBook(r.Context(), ab)
@@ -741,6 +1386,7 @@ const (
 	PreconditionSupportedAddressData PreconditionType = "supported-address-data"
 	PreconditionValidAddressData     PreconditionType = "valid-address-data"
 	PreconditionMaxResourceSize      PreconditionType = "max-resource-size"
+	PreconditionSupportedCollation   PreconditionType = "supported-collation"
 )
 
 func NewPreconditionError(err PreconditionType) error {
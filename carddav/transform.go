@@ -0,0 +1,50 @@
+package carddav
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// TransformFunc rewrites an address object received via PUT before it's
+// stored. addressBookPath is the path of the address book containing the
+// object, which allows transformations to be applied per address book.
+type TransformFunc func(ctx context.Context, addressBookPath string, card vcard.Card) error
+
+// StripExtendedFields is a TransformFunc removing non-standard "X-" fields.
+func StripExtendedFields(ctx context.Context, addressBookPath string, card vcard.Card) error {
+	for k := range card {
+		if strings.HasPrefix(k, "X-") {
+			delete(card, k)
+		}
+	}
+	return nil
+}
+
+// AssignUID is a TransformFunc generating a UID for vCards lacking one, which
+// some clients omit.
+func AssignUID(ctx context.Context, addressBookPath string, card vcard.Card) error {
+	if card.Value(vcard.FieldUID) != "" {
+		return nil
+	}
+	uuid, err := internal.NewUUID()
+	if err != nil {
+		return err
+	}
+	card.SetValue(vcard.FieldUID, "urn:uuid:"+uuid)
+	return nil
+}
+
+// transform applies transformations to an address object about to be stored
+// at objPath.
+func transform(ctx context.Context, transforms []TransformFunc, objPath string, card vcard.Card) error {
+	for _, f := range transforms {
+		if err := f(ctx, path.Dir(objPath), card); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package webdav
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Checksum describes how uploads are verified by Client.CreateWithChecksum.
+type Checksum struct {
+	// Algorithm is the name of the hash algorithm, e.g. "SHA256". A value
+	// prefixed with the algorithm name, e.g. "SHA256:abcd" or "sha256=q80=",
+	// is accepted in the server's checksum header.
+	Algorithm string
+	// New creates the hash computed while streaming the upload.
+	New func() hash.Hash
+	// Header is the response header carrying the server's checksum of the
+	// stored file, e.g. "OC-Checksum".
+	Header string
+	// VerifyETag, if set, falls back to comparing the checksum with the
+	// file's ETag when the response lacks Header. This works with backends
+	// using content hashes as ETags.
+	VerifyETag bool
+}
+
+// ChecksumMismatchError is returned when the checksum computed while uploading
+// a file doesn't match the one reported by the server.
+type ChecksumMismatchError struct {
+	Path      string
+	Algorithm string
+	// Local is the hex-encoded checksum of the uploaded data.
+	Local string
+	// Remote is the checksum reported by the server.
+	Remote string
+}
+
+func (err *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("webdav: %v checksum mismatch for %v: uploaded %v, server reported %v", err.Algorithm, err.Path, err.Local, err.Remote)
+}
+
+// matchChecksum reports whether a checksum reported by the server matches
+// sum. Hex and base64 encodings are accepted.
+func matchChecksum(remote, algorithm string, sum []byte) bool {
+	remote = strings.TrimSpace(remote)
+	for _, sep := range []string{":", "="} {
+		prefix := algorithm + sep
+		if len(remote) > len(prefix) && strings.EqualFold(remote[:len(prefix)], prefix) {
+			remote = remote[len(prefix):]
+			break
+		}
+	}
+
+	if b, err := hex.DecodeString(remote); err == nil && string(b) == string(sum) {
+		return true
+	}
+	b, err := base64.StdEncoding.DecodeString(remote)
+	return err == nil && string(b) == string(sum)
+}
+
+type checksumWriter struct {
+	*fileWriter
+	ctx      context.Context
+	c        *Client
+	name     string
+	checksum *Checksum
+	h        hash.Hash
+}
+
+func (cw *checksumWriter) Write(b []byte) (int, error) {
+	n, err := cw.fileWriter.Write(b)
+	cw.h.Write(b[:n])
+	return n, err
+}
+
+func (cw *checksumWriter) Close() error {
+	if cw.closed {
+		return cw.closeErr
+	}
+	if err := cw.fileWriter.Close(); err != nil {
+		return err
+	}
+	cw.closeErr = cw.verify()
+	return cw.closeErr
+}
+
+func (cw *checksumWriter) verify() error {
+	sum := cw.h.Sum(nil)
+
+	remote := ""
+	if cw.checksum.Header != "" {
+		remote = cw.respHeader.Get(cw.checksum.Header)
+	}
+	if remote == "" && cw.checksum.VerifyETag {
+		fi, err := cw.c.Stat(cw.ctx, cw.name)
+		if err != nil {
+			return err
+		}
+		remote = fi.ETag
+	}
+	if remote == "" {
+		return fmt.Errorf("webdav: server didn't report a checksum for %v", cw.name)
+	}
+
+	if !matchChecksum(remote, cw.checksum.Algorithm, sum) {
+		return &ChecksumMismatchError{
+			Path:      cw.name,
+			Algorithm: cw.checksum.Algorithm,
+			Local:     hex.EncodeToString(sum),
+			Remote:    remote,
+		}
+	}
+	return nil
+}
+
+// CreateWithChecksum writes a file's contents, like Create. A checksum is
+// computed while streaming the data, and verified against the server's
+// checksum when the returned writer is closed. On mismatch, Close returns a
+// *ChecksumMismatchError.
+func (c *Client) CreateWithChecksum(ctx context.Context, name string, checksum *Checksum) (io.WriteCloser, error) {
+	fw, err := c.create(ctx, name, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+	return &checksumWriter{
+		fileWriter: fw,
+		ctx:        ctx,
+		c:          c,
+		name:       name,
+		checksum:   checksum,
+		h:          checksum.New(),
+	}, nil
+}
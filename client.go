@@ -2,9 +2,14 @@ package webdav
 
 import (
 	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-webdav/internal"
@@ -45,6 +50,8 @@ type Client struct {
 // If the HTTPClient is nil, http.DefaultClient is used.
 //
 // To use HTTP basic authentication, HTTPClientWithBasicAuth can be used.
+// HTTPClientWithDigestAuth and HTTPClientWithBearerToken provide Digest and
+// OAuth 2.0 authentication.
 func NewClient(c HTTPClient, endpoint string) (*Client, error) {
 	ic, err := internal.NewClient(c, endpoint)
 	if err != nil {
@@ -55,24 +62,110 @@ func NewClient(c HTTPClient, endpoint string) (*Client, error) {
 
 // FindCurrentUserPrincipal finds the current user's principal path.
 func (c *Client) FindCurrentUserPrincipal(ctx context.Context) (string, error) {
-	propfind := internal.NewPropNamePropFind(internal.CurrentUserPrincipalName)
-
 	// TODO: consider retrying on the root URI "/" if this fails, as suggested
 	// by the RFC?
-	resp, err := c.ic.PropFindFlat(ctx, "", propfind)
-	if err != nil {
-		return "", err
+	return c.ic.FindCurrentUserPrincipal(ctx, "")
+}
+
+// DiscoveryError is returned when a step of a discovery chain fails, e.g. by
+// caldav.Client.DiscoverCalendars. The results of previous steps are returned
+// along with the error.
+type DiscoveryError struct {
+	// Step is the name of the property which couldn't be discovered, e.g.
+	// "current-user-principal".
+	Step string
+	Err  error
+}
+
+func (err *DiscoveryError) Error() string {
+	return fmt.Sprintf("webdav: failed to discover %v: %v", err.Step, err.Err)
+}
+
+func (err *DiscoveryError) Unwrap() error {
+	return err.Err
+}
+
+// ResponseError is an error for a single resource, e.g. in a multi-status
+// response.
+type ResponseError struct {
+	Path string
+	Err  error
+	// StatusCode is the HTTP status of the resource, if known.
+	StatusCode int
+	// Data is the raw payload of the resource, if it has been retrieved but
+	// couldn't be parsed. It can be used to quarantine malformed resources.
+	Data []byte
+}
+
+func (err *ResponseError) Error() string {
+	return fmt.Sprintf("%v: %v", err.Path, err.Err)
+}
+
+func (err *ResponseError) Unwrap() error {
+	return err.Err
+}
+
+// PartialError is returned when some resources of a multi-status response
+// couldn't be retrieved or decoded, e.g. by caldav.Client.QueryCalendar. The
+// other resources are returned along with the error.
+type PartialError struct {
+	Errors []ResponseError
+}
+
+func (err *PartialError) Error() string {
+	if len(err.Errors) == 1 {
+		return fmt.Sprintf("webdav: failed to decode resource %v", err.Errors[0].Error())
 	}
+	return fmt.Sprintf("webdav: failed to decode %v resources, first error: %v", len(err.Errors), err.Errors[0].Error())
+}
+
+// MultiStatusError is returned when a request on a collection, e.g. COPY,
+// MOVE or DELETE, partially failed. The server then lists the members which
+// couldn't be processed in a multi-status response.
+type MultiStatusError struct {
+	Errors []ResponseError
+}
 
-	var prop internal.CurrentUserPrincipal
-	if err := resp.DecodeProp(&prop); err != nil {
-		return "", err
+func (err *MultiStatusError) Error() string {
+	if len(err.Errors) == 1 {
+		return fmt.Sprintf("webdav: request failed for %v", err.Errors[0].Error())
 	}
-	if prop.Unauthenticated != nil {
-		return "", fmt.Errorf("webdav: unauthenticated")
+	return fmt.Sprintf("webdav: request failed for %v resources, first error: %v", len(err.Errors), err.Errors[0].Error())
+}
+
+// checkMultiStatus returns a *MultiStatusError if a response is a
+// multi-status response reporting failures. The response body is closed.
+func checkMultiStatus(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil
 	}
 
-	return prop.Href.Path, nil
+	var ms internal.MultiStatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("webdav: failed to decode multi-status response: %v", err)
+	}
+
+	var msErr MultiStatusError
+	for _, r := range ms.Responses {
+		err := r.Err()
+		if err == nil {
+			continue
+		}
+		respErr := ResponseError{Err: err}
+		var httpErr *internal.HTTPError
+		if errors.As(err, &httpErr) {
+			respErr.StatusCode = httpErr.Code
+		}
+		for _, href := range r.Hrefs {
+			respErr.Path = href.Path
+			msErr.Errors = append(msErr.Errors, respErr)
+		}
+	}
+	if len(msErr.Errors) > 0 {
+		return &msErr
+	}
+	return nil
 }
 
 var fileInfoPropFind = internal.NewPropNamePropFind(
@@ -81,6 +174,7 @@ var fileInfoPropFind = internal.NewPropNamePropFind(
 	internal.GetLastModifiedName,
 	internal.GetContentTypeName,
 	internal.GetETagName,
+	refTargetName,
 )
 
 func fileInfoFromResponse(resp *internal.Response) (*FileInfo, error) {
@@ -96,9 +190,18 @@ func fileInfoFromResponse(resp *internal.Response) (*FileInfo, error) {
 		return nil, err
 	}
 
+	if resType.Is(redirectRefName) {
+		var target refTarget
+		if err := resp.DecodeProp(&target); err == nil {
+			fi.RedirectTarget = target.Href.String()
+		} else if !internal.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
 	if resType.Is(internal.CollectionName) {
 		fi.IsDir = true
-	} else {
+	} else if fi.RedirectTarget == "" {
 		var getLen internal.GetContentLength
 		if err := resp.DecodeProp(&getLen); err != nil {
 			return nil, err
@@ -129,56 +232,266 @@ func fileInfoFromResponse(resp *internal.Response) (*FileInfo, error) {
 }
 
 // Stat fetches a FileInfo for a single file.
+//
+// Redirect reference resources (RFC 4437) aren't followed: their
+// FileInfo.RedirectTarget is populated instead.
 func (c *Client) Stat(ctx context.Context, name string) (*FileInfo, error) {
-	resp, err := c.ic.PropFindFlat(ctx, name, fileInfoPropFind)
+	req, err := c.ic.NewXMLRequest(ctx, "PROPFIND", name, fileInfoPropFind)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", internal.DepthZero.String())
+	req.Header.Set("Apply-To-Redirect-Ref", "T")
+
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
-	return fileInfoFromResponse(resp)
+	if len(ms.Responses) != 1 {
+		return nil, fmt.Errorf("PROPFIND with Depth: 0 returned %d responses", len(ms.Responses))
+	}
+	return fileInfoFromResponse(&ms.Responses[0])
 }
 
 // Open fetches a file's contents.
 func (c *Client) Open(ctx context.Context, name string) (io.ReadCloser, error) {
-	req, err := c.ic.NewRequest(http.MethodGet, name, nil)
+	req, err := c.ic.NewRequest(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// OpenRange fetches length bytes of a file's contents, starting at offset. If
+// length is negative, the rest of the file is fetched.
+//
+// If etag isn't empty, the range is only fetched if the file still has this
+// ETag, e.g. to resume a download. Otherwise an HTTP 412 error is returned.
+// An error is also returned if the server doesn't support byte ranges.
+func (c *Client) OpenRange(ctx context.Context, name string, offset, length int64, etag string) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("webdav: invalid range offset %v", offset)
+	} else if length == 0 {
+		return http.NoBody, nil
+	}
+
+	req, err := c.ic.NewRequest(ctx, http.MethodGet, name, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	req.Header.Set("Range", rng)
+	if etag != "" {
+		req.Header.Set("If-Range", internal.ETag(etag).String())
+	}
+
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if etag != "" {
+			var respETag internal.ETag
+			if err := respETag.UnmarshalText([]byte(resp.Header.Get("ETag"))); err == nil && string(respETag) != etag {
+				return nil, internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: %q has changed", name)
+			}
+		}
+		return nil, fmt.Errorf("webdav: server doesn't support byte ranges")
+	}
+	if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "multipart/") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("webdav: unexpected multipart response to a single range request")
+	}
+
 	return resp.Body, nil
 }
 
+// ReadRange reads len(p) bytes of a file's contents starting at offset, with
+// the same semantics as io.ReaderAt.
+func (c *Client) ReadRange(ctx context.Context, name string, p []byte, offset int64) (int, error) {
+	rc, err := c.OpenRange(ctx, name, offset, int64(len(p)), "")
+	if httpErr, ok := err.(*internal.HTTPError); ok && httpErr.Code == http.StatusRequestedRangeNotSatisfiable {
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
 // ReadDir lists files in a directory.
+//
+// Large listings which the server rejects or truncates, e.g. because it caps
+// response sizes or doesn't support "Depth: infinity", are split into
+// smaller requests: directories are listed one level at a time, and if
+// needed the properties of each child are fetched separately.
 func (c *Client) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
-	depth := internal.DepthOne
-	if recursive {
-		depth = internal.DepthInfinity
+	if !recursive {
+		return c.readDirOneLevel(ctx, name)
+	}
+
+	l, err := c.readDir(ctx, name, internal.DepthInfinity)
+	if isListingTooLarge(err) {
+		return c.readDirWalk(ctx, name)
 	}
+	return l, err
+}
+
+var errListingTruncated = errors.New("webdav: server truncated directory listing")
+
+// isListingTooLarge reports whether a PROPFIND request failed because the
+// response would have been too large.
+func isListingTooLarge(err error) bool {
+	var httpErr *internal.HTTPError
+	var syntaxErr *xml.SyntaxError
+	switch {
+	case err == errListingTruncated, errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &syntaxErr):
+		return true
+	case errors.As(err, &httpErr):
+		switch httpErr.Code {
+		case http.StatusForbidden:
+			// RFC 4918 section 9.1: DAV:propfind-finite-depth
+			var davErr *internal.Error
+			return errors.As(err, &davErr) && strings.Contains(davErr.Error(), "propfind-finite-depth")
+		case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+			return true
+		}
+	}
+	return false
+}
+
+// readDir lists a directory. Listings split into pages by the server are
+// requested page by page.
+func (c *Client) readDir(ctx context.Context, name string, depth internal.Depth) ([]FileInfo, error) {
+	var l []FileInfo
+	var token string
+	for {
+		req, err := c.ic.NewXMLRequest(ctx, "PROPFIND", name, fileInfoPropFind)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Depth", depth.String())
+		if token != "" {
+			req.Header.Set(pageTokenHeader, token)
+		}
+		ms, err := c.ic.DoMultiStatus(req)
+		if err != nil {
+			return nil, err
+		}
 
-	ms, err := c.ic.PropFind(ctx, name, depth, fileInfoPropFind)
+		prev := token
+		token = ""
+		for _, resp := range ms.Responses {
+			if resp.IsTruncated() {
+				// A token which doesn't advance would loop forever
+				if token = nextPageToken(&resp); token == "" || token == prev {
+					return nil, errListingTruncated
+				}
+				continue
+			}
+			fi, err := fileInfoFromResponse(&resp)
+			if err != nil {
+				return l, err
+			}
+			l = append(l, *fi)
+		}
+		if token == "" {
+			return l, nil
+		}
+	}
+}
+
+// readDirOneLevel lists the direct children of a directory. If the listing
+// is too large, only the children's paths are listed, with a minimal response
+// as defined in RFC 8144, and their properties are fetched one by one.
+func (c *Client) readDirOneLevel(ctx context.Context, name string) ([]FileInfo, error) {
+	l, err := c.readDir(ctx, name, internal.DepthOne)
+	if !isListingTooLarge(err) {
+		return l, err
+	}
+
+	propfind := internal.NewPropNamePropFind(internal.ResourceTypeName)
+	req, err := c.ic.NewXMLRequest(ctx, "PROPFIND", name, propfind)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", internal.DepthOne.String())
+	req.Header.Set("Prefer", "return=minimal")
+	ms, err := c.ic.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
 
-	l := make([]FileInfo, 0, len(ms.Responses))
+	l = make([]FileInfo, 0, len(ms.Responses))
 	for _, resp := range ms.Responses {
-		fi, err := fileInfoFromResponse(&resp)
+		if resp.IsTruncated() {
+			return nil, errListingTruncated
+		}
+		p, err := resp.Path()
+		if err != nil {
+			return l, err
+		}
+		fi, err := c.Stat(ctx, p)
 		if err != nil {
 			return l, err
 		}
 		l = append(l, *fi)
 	}
+	return l, nil
+}
+
+// readDirWalk lists a directory recursively, one level at a time.
+func (c *Client) readDirWalk(ctx context.Context, name string) ([]FileInfo, error) {
+	l, err := c.readDirOneLevel(ctx, name)
+	if err != nil {
+		return l, err
+	}
 
+	self := path.Clean(c.ic.ResolveHref(name).Path)
+	for _, fi := range l {
+		p := path.Clean(fi.Path)
+		if !fi.IsDir || p == self {
+			continue
+		}
+		children, err := c.readDirWalk(ctx, fi.Path)
+		if err != nil {
+			return l, err
+		}
+		for _, child := range children {
+			if path.Clean(child.Path) != p {
+				l = append(l, child)
+			}
+		}
+	}
 	return l, nil
 }
 
 type fileWriter struct {
 	pw   *io.PipeWriter
 	done <-chan error
+	// respHeader is populated with the response header before done is
+	// signaled.
+	respHeader http.Header
+
+	closed   bool
+	closeErr error
 }
 
 func (fw *fileWriter) Write(b []byte) (int, error) {
@@ -186,17 +499,25 @@ func (fw *fileWriter) Write(b []byte) (int, error) {
 }
 
 func (fw *fileWriter) Close() error {
-	if err := fw.pw.Close(); err != nil {
-		return err
+	if fw.closed {
+		return fw.closeErr
+	}
+	fw.closed = true
+	if fw.closeErr = fw.pw.Close(); fw.closeErr == nil {
+		fw.closeErr = <-fw.done
 	}
-	return <-fw.done
+	return fw.closeErr
 }
 
 // Create writes a file's contents.
 func (c *Client) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return c.create(ctx, name, nil)
+}
+
+func (c *Client) create(ctx context.Context, name string, respHeader http.Header) (*fileWriter, error) {
 	pr, pw := io.Pipe()
 
-	req, err := c.ic.NewRequest(http.MethodPut, name, pr)
+	req, err := c.ic.NewRequest(ctx, http.MethodPut, name, pr)
 	if err != nil {
 		pw.Close()
 		return nil, err
@@ -204,42 +525,80 @@ func (c *Client) Create(ctx context.Context, name string) (io.WriteCloser, error
 
 	done := make(chan error, 1)
 	go func() {
-		resp, err := c.ic.Do(req.WithContext(ctx))
+		resp, err := c.ic.Do(req)
 		if err != nil {
 			done <- err
 			return
 		}
 		resp.Body.Close()
+		if respHeader != nil {
+			for k, v := range resp.Header {
+				respHeader[k] = v
+			}
+		}
 		done <- nil
 	}()
 
-	return &fileWriter{pw, done}, nil
+	return &fileWriter{pw: pw, done: done, respHeader: respHeader}, nil
+}
+
+// Put writes a file's contents. Unlike Create, the write can be conditional
+// and the body isn't streamed. The returned FileInfo contains the path of the
+// file, which may differ from name if the server returned a Location, and its
+// ETag, if the server returned one.
+func (c *Client) Put(ctx context.Context, name string, body io.Reader, options *PutOptions) (*FileInfo, error) {
+	req, err := c.ic.NewRequest(ctx, http.MethodPut, name, body)
+	if err != nil {
+		return nil, err
+	}
+	if options != nil {
+		internal.SetConditional(req, string(options.IfMatch), string(options.IfNoneMatch))
+	}
+
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	fi := FileInfo{Path: req.URL.Path}
+	if loc, err := resp.Location(); err == nil {
+		fi.Path = loc.Path
+	}
+	if s := resp.Header.Get("ETag"); s != "" {
+		var etag internal.ETag
+		if err := etag.UnmarshalText([]byte(s)); err != nil {
+			return nil, err
+		}
+		fi.ETag = string(etag)
+	}
+	return &fi, nil
 }
 
 // RemoveAll deletes a file. If the file is a directory, all of its descendants
-// are recursively deleted as well.
+// are recursively deleted as well. If some of them couldn't be deleted, a
+// *MultiStatusError is returned.
 func (c *Client) RemoveAll(ctx context.Context, name string) error {
-	req, err := c.ic.NewRequest(http.MethodDelete, name, nil)
+	req, err := c.ic.NewRequest(ctx, http.MethodDelete, name, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	return nil
+	return checkMultiStatus(resp)
 }
 
 // Mkdir creates a new directory.
 func (c *Client) Mkdir(ctx context.Context, name string) error {
-	req, err := c.ic.NewRequest("MKCOL", name, nil)
+	req, err := c.ic.NewRequest(ctx, "MKCOL", name, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return err
 	}
@@ -250,13 +609,14 @@ func (c *Client) Mkdir(ctx context.Context, name string) error {
 // Copy copies a file.
 //
 // By default, if the file is a directory, all descendants are recursively
-// copied as well.
+// copied as well. If some of them couldn't be copied, a *MultiStatusError is
+// returned.
 func (c *Client) Copy(ctx context.Context, name, dest string, options *CopyOptions) error {
 	if options == nil {
 		options = new(CopyOptions)
 	}
 
-	req, err := c.ic.NewRequest("COPY", name, nil)
+	req, err := c.ic.NewRequest(ctx, "COPY", name, nil)
 	if err != nil {
 		return err
 	}
@@ -270,21 +630,21 @@ func (c *Client) Copy(ctx context.Context, name, dest string, options *CopyOptio
 	req.Header.Set("Overwrite", internal.FormatOverwrite(!options.NoOverwrite))
 	req.Header.Set("Depth", depth.String())
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	return nil
+	return checkMultiStatus(resp)
 }
 
-// Move moves a file.
+// Move moves a file. If some descendants of a directory couldn't be moved, a
+// *MultiStatusError is returned.
 func (c *Client) Move(ctx context.Context, name, dest string, options *MoveOptions) error {
 	if options == nil {
 		options = new(MoveOptions)
 	}
 
-	req, err := c.ic.NewRequest("MOVE", name, nil)
+	req, err := c.ic.NewRequest(ctx, "MOVE", name, nil)
 	if err != nil {
 		return err
 	}
@@ -292,10 +652,9 @@ func (c *Client) Move(ctx context.Context, name, dest string, options *MoveOptio
 	req.Header.Set("Destination", c.ic.ResolveHref(dest).String())
 	req.Header.Set("Overwrite", internal.FormatOverwrite(!options.NoOverwrite))
 
-	resp, err := c.ic.Do(req.WithContext(ctx))
+	resp, err := c.ic.Do(req)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	return nil
+	return checkMultiStatus(resp)
 }
@@ -0,0 +1,64 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+)
+
+// TokenSource supplies bearer tokens, e.g. OAuth 2.0 access tokens, to
+// HTTPClientWithBearerToken.
+//
+// An oauth2.TokenSource can be adapted by returning the AccessToken of the
+// token it returns. Since oauth2.ReuseTokenSource only refreshes expired
+// tokens, the underlying token source should be used when refresh is true.
+type TokenSource interface {
+	// Token returns a bearer token. If refresh is true, the server has
+	// rejected the last token, e.g. because it has been revoked before its
+	// expiry, and a new token should be obtained.
+	Token(ctx context.Context, refresh bool) (string, error)
+}
+
+type bearerTokenHTTPClient struct {
+	c  HTTPClient
+	ts TokenSource
+}
+
+func (c *bearerTokenHTTPClient) do(req *http.Request, refresh bool) (*http.Response, error) {
+	token, err := c.ts.Token(req.Context(), refresh)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.c.Do(req)
+}
+
+func (c *bearerTokenHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.do(req, false)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !hasReplayableBody(req) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	// Retry once with a fresh token
+	if req.GetBody != nil {
+		req = req.Clone(req.Context())
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return c.do(req, true)
+}
+
+// HTTPClientWithBearerToken returns an HTTP client that authenticates
+// outgoing requests with bearer tokens, as defined in RFC 6750. If c is nil,
+// http.DefaultClient is used.
+//
+// If the server replies with 401 Unauthorized, a new token is requested from
+// ts and the request is sent again, unless its body can't be sent twice.
+func HTTPClientWithBearerToken(c HTTPClient, ts TokenSource) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &bearerTokenHTTPClient{c, ts}
+}
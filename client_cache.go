@@ -0,0 +1,198 @@
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// CacheStore is a key-value storage for CollectionCache. Implementations can
+// persist entries, e.g. on disk, so that they survive application restarts.
+type CacheStore interface {
+	// Get returns the value stored for a key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// DirCacheStore is a CacheStore keeping each entry in a file of a local
+// directory.
+type DirCacheStore string
+
+var _ CacheStore = DirCacheStore("")
+
+func (dir DirCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(string(dir), hex.EncodeToString(sum[:]))
+}
+
+func (dir DirCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(dir.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (dir DirCacheStore) Put(ctx context.Context, key string, value []byte) error {
+	// Write to a temporary file first, so that readers never see partial
+	// entries
+	f, err := ioutil.TempFile(string(dir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), dir.path(key))
+}
+
+func (dir DirCacheStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(dir.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// CollectionCache caches collection listings on the client side, including
+// the metadata of their members. Before a cached listing is used, it's
+// validated against the collection's version with a single "Depth: 0"
+// PROPFIND request: the CalendarServer ctag, the sync token (RFC 6578) or the
+// ETag, whichever the server supports. Collections without any of these are
+// never cached.
+//
+// The version of a collection doesn't change when a nested collection
+// changes, so only listings of direct members are cached. Recursive listings
+// are assembled from the listings of each sub-collection, which are validated
+// separately.
+type CollectionCache struct {
+	Client *Client
+	Store  CacheStore
+}
+
+type cachedListing struct {
+	Version string     `json:"version"`
+	Infos   []FileInfo `json:"infos"`
+}
+
+var collectionVersionPropFind = internal.NewPropNamePropFind(
+	internal.GetCTagName,
+	internal.SyncTokenName,
+	internal.GetETagName,
+)
+
+// collectionVersion returns a string which changes whenever the contents of a
+// collection change, or an empty string if the server doesn't provide one.
+func (cc *CollectionCache) collectionVersion(ctx context.Context, name string) (string, error) {
+	resp, err := cc.Client.ic.PropFindFlat(ctx, name, collectionVersionPropFind)
+	if err != nil {
+		return "", err
+	}
+
+	var ctag internal.GetCTag
+	if err := resp.DecodeProp(&ctag); err == nil && ctag.CTag != "" {
+		return "ctag:" + ctag.CTag, nil
+	} else if err != nil && !internal.IsNotFound(err) {
+		return "", err
+	}
+
+	var syncToken internal.SyncToken
+	if err := resp.DecodeProp(&syncToken); err == nil && syncToken.Token != "" {
+		return "sync-token:" + syncToken.Token, nil
+	} else if err != nil && !internal.IsNotFound(err) {
+		return "", err
+	}
+
+	var getETag internal.GetETag
+	if err := resp.DecodeProp(&getETag); err == nil && getETag.ETag != "" {
+		return "etag:" + string(getETag.ETag), nil
+	} else if err != nil && !internal.IsNotFound(err) {
+		return "", err
+	}
+
+	return "", nil
+}
+
+func collectionCacheKey(c *Client, name string) string {
+	return "readdir:" + c.ic.ResolveHref(name).String()
+}
+
+// ReadDir lists files in a directory, like Client.ReadDir. The cached listing
+// of each collection is returned if it hasn't changed since it was stored.
+func (cc *CollectionCache) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	l, err := cc.readDirOneLevel(ctx, name)
+	if err != nil || !recursive {
+		return l, err
+	}
+
+	self := path.Clean(cc.Client.ic.ResolveHref(name).Path)
+	for _, fi := range l {
+		p := path.Clean(fi.Path)
+		if !fi.IsDir || p == self {
+			continue
+		}
+		children, err := cc.ReadDir(ctx, fi.Path, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if path.Clean(child.Path) != p {
+				l = append(l, child)
+			}
+		}
+	}
+	return l, nil
+}
+
+func (cc *CollectionCache) readDirOneLevel(ctx context.Context, name string) ([]FileInfo, error) {
+	version, err := cc.collectionVersion(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		return cc.Client.ReadDir(ctx, name, false)
+	}
+
+	key := collectionCacheKey(cc.Client, name)
+	if b, err := cc.Store.Get(ctx, key); err != nil {
+		return nil, err
+	} else if b != nil {
+		var cached cachedListing
+		// Corrupted entries are treated as cache misses
+		if json.Unmarshal(b, &cached) == nil && cached.Version == version {
+			return cached.Infos, nil
+		}
+	}
+
+	l, err := cc.Client.ReadDir(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&cachedListing{Version: version, Infos: l})
+	if err != nil {
+		return nil, err
+	}
+	if err := cc.Store.Put(ctx, key, b); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Invalidate drops the cached listing of a directory.
+func (cc *CollectionCache) Invalidate(ctx context.Context, name string) error {
+	return cc.Store.Delete(ctx, collectionCacheKey(cc.Client, name))
+}
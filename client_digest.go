@@ -0,0 +1,267 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// digestChallenge is a Digest challenge sent by a server, as defined in RFC
+// 7616 section 3.3.
+type digestChallenge struct {
+	realm, nonce, opaque, algorithm, qop string
+
+	// nc is the number of requests sent with the nonce
+	nc uint32
+}
+
+// parseDigestChallenge parses the strongest supported Digest challenge out of
+// WWW-Authenticate header values.
+func parseDigestChallenge(values []string) *digestChallenge {
+	var best *digestChallenge
+	for _, v := range values {
+		scheme, s := internal.ParseAuthorization(v)
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		params, err := internal.ParseAuthParams(s)
+		if err != nil || params["nonce"] == "" {
+			continue
+		}
+
+		ch := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		if ch.algorithm == "" {
+			ch.algorithm = "MD5"
+		}
+		switch strings.ToUpper(ch.algorithm) {
+		case "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+		default:
+			continue
+		}
+
+		// Prefer "auth", since "auth-int" requires hashing the request body
+		if _, qop := params["qop"]; qop {
+			for _, q := range strings.Split(params["qop"], ",") {
+				q = strings.ToLower(strings.TrimSpace(q))
+				if q == "auth" || (q == "auth-int" && ch.qop == "") {
+					ch.qop = q
+				}
+			}
+			if ch.qop == "" {
+				continue
+			}
+		}
+
+		if best == nil || (strings.HasPrefix(strings.ToUpper(ch.algorithm), "SHA-256") && !strings.HasPrefix(strings.ToUpper(best.algorithm), "SHA-256")) {
+			best = ch
+		}
+	}
+	return best
+}
+
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+type digestAuthHTTPClient struct {
+	c                  HTTPClient
+	username, password string
+
+	mu         sync.Mutex
+	challenges map[string]*digestChallenge // by host
+}
+
+func (c *digestAuthHTTPClient) challenge(host string) *digestChallenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.challenges[host]
+}
+
+func (c *digestAuthHTTPClient) setChallenge(host string, ch *digestChallenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.challenges[host] = ch
+}
+
+// authorize sets the Authorization header of a request for a challenge.
+func (c *digestAuthHTTPClient) authorize(req *http.Request, ch *digestChallenge) error {
+	c.mu.Lock()
+	ch.nc++
+	nc := fmt.Sprintf("%08x", ch.nc)
+	c.mu.Unlock()
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	cnonce := hex.EncodeToString(b[:])
+
+	h := func(s string) string {
+		return internal.DigestHash(ch.algorithm, s)
+	}
+
+	uri := req.URL.RequestURI()
+	ha1 := h(c.username + ":" + ch.realm + ":" + c.password)
+	if strings.HasSuffix(strings.ToLower(ch.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	if ch.qop == "auth-int" {
+		body, err := readRequestBody(req)
+		if err != nil {
+			return err
+		}
+		ha2 = h(req.Method + ":" + uri + ":" + h(string(body)))
+	}
+
+	var response string
+	if ch.qop != "" {
+		response = h(strings.Join([]string{ha1, ch.nonce, nc, cnonce, ch.qop, ha2}, ":"))
+	} else {
+		// RFC 2069 compatibility
+		response = h(ha1 + ":" + ch.nonce + ":" + ha2)
+	}
+
+	params := []string{
+		"username=" + quoteAuthParam(c.username),
+		"realm=" + quoteAuthParam(ch.realm),
+		"nonce=" + quoteAuthParam(ch.nonce),
+		"uri=" + quoteAuthParam(uri),
+		"algorithm=" + ch.algorithm,
+		"response=" + quoteAuthParam(response),
+	}
+	if ch.opaque != "" {
+		params = append(params, "opaque="+quoteAuthParam(ch.opaque))
+	}
+	if ch.qop != "" {
+		params = append(params, "qop="+ch.qop, "nc="+nc, "cnonce="+quoteAuthParam(cnonce))
+	}
+	req.Header.Set("Authorization", "Digest "+strings.Join(params, ", "))
+	return nil
+}
+
+// readRequestBody returns the body of a request without consuming it.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	// The body can only be read once, keep a copy
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// hasReplayableBody reports whether a request can be sent again.
+func hasReplayableBody(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// fetchChallenge requests a challenge with an OPTIONS request, so that a
+// request body which can't be sent again isn't sent unauthenticated.
+func (c *digestAuthHTTPClient) fetchChallenge(req *http.Request) (*digestChallenge, error) {
+	options, err := http.NewRequestWithContext(req.Context(), http.MethodOptions, req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.c.Do(options)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return parseDigestChallenge(resp.Header["Www-Authenticate"]), nil
+}
+
+func (c *digestAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	ch := c.challenge(host)
+	if ch == nil && !hasReplayableBody(req) {
+		var err error
+		if ch, err = c.fetchChallenge(req); err != nil {
+			return nil, err
+		} else if ch != nil {
+			c.setChallenge(host, ch)
+		}
+	}
+
+	if ch != nil {
+		req = req.Clone(req.Context())
+		if err := c.authorize(req, ch); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Retry once with the new challenge, e.g. because the cached nonce
+	// expired
+	newCh := parseDigestChallenge(resp.Header["Www-Authenticate"])
+	if newCh == nil || (ch != nil && newCh.nonce == ch.nonce) || !hasReplayableBody(req) {
+		return resp, nil
+	}
+	c.setChallenge(host, newCh)
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.authorize(retry, newCh); err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return c.c.Do(retry)
+}
+
+// HTTPClientWithDigestAuth returns an HTTP client that authenticates
+// outgoing requests with HTTP Digest authentication, as defined in RFC 7616.
+// If c is nil, http.DefaultClient is used.
+//
+// Challenges are cached per host, so that only the first request to a host
+// needs to be sent twice. Request bodies which can't be sent again, e.g. from
+// Client.Create, are only sent once a challenge has been fetched with an
+// OPTIONS request. The "auth-int" quality of protection is used if the server
+// doesn't support "auth"; the request body is then buffered in memory.
+func HTTPClientWithDigestAuth(c HTTPClient, username, password string) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &digestAuthHTTPClient{
+		c:          c,
+		username:   username,
+		password:   password,
+		challenges: make(map[string]*digestChallenge),
+	}
+}
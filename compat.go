@@ -0,0 +1,19 @@
+package webdav
+
+import (
+	"path"
+)
+
+// win32Namespace is the namespace of the Win32 file properties set by
+// Windows Explorer, such as Win32FileAttributes.
+const win32Namespace = "urn:schemas-microsoft-com:"
+
+// compatCollectionPath returns a collection path ending with a slash, as
+// expected by the Windows mini-redirector.
+func compatCollectionPath(p string) string {
+	p = path.Clean("/" + p)
+	if p != "/" {
+		p += "/"
+	}
+	return p
+}
@@ -0,0 +1,87 @@
+package webdav
+
+import (
+	"log"
+	"strings"
+)
+
+// ComplianceIssue describes checks of the litmus WebDAV test suite which are
+// expected to fail with a Handler's configuration.
+type ComplianceIssue struct {
+	// Suite is the litmus test suite, e.g. "locks" or "props".
+	Suite string
+	// Tests lists the failing tests. If empty, the whole suite fails.
+	Tests []string
+	// Reason explains the failure and how to address it.
+	Reason string
+}
+
+func (issue *ComplianceIssue) String() string {
+	s := "litmus suite " + issue.Suite
+	if len(issue.Tests) > 0 {
+		s += " (" + strings.Join(issue.Tests, ", ") + ")"
+	}
+	return s + ": " + issue.Reason
+}
+
+// ComplianceReport lists the litmus checks expected to fail given the
+// capabilities of the FileSystem and the Handler's configuration. It's
+// intended to guide integrators towards the optional interfaces to
+// implement.
+func (h *Handler) ComplianceReport() []ComplianceIssue {
+	if h.FileSystem == nil {
+		return []ComplianceIssue{{
+			Suite:  "basic",
+			Reason: "no FileSystem is set",
+		}}
+	}
+
+	var issues []ComplianceIssue
+	hasLocks := h.LockSystem != nil || h.WindowsCompat || h.Finder != nil
+	_, hasStore := optionalFileSystem(h.FileSystem).(DeadPropertyStore)
+	if !hasLocks {
+		issues = append(issues, ComplianceIssue{
+			Suite:  "locks",
+			Reason: "set Handler.LockSystem, e.g. to a MemLockSystem, to support LOCK and UNLOCK",
+		})
+	}
+	if !hasStore {
+		issues = append(issues, ComplianceIssue{
+			Suite: "props",
+			Tests: []string{
+				"propset", "propget", "propextended", "propmove",
+				"propdeletes", "propreplace", "propnullns", "prophighunicode",
+				"propremoveset", "propsetremove", "propvalnspace", "propmanyns",
+			},
+			Reason: "implement DeadPropertyStore in the FileSystem to store properties set via PROPPATCH",
+		})
+		if hasLocks {
+			issues = append(issues, ComplianceIssue{
+				Suite:  "locks",
+				Tests:  []string{"owner_modify", "notowner_modify"},
+				Reason: "implement DeadPropertyStore in the FileSystem to store properties set via PROPPATCH",
+			})
+		}
+	}
+	if h.PrivilegeChecker != nil {
+		issues = append(issues, ComplianceIssue{
+			Suite:  "basic",
+			Reason: "requests fail unless the PrivilegeChecker grants DAV:all to the litmus user",
+		})
+	}
+	return issues
+}
+
+func (h *Handler) logComplianceReport() {
+	issues := h.ComplianceReport()
+	logf := log.Printf
+	if h.ErrorLog != nil {
+		logf = h.ErrorLog.Printf
+	}
+	if len(issues) == 0 {
+		logf("webdav: no litmus compliance issues detected")
+	}
+	for _, issue := range issues {
+		logf("webdav: %v", &issue)
+	}
+}
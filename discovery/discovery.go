@@ -0,0 +1,207 @@
+// Package discovery locates CalDAV and CardDAV services from an email address
+// or a domain.
+//
+// Service discovery is defined in RFC 6764.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Service is a service which can be discovered.
+type Service string
+
+const (
+	CalDAV  Service = "caldav"
+	CardDAV Service = "carddav"
+)
+
+// maxRedirects is the number of redirects followed from the well-known URI.
+const maxRedirects = 10
+
+// errNoSRV is returned by ContextURL if the domain doesn't have an SRV
+// record for the service.
+var errNoSRV = errors.New("webdav: domain doesn't have an SRV record")
+
+// Resolver performs DNS lookups. It's implemented by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Domain returns the domain of an email address. Bare domains are returned
+// unchanged.
+func Domain(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return addr[i+1:]
+	}
+	return addr
+}
+
+// ContextURL looks up the context URL of a service with the SRV and TXT
+// records of a domain, as described in RFC 6764 section 6. Only services
+// offered over TLS are looked up. If the TXT record doesn't specify a context
+// path, the well-known URI of the service is returned.
+//
+// If r is nil, net.DefaultResolver is used.
+func ContextURL(ctx context.Context, r Resolver, service Service, domain string) (*url.URL, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	// Only lookup TLS records, plaintext connections are insecure
+	name := "_" + string(service) + "s._tcp." + domain
+	_, addrs, err := r.LookupSRV(ctx, "", "", name)
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsTemporary {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errNoSRV
+	}
+	// Records are sorted by priority and weight
+	addr := addrs[0]
+
+	target := strings.TrimSuffix(addr.Target, ".")
+	if target == "" {
+		return nil, fmt.Errorf("webdav: %v service isn't available for domain %q", service, domain)
+	}
+
+	u := &url.URL{Scheme: "https", Path: "/.well-known/" + string(service)}
+	if addr.Port == 443 {
+		u.Host = target
+	} else {
+		u.Host = fmt.Sprintf("%v:%v", target, addr.Port)
+	}
+
+	txts, err := r.LookupTXT(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsTemporary {
+		return nil, err
+	}
+	for _, txt := range txts {
+		if p := strings.TrimPrefix(txt, "path="); p != txt && strings.HasPrefix(p, "/") {
+			u.Path = p
+			break
+		}
+	}
+
+	return u, nil
+}
+
+// Result is the result of Discoverer.Discover.
+type Result struct {
+	// ContextURL is the URL of the service, after following redirects.
+	ContextURL *url.URL
+	// Principal is the URL of the current user principal.
+	Principal *url.URL
+}
+
+// Discoverer discovers CalDAV and CardDAV services.
+type Discoverer struct {
+	// HTTPClient is used to find the current user principal. It should
+	// authenticate requests, e.g. with webdav.HTTPClientWithBasicAuth. If nil,
+	// http.DefaultClient is used.
+	HTTPClient webdav.HTTPClient
+	// Resolver is used for DNS lookups. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+func (d *Discoverer) httpClient() webdav.HTTPClient {
+	if d.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return d.HTTPClient
+}
+
+// Discover finds the context URL and the current user principal of a service
+// for an email address or a domain.
+//
+// The context URL is looked up via DNS with ContextURL. If the domain doesn't
+// have an SRV record, the well-known URI of the domain itself is used. Then
+// redirects are followed, and the current user principal is requested from
+// the context URL.
+//
+// If a step fails, a *webdav.DiscoveryError is returned along with the
+// results of the previous steps.
+func (d *Discoverer) Discover(ctx context.Context, service Service, addr string) (*Result, error) {
+	var result Result
+	domain := Domain(addr)
+	u, err := ContextURL(ctx, d.Resolver, service, domain)
+	if errors.Is(err, errNoSRV) {
+		u = &url.URL{Scheme: "https", Host: domain, Path: "/.well-known/" + string(service)}
+	} else if err != nil {
+		return &result, &webdav.DiscoveryError{Step: "context-url", Err: err}
+	}
+
+	if result.ContextURL, err = d.followRedirects(ctx, u); err != nil {
+		return &result, &webdav.DiscoveryError{Step: "context-url", Err: err}
+	}
+
+	ic, err := internal.NewClient(d.httpClient(), result.ContextURL.String())
+	if err != nil {
+		return &result, &webdav.DiscoveryError{Step: "current-user-principal", Err: err}
+	}
+	// Pass the path explicitly, since relative paths lose their trailing
+	// slash
+	principal, err := ic.FindCurrentUserPrincipal(ctx, result.ContextURL.Path)
+	if err != nil {
+		return &result, &webdav.DiscoveryError{Step: "current-user-principal", Err: err}
+	}
+	result.Principal = result.ContextURL.ResolveReference(&url.URL{Path: principal})
+	return &result, nil
+}
+
+// followRedirects returns the URL a context URL redirects to.
+//
+// HTTP clients drop the body of PROPFIND requests when following 301 and 302
+// redirects, so the target is resolved first with a bodyless request.
+func (d *Discoverer) followRedirects(ctx context.Context, u *url.URL) (*url.URL, error) {
+	for i := 0; i < maxRedirects; i++ {
+		req, err := http.NewRequestWithContext(ctx, "PROPFIND", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Depth", "0")
+		resp, err := d.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+
+		// The HTTP client may have followed redirects already
+		if resp.Request != nil && resp.Request.URL != nil {
+			u = resp.Request.URL
+		}
+
+		loc := resp.Header.Get("Location")
+		if resp.StatusCode/100 != 3 || loc == "" {
+			return u, nil
+		}
+		next, err := u.Parse(loc)
+		if err != nil {
+			return nil, fmt.Errorf("webdav: invalid redirect location: %v", err)
+		}
+		u = next
+	}
+	return nil, fmt.Errorf("webdav: stopped after %v redirects", maxRedirects)
+}
+
+// Discover finds the context URL and the current user principal of a service,
+// with the default Discoverer settings and c to perform HTTP requests. See
+// Discoverer.Discover.
+func Discover(ctx context.Context, c webdav.HTTPClient, service Service, addr string) (*Result, error) {
+	d := Discoverer{HTTPClient: c}
+	return d.Discover(ctx, service, addr)
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-webdav"
+)
+
+type testResolver struct {
+	srv map[string][]*net.SRV
+	txt map[string][]string
+}
+
+func (r *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if addrs, ok := r.srv[name]; ok {
+		return name, addrs, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+type testUserPrincipal string
+
+func (p testUserPrincipal) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return string(p), nil
+}
+
+func TestContextURL(t *testing.T) {
+	r := &testResolver{
+		srv: map[string][]*net.SRV{
+			"_caldavs._tcp.example.org":  {{Target: "dav.example.org.", Port: 443}},
+			"_carddavs._tcp.example.org": {{Target: "dav.example.org.", Port: 8443}},
+			"_caldavs._tcp.example.com":  {{Target: ".", Port: 0}},
+		},
+		txt: map[string][]string{
+			"_caldavs._tcp.example.org": {"path=/dav/calendars"},
+		},
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		service Service
+		domain  string
+		want    string
+	}{
+		{CalDAV, "example.org", "https://dav.example.org/dav/calendars"},
+		{CardDAV, "example.org", "https://dav.example.org:8443/.well-known/carddav"},
+	} {
+		u, err := ContextURL(ctx, r, tc.service, tc.domain)
+		if err != nil {
+			t.Errorf("ContextURL(%v, %v) = %v", tc.service, tc.domain, err)
+		} else if u.String() != tc.want {
+			t.Errorf("ContextURL(%v, %v) = %v, want %v", tc.service, tc.domain, u, tc.want)
+		}
+	}
+
+	if _, err := ContextURL(ctx, r, CalDAV, "example.com"); err == nil {
+		t.Errorf("ContextURL() succeeded for an unavailable service")
+	}
+	if _, err := ContextURL(ctx, r, CalDAV, "example.net"); err != errNoSRV {
+		t.Errorf("ContextURL() = %v, want %v", err, errNoSRV)
+	}
+}
+
+func TestDiscoverer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+	mux.Handle("/dav/", http.StripPrefix("/dav", &webdav.Handler{
+		FileSystem:    webdav.LocalFileSystem(t.TempDir()),
+		UserPrincipal: testUserPrincipal("/principals/alice/"),
+	}))
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, _ := net.SplitHostPort(tsURL.Host)
+	port, _ := strconv.Atoi(portStr)
+	d := Discoverer{
+		HTTPClient: ts.Client(),
+		Resolver: &testResolver{srv: map[string][]*net.SRV{
+			"_caldavs._tcp.example.org":  {{Target: host + ".", Port: uint16(port)}},
+			"_carddavs._tcp.example.org": {{Target: host + ".", Port: uint16(port)}},
+		}},
+	}
+
+	result, err := d.Discover(context.Background(), CalDAV, "alice@example.org")
+	if err != nil {
+		t.Fatalf("Discover() = %v", err)
+	}
+	if want := ts.URL + "/dav/"; result.ContextURL.String() != want {
+		t.Errorf("ContextURL = %v, want %v", result.ContextURL, want)
+	}
+	if want := ts.URL + "/principals/alice/"; result.Principal.String() != want {
+		t.Errorf("Principal = %v, want %v", result.Principal, want)
+	}
+
+	_, err = d.Discover(context.Background(), CardDAV, "alice@example.org")
+	if discoveryErr, ok := err.(*webdav.DiscoveryError); !ok || discoveryErr.Step != "current-user-principal" {
+		t.Errorf("Discover() for a missing service = %v, want current-user-principal error", err)
+	}
+}
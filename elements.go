@@ -30,3 +30,180 @@ type groupMembership struct {
 	XMLName xml.Name        `xml:"DAV: group-membership"`
 	Hrefs   []internal.Href `xml:"href"`
 }
+
+var (
+	lockDiscoveryName = xml.Name{"DAV:", "lockdiscovery"}
+	supportedLockName = xml.Name{"DAV:", "supportedlock"}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.11
+type lockInfo struct {
+	XMLName   xml.Name   `xml:"DAV: lockinfo"`
+	LockScope lockScope  `xml:"lockscope"`
+	LockType  lockType   `xml:"locktype"`
+	Owner     *lockOwner `xml:"owner,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.13
+type lockScope struct {
+	Exclusive *struct{} `xml:"exclusive,omitempty"`
+	Shared    *struct{} `xml:"shared,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.15
+type lockType struct {
+	Write *struct{} `xml:"write,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.17
+type lockOwner struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.1
+type activeLock struct {
+	XMLName   xml.Name   `xml:"DAV: activelock"`
+	LockScope lockScope  `xml:"lockscope"`
+	LockType  lockType   `xml:"locktype"`
+	Depth     string     `xml:"depth"`
+	Owner     *lockOwner `xml:"owner,omitempty"`
+	Timeout   string     `xml:"timeout"`
+	LockToken *lockHref  `xml:"locktoken,omitempty"`
+	LockRoot  lockHref   `xml:"lockroot"`
+}
+
+type lockHref struct {
+	Href internal.Href `xml:"href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-15.8
+type lockDiscovery struct {
+	XMLName     xml.Name     `xml:"DAV: lockdiscovery"`
+	ActiveLocks []activeLock `xml:"activelock"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-15.10
+type supportedLock struct {
+	XMLName     xml.Name    `xml:"DAV: supportedlock"`
+	LockEntries []lockEntry `xml:"lockentry"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-14.10
+type lockEntry struct {
+	XMLName   xml.Name  `xml:"DAV: lockentry"`
+	LockScope lockScope `xml:"lockscope"`
+	LockType  lockType  `xml:"locktype"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4918#section-9.10.1
+type lockResponse struct {
+	XMLName       xml.Name      `xml:"DAV: prop"`
+	LockDiscovery lockDiscovery `xml:"lockdiscovery"`
+}
+
+var (
+	redirectRefName = xml.Name{"DAV:", "redirectref"}
+	refTargetName   = xml.Name{"DAV:", "reftarget"}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc4437#section-12.1
+type refTarget struct {
+	XMLName xml.Name      `xml:"DAV: reftarget"`
+	Href    internal.Href `xml:"href"`
+}
+
+var (
+	ownerName                   = xml.Name{"DAV:", "owner"}
+	aclName                     = xml.Name{"DAV:", "acl"}
+	currentUserPrivilegeSetName = xml.Name{"DAV:", "current-user-privilege-set"}
+	supportedPrivilegeSetName   = xml.Name{"DAV:", "supported-privilege-set"}
+	principalCollectionSetName  = xml.Name{"DAV:", "principal-collection-set"}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.1
+type owner struct {
+	XMLName xml.Name       `xml:"DAV: owner"`
+	Href    *internal.Href `xml:"href,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.2
+type privilege struct {
+	XMLName xml.Name               `xml:"DAV: privilege"`
+	Raw     []internal.RawXMLValue `xml:",any"`
+}
+
+func newPrivilege(p Privilege) privilege {
+	return privilege{Raw: []internal.RawXMLValue{
+		*internal.NewRawXMLElement(xml.Name{"DAV:", string(p)}, nil, nil),
+	}}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.3
+type supportedPrivilegeSet struct {
+	XMLName             xml.Name             `xml:"DAV: supported-privilege-set"`
+	SupportedPrivileges []supportedPrivilege `xml:"supported-privilege"`
+}
+
+type supportedPrivilege struct {
+	XMLName             xml.Name             `xml:"DAV: supported-privilege"`
+	Privilege           privilege            `xml:"privilege"`
+	Abstract            *struct{}            `xml:"abstract,omitempty"`
+	Description         string               `xml:"description"`
+	SupportedPrivileges []supportedPrivilege `xml:"supported-privilege,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.4
+type currentUserPrivilegeSet struct {
+	XMLName    xml.Name    `xml:"DAV: current-user-privilege-set"`
+	Privileges []privilege `xml:"privilege"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.5
+type acl struct {
+	XMLName xml.Name `xml:"DAV: acl"`
+	ACEs    []ace    `xml:"ace"`
+}
+
+type ace struct {
+	XMLName   xml.Name       `xml:"DAV: ace"`
+	Principal acePrincipal   `xml:"principal"`
+	Grant     *privilegeList `xml:"grant,omitempty"`
+	Deny      *privilegeList `xml:"deny,omitempty"`
+	Protected *struct{}      `xml:"protected,omitempty"`
+	Inherited *inherited     `xml:"inherited,omitempty"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.5.1
+type acePrincipal struct {
+	Href            *internal.Href `xml:"href,omitempty"`
+	All             *struct{}      `xml:"all,omitempty"`
+	Authenticated   *struct{}      `xml:"authenticated,omitempty"`
+	Unauthenticated *struct{}      `xml:"unauthenticated,omitempty"`
+	Self            *struct{}      `xml:"self,omitempty"`
+}
+
+type privilegeList struct {
+	Privileges []privilege `xml:"privilege"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.5.2
+type inherited struct {
+	Href internal.Href `xml:"href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-5.8
+type principalCollectionSet struct {
+	XMLName xml.Name        `xml:"DAV: principal-collection-set"`
+	Hrefs   []internal.Href `xml:"href"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3744#section-7.1.1
+type needPrivileges struct {
+	XMLName   xml.Name                 `xml:"DAV: need-privileges"`
+	Resources []needPrivilegesResource `xml:"resource"`
+}
+
+type needPrivilegesResource struct {
+	Href      internal.Href `xml:"href"`
+	Privilege privilege     `xml:"privilege"`
+}
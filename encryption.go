@@ -0,0 +1,308 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// KeyProvider supplies the keys used to encrypt data at rest, e.g. by
+// NewEncryptedFileSystem. Keys must be 16, 24 or 32 bytes long, to select
+// AES-128, AES-192 or AES-256.
+//
+// Keys can be rotated: data is encrypted with the current key, and the ID of
+// the key is stored along with the data to decrypt it later.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new data, and its ID. IDs
+	// are at most 255 bytes long.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the key with the given ID, to decrypt existing data.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider with a single key, whose ID is empty.
+type StaticKey []byte
+
+var _ KeyProvider = StaticKey(nil)
+
+func (k StaticKey) CurrentKey(ctx context.Context) (id string, key []byte, err error) {
+	return "", k, nil
+}
+
+func (k StaticKey) Key(ctx context.Context, id string) ([]byte, error) {
+	if id != "" {
+		return nil, fmt.Errorf("webdav: unknown key %q", id)
+	}
+	return k, nil
+}
+
+// EncryptionOptions contains options for NewEncryptedFileSystem and the
+// encrypted backends of the caldav and carddav packages.
+type EncryptionOptions struct {
+	// RejectPlaintext fails to read data which isn't encrypted instead of
+	// returning it as is. It should be set once all the existing data has
+	// been encrypted, so that data written to the storage by a third party
+	// isn't mistaken for encrypted data.
+	RejectPlaintext bool
+}
+
+type encryptedFileSystem struct {
+	FileSystem
+	keys KeyProvider
+	opts EncryptionOptions
+}
+
+// NewEncryptedFileSystem returns a FileSystem encrypting the contents of the
+// files stored in fs with AES-GCM. File names and directories aren't
+// encrypted, but the contents of a file are bound to its path: they can't be
+// decrypted once moved to another path in fs, except via the returned
+// FileSystem. Unless opts.RejectPlaintext is set, files which aren't
+// encrypted, e.g. because they were stored before encryption was enabled, are
+// read as is.
+//
+// Files are held in memory while they're encrypted and decrypted, so this is
+// best suited to small files such as calendar and address book data.
+//
+// The optional interfaces of fs which don't handle file contents, such as
+// SyncFileSystem or DeadPropertyStore, are forwarded. WalkFileSystem and
+// ConditionalFileSystem are supported, using the implementations of fs if
+// any. AppendFileSystem isn't exposed, since it would bypass encryption.
+func NewEncryptedFileSystem(fs FileSystem, keys KeyProvider, opts *EncryptionOptions) FileSystem {
+	if opts == nil {
+		opts = &EncryptionOptions{}
+	}
+	return &encryptedFileSystem{fs, keys, *opts}
+}
+
+var (
+	_ WalkFileSystem        = (*encryptedFileSystem)(nil)
+	_ ConditionalFileSystem = (*encryptedFileSystem)(nil)
+)
+
+func (fs *encryptedFileSystem) unwrapFileSystem() FileSystem {
+	return fs.FileSystem
+}
+
+// encryptedFileData returns the AES-GCM additional data of a file.
+func encryptedFileData(name string) []byte {
+	return []byte(path.Clean(name))
+}
+
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// readFile reads and decrypts the file name, whose contents are bound to the
+// path boundTo.
+func (fs *encryptedFileSystem) readFile(ctx context.Context, name, boundTo string) ([]byte, error) {
+	rc, err := fs.FileSystem.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return internal.Decrypt(ctx, fs.keys, data, encryptedFileData(boundTo), fs.opts.RejectPlaintext)
+}
+
+func (fs *encryptedFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	data, err := fs.readFile(ctx, name, name)
+	if err != nil {
+		return nil, err
+	}
+	// Seekable, to support range requests
+	return bytesReadCloser{bytes.NewReader(data)}, nil
+}
+
+// plaintextSize replaces the size of an encrypted file with the size of its
+// contents.
+func (fs *encryptedFileSystem) plaintextSize(ctx context.Context, fi *FileInfo) error {
+	if fi.IsDir {
+		return nil
+	}
+
+	rc, err := fs.FileSystem.Open(ctx, fi.Path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	header := make([]byte, 5+255)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if id, ok := internal.EncryptedKeyID(header[:n]); ok {
+		fi.Size -= int64(internal.EncryptedOverhead(id))
+	}
+	return nil
+}
+
+func (fs *encryptedFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fi, err := fs.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.plaintextSize(ctx, fi); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (fs *encryptedFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	l, err := fs.FileSystem.ReadDir(ctx, name, recursive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l {
+		if err := fs.plaintextSize(ctx, &l[i]); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (fs *encryptedFileSystem) WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	wfs, ok := fs.FileSystem.(WalkFileSystem)
+	if !ok {
+		l, err := fs.ReadDir(ctx, name, recursive)
+		if err != nil {
+			return err
+		}
+		for i := range l {
+			if err := fn(&l[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return wfs.WalkDir(ctx, name, recursive, func(fi *FileInfo) error {
+		if err := fs.plaintextSize(ctx, fi); err != nil {
+			return err
+		}
+		return fn(fi)
+	})
+}
+
+type encryptedWriter struct {
+	bytes.Buffer
+	ctx    context.Context
+	fs     *encryptedFileSystem
+	name   string
+	opts   *CreateOptions
+	closed bool
+}
+
+// create creates the underlying file, evaluating the preconditions if any.
+func (w *encryptedWriter) create() (io.WriteCloser, error) {
+	if w.opts == nil {
+		return w.fs.FileSystem.Create(w.ctx, w.name)
+	}
+	if cfs, ok := w.fs.FileSystem.(ConditionalFileSystem); ok {
+		return cfs.CreateWithOptions(w.ctx, w.name, w.opts)
+	}
+	fi, err := w.fs.FileSystem.Stat(w.ctx, w.name)
+	if err != nil && !internal.IsNotFound(err) {
+		return nil, err
+	}
+	var etag string
+	if fi != nil {
+		etag = fi.ETag
+	}
+	if err := w.opts.check(etag, err == nil); err != nil {
+		return nil, err
+	}
+	return w.fs.FileSystem.Create(w.ctx, w.name)
+}
+
+func (w *encryptedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	data, err := internal.Encrypt(w.ctx, w.fs.keys, w.Bytes(), encryptedFileData(w.name))
+	if err != nil {
+		return err
+	}
+	wc, err := w.create()
+	if err != nil {
+		return err
+	}
+	defer wc.Close()
+	if _, err := wc.Write(data); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+func (fs *encryptedFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	// Contents are encrypted and written once complete
+	return &encryptedWriter{ctx: ctx, fs: fs, name: name}, nil
+}
+
+func (fs *encryptedFileSystem) CreateWithOptions(ctx context.Context, name string, opts *CreateOptions) (io.WriteCloser, error) {
+	return &encryptedWriter{ctx: ctx, fs: fs, name: name, opts: opts}, nil
+}
+
+// rebind re-encrypts the files copied or moved from name to dest, so that
+// their contents are bound to their new path.
+func (fs *encryptedFileSystem) rebind(ctx context.Context, name, dest string) error {
+	fi, err := fs.FileSystem.Stat(ctx, dest)
+	if err != nil {
+		return err
+	}
+	files := []FileInfo{*fi}
+	if fi.IsDir {
+		files, err = fs.FileSystem.ReadDir(ctx, dest, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fi := range files {
+		if fi.IsDir {
+			continue
+		}
+		src := path.Clean(name) + strings.TrimPrefix(path.Clean(fi.Path), path.Clean(dest))
+		data, err := fs.readFile(ctx, fi.Path, src)
+		if err != nil {
+			return err
+		}
+		w := &encryptedWriter{ctx: ctx, fs: fs, name: fi.Path}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *encryptedFileSystem) Copy(ctx context.Context, name, dest string, options *CopyOptions) (created bool, err error) {
+	created, err = fs.FileSystem.Copy(ctx, name, dest, options)
+	if err != nil {
+		return false, err
+	}
+	return created, fs.rebind(ctx, name, dest)
+}
+
+func (fs *encryptedFileSystem) Move(ctx context.Context, name, dest string, options *MoveOptions) (created bool, err error) {
+	created, err = fs.FileSystem.Move(ctx, name, dest, options)
+	if err != nil {
+		return false, err
+	}
+	return created, fs.rebind(ctx, name, dest)
+}
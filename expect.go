@@ -0,0 +1,34 @@
+package webdav
+
+import (
+	"net/http"
+)
+
+type expectContinueHTTPClient struct {
+	c         HTTPClient
+	threshold int64
+}
+
+func (c *expectContinueHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && (req.ContentLength <= 0 || req.ContentLength > c.threshold) {
+		// A zero ContentLength with a body means that the length is unknown
+		req.Header.Set("Expect", "100-continue")
+	}
+	return c.c.Do(req)
+}
+
+// HTTPClientWithExpectContinue returns an HTTP client that sends an
+// "Expect: 100-continue" header with request bodies larger than threshold
+// bytes, or of unknown length. The server can then reject a request, e.g.
+// because of a failed precondition or an exceeded quota, before the body is
+// uploaded. If c is nil, http.DefaultClient is used.
+//
+// The client waits for the server's interim response for the
+// http.Transport.ExpectContinueTimeout duration before sending the body
+// anyway. Transports with a zero timeout send the body immediately.
+func HTTPClientWithExpectContinue(c HTTPClient, threshold int64) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &expectContinueHTTPClient{c, threshold}
+}
@@ -0,0 +1,74 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// AppleDoublePolicy specifies how the metadata files created by the macOS
+// Finder are handled: AppleDouble files, whose names start with "._", and
+// .DS_Store files.
+type AppleDoublePolicy int
+
+const (
+	// AppleDoubleStore stores metadata files like any other file.
+	AppleDoubleStore AppleDoublePolicy = iota
+	// AppleDoubleDiscard accepts writes to metadata files, but discards
+	// them. Existing metadata files are hidden.
+	AppleDoubleDiscard
+	// AppleDoubleReject rejects the creation of metadata files with 403
+	// Forbidden.
+	AppleDoubleReject
+)
+
+// FinderOptions contains options for macOS Finder clients.
+type FinderOptions struct {
+	AppleDouble AppleDoublePolicy
+}
+
+func isAppleDouble(p string) bool {
+	name := path.Base(strings.TrimSuffix(p, "/"))
+	return strings.HasPrefix(name, "._") || name == ".DS_Store"
+}
+
+// discards reports whether writes to a file are discarded.
+func (opts *FinderOptions) discards(p string) bool {
+	return opts != nil && opts.AppleDouble == AppleDoubleDiscard && isAppleDouble(p)
+}
+
+// checkCreate checks that a file can be created.
+func (opts *FinderOptions) checkCreate(p string) error {
+	if opts != nil && opts.AppleDouble == AppleDoubleReject && isAppleDouble(p) {
+		return internal.HTTPErrorf(http.StatusForbidden, "webdav: creating %q is forbidden", p)
+	}
+	return nil
+}
+
+// discardsCopy reports whether copying or moving a file is discarded. Other
+// files can't be copied or moved to the name of a discarded file.
+func (opts *FinderOptions) discardsCopy(src, dest string) (bool, error) {
+	if err := opts.checkCreate(dest); err != nil {
+		return false, err
+	}
+	if !opts.discards(dest) {
+		return false, nil
+	}
+	if !isAppleDouble(src) {
+		return false, internal.HTTPErrorf(http.StatusForbidden, "webdav: %q would be discarded", dest)
+	}
+	return true, nil
+}
+
+// visibility hides discarded files.
+func (opts *FinderOptions) visibility(f VisibilityFunc) VisibilityFunc {
+	if opts == nil || opts.AppleDouble != AppleDoubleDiscard {
+		return f
+	}
+	return func(ctx context.Context, p string) bool {
+		return !isAppleDouble(p) && f.IsVisible(ctx, p)
+	}
+}
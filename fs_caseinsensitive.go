@@ -0,0 +1,204 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// CaseConflictPolicy specifies how CaseInsensitiveFileSystem resolves a name
+// matching multiple files which only differ by case.
+type CaseConflictPolicy int
+
+const (
+	// CaseConflictError fails with 409 Conflict.
+	CaseConflictError CaseConflictPolicy = iota
+	// CaseConflictFirst picks the first match in lexical order.
+	CaseConflictFirst
+)
+
+// CaseInsensitiveFileSystem wraps a case-sensitive FileSystem to map names
+// case-insensitively, as expected by Windows clients. Exact matches always
+// take precedence. Files returned to clients keep the casing of the request
+// when they're looked up by name.
+type CaseInsensitiveFileSystem struct {
+	FileSystem FileSystem
+	// Conflict is the policy used when a name matches multiple files without
+	// matching any of them exactly.
+	Conflict CaseConflictPolicy
+}
+
+var _ FileSystem = (*CaseInsensitiveFileSystem)(nil)
+
+// resolve returns the stored name of a file. If create is set, names of
+// missing files are returned with their parent directory resolved.
+func (fs *CaseInsensitiveFileSystem) resolve(ctx context.Context, name string, create bool) (string, error) {
+	if _, err := fs.FileSystem.Stat(ctx, name); err == nil {
+		return name, nil
+	} else if !internal.IsNotFound(err) {
+		return "", err
+	}
+
+	trimmed := strings.TrimSuffix(name, "/")
+	if trimmed == "" {
+		return name, nil
+	}
+	suffix := name[len(trimmed):]
+	dir, base := path.Split(trimmed)
+
+	dir, err := fs.resolve(ctx, dir, false)
+	if internal.IsNotFound(err) && create {
+		// Let the wrapped FileSystem report the missing parent
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	match, err := fs.lookup(ctx, dir, base)
+	if err != nil {
+		return "", err
+	}
+	if match == "" {
+		if create {
+			return path.Join(dir, base) + suffix, nil
+		}
+		return "", internal.HTTPErrorf(http.StatusNotFound, "webdav: file %q not found", name)
+	}
+	return match + suffix, nil
+}
+
+// lookup returns the name of the member of dir matching base
+// case-insensitively, or an empty string if there is none.
+func (fs *CaseInsensitiveFileSystem) lookup(ctx context.Context, dir, base string) (string, error) {
+	children, err := fs.FileSystem.ReadDir(ctx, dir, false)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, child := range children {
+		p := strings.TrimSuffix(child.Path, "/")
+		if p == strings.TrimSuffix(dir, "/") {
+			continue
+		}
+		if strings.EqualFold(path.Base(p), base) {
+			matches = append(matches, p)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		return "", nil
+	case len(matches) > 1 && fs.Conflict == CaseConflictError:
+		return "", internal.HTTPErrorf(http.StatusConflict, "webdav: name %q matches multiple files", path.Join(dir, base))
+	}
+	sort.Strings(matches)
+	return matches[0], nil
+}
+
+// rebasePath rewrites a path inside the resolved directory to be inside the
+// requested one.
+func rebasePath(p, resolved, requested string) string {
+	resolved = strings.TrimSuffix(resolved, "/")
+	requested = strings.TrimSuffix(requested, "/")
+	if p == resolved || strings.HasPrefix(p, resolved+"/") {
+		return requested + p[len(resolved):]
+	}
+	return p
+}
+
+func (fs *CaseInsensitiveFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Open(ctx, p)
+}
+
+func (fs *CaseInsensitiveFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.FileSystem.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	fi.Path = rebasePath(fi.Path, p, name)
+	return fi, nil
+}
+
+func (fs *CaseInsensitiveFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	l, err := fs.FileSystem.ReadDir(ctx, p, recursive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l {
+		l[i].Path = rebasePath(l[i].Path, p, name)
+	}
+	return l, nil
+}
+
+func (fs *CaseInsensitiveFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	p, err := fs.resolve(ctx, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Create(ctx, p)
+}
+
+func (fs *CaseInsensitiveFileSystem) RemoveAll(ctx context.Context, name string) error {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(ctx, p)
+}
+
+func (fs *CaseInsensitiveFileSystem) Mkdir(ctx context.Context, name string) error {
+	p, err := fs.resolve(ctx, name, true)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(ctx, p)
+}
+
+func (fs *CaseInsensitiveFileSystem) Copy(ctx context.Context, name, dest string, options *CopyOptions) (created bool, err error) {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return false, err
+	}
+	dest, err = fs.resolve(ctx, dest, true)
+	if err != nil {
+		return false, err
+	}
+	return fs.FileSystem.Copy(ctx, p, dest, options)
+}
+
+func (fs *CaseInsensitiveFileSystem) Move(ctx context.Context, name, dest string, options *MoveOptions) (created bool, err error) {
+	p, err := fs.resolve(ctx, name, false)
+	if err != nil {
+		return false, err
+	}
+	trimmedDest := strings.TrimSuffix(dest, "/")
+	if strings.EqualFold(strings.TrimSuffix(p, "/"), trimmedDest) {
+		// Renaming a file to change its casing must not resolve to the file
+		// itself
+		dest = path.Join(path.Dir(strings.TrimSuffix(p, "/")), path.Base(trimmedDest)) + dest[len(trimmedDest):]
+	} else {
+		dest, err = fs.resolve(ctx, dest, true)
+		if err != nil {
+			return false, err
+		}
+	}
+	return fs.FileSystem.Move(ctx, p, dest, options)
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-webdav/internal"
 )
@@ -17,15 +19,17 @@ import (
 // LocalFileSystem implements FileSystem for a local directory.
 type LocalFileSystem string
 
-var _ FileSystem = LocalFileSystem("")
+var _ AppendFileSystem = LocalFileSystem("")
+var _ ConditionalFileSystem = LocalFileSystem("")
+var _ WalkFileSystem = LocalFileSystem("")
 
 func (fs LocalFileSystem) localPath(name string) (string, error) {
-	if (filepath.Separator != '/' && strings.IndexRune(name, filepath.Separator) >= 0) || strings.Contains(name, "\x00") {
+	if filepath.Separator != '/' && strings.IndexRune(name, filepath.Separator) >= 0 {
 		return "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: invalid character in path")
 	}
-	name = path.Clean(name)
-	if !path.IsAbs(name) {
-		return "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: expected absolute path, got %q", name)
+	name, err := internal.SanitizePath(name)
+	if err != nil {
+		return "", err
 	}
 	return filepath.Join(string(fs), filepath.FromSlash(name)), nil
 }
@@ -35,7 +39,7 @@ func (fs LocalFileSystem) externalPath(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return "/" + filepath.ToSlash(rel), nil
+	return path.Clean("/" + filepath.ToSlash(rel)), nil
 }
 
 func (fs LocalFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
@@ -88,12 +92,23 @@ func (fs LocalFileSystem) Stat(ctx context.Context, name string) (*FileInfo, err
 }
 
 func (fs LocalFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
-	path, err := fs.localPath(name)
+	var l []FileInfo
+	err := fs.WalkDir(ctx, name, recursive, func(fi *FileInfo) error {
+		l = append(l, *fi)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return l, nil
+}
+
+func (fs LocalFileSystem) WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	path, err := fs.localPath(name)
+	if err != nil {
+		return err
+	}
 
-	var l []FileInfo
 	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -104,14 +119,16 @@ func (fs LocalFileSystem) ReadDir(ctx context.Context, name string, recursive bo
 			return err
 		}
 
-		l = append(l, *fileInfoFromOS(href, fi))
+		if err := fn(fileInfoFromOS(href, fi)); err != nil {
+			return err
+		}
 
 		if !recursive && fi.IsDir() && path != p {
 			return filepath.SkipDir
 		}
 		return nil
 	})
-	return l, errFromOS(err)
+	return errFromOS(err)
 }
 
 func (fs LocalFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
@@ -123,6 +140,78 @@ func (fs LocalFileSystem) Create(ctx context.Context, name string) (io.WriteClos
 	return wc, errFromOS(err)
 }
 
+// localConditionalMu serializes the conditional writes of LocalFileSystem.
+var localConditionalMu sync.Mutex
+
+// CreateWithOptions implements ConditionalFileSystem. The data is written to
+// a temporary file, which replaces the file when the writer is closed. The
+// preconditions are evaluated atomically with respect to other conditional
+// writes of this process only.
+func (fs LocalFileSystem) CreateWithOptions(ctx context.Context, name string, opts *CreateOptions) (io.WriteCloser, error) {
+	p, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return nil, errFromOS(err)
+	}
+	return &localConditionalWriter{File: f, path: p, opts: opts}, nil
+}
+
+type localConditionalWriter struct {
+	*os.File
+	path   string
+	opts   *CreateOptions
+	closed bool
+}
+
+// Close replaces the file if the preconditions are met. Closing the writer
+// twice is a no-op.
+func (w *localConditionalWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	tmp := w.File.Name()
+	if err := w.File.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	localConditionalMu.Lock()
+	defer localConditionalMu.Unlock()
+	var etag string
+	fi, err := os.Stat(w.path)
+	if err == nil {
+		etag = fileInfoFromOS(w.path, fi).ETag
+	} else if !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return errFromOS(err)
+	}
+	if err := w.opts.check(etag, err == nil); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		os.Remove(tmp)
+		return errFromOS(err)
+	}
+	return nil
+}
+
+func (fs LocalFileSystem) AppendFile(ctx context.Context, name string) (io.WriteCloser, error) {
+	p, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, errFromOS(err)
+	}
+	return f, nil
+}
+
 func (fs LocalFileSystem) RemoveAll(ctx context.Context, name string) error {
 	p, err := fs.localPath(name)
 	if err != nil {
@@ -178,14 +267,12 @@ func (fs LocalFileSystem) Copy(ctx context.Context, src, dst string, options *Co
 		return false, err
 	}
 
-	// TODO: "Note that an infinite-depth COPY of /A/ into /A/B/ could lead to
-	// infinite recursion if not handled correctly"
-
-	srcInfo, err := os.Stat(srcPath)
-	if err != nil {
+	if _, err := os.Stat(srcPath); err != nil {
 		return false, errFromOS(err)
 	}
-	srcPerm := srcInfo.Mode() & os.ModePerm
+	if err := checkCopyMoveDest(srcPath, dstPath); err != nil {
+		return false, err
+	}
 
 	if _, err := os.Stat(dstPath); err != nil {
 		if !os.IsNotExist(err) {
@@ -206,12 +293,19 @@ func (fs LocalFileSystem) Copy(ctx context.Context, src, dst string, options *Co
 			return err
 		}
 
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstPath, rel)
+		perm := fi.Mode() & os.ModePerm
+
 		if fi.IsDir() {
-			if err := os.Mkdir(dstPath, srcPerm); err != nil {
+			if err := os.Mkdir(dst, perm); err != nil {
 				return errFromOS(err)
 			}
 		} else {
-			if err := copyRegularFile(srcPath, dstPath, srcPerm); err != nil {
+			if err := copyRegularFile(p, dst, perm); err != nil {
 				return err
 			}
 		}
@@ -228,6 +322,29 @@ func (fs LocalFileSystem) Copy(ctx context.Context, src, dst string, options *Co
 	return created, nil
 }
 
+// checkCopyMoveDest checks that the destination of a COPY or MOVE request
+// isn't inside the source nor one of its parents, and that its parent
+// directory exists.
+func checkCopyMoveDest(srcPath, dstPath string) error {
+	if isLocalSubPath(dstPath, srcPath) {
+		return NewHTTPError(http.StatusForbidden, fmt.Errorf("webdav: cannot copy or move a resource into itself"))
+	} else if isLocalSubPath(srcPath, dstPath) {
+		return NewHTTPError(http.StatusForbidden, fmt.Errorf("webdav: cannot overwrite a parent of the source"))
+	}
+	if _, err := os.Stat(filepath.Dir(dstPath)); os.IsNotExist(err) {
+		return NewHTTPError(http.StatusConflict, err)
+	} else if err != nil {
+		return errFromOS(err)
+	}
+	return nil
+}
+
+// isLocalSubPath reports whether the local path p is dir or is inside dir.
+func isLocalSubPath(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func (fs LocalFileSystem) Move(ctx context.Context, src, dst string, options *MoveOptions) (created bool, err error) {
 	srcPath, err := fs.localPath(src)
 	if err != nil {
@@ -238,6 +355,13 @@ func (fs LocalFileSystem) Move(ctx context.Context, src, dst string, options *Mo
 		return false, err
 	}
 
+	if _, err := os.Stat(srcPath); err != nil {
+		return false, errFromOS(err)
+	}
+	if err := checkCopyMoveDest(srcPath, dstPath); err != nil {
+		return false, err
+	}
+
 	if _, err := os.Stat(dstPath); err != nil {
 		if !os.IsNotExist(err) {
 			return false, errFromOS(err)
@@ -258,3 +382,53 @@ func (fs LocalFileSystem) Move(ctx context.Context, src, dst string, options *Mo
 
 	return created, nil
 }
+
+// PosixLocalFileSystem is a LocalFileSystem which also exposes the owner, group
+// and mode of files, see PosixFileSystem. LocalFileSystem doesn't, since these
+// are returned in every allprop PROPFIND response.
+type PosixLocalFileSystem struct {
+	LocalFileSystem
+}
+
+var _ PosixFileSystem = PosixLocalFileSystem{}
+
+func (fs PosixLocalFileSystem) PosixMetadata(ctx context.Context, name string) (*PosixMetadata, error) {
+	p, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, errFromOS(err)
+	}
+	owner, group := fileOwner(fi)
+	return &PosixMetadata{
+		Owner: owner,
+		Group: group,
+		Mode:  fi.Mode() & os.ModePerm,
+	}, nil
+}
+
+func (fs PosixLocalFileSystem) SetPosixMetadata(ctx context.Context, name string, md *PosixMetadata) error {
+	p, err := fs.localPath(name)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return errFromOS(err)
+	}
+
+	owner, group := fileOwner(fi)
+	if md.Owner != owner || md.Group != group {
+		if err := chownFile(p, md.Owner, md.Group); err != nil {
+			return err
+		}
+	}
+	if md.Mode != fi.Mode()&os.ModePerm {
+		if err := os.Chmod(p, md.Mode); err != nil {
+			return errFromOS(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !illumos && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!illumos,!linux,!netbsd,!openbsd,!solaris
+
+package webdav
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+func fileOwner(fi os.FileInfo) (owner, group string) {
+	return "", ""
+}
+
+func chownFile(p, owner, group string) error {
+	return internal.HTTPErrorf(http.StatusNotImplemented, "webdav: changing file ownership is unsupported on this platform")
+}
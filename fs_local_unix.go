@@ -0,0 +1,72 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package webdav
+
+import (
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// fileOwner returns the names of the user and group owning a file, falling
+// back to numeric IDs.
+func fileOwner(fi os.FileInfo) (owner, group string) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	uid := strconv.FormatUint(uint64(st.Uid), 10)
+	gid := strconv.FormatUint(uint64(st.Gid), 10)
+
+	owner, group = uid, gid
+	if u, err := user.LookupId(uid); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(gid); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
+
+func lookupID(name string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	s, err := lookup(name)
+	if err != nil {
+		return 0, internal.HTTPErrorf(http.StatusConflict, "webdav: %v", err)
+	}
+	return strconv.Atoi(s)
+}
+
+func chownFile(p, owner, group string) error {
+	uid, err := lookupID(owner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return err
+	}
+	gid, err := lookupID(group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(p, uid, gid); err != nil {
+		return errFromOS(err)
+	}
+	return nil
+}
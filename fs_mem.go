@@ -0,0 +1,484 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// MemFileSystem is an in-memory FileSystem, e.g. for tests. The zero value is
+// an empty file system, ready to use. It's safe for concurrent use.
+//
+// Dead properties are stored along with files, and directories support
+// collection synchronization. ETags and sync tokens are derived from a change
+// counter, so they change whenever a file is written.
+type MemFileSystem struct {
+	mu      sync.Mutex
+	files   map[string]*memFile
+	removed map[string]uint64 // change sequence numbers by path
+	seq     uint64
+}
+
+type memFile struct {
+	isDir             bool
+	data              []byte
+	modTime           time.Time
+	created, modified uint64
+	props             map[xml.Name]string
+}
+
+var (
+	_ AppendFileSystem      = (*MemFileSystem)(nil)
+	_ ConditionalFileSystem = (*MemFileSystem)(nil)
+	_ SyncFileSystem        = (*MemFileSystem)(nil)
+	_ DeadPropertyStore     = (*MemFileSystem)(nil)
+)
+
+func (f *memFile) fileInfo(p string) *FileInfo {
+	return &FileInfo{
+		Path:     p,
+		Size:     int64(len(f.data)),
+		ModTime:  f.modTime,
+		IsDir:    f.isDir,
+		MIMEType: mime.TypeByExtension(path.Ext(p)),
+		ETag:     strconv.FormatUint(f.modified, 16),
+	}
+}
+
+// lookup returns the file at a path. The lock must be held.
+func (fs *MemFileSystem) lookup(name string) (string, *memFile, error) {
+	p, err := internal.SanitizePath(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if fs.files == nil {
+		fs.files = map[string]*memFile{"/": {isDir: true, modTime: time.Now()}}
+		fs.removed = make(map[string]uint64)
+	}
+	return p, fs.files[p], nil
+}
+
+// stat returns the file at a path, or an HTTP 404 error. The lock must be
+// held.
+func (fs *MemFileSystem) stat(name string) (string, *memFile, error) {
+	p, f, err := fs.lookup(name)
+	if err != nil {
+		return "", nil, err
+	} else if f == nil {
+		return "", nil, internal.HTTPErrorf(http.StatusNotFound, "webdav: %q not found", p)
+	}
+	return p, f, nil
+}
+
+// checkParent checks that the parent of a path is a directory. The lock must
+// be held.
+func (fs *MemFileSystem) checkParent(p string) error {
+	if parent := fs.files[path.Dir(p)]; parent == nil || !parent.isDir {
+		return internal.HTTPErrorf(http.StatusConflict, "webdav: parent directory of %q doesn't exist", p)
+	}
+	return nil
+}
+
+// walk returns the paths of a file and its descendants, in lexical order
+// within each directory. The lock must be held.
+func (fs *MemFileSystem) walk(p string, recursive bool) []string {
+	var children []string
+	for child := range fs.files {
+		if child != "/" && path.Dir(child) == p {
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+
+	l := []string{p}
+	for _, child := range children {
+		if recursive {
+			l = append(l, fs.walk(child, true)...)
+		} else {
+			l = append(l, child)
+		}
+	}
+	return l
+}
+
+func (fs *MemFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	} else if f.isDir {
+		return nil, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q is a directory", p)
+	}
+	// Data is never modified in place. The reader is seekable, to support
+	// range requests.
+	return bytesReadCloser{bytes.NewReader(f.data)}, nil
+}
+
+func (fs *MemFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.fileInfo(p), nil
+}
+
+func (fs *MemFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, _, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	var l []FileInfo
+	for _, child := range fs.walk(p, recursive) {
+		l = append(l, *fs.files[child].fileInfo(child))
+	}
+	return l, nil
+}
+
+type memFileWriter struct {
+	fs        *MemFileSystem
+	name      string
+	appending bool
+	opts      *CreateOptions
+	buf       bytes.Buffer
+	closed    bool
+}
+
+func (w *memFileWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// Close stores the written data. Closing the writer twice is a no-op.
+func (w *memFileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.fs.write(w.name, w.buf.Bytes(), w.appending, w.opts)
+}
+
+// write replaces or appends to the contents of a file. opts may be nil.
+func (fs *MemFileSystem) write(name string, data []byte, appending bool, opts *CreateOptions) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkParent(p); err != nil {
+		return err
+	} else if f != nil && f.isDir {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q is a directory", p)
+	}
+	if opts != nil {
+		var etag string
+		if f != nil {
+			etag = f.fileInfo(p).ETag
+		}
+		if err := opts.check(etag, f != nil); err != nil {
+			return err
+		}
+	}
+
+	fs.seq++
+	if f == nil {
+		if appending {
+			return internal.HTTPErrorf(http.StatusNotFound, "webdav: %q not found", p)
+		}
+		f = &memFile{created: fs.seq}
+		fs.files[p] = f
+	}
+	if appending {
+		// Copy the data, readers may still hold the previous slice
+		data = append(f.data[:len(f.data):len(f.data)], data...)
+	}
+	f.data = data
+	f.modified = fs.seq
+	f.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.checkParent(p); err != nil {
+		return nil, err
+	} else if f != nil && f.isDir {
+		return nil, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q is a directory", p)
+	}
+	return &memFileWriter{fs: fs, name: p}, nil
+}
+
+// CreateWithOptions implements ConditionalFileSystem.
+func (fs *MemFileSystem) CreateWithOptions(ctx context.Context, name string, opts *CreateOptions) (io.WriteCloser, error) {
+	wc, err := fs.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	wc.(*memFileWriter).opts = opts
+	return wc, nil
+}
+
+func (fs *MemFileSystem) AppendFile(ctx context.Context, name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	} else if f.isDir {
+		return nil, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q is a directory", p)
+	}
+	return &memFileWriter{fs: fs, name: p, appending: true}, nil
+}
+
+// remove removes a file and its descendants. The lock must be held.
+func (fs *MemFileSystem) remove(p string) {
+	fs.seq++
+	for _, child := range fs.walk(p, true) {
+		delete(fs.files, child)
+		fs.removed[child] = fs.seq
+	}
+}
+
+func (fs *MemFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, _, err := fs.stat(name)
+	if err != nil {
+		return err
+	} else if p == "/" {
+		return internal.HTTPErrorf(http.StatusForbidden, "webdav: cannot remove the root directory")
+	}
+	fs.remove(p)
+	return nil
+}
+
+func (fs *MemFileSystem) Mkdir(ctx context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, f, err := fs.lookup(name)
+	if err != nil {
+		return err
+	} else if f != nil {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q already exists", p)
+	}
+	if err := fs.checkParent(p); err != nil {
+		return err
+	}
+	fs.seq++
+	fs.files[p] = &memFile{isDir: true, modTime: time.Now(), created: fs.seq, modified: fs.seq}
+	return nil
+}
+
+// prepareCopyMove checks the source and destination of a COPY or MOVE
+// request, and removes the destination if it's overwritten. The lock must be
+// held.
+func (fs *MemFileSystem) prepareCopyMove(src, dst string, noOverwrite bool) (srcPath, dstPath string, created bool, err error) {
+	srcPath, _, err = fs.stat(src)
+	if err != nil {
+		return "", "", false, err
+	}
+	dstPath, dstFile, err := fs.lookup(dst)
+	if err != nil {
+		return "", "", false, err
+	}
+	if isSubPath(dstPath, srcPath) {
+		return "", "", false, internal.HTTPErrorf(http.StatusForbidden, "webdav: cannot copy or move a resource into itself")
+	} else if isSubPath(srcPath, dstPath) {
+		return "", "", false, internal.HTTPErrorf(http.StatusForbidden, "webdav: cannot overwrite a parent of the source")
+	}
+	if err := fs.checkParent(dstPath); err != nil {
+		return "", "", false, err
+	}
+
+	if dstFile == nil {
+		created = true
+	} else if noOverwrite {
+		return "", "", false, internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: %q already exists", dstPath)
+	} else {
+		fs.remove(dstPath)
+	}
+	return srcPath, dstPath, created, nil
+}
+
+func (fs *MemFileSystem) Copy(ctx context.Context, src, dst string, options *CopyOptions) (created bool, err error) {
+	if options == nil {
+		options = new(CopyOptions)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	srcPath, dstPath, created, err := fs.prepareCopyMove(src, dst, options.NoOverwrite)
+	if err != nil {
+		return false, err
+	}
+
+	paths := []string{srcPath}
+	if !options.NoRecursive {
+		paths = fs.walk(srcPath, true)
+	}
+
+	fs.seq++
+	now := time.Now()
+	for _, p := range paths {
+		f := *fs.files[p]
+		f.modTime = now
+		f.created, f.modified = fs.seq, fs.seq
+		f.props = copyDeadProps(f.props)
+		fs.files[dstPath+p[len(srcPath):]] = &f
+	}
+	return created, nil
+}
+
+func (fs *MemFileSystem) Move(ctx context.Context, src, dst string, options *MoveOptions) (created bool, err error) {
+	if options == nil {
+		options = new(MoveOptions)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	srcPath, dstPath, created, err := fs.prepareCopyMove(src, dst, options.NoOverwrite)
+	if err != nil {
+		return false, err
+	}
+
+	fs.seq++
+	for _, p := range fs.walk(srcPath, true) {
+		f := fs.files[p]
+		f.created, f.modified = fs.seq, fs.seq
+		fs.files[dstPath+p[len(srcPath):]] = f
+		delete(fs.files, p)
+		fs.removed[p] = fs.seq
+	}
+	return created, nil
+}
+
+func copyDeadProps(props map[xml.Name]string) map[xml.Name]string {
+	if props == nil {
+		return nil
+	}
+	m := make(map[xml.Name]string, len(props))
+	for k, v := range props {
+		m[k] = v
+	}
+	return m
+}
+
+func (fs *MemFileSystem) GetDeadProperties(ctx context.Context, name string) (map[xml.Name]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, f, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return copyDeadProps(f.props), nil
+}
+
+func (fs *MemFileSystem) SetDeadProperties(ctx context.Context, name string, props map[xml.Name]string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, f, err := fs.stat(name)
+	if err != nil {
+		return err
+	}
+	if f.props == nil {
+		f.props = make(map[xml.Name]string)
+	}
+	for k, v := range props {
+		f.props[k] = v
+	}
+	return nil
+}
+
+func (fs *MemFileSystem) RemoveDeadProperties(ctx context.Context, name string, names []xml.Name) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, f, err := fs.stat(name)
+	if err != nil {
+		return err
+	}
+	for _, k := range names {
+		delete(f.props, k)
+	}
+	return nil
+}
+
+// syncSeq returns the latest change sequence number of a directory and its
+// descendants. The lock must be held.
+func (fs *MemFileSystem) syncSeq(dir string) uint64 {
+	var seq uint64
+	for _, p := range fs.walk(dir, true) {
+		if f := fs.files[p]; f.modified > seq {
+			seq = f.modified
+		}
+	}
+	for p, removed := range fs.removed {
+		if removed > seq && isSubPath(p, dir) {
+			seq = removed
+		}
+	}
+	return seq
+}
+
+func (fs *MemFileSystem) SyncToken(ctx context.Context, name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, _, err := fs.stat(name)
+	if err != nil {
+		return "", err
+	}
+	return internal.FormatSyncToken(fs.syncSeq(p)), nil
+}
+
+func (fs *MemFileSystem) Changes(ctx context.Context, name, syncToken string, recursive bool) (*SyncChanges, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p, _, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	seq := fs.syncSeq(p)
+
+	var since uint64
+	removed := make(map[string]uint64)
+	if syncToken != "" {
+		if since, err = internal.ParseSyncToken(syncToken, seq); err != nil {
+			return nil, err
+		}
+		for child, n := range fs.removed {
+			if child != p && isSubPath(child, p) && (recursive || path.Dir(child) == p) {
+				removed[child] = n
+			}
+		}
+	}
+
+	var members []internal.MemberVersion
+	for _, child := range fs.walk(p, recursive)[1:] {
+		f := fs.files[child]
+		members = append(members, internal.MemberVersion{
+			Path:     child,
+			Created:  f.created,
+			Modified: f.modified,
+		})
+	}
+
+	changes := SyncChanges{SyncToken: internal.FormatSyncToken(seq)}
+	changes.Added, changes.Modified, changes.Deleted = internal.ChangesSince(members, removed, since)
+	return &changes, nil
+}
@@ -0,0 +1,166 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// WindowsNameFileSystem wraps a FileSystem to keep it usable by Windows
+// clients, e.g. the Windows WebDAV redirector. Creating files with names
+// invalid on Windows fails with 403 Forbidden: reserved device names such as
+// "CON" or "LPT1", names with a trailing dot or space, and names containing
+// reserved characters such as ":" or "?".
+type WindowsNameFileSystem struct {
+	FileSystem FileSystem
+	// Translate, if set, maps reserved characters, and trailing dots and
+	// spaces, to Unicode private use characters instead of rejecting them,
+	// like Cygwin and Samba do. Existing files are listed with translated
+	// names. Reserved device names are always rejected.
+	Translate bool
+}
+
+var _ FileSystem = (*WindowsNameFileSystem)(nil)
+
+// windowsPrivateUseBase is the base of the Unicode private use characters
+// used to translate characters invalid on Windows.
+const windowsPrivateUseBase = 0xF000
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func isWindowsReservedChar(r rune) bool {
+	return r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r)
+}
+
+func isWindowsReservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(name, " "))]
+}
+
+// checkName validates each element of a path.
+func (fs *WindowsNameFileSystem) checkName(name string) error {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" {
+			continue
+		}
+		if isWindowsReservedName(elem) {
+			return internal.HTTPErrorf(http.StatusForbidden, "webdav: %q is a reserved name on Windows", elem)
+		}
+		if fs.Translate {
+			continue
+		}
+		if i := strings.IndexFunc(elem, isWindowsReservedChar); i >= 0 {
+			return internal.HTTPErrorf(http.StatusForbidden, "webdav: name %q contains character %q, which is invalid on Windows", elem, elem[i])
+		}
+		if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+			return internal.HTTPErrorf(http.StatusForbidden, "webdav: name %q ends with a dot or space, which is invalid on Windows", elem)
+		}
+	}
+	return nil
+}
+
+// external translates a path returned by the wrapped FileSystem.
+func (fs *WindowsNameFileSystem) external(name string) string {
+	if !fs.Translate {
+		return name
+	}
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+		trimmed := strings.TrimRight(elem, ". ")
+		var sb strings.Builder
+		for _, r := range trimmed {
+			if isWindowsReservedChar(r) {
+				r += windowsPrivateUseBase
+			}
+			sb.WriteRune(r)
+		}
+		for _, r := range elem[len(trimmed):] {
+			sb.WriteRune(r + windowsPrivateUseBase)
+		}
+		elems[i] = sb.String()
+	}
+	return strings.Join(elems, "/")
+}
+
+// internal reverts the translation of a path sent by a client.
+func (fs *WindowsNameFileSystem) internal(name string) string {
+	if !fs.Translate {
+		return name
+	}
+	return strings.Map(func(r rune) rune {
+		if c := r - windowsPrivateUseBase; c >= 0 && (isWindowsReservedChar(c) || c == '.' || c == ' ') {
+			return c
+		}
+		return r
+	}, name)
+}
+
+func (fs *WindowsNameFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return fs.FileSystem.Open(ctx, fs.internal(name))
+}
+
+func (fs *WindowsNameFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fi, err := fs.FileSystem.Stat(ctx, fs.internal(name))
+	if err != nil {
+		return nil, err
+	}
+	fi.Path = fs.external(fi.Path)
+	return fi, nil
+}
+
+func (fs *WindowsNameFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	l, err := fs.FileSystem.ReadDir(ctx, fs.internal(name), recursive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l {
+		l[i].Path = fs.external(l[i].Path)
+	}
+	return l, nil
+}
+
+func (fs *WindowsNameFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := fs.checkName(name); err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Create(ctx, fs.internal(name))
+}
+
+func (fs *WindowsNameFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return fs.FileSystem.RemoveAll(ctx, fs.internal(name))
+}
+
+func (fs *WindowsNameFileSystem) Mkdir(ctx context.Context, name string) error {
+	if err := fs.checkName(name); err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(ctx, fs.internal(name))
+}
+
+func (fs *WindowsNameFileSystem) Copy(ctx context.Context, name, dest string, options *CopyOptions) (created bool, err error) {
+	if err := fs.checkName(dest); err != nil {
+		return false, err
+	}
+	return fs.FileSystem.Copy(ctx, fs.internal(name), fs.internal(dest), options)
+}
+
+func (fs *WindowsNameFileSystem) Move(ctx context.Context, name, dest string, options *MoveOptions) (created bool, err error) {
+	if err := fs.checkName(dest); err != nil {
+		return false, err
+	}
+	return fs.FileSystem.Move(ctx, fs.internal(name), fs.internal(dest), options)
+}
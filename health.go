@@ -0,0 +1,125 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// HealthProbe checks whether a backend dependency is reachable.
+type HealthProbe func(ctx context.Context) error
+
+// FileSystemProbe returns a HealthProbe which stats the root of a FileSystem
+// and lists its children.
+func FileSystemProbe(fs FileSystem) HealthProbe {
+	return func(ctx context.Context) error {
+		fi, err := fs.Stat(ctx, "/")
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir {
+			return fmt.Errorf("webdav: root is not a collection")
+		}
+		_, err = fs.ReadDir(ctx, "/", false)
+		return err
+	}
+}
+
+// HealthHandler serves health checks, typically mounted at a path such as
+// /healthz or /readyz next to the WebDAV handler.
+//
+// All probes are run concurrently. The handler replies with 200 OK if all of
+// them succeed and with 503 Service Unavailable otherwise. Probes which don't
+// return before the timeout are reported as failed, even if they ignore their
+// context. The response body
+// lists the status of each probe, without error details: errors are logged
+// to ErrorLog. A HealthHandler without probes can be used as a liveness
+// check.
+type HealthHandler struct {
+	// Probes maps probe names to probes.
+	Probes map[string]HealthProbe
+	// Timeout limits the duration of each health check. Zero means 5
+	// seconds.
+	Timeout time.Duration
+	// ErrorLog specifies an optional logger for probe failures. If nil,
+	// logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+type healthResult struct {
+	name string
+	err  error
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "webdav: unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	ch := make(chan healthResult, len(h.Probes))
+	for name, probe := range h.Probes {
+		go func(name string, probe HealthProbe) {
+			ch <- healthResult{name, probe(ctx)}
+		}(name, probe)
+	}
+
+	// Late probes send their result to the buffered channel and exit
+	done := make(map[string]bool, len(h.Probes))
+	results := make([]healthResult, 0, len(h.Probes))
+	for len(results) < len(h.Probes) {
+		select {
+		case res := <-ch:
+			done[res.name] = true
+			results = append(results, res)
+			continue
+		case <-ctx.Done():
+		}
+		for name := range h.Probes {
+			if !done[name] {
+				results = append(results, healthResult{name, ctx.Err()})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].name < results[j].name
+	})
+
+	code := http.StatusOK
+	for _, res := range results {
+		if res.err != nil {
+			code = http.StatusServiceUnavailable
+			if h.ErrorLog != nil {
+				h.ErrorLog.Printf("webdav: health probe %q failed: %v", res.name, res.err)
+			} else {
+				log.Printf("webdav: health probe %q failed: %v", res.name, res.err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead {
+		return
+	}
+	for _, res := range results {
+		status := "ok"
+		if res.err != nil {
+			status = "failed"
+		}
+		fmt.Fprintf(w, "%v: %v\n", res.name, status)
+	}
+}
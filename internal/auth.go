@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ParseAuthorization splits an Authorization header into its scheme and
+// credentials.
+func ParseAuthorization(s string) (scheme, credentials string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i+1:])
+}
+
+// ParseAuthParams parses a comma-separated list of authentication
+// parameters, as defined in RFC 7235 section 2.1.
+func ParseAuthParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("webdav: malformed authentication parameter %q", s)
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("webdav: unterminated quoted string in authentication parameter %q", name)
+			}
+			value = sb.String()
+			s = s[i+1:]
+		} else {
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			value = strings.TrimSpace(s[:i])
+			s = s[i:]
+		}
+		params[name] = value
+	}
+}
+
+func newDigestHash(algorithm string) hash.Hash {
+	// Session variants ("-sess" suffix) use the same hash function
+	if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// DigestHash returns the hex-encoded hash of s with a HTTP Digest
+// authentication algorithm, as defined in RFC 7616 section 3.4.2.
+func DigestHash(algorithm, s string) string {
+	h := newDigestHash(algorithm)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type pathFilterKey struct{}
+
+// WithPathFilter returns a copy of ctx restricting the paths which can be
+// referenced by a request. It's used to apply credential scopes to hrefs
+// carried in request bodies, e.g. by multiget reports.
+func WithPathFilter(ctx context.Context, allowed func(p string) bool) context.Context {
+	return context.WithValue(ctx, pathFilterKey{}, allowed)
+}
+
+// PathAllowed reports whether the path p can be referenced by the request.
+// All paths are allowed if ctx doesn't carry a path filter.
+func PathAllowed(ctx context.Context, p string) bool {
+	allowed, ok := ctx.Value(pathFilterKey{}).(func(p string) bool)
+	return !ok || allowed(p)
+}
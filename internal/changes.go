@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// syncTokenPrefix is the prefix of the sync tokens created by FormatSyncToken.
+// Sync tokens must be URIs, see RFC 6578 section 3.2.
+const syncTokenPrefix = "https://github.com/emersion/go-webdav/ns/sync/"
+
+// FormatSyncToken formats a change sequence number as a sync token.
+func FormatSyncToken(seq uint64) string {
+	return syncTokenPrefix + strconv.FormatUint(seq, 10)
+}
+
+// ParseSyncToken parses a sync token created by FormatSyncToken. cur is the
+// current sequence number: ErrInvalidSyncToken is returned for malformed
+// tokens and tokens newer than cur.
+func ParseSyncToken(token string, cur uint64) (uint64, error) {
+	s := strings.TrimPrefix(token, syncTokenPrefix)
+	if s == token {
+		return 0, ErrInvalidSyncToken
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || seq > cur {
+		return 0, ErrInvalidSyncToken
+	}
+	return seq, nil
+}
+
+// MemberVersion records when a member of a collection has been created and
+// last modified, as change sequence numbers.
+type MemberVersion struct {
+	Path              string
+	Created, Modified uint64
+}
+
+// ChangesSince lists the members added, modified and removed after the
+// change sequence number since. removed maps the paths of removed members to
+// the sequence number of their removal, members which exist again are
+// ignored. The lists are sorted.
+func ChangesSince(members []MemberVersion, removed map[string]uint64, since uint64) (added, modified, deleted []string) {
+	exists := make(map[string]bool, len(members))
+	for _, m := range members {
+		exists[m.Path] = true
+		if m.Created > since {
+			added = append(added, m.Path)
+		} else if m.Modified > since {
+			modified = append(modified, m.Path)
+		}
+	}
+	for p, seq := range removed {
+		if seq > since && !exists[p] {
+			deleted = append(deleted, p)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(modified)
+	sort.Strings(deleted)
+	return added, modified, deleted
+}
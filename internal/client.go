@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"mime"
-	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -15,42 +14,6 @@ import (
 	"unicode"
 )
 
-// DiscoverContextURL performs a DNS-based CardDAV/CalDAV service discovery as
-// described in RFC 6352 section 11. It returns the URL to the CardDAV server.
-func DiscoverContextURL(ctx context.Context, service, domain string) (string, error) {
-	var resolver net.Resolver
-
-	// Only lookup TLS records, plaintext connections are insecure
-	_, addrs, err := resolver.LookupSRV(ctx, service+"s", "tcp", domain)
-	if dnsErr, ok := err.(*net.DNSError); ok {
-		if dnsErr.IsTemporary {
-			return "", err
-		}
-	} else if err != nil {
-		return "", err
-	}
-
-	if len(addrs) == 0 {
-		return "", fmt.Errorf("webdav: domain doesn't have an SRV record")
-	}
-	addr := addrs[0]
-
-	target := strings.TrimSuffix(addr.Target, ".")
-	if target == "" {
-		return "", fmt.Errorf("webdav: empty target in SRV record")
-	}
-
-	// TODO: perform a TXT lookup, check for a "path" key in the response
-	u := url.URL{Scheme: "https"}
-	if addr.Port == 443 {
-		u.Host = target
-	} else {
-		u.Host = fmt.Sprintf("%v:%v", target, addr.Port)
-	}
-	u.Path = "/.well-known/" + service
-	return u.String(), nil
-}
-
 // HTTPClient performs HTTP requests. It's implemented by *http.Client.
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -89,18 +52,20 @@ func (c *Client) ResolveHref(p string) *url.URL {
 	}
 }
 
-func (c *Client) NewRequest(method string, path string, body io.Reader) (*http.Request, error) {
-	return http.NewRequest(method, c.ResolveHref(path).String(), body)
+// NewRequest creates a new request for the given path. The request is
+// cancelled when ctx is done.
+func (c *Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, c.ResolveHref(path).String(), body)
 }
 
-func (c *Client) NewXMLRequest(method string, path string, v interface{}) (*http.Request, error) {
+func (c *Client) NewXMLRequest(ctx context.Context, method string, path string, v interface{}) (*http.Request, error) {
 	var buf bytes.Buffer
 	buf.WriteString(xml.Header)
 	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
 		return nil, err
 	}
 
-	req, err := c.NewRequest(method, path, &buf)
+	req, err := c.NewRequest(ctx, method, path, &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +75,17 @@ func (c *Client) NewXMLRequest(method string, path string, v interface{}) (*http
 	return req, nil
 }
 
+// SetConditional sets the If-Match and If-None-Match headers of a request,
+// if not empty.
+func SetConditional(req *http.Request, ifMatch, ifNoneMatch string) {
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+}
+
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	resp, err := c.http.Do(req)
 	if err != nil {
@@ -170,14 +146,14 @@ func (c *Client) DoMultiStatus(req *http.Request) (*MultiStatus, error) {
 }
 
 func (c *Client) PropFind(ctx context.Context, path string, depth Depth, propfind *PropFind) (*MultiStatus, error) {
-	req, err := c.NewXMLRequest("PROPFIND", path, propfind)
+	req, err := c.NewXMLRequest(ctx, "PROPFIND", path, propfind)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Depth", depth.String())
 
-	return c.DoMultiStatus(req.WithContext(ctx))
+	return c.DoMultiStatus(req)
 }
 
 // PropfindFlat performs a PROPFIND request with a zero depth.
@@ -194,6 +170,51 @@ func (c *Client) PropFindFlat(ctx context.Context, path string, propfind *PropFi
 	return &ms.Responses[0], nil
 }
 
+// PropPatch performs a PROPPATCH request. An error is returned if any of the
+// properties couldn't be updated.
+func (c *Client) PropPatch(ctx context.Context, path string, update *PropertyUpdate) error {
+	req, err := c.NewXMLRequest(ctx, "PROPPATCH", path, update)
+	if err != nil {
+		return err
+	}
+
+	ms, err := c.DoMultiStatus(req)
+	if err != nil {
+		return err
+	}
+	for _, resp := range ms.Responses {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, propstat := range resp.PropStats {
+			if err := propstat.Status.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FindCurrentUserPrincipal finds the current user's principal path, by
+// performing a PROPFIND request on the provided path.
+func (c *Client) FindCurrentUserPrincipal(ctx context.Context, path string) (string, error) {
+	propfind := NewPropNamePropFind(CurrentUserPrincipalName)
+	resp, err := c.PropFindFlat(ctx, path, propfind)
+	if err != nil {
+		return "", err
+	}
+
+	var prop CurrentUserPrincipal
+	if err := resp.DecodeProp(&prop); err != nil {
+		return "", err
+	}
+	if prop.Unauthenticated != nil {
+		return "", fmt.Errorf("webdav: unauthenticated")
+	}
+
+	return prop.Href.Path, nil
+}
+
 func parseCommaSeparatedSet(values []string, upper bool) map[string]bool {
 	m := make(map[string]bool)
 	for _, v := range values {
@@ -213,12 +234,12 @@ func parseCommaSeparatedSet(values []string, upper bool) map[string]bool {
 }
 
 func (c *Client) Options(ctx context.Context, path string) (classes map[string]bool, methods map[string]bool, err error) {
-	req, err := c.NewRequest(http.MethodOptions, path, nil)
+	req, err := c.NewRequest(ctx, http.MethodOptions, path, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	resp, err := c.Do(req.WithContext(ctx))
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -235,19 +256,23 @@ func (c *Client) Options(ctx context.Context, path string) (classes map[string]b
 
 // SyncCollection perform a `sync-collection` REPORT operation on a resource
 func (c *Client) SyncCollection(ctx context.Context, path, syncToken string, level Depth, limit *Limit, prop *Prop) (*MultiStatus, error) {
+	syncLevel, err := FormatSyncLevel(level)
+	if err != nil {
+		return nil, err
+	}
 	q := SyncCollectionQuery{
 		SyncToken: syncToken,
-		SyncLevel: level.String(),
+		SyncLevel: syncLevel,
 		Limit:     limit,
 		Prop:      prop,
 	}
 
-	req, err := c.NewXMLRequest("REPORT", path, &q)
+	req, err := c.NewXMLRequest(ctx, "REPORT", path, &q)
 	if err != nil {
 		return nil, err
 	}
 
-	ms, err := c.DoMultiStatus(req.WithContext(ctx))
+	ms, err := c.DoMultiStatus(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Collations used by CalDAV and CardDAV text-match elements, defined in
+// RFC 4790 and RFC 5051.
+const (
+	CollationOctet          = "i;octet"
+	CollationASCIICasemap   = "i;ascii-casemap"
+	CollationUnicodeCasemap = "i;unicode-casemap"
+)
+
+// SupportedCollations lists the collations supported by MatchText.
+var SupportedCollations = []string{
+	CollationASCIICasemap,
+	CollationOctet,
+	CollationUnicodeCasemap,
+}
+
+// IsSupportedCollation checks whether a collation is supported by MatchText.
+func IsSupportedCollation(collation string) bool {
+	for _, c := range SupportedCollations {
+		if c == collation {
+			return true
+		}
+	}
+	return false
+}
+
+func asciiUpper(r rune) rune {
+	if r >= 'a' && r <= 'z' {
+		return r - 'a' + 'A'
+	}
+	return r
+}
+
+// collationKey maps a string to a form which can be compared octet by octet.
+func collationKey(collation, s string) (string, error) {
+	switch collation {
+	case CollationOctet:
+		return s, nil
+	case CollationASCIICasemap:
+		return strings.Map(asciiUpper, s), nil
+	case CollationUnicodeCasemap:
+		// RFC 5051 also requires NFKD normalization, which isn't applied here
+		return strings.Map(unicode.ToTitle, s), nil
+	}
+	return "", fmt.Errorf("webdav: unsupported collation %q", collation)
+}
+
+// MatchText matches a value against text with a collation. The match type is
+// one of "equals", "contains", "starts-with" or "ends-with", as defined in
+// RFC 6352 section 10.5.4.
+func MatchText(collation, matchType, text, value string) (bool, error) {
+	text, err := collationKey(collation, text)
+	if err != nil {
+		return false, err
+	}
+	value, err = collationKey(collation, value)
+	if err != nil {
+		return false, err
+	}
+
+	switch matchType {
+	case "equals":
+		return value == text, nil
+	case "contains":
+		return strings.Contains(value, text), nil
+	case "starts-with":
+		return strings.HasPrefix(value, text), nil
+	case "ends-with":
+		return strings.HasSuffix(value, text), nil
+	}
+	return false, fmt.Errorf("webdav: unknown text-match type %q", matchType)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +23,13 @@ var (
 	GetETagName          = xml.Name{Namespace, "getetag"}
 
 	CurrentUserPrincipalName = xml.Name{Namespace, "current-user-principal"}
+
+	NumberOfMatchesWithinLimitsName = xml.Name{Namespace, "number-of-matches-within-limits"}
+
+	SyncTokenName      = xml.Name{Namespace, "sync-token"}
+	SyncCollectionName = xml.Name{Namespace, "sync-collection"}
+
+	ResponseDescriptionName = xml.Name{Namespace, "responsedescription"}
 )
 
 type Status struct {
@@ -80,7 +88,7 @@ func (h *Href) MarshalText() ([]byte, error) {
 }
 
 func (h *Href) UnmarshalText(b []byte) error {
-	u, err := url.Parse(string(b))
+	u, err := ParseURL(string(b))
 	if err != nil {
 		return err
 	}
@@ -88,6 +96,24 @@ func (h *Href) UnmarshalText(b []byte) error {
 	return nil
 }
 
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// ParseURL parses a URL. Some clients and servers don't percent-encode '%'
+// characters in resource names: these are escaped before parsing.
+func ParseURL(s string) (*url.URL, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && (i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])) {
+			sb.WriteString("%25")
+		} else {
+			sb.WriteByte(s[i])
+		}
+	}
+	return url.Parse(sb.String())
+}
+
 // https://tools.ietf.org/html/rfc4918#section-14.16
 type MultiStatus struct {
 	XMLName             xml.Name   `xml:"DAV: multistatus"`
@@ -100,6 +126,20 @@ func NewMultiStatus(resps ...Response) *MultiStatus {
 	return &MultiStatus{Responses: resps}
 }
 
+// SortResponses sorts responses by their first href, so that multi-status
+// responses don't depend on the order in which backends list resources.
+func SortResponses(resps []Response) {
+	key := func(resp *Response) string {
+		if len(resp.Hrefs) == 0 {
+			return ""
+		}
+		return resp.Hrefs[0].String()
+	}
+	sort.SliceStable(resps, func(i, j int) bool {
+		return key(&resps[i]) < key(&resps[j])
+	})
+}
+
 // https://tools.ietf.org/html/rfc4918#section-14.24
 type Response struct {
 	XMLName             xml.Name   `xml:"DAV: response"`
@@ -138,6 +178,24 @@ func NewErrorResponse(path string, err error) *Response {
 	}
 }
 
+// NewTruncatedResponse creates a response indicating that the results for the
+// request-URI have been truncated, as described in RFC 6578 section 3.6.
+func NewTruncatedResponse(path string) *Response {
+	href := Href{Path: path}
+	elem := NewRawXMLElement(NumberOfMatchesWithinLimitsName, nil, nil)
+	return &Response{
+		Hrefs:  []Href{href},
+		Status: &Status{Code: http.StatusInsufficientStorage},
+		Error:  &Error{Raw: []RawXMLValue{*elem}},
+	}
+}
+
+// IsTruncated reports whether the response indicates that the server has
+// truncated the results.
+func (resp *Response) IsTruncated() bool {
+	return resp.Status != nil && resp.Status.Code == http.StatusInsufficientStorage
+}
+
 func (resp *Response) Err() error {
 	if resp.Status == nil || resp.Status.Code/100 == 2 {
 		return nil
@@ -346,14 +404,21 @@ type GetContentType struct {
 	Type    string   `xml:",chardata"`
 }
 
+// Time is a timestamp formatted as an HTTP-date. When parsing, RFC 3339
+// timestamps (with or without fractional seconds) are accepted as well, since
+// some servers send them. Parsed timestamps are normalized to UTC.
 type Time time.Time
 
 func (t *Time) UnmarshalText(b []byte) error {
 	tt, err := http.ParseTime(string(b))
 	if err != nil {
-		return err
+		var rfc3339Err error
+		tt, rfc3339Err = time.Parse(time.RFC3339Nano, string(b))
+		if rfc3339Err != nil {
+			return err
+		}
 	}
-	*t = Time(tt)
+	*t = Time(tt.UTC())
 	return nil
 }
 
@@ -366,6 +431,20 @@ func (t *Time) MarshalText() ([]byte, error) {
 type GetLastModified struct {
 	XMLName      xml.Name `xml:"DAV: getlastmodified"`
 	LastModified Time     `xml:",chardata"`
+
+	// Layout overrides the time layout used when marshalling. The timestamp
+	// is always converted to UTC.
+	Layout string `xml:"-"`
+}
+
+func (glm *GetLastModified) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = GetLastModifiedName
+	if glm.Layout == "" {
+		type getLastModified GetLastModified
+		return e.EncodeElement((*getLastModified)(glm), start)
+	}
+	s := time.Time(glm.LastModified).UTC().Format(glm.Layout)
+	return e.EncodeElement(s, start)
 }
 
 // https://tools.ietf.org/html/rfc4918#section-15.6
@@ -404,6 +483,20 @@ func (err *Error) Error() string {
 	return string(b)
 }
 
+// PropStatError is a failure to set the properties of a new collection. The
+// response body lists the status of each property, as defined in RFC 5689
+// section 3.3 for DAV:mkcol-response and RFC 4791 section 5.3.1.2 for
+// CALDAV:mkcalendar-response.
+type PropStatError struct {
+	XMLName   xml.Name
+	PropStats []PropStat `xml:"propstat"`
+}
+
+func (err *PropStatError) Error() string {
+	b, _ := xml.Marshal(err)
+	return string(b)
+}
+
 // https://tools.ietf.org/html/rfc4918#section-15.2
 type DisplayName struct {
 	XMLName xml.Name `xml:"DAV: displayname"`
@@ -445,6 +538,20 @@ type SyncCollectionQuery struct {
 	Prop      *Prop    `xml:"prop"`
 }
 
+// https://tools.ietf.org/html/rfc6578#section-4
+type SyncToken struct {
+	XMLName xml.Name `xml:"DAV: sync-token"`
+	Token   string   `xml:",chardata"`
+}
+
+var GetCTagName = xml.Name{"http://calendarserver.org/ns/", "getctag"}
+
+// https://github.com/apple/ccs-calendarserver/blob/master/doc/Extensions/caldav-ctag.txt
+type GetCTag struct {
+	XMLName xml.Name `xml:"http://calendarserver.org/ns/ getctag"`
+	CTag    string   `xml:",chardata"`
+}
+
 // https://tools.ietf.org/html/rfc5323#section-5.17
 type Limit struct {
 	XMLName  xml.Name `xml:"DAV: limit"`
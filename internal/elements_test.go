@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"encoding/xml"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -63,3 +64,249 @@ func TestTimeRoundTrip(t *testing.T) {
 		t.Fatalf("invalid round-trip:\ngot= %s\nwant=%s", got, want)
 	}
 }
+
+func TestHref_UnmarshalText(t *testing.T) {
+	for s, want := range map[string]string{
+		"/d%C3%A9j%C3%A0%20vu.txt": "/déjà vu.txt",
+		"/déjà vu.txt":             "/déjà vu.txt",
+		"/100%.txt":                "/100%.txt",
+		"/100%25.txt":              "/100%.txt",
+		"http://example.org/a%":    "/a%",
+	} {
+		var href Href
+		if err := href.UnmarshalText([]byte(s)); err != nil {
+			t.Errorf("UnmarshalText(%q) = %v", s, err)
+		} else if href.Path != want {
+			t.Errorf("UnmarshalText(%q).Path = %q, want %q", s, href.Path, want)
+		}
+	}
+}
+
+func TestTime_UnmarshalText(t *testing.T) {
+	want := time.Date(2020, 4, 2, 13, 4, 5, 0, time.UTC)
+	for _, s := range []string{
+		"Thu, 02 Apr 2020 13:04:05 GMT",
+		"2020-04-02T13:04:05Z",
+		"2020-04-02T15:04:05+02:00",
+		"2020-04-02T13:04:05.000Z",
+	} {
+		var got Time
+		if err := got.UnmarshalText([]byte(s)); err != nil {
+			t.Errorf("UnmarshalText(%q) = %v", s, err)
+		} else if tt := time.Time(got); !tt.Equal(want) || tt.Location() != time.UTC {
+			t.Errorf("UnmarshalText(%q) = %v, want %v", s, tt, want)
+		}
+	}
+}
+
+func TestGetLastModified_layout(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	lastModified := Time(time.Date(2020, 4, 2, 15, 4, 5, 0, loc))
+
+	for _, tc := range []struct {
+		layout, want string
+	}{
+		{"", `<getlastmodified xmlns="DAV:">Thu, 02 Apr 2020 13:04:05 GMT</getlastmodified>`},
+		{time.RFC3339, `<getlastmodified xmlns="DAV:">2020-04-02T13:04:05Z</getlastmodified>`},
+	} {
+		b, err := xml.Marshal(&GetLastModified{LastModified: lastModified, Layout: tc.layout})
+		if err != nil {
+			t.Fatalf("xml.Marshal() = %v", err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("xml.Marshal() with layout %q = %s, want %s", tc.layout, b, tc.want)
+		}
+	}
+}
+
+// https://tools.ietf.org/html/rfc6578#section-3.6
+const exampleTruncatedMultistatusStr = `<?xml version="1.0" encoding="utf-8" ?>
+<D:multistatus xmlns:D="DAV:">
+  <D:response>
+    <D:href>http://example.com/ns/home/calendars/</D:href>
+    <D:status>HTTP/1.1 507 Insufficient Storage</D:status>
+    <D:error><D:number-of-matches-within-limits/></D:error>
+  </D:response>
+  <D:sync-token>http://example.com/ns/sync/1233</D:sync-token>
+</D:multistatus>`
+
+func TestResponse_IsTruncated(t *testing.T) {
+	r := strings.NewReader(exampleTruncatedMultistatusStr)
+	var ms MultiStatus
+	if err := xml.NewDecoder(r).Decode(&ms); err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+
+	if len(ms.Responses) != 1 {
+		t.Fatalf("expected 1 <response>, got %v", len(ms.Responses))
+	}
+	if !ms.Responses[0].IsTruncated() {
+		t.Errorf("Response.IsTruncated() = false, expected true")
+	}
+	if ms.SyncToken != "http://example.com/ns/sync/1233" {
+		t.Errorf("MultiStatus.SyncToken = %q", ms.SyncToken)
+	}
+
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(NewTruncatedResponse("/ns/home/calendars/")); err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+	var resp Response
+	if err := xml.NewDecoder(&buf).Decode(&resp); err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+	if !resp.IsTruncated() {
+		t.Errorf("Response.IsTruncated() = false for NewTruncatedResponse")
+	}
+	if resp.Error == nil || len(resp.Error.Raw) != 1 {
+		t.Fatalf("expected a single error condition, got %v", resp.Error)
+	}
+	if name, _ := resp.Error.Raw[0].XMLName(); name != NumberOfMatchesWithinLimitsName {
+		t.Errorf("error condition = %v, expected %v", name, NumberOfMatchesWithinLimitsName)
+	}
+}
+
+func TestFormatSyncLevel(t *testing.T) {
+	if got, err := FormatSyncLevel(DepthInfinity); err != nil || got != "infinite" {
+		t.Errorf("FormatSyncLevel(DepthInfinity) = %q, %v, want %q", got, err, "infinite")
+	}
+	if _, err := FormatSyncLevel(DepthZero); err == nil {
+		t.Errorf("FormatSyncLevel(DepthZero) = nil, expected an error")
+	}
+}
+
+func TestSyncCollectionQuery_Page(t *testing.T) {
+	// Versions of the members of a collection, by sync token
+	states := map[string]map[string]int{
+		"":   {},
+		"t1": {"a": 1, "b": 1, "c": 1, "d": 1},
+		"t2": {"a": 1, "b": 2, "d": 1, "e": 1},
+	}
+	current := "t1"
+	changes := func(syncToken string) (string, []string, []string, error) {
+		prev, ok := states[syncToken]
+		if !ok {
+			return "", nil, nil, ErrInvalidSyncToken
+		}
+		var updated, deleted []string
+		for p, v := range states[current] {
+			if prev[p] != v {
+				updated = append(updated, p)
+			}
+		}
+		for p := range prev {
+			if _, ok := states[current][p]; !ok {
+				deleted = append(deleted, p)
+			}
+		}
+		return current, updated, deleted, nil
+	}
+
+	q := SyncCollectionQuery{Limit: &Limit{NResults: 2}}
+	page, err := q.Page(changes)
+	if err != nil {
+		t.Fatalf("Page() = %v", err)
+	} else if !page.Truncated || !reflect.DeepEqual(page.Updated, []string{"a", "b"}) || len(page.Deleted) != 0 {
+		t.Fatalf("Page() = %+v, want a and b, truncated", page)
+	}
+
+	// Changes made between two pages must not be lost
+	current = "t2"
+	q.SyncToken = page.SyncToken
+	page, err = q.Page(changes)
+	if err != nil {
+		t.Fatalf("Page() = %v", err)
+	} else if !page.Truncated || !reflect.DeepEqual(page.Updated, []string{"b", "d"}) || len(page.Deleted) != 0 {
+		t.Fatalf("Page() = %+v, want b and d, truncated", page)
+	}
+
+	q.SyncToken = page.SyncToken
+	page, err = q.Page(changes)
+	if err != nil {
+		t.Fatalf("Page() = %v", err)
+	} else if page.Truncated || page.SyncToken != "t2" || !reflect.DeepEqual(page.Updated, []string{"e"}) || len(page.Deleted) != 0 {
+		t.Fatalf("Page() = %+v, want e with token t2", page)
+	}
+
+	q = SyncCollectionQuery{SyncToken: "t1", Limit: &Limit{NResults: 3}}
+	page, err = q.Page(changes)
+	if err != nil {
+		t.Fatalf("Page() = %v", err)
+	} else if page.Truncated || !reflect.DeepEqual(page.Updated, []string{"b", "e"}) || !reflect.DeepEqual(page.Deleted, []string{"c"}) {
+		t.Errorf("Page() = %+v, want b and e updated and c deleted", page)
+	}
+}
+
+func TestFormatContentDisposition(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":       `attachment; filename="report.pdf"`,
+		`say "hi".txt`:     `attachment; filename="say \"hi\".txt"`,
+		"naïve résumé.txt": `attachment; filename="na_ve r_sum_.txt"; filename*=UTF-8''na%C3%AFve%20r%C3%A9sum%C3%A9.txt`,
+		"日本.ics":           `attachment; filename="__.ics"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.ics`,
+	} {
+		if got := FormatContentDisposition(name); got != want {
+			t.Errorf("FormatContentDisposition(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	valid := map[string]string{
+		"/":                            "/",
+		"/a/b/":                        "/a/b",
+		"/a/./b":                       "/a/b",
+		"/..foo/bar..":                 "/..foo/bar..",
+		"/déjà vu.txt":                 "/déjà vu.txt",
+		"/a\\b":                        "/a\\b",
+		"/100%.txt":                    "/100%.txt",
+		"/" + strings.Repeat("a", 255): "/" + strings.Repeat("a", 255),
+	}
+	for p, want := range valid {
+		if got, err := SanitizePath(p); err != nil {
+			t.Errorf("SanitizePath(%q) = %v", p, err)
+		} else if got != want {
+			t.Errorf("SanitizePath(%q) = %q, want %q", p, got, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"relative/path",
+		"/..",
+		"/a/../../etc/passwd",
+		"/a/..",
+		"/a/..\\..\\b",
+		"/a\\..",
+		"/%2e%2e/etc/passwd",
+		"/a%2F..%2F..",
+		"/a\x00b",
+		"/a%00b",
+		"/a\nb",
+		"/" + strings.Repeat("a", 256),
+		"/" + strings.Repeat("a/", 2048),
+	}
+	for _, p := range invalid {
+		if _, err := SanitizePath(p); err == nil {
+			t.Errorf("SanitizePath(%q) = nil, want error", p)
+		}
+	}
+}
+
+func TestSanitizeURLPath(t *testing.T) {
+	for p, want := range map[string]string{
+		"/":         "/",
+		"//":        "/",
+		"/a/b/":     "/a/b/",
+		"/a/./b":    "/a/b",
+		"//a//b/./": "/a/b/",
+	} {
+		if got, err := SanitizeURLPath(p); err != nil {
+			t.Errorf("SanitizeURLPath(%q) = %v", p, err)
+		} else if got != want {
+			t.Errorf("SanitizeURLPath(%q) = %q, want %q", p, got, want)
+		}
+	}
+	if _, err := SanitizeURLPath("/a/../"); err == nil {
+		t.Errorf("SanitizeURLPath(%q) = nil, want error", "/a/../")
+	}
+}
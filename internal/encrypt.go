@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// KeyProvider has the same methods as webdav.KeyProvider.
+type KeyProvider interface {
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// Encrypted data starts with a magic string, followed by the length of the
+// key ID on one byte, the key ID, the nonce and the AES-GCM ciphertext. The
+// additional data of AES-GCM binds the ciphertext to the path of the
+// resource, so that it can't be swapped with the data of another resource.
+var encryptedMagic = []byte("GWE1")
+
+// encryptedTextPrefix is prepended to base64-encoded encrypted text values.
+const encryptedTextPrefix = "$gwe1$"
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts data with the current key of a KeyProvider. The same
+// additional data must be supplied to decrypt it.
+func Encrypt(ctx context.Context, keys KeyProvider, plaintext, additionalData []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, err
+	} else if len(id) > 255 {
+		return nil, fmt.Errorf("webdav: key ID %q is too long", id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, EncryptedOverhead(id)+len(plaintext))
+	out = append(out, encryptedMagic...)
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, additionalData), nil
+}
+
+// EncryptedOverhead returns the number of bytes added by Encrypt with a key.
+func EncryptedOverhead(keyID string) int {
+	// AES-GCM uses 12-byte nonces and 16-byte tags
+	return len(encryptedMagic) + 1 + len(keyID) + 12 + 16
+}
+
+// EncryptedKeyID returns the ID of the key used to encrypt data, given the
+// first bytes of the data. ok is false if the data isn't encrypted or if
+// header is too short.
+func EncryptedKeyID(header []byte) (id string, ok bool) {
+	if !bytes.HasPrefix(header, encryptedMagic) || len(header) <= len(encryptedMagic) {
+		return "", false
+	}
+	n := int(header[len(encryptedMagic)])
+	header = header[len(encryptedMagic)+1:]
+	if len(header) < n {
+		return "", false
+	}
+	return string(header[:n]), true
+}
+
+// Decrypt decrypts data produced by Encrypt. Data which isn't encrypted is
+// returned unchanged, so that encryption can be enabled on existing storage,
+// unless rejectPlaintext is set.
+func Decrypt(ctx context.Context, keys KeyProvider, data, additionalData []byte, rejectPlaintext bool) ([]byte, error) {
+	id, ok := EncryptedKeyID(data)
+	if !ok && rejectPlaintext {
+		return nil, fmt.Errorf("webdav: data isn't encrypted")
+	} else if !ok {
+		return data, nil
+	}
+	key, err := keys.Key(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[len(encryptedMagic)+1+len(id):]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("webdav: truncated encrypted data")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: failed to decrypt data: %v", err)
+	}
+	return plaintext, nil
+}
+
+// EncryptText encrypts a text value, e.g. a vCard or iCalendar property. The
+// result only contains base64 characters and a prefix.
+func EncryptText(ctx context.Context, keys KeyProvider, s string, additionalData []byte) (string, error) {
+	b, err := Encrypt(ctx, keys, []byte(s), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return encryptedTextPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecryptText decrypts a value produced by EncryptText. Values which aren't
+// encrypted are returned unchanged, unless rejectPlaintext is set.
+func DecryptText(ctx context.Context, keys KeyProvider, s string, additionalData []byte, rejectPlaintext bool) (string, error) {
+	if !strings.HasPrefix(s, encryptedTextPrefix) && rejectPlaintext {
+		return "", fmt.Errorf("webdav: value isn't encrypted")
+	} else if !strings.HasPrefix(s, encryptedTextPrefix) {
+		return s, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, encryptedTextPrefix))
+	if err != nil {
+		return "", fmt.Errorf("webdav: malformed encrypted value: %v", err)
+	}
+	b, err = Decrypt(ctx, keys, b, additionalData, true)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
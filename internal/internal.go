@@ -2,9 +2,14 @@
 package internal
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 )
 
 // Depth indicates whether a request applies to the resource's members. It's
@@ -68,6 +73,196 @@ func FormatOverwrite(overwrite bool) string {
 	}
 }
 
+// FormatSyncLevel formats a sync-level element value, as defined in RFC 6578
+// section 6.3.
+func FormatSyncLevel(d Depth) (string, error) {
+	switch d {
+	case DepthOne:
+		return "1", nil
+	case DepthInfinity:
+		return "infinite", nil
+	}
+	return "", fmt.Errorf("webdav: invalid sync-level %v", d)
+}
+
+const (
+	maxPathLen        = 4096
+	maxPathSegmentLen = 255
+)
+
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// SanitizePath checks that a request path is safe to hand over to backends
+// and returns its cleaned form. It rejects relative paths, NUL and other
+// control characters, ".." segments (including ones hidden behind a
+// backslash or an additional level of percent-encoding) and excessively long
+// paths or segments.
+func SanitizePath(p string) (string, error) {
+	if len(p) > maxPathLen {
+		return "", HTTPErrorf(http.StatusRequestURITooLong, "webdav: path too long")
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", HTTPErrorf(http.StatusBadRequest, "webdav: expected absolute path, got %q", p)
+	}
+	for i := 0; i < len(p); i++ {
+		if c := p[i]; c < 0x20 || c == 0x7F {
+			return "", HTTPErrorf(http.StatusBadRequest, "webdav: invalid character in path")
+		}
+	}
+
+	for _, seg := range strings.Split(p, "/") {
+		if len(seg) > maxPathSegmentLen {
+			return "", HTTPErrorf(http.StatusBadRequest, "webdav: path segment too long")
+		}
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			seg = unescaped
+		}
+		if strings.ContainsRune(seg, 0) {
+			return "", HTTPErrorf(http.StatusBadRequest, "webdav: invalid character in path")
+		}
+		for _, s := range strings.FieldsFunc(seg, isPathSeparator) {
+			if s == ".." {
+				return "", HTTPErrorf(http.StatusBadRequest, "webdav: invalid path")
+			}
+		}
+	}
+
+	return path.Clean(p), nil
+}
+
+// SanitizeURLPath is like SanitizePath, but preserves the trailing slash of
+// collection paths.
+func SanitizeURLPath(p string) (string, error) {
+	clean, err := SanitizePath(p)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean, nil
+}
+
+// SanitizeRequest checks the path of a request with SanitizeURLPath. It
+// returns a shallow copy of the request with the sanitized path.
+func SanitizeRequest(r *http.Request) (*http.Request, error) {
+	p, err := SanitizeURLPath(r.URL.Path)
+	if err != nil {
+		return nil, err
+	} else if p == r.URL.Path {
+		return r, nil
+	}
+	u := *r.URL
+	u.Path, u.RawPath = p, ""
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	return r2, nil
+}
+
+// PreferDryRun is the preference token used by clients to ask the server to
+// validate a request without applying it.
+const PreferDryRun = "dry-run"
+
+// PreferReturnRepresentation is the preference used by clients to ask the
+// server to include the resulting representation in the response, as defined
+// in RFC 7240 section 4.2.
+const PreferReturnRepresentation = "return=representation"
+
+// preference returns the value of a preference in a Prefer header.
+func preference(h http.Header, name string) (value string, ok bool) {
+	for _, v := range h["Prefer"] {
+		for _, pref := range strings.Split(v, ",") {
+			// Strip the preference parameters, if any
+			if i := strings.IndexByte(pref, ';'); i >= 0 {
+				pref = pref[:i]
+			}
+			k := pref
+			value = ""
+			if i := strings.IndexByte(pref, '='); i >= 0 {
+				k, value = pref[:i], strings.Trim(strings.TrimSpace(pref[i+1:]), `"`)
+			}
+			if strings.EqualFold(strings.TrimSpace(k), name) {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// IsDryRun reports whether the request headers contain a "Prefer: dry-run"
+// preference.
+func IsDryRun(h http.Header) bool {
+	_, ok := preference(h, PreferDryRun)
+	return ok
+}
+
+// IsReturnRepresentation reports whether the request headers contain a
+// "Prefer: return=representation" preference.
+func IsReturnRepresentation(h http.Header) bool {
+	v, ok := preference(h, "return")
+	return ok && strings.EqualFold(v, "representation")
+}
+
+// NewUUID generates a random UUID, as defined in RFC 4122 section 4.4.
+func NewUUID() (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// isAttrChar reports whether c is an attr-char, as defined in RFC 5987
+// section 3.2.1.
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// FormatContentDisposition formats an attachment Content-Disposition header
+// suggesting the given file name, as defined in RFC 6266. Non-ASCII file
+// names are sent in an UTF-8 ext-value, along with an ASCII fallback.
+func FormatContentDisposition(name string) string {
+	var fallback, ext strings.Builder
+	needsExt := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 0x80 || c < 0x20 || c == 0x7F:
+			needsExt = true
+			// Only output one replacement character per UTF-8 sequence
+			if c < 0x80 || c >= 0xC0 {
+				fallback.WriteByte('_')
+			}
+		case c == '"' || c == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteByte(c)
+		default:
+			fallback.WriteByte(c)
+		}
+
+		if isAttrChar(c) {
+			ext.WriteByte(c)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", c)
+		}
+	}
+
+	s := `attachment; filename="` + fallback.String() + `"`
+	if needsExt {
+		s += "; filename*=UTF-8''" + ext.String()
+	}
+	return s
+}
+
 type HTTPError struct {
 	Code int
 	Err  error
@@ -1,14 +1,26 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"mime"
 	"net/http"
 	"net/url"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 func ServeError(w http.ResponseWriter, err error) {
@@ -24,17 +36,165 @@ func ServeError(w http.ResponseWriter, err error) {
 		ServeXML(w).Encode(errElt)
 		return
 	}
+	var propStatErr *PropStatError
+	if errors.As(err, &propStatErr) {
+		w.WriteHeader(code)
+		ServeXML(w).Encode(propStatErr)
+		return
+	}
 
 	http.Error(w, err.Error(), code)
 }
 
-func isContentXML(h http.Header) bool {
+// recoverResponseWriter keeps track of whether a response has been started.
+type recoverResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoverResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoverResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func newErrorID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// ServeRecover calls h and recovers from panics. A panic is logged to logger
+// (or the standard logger if nil) along with an error ID and the stack trace,
+// and a 500 Internal Server Error response carrying the error ID is sent if
+// the response hasn't been started yet.
+func ServeRecover(w http.ResponseWriter, r *http.Request, logger *log.Logger, h http.Handler) {
+	rw := &recoverResponseWriter{ResponseWriter: w}
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		} else if v == http.ErrAbortHandler {
+			panic(v)
+		}
+
+		id := newErrorID()
+
+		const size = 64 << 10
+		buf := make([]byte, size)
+		buf = buf[:runtime.Stack(buf, false)]
+		logf(logger, "webdav: panic serving %v %v (error ID %v): %v\n%s", r.Method, r.URL.Path, id, v, buf)
+
+		if rw.wroteHeader {
+			return
+		}
+
+		desc := NewRawXMLElement(ResponseDescriptionName, nil, []RawXMLValue{
+			{tok: xml.CharData("internal server error (error ID " + id + ")")},
+		})
+		ServeError(rw, &HTTPError{
+			Code: http.StatusInternalServerError,
+			Err:  &Error{Raw: []RawXMLValue{*desc}},
+		})
+	}()
+
+	h.ServeHTTP(rw, r)
+}
+
+// ErrorVerbosity controls how much error detail is sent to clients. It must
+// be kept in sync with webdav.ErrorVerbosity.
+type ErrorVerbosity int
+
+const (
+	ErrorVerbosityFull ErrorVerbosity = iota
+	ErrorVerbosityClientErrors
+	ErrorVerbosityNone
+)
+
+// ErrorReporter sends error responses. Error details hidden from clients are
+// logged along with an error ID, which is included in the response.
+type ErrorReporter struct {
+	Verbosity ErrorVerbosity
+	Logger    *log.Logger
+}
+
+func logf(logger *log.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// Logf logs a server-side error which isn't reported to the client.
+func (rep *ErrorReporter) Logf(format string, v ...interface{}) {
+	var logger *log.Logger
+	if rep != nil {
+		logger = rep.Logger
+	}
+	logf(logger, format, v...)
+}
+
+// ServeError sends an error response. A nil ErrorReporter sends full error
+// details without logging them.
+func (rep *ErrorReporter) ServeError(w http.ResponseWriter, r *http.Request, err error) {
+	if rep == nil {
+		ServeError(w, err)
+		return
+	}
+
+	code := http.StatusInternalServerError
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		code = httpErr.Code
+	}
+
+	var hide bool
+	switch rep.Verbosity {
+	case ErrorVerbosityClientErrors:
+		hide = code/100 != 4
+	case ErrorVerbosityNone:
+		hide = true
+	}
+
+	// DAV:error elements and property statuses are part of the protocol and
+	// don't leak details
+	var errElt *Error
+	var propStatErr *PropStatError
+	if !hide || errors.As(err, &errElt) || errors.As(err, &propStatErr) {
+		if code/100 == 5 {
+			logf(rep.Logger, "webdav: error serving %v %v: %v", r.Method, r.URL.Path, err)
+		}
+		ServeError(w, err)
+		return
+	}
+
+	id := newErrorID()
+	logf(rep.Logger, "webdav: error serving %v %v (error ID %v): %v", r.Method, r.URL.Path, id, err)
+	http.Error(w, fmt.Sprintf("%v (error ID %v)", http.StatusText(code), id), code)
+}
+
+// IsContentXML checks whether a request or response body is XML.
+func IsContentXML(h http.Header) bool {
 	t, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
 	return t == "application/xml" || t == "text/xml"
 }
 
 func DecodeXMLRequest(r *http.Request, v interface{}) error {
-	if !isContentXML(r.Header) {
+	if !IsContentXML(r.Header) {
 		return HTTPErrorf(http.StatusBadRequest, "webdav: expected application/xml request")
 	}
 
@@ -44,6 +204,40 @@ func DecodeXMLRequest(r *http.Request, v interface{}) error {
 	return nil
 }
 
+// ErrBodyTooLarge is returned by ReadBody when a request body exceeds the
+// maximum size.
+var ErrBodyTooLarge = errors.New("webdav: request body too large")
+
+// ReadBody reads a request body of at most maxSize bytes. A zero maxSize
+// means no limit. The Content-Length is checked before reading, so that
+// clients sending "Expect: 100-continue" don't upload a body which would be
+// rejected.
+func ReadBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	if r.ContentLength > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
+
+// ServeRawObject writes the raw payload of a resource and its metadata.
+func ServeRawObject(w http.ResponseWriter, r *http.Request, contentType, etag string, modTime time.Time, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if etag != "" {
+		w.Header().Set("ETag", ETag(etag).String())
+	}
+	// http.ServeContent handles byte ranges and sets Last-Modified
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
+
 func ServeXML(w http.ResponseWriter) *xml.Encoder {
 	w.Header().Add("Content-Type", "text/xml; charset=\"utf-8\"")
 	w.Write([]byte(xml.Header))
@@ -51,25 +245,223 @@ func ServeXML(w http.ResponseWriter) *xml.Encoder {
 }
 
 func ServeMultiStatus(w http.ResponseWriter, ms *MultiStatus) error {
-	// TODO: streaming
 	w.WriteHeader(http.StatusMultiStatus)
 	return ServeXML(w).Encode(ms)
 }
 
+// multiStatusFlushInterval is the number of responses written between two
+// flushes of a streamed multi-status response.
+const multiStatusFlushInterval = 100
+
+var multiStatusStart = xml.StartElement{Name: xml.Name{Space: "DAV:", Local: "multistatus"}}
+
+// MultiStatusWriter streams a multi-status response. The status code and the
+// opening multistatus element are written along with the first response, so
+// that errors occurring before can still be reported.
+type MultiStatusWriter struct {
+	w   http.ResponseWriter
+	enc *xml.Encoder
+	n   int
+}
+
+func NewMultiStatusWriter(w http.ResponseWriter) *MultiStatusWriter {
+	return &MultiStatusWriter{w: w}
+}
+
+// Started reports whether the response has been started, in which case the
+// status code can't be changed anymore.
+func (mw *MultiStatusWriter) Started() bool {
+	return mw.enc != nil
+}
+
+func (mw *MultiStatusWriter) start() error {
+	if mw.enc != nil {
+		return nil
+	}
+	mw.w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	mw.w.WriteHeader(http.StatusMultiStatus)
+	if _, err := mw.w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	mw.enc = xml.NewEncoder(mw.w)
+	return mw.enc.EncodeToken(multiStatusStart)
+}
+
+// WriteResponse writes a response element.
+func (mw *MultiStatusWriter) WriteResponse(resp *Response) error {
+	if err := mw.start(); err != nil {
+		return err
+	}
+	if err := mw.enc.Encode(resp); err != nil {
+		return err
+	}
+	mw.n++
+	if mw.n%multiStatusFlushInterval == 0 {
+		if f, ok := mw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// Close terminates the multi-status response.
+func (mw *MultiStatusWriter) Close() error {
+	if err := mw.start(); err != nil {
+		return err
+	}
+	if err := mw.enc.EncodeToken(multiStatusStart.End()); err != nil {
+		return err
+	}
+	return mw.enc.Flush()
+}
+
+// StreamMultiStatus writes a multi-status response containing the responses
+// passed by list to its callback. If sort is set, the responses are buffered
+// and sorted by href. Otherwise, they're streamed with a MultiStatusWriter:
+// errors returned by list once the response has been started are too late to
+// be reported to the client, so they're logged and the multi-status response
+// is left unterminated, so that clients don't mistake it for a complete one.
+func StreamMultiStatus(w http.ResponseWriter, r *http.Request, rep *ErrorReporter, sort bool, list func(fn func(resp *Response) error) error) error {
+	if sort {
+		var resps []Response
+		err := list(func(resp *Response) error {
+			resps = append(resps, *resp)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		SortResponses(resps)
+		return ServeMultiStatus(w, NewMultiStatus(resps...))
+	}
+
+	mw := NewMultiStatusWriter(w)
+	err := list(mw.WriteResponse)
+	if err != nil && mw.Started() {
+		rep.Logf("webdav: error streaming %v response for %v: %v", r.Method, r.URL.Path, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
 type Backend interface {
 	Options(r *http.Request) (caps []string, allow []string, err error)
 	HeadGet(w http.ResponseWriter, r *http.Request) error
 	PropFind(r *http.Request, pf *PropFind, depth Depth) (*MultiStatus, error)
 	PropPatch(r *http.Request, pu *PropertyUpdate) (*Response, error)
-	Put(r *http.Request) (*Href, error)
+	Put(r *http.Request) (*PutResult, error)
 	Delete(r *http.Request) error
 	Mkcol(r *http.Request) error
 	Copy(r *http.Request, dest *Href, recursive, overwrite bool) (created bool, err error)
 	Move(r *http.Request, dest *Href, overwrite bool) (created bool, err error)
 }
 
+// PutResult is the outcome of a successful PUT request.
+type PutResult struct {
+	// Href is the location of the stored resource, if it differs from the
+	// request URL.
+	Href *Href
+	// ETag is the ETag of the stored resource. It must be left empty if the
+	// stored representation differs from the request body, e.g. because the
+	// backend has transformed it (RFC 7231 section 4.3.4).
+	ETag string
+}
+
+// PropFindStreamer is an optional interface which can be implemented by a
+// Backend to stream PROPFIND responses instead of building them in memory.
+type PropFindStreamer interface {
+	// PropFindStream is like Backend.PropFind, but calls fn for each
+	// response. Errors returned by fn must be returned as is.
+	PropFindStream(r *http.Request, pf *PropFind, depth Depth, fn func(resp *Response) error) error
+}
+
+// PatchBackend is an optional interface which can be implemented by a Backend
+// to support PATCH requests.
+type PatchBackend interface {
+	// Patch applies a PATCH request. The response is written by the caller,
+	// but the backend may set headers.
+	Patch(w http.ResponseWriter, r *http.Request) (*PutResult, error)
+}
+
+// DryRunBackend is an optional interface which can be implemented by a
+// Backend able to validate PUT requests without applying them. Without it, or
+// if SupportsDryRun returns false, the "Prefer: dry-run" preference is ignored
+// and the request is processed as usual.
+type DryRunBackend interface {
+	SupportsDryRun(r *http.Request) bool
+}
+
+// IdempotentPut is the outcome of a PUT request carrying an Idempotency-Key
+// header.
+type IdempotentPut struct {
+	// RequestHash identifies the target and the payload of the request.
+	RequestHash string
+	// StatusCode is the status code of the response. Zero means that the
+	// request is still in progress.
+	StatusCode int
+	// Location is the Location header of the response, if any.
+	Location string
+	// ETag is the ETag header of the response, if any.
+	ETag string
+}
+
+// IdempotencyStore records the outcome of PUT requests carrying an
+// Idempotency-Key header.
+type IdempotencyStore interface {
+	LoadPut(ctx context.Context, path, key string) (*IdempotentPut, error)
+	StorePut(ctx context.Context, path, key string, put *IdempotentPut) error
+	DeletePut(ctx context.Context, path, key string) error
+}
+
+// hashingReadCloser hashes the request body as it's read.
+type hashingReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// hashPutRequest starts hashing the target and the payload of a PUT or PATCH
+// request. The hash is complete once the request body has been read.
+func hashPutRequest(r *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, r.URL.Path+"\x00")
+	if r.Method != http.MethodPut {
+		// Keep the hash of PUT requests stable
+		io.WriteString(h, r.Method+"\x00"+r.Header.Get("Content-Range")+"\x00")
+	}
+	r.Body = hashingReadCloser{io.TeeReader(r.Body, h), r.Body}
+	return h
+}
+
+// sumPutRequest reads the rest of the request body and returns the hash
+// started by hashPutRequest.
+func sumPutRequest(r *http.Request, h hash.Hash) (string, error) {
+	if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AuditEvent describes a successful mutating request. It must be kept in sync
+// with webdav.AuditEvent.
+type AuditEvent struct {
+	Method      string
+	Principal   string
+	Path        string
+	Destination string
+	ETagBefore  string
+	ETagAfter   string
+}
+
 type Handler struct {
-	Backend Backend
+	Backend          Backend
+	IdempotencyStore IdempotencyStore
+	Audit            func(ctx context.Context, event *AuditEvent)
+	ErrorReporter    *ErrorReporter
+	// SortResponses sorts PROPFIND responses by href. Streamed responses
+	// are buffered.
+	SortResponses bool
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -83,21 +475,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case http.MethodGet, http.MethodHead:
 			err = h.Backend.HeadGet(w, r)
 		case http.MethodPut:
-			var href *Href
-			href, err = h.Backend.Put(r)
-			if err == nil {
-				// TODO: Last-Modified, ETag, Content-Type if the request has
-				// been copied verbatim
-				if href != nil {
-					w.Header().Set("Location", (*url.URL)(href).String())
-				}
-				// TODO: http.StatusNoContent if the resource already existed
-				w.WriteHeader(http.StatusCreated)
+			err = h.handlePut(w, r)
+		case http.MethodPatch:
+			if pb, ok := h.Backend.(PatchBackend); ok {
+				err = h.handlePatch(w, r, pb)
+			} else {
+				err = HTTPErrorf(http.StatusMethodNotAllowed, "webdav: unsupported method")
 			}
 		case http.MethodDelete:
+			if err = h.checkPreconditions(r); err != nil {
+				break
+			}
+			before := h.auditETag(r, r.URL.Path)
 			// TODO: send a multistatus in case of partial failure
 			err = h.Backend.Delete(r)
 			if err == nil {
+				h.audit(r, "", before, "")
 				w.WriteHeader(http.StatusNoContent)
 			}
 		case "PROPFIND":
@@ -107,6 +500,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "MKCOL":
 			err = h.Backend.Mkcol(r)
 			if err == nil {
+				h.audit(r, "", "", r.URL.Path)
 				w.WriteHeader(http.StatusCreated)
 			}
 		case "COPY", "MOVE":
@@ -117,7 +511,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		ServeError(w, err)
+		h.ErrorReporter.ServeError(w, r, err)
 	}
 }
 
@@ -134,10 +528,255 @@ func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) error {
+	dryRun := false
+	if drb, ok := h.Backend.(DryRunBackend); ok && IsDryRun(r.Header) {
+		dryRun = drb.SupportsDryRun(r)
+	}
+
+	var idem *idempotentRequest
+	if !dryRun {
+		var replayed bool
+		var err error
+		idem, replayed, err = h.beginIdempotent(w, r)
+		if err != nil || replayed {
+			return err
+		}
+		defer idem.cancel()
+	}
+
+	// Preconditions must be checked before the body is read: net/http only
+	// sends a 100 Continue response when the handler starts reading it, so
+	// clients waiting for it don't upload the body of rejected requests
+	if err := h.checkPreconditions(r); err != nil {
+		return err
+	}
+
+	if dryRun {
+		if _, err := h.Backend.Put(r); err != nil {
+			return err
+		}
+		w.Header().Set("Preference-Applied", PreferDryRun)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	before := h.auditETag(r, r.URL.Path)
+	res, err := h.Backend.Put(r)
+	if err != nil {
+		return err
+	} else if res == nil {
+		res = &PutResult{}
+	}
+
+	var loc string
+	afterPath := r.URL.Path
+	if res.Href != nil {
+		loc = (*url.URL)(res.Href).String()
+		afterPath = res.Href.Path
+	}
+	h.audit(r, "", before, afterPath)
+
+	// TODO: http.StatusNoContent if the resource already existed
+	status := http.StatusCreated
+	idem.finish(status, loc, res.ETag)
+
+	// The backend leaves the ETag empty if it has transformed the request
+	// body: clients would otherwise assume they hold the stored representation
+	if res.ETag != "" {
+		w.Header().Set("ETag", ETag(res.ETag).String())
+	}
+	// TODO: Last-Modified, Content-Type if the request has been copied
+	// verbatim
+	if loc != "" {
+		w.Header().Set("Location", loc)
+	}
+	if IsReturnRepresentation(r.Header) {
+		return h.servePutRepresentation(w, r, afterPath)
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+func (h *Handler) handlePatch(w http.ResponseWriter, r *http.Request, pb PatchBackend) error {
+	idem, replayed, err := h.beginIdempotent(w, r)
+	if err != nil || replayed {
+		return err
+	}
+	defer idem.cancel()
+
+	if err := h.checkPreconditions(r); err != nil {
+		return err
+	}
+
+	before := h.auditETag(r, r.URL.Path)
+	res, err := pb.Patch(w, r)
+	if err != nil {
+		return err
+	} else if res == nil {
+		res = &PutResult{}
+	}
+	h.audit(r, "", before, r.URL.Path)
+
+	status := http.StatusNoContent
+	idem.finish(status, "", res.ETag)
+
+	if res.ETag != "" {
+		w.Header().Set("ETag", ETag(res.ETag).String())
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// idempotencyMu serializes the reservation of idempotency keys.
+var idempotencyMu sync.Mutex
+
+// idempotentRequest is a request carrying an Idempotency-Key header, whose key
+// has been reserved. A nil *idempotentRequest is a no-op.
+type idempotentRequest struct {
+	h    *Handler
+	r    *http.Request
+	key  string
+	hash hash.Hash
+	done bool
+}
+
+// beginIdempotent replays the response to a previous request carrying the
+// same Idempotency-Key header, if any. Otherwise, the key is reserved until
+// the request is finished or cancelled, so that concurrent retries are
+// rejected instead of being applied twice.
+//
+// Keys are namespaced by the current user principal, so that users can't
+// replay the responses of others.
+func (h *Handler) beginIdempotent(w http.ResponseWriter, r *http.Request) (idem *idempotentRequest, replayed bool, err error) {
+	key := r.Header.Get("Idempotency-Key")
+	if h.IdempotencyStore == nil || key == "" {
+		return nil, false, nil
+	}
+	// Header values can't contain line breaks, so the key can't be forged
+	key = h.principal(r) + "\n" + key
+
+	ctx := r.Context()
+	idempotencyMu.Lock()
+	put, err := h.IdempotencyStore.LoadPut(ctx, r.URL.Path, key)
+	if err == nil && put == nil {
+		err = h.IdempotencyStore.StorePut(ctx, r.URL.Path, key, &IdempotentPut{})
+	}
+	idempotencyMu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	reqHash := hashPutRequest(r)
+	if put == nil {
+		return &idempotentRequest{h: h, r: r, key: key, hash: reqHash}, false, nil
+	} else if put.StatusCode == 0 {
+		return nil, false, HTTPErrorf(http.StatusConflict, "webdav: a request with this idempotency key is in progress")
+	}
+
+	sum, err := sumPutRequest(r, reqHash)
+	if err != nil {
+		return nil, false, err
+	} else if sum != put.RequestHash {
+		return nil, false, HTTPErrorf(http.StatusUnprocessableEntity, "webdav: idempotency key reused for a different request")
+	}
+	// The original request has already been applied, replay its response
+	if put.Location != "" {
+		w.Header().Set("Location", put.Location)
+	}
+	if put.ETag != "" {
+		w.Header().Set("ETag", ETag(put.ETag).String())
+	}
+	w.WriteHeader(put.StatusCode)
+	return nil, true, nil
+}
+
+// finish records the response to a successful request. The request has
+// already been applied, so failures are logged instead of being reported to
+// the client.
+func (idem *idempotentRequest) finish(status int, loc, etag string) {
+	if idem == nil {
+		return
+	}
+	idem.done = true
+
+	sum, err := sumPutRequest(idem.r, idem.hash)
+	if err == nil {
+		put := &IdempotentPut{RequestHash: sum, StatusCode: status, Location: loc, ETag: etag}
+		err = idem.h.IdempotencyStore.StorePut(idem.r.Context(), idem.r.URL.Path, idem.key, put)
+	}
+	if err != nil {
+		idem.h.ErrorReporter.Logf("webdav: failed to record the outcome of %v %v: %v", idem.r.Method, idem.r.URL.Path, err)
+	}
+}
+
+// cancel releases the key of a failed request, so that it can be retried. It
+// is a no-op if the request has been finished.
+func (idem *idempotentRequest) cancel() {
+	if idem == nil || idem.done {
+		return
+	}
+	idem.done = true
+	if err := idem.h.IdempotencyStore.DeletePut(idem.r.Context(), idem.r.URL.Path, idem.key); err != nil {
+		idem.h.ErrorReporter.Logf("webdav: failed to release idempotency key of %v %v: %v", idem.r.Method, idem.r.URL.Path, err)
+	}
+}
+
+// servePutRepresentation replies to a PUT request with the stored
+// representation of the resource at the given path, which may differ from the
+// request body.
+func (h *Handler) servePutRepresentation(w http.ResponseWriter, r *http.Request, p string) error {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL.Path = p
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	for _, k := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+		req.Header.Del(k)
+	}
+
+	w.Header().Set("Preference-Applied", PreferReturnRepresentation)
+	cw := &createdResponseWriter{ResponseWriter: w}
+	if err := h.Backend.HeadGet(cw, req); err != nil && !cw.wroteHeader {
+		// The resource has been stored, but can't be retrieved
+		w.Header().Del("Preference-Applied")
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// createdResponseWriter replaces the 200 OK status with 201 Created.
+type createdResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *createdResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK {
+		code = http.StatusCreated
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *createdResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
 func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) error {
 	var propfind PropFind
-	if isContentXML(r.Header) {
-		if err := DecodeXMLRequest(r, &propfind); err != nil {
+	if IsContentXML(r.Header) {
+		if err := DecodeXMLRequest(r, &propfind); errors.Is(err, io.EOF) {
+			// RFC 4918 section 9.1: an empty body must be treated as an
+			// allprop request
+			propfind.AllProp = &struct{}{}
+		} else if err != nil {
 			return err
 		}
 	} else {
@@ -157,16 +796,41 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	if streamer, ok := h.Backend.(PropFindStreamer); ok {
+		return StreamMultiStatus(w, r, h.ErrorReporter, h.SortResponses, func(fn func(resp *Response) error) error {
+			return streamer.PropFindStream(r, &propfind, depth, fn)
+		})
+	}
+
 	ms, err := h.Backend.PropFind(r, &propfind, depth)
 	if err != nil {
 		return err
 	}
+	if h.SortResponses {
+		SortResponses(ms.Responses)
+	}
 
 	return ServeMultiStatus(w, ms)
 }
 
 type PropFindFunc func(raw *RawXMLValue) (interface{}, error)
 
+// sortedPropNames returns the names of props in a stable order, so that
+// allprop and propname responses are deterministic.
+func sortedPropNames(props map[xml.Name]PropFindFunc) []xml.Name {
+	names := make([]xml.Name, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Space != names[j].Space {
+			return names[i].Space < names[j].Space
+		}
+		return names[i].Local < names[j].Local
+	})
+	return names
+}
+
 func NewPropFindResponse(path string, propfind *PropFind, props map[xml.Name]PropFindFunc) (*Response, error) {
 	resp := NewOKResponse(path)
 
@@ -177,7 +841,7 @@ func NewPropFindResponse(path string, propfind *PropFind, props map[xml.Name]Pro
 	}
 
 	if propfind.PropName != nil {
-		for xmlName, _ := range props {
+		for _, xmlName := range sortedPropNames(props) {
 			emptyVal := NewRawXMLElement(xmlName, nil, nil)
 			if err := resp.EncodeProp(http.StatusOK, emptyVal); err != nil {
 				return nil, err
@@ -185,7 +849,8 @@ func NewPropFindResponse(path string, propfind *PropFind, props map[xml.Name]Pro
 		}
 	} else if propfind.AllProp != nil {
 		// TODO: add support for propfind.Include
-		for xmlName, f := range props {
+		for _, xmlName := range sortedPropNames(props) {
+			f := props[xmlName]
 			emptyVal := NewRawXMLElement(xmlName, nil, nil)
 
 			val, err := f(emptyVal)
@@ -236,38 +901,204 @@ func NewPropFindResponse(path string, propfind *PropFind, props map[xml.Name]Pro
 	return resp, nil
 }
 
+// DeadPropertyStore stores properties set by clients with PROPPATCH. Values
+// are stored as inner XML.
+type DeadPropertyStore interface {
+	GetDeadProperties(ctx context.Context, path string) (map[xml.Name]string, error)
+	SetDeadProperties(ctx context.Context, path string, props map[xml.Name]string) error
+	RemoveDeadProperties(ctx context.Context, path string, names []xml.Name) error
+}
+
+type deadProp struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+// DeadPropValue returns the inner XML of a property sent by a client.
+func DeadPropValue(raw *RawXMLValue) (string, error) {
+	b, err := xml.Marshal(raw)
+	if err != nil {
+		return "", err
+	}
+	var prop deadProp
+	if err := xml.Unmarshal(b, &prop); err != nil {
+		return "", err
+	}
+	return prop.Inner, nil
+}
+
+// AddDeadProps adds the dead properties of a resource to props. Live
+// properties, as reported by isLive, take precedence. Dead properties override
+// the other entries of props, e.g. a display name derived from backend
+// metadata which has been changed with PROPPATCH.
+func AddDeadProps(ctx context.Context, props map[xml.Name]PropFindFunc, store DeadPropertyStore, path string, isLive func(name xml.Name) bool) error {
+	dead, err := store.GetDeadProperties(ctx, path)
+	if err != nil {
+		return err
+	}
+	for name, inner := range dead {
+		if _, ok := props[name]; ok && isLive(name) {
+			continue
+		}
+		prop := &deadProp{XMLName: name, Inner: inner}
+		props[name] = func(*RawXMLValue) (interface{}, error) {
+			return prop, nil
+		}
+	}
+	return nil
+}
+
+// PropFindHasOnly checks whether a PROPFIND request only asks for properties
+// in props, in which case looking up other properties can be skipped.
+func PropFindHasOnly(propfind *PropFind, props map[xml.Name]PropFindFunc) bool {
+	if propfind.Prop == nil || propfind.AllProp != nil || propfind.PropName != nil {
+		return false
+	}
+	for _, raw := range propfind.Prop.Raw {
+		name, ok := raw.XMLName()
+		if !ok {
+			continue
+		}
+		if _, ok := props[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPropPatchResponse creates a response to a PROPPATCH request. Properties
+// missing from failed are reported as successfully updated. If any update
+// failed, the others are reported as failed dependencies, since PROPPATCH
+// requests are atomic.
+func NewPropPatchResponse(path string, names []xml.Name, failed map[xml.Name]int) (*Response, error) {
+	code := http.StatusOK
+	if len(failed) > 0 {
+		code = http.StatusFailedDependency
+	}
+
+	resp := NewOKResponse(path)
+	for _, name := range names {
+		c := code
+		if failedCode, ok := failed[name]; ok {
+			c = failedCode
+		}
+		if err := resp.EncodeProp(c, NewRawXMLElement(name, nil, nil)); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// PatchDeadProperties handles a PROPPATCH request by updating dead
+// properties. Live properties can't be modified.
+func PatchDeadProperties(ctx context.Context, store DeadPropertyStore, path string, update *PropertyUpdate, isLive func(name xml.Name) bool) (*Response, error) {
+	var names []xml.Name
+	failed := make(map[xml.Name]int)
+
+	set := make(map[xml.Name]string)
+	for _, s := range update.Set {
+		for i := range s.Prop.Raw {
+			raw := &s.Prop.Raw[i]
+			name, ok := raw.XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+			if isLive(name) {
+				failed[name] = http.StatusForbidden
+				continue
+			}
+			v, err := DeadPropValue(raw)
+			if err != nil {
+				failed[name] = http.StatusBadRequest
+				continue
+			}
+			set[name] = v
+		}
+	}
+
+	var remove []xml.Name
+	for _, rm := range update.Remove {
+		for i := range rm.Prop.Raw {
+			name, ok := rm.Prop.Raw[i].XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+			if isLive(name) {
+				failed[name] = http.StatusForbidden
+				continue
+			}
+			remove = append(remove, name)
+		}
+	}
+
+	if len(failed) == 0 {
+		if err := UpdateDeadProperties(ctx, store, path, set, remove); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewPropPatchResponse(path, names, failed)
+}
+
+// UpdateDeadProperties sets and removes dead properties.
+func UpdateDeadProperties(ctx context.Context, store DeadPropertyStore, path string, set map[xml.Name]string, remove []xml.Name) error {
+	if len(set) > 0 {
+		if err := store.SetDeadProperties(ctx, path, set); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		if err := store.RemoveDeadProperties(ctx, path, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) error {
 	var update PropertyUpdate
 	if err := DecodeXMLRequest(r, &update); err != nil {
 		return err
 	}
 
+	before := h.auditETag(r, r.URL.Path)
 	resp, err := h.Backend.PropPatch(r, &update)
 	if err != nil {
 		return err
 	}
+	h.audit(r, "", before, r.URL.Path)
 
 	ms := NewMultiStatus(*resp)
 	return ServeMultiStatus(w, ms)
 }
 
-func parseDestination(h http.Header) (*Href, error) {
-	destHref := h.Get("Destination")
+func parseDestination(r *http.Request) (*Href, error) {
+	destHref := r.Header.Get("Destination")
 	if destHref == "" {
-		return nil, HTTPErrorf(http.StatusBadRequest, "webdav: missing Destination header in MOVE request")
+		return nil, HTTPErrorf(http.StatusBadRequest, "webdav: missing Destination header in %v request", r.Method)
 	}
-	dest, err := url.Parse(destHref)
+	dest, err := ParseURL(destHref)
 	if err != nil {
-		return nil, HTTPErrorf(http.StatusBadRequest, "webdav: marlformed Destination header in MOVE request: %v", err)
+		return nil, HTTPErrorf(http.StatusBadRequest, "webdav: malformed Destination header in %v request: %v", r.Method, err)
 	}
+	p, err := SanitizeURLPath(dest.Path)
+	if err != nil {
+		return nil, err
+	}
+	dest.Path, dest.RawPath = p, ""
 	return (*Href)(dest), nil
 }
 
 func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) error {
-	dest, err := parseDestination(r.Header)
+	dest, err := parseDestination(r)
 	if err != nil {
 		return err
 	}
+	if strings.TrimSuffix(dest.Path, "/") == strings.TrimSuffix(r.URL.Path, "/") {
+		return HTTPErrorf(http.StatusForbidden, "webdav: source and destination of %v request are the same", r.Method)
+	}
 
 	overwrite := true
 	if s := r.Header.Get("Overwrite"); s != "" {
@@ -285,6 +1116,8 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	before := h.auditETag(r, r.URL.Path)
+
 	var created bool
 	if r.Method == "COPY" {
 		var recursive bool
@@ -307,6 +1140,7 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	h.audit(r, dest.Path, before, dest.Path)
 
 	if created {
 		w.WriteHeader(http.StatusCreated)
@@ -315,3 +1149,300 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) error {
 	}
 	return nil
 }
+
+// auditETag returns the ETag of the resource at the given path, if any. It
+// returns an empty string if auditing is disabled.
+func (h *Handler) auditETag(r *http.Request, p string) string {
+	if h.Audit == nil {
+		return ""
+	}
+	return h.etag(r, p)
+}
+
+// etag returns the ETag of the resource at the given path, if any.
+func (h *Handler) etag(r *http.Request, p string) string {
+	etag, _, _ := h.currentETag(r, p)
+	return etag
+}
+
+// currentETag returns the ETag of the resource at the given path and whether
+// the resource exists. The ETag is empty if the resource doesn't have one.
+func (h *Handler) currentETag(r *http.Request, p string) (etag string, exists bool, err error) {
+	req := r.Clone(r.Context())
+	req.URL.Path = p
+	ms, err := h.Backend.PropFind(req, NewPropNamePropFind(GetETagName), DepthZero)
+	if IsNotFound(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	} else if len(ms.Responses) == 0 {
+		return "", false, nil
+	}
+
+	// Responses built by backends can only be marshalled, round-trip them
+	// through XML to decode the property
+	b, err := xml.Marshal(&ms.Responses[0])
+	if err != nil {
+		return "", true, err
+	}
+	var resp Response
+	if err := xml.Unmarshal(b, &resp); err != nil {
+		return "", true, err
+	}
+
+	var getETag GetETag
+	if err := resp.DecodeProp(&getETag); err != nil {
+		return "", true, nil
+	}
+	return string(getETag.ETag), true, nil
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers of a
+// request modifying the resource at the request path, as defined in RFC 7232
+// sections 3.1 and 3.2. This prevents lost updates when resources are changed
+// concurrently.
+func (h *Handler) checkPreconditions(r *http.Request) error {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+
+	etag, exists, err := h.currentETag(r, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && (!exists || !MatchETag(ifMatch, etag, false)) {
+		return HTTPErrorf(http.StatusPreconditionFailed, "webdav: If-Match precondition failed")
+	}
+	if ifNoneMatch != "" && exists && MatchETag(ifNoneMatch, etag, true) {
+		return HTTPErrorf(http.StatusPreconditionFailed, "webdav: If-None-Match precondition failed")
+	}
+	return nil
+}
+
+// MatchETag reports whether an If-Match or If-None-Match header value matches
+// the ETag of an existing resource. Weak entity tags only match if weak is
+// set.
+func MatchETag(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, s := range strings.Split(header, ",") {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "W/") {
+			if !weak {
+				continue
+			}
+			s = strings.TrimPrefix(s, "W/")
+		}
+		var e ETag
+		if err := e.UnmarshalText([]byte(s)); err == nil && string(e) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// audit reports a successful mutating request. afterPath is the path of the
+// resource whose ETag is recorded after the mutation, if any.
+// principal returns the current user principal, if the backend reports it.
+func (h *Handler) principal(r *http.Request) string {
+	pb, ok := h.Backend.(interface {
+		CurrentUserPrincipal(ctx context.Context) (string, error)
+	})
+	if !ok {
+		return ""
+	}
+	principal, _ := pb.CurrentUserPrincipal(r.Context())
+	return principal
+}
+
+func (h *Handler) audit(r *http.Request, dest, before, afterPath string) {
+	if h.Audit == nil {
+		return
+	}
+
+	principal := h.principal(r)
+
+	var after string
+	if afterPath != "" {
+		after = h.auditETag(r, afterPath)
+	}
+
+	h.Audit(r.Context(), &AuditEvent{
+		Method:      r.Method,
+		Principal:   principal,
+		Path:        r.URL.Path,
+		Destination: dest,
+		ETagBefore:  before,
+		ETagAfter:   after,
+	})
+}
+
+func newPreconditionError(code int, name string) *HTTPError {
+	elem := NewRawXMLElement(xml.Name{Namespace, name}, nil, nil)
+	return &HTTPError{
+		Code: code,
+		Err:  &Error{Raw: []RawXMLValue{*elem}},
+	}
+}
+
+// ErrInvalidSyncToken is returned by backends when a sync token is unknown or
+// has expired, as defined in RFC 6578 section 3.2. Clients are expected to
+// perform a full synchronization.
+var ErrInvalidSyncToken error = newPreconditionError(http.StatusForbidden, "valid-sync-token")
+
+// ErrQuotaExceeded is returned when a request would exceed the storage quota,
+// as defined in RFC 4331 section 6.
+var ErrQuotaExceeded error = newPreconditionError(http.StatusInsufficientStorage, "quota-not-exceeded")
+
+// ErrPropFindFiniteDepth is returned when a server doesn't allow a PROPFIND
+// request with "Depth: infinity", as defined in RFC 4918 section 9.1.
+var ErrPropFindFiniteDepth error = newPreconditionError(http.StatusForbidden, "propfind-finite-depth")
+
+// IsRecursive reports whether the sync-collection report covers all
+// descendants of the collection, instead of its direct members only.
+func (q *SyncCollectionQuery) IsRecursive() (bool, error) {
+	switch q.SyncLevel {
+	case "1":
+		return false, nil
+	case "infinite":
+		return true, nil
+	default:
+		return false, HTTPErrorf(http.StatusBadRequest, "webdav: invalid sync-level %q", q.SyncLevel)
+	}
+}
+
+// syncPageTokenPrefix is the prefix of the intermediate sync tokens returned
+// with truncated sync-collection reports. Backends never see them.
+const syncPageTokenPrefix = "https://github.com/emersion/go-webdav/sync-page?"
+
+// SyncPage contains the changes reported by a sync-collection report.
+type SyncPage struct {
+	SyncToken string
+	// Updated and Deleted contain the paths of the added or modified members
+	// and of the removed members.
+	Updated, Deleted []string
+	// Truncated is set if changes have been left out because of the limit
+	// requested by the client. SyncToken is then an intermediate token.
+	Truncated bool
+}
+
+// SyncChangesFunc returns the current sync token of a collection along with
+// the members updated and deleted since a sync token.
+type SyncChangesFunc func(syncToken string) (token string, updated, deleted []string, err error)
+
+// Page returns the changes requested by a sync-collection report. If they
+// exceed the limit requested by the client, only the first ones by path are
+// returned along with an intermediate sync token, as described in RFC 6578
+// section 3.6. The remaining changes are returned when the client repeats the
+// report with that token.
+//
+// An intermediate token wraps the sync token of the first request, the sync
+// token of the collection when the page was built and the last path of the
+// page. Members after that path are reported relative to the first token, and
+// members up to that path relative to the snapshot, so that changes made
+// between two pages aren't lost.
+func (q *SyncCollectionQuery) Page(changes SyncChangesFunc) (*SyncPage, error) {
+	base, snapshot, after, paged := parseSyncPageToken(q.SyncToken)
+	if !paged {
+		base = q.SyncToken
+	}
+
+	token, updated, deleted, err := changes(base)
+	if err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		path    string
+		deleted bool
+	}
+	var l []change
+	seen := make(map[string]bool)
+	add := func(updated, deleted []string, include func(p string) bool) {
+		for i, paths := range [][]string{updated, deleted} {
+			for _, p := range paths {
+				if !seen[p] && include(p) {
+					seen[p] = true
+					l = append(l, change{p, i == 1})
+				}
+			}
+		}
+	}
+	add(updated, deleted, func(p string) bool { return !paged || p > after })
+	if paged && snapshot != token {
+		_, updated, deleted, err := changes(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		add(updated, deleted, func(p string) bool { return p <= after })
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].path < l[j].path
+	})
+
+	page := &SyncPage{SyncToken: token}
+	if q.Limit != nil && len(l) > int(q.Limit.NResults) {
+		if q.Limit.NResults == 0 {
+			return nil, newPreconditionError(http.StatusInsufficientStorage, NumberOfMatchesWithinLimitsName.Local)
+		}
+		l = l[:q.Limit.NResults]
+		page.Truncated = true
+		page.SyncToken = formatSyncPageToken(base, token, l[len(l)-1].path)
+	}
+	for _, c := range l {
+		if c.deleted {
+			page.Deleted = append(page.Deleted, c.path)
+		} else {
+			page.Updated = append(page.Updated, c.path)
+		}
+	}
+	return page, nil
+}
+
+func formatSyncPageToken(base, snapshot, after string) string {
+	v := url.Values{}
+	v.Set("base", base)
+	v.Set("snapshot", snapshot)
+	v.Set("after", after)
+	return syncPageTokenPrefix + v.Encode()
+}
+
+// parseSyncPageToken parses an intermediate sync token. ok is false if s
+// isn't one.
+func parseSyncPageToken(s string) (base, snapshot, after string, ok bool) {
+	if !strings.HasPrefix(s, syncPageTokenPrefix) {
+		return "", "", "", false
+	}
+	v, err := url.ParseQuery(strings.TrimPrefix(s, syncPageTokenPrefix))
+	if err != nil {
+		// Let the backend reject the token
+		return "", "", "", false
+	}
+	return v.Get("base"), v.Get("snapshot"), v.Get("after"), true
+}
+
+// ServeSyncCollection sends the response of a sync-collection report on the
+// collection at path: resps describes the added and modified members, and
+// deleted members are reported with a 404 status. A truncated response is
+// added for the collection if the page is truncated. If sorted is true,
+// responses are sorted by href.
+func ServeSyncCollection(w http.ResponseWriter, path string, page *SyncPage, resps []Response, deleted []string, sorted bool) error {
+	for _, p := range deleted {
+		resps = append(resps, *NewErrorResponse(p, &HTTPError{Code: http.StatusNotFound}))
+	}
+	if page.Truncated {
+		resps = append(resps, *NewTruncatedResponse(path))
+	}
+	if sorted {
+		SortResponses(resps)
+	}
+	ms := NewMultiStatus(resps...)
+	ms.SyncToken = page.SyncToken
+	return ServeMultiStatus(w, ms)
+}
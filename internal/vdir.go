@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Vdir helpers, for backends storing collections in the vdir layout used by
+// vdirsyncer: one directory per collection and one file per object. See
+// https://vdirsyncer.pimutils.org/en/stable/vdir.html
+
+// VdirSidecarName is the name of the file storing the collection metadata
+// which doesn't have a vdir metadata file. It's ignored by vdirsyncer, which
+// only syncs files with the collection's file extension.
+const VdirSidecarName = ".go-webdav.json"
+
+// CheckVdirName checks that name is a valid file name for a collection (if
+// ext is empty) or an object with the file extension ext.
+func CheckVdirName(name, ext string) error {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return HTTPErrorf(http.StatusForbidden, "webdav: invalid file name %q", name)
+	}
+	if ext != "" && (!strings.HasSuffix(name, ext) || name == ext) {
+		return HTTPErrorf(http.StatusForbidden, "webdav: file name %q doesn't have the %q extension", name, ext)
+	}
+	return nil
+}
+
+// VdirETag returns the ETag of an object file, derived from its contents.
+// Modification times aren't used because file systems may not record them
+// with enough precision to tell apart quick successive writes.
+func VdirETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// VdirCTag returns a collection tag which changes whenever an object file
+// with the extension ext is added, modified or removed in dir. It's derived
+// from the names and the VdirETag of the files, since sizes and modification
+// times don't tell apart quick successive writes of the same size.
+func VdirCTag(dir, ext string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || CheckVdirName(fi.Name(), ext) != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			// Removed since the directory was read
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", fi.Name(), VdirETag(data))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// VdirMayContainText reports whether the iCalendar or vCard data may contain a
+// property with the text value s. It's used to skip parsing object files which
+// can't match, e.g. when looking for a UID. Lines are unfolded and s is
+// looked for both as is and escaped.
+func VdirMayContainText(data []byte, s string) bool {
+	for _, fold := range []string{"\r\n ", "\r\n\t", "\n ", "\n\t"} {
+		data = bytes.Replace(data, []byte(fold), nil, -1)
+	}
+	escaped := vdirTextEscaper.Replace(s)
+	return bytes.Contains(data, []byte(s)) || bytes.Contains(data, []byte(escaped))
+}
+
+var vdirTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// ReadVdirMetadata reads a vdir metadata file, e.g. "displayname" or "color".
+// An empty string is returned if the file doesn't exist.
+func ReadVdirMetadata(dir, key string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, key))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// WriteVdirMetadata writes a vdir metadata file. The file is removed if the
+// value is empty.
+func WriteVdirMetadata(dir, key, value string) error {
+	p := filepath.Join(dir, key)
+	if value == "" {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return WriteFileAtomic(p, []byte(value))
+}
+
+// ReadVdirSidecar decodes the sidecar file of a collection into v. v is left
+// unchanged if the file doesn't exist.
+func ReadVdirSidecar(dir string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, VdirSidecarName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// WriteVdirSidecar encodes v into the sidecar file of a collection.
+func WriteVdirSidecar(dir string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(dir, VdirSidecarName), b)
+}
+
+// WriteFileAtomic writes a file via a temporary file in the same directory,
+// so that readers never observe partially written data.
+func WriteFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	// TempFile creates files only readable by the owner
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
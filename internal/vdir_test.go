@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestVdirMayContainText(t *testing.T) {
+	data := []byte("BEGIN:VEVENT\r\nUID:0123456789012345678901234567890123456789012345678901234567890123456789\r\n 0123456789\r\nSUMMARY:a\\, b\r\nEND:VEVENT\r\n")
+	for _, tc := range []struct {
+		s    string
+		want bool
+	}{
+		{"01234567890123456789012345678901234567890123456789012345678901234567890123456789", true},
+		{"a, b", true},
+		{"a; b", false},
+		{"other", false},
+	} {
+		if got := VdirMayContainText(data, tc.s); got != tc.want {
+			t.Errorf("VdirMayContainText(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
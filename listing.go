@@ -0,0 +1,160 @@
+package webdav
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Listing describes a collection, for browser-friendly listings.
+type Listing struct {
+	// Path is the path of the collection.
+	Path    string         `json:"path"`
+	Entries []ListingEntry `json:"entries"`
+}
+
+// ListingEntry describes a member of a collection in a Listing.
+type ListingEntry struct {
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	IsCollection bool      `json:"is_collection"`
+	Size         int64     `json:"size,omitempty"`
+	ModTime      time.Time `json:"mod_time,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+}
+
+// ListingOptions enables browser-friendly listings in response to GET
+// requests on collections, which DAV clients don't use.
+//
+// Listings are rendered as HTML, or as JSON if the client prefers it via the
+// Accept header.
+type ListingOptions struct {
+	// Template renders HTML listings. It's executed with a *Listing. If nil,
+	// a simple table is rendered.
+	Template *template.Template
+	// Sort is the sort order of entries. Collections are always listed
+	// first.
+	Sort ListingSort
+	// Reverse reverses the sort order.
+	Reverse bool
+	// Hidden, if set, reports whether an entry is omitted from listings.
+	// Hidden entries can still be accessed directly: use a VisibilityFunc to
+	// hide resources completely.
+	Hidden func(entry *ListingEntry) bool
+}
+
+// ListingSort is the sort order of listing entries.
+type ListingSort int
+
+const (
+	// ListingSortName sorts entries by name.
+	ListingSortName ListingSort = iota
+	// ListingSortModTime sorts entries by modification time, oldest first.
+	ListingSortModTime
+	// ListingSortSize sorts entries by size, smallest first.
+	ListingSortSize
+)
+
+// HideDotFiles is a ListingOptions.Hidden function hiding entries whose name
+// starts with a dot.
+func HideDotFiles(entry *ListingEntry) bool {
+	return strings.HasPrefix(path.Base(strings.TrimSuffix(entry.Path, "/")), ".")
+}
+
+var defaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Path}}</title>
+</head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>
+{{- range .Entries}}
+<tr>
+<td><a href="{{.Path}}">{{.Name}}{{if .IsCollection}}/{{end}}</a></td>
+<td>{{if not .IsCollection}}{{.Size}}{{end}}</td>
+<td>{{if not .ModTime.IsZero}}{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// ServeListing writes a listing to w. Listing entries are filtered and sorted
+// in place according to opts.
+func (opts *ListingOptions) ServeListing(w http.ResponseWriter, r *http.Request, listing *Listing) error {
+	opts.prepare(listing)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		return json.NewEncoder(w).Encode(listing)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	tmpl := opts.Template
+	if tmpl == nil {
+		tmpl = defaultListingTemplate
+	}
+	return tmpl.Execute(w, listing)
+}
+
+func (opts *ListingOptions) prepare(listing *Listing) {
+	if opts.Hidden != nil {
+		entries := listing.Entries[:0]
+		for i := range listing.Entries {
+			if !opts.Hidden(&listing.Entries[i]) {
+				entries = append(entries, listing.Entries[i])
+			}
+		}
+		listing.Entries = entries
+	}
+
+	sort.SliceStable(listing.Entries, func(i, j int) bool {
+		a, b := &listing.Entries[i], &listing.Entries[j]
+		if a.IsCollection != b.IsCollection {
+			return a.IsCollection
+		}
+		if opts.Reverse {
+			a, b = b, a
+		}
+		switch opts.Sort {
+		case ListingSortModTime:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		case ListingSortSize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// prefersJSON reports whether an Accept header value lists JSON before HTML.
+func prefersJSON(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html", "*/*":
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,517 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// Lock is a WebDAV write lock, as defined in RFC 4918 section 6.
+type Lock struct {
+	// Token is the lock token, a URI generated by the server.
+	Token string
+	// Root is the path of the locked resource.
+	Root string
+	// Recursive is true for "Depth: infinity" locks, which also apply to all
+	// descendants of Root.
+	Recursive bool
+	// Shared is true for shared locks. Other locks are exclusive.
+	Shared bool
+	// Owner is the raw XML content of the DAV:owner element supplied by the
+	// client, if any.
+	Owner string
+	// Expires is the time at which the lock expires. Zero means never.
+	Expires time.Time
+	// Principal is the principal of the user who created the lock, if known.
+	// Other users can't use, refresh or remove the lock, and its token is
+	// hidden from them.
+	Principal string
+}
+
+func (l *Lock) appliesTo(p string) bool {
+	return l.Root == p || (l.Recursive && isSubPath(p, l.Root))
+}
+
+func (l *Lock) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// heldBy reports whether the user with the given principal can use the lock.
+func (l *Lock) heldBy(principal string) bool {
+	return l.Principal == "" || l.Principal == principal
+}
+
+// LockSystem manages WebDAV locks. Implementations are responsible for
+// expiring locks.
+type LockSystem interface {
+	// Create creates a new lock. It returns an HTTP 423 Locked error if the
+	// lock conflicts with an existing one.
+	Create(ctx context.Context, lock *Lock) error
+	// Refresh updates the expiration time of an existing lock.
+	Refresh(ctx context.Context, token string, expires time.Time) (*Lock, error)
+	// Remove removes a lock.
+	Remove(ctx context.Context, token string) error
+	// Locks returns the locks applying to a path: locks rooted at the path
+	// and recursive locks rooted at one of its ancestors. If descendants is
+	// true, locks rooted at one of its descendants are returned as well.
+	Locks(ctx context.Context, path string, descendants bool) ([]Lock, error)
+}
+
+// MemLockSystem is an in-memory LockSystem. The zero value is ready to use.
+type MemLockSystem struct {
+	mu    sync.Mutex
+	locks map[string]Lock
+}
+
+var _ LockSystem = (*MemLockSystem)(nil)
+
+// sweep removes expired locks. The lock must be held.
+func (ls *MemLockSystem) sweep(now time.Time) {
+	for token, l := range ls.locks {
+		if l.expired(now) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+func (ls *MemLockSystem) Create(ctx context.Context, lock *Lock) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.sweep(time.Now())
+
+	for _, l := range ls.locks {
+		conflict := l.appliesTo(lock.Root) || lock.appliesTo(l.Root)
+		if conflict && !(l.Shared && lock.Shared) {
+			return internal.HTTPErrorf(http.StatusLocked, "webdav: %q is locked", l.Root)
+		}
+	}
+	if ls.locks == nil {
+		ls.locks = make(map[string]Lock)
+	}
+	ls.locks[lock.Token] = *lock
+	return nil
+}
+
+func (ls *MemLockSystem) Refresh(ctx context.Context, token string, expires time.Time) (*Lock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.sweep(time.Now())
+
+	l, ok := ls.locks[token]
+	if !ok {
+		return nil, internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: unknown lock token")
+	}
+	l.Expires = expires
+	ls.locks[token] = l
+	return &l, nil
+}
+
+func (ls *MemLockSystem) Remove(ctx context.Context, token string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.locks[token]; !ok {
+		return internal.HTTPErrorf(http.StatusConflict, "webdav: unknown lock token")
+	}
+	delete(ls.locks, token)
+	return nil
+}
+
+func (ls *MemLockSystem) Locks(ctx context.Context, p string, descendants bool) ([]Lock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.sweep(time.Now())
+
+	var l []Lock
+	for _, lock := range ls.locks {
+		if lock.appliesTo(p) || (descendants && isSubPath(lock.Root, p)) {
+			l = append(l, lock)
+		}
+	}
+	return l, nil
+}
+
+func newLockToken() (string, error) {
+	uuid, err := internal.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	return "urn:uuid:" + uuid, nil
+}
+
+// parseIfLockTokens returns the lock tokens submitted in an If header, as
+// defined in RFC 4918 section 10.4. Negated conditions, entity tags and
+// resource tags are ignored.
+func parseIfLockTokens(h string) []string {
+	var tokens []string
+	inList, negated := false, false
+	for h != "" {
+		switch h[0] {
+		case '(':
+			inList, negated = true, false
+			h = h[1:]
+		case ')':
+			inList = false
+			h = h[1:]
+		case '<':
+			end := strings.IndexByte(h, '>')
+			if end < 0 {
+				return tokens
+			}
+			if inList && !negated {
+				tokens = append(tokens, h[1:end])
+			}
+			negated = false
+			h = h[end+1:]
+		case '[':
+			end := strings.IndexByte(h, ']')
+			if end < 0 {
+				return tokens
+			}
+			negated = false
+			h = h[end+1:]
+		default:
+			if strings.HasPrefix(h, "Not") {
+				negated = true
+				h = h[len("Not"):]
+			} else {
+				h = h[1:]
+			}
+		}
+	}
+	return tokens
+}
+
+// checkLocks returns an HTTP 423 Locked error if the request modifies a
+// locked resource without submitting the lock token in an If header. The
+// resource at p, its descendants if descendants is true, and its parent
+// collection, whose membership changes, are checked.
+func (b *backend) checkLocks(r *http.Request, p string, descendants bool) error {
+	if b.LockSystem == nil {
+		return nil
+	}
+
+	locks, err := b.LockSystem.Locks(r.Context(), p, descendants)
+	if err != nil {
+		return err
+	}
+	if parent := path.Dir(strings.TrimSuffix(p, "/")); parent != p {
+		parentLocks, err := b.LockSystem.Locks(r.Context(), parent, false)
+		if err != nil {
+			return err
+		}
+		for _, l := range parentLocks {
+			// Recursive locks on ancestors are already in locks
+			if l.Root == parent || l.Root == parent+"/" {
+				locks = append(locks, l)
+			}
+		}
+	}
+
+	submitted := make(map[string]bool)
+	for _, token := range parseIfLockTokens(r.Header.Get("If")) {
+		submitted[token] = true
+	}
+	// Tokens of locks created by other users can't be used
+	principal := b.lockPrincipal(r.Context())
+	for _, l := range locks {
+		if !l.heldBy(principal) {
+			delete(submitted, l.Token)
+		}
+	}
+
+	// A single token is enough for shared locks
+	sharedOK, hasShared := false, false
+	for _, l := range locks {
+		if l.Shared {
+			hasShared = true
+			sharedOK = sharedOK || submitted[l.Token]
+		} else if !submitted[l.Token] {
+			return internal.HTTPErrorf(http.StatusLocked, "webdav: %q is locked", l.Root)
+		}
+	}
+	if hasShared && !sharedOK {
+		return internal.HTTPErrorf(http.StatusLocked, "webdav: %q is locked", p)
+	}
+	return nil
+}
+
+// removeLocks removes the locks rooted at a path or one of its descendants,
+// after the resources have been deleted or moved.
+func (b *backend) removeLocks(ctx context.Context, p string) error {
+	if b.LockSystem == nil {
+		return nil
+	}
+	locks, err := b.LockSystem.Locks(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if isSubPath(l.Root, p) {
+			if err := b.LockSystem.Remove(ctx, l.Token); err != nil && !isHTTPErrorCode(err, http.StatusConflict) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isHTTPErrorCode(err error, code int) bool {
+	return internal.HTTPErrorFromError(err).Code == code
+}
+
+const (
+	defaultLockTimeout = time.Hour
+	maxLockTimeout     = 7 * 24 * time.Hour
+)
+
+// parseTimeout parses a Timeout header, as defined in RFC 4918 section 10.7.
+func parseTimeout(h string) time.Duration {
+	for _, v := range strings.Split(h, ",") {
+		v = strings.TrimSpace(v)
+		if v == "Infinite" {
+			return maxLockTimeout
+		}
+		if strings.HasPrefix(v, "Second-") {
+			sec, err := strconv.ParseInt(strings.TrimPrefix(v, "Second-"), 10, 64)
+			if err != nil || sec <= 0 {
+				continue
+			}
+			if sec >= int64(maxLockTimeout/time.Second) {
+				return maxLockTimeout
+			}
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return defaultLockTimeout
+}
+
+// lockPrincipal returns the principal of the current user, or an empty string
+// if unknown.
+func (b *backend) lockPrincipal(ctx context.Context) string {
+	principal, err := b.CurrentUserPrincipal(ctx)
+	if err != nil {
+		return ""
+	}
+	return principal
+}
+
+// newActiveLock describes a lock. The token is omitted unless showToken is
+// set.
+func newActiveLock(l *Lock, now time.Time, showToken bool) *activeLock {
+	al := &activeLock{
+		LockType: lockType{Write: &struct{}{}},
+		Depth:    "0",
+		Timeout:  "Infinite",
+	}
+	if l.Shared {
+		al.LockScope.Shared = &struct{}{}
+	} else {
+		al.LockScope.Exclusive = &struct{}{}
+	}
+	if l.Recursive {
+		al.Depth = "infinity"
+	}
+	if l.Owner != "" {
+		al.Owner = &lockOwner{InnerXML: l.Owner}
+	}
+	if !l.Expires.IsZero() {
+		sec := int64(l.Expires.Sub(now) / time.Second)
+		if sec < 0 {
+			sec = 0
+		}
+		al.Timeout = "Second-" + strconv.FormatInt(sec, 10)
+	}
+	if showToken {
+		al.LockToken = &lockHref{Href: internal.Href{Opaque: l.Token}}
+		if u, err := internal.ParseURL(l.Token); err == nil {
+			al.LockToken.Href = internal.Href(*u)
+		}
+	}
+	al.LockRoot.Href = internal.Href{Path: l.Root}
+	return al
+}
+
+func (b *backend) lockDiscovery(ctx context.Context, p string) (*lockDiscovery, error) {
+	locks, err := b.LockSystem.Locks(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	principal := b.lockPrincipal(ctx)
+	ld := &lockDiscovery{}
+	for i := range locks {
+		l := &locks[i]
+		ld.ActiveLocks = append(ld.ActiveLocks, *newActiveLock(l, now, l.heldBy(principal)))
+	}
+	return ld, nil
+}
+
+func addLockProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, b *backend, p string) {
+	props[lockDiscoveryName] = func(*internal.RawXMLValue) (interface{}, error) {
+		return b.lockDiscovery(ctx, p)
+	}
+	props[supportedLockName] = func(*internal.RawXMLValue) (interface{}, error) {
+		return &supportedLock{
+			LockEntries: []lockEntry{
+				{LockScope: lockScope{Exclusive: &struct{}{}}, LockType: lockType{Write: &struct{}{}}},
+				{LockScope: lockScope{Shared: &struct{}{}}, LockType: lockType{Write: &struct{}{}}},
+			},
+		}, nil
+	}
+}
+
+// handleLock handles LOCK requests, as defined in RFC 4918 section 9.10.
+func (b *backend) handleLock(w http.ResponseWriter, r *http.Request) error {
+	expires := time.Now().Add(parseTimeout(r.Header.Get("Timeout")))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// An empty body refreshes an existing lock
+		tokens := parseIfLockTokens(r.Header.Get("If"))
+		if len(tokens) != 1 {
+			return internal.HTTPErrorf(http.StatusBadRequest, "webdav: expected a single lock token in If header")
+		}
+		// The lock is checked before it's extended
+		locks, err := b.LockSystem.Locks(r.Context(), r.URL.Path, false)
+		if err != nil {
+			return err
+		}
+		var lock *Lock
+		for i := range locks {
+			if locks[i].Token == tokens[0] {
+				lock = &locks[i]
+			}
+		}
+		if lock == nil || !lock.heldBy(b.lockPrincipal(r.Context())) {
+			return internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: lock token doesn't apply to %q", r.URL.Path)
+		}
+		if lock, err = b.LockSystem.Refresh(r.Context(), tokens[0], expires); err != nil {
+			return err
+		}
+		return serveLockResponse(w, http.StatusOK, lock)
+	}
+
+	var info lockInfo
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := internal.DecodeXMLRequest(r, &info); err != nil {
+		return err
+	}
+	if info.LockType.Write == nil {
+		return internal.HTTPErrorf(http.StatusBadRequest, "webdav: only write locks are supported")
+	}
+
+	recursive := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		recursive = false
+	default:
+		return internal.HTTPErrorf(http.StatusBadRequest, "webdav: invalid Depth header in LOCK request")
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	lock := &Lock{
+		Token:     token,
+		Root:      r.URL.Path,
+		Recursive: recursive,
+		Shared:    info.LockScope.Shared != nil,
+		Expires:   expires,
+		Principal: b.lockPrincipal(r.Context()),
+	}
+	if info.Owner != nil {
+		lock.Owner = info.Owner.InnerXML
+	}
+	if err := b.LockSystem.Create(r.Context(), lock); err != nil {
+		return err
+	}
+
+	// Locking an unmapped URL creates an empty resource
+	code := http.StatusOK
+	if b.Finder.discards(r.URL.Path) {
+		code = http.StatusCreated
+	} else if _, err := b.FileSystem.Stat(r.Context(), r.URL.Path); internal.IsNotFound(err) {
+		if _, err := b.FileSystem.Stat(r.Context(), path.Dir(strings.TrimSuffix(r.URL.Path, "/"))); err != nil {
+			b.LockSystem.Remove(r.Context(), token)
+			return &internal.HTTPError{Code: http.StatusConflict, Err: err}
+		}
+		wc, err := b.FileSystem.Create(r.Context(), r.URL.Path)
+		if err == nil {
+			err = wc.Close()
+		}
+		if err != nil {
+			b.LockSystem.Remove(r.Context(), token)
+			return err
+		}
+		code = http.StatusCreated
+	} else if err != nil {
+		b.LockSystem.Remove(r.Context(), token)
+		return err
+	}
+
+	w.Header().Set("Lock-Token", "<"+token+">")
+	return serveLockResponse(w, code, lock)
+}
+
+func serveLockResponse(w http.ResponseWriter, code int, lock *Lock) error {
+	resp := lockResponse{
+		LockDiscovery: lockDiscovery{
+			ActiveLocks: []activeLock{*newActiveLock(lock, time.Now(), true)},
+		},
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	return xml.NewEncoder(w).Encode(&resp)
+}
+
+// handleUnlock handles UNLOCK requests, as defined in RFC 4918 section 9.11.
+func (b *backend) handleUnlock(w http.ResponseWriter, r *http.Request) error {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		return internal.HTTPErrorf(http.StatusBadRequest, "webdav: missing or malformed Lock-Token header")
+	}
+	token = token[1 : len(token)-1]
+
+	locks, err := b.LockSystem.Locks(r.Context(), r.URL.Path, false)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, l := range locks {
+		if l.Token != token {
+			continue
+		}
+		if !l.heldBy(b.lockPrincipal(r.Context())) {
+			return internal.HTTPErrorf(http.StatusForbidden, "webdav: lock %q belongs to another user", token)
+		}
+		found = true
+	}
+	if !found && b.Finder != nil {
+		// Finder fails to unmount shares if its locks expired
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	} else if !found {
+		return internal.HTTPErrorf(http.StatusConflict, "webdav: lock token doesn't apply to %q", r.URL.Path)
+	}
+
+	if err := b.LockSystem.Remove(r.Context(), token); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,28 @@
+package webdav
+
+import (
+	"context"
+)
+
+// MigrationProgress describes the progress of a migration, e.g. via
+// caldav.Migrate or carddav.Migrate.
+type MigrationProgress struct {
+	// Collection is the path of the source collection being migrated.
+	Collection string
+	// Path is the path of the source object which has just been processed.
+	Path string
+	// Done and Total are the number of processed objects and the total
+	// number of objects in the collection.
+	Done, Total int
+	// Skipped is set if the object had already been migrated.
+	Skipped bool
+}
+
+// MigrationState records which objects have been migrated, allowing an
+// interrupted migration to be resumed. Objects are identified by their source
+// path and ETag, so that objects modified since they were migrated are
+// migrated again.
+type MigrationState interface {
+	IsMigrated(ctx context.Context, path, etag string) (bool, error)
+	SetMigrated(ctx context.Context, path, etag string) error
+}
@@ -0,0 +1,151 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MirrorOptions contains options for Mirror.
+type MirrorOptions struct {
+	// SourcePath and DestinationPath are the directories to mirror. They
+	// default to "/".
+	SourcePath, DestinationPath string
+	// State maps paths relative to SourcePath to the ETags of the source
+	// files as of the last mirror. It's updated in place and should be
+	// persisted between calls: files whose ETag hasn't changed are skipped.
+	// If nil, all files are copied.
+	State map[string]string
+	// Delete removes destination files missing from the source.
+	Delete bool
+}
+
+// Mirror copies a directory tree from a WebDAV server to another one,
+// overwriting modified files.
+func Mirror(ctx context.Context, src, dst *Client, opts *MirrorOptions) error {
+	if opts == nil {
+		opts = new(MirrorOptions)
+	}
+
+	srcFiles, err := readDirRel(ctx, src, opts.SourcePath)
+	if err != nil {
+		return fmt.Errorf("webdav: failed to list mirror source: %w", err)
+	}
+	dstFiles, err := readDirRel(ctx, dst, opts.DestinationPath)
+	if err != nil {
+		return fmt.Errorf("webdav: failed to list mirror destination: %w", err)
+	}
+	dstRoot := dstFiles[""].Path
+
+	// Parent directories sort before their children
+	names := sortedKeys(srcFiles)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		fi := srcFiles[name]
+		p := path.Join(dstRoot, name)
+
+		if fi.IsDir {
+			if _, ok := dstFiles[name]; !ok {
+				if err := dst.Mkdir(ctx, p); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if _, ok := dstFiles[name]; ok && opts.State != nil && fi.ETag != "" && opts.State[name] == fi.ETag {
+			continue
+		}
+		if err := mirrorFile(ctx, src, fi.Path, dst, p); err != nil {
+			return err
+		}
+		if opts.State != nil {
+			opts.State[name] = fi.ETag
+		}
+	}
+
+	for name := range opts.State {
+		if _, ok := srcFiles[name]; !ok {
+			delete(opts.State, name)
+		}
+	}
+
+	if opts.Delete {
+		deleted := make(map[string]bool)
+		for _, name := range sortedKeys(dstFiles) {
+			if _, ok := srcFiles[name]; ok || deleted[path.Dir(name)] {
+				// Children of deleted directories are gone already
+				deleted[name] = deleted[path.Dir(name)]
+				continue
+			}
+			if err := dst.RemoveAll(ctx, dstFiles[name].Path); err != nil {
+				return err
+			}
+			deleted[name] = true
+		}
+	}
+
+	return nil
+}
+
+// readDirRel lists a directory tree, keyed by path relative to the directory.
+func readDirRel(ctx context.Context, c *Client, name string) (map[string]*FileInfo, error) {
+	if name == "" {
+		name = "/"
+	}
+	root, err := c.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !root.IsDir {
+		return nil, fmt.Errorf("webdav: %q is not a directory", name)
+	}
+	rootPath := strings.TrimSuffix(root.Path, "/")
+
+	l, err := c.ReadDir(ctx, name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*FileInfo{"": root}
+	for i := range l {
+		fi := &l[i]
+		rel := strings.Trim(strings.TrimPrefix(fi.Path, rootPath), "/")
+		if rel != "" {
+			files[rel] = fi
+		}
+	}
+	return files, nil
+}
+
+func sortedKeys(m map[string]*FileInfo) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mirrorFile(ctx context.Context, src *Client, srcPath string, dst *Client, dstPath string) error {
+	r, err := src.Open(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.Create(ctx, dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
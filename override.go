@@ -0,0 +1,48 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Override intercepts requests before they're handled by a Handler, e.g. to
+// serve custom POST endpoints inside the DAV tree.
+type Override struct {
+	// Method is the request method to match. If empty, all methods match.
+	Method string
+	// Path is the request path to match. A path ending with a slash matches
+	// all paths below it. If empty, all paths match.
+	Path string
+	// Handle handles matching requests. next serves the request as if no
+	// override matched, and can be used to delegate or wrap the default
+	// handling.
+	Handle func(w http.ResponseWriter, r *http.Request, next http.Handler)
+}
+
+// Match reports whether the override applies to a request.
+func (o *Override) Match(r *http.Request) bool {
+	if o.Method != "" && o.Method != r.Method {
+		return false
+	}
+	if o.Path == "" || o.Path == r.URL.Path {
+		return true
+	}
+	return strings.HasSuffix(o.Path, "/") && strings.HasPrefix(r.URL.Path, o.Path)
+}
+
+// WithOverrides returns a handler serving requests with the first matching
+// override, or with next if none match.
+func WithOverrides(overrides []Override, next http.Handler) http.Handler {
+	if len(overrides) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range overrides {
+			if o := &overrides[i]; o.Match(r) {
+				o.Handle(w, r, next)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package webdav
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// pageTokenHeader is sent by clients to request the next page of a PROPFIND
+// listing, with the token found in the truncated response of the previous
+// page.
+const pageTokenHeader = "Page-Token"
+
+const goWebDAVNamespace = "https://github.com/emersion/go-webdav"
+
+var nextPageName = xml.Name{goWebDAVNamespace, "next-page"}
+
+// nextPage is added to the DAV:error element of truncated PROPFIND responses
+// when more members can be listed with a follow-up request.
+type nextPage struct {
+	XMLName xml.Name `xml:"https://github.com/emersion/go-webdav next-page"`
+	Token   string   `xml:",chardata"`
+}
+
+// parsePageToken returns the path of the last member listed by the previous
+// page.
+func parsePageToken(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !strings.HasPrefix(string(b), "/") {
+		return "", internal.HTTPErrorf(http.StatusBadRequest, "webdav: invalid %v header", pageTokenHeader)
+	}
+	return path.Clean(string(b)), nil
+}
+
+// newNextPageResponse creates a truncated response for a collection, as
+// defined in RFC 6578 section 3.6, pointing to the page following the member
+// after.
+func newNextPageResponse(p, after string) (*internal.Response, error) {
+	resp := internal.NewTruncatedResponse(p)
+	token := base64.RawURLEncoding.EncodeToString([]byte(after))
+	raw, err := internal.EncodeRawXMLElement(&nextPage{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	resp.Error.Raw = append(resp.Error.Raw, *raw)
+	return resp, nil
+}
+
+// memberPage collects the first members of a listing whose path sorts after
+// a cursor. Members can be added in any order.
+type memberPage struct {
+	after string
+	size  int
+	// Sorted by path, holds at most size+1 members to detect truncation
+	l []FileInfo
+}
+
+func (page *memberPage) add(fi *FileInfo) {
+	p := path.Clean(fi.Path)
+	if page.after != "" && p <= page.after {
+		return
+	}
+	i := sort.Search(len(page.l), func(i int) bool {
+		return path.Clean(page.l[i].Path) > p
+	})
+	if i > page.size {
+		return
+	}
+	page.l = append(page.l, FileInfo{})
+	copy(page.l[i+1:], page.l[i:])
+	page.l[i] = *fi
+	if len(page.l) > page.size+1 {
+		page.l = page.l[:page.size+1]
+	}
+}
+
+// members returns the members of the page, and the cursor of the next page if
+// the listing is truncated.
+func (page *memberPage) members() (l []FileInfo, next string) {
+	if len(page.l) <= page.size {
+		return page.l, ""
+	}
+	l = page.l[:page.size]
+	return l, path.Clean(l[len(l)-1].Path)
+}
+
+// nextPageToken returns the token to request the next page of a truncated
+// response, if any.
+func nextPageToken(resp *internal.Response) string {
+	if resp.Error == nil {
+		return ""
+	}
+	for i := range resp.Error.Raw {
+		raw := &resp.Error.Raw[i]
+		if name, ok := raw.XMLName(); !ok || name != nextPageName {
+			continue
+		}
+		var np nextPage
+		if err := raw.Decode(&np); err != nil {
+			return ""
+		}
+		return np.Token
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// PosixNamespace is the XML namespace of the properties exposing POSIX
+// metadata: owner, group and mode. The mode is formatted as an octal number.
+const PosixNamespace = "https://github.com/emersion/go-webdav/posix"
+
+var (
+	posixOwnerName = xml.Name{PosixNamespace, "owner"}
+	posixGroupName = xml.Name{PosixNamespace, "group"}
+	posixModeName  = xml.Name{PosixNamespace, "mode"}
+)
+
+// PosixMetadata holds the ownership and permissions of a file.
+type PosixMetadata struct {
+	// Owner and Group are user and group names, or numeric IDs if the names
+	// are unknown.
+	Owner string
+	Group string
+	// Mode contains the permission bits.
+	Mode os.FileMode
+}
+
+// PosixFileSystem is a FileSystem exposing POSIX metadata. Metadata is
+// reported in PROPFIND responses, and can be modified via PROPPATCH if
+// Handler.AuthorizePosix allows it.
+type PosixFileSystem interface {
+	FileSystem
+	PosixMetadata(ctx context.Context, name string) (*PosixMetadata, error)
+	// SetPosixMetadata replaces the metadata of a file. Fields left unchanged
+	// from PosixMetadata should not be touched.
+	SetPosixMetadata(ctx context.Context, name string, md *PosixMetadata) error
+}
+
+type posixProp struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func formatPosixMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", uint32(mode&os.ModePerm))
+}
+
+func parsePosixMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return 0, fmt.Errorf("webdav: invalid POSIX mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func addPosixProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, fs PosixFileSystem, name string) {
+	var md *PosixMetadata
+	get := func() (*PosixMetadata, error) {
+		if md != nil {
+			return md, nil
+		}
+		var err error
+		md, err = fs.PosixMetadata(ctx, name)
+		return md, err
+	}
+
+	newProp := func(name xml.Name, f func(md *PosixMetadata) string) {
+		props[name] = func(*internal.RawXMLValue) (interface{}, error) {
+			md, err := get()
+			if err != nil {
+				return nil, err
+			}
+			return &posixProp{XMLName: name, Value: f(md)}, nil
+		}
+	}
+	newProp(posixOwnerName, func(md *PosixMetadata) string { return md.Owner })
+	newProp(posixGroupName, func(md *PosixMetadata) string { return md.Group })
+	newProp(posixModeName, func(md *PosixMetadata) string { return formatPosixMode(md.Mode) })
+}
+
+// setPosixProp applies a POSIX property update to md. It returns a non-zero
+// status code on failure.
+func setPosixProp(md *PosixMetadata, name xml.Name, raw *internal.RawXMLValue) int {
+	var v posixProp
+	if err := raw.Decode(&v); err != nil {
+		return http.StatusBadRequest
+	}
+
+	switch name {
+	case posixOwnerName:
+		md.Owner = strings.TrimSpace(v.Value)
+	case posixGroupName:
+		md.Group = strings.TrimSpace(v.Value)
+	case posixModeName:
+		mode, err := parsePosixMode(v.Value)
+		if err != nil {
+			return http.StatusConflict
+		}
+		md.Mode = mode
+	default:
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+func (b *backend) setPosixMetadata(r *http.Request, fs PosixFileSystem, md *PosixMetadata) error {
+	if b.AuthorizePosix == nil {
+		return internal.HTTPErrorf(http.StatusForbidden, "webdav: changing POSIX metadata is not allowed")
+	}
+	if err := b.AuthorizePosix(r); err != nil {
+		return err
+	}
+	return fs.SetPosixMetadata(r.Context(), r.URL.Path, md)
+}
@@ -0,0 +1,344 @@
+package webdav
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// ProxyFileSystem implements FileSystem by forwarding all operations to a
+// remote WebDAV server. Together with Handler, it can be used to build a
+// WebDAV gateway, e.g. to translate authentication with the Client's
+// HTTPClient.
+type ProxyFileSystem struct {
+	Client *Client
+	// Prefix is prepended to paths before forwarding them to the remote
+	// server, and stripped from paths returned by it. For instance, with a
+	// prefix "/remote.php/dav", "/a.txt" is forwarded as
+	// "/remote.php/dav/a.txt".
+	Prefix string
+	// Cache, if set, caches file contents and directory listings. Cached
+	// entries are revalidated with the remote server's ETags. Listings of
+	// each collection are cached and revalidated separately, since the ETag
+	// of a collection doesn't change when a nested collection changes.
+	Cache *ProxyCache
+}
+
+var _ FileSystem = (*ProxyFileSystem)(nil)
+
+func (fs *ProxyFileSystem) remotePath(name string) string {
+	if fs.Prefix == "" {
+		return name
+	}
+	p := path.Join(fs.Prefix, name)
+	if strings.HasSuffix(name, "/") && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func (fs *ProxyFileSystem) localFileInfo(fi *FileInfo) error {
+	if fs.Prefix == "" {
+		return nil
+	}
+	prefix := strings.TrimSuffix(fs.Prefix, "/")
+	if fi.Path != prefix && !strings.HasPrefix(fi.Path, prefix+"/") {
+		return internal.HTTPErrorf(http.StatusBadGateway, "webdav: remote server returned path %q outside of prefix %q", fi.Path, fs.Prefix)
+	}
+	fi.Path = strings.TrimPrefix(fi.Path, prefix)
+	if fi.Path == "" {
+		fi.Path = "/"
+	}
+	return nil
+}
+
+func (fs *ProxyFileSystem) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	p := fs.remotePath(name)
+	if fs.Cache == nil {
+		return fs.Client.Open(ctx, p)
+	}
+
+	req, err := fs.Client.ic.NewRequest(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	cached, ok := fs.Cache.file(p)
+	if ok {
+		req.Header.Set("If-None-Match", internal.ETag(cached.etag).String())
+	}
+
+	resp, err := fs.Client.ic.Do(req)
+	var httpErr *internal.HTTPError
+	if ok && errors.As(err, &httpErr) && httpErr.Code == http.StatusNotModified {
+		return ioutil.NopCloser(bytes.NewReader(cached.data)), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var etag internal.ETag
+	if err := etag.UnmarshalText([]byte(resp.Header.Get("ETag"))); err != nil || !fs.Cache.fits(resp.ContentLength) {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	fs.Cache.storeFile(p, string(etag), data)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fs *ProxyFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fi, err := fs.Client.Stat(ctx, fs.remotePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.localFileInfo(fi); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (fs *ProxyFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	l, err := fs.readDir(ctx, fs.remotePath(name), recursive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l {
+		if err := fs.localFileInfo(&l[i]); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// readDir lists a remote directory. If caching is enabled, recursive listings
+// are assembled from the cached listings of each sub-collection.
+func (fs *ProxyFileSystem) readDir(ctx context.Context, p string, recursive bool) ([]FileInfo, error) {
+	if fs.Cache == nil {
+		return fs.Client.ReadDir(ctx, p, recursive)
+	}
+
+	l, err := fs.readDirOneLevel(ctx, p)
+	if err != nil || !recursive {
+		return l, err
+	}
+
+	self := path.Clean(fs.Client.ic.ResolveHref(p).Path)
+	for _, fi := range l {
+		child := path.Clean(fi.Path)
+		if !fi.IsDir || child == self {
+			continue
+		}
+		children, err := fs.readDir(ctx, fi.Path, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range children {
+			if path.Clean(fi.Path) != child {
+				l = append(l, fi)
+			}
+		}
+	}
+	return l, nil
+}
+
+// readDirOneLevel lists the direct children of a remote directory. The
+// directory's ETag is used to revalidate cached listings.
+func (fs *ProxyFileSystem) readDirOneLevel(ctx context.Context, p string) ([]FileInfo, error) {
+	fi, err := fs.Client.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.ETag == "" {
+		return fs.Client.ReadDir(ctx, p, false)
+	}
+	if l, ok := fs.Cache.dir(p, fi.ETag); ok {
+		return l, nil
+	}
+
+	l, err := fs.Client.ReadDir(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	fs.Cache.storeDir(p, fi.ETag, l)
+	return append([]FileInfo(nil), l...), nil
+}
+
+func (fs *ProxyFileSystem) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	fs.invalidate(name)
+	return fs.Client.Create(ctx, fs.remotePath(name))
+}
+
+func (fs *ProxyFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fs.invalidate(name)
+	return fs.Client.RemoveAll(ctx, fs.remotePath(name))
+}
+
+func (fs *ProxyFileSystem) Mkdir(ctx context.Context, name string) error {
+	fs.invalidate(name)
+	return fs.Client.Mkdir(ctx, fs.remotePath(name))
+}
+
+func (fs *ProxyFileSystem) invalidate(name string) {
+	if fs.Cache != nil {
+		fs.Cache.invalidate(fs.remotePath(name))
+	}
+}
+
+// exists reports whether a remote file exists. It's used to find out whether
+// a COPY or MOVE creates its destination, since the Client doesn't expose the
+// response status.
+func (fs *ProxyFileSystem) exists(ctx context.Context, name string) (bool, error) {
+	if _, err := fs.Client.Stat(ctx, fs.remotePath(name)); internal.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs *ProxyFileSystem) Copy(ctx context.Context, name, dest string, options *CopyOptions) (created bool, err error) {
+	exists, err := fs.exists(ctx, dest)
+	if err != nil {
+		return false, err
+	}
+	fs.invalidate(dest)
+	if err := fs.Client.Copy(ctx, fs.remotePath(name), fs.remotePath(dest), options); err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+func (fs *ProxyFileSystem) Move(ctx context.Context, name, dest string, options *MoveOptions) (created bool, err error) {
+	exists, err := fs.exists(ctx, dest)
+	if err != nil {
+		return false, err
+	}
+	fs.invalidate(name)
+	fs.invalidate(dest)
+	if err := fs.Client.Move(ctx, fs.remotePath(name), fs.remotePath(dest), options); err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// ProxyCache is an in-memory cache for a ProxyFileSystem. The zero value is
+// an empty cache without size limit.
+type ProxyCache struct {
+	// MaxFileSize is the maximum size of a cached file, in bytes. Zero means
+	// no limit. Files of unknown size are never cached.
+	MaxFileSize int64
+	// MaxEntries is the maximum number of cached files and directory
+	// listings. Zero means no limit. The least recently used entries are
+	// evicted first.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[proxyCacheKey]*list.Element
+	// lru contains the *proxyCacheEntry values, most recently used first
+	lru list.List
+}
+
+type proxyCacheKey struct {
+	path string
+	dir  bool
+}
+
+type proxyCacheEntry struct {
+	key   proxyCacheKey
+	etag  string
+	data  []byte
+	infos []FileInfo
+}
+
+func (c *ProxyCache) fits(size int64) bool {
+	return size >= 0 && (c.MaxFileSize == 0 || size <= c.MaxFileSize)
+}
+
+// get returns a cached entry and marks it as recently used. The caller must
+// hold c.mu.
+func (c *ProxyCache) get(key proxyCacheKey) (*proxyCacheEntry, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*proxyCacheEntry), true
+}
+
+// store adds or replaces an entry, and evicts the least recently used entries
+// if the cache is full. The caller must hold c.mu.
+func (c *ProxyCache) store(entry *proxyCacheEntry) {
+	if c.entries == nil {
+		c.entries = make(map[proxyCacheKey]*list.Element)
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. The caller must hold c.mu.
+func (c *ProxyCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*proxyCacheEntry).key)
+}
+
+func (c *ProxyCache) file(p string) (*proxyCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(proxyCacheKey{path: p})
+}
+
+func (c *ProxyCache) storeFile(p, etag string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(&proxyCacheEntry{key: proxyCacheKey{path: p}, etag: etag, data: data})
+}
+
+func (c *ProxyCache) dir(p string, etag string) ([]FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.get(proxyCacheKey{path: p, dir: true})
+	if !ok || d.etag != etag {
+		return nil, false
+	}
+	return append([]FileInfo(nil), d.infos...), true
+}
+
+func (c *ProxyCache) storeDir(p string, etag string, infos []FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(&proxyCacheEntry{key: proxyCacheKey{path: p, dir: true}, etag: etag, infos: infos})
+}
+
+// invalidate drops the cached entries affected by a change to p: the file
+// itself, its descendants and the listings of its ancestors.
+func (c *ProxyCache) invalidate(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, elem := range c.entries {
+		if isSubPath(k.path, p) || (k.dir && isSubPath(p, k.path)) {
+			c.remove(elem)
+		}
+	}
+}
+
+// isSubPath reports whether p is equal to or a descendant of dir.
+func isSubPath(p, dir string) bool {
+	p, dir = strings.TrimSuffix(p, "/"), strings.TrimSuffix(dir, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,150 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// ErrQuotaExceeded can be returned by FileSystems when a write would exceed
+// the storage quota. The client gets a 507 Insufficient Storage response with
+// the DAV:quota-not-exceeded precondition, as defined in RFC 4331.
+var ErrQuotaExceeded = internal.ErrQuotaExceeded
+
+// Quota describes the storage quota of a collection. Negative values are
+// unknown.
+type Quota struct {
+	// Available is the number of bytes which can still be stored.
+	Available int64
+	// Used is the number of bytes used by the collection and its members.
+	Used int64
+}
+
+// QuotaProvider is a FileSystem reporting storage quotas (RFC 4331). Quotas
+// are exposed in PROPFIND responses for collections, and PUT requests
+// exceeding the available quota fail with ErrQuotaExceeded.
+type QuotaProvider interface {
+	FileSystem
+	// Quota returns the quota applying to a file or collection.
+	Quota(ctx context.Context, name string) (*Quota, error)
+}
+
+var (
+	quotaAvailableBytesName = xml.Name{"DAV:", "quota-available-bytes"}
+	quotaUsedBytesName      = xml.Name{"DAV:", "quota-used-bytes"}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc4331#section-3
+type quotaAvailableBytes struct {
+	XMLName xml.Name `xml:"DAV: quota-available-bytes"`
+	Bytes   int64    `xml:",chardata"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc4331#section-4
+type quotaUsedBytes struct {
+	XMLName xml.Name `xml:"DAV: quota-used-bytes"`
+	Bytes   int64    `xml:",chardata"`
+}
+
+func addQuotaProps(ctx context.Context, props map[xml.Name]internal.PropFindFunc, qp QuotaProvider, name string) {
+	var quota *Quota
+	get := func() (*Quota, error) {
+		if quota != nil {
+			return quota, nil
+		}
+		var err error
+		quota, err = qp.Quota(ctx, name)
+		return quota, err
+	}
+
+	props[quotaAvailableBytesName] = func(*internal.RawXMLValue) (interface{}, error) {
+		q, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if q.Available < 0 {
+			return nil, &internal.HTTPError{Code: http.StatusNotFound}
+		}
+		return &quotaAvailableBytes{Bytes: q.Available}, nil
+	}
+	props[quotaUsedBytesName] = func(*internal.RawXMLValue) (interface{}, error) {
+		q, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if q.Used < 0 {
+			return nil, &internal.HTTPError{Code: http.StatusNotFound}
+		}
+		return &quotaUsedBytes{Bytes: q.Used}, nil
+	}
+}
+
+// checkQuota checks that a PUT request fits in the available quota. The
+// size of the file being replaced, if any, is freed by the request. Request
+// bodies of unknown size are checked while they're read.
+func checkQuota(r *http.Request, qp QuotaProvider) error {
+	size := r.ContentLength
+	if size < 0 {
+		// Sent by macOS along with chunked request bodies
+		if n, err := strconv.ParseInt(r.Header.Get("X-Expected-Entity-Length"), 10, 64); err == nil {
+			size = n
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+
+	quota, err := qp.Quota(r.Context(), r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if quota.Available < 0 {
+		return nil
+	}
+
+	available := quota.Available
+	if fi, err := qp.Stat(r.Context(), r.URL.Path); err == nil && !fi.IsDir {
+		available += fi.Size
+	} else if err != nil && !internal.IsNotFound(err) {
+		return err
+	}
+	if size > available {
+		return ErrQuotaExceeded
+	}
+	if r.ContentLength < 0 {
+		// The expected length isn't binding, and chunked bodies may have any
+		// size
+		r.Body = &quotaReader{ReadCloser: r.Body, n: available}
+	}
+	return nil
+}
+
+// quotaReader fails with ErrQuotaExceeded if more than n bytes are read.
+type quotaReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if qr.n <= 0 {
+		var b [1]byte
+		n, err := qr.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, ErrQuotaExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > qr.n {
+		p = p[:qr.n]
+	}
+	n, err := qr.ReadCloser.Read(p)
+	qr.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,46 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// applyToRedirectRef reports whether a request operates on redirect reference
+// resources themselves rather than on their targets, as specified by the
+// Apply-To-Redirect-Ref header (RFC 4437 section 12.1).
+func applyToRedirectRef(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Apply-To-Redirect-Ref")), "T")
+}
+
+// serveRedirectRef redirects the client to the target of a redirect reference
+// resource. It returns false if the request should be processed normally.
+func serveRedirectRef(w http.ResponseWriter, r *http.Request, fi *FileInfo) bool {
+	if fi.RedirectTarget == "" || applyToRedirectRef(r) {
+		return false
+	}
+	target := fi.RedirectTarget
+	if u, err := internal.ParseURL(target); err == nil {
+		target = u.String()
+	}
+	w.Header().Set("Location", target)
+	w.Header().Set("Redirect-Ref", target)
+	w.WriteHeader(http.StatusFound)
+	return true
+}
+
+// handleRedirectRefPropFind redirects PROPFIND requests targeting a redirect
+// reference resource. Redirect references listed as members of a collection
+// are reported with their own properties.
+func (b *backend) handleRedirectRefPropFind(w http.ResponseWriter, r *http.Request) bool {
+	if applyToRedirectRef(r) || !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return false
+	}
+	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil {
+		// Errors are reported by the regular PROPFIND handler
+		return false
+	}
+	return serveRedirectRef(w, r, fi)
+}
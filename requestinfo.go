@@ -0,0 +1,164 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RequestInfo describes the HTTP request being served. Handlers store it in
+// the request context, where backends can retrieve it with
+// RequestInfoFromContext, e.g. to work around client bugs or to track abuse.
+type RequestInfo struct {
+	// ID identifies the request, e.g. in logs. It's taken from the
+	// X-Request-ID request header if any, or generated otherwise, and sent
+	// back in the X-Request-ID response header.
+	ID string
+	// RemoteIP is the IP address of the client, taken from
+	// http.Request.RemoteAddr. Deployments behind a reverse proxy should
+	// rewrite RemoteAddr beforehand.
+	RemoteIP net.IP
+	// UserAgent is the raw User-Agent request header.
+	UserAgent string
+	// Products lists the products of the User-Agent header, in order.
+	Products []UserAgentProduct
+}
+
+// UserAgentProduct is a product token of a User-Agent header, as defined in
+// RFC 7231 section 5.5.3, e.g. "DAVx5/4.3".
+type UserAgentProduct struct {
+	Name    string
+	Version string
+}
+
+// Product returns the version of the first User-Agent product with the given
+// name, compared case-insensitively.
+func (info *RequestInfo) Product(name string) (version string, ok bool) {
+	for _, p := range info.Products {
+		if strings.EqualFold(p.Name, name) {
+			return p.Version, true
+		}
+	}
+	return "", false
+}
+
+type requestInfoKey struct{}
+
+// NewRequestInfoContext returns a copy of ctx carrying info.
+func NewRequestInfoContext(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the RequestInfo stored in ctx, if any.
+func RequestInfoFromContext(ctx context.Context) (info *RequestInfo, ok bool) {
+	info, ok = ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// NewRequestInfo describes an HTTP request.
+func NewRequestInfo(r *http.Request) *RequestInfo {
+	info := &RequestInfo{
+		ID:        r.Header.Get("X-Request-ID"),
+		UserAgent: r.Header.Get("User-Agent"),
+	}
+	if !isValidRequestID(info.ID) {
+		info.ID = newRequestID()
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	info.RemoteIP = net.ParseIP(host)
+
+	info.Products = parseUserAgent(info.UserAgent)
+	return info
+}
+
+// WithRequestInfo returns a handler storing a RequestInfo in the context of
+// requests before calling next, unless one is already present. Handler,
+// caldav.Handler and carddav.Handler already do this.
+func WithRequestInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := RequestInfoFromContext(r.Context())
+		if !ok {
+			info = NewRequestInfo(r)
+			r = r.WithContext(NewRequestInfoContext(r.Context(), info))
+		}
+		w.Header().Set("X-Request-ID", info.ID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// isValidRequestID checks that a request ID supplied by a client can safely
+// be logged and echoed back.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseUserAgent extracts the products of a User-Agent header. Comments are
+// skipped.
+func parseUserAgent(s string) []UserAgentProduct {
+	var products []UserAgentProduct
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return products
+		}
+
+		if s[0] == '(' {
+			// Comments can be nested
+			depth := 0
+			i := 0
+			for ; i < len(s); i++ {
+				if s[i] == '(' {
+					depth++
+				} else if s[i] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if i == len(s) {
+				return products
+			}
+			s = s[i+1:]
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t(")
+		if end < 0 {
+			end = len(s)
+		}
+		token := s[:end]
+		s = s[end:]
+
+		var p UserAgentProduct
+		if i := strings.IndexByte(token, '/'); i >= 0 {
+			p.Name, p.Version = token[:i], token[i+1:]
+		} else {
+			p.Name = token
+		}
+		products = append(products, p)
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/xml"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-webdav/internal"
 )
@@ -24,24 +28,348 @@ type FileSystem interface {
 	Move(ctx context.Context, name, dest string, options *MoveOptions) (created bool, err error)
 }
 
+// WalkFileSystem is an optional interface which can be implemented by a
+// FileSystem to list large directories without holding all of their entries
+// in memory. PROPFIND responses are then streamed as files are visited.
+type WalkFileSystem interface {
+	FileSystem
+	// WalkDir calls fn for each file which would be returned by ReadDir. If
+	// fn returns an error, WalkDir stops and returns it. Types embedding a
+	// WalkFileSystem and overriding ReadDir must override WalkDir as well.
+	WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error
+}
+
+// ConditionalFileSystem is an optional interface which can be implemented by
+// a FileSystem to evaluate the If-Match and If-None-Match preconditions of PUT
+// requests atomically with the write. Otherwise, they're only checked before
+// the file is created, and a concurrent update may be overwritten.
+type ConditionalFileSystem interface {
+	FileSystem
+	// CreateWithOptions is like Create, but the preconditions are evaluated
+	// against the file when the writer is closed. Close fails with HTTP 412
+	// if they aren't met, and the file is left unchanged.
+	CreateWithOptions(ctx context.Context, name string, opts *CreateOptions) (io.WriteCloser, error)
+}
+
+// fileSystemWrapper is implemented by FileSystems wrapping another
+// FileSystem, such as the one returned by NewEncryptedFileSystem.
+type fileSystemWrapper interface {
+	unwrapFileSystem() FileSystem
+}
+
+// optionalFileSystem returns the FileSystem implementing the optional
+// interfaces of fs which don't handle file contents: SyncFileSystem,
+// DeadPropertyStore, PosixFileSystem and QuotaProvider. Wrapped FileSystems
+// forward these as is.
+func optionalFileSystem(fs FileSystem) FileSystem {
+	for {
+		w, ok := fs.(fileSystemWrapper)
+		if !ok {
+			return fs
+		}
+		fs = w.unwrapFileSystem()
+	}
+}
+
 // Handler handles WebDAV HTTP requests. It can be used to create a WebDAV
 // server.
 type Handler struct {
 	FileSystem FileSystem
+
+	// IdempotencyStore, if set, is used to deduplicate retried PUT and PATCH
+	// requests carrying an Idempotency-Key header.
+	IdempotencyStore IdempotencyStore
+	// Visibility, if set, is used to hide resources from GET, HEAD and
+	// PROPFIND requests.
+	Visibility VisibilityFunc
+	// AuditSink, if set, is notified of each successful mutating request.
+	AuditSink AuditSink
+	// ErrorLog specifies an optional logger for errors, e.g. panics in the
+	// backend. If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+	// ErrorVerbosity controls how much error detail is sent to clients.
+	// Server errors are always logged to ErrorLog.
+	ErrorVerbosity ErrorVerbosity
+	// TimeLayout, if set, overrides the layout used to format timestamps
+	// such as DAV:getlastmodified in generated XML, e.g. time.RFC3339 for
+	// clients expecting Z-suffixed UTC timestamps. Timestamps are always
+	// converted to UTC. By default, the HTTP-date format mandated by RFC 4918
+	// is used.
+	TimeLayout string
+	// Listing, if set, enables browser-friendly directory listings in
+	// response to GET requests on directories.
+	Listing *ListingOptions
+	// Overrides intercept requests before they're handled, e.g. to serve
+	// custom endpoints. The first matching override is used.
+	Overrides []Override
+	// Throttle, if set, returns the throttle limiting the bandwidth of a GET
+	// or PUT request, or nil for no limit. Return a new Throttle for each
+	// request to limit connections individually, or share a Throttle to
+	// limit all requests of a user.
+	Throttle func(r *http.Request) *Throttle
+	// LockSystem, if set, enables LOCK and UNLOCK requests. Locked resources
+	// can only be modified by requests submitting the lock token in an If
+	// header.
+	LockSystem LockSystem
+	// AuthorizePosix, if set, is called before POSIX metadata is modified via
+	// PROPPATCH, for FileSystems implementing PosixFileSystem. Returning an
+	// error rejects the change. If nil, changes are always rejected.
+	AuthorizePosix func(r *http.Request) error
+	// InfiniteDepth limits PROPFIND requests with "Depth: infinity".
+	InfiniteDepth InfiniteDepthLimits
+	// PropFindPageSize, if non-zero, limits the number of members listed in
+	// a single PROPFIND response. Larger listings are truncated as described
+	// in RFC 6578 section 3.6, and the DAV:error element of the truncated
+	// response carries a go-webdav next-page token which clients can send in
+	// a Page-Token header to list the following members. Members are listed
+	// in path order, and the token is a cursor after the last member of the
+	// page, so concurrent changes don't shift the following pages.
+	PropFindPageSize int
+	// PrivilegeChecker, if set, enables access control (RFC 3744). Requests
+	// are rejected if the current user lacks the required privileges, and
+	// resources the user can't read are omitted from listings. If it
+	// implements ACLStore, ACLs can be read and modified by clients.
+	PrivilegeChecker PrivilegeChecker
+	// WindowsCompat enables workarounds for the Windows WebDAV
+	// mini-redirector, so that shares can be mapped with "net use": OPTIONS
+	// responses advertise Microsoft authoring support, locks are emulated in
+	// memory if LockSystem is nil, collection paths end with a slash, and
+	// the Win32 properties set by Windows Explorer via PROPPATCH are
+	// accepted even if they can't be stored.
+	WindowsCompat bool
+	// Finder, if set, enables workarounds for the macOS Finder: locks are
+	// emulated in memory if LockSystem is nil, since Finder mounts shares
+	// read-only otherwise, UNLOCK requests for expired locks succeed, quotas
+	// are only computed for the requested collection in PROPFIND responses,
+	// and metadata files are handled according to the AppleDouble policy.
+	Finder *FinderOptions
+	// UserPrincipal, if set, is used to report the DAV:current-user-principal
+	// property (RFC 5397) in PROPFIND responses, e.g. auth.UserPrincipal to
+	// report the authenticated user.
+	UserPrincipal UserPrincipalBackend
+	// Diagnostics, if set, logs the result of ComplianceReport to ErrorLog
+	// when the first request is served.
+	Diagnostics bool
+	// SortResponses sorts the responses of PROPFIND and REPORT requests by
+	// href, e.g. for caching proxies or clients which depend on the order.
+	// Otherwise, resources are listed in the order of the FileSystem. Large
+	// PROPFIND responses are buffered instead of streamed.
+	SortResponses bool
+
+	compatLocks     MemLockSystem
+	uploads         pathLocks
+	diagnosticsOnce sync.Once
+}
+
+// InfiniteDepthLimits limits PROPFIND requests with "Depth: infinity", which
+// list whole trees. Rejected requests fail with the DAV:propfind-finite-depth
+// precondition error, and clients are expected to fall back to "Depth: 1".
+type InfiniteDepthLimits struct {
+	// Disabled rejects all requests.
+	Disabled bool
+	// MaxResources and MaxDepth, if non-zero, limit the number of listed
+	// resources and the number of levels below the requested collection.
+	// Requests exceeding a limit are rejected.
+	MaxResources int
+	MaxDepth     int
+}
+
+func (h *Handler) errorReporter() *internal.ErrorReporter {
+	return &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(h.ErrorVerbosity),
+		Logger:    h.ErrorLog,
+	}
 }
 
 // ServeHTTP implements http.Handler.
+//
+// Panics in the backend are recovered from and result in a 500 Internal
+// Server Error response.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Diagnostics {
+		h.diagnosticsOnce.Do(h.logComplianceReport)
+	}
+	internal.ServeRecover(w, r, h.ErrorLog, http.HandlerFunc(h.serveHTTP))
+}
+
+func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.FileSystem == nil {
-		http.Error(w, "webdav: no filesystem available", http.StatusInternalServerError)
+		h.errorReporter().ServeError(w, r, internal.HTTPErrorf(http.StatusInternalServerError, "webdav: no filesystem available"))
+		return
+	}
+
+	r, err := internal.SanitizeRequest(r)
+	if err != nil {
+		h.errorReporter().ServeError(w, r, err)
+		return
+	}
+
+	WithRequestInfo(WithOverrides(h.Overrides, http.HandlerFunc(h.serveDAV))).ServeHTTP(w, r)
+}
+
+func (h *Handler) serveDAV(w http.ResponseWriter, r *http.Request) {
+	if h.Throttle != nil {
+		if t := h.Throttle(r); t != nil {
+			w, r = throttle(t, w, r)
+		}
+	}
+
+	b := backend{
+		FileSystem:       h.FileSystem,
+		Visibility:       h.Finder.visibility(h.Visibility),
+		TimeLayout:       h.TimeLayout,
+		Listing:          h.Listing,
+		LockSystem:       h.LockSystem,
+		AuthorizePosix:   h.AuthorizePosix,
+		InfiniteDepth:    h.InfiniteDepth,
+		PropFindPageSize: h.PropFindPageSize,
+
+		PrivilegeChecker: h.PrivilegeChecker,
+		WindowsCompat:    h.WindowsCompat,
+		Finder:           h.Finder,
+		UserPrincipal:    h.UserPrincipal,
+		SortResponses:    h.SortResponses,
+		uploads:          &h.uploads,
+	}
+	if b.LockSystem == nil && (h.WindowsCompat || h.Finder != nil) {
+		// Windows and macOS mount shares read-only if locking is unsupported
+		b.LockSystem = &h.compatLocks
+	}
+	if h.WindowsCompat && r.Method == http.MethodOptions {
+		w.Header().Set("MS-Author-Via", "DAV")
+	}
+
+	if h.PrivilegeChecker != nil {
+		if err := b.checkRequestPrivileges(r); err != nil {
+			h.errorReporter().ServeError(w, r, err)
+			return
+		}
+	}
+	if store, ok := h.PrivilegeChecker.(ACLStore); ok && r.Method == "ACL" {
+		if err := b.handleACL(w, r, store); err != nil {
+			h.errorReporter().ServeError(w, r, err)
+		}
+		return
+	}
+
+	if b.LockSystem != nil && (r.Method == "LOCK" || r.Method == "UNLOCK") {
+		var err error
+		if r.Method == "LOCK" {
+			err = b.handleLock(w, r)
+		} else {
+			err = b.handleUnlock(w, r)
+		}
+		if err != nil {
+			h.errorReporter().ServeError(w, r, err)
+		}
+		return
+	}
+	if fs, ok := optionalFileSystem(h.FileSystem).(SyncFileSystem); ok && r.Method == "REPORT" {
+		if err := b.handleSyncCollection(w, r, fs); err != nil {
+			h.errorReporter().ServeError(w, r, err)
+		}
+		return
+	}
+	if r.Method == "PROPFIND" && b.handleRedirectRefPropFind(w, r) {
 		return
 	}
 
-	b := backend{h.FileSystem}
-	hh := internal.Handler{&b}
+	hh := internal.Handler{
+		Backend:          &b,
+		IdempotencyStore: h.IdempotencyStore,
+		ErrorReporter:    h.errorReporter(),
+		SortResponses:    h.SortResponses,
+	}
+	if h.AuditSink != nil {
+		hh.Audit = func(ctx context.Context, event *internal.AuditEvent) {
+			h.AuditSink.Audit(ctx, (*AuditEvent)(event))
+		}
+	}
 	hh.ServeHTTP(w, r)
 }
 
+// IdempotentPut is the outcome of a successful PUT or PATCH request carrying
+// an Idempotency-Key header, as recorded by an IdempotencyStore. RequestHash
+// identifies the target and the payload of the request, StatusCode, Location
+// and ETag are replayed in the response to retries. A zero StatusCode marks
+// a request which is still in progress.
+type IdempotentPut = internal.IdempotentPut
+
+// IdempotencyStore records the outcome of recent PUT and PATCH requests
+// carrying an Idempotency-Key header. When a client retries a request with
+// the same key (e.g. after a timeout), the recorded outcome is replayed
+// instead of writing the resource again. A key reused for a request with a
+// different payload is rejected with 422 Unprocessable Entity, and retries
+// sent while the original request is in progress with 409 Conflict.
+//
+// Keys are scoped to the request path, and namespaced by the current user
+// principal if the backend reports it. Implementations are expected to
+// expire old entries.
+type IdempotencyStore interface {
+	// LoadPut returns the outcome recorded for a previous request, or nil if
+	// no request with this key has been recorded.
+	LoadPut(ctx context.Context, path, key string) (*IdempotentPut, error)
+	// StorePut records the outcome of a request. It's called with a zero
+	// StatusCode to reserve the key before the request is applied, and
+	// again once it has succeeded.
+	StorePut(ctx context.Context, path, key string, put *IdempotentPut) error
+	// DeletePut releases the key of a request which failed, so that it can
+	// be retried.
+	DeletePut(ctx context.Context, path, key string) error
+}
+
+// ErrorVerbosity controls how much error detail is sent to clients. Details
+// hidden from clients are logged along with an error ID, which is included in
+// the response.
+type ErrorVerbosity int
+
+const (
+	// ErrorVerbosityFull sends full error messages to clients.
+	ErrorVerbosityFull ErrorVerbosity = iota
+	// ErrorVerbosityClientErrors sends full error messages for client errors
+	// (4xx) only, other errors are replaced with a generic message.
+	ErrorVerbosityClientErrors
+	// ErrorVerbosityNone replaces all error messages with a generic message.
+	ErrorVerbosityNone
+)
+
+// AuditEvent describes a successful mutating request (PUT, PATCH, DELETE,
+// MKCOL, PROPPATCH, COPY or MOVE).
+type AuditEvent struct {
+	// Method is the request method.
+	Method string
+	// Principal is the path of the current user principal, if the backend
+	// exposes one.
+	Principal string
+	// Path is the request path.
+	Path string
+	// Destination is the destination path of COPY and MOVE requests.
+	Destination string
+	// ETagBefore and ETagAfter are the ETags of the affected resource before
+	// and after the request, if any.
+	ETagBefore string
+	ETagAfter  string
+}
+
+// AuditSink receives events for mutating requests, e.g. for compliance
+// logging.
+type AuditSink interface {
+	Audit(ctx context.Context, event *AuditEvent)
+}
+
+// VisibilityFunc reports whether the resource at the given path is visible to
+// the user making the request. The request context is passed so that
+// applications can look up the current principal.
+//
+// Hidden resources are reported as not found and are omitted from listings.
+type VisibilityFunc func(ctx context.Context, path string) bool
+
+// IsVisible reports whether the resource at the given path is visible. A nil
+// VisibilityFunc makes all resources visible.
+func (f VisibilityFunc) IsVisible(ctx context.Context, path string) bool {
+	return f == nil || f(ctx, path)
+}
+
 // NewHTTPError creates a new error that is associated with an HTTP status code
 // and optionally an error that lead to it. Backends can use this functions to
 // return errors that convey some semantics (e.g. 404 not found, 403 access
@@ -53,12 +381,48 @@ func NewHTTPError(statusCode int, cause error) error {
 
 type backend struct {
 	FileSystem FileSystem
+	Visibility VisibilityFunc
+	TimeLayout string
+	Listing    *ListingOptions
+	LockSystem LockSystem
+
+	AuthorizePosix   func(r *http.Request) error
+	InfiniteDepth    InfiniteDepthLimits
+	PropFindPageSize int
+
+	PrivilegeChecker PrivilegeChecker
+	WindowsCompat    bool
+	Finder           *FinderOptions
+	UserPrincipal    UserPrincipalBackend
+	SortResponses    bool
+
+	uploads *pathLocks
+}
+
+// CurrentUserPrincipal returns the principal reported by UserPrincipal, if
+// any. It identifies the user in audit events and idempotency keys.
+func (b *backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	if b.UserPrincipal == nil {
+		return "", nil
+	}
+	return b.UserPrincipal.CurrentUserPrincipal(ctx)
 }
 
 func (b *backend) Options(r *http.Request) (caps []string, allow []string, err error) {
+	if b.LockSystem != nil {
+		caps = []string{"2"}
+	}
+	if b.PrivilegeChecker != nil {
+		caps = append(caps, "access-control")
+	}
+
 	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
 	if internal.IsNotFound(err) {
-		return nil, []string{http.MethodOptions, http.MethodPut, "MKCOL"}, nil
+		allow = []string{http.MethodOptions, http.MethodPut, "MKCOL"}
+		if b.LockSystem != nil {
+			allow = append(allow, "LOCK")
+		}
+		return caps, allow, nil
 	} else if err != nil {
 		return nil, nil, err
 	}
@@ -73,17 +437,46 @@ func (b *backend) Options(r *http.Request) (caps []string, allow []string, err e
 
 	if !fi.IsDir {
 		allow = append(allow, http.MethodHead, http.MethodGet, http.MethodPut)
+	} else if b.Listing != nil {
+		allow = append(allow, http.MethodHead, http.MethodGet)
+	}
+	if _, ok := b.FileSystem.(AppendFileSystem); ok && !fi.IsDir {
+		allow = append(allow, http.MethodPatch)
+	}
+	if _, ok := optionalFileSystem(b.FileSystem).(SyncFileSystem); ok && fi.IsDir {
+		allow = append(allow, "REPORT")
+	}
+	_, hasPosix := optionalFileSystem(b.FileSystem).(PosixFileSystem)
+	_, hasStore := optionalFileSystem(b.FileSystem).(DeadPropertyStore)
+	if hasPosix || hasStore {
+		allow = append(allow, "PROPPATCH")
+	}
+	if b.LockSystem != nil {
+		allow = append(allow, "LOCK", "UNLOCK")
+	}
+	if _, ok := b.PrivilegeChecker.(ACLStore); ok {
+		allow = append(allow, "ACL")
 	}
 
-	return nil, allow, nil
+	return caps, allow, nil
 }
 
 func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
+	if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
 	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
 	if err != nil {
 		return err
 	}
+	if serveRedirectRef(w, r, fi) {
+		return nil
+	}
 	if fi.IsDir {
+		if b.Listing != nil {
+			return b.serveListing(w, r, fi)
+		}
 		return &internal.HTTPError{Code: http.StatusMethodNotAllowed}
 	}
 
@@ -93,7 +486,6 @@ func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
 	}
 	defer f.Close()
 
-	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
 	if fi.MIMEType != "" {
 		w.Header().Set("Content-Type", fi.MIMEType)
 	}
@@ -103,11 +495,17 @@ func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
 	if fi.ETag != "" {
 		w.Header().Set("ETag", internal.ETag(fi.ETag).String())
 	}
+	if fi.DownloadName != "" {
+		w.Header().Set("Content-Disposition", internal.FormatContentDisposition(fi.DownloadName))
+	}
 
 	if rs, ok := f.(io.ReadSeeker); ok {
 		// If it's an io.Seeker, use http.ServeContent which supports ranges
+		// and sets Content-Length according to the requested ranges
 		http.ServeContent(w, r, r.URL.Path, fi.ModTime, rs)
 	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
+		w.Header().Set("Accept-Ranges", "none")
 		if r.Method != http.MethodHead {
 			io.Copy(w, f)
 		}
@@ -115,42 +513,209 @@ func (b *backend) HeadGet(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (b *backend) serveListing(w http.ResponseWriter, r *http.Request, fi *FileInfo) error {
+	children, err := b.FileSystem.ReadDir(r.Context(), r.URL.Path, false)
+	if err != nil {
+		return err
+	}
+
+	listing := Listing{Path: r.URL.Path}
+	for _, child := range children {
+		p := strings.TrimSuffix(child.Path, "/")
+		if p == strings.TrimSuffix(fi.Path, "/") || !b.Visibility.IsVisible(r.Context(), child.Path) || !b.canRead(r.Context(), child.Path) {
+			continue
+		}
+		entry := ListingEntry{
+			Name:         path.Base(p),
+			Path:         p,
+			IsCollection: child.IsDir,
+			ModTime:      child.ModTime,
+		}
+		if child.IsDir {
+			entry.Path += "/"
+		} else {
+			entry.Size = child.Size
+			entry.ContentType = child.MIMEType
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	return b.Listing.ServeListing(w, r, &listing)
+}
+
 func (b *backend) PropFind(r *http.Request, propfind *internal.PropFind, depth internal.Depth) (*internal.MultiStatus, error) {
+	var resps []internal.Response
+	err := b.PropFindStream(r, propfind, depth, func(resp *internal.Response) error {
+		resps = append(resps, *resp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewMultiStatus(resps...), nil
+}
+
+func (b *backend) PropFindStream(r *http.Request, propfind *internal.PropFind, depth internal.Depth, fn func(resp *internal.Response) error) error {
 	// TODO: use partial error Response on error
 
+	if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
 	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var resps []internal.Response
-	if depth != internal.DepthZero && fi.IsDir {
-		children, err := b.FileSystem.ReadDir(r.Context(), r.URL.Path, depth == internal.DepthInfinity)
+	if depth == internal.DepthZero || !fi.IsDir {
+		resp, err := b.propFindFile(r.Context(), propfind, fi, false)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		return fn(resp)
+	}
 
-		resps = make([]internal.Response, len(children))
-		for i, child := range children {
-			resp, err := b.propFindFile(propfind, &child)
-			if err != nil {
-				return nil, err
-			}
-			resps[i] = *resp
+	if depth == internal.DepthInfinity && b.InfiniteDepth.Disabled {
+		return internal.ErrPropFindFiniteDepth
+	}
+
+	if b.PropFindPageSize > 0 {
+		return b.propFindPage(r, propfind, fi, depth == internal.DepthInfinity, fn)
+	}
+
+	visit := func(child *FileInfo) error {
+		if !b.Visibility.IsVisible(r.Context(), child.Path) || !b.canRead(r.Context(), child.Path) {
+			return nil
+		}
+		member := path.Clean(child.Path) != path.Clean(fi.Path)
+		resp, err := b.propFindFile(r.Context(), propfind, child, member)
+		if err != nil {
+			return err
+		}
+		return fn(resp)
+	}
+
+	return b.walkPropFind(r, fi, depth == internal.DepthInfinity, visit)
+}
+
+// propFindPage lists a page of a collection's members, following the cursor
+// sent by the client in the Page-Token header.
+func (b *backend) propFindPage(r *http.Request, propfind *internal.PropFind, fi *FileInfo, recursive bool, fn func(resp *internal.Response) error) error {
+	after, err := parsePageToken(r.Header.Get(pageTokenHeader))
+	if err != nil {
+		return err
+	}
+
+	page := memberPage{after: after, size: b.PropFindPageSize}
+	var self *FileInfo
+	err = b.walkPropFind(r, fi, recursive, func(child *FileInfo) error {
+		if !b.Visibility.IsVisible(r.Context(), child.Path) || !b.canRead(r.Context(), child.Path) {
+			return nil
+		}
+		if path.Clean(child.Path) != path.Clean(fi.Path) {
+			page.add(child)
+		} else if after == "" {
+			// The collection itself is only listed in the first page
+			fi := *child
+			self = &fi
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if self != nil {
+		resp, err := b.propFindFile(r.Context(), propfind, self, false)
+		if err != nil {
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+	members, next := page.members()
+	for i := range members {
+		resp, err := b.propFindFile(r.Context(), propfind, &members[i], true)
+		if err != nil {
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+	if next == "" {
+		return nil
+	}
+	resp, err := newNextPageResponse(fi.Path, next)
+	if err != nil {
+		return err
+	}
+	return fn(resp)
+}
+
+func (b *backend) walkPropFind(r *http.Request, fi *FileInfo, recursive bool, visit func(child *FileInfo) error) error {
+	limited := recursive && b.InfiniteDepth.limited()
+	if wfs, ok := b.FileSystem.(WalkFileSystem); ok && !limited {
+		return wfs.WalkDir(r.Context(), r.URL.Path, recursive, visit)
+	}
+
+	// Limits need to be checked before responding: collect the listing, and
+	// stop walking as soon as a limit is exceeded
+	var children []FileInfo
+	if wfs, ok := b.FileSystem.(WalkFileSystem); ok {
+		err := wfs.WalkDir(r.Context(), r.URL.Path, recursive, func(child *FileInfo) error {
+			children = append(children, *child)
+			return b.InfiniteDepth.checkFile(fi.Path, len(children), child)
+		})
+		if err != nil {
+			return err
 		}
 	} else {
-		resp, err := b.propFindFile(propfind, fi)
+		var err error
+		children, err = b.FileSystem.ReadDir(r.Context(), r.URL.Path, recursive)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if limited {
+			for i := range children {
+				if err := b.InfiniteDepth.checkFile(fi.Path, i+1, &children[i]); err != nil {
+					return err
+				}
+			}
 		}
+	}
 
-		resps = []internal.Response{*resp}
+	for i := range children {
+		if err := visit(&children[i]); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return internal.NewMultiStatus(resps...), nil
+func (limits *InfiniteDepthLimits) limited() bool {
+	return limits.MaxResources > 0 || limits.MaxDepth > 0
 }
 
-func (b *backend) propFindFile(propfind *internal.PropFind, fi *FileInfo) (*internal.Response, error) {
+// checkFile checks the n-th file listed below root against the limits.
+func (limits *InfiniteDepthLimits) checkFile(root string, n int, fi *FileInfo) error {
+	if limits.MaxResources > 0 && n > limits.MaxResources {
+		return internal.ErrPropFindFiniteDepth
+	}
+	if limits.MaxDepth > 0 {
+		root = strings.TrimSuffix(root, "/")
+		rel := strings.TrimPrefix(strings.TrimSuffix(fi.Path, "/"), root)
+		if strings.Count(rel, "/") > limits.MaxDepth {
+			return internal.ErrPropFindFiniteDepth
+		}
+	}
+	return nil
+}
+
+// propFindFile builds the PROPFIND response for a file. member is set if the
+// file is listed as a member of the requested collection.
+func (b *backend) propFindFile(ctx context.Context, propfind *internal.PropFind, fi *FileInfo, member bool) (*internal.Response, error) {
 	props := make(map[xml.Name]internal.PropFindFunc)
 
 	props[internal.ResourceTypeName] = func(*internal.RawXMLValue) (interface{}, error) {
@@ -158,9 +723,32 @@ func (b *backend) propFindFile(propfind *internal.PropFind, fi *FileInfo) (*inte
 		if fi.IsDir {
 			types = append(types, internal.CollectionName)
 		}
+		if fi.RedirectTarget != "" {
+			types = append(types, redirectRefName)
+		}
 		return internal.NewResourceType(types...), nil
 	}
 
+	if fi.RedirectTarget != "" {
+		props[refTargetName] = func(*internal.RawXMLValue) (interface{}, error) {
+			u, err := internal.ParseURL(fi.RedirectTarget)
+			if err != nil {
+				return nil, err
+			}
+			return &refTarget{Href: internal.Href(*u)}, nil
+		}
+	}
+
+	if fs, ok := optionalFileSystem(b.FileSystem).(SyncFileSystem); ok && fi.IsDir {
+		props[internal.SyncTokenName] = func(*internal.RawXMLValue) (interface{}, error) {
+			token, err := fs.SyncToken(ctx, fi.Path)
+			if err != nil {
+				return nil, err
+			}
+			return &internal.SyncToken{Token: token}, nil
+		}
+	}
+
 	if !fi.IsDir {
 		props[internal.GetContentLengthName] = func(*internal.RawXMLValue) (interface{}, error) {
 			return &internal.GetContentLength{Length: fi.Size}, nil
@@ -168,7 +756,10 @@ func (b *backend) propFindFile(propfind *internal.PropFind, fi *FileInfo) (*inte
 
 		if !fi.ModTime.IsZero() {
 			props[internal.GetLastModifiedName] = func(*internal.RawXMLValue) (interface{}, error) {
-				return &internal.GetLastModified{LastModified: internal.Time(fi.ModTime)}, nil
+				return &internal.GetLastModified{
+					LastModified: internal.Time(fi.ModTime),
+					Layout:       b.TimeLayout,
+				}, nil
 			}
 		}
 
@@ -185,17 +776,191 @@ func (b *backend) propFindFile(propfind *internal.PropFind, fi *FileInfo) (*inte
 		}
 	}
 
-	return internal.NewPropFindResponse(fi.Path, propfind, props)
+	if b.UserPrincipal != nil {
+		props[internal.CurrentUserPrincipalName] = func(*internal.RawXMLValue) (interface{}, error) {
+			p, err := b.UserPrincipal.CurrentUserPrincipal(ctx)
+			if err != nil && isHTTPErrorCode(err, http.StatusUnauthorized) {
+				return &internal.CurrentUserPrincipal{Unauthenticated: &struct{}{}}, nil
+			} else if err != nil {
+				return nil, err
+			}
+			return &internal.CurrentUserPrincipal{Href: internal.Href{Path: p}}, nil
+		}
+	}
+	if b.LockSystem != nil {
+		addLockProps(ctx, props, b, fi.Path)
+	}
+	if fs, ok := optionalFileSystem(b.FileSystem).(PosixFileSystem); ok {
+		addPosixProps(ctx, props, fs, fi.Path)
+	}
+	if b.PrivilegeChecker != nil {
+		addACLProps(ctx, props, b, fi.Path)
+	}
+	if qp, ok := optionalFileSystem(b.FileSystem).(QuotaProvider); ok && fi.IsDir && !(member && b.Finder != nil) {
+		// Finder requests quotas for all members, but only uses the
+		// requested collection's
+		addQuotaProps(ctx, props, qp, fi.Path)
+	}
+	if store, ok := optionalFileSystem(b.FileSystem).(DeadPropertyStore); ok && !internal.PropFindHasOnly(propfind, props) {
+		if err := internal.AddDeadProps(ctx, props, store, fi.Path, isLiveProp); err != nil {
+			return nil, err
+		}
+	}
+
+	p := fi.Path
+	if b.WindowsCompat && fi.IsDir {
+		p = compatCollectionPath(p)
+	}
+	return internal.NewPropFindResponse(p, propfind, props)
 }
 
 func (b *backend) PropPatch(r *http.Request, update *internal.PropertyUpdate) (*internal.Response, error) {
-	// TODO: return a failed Response instead
-	return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: PROPPATCH is unsupported")
+	posixFS, hasPosix := optionalFileSystem(b.FileSystem).(PosixFileSystem)
+	store, hasStore := optionalFileSystem(b.FileSystem).(DeadPropertyStore)
+	if !hasPosix && !hasStore && !b.WindowsCompat {
+		// TODO: return a failed Response instead
+		return nil, internal.HTTPErrorf(http.StatusForbidden, "webdav: PROPPATCH is unsupported")
+	}
+	if err := b.checkLocks(r, r.URL.Path, false); err != nil {
+		return nil, err
+	}
+	if _, err := b.FileSystem.Stat(r.Context(), r.URL.Path); err != nil {
+		return nil, err
+	}
+
+	var md, newMD PosixMetadata
+	if hasPosix {
+		p, err := posixFS.PosixMetadata(r.Context(), r.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		md, newMD = *p, *p
+	}
+
+	var names []xml.Name
+	failed := make(map[xml.Name]int)
+	set := make(map[xml.Name]string)
+	for _, s := range update.Set {
+		for i := range s.Prop.Raw {
+			raw := &s.Prop.Raw[i]
+			name, ok := raw.XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+
+			switch {
+			case hasPosix && name.Space == PosixNamespace:
+				if code := setPosixProp(&newMD, name, raw); code != 0 {
+					failed[name] = code
+				}
+			case b.WindowsCompat && !hasStore && name.Space == win32Namespace:
+				// Ignored, Windows Explorer fails to copy files otherwise
+			case !hasStore || isLiveProp(name):
+				failed[name] = http.StatusForbidden
+			default:
+				v, err := internal.DeadPropValue(raw)
+				if err != nil {
+					failed[name] = http.StatusBadRequest
+				} else {
+					set[name] = v
+				}
+			}
+		}
+	}
+
+	var remove []xml.Name
+	for _, rm := range update.Remove {
+		for i := range rm.Prop.Raw {
+			name, ok := rm.Prop.Raw[i].XMLName()
+			if !ok {
+				continue
+			}
+			names = append(names, name)
+
+			switch {
+			case hasPosix && name.Space == PosixNamespace, isLiveProp(name):
+				failed[name] = http.StatusForbidden
+			case hasStore:
+				remove = append(remove, name)
+			}
+			// Removing a property which doesn't exist isn't an error
+		}
+	}
+
+	if len(failed) == 0 {
+		if newMD != md {
+			if err := b.setPosixMetadata(r, posixFS, &newMD); err != nil {
+				return nil, err
+			}
+		}
+		if hasStore {
+			if err := internal.UpdateDeadProperties(r.Context(), store, r.URL.Path, set, remove); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return internal.NewPropPatchResponse(r.URL.Path, names, failed)
 }
 
-func (b *backend) Put(r *http.Request) (*internal.Href, error) {
-	wc, err := b.FileSystem.Create(r.Context(), r.URL.Path)
-	if err != nil {
+// isLiveProp reports whether a property is maintained by the server.
+func isLiveProp(name xml.Name) bool {
+	switch name {
+	case internal.ResourceTypeName, internal.GetContentLengthName,
+		internal.GetLastModifiedName, internal.GetContentTypeName,
+		internal.GetETagName, internal.SyncTokenName,
+		lockDiscoveryName, supportedLockName, refTargetName,
+		ownerName, aclName, currentUserPrivilegeSetName,
+		supportedPrivilegeSetName, principalCollectionSetName,
+		quotaAvailableBytesName, quotaUsedBytesName,
+		internal.CurrentUserPrincipalName:
+		return true
+	}
+	return false
+}
+
+func (b *backend) SupportsDryRun(r *http.Request) bool {
+	return true
+}
+
+func (b *backend) Put(r *http.Request) (*internal.PutResult, error) {
+	if err := b.checkLocks(r, r.URL.Path, false); err != nil {
+		return nil, err
+	}
+	if err := b.Finder.checkCreate(r.URL.Path); err != nil {
+		return nil, err
+	}
+	if b.Finder.discards(r.URL.Path) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		return nil, err
+	}
+	if qp, ok := optionalFileSystem(b.FileSystem).(QuotaProvider); ok {
+		if err := checkQuota(r, qp); err != nil {
+			return nil, err
+		}
+	}
+
+	if internal.IsDryRun(r.Header) {
+		return nil, b.checkCreateFile(r.Context(), r.URL.Path)
+	}
+
+	var (
+		wc  io.WriteCloser
+		err error
+	)
+	opts := CreateOptions{
+		IfMatch:     ConditionalMatch(r.Header.Get("If-Match")),
+		IfNoneMatch: ConditionalMatch(r.Header.Get("If-None-Match")),
+	}
+	if cfs, ok := b.FileSystem.(ConditionalFileSystem); ok && (opts.IfMatch.IsSet() || opts.IfNoneMatch.IsSet()) {
+		wc, err = cfs.CreateWithOptions(r.Context(), r.URL.Path, &opts)
+	} else {
+		wc, err = b.FileSystem.Create(r.Context(), r.URL.Path)
+	}
+	if internal.IsNotFound(err) {
+		return nil, &internal.HTTPError{Code: http.StatusConflict, Err: err}
+	} else if err != nil {
 		return nil, err
 	}
 	defer wc.Close()
@@ -203,18 +968,58 @@ func (b *backend) Put(r *http.Request) (*internal.Href, error) {
 	if _, err := io.Copy(wc, r.Body); err != nil {
 		return nil, err
 	}
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
 
-	return nil, wc.Close()
+	// The file is stored verbatim, so its ETag can be sent back
+	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &internal.PutResult{ETag: fi.ETag}, nil
+}
+
+// checkCreateFile checks that a PUT request can create or replace a file: its
+// parent must be a collection, and it must not be a collection itself.
+func (b *backend) checkCreateFile(ctx context.Context, p string) error {
+	if fi, err := b.FileSystem.Stat(ctx, p); err == nil && fi.IsDir {
+		return internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: %q is a collection", p)
+	} else if err != nil && !internal.IsNotFound(err) {
+		return err
+	}
+
+	parent, err := b.FileSystem.Stat(ctx, path.Dir(strings.TrimSuffix(p, "/")))
+	if internal.IsNotFound(err) || (err == nil && !parent.IsDir) {
+		return internal.HTTPErrorf(http.StatusConflict, "webdav: parent collection of %q doesn't exist", p)
+	}
+	return err
 }
 
 func (b *backend) Delete(r *http.Request) error {
-	return b.FileSystem.RemoveAll(r.Context(), r.URL.Path)
+	if err := b.checkLocks(r, r.URL.Path, true); err != nil {
+		return err
+	}
+	err := b.FileSystem.RemoveAll(r.Context(), r.URL.Path)
+	if internal.IsNotFound(err) && b.Finder.discards(r.URL.Path) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.removeLocks(r.Context(), r.URL.Path)
 }
 
 func (b *backend) Mkcol(r *http.Request) error {
 	if r.Header.Get("Content-Type") != "" {
 		return internal.HTTPErrorf(http.StatusUnsupportedMediaType, "webdav: request body not supported in MKCOL request")
 	}
+	if err := b.checkLocks(r, r.URL.Path, false); err != nil {
+		return err
+	}
+	if err := b.Finder.checkCreate(r.URL.Path); err != nil {
+		return err
+	}
 	err := b.FileSystem.Mkdir(r.Context(), r.URL.Path)
 	if internal.IsNotFound(err) {
 		return &internal.HTTPError{Code: http.StatusConflict, Err: err}
@@ -223,6 +1028,14 @@ func (b *backend) Mkcol(r *http.Request) error {
 }
 
 func (b *backend) Copy(r *http.Request, dest *internal.Href, recursive, overwrite bool) (created bool, err error) {
+	if err := b.checkLocks(r, dest.Path, true); err != nil {
+		return false, err
+	}
+	if discard, err := b.Finder.discardsCopy(r.URL.Path, dest.Path); err != nil {
+		return false, err
+	} else if discard {
+		return true, nil
+	}
 	options := CopyOptions{
 		NoRecursive: !recursive,
 		NoOverwrite: !overwrite,
@@ -235,14 +1048,27 @@ func (b *backend) Copy(r *http.Request, dest *internal.Href, recursive, overwrit
 }
 
 func (b *backend) Move(r *http.Request, dest *internal.Href, overwrite bool) (created bool, err error) {
+	if err := b.checkLocks(r, r.URL.Path, true); err != nil {
+		return false, err
+	}
+	if err := b.checkLocks(r, dest.Path, true); err != nil {
+		return false, err
+	}
+	if discard, err := b.Finder.discardsCopy(r.URL.Path, dest.Path); err != nil {
+		return false, err
+	} else if discard {
+		return true, b.Delete(r)
+	}
 	options := MoveOptions{
 		NoOverwrite: !overwrite,
 	}
 	created, err = b.FileSystem.Move(r.Context(), r.URL.Path, dest.Path, &options)
 	if os.IsExist(err) {
 		return false, &internal.HTTPError{http.StatusPreconditionFailed, err}
+	} else if err != nil {
+		return false, err
 	}
-	return created, err
+	return created, b.removeLocks(r.Context(), r.URL.Path)
 }
 
 // BackendSuppliedHomeSet represents either a CalDAV calendar-home-set or a
@@ -268,10 +1094,18 @@ type ServePrincipalOptions struct {
 	CurrentUserPrincipalPath string
 	HomeSets                 []BackendSuppliedHomeSet
 	Capabilities             []Capability
+	// ErrorLog and ErrorVerbosity are used like the Handler fields of the
+	// same name.
+	ErrorLog       *log.Logger
+	ErrorVerbosity ErrorVerbosity
 }
 
 // ServePrincipal replies to requests for a principal URL.
 func ServePrincipal(w http.ResponseWriter, r *http.Request, options *ServePrincipalOptions) {
+	errs := &internal.ErrorReporter{
+		Verbosity: internal.ErrorVerbosity(options.ErrorVerbosity),
+		Logger:    options.ErrorLog,
+	}
 	switch r.Method {
 	case http.MethodOptions:
 		caps := []string{"1", "3"}
@@ -284,10 +1118,10 @@ func ServePrincipal(w http.ResponseWriter, r *http.Request, options *ServePrinci
 		w.WriteHeader(http.StatusNoContent)
 	case "PROPFIND":
 		if err := servePrincipalPropfind(w, r, options); err != nil {
-			internal.ServeError(w, err)
+			errs.ServeError(w, r, err)
 		}
 	default:
-		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		errs.ServeError(w, r, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: unsupported method"))
 	}
 }
 
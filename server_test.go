@@ -0,0 +1,3323 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// newTestFileSystem returns a MemFileSystem holding files, keyed by path.
+// Paths ending with a slash are created as empty directories.
+func newTestFileSystem(t *testing.T, files map[string]string) *MemFileSystem {
+	fs := &MemFileSystem{}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			mkdirTestFile(t, fs, name)
+		} else {
+			writeTestFile(t, fs, name, files[name])
+		}
+	}
+	return fs
+}
+
+// mkdirTestFile creates a directory and its missing parents.
+func mkdirTestFile(t *testing.T, fs FileSystem, name string) {
+	ctx := context.Background()
+	p := "/"
+	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
+		p = path.Join(p, elem)
+		if _, err := fs.Stat(ctx, p); internal.IsNotFound(err) {
+			if err := fs.Mkdir(ctx, p); err != nil {
+				t.Fatalf("Mkdir(%q) = %v", p, err)
+			}
+		} else if err != nil {
+			t.Fatalf("Stat(%q) = %v", p, err)
+		}
+	}
+}
+
+// writeTestFile writes a file, creating its missing parent directories.
+func writeTestFile(t *testing.T, fs FileSystem, name, data string) {
+	if dir := path.Dir(name); dir != "/" {
+		mkdirTestFile(t, fs, dir)
+	}
+	wc, err := fs.Create(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Create(%q) = %v", name, err)
+	}
+	io.WriteString(wc, data)
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Close(%q) = %v", name, err)
+	}
+}
+
+// readTestFile returns the contents of a file.
+func readTestFile(t *testing.T, fs FileSystem, name string) string {
+	rc, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Open(%q) = %v", name, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%q) = %v", name, err)
+	}
+	return string(b)
+}
+
+// testFileExists reports whether a file exists.
+func testFileExists(t *testing.T, fs FileSystem, name string) bool {
+	_, err := fs.Stat(context.Background(), name)
+	if err != nil && !internal.IsNotFound(err) {
+		t.Fatalf("Stat(%q) = %v", name, err)
+	}
+	return err == nil
+}
+
+type testIdempotencyStore map[string]*IdempotentPut
+
+func (s testIdempotencyStore) LoadPut(ctx context.Context, path, key string) (*IdempotentPut, error) {
+	return s[path+"\x00"+key], nil
+}
+
+func (s testIdempotencyStore) StorePut(ctx context.Context, path, key string, put *IdempotentPut) error {
+	s[path+"\x00"+key] = put
+	return nil
+}
+
+func (s testIdempotencyStore) DeletePut(ctx context.Context, path, key string) error {
+	delete(s, path+"\x00"+key)
+	return nil
+}
+
+func TestHandler_putIdempotencyKey(t *testing.T) {
+	fs := &MemFileSystem{}
+	h := Handler{
+		FileSystem:       fs,
+		IdempotencyStore: make(testIdempotencyStore),
+	}
+
+	put := func(body, key string, want int) {
+		req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("PUT = %v, want %v", w.Code, want)
+		}
+	}
+
+	check := func(want string) {
+		if got := readTestFile(t, fs, "/file.txt"); got != want {
+			t.Errorf("file content = %q, want %q", got, want)
+		}
+	}
+
+	put("first", "a", http.StatusCreated)
+	check("first")
+
+	// A retry with the same key must not write the resource again
+	writeTestFile(t, fs, "/file.txt", "changed")
+	put("first", "a", http.StatusCreated)
+	check("changed")
+
+	// Reusing a key for a different payload is an error
+	put("second", "a", http.StatusUnprocessableEntity)
+	check("changed")
+
+	put("third", "b", http.StatusCreated)
+	check("third")
+
+	// The original status code is replayed
+	store := h.IdempotencyStore.(testIdempotencyStore)
+	store["/file.txt\x00\nb"].StatusCode = http.StatusNoContent
+	put("third", "b", http.StatusNoContent)
+	req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("third"))
+	req.Header.Set("Idempotency-Key", "b")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if etag := store["/file.txt\x00\nb"].ETag; etag == "" || w.Header().Get("ETag") != internal.ETag(etag).String() {
+		t.Errorf("replayed ETag = %q, want %q", w.Header().Get("ETag"), etag)
+	}
+
+	// Retries of requests in progress are rejected
+	store["/file.txt\x00\nc"] = &IdempotentPut{}
+	put("fourth", "c", http.StatusConflict)
+	check("third")
+
+	// Keys of failed requests are released
+	req = httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("fifth"))
+	req.Header.Set("Idempotency-Key", "d")
+	req.Header.Set("If-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with stale If-Match = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	if _, ok := store["/file.txt\x00\nd"]; ok {
+		t.Errorf("key of a failed request hasn't been released")
+	}
+	put("fifth", "d", http.StatusCreated)
+	check("fifth")
+
+	// Keys are namespaced by principal
+	h.UserPrincipal = testUserPrincipal("/users/alice/")
+	put("sixth", "d", http.StatusCreated)
+	check("sixth")
+}
+
+type testUserPrincipal string
+
+func (p testUserPrincipal) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return string(p), nil
+}
+
+func TestHandler_visibility(t *testing.T) {
+	h := Handler{
+		FileSystem: newTestFileSystem(t, map[string]string{
+			"/public.txt": "public.txt",
+			"/secret.txt": "secret.txt",
+		}),
+		Visibility: func(ctx context.Context, path string) bool {
+			return path != "/secret.txt"
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/secret.txt", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET hidden = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	req = httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND = %v, want %v", w.Code, http.StatusMultiStatus)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "/public.txt") {
+		t.Errorf("PROPFIND response doesn't list /public.txt")
+	}
+	if strings.Contains(body, "/secret.txt") {
+		t.Errorf("PROPFIND response lists hidden /secret.txt")
+	}
+}
+
+func TestHandler_listing(t *testing.T) {
+	h := Handler{FileSystem: newTestFileSystem(t, map[string]string{
+		"/b.txt":   "b",
+		"/a.txt":   "aaa",
+		"/.hidden": "",
+		"/z/":      "",
+	})}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET directory without listing = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	h.Listing = &ListingOptions{
+		Template: template.Must(template.New("").Parse(`{{range .Entries}}{{.Path}} {{end}}`)),
+		Sort:     ListingSortSize,
+		Reverse:  true,
+		Hidden:   HideDotFiles,
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET directory = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got, want := w.Body.String(), "/z/ /a.txt /b.txt "; got != want {
+		t.Errorf("listing = %q, want %q", got, want)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var listing Listing
+	if err := json.NewDecoder(w.Body).Decode(&listing); err != nil {
+		t.Fatalf("failed to decode listing: %v", err)
+	}
+	if len(listing.Entries) != 3 || listing.Entries[1].Name != "a.txt" || listing.Entries[1].Size != 3 {
+		t.Errorf("listing entries = %+v", listing.Entries)
+	}
+}
+
+func TestHandler_overrides(t *testing.T) {
+	var wrapped bool
+	h := Handler{
+		FileSystem: &MemFileSystem{},
+		Overrides: []Override{
+			{
+				Method: http.MethodPost,
+				Path:   "/api/",
+				Handle: func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+					io.WriteString(w, "custom "+r.URL.Path)
+				},
+			},
+			{
+				Method: "MKCOL",
+				Handle: func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+					wrapped = true
+					next.ServeHTTP(w, r)
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/hook", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Body.String(); got != "custom /api/hook" {
+		t.Errorf("POST /api/hook = %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/other", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /other = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	req = httptest.NewRequest("MKCOL", "/dir", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated || !wrapped {
+		t.Errorf("MKCOL = %v, wrapped = %v, want %v and true", w.Code, wrapped, http.StatusCreated)
+	}
+}
+
+type testAuditSink []AuditEvent
+
+func (s *testAuditSink) Audit(ctx context.Context, event *AuditEvent) {
+	*s = append(*s, *event)
+}
+
+func TestHandler_audit(t *testing.T) {
+	var sink testAuditSink
+	h := Handler{
+		FileSystem: &MemFileSystem{},
+		AuditSink:  &sink,
+	}
+
+	for _, body := range []string{"first", "second, longer"} {
+		req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader(body))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/file.txt", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(sink) != 3 {
+		t.Fatalf("got %v audit events, want 3", len(sink))
+	}
+	for i, method := range []string{http.MethodPut, http.MethodPut, http.MethodDelete} {
+		if ev := sink[i]; ev.Method != method || ev.Path != "/file.txt" {
+			t.Errorf("event %v = %v %v, want %v /file.txt", i, ev.Method, ev.Path, method)
+		}
+	}
+	if sink[0].ETagBefore != "" || sink[0].ETagAfter == "" {
+		t.Errorf("creation event has ETags %q → %q", sink[0].ETagBefore, sink[0].ETagAfter)
+	}
+	if sink[1].ETagBefore != sink[0].ETagAfter || sink[1].ETagAfter == "" {
+		t.Errorf("update event has ETags %q → %q", sink[1].ETagBefore, sink[1].ETagAfter)
+	}
+	if sink[2].ETagBefore != sink[1].ETagAfter || sink[2].ETagAfter != "" {
+		t.Errorf("deletion event has ETags %q → %q", sink[2].ETagBefore, sink[2].ETagAfter)
+	}
+}
+
+func TestHandler_putDryRun(t *testing.T) {
+	fs := &MemFileSystem{}
+	h := Handler{FileSystem: fs}
+
+	req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("content"))
+	req.Header.Set("Prefer", "return=minimal, dry-run")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("PUT = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Preference-Applied"); got != "dry-run" {
+		t.Errorf("Preference-Applied = %q, want %q", got, "dry-run")
+	}
+	if testFileExists(t, fs, "/file.txt") {
+		t.Errorf("dry-run PUT created the file")
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/missing/file.txt", strings.NewReader("content"))
+	req.Header.Set("Prefer", "dry-run")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("PUT in missing directory = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	// Dry runs fail like real requests
+	req = httptest.NewRequest(http.MethodPut, "/missing/file.txt", strings.NewReader("content"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("real PUT in missing directory = %v, want %v", w.Code, http.StatusConflict)
+	}
+	mkdirTestFile(t, fs, "/dir")
+	req = httptest.NewRequest(http.MethodPut, "/dir", strings.NewReader("content"))
+	req.Header.Set("Prefer", "dry-run")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT on collection = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandler_putReturnRepresentation(t *testing.T) {
+	h := Handler{FileSystem: &MemFileSystem{}}
+
+	req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("content"))
+	req.Header.Set("Prefer", "return=representation")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if got := w.Header().Get("Preference-Applied"); got != "return=representation" {
+		t.Errorf("Preference-Applied = %q, want %q", got, "return=representation")
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Errorf("PUT response has no ETag")
+	}
+	if got := w.Body.String(); got != "content" {
+		t.Errorf("PUT response body = %q, want %q", got, "content")
+	}
+}
+
+func TestHandler_conditional(t *testing.T) {
+	h := Handler{FileSystem: &MemFileSystem{}}
+
+	do := func(method, ifMatch, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/file.txt", strings.NewReader("content"))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPut, "*", ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with If-Match on missing file = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	w := do(http.MethodPut, "", "*")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT with If-None-Match on missing file = %v, want %v", w.Code, http.StatusCreated)
+	}
+	etag := w.Header().Get("ETag")
+	if w := do(http.MethodPut, "", "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with If-None-Match on existing file = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := do(http.MethodPut, `"stale"`, ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale If-Match = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := do(http.MethodDelete, `"stale", W/`+etag, ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with stale and weak If-Match = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := do(http.MethodDelete, `"stale", `+etag, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE with matching If-Match = %v, want %v", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestClient_put(t *testing.T) {
+	ts := httptest.NewServer(&Handler{FileSystem: &MemFileSystem{}})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	createOnly := &PutOptions{IfNoneMatch: "*"}
+	fi, err := c.Put(ctx, "/file.txt", strings.NewReader("v1"), createOnly)
+	if err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if fi.Path != "/file.txt" || fi.ETag == "" {
+		t.Errorf("Put() = %+v, want path and ETag", fi)
+	}
+	if _, err := c.Put(ctx, "/file.txt", strings.NewReader("v2"), createOnly); err == nil {
+		t.Errorf("Put() with If-None-Match on existing file succeeded")
+	}
+	if _, err := c.Put(ctx, "/file.txt", strings.NewReader("v2"), &PutOptions{IfMatch: MatchETag(fi.ETag)}); err != nil {
+		t.Errorf("Put() with matching If-Match = %v", err)
+	}
+}
+
+func TestClient_openRange(t *testing.T) {
+	h := &Handler{FileSystem: newTestFileSystem(t, map[string]string{"/file.txt": "0123456789"})}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	req.Header.Set("Range", "bytes=0-1,8-")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("GET with several ranges = %v %q, want multipart/byteranges", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fi, err := c.Stat(ctx, "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{2, 3, "234"},
+		{7, -1, "789"},
+		{8, 10, "89"},
+		{4, 0, ""},
+	} {
+		rc, err := c.OpenRange(ctx, "/file.txt", tc.offset, tc.length, fi.ETag)
+		if err != nil {
+			t.Errorf("OpenRange(%v, %v) = %v", tc.offset, tc.length, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b) != tc.want {
+			t.Errorf("OpenRange(%v, %v) = %q, want %q", tc.offset, tc.length, b, tc.want)
+		}
+	}
+
+	p := make([]byte, 4)
+	if n, err := c.ReadRange(ctx, "/file.txt", p, 8); n != 2 || err != io.EOF || string(p[:n]) != "89" {
+		t.Errorf("ReadRange() = %v, %v, want 2, EOF", n, err)
+	}
+	if n, err := c.ReadRange(ctx, "/file.txt", p, 10); n != 0 || err != io.EOF {
+		t.Errorf("ReadRange() past the end = %v, %v, want 0, EOF", n, err)
+	}
+
+	if _, err := c.Put(ctx, "/file.txt", strings.NewReader("changed"), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.OpenRange(ctx, "/file.txt", 2, 3, fi.ETag)
+	if httpErr, ok := err.(*internal.HTTPError); !ok || httpErr.Code != http.StatusPreconditionFailed {
+		t.Errorf("OpenRange() with outdated ETag = %v, want HTTP 412", err)
+	}
+}
+
+// flakyAppendFileSystem fails the first append after writing a few bytes.
+type flakyAppendFileSystem struct {
+	*MemFileSystem
+	failed bool
+}
+
+type flakyWriter struct {
+	io.WriteCloser
+}
+
+func (w flakyWriter) Write(b []byte) (int, error) {
+	if len(b) > 5 {
+		b = b[:5]
+	}
+	n, err := w.WriteCloser.Write(b)
+	if err == nil {
+		err = errors.New("disk on fire")
+	}
+	return n, err
+}
+
+func (fs *flakyAppendFileSystem) AppendFile(ctx context.Context, name string) (io.WriteCloser, error) {
+	wc, err := fs.MemFileSystem.AppendFile(ctx, name)
+	if err != nil || fs.failed {
+		return wc, err
+	}
+	fs.failed = true
+	return flakyWriter{wc}, nil
+}
+
+func TestClient_resumableUpload(t *testing.T) {
+	fs := &flakyAppendFileSystem{MemFileSystem: &MemFileSystem{}}
+	h := &Handler{FileSystem: fs}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	data := strings.Repeat("0123456789", 10)
+	fi, err := c.ResumableUpload(ctx, "/file.txt", strings.NewReader(data), int64(len(data)), &ResumableUploadOptions{ChunkSize: 30})
+	if err != nil {
+		t.Fatalf("ResumableUpload() = %v", err)
+	}
+	if !fs.failed {
+		t.Errorf("no chunk failed")
+	}
+	if fi.Size != int64(len(data)) {
+		t.Errorf("ResumableUpload() size = %v, want %v", fi.Size, len(data))
+	}
+	if got := readTestFile(t, fs, "/file.txt"); got != data {
+		t.Errorf("uploaded file = %q, want %q", got, data)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/file.txt", strings.NewReader("abc"))
+	req.Header.Set("Content-Range", "bytes 10-12/*")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */100" {
+		t.Errorf("PATCH in the middle of the file = %v %q, want 416 with the file size", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	more := data + "abc"
+	if _, err := c.ResumableUpload(ctx, "/file.txt", strings.NewReader(more), int64(len(more)), &ResumableUploadOptions{Resume: true}); err != nil {
+		t.Fatalf("ResumableUpload() with Resume = %v", err)
+	}
+	if got := readTestFile(t, fs, "/file.txt"); got != more {
+		t.Errorf("resumed file = %q, want %q", got, more)
+	}
+}
+
+func TestHandler_patch(t *testing.T) {
+	var sink testAuditSink
+	fs := &MemFileSystem{}
+	h := &Handler{
+		FileSystem:       fs,
+		IdempotencyStore: make(testIdempotencyStore),
+		AuditSink:        &sink,
+		Finder:           &FinderOptions{AppleDouble: AppleDoubleDiscard},
+	}
+	do := func(p, contentRange, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, p, strings.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("01234")))
+	sink = nil
+
+	// Only one of concurrent chunks starting at the same offset is appended
+	const n = 8
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- do("/file.txt", "bytes 5-7/*", "abc", "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	appended := 0
+	for code := range codes {
+		if code == http.StatusNoContent {
+			appended++
+		} else if code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("concurrent PATCH = %v", code)
+		}
+	}
+	if appended != 1 {
+		t.Errorf("%v concurrent chunks were appended, want 1", appended)
+	}
+	if fi, err := fs.Stat(context.Background(), "/file.txt"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size != 8 {
+		t.Errorf("file size = %v, want 8", fi.Size)
+	}
+	if len(sink) != 1 || sink[0].Method != http.MethodPatch || sink[0].ETagBefore == sink[0].ETagAfter {
+		t.Errorf("audit events = %+v, want a PATCH changing the ETag", sink)
+	}
+
+	// Retries are replayed
+	for i := 0; i < 2; i++ {
+		if w := do("/file.txt", "bytes 8-9/*", "de", "chunk-1"); w.Code != http.StatusNoContent {
+			t.Errorf("PATCH #%v with Idempotency-Key = %v, want %v", i, w.Code, http.StatusNoContent)
+		}
+	}
+	if fi, err := fs.Stat(context.Background(), "/file.txt"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size != 10 {
+		t.Errorf("file size after retry = %v, want 10", fi.Size)
+	}
+
+	// AppleDouble files are discarded
+	if w := do("/._file.txt", "bytes 0-2/*", "abc", ""); w.Code != http.StatusNoContent {
+		t.Errorf("PATCH of an AppleDouble file = %v, want %v", w.Code, http.StatusNoContent)
+	}
+}
+
+type blockingFileSystem struct {
+	FileSystem
+	started chan struct{}
+	done    chan error
+}
+
+func (fs *blockingFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	close(fs.started)
+	<-ctx.Done()
+	fs.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestClient_cancel(t *testing.T) {
+	fs := &blockingFileSystem{
+		FileSystem: &MemFileSystem{},
+		started:    make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+	ts := httptest.NewServer(&Handler{FileSystem: fs})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fs.started
+		cancel()
+	}()
+	if _, err := c.Stat(ctx, "/file.txt"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Stat() = %v, want context.Canceled", err)
+	}
+
+	select {
+	case err := <-fs.done:
+		if err != context.Canceled {
+			t.Errorf("backend context error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("backend context wasn't cancelled")
+	}
+}
+
+type requestInfoFileSystem struct {
+	FileSystem
+	info *RequestInfo
+}
+
+func (fs *requestInfoFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fs.info, _ = RequestInfoFromContext(ctx)
+	return fs.FileSystem.Stat(ctx, name)
+}
+
+func TestHandler_requestInfo(t *testing.T) {
+	fs := &requestInfoFileSystem{FileSystem: &MemFileSystem{}}
+	h := Handler{FileSystem: fs}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "DAVx5/4.3-ose (2023/06/01; dav4jvm; okhttp/4.11.0) Android/13")
+	req.Header.Set("X-Request-ID", "abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	info := fs.info
+	if info == nil {
+		t.Fatalf("backend didn't get a RequestInfo")
+	}
+	if info.ID != "abc123" || w.Header().Get("X-Request-ID") != "abc123" {
+		t.Errorf("request ID = %q, response header = %q, want %q", info.ID, w.Header().Get("X-Request-ID"), "abc123")
+	}
+	if !info.RemoteIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("RemoteIP = %v, want 192.0.2.1", info.RemoteIP)
+	}
+	want := []UserAgentProduct{{"DAVx5", "4.3-ose"}, {"Android", "13"}}
+	if !reflect.DeepEqual(info.Products, want) {
+		t.Errorf("Products = %+v, want %+v", info.Products, want)
+	}
+	if v, ok := info.Product("davx5"); !ok || v != "4.3-ose" {
+		t.Errorf("Product(%q) = %q, %v", "davx5", v, ok)
+	}
+
+	req = httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("X-Request-ID", "bad\nid")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if fs.info.ID == "" || fs.info.ID == "bad\nid" {
+		t.Errorf("invalid request ID wasn't replaced: %q", fs.info.ID)
+	}
+}
+
+type panicFileSystem struct {
+	FileSystem
+}
+
+func (panicFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	panic("oops")
+}
+
+func TestHandler_recoverPanic(t *testing.T) {
+	var logBuf bytes.Buffer
+	h := Handler{
+		FileSystem: panicFileSystem{&MemFileSystem{}},
+		ErrorLog:   log.New(&logBuf, "", 0),
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("PROPFIND = %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.Body.String(), "internal server error (error ID ") {
+		t.Errorf("response doesn't contain error ID:\n%v", w.Body.String())
+	}
+	if !strings.Contains(logBuf.String(), "oops") {
+		t.Errorf("panic not logged:\n%v", logBuf.String())
+	}
+}
+
+type failingFileSystem struct {
+	FileSystem
+}
+
+func (failingFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	return nil, errors.New("dial tcp 10.0.0.1:5432: connection refused")
+}
+
+func TestHandler_errorVerbosity(t *testing.T) {
+	for _, tc := range []struct {
+		verbosity  ErrorVerbosity
+		wantDetail bool
+	}{
+		{ErrorVerbosityFull, true},
+		{ErrorVerbosityClientErrors, false},
+		{ErrorVerbosityNone, false},
+	} {
+		var logBuf bytes.Buffer
+		h := Handler{
+			FileSystem:     failingFileSystem{&MemFileSystem{}},
+			ErrorLog:       log.New(&logBuf, "", 0),
+			ErrorVerbosity: tc.verbosity,
+		}
+
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("verbosity %v: PROPFIND = %v, want %v", tc.verbosity, w.Code, http.StatusInternalServerError)
+		}
+		body := w.Body.String()
+		if got := strings.Contains(body, "connection refused"); got != tc.wantDetail {
+			t.Errorf("verbosity %v: response contains error detail = %v, want %v:\n%v", tc.verbosity, got, tc.wantDetail, body)
+		}
+		if !tc.wantDetail && !strings.Contains(body, "(error ID ") {
+			t.Errorf("verbosity %v: response doesn't contain error ID:\n%v", tc.verbosity, body)
+		}
+		if !strings.Contains(logBuf.String(), "connection refused") {
+			t.Errorf("verbosity %v: error not logged:\n%v", tc.verbosity, logBuf.String())
+		}
+	}
+
+	// Client errors are only hidden with ErrorVerbosityNone
+	h := Handler{
+		FileSystem:     &MemFileSystem{},
+		ErrorLog:       log.New(ioutil.Discard, "", 0),
+		ErrorVerbosity: ErrorVerbosityClientErrors,
+	}
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "error ID") {
+		t.Errorf("PROPFIND with invalid depth = %v %q, want %v with detail", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
+
+func TestInternationalizedNames(t *testing.T) {
+	fs := &MemFileSystem{}
+	ts := httptest.NewServer(&Handler{FileSystem: fs})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	ctx := context.Background()
+
+	const (
+		dirName  = "/Ünïcödé 日本語"
+		fileName = dirName + "/naïve résumé #1?.txt"
+		dest     = dirName + "/Ελληνικά 100%.txt"
+	)
+
+	if err := c.Mkdir(ctx, dirName); err != nil {
+		t.Fatalf("Mkdir() = %v", err)
+	}
+
+	wc, err := c.Create(ctx, fileName)
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := io.WriteString(wc, "hello"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	if !testFileExists(t, fs, fileName) {
+		t.Errorf("file not stored under its decoded name")
+	}
+
+	fi, err := c.Stat(ctx, fileName)
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	} else if fi.Path != fileName {
+		t.Errorf("Stat().Path = %q, want %q", fi.Path, fileName)
+	}
+
+	l, err := c.ReadDir(ctx, dirName, false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	var found bool
+	for _, fi := range l {
+		found = found || fi.Path == fileName
+	}
+	if !found {
+		t.Errorf("ReadDir() = %+v, want %q to be listed", l, fileName)
+	}
+
+	if err := c.Move(ctx, fileName, dest, nil); err != nil {
+		t.Fatalf("Move() = %v", err)
+	}
+	rc, err := c.Open(ctx, dest)
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	} else if string(b) != "hello" {
+		t.Errorf("Open() = %q, want %q", string(b), "hello")
+	}
+}
+
+func TestHandler_moveRawUTF8Destination(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{"/src.txt": "hello"})
+	h := Handler{FileSystem: fs}
+
+	// Some clients don't percent-encode the Destination header
+	req := httptest.NewRequest("MOVE", "/src.txt", nil)
+	req.Header.Set("Destination", "http://example.org/dést ünicode.txt")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MOVE = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if !testFileExists(t, fs, "/dést ünicode.txt") {
+		t.Errorf("destination not created")
+	}
+}
+
+func TestHandler_pathTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "dav")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir() = %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	h := Handler{FileSystem: LocalFileSystem(dir)}
+
+	for _, target := range []string{
+		"/../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/%252e%252e/secret.txt",
+		"/..%5csecret.txt",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path, _ = url.PathUnescape(target)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %v = %v, want %v", target, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest("COPY", "/", nil)
+	req.Header.Set("Destination", "http://example.org/%2e%2e/copy")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("COPY to parent = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	// Paths are cleaned before they're handed over to the FileSystem
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	req = httptest.NewRequest("PROPFIND", "//sub/./", nil)
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "<href>/sub/</href>") {
+		t.Errorf("PROPFIND //sub/./ = %v, want href /sub/", body)
+	}
+	req = httptest.NewRequest("COPY", "/sub/", nil)
+	req.Header.Set("Destination", "http://example.org//copy/./")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if _, err := os.Stat(filepath.Join(dir, "copy")); w.Code != http.StatusCreated || err != nil {
+		t.Errorf("COPY to //copy/./ = %v, %v", w.Code, err)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := HealthHandler{
+		Probes: map[string]HealthProbe{
+			"storage": FileSystemProbe(&MemFileSystem{}),
+		},
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "storage: ok\n" {
+		t.Errorf("GET /healthz = %v %q, want %v", w.Code, w.Body.String(), http.StatusOK)
+	}
+
+	h.Probes["missing"] = FileSystemProbe(failingFileSystem{&MemFileSystem{}})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "missing: failed\nstorage: ok\n" {
+		t.Errorf("GET /healthz = %v %q, want %v", w.Code, w.Body.String(), http.StatusServiceUnavailable)
+	}
+
+	// Probes ignoring their context don't delay the response
+	block := make(chan struct{})
+	defer close(block)
+	delete(h.Probes, "missing")
+	h.Probes["stuck"] = func(ctx context.Context) error {
+		<-block
+		return nil
+	}
+	h.Timeout = 10 * time.Millisecond
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "storage: ok\nstuck: failed\n" {
+		t.Errorf("GET /healthz = %v %q, want %v", w.Code, w.Body.String(), http.StatusServiceUnavailable)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	srcFS := newTestFileSystem(t, map[string]string{
+		"/dir/a.txt": "a",
+		"/b.txt":     "b",
+	})
+	dstFS := newTestFileSystem(t, map[string]string{"/stale/c.txt": "c"})
+	srcTS := httptest.NewServer(&Handler{FileSystem: srcFS})
+	defer srcTS.Close()
+	dstTS := httptest.NewServer(&Handler{FileSystem: dstFS})
+	defer dstTS.Close()
+
+	src, err := NewClient(nil, srcTS.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewClient(nil, dstTS.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &MirrorOptions{State: make(map[string]string), Delete: true}
+	if err := Mirror(context.Background(), src, dst, opts); err != nil {
+		t.Fatalf("Mirror() = %v", err)
+	}
+	if got := readTestFile(t, dstFS, "/dir/a.txt"); got != "a" {
+		t.Errorf("dir/a.txt = %q, want %q", got, "a")
+	}
+	if got := readTestFile(t, dstFS, "/b.txt"); got != "b" {
+		t.Errorf("b.txt = %q, want %q", got, "b")
+	}
+	if testFileExists(t, dstFS, "/stale") {
+		t.Errorf("stale directory not deleted")
+	}
+	if len(opts.State) != 2 {
+		t.Errorf("State = %v, want 2 entries", opts.State)
+	}
+
+	// Unchanged files are skipped
+	writeTestFile(t, dstFS, "/b.txt", "local")
+	if err := Mirror(context.Background(), src, dst, opts); err != nil {
+		t.Fatalf("Mirror() = %v", err)
+	}
+	if got := readTestFile(t, dstFS, "/b.txt"); got != "local" {
+		t.Errorf("unchanged b.txt was copied again")
+	}
+}
+
+type memoryLocalStore struct {
+	objects  map[string]string
+	versions map[string]int
+}
+
+func (s *memoryLocalStore) List(ctx context.Context) (map[string]string, error) {
+	l := make(map[string]string, len(s.objects))
+	for name := range s.objects {
+		l[name] = strconv.Itoa(s.versions[name])
+	}
+	return l, nil
+}
+
+func (s *memoryLocalStore) Read(ctx context.Context, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(s.objects[name])), nil
+}
+
+func (s *memoryLocalStore) Write(ctx context.Context, name string, r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	s.objects[name] = string(b)
+	s.versions[name]++
+	return strconv.Itoa(s.versions[name]), nil
+}
+
+func (s *memoryLocalStore) Remove(ctx context.Context, name string) error {
+	delete(s.objects, name)
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/remote.txt":  "remote",
+		"/deleted.txt": "deleted",
+	})
+	h := &Handler{FileSystem: fs}
+	var beforePut func()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && beforePut != nil {
+			beforePut()
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	local := &memoryLocalStore{
+		objects:  map[string]string{"sub/local.txt": "local"},
+		versions: make(map[string]int),
+	}
+	opts := &SyncOptions{State: new(SyncState)}
+
+	if _, err := Sync(ctx, c, local, opts); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if local.objects["remote.txt"] != "remote" {
+		t.Errorf("remote.txt not pulled: %v", local.objects)
+	}
+	if got := readTestFile(t, fs, "/sub/local.txt"); got != "local" {
+		t.Errorf("sub/local.txt = %q, want pushed", got)
+	}
+
+	// Deletions are propagated in both directions
+	delete(local.objects, "deleted.txt")
+	if err := fs.RemoveAll(ctx, "/remote.txt"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Sync(ctx, c, local, opts)
+	if err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if _, ok := local.objects["remote.txt"]; ok {
+		t.Errorf("remote.txt not deleted locally")
+	}
+	if testFileExists(t, fs, "/deleted.txt") {
+		t.Errorf("deleted.txt not deleted remotely")
+	}
+	if len(res.Pulled) != 0 || len(res.Pushed) != 0 || len(opts.State.Entries) != 1 {
+		t.Errorf("Sync() = %+v, state %v", res, opts.State.Entries)
+	}
+
+	// Conflicting changes are left untouched with ConflictSkip
+	writeTestFile(t, fs, "/sub/local.txt", "remote change")
+	local.Write(ctx, "sub/local.txt", strings.NewReader("local change"))
+	opts.Conflict = ConflictSkip
+	res, err = Sync(ctx, c, local, opts)
+	if err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if len(res.Conflicts) != 1 || local.objects["sub/local.txt"] != "local change" {
+		t.Errorf("Sync() = %+v, want conflict", res)
+	}
+
+	opts.Conflict = ConflictLocalWins
+	if _, err := Sync(ctx, c, local, opts); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if got := readTestFile(t, fs, "/sub/local.txt"); got != "local change" {
+		t.Errorf("sub/local.txt = %q, want local change", got)
+	}
+
+	// Remote changes made after the listing aren't overwritten
+	local.Write(ctx, "sub/local.txt", strings.NewReader("another local change"))
+	beforePut = func() {
+		writeTestFile(t, fs, "/sub/local.txt", "concurrent remote change")
+	}
+	res, err = Sync(ctx, c, local, opts)
+	if err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if len(res.Conflicts) != 1 || len(res.Pushed) != 0 {
+		t.Errorf("Sync() = %+v, want conflict", res)
+	}
+	if got := readTestFile(t, fs, "/sub/local.txt"); got != "concurrent remote change" {
+		t.Errorf("sub/local.txt = %q, want concurrent remote change", got)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		attempts      int
+		payload       WebhookPayload
+		ids           []string
+		sig           string
+		timestamp     string
+		signedContent []byte
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		ids = append(ids, r.Header.Get("Webhook-Id"))
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		sig = r.Header.Get("Webhook-Signature")
+		timestamp = r.Header.Get("Webhook-Timestamp")
+		body, _ := ioutil.ReadAll(r.Body)
+		signedContent = []byte(r.Header.Get("Webhook-Id") + "." + timestamp + "." + string(body))
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	wh := &Webhook{
+		URLs:       []string{ts.URL},
+		Secret:     []byte("secret"),
+		RetryDelay: time.Millisecond,
+	}
+	h := Handler{FileSystem: &MemFileSystem{}, AuditSink: wh}
+
+	req := httptest.NewRequest("PUT", "/a.txt", strings.NewReader("a"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	wh.Wait()
+
+	if attempts != 2 {
+		t.Errorf("attempts = %v, want 2", attempts)
+	}
+	if payload.Method != "PUT" || payload.Path != "/a.txt" {
+		t.Errorf("payload = %+v", payload)
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Webhook-Id = %q, want the same ID for each attempt", ids)
+	}
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("Webhook-Timestamp = %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(signedContent)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("Webhook-Signature = %q, want %q", sig, want)
+	}
+}
+
+func TestWebhook_close(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	wh := &Webhook{
+		URLs:       []string{ts.URL},
+		RetryDelay: time.Hour,
+		QueueSize:  1,
+		Workers:    1,
+		ErrorLog:   log.New(&logs, "", 0),
+	}
+	for i := 0; i < 3; i++ {
+		wh.Audit(context.Background(), &AuditEvent{Method: "PUT", Path: "/a.txt"})
+	}
+	if !strings.Contains(logs.String(), "queue is full") {
+		t.Errorf("deliveries exceeding the queue size weren't dropped: %q", logs.String())
+	}
+
+	// Close abandons the retry waiting for its backoff delay
+	wh.Close()
+	done := make(chan struct{})
+	go func() {
+		wh.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() didn't return after Close()")
+	}
+}
+
+func TestProxyFileSystem(t *testing.T) {
+	upstreamFS := &MemFileSystem{}
+	upstream := httptest.NewServer(&Handler{FileSystem: upstreamFS})
+	defer upstream.Close()
+
+	upstreamClient, err := NewClient(nil, upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewServer(&Handler{FileSystem: &ProxyFileSystem{Client: upstreamClient}})
+	defer gateway.Close()
+
+	c, err := NewClient(nil, gateway.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatalf("Mkdir() = %v", err)
+	}
+	wc, err := c.Create(ctx, "/dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(wc, "a")
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if got := readTestFile(t, upstreamFS, "/dir/a.txt"); got != "a" {
+		t.Errorf("upstream dir/a.txt = %q, want %q", got, "a")
+	}
+
+	if err := c.Copy(ctx, "/dir/a.txt", "/b.txt", nil); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	l, err := c.ReadDir(ctx, "/", true)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	want, err := upstreamClient.ReadDir(ctx, "/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths, wantPaths := fileInfoPaths(l), fileInfoPaths(want); !reflect.DeepEqual(paths, wantPaths) || len(paths) != 4 {
+		t.Errorf("ReadDir() = %v, want %v", paths, wantPaths)
+	}
+
+	if _, err := c.Stat(ctx, "/missing"); !internal.IsNotFound(err) {
+		t.Errorf("Stat(/missing) = %v, want not found", err)
+	}
+
+	fs := &ProxyFileSystem{Prefix: "/remote.php/dav"}
+	if got := fs.remotePath("/dir/"); got != "/remote.php/dav/dir/" {
+		t.Errorf("remotePath(/dir/) = %q", got)
+	}
+	fi := FileInfo{Path: "/remote.php/dav/dir/a.txt"}
+	if err := fs.localFileInfo(&fi); err != nil || fi.Path != "/dir/a.txt" {
+		t.Errorf("localFileInfo() = %q, %v", fi.Path, err)
+	}
+}
+
+func fileInfoPaths(l []FileInfo) []string {
+	var paths []string
+	for _, fi := range l {
+		paths = append(paths, fi.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestProxyFileSystem_cache(t *testing.T) {
+	upstreamFS := newTestFileSystem(t, map[string]string{"/a.txt": "a"})
+
+	var statuses []int
+	upstreamHandler := &Handler{FileSystem: upstreamFS}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		upstreamHandler.ServeHTTP(rec, r)
+		if r.Method == http.MethodGet {
+			statuses = append(statuses, rec.Code)
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer upstream.Close()
+
+	upstreamClient, err := NewClient(nil, upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &ProxyFileSystem{Client: upstreamClient, Cache: &ProxyCache{}}
+	ctx := context.Background()
+
+	readFile := func(name string) string {
+		rc, err := fs.Open(ctx, name)
+		if err != nil {
+			t.Fatalf("Open() = %v", err)
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	read := func() string {
+		return readFile("/a.txt")
+	}
+
+	if got := read(); got != "a" {
+		t.Errorf("Open() = %q, want %q", got, "a")
+	}
+	if got := read(); got != "a" {
+		t.Errorf("cached Open() = %q, want %q", got, "a")
+	}
+	if want := []int{http.StatusOK, http.StatusNotModified}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("upstream GET statuses = %v, want %v", statuses, want)
+	}
+
+	// Changes made directly on the remote server are picked up
+	writeTestFile(t, upstreamFS, "/a.txt", "changed")
+	if got := read(); got != "changed" {
+		t.Errorf("Open() after change = %q, want %q", got, "changed")
+	}
+
+	// Changes in sub-collections are picked up by recursive listings
+	writeTestFile(t, upstreamFS, "/sub/b.txt", "b")
+	before, err := fs.ReadDir(ctx, "/", true)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	writeTestFile(t, upstreamFS, "/sub/c.txt", "c")
+	if l, err := fs.ReadDir(ctx, "/", true); err != nil || len(l) != len(before)+1 {
+		t.Errorf("ReadDir() after change = %v, %v, want %v plus /sub/c.txt", fileInfoPaths(l), err, fileInfoPaths(before))
+	}
+
+	// The least recently used entries are evicted
+	fs.Cache = &ProxyCache{MaxEntries: 1}
+	statuses = nil
+	readFile("/a.txt")
+	readFile("/sub/b.txt")
+	readFile("/a.txt")
+	if want := []int{http.StatusOK, http.StatusOK, http.StatusOK}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("upstream GET statuses = %v, want %v", statuses, want)
+	}
+}
+
+func TestHandler_throttle(t *testing.T) {
+	data := strings.Repeat("a", 130000)
+	h := Handler{
+		FileSystem: newTestFileSystem(t, map[string]string{"/a.txt": data}),
+		Throttle: func(r *http.Request) *Throttle {
+			return NewThrottle(100000)
+		},
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != len(data) {
+		t.Fatalf("GET = %v, %v bytes", w.Code, w.Body.Len())
+	}
+	// The first 100000 bytes are a burst, the rest takes 300ms
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("throttled GET took %v, want at least 300ms", d)
+	}
+}
+
+func TestHandler_lock(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{"/a.txt": "a"})
+	h := Handler{
+		FileSystem: fs,
+		LockSystem: &MemLockSystem{},
+	}
+	do := func(method, p, ifHeader, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/xml")
+		}
+		if ifHeader != "" {
+			req.Header.Set("If", ifHeader)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	lockInfo := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+	<D:lockscope><D:exclusive/></D:lockscope>
+	<D:locktype><D:write/></D:locktype>
+	<D:owner><D:href>mailto:alice@example.org</D:href></D:owner>
+</D:lockinfo>`
+	w := do("LOCK", "/a.txt", "", lockInfo)
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK = %v: %v", w.Code, w.Body.String())
+	}
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if !strings.HasPrefix(token, "urn:uuid:") || !strings.Contains(w.Body.String(), token) {
+		t.Fatalf("LOCK returned token %q and body %q", token, w.Body.String())
+	}
+
+	if w := do("LOCK", "/a.txt", "", lockInfo); w.Code != http.StatusLocked {
+		t.Errorf("conflicting LOCK = %v, want %v", w.Code, http.StatusLocked)
+	}
+	if w := do(http.MethodPut, "/a.txt", "", "b"); w.Code != http.StatusLocked {
+		t.Errorf("PUT without token = %v, want %v", w.Code, http.StatusLocked)
+	}
+	if w := do(http.MethodDelete, "/a.txt", "(<urn:uuid:wrong>)", ""); w.Code != http.StatusLocked {
+		t.Errorf("DELETE with wrong token = %v, want %v", w.Code, http.StatusLocked)
+	}
+	if w := do(http.MethodPut, "/a.txt", "(<"+token+">)", "b"); w.Code != http.StatusCreated {
+		t.Errorf("PUT with token = %v: %v", w.Code, w.Body.String())
+	}
+
+	w = do("PROPFIND", "/a.txt", "", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/><D:supportedlock/></D:prop></D:propfind>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), token) || !strings.Contains(w.Body.String(), "alice@example.org") {
+		t.Errorf("PROPFIND = %v: %v", w.Code, w.Body.String())
+	}
+
+	if w := do("LOCK", "/a.txt", "(<"+token+">)", ""); w.Code != http.StatusOK {
+		t.Errorf("refresh LOCK = %v: %v", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest("UNLOCK", "/a.txt", nil)
+	req.Header.Set("Lock-Token", "<"+token+">")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK = %v: %v", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodDelete, "/a.txt", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE after UNLOCK = %v: %v", w.Code, w.Body.String())
+	}
+
+	// Locking an unmapped URL creates an empty resource
+	if w := do("LOCK", "/b.txt", "", lockInfo); w.Code != http.StatusCreated {
+		t.Errorf("LOCK on unmapped URL = %v: %v", w.Code, w.Body.String())
+	}
+	if !testFileExists(t, fs, "/b.txt") {
+		t.Errorf("LOCK didn't create resource")
+	}
+}
+
+func TestHandler_lockPrincipal(t *testing.T) {
+	h := Handler{
+		FileSystem:    &MemFileSystem{},
+		LockSystem:    &MemLockSystem{},
+		UserPrincipal: testUserPrincipal("/users/alice/"),
+	}
+	do := func(method, p, ifHeader, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		if strings.HasPrefix(body, "<?xml") {
+			req.Header.Set("Content-Type", "application/xml")
+		}
+		if ifHeader != "" {
+			req.Header.Set("If", ifHeader)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPut, "/a.txt", "", "a"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %v: %v", w.Code, w.Body.String())
+	}
+	w := do("LOCK", "/a.txt", "", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+	<D:lockscope><D:exclusive/></D:lockscope>
+	<D:locktype><D:write/></D:locktype>
+</D:lockinfo>`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK = %v: %v", w.Code, w.Body.String())
+	}
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if w := do(http.MethodPut, "/b.txt", "", "b"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %v: %v", w.Code, w.Body.String())
+	}
+	if w := do("LOCK", "/b.txt", "(<"+token+">)", ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("refresh LOCK on another resource = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+
+	h.UserPrincipal = testUserPrincipal("/users/bob/")
+	propfind := `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/></D:prop></D:propfind>`
+	if w := do("PROPFIND", "/a.txt", "", propfind); w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), token) || !strings.Contains(w.Body.String(), "activelock") {
+		t.Errorf("PROPFIND by another user = %v: %v", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPut, "/a.txt", "(<"+token+">)", "b"); w.Code != http.StatusLocked {
+		t.Errorf("PUT with another user's token = %v, want %v", w.Code, http.StatusLocked)
+	}
+	if w := do("LOCK", "/a.txt", "(<"+token+">)", ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("refresh LOCK by another user = %v, want %v", w.Code, http.StatusPreconditionFailed)
+	}
+	req := httptest.NewRequest("UNLOCK", "/a.txt", nil)
+	req.Header.Set("Lock-Token", "<"+token+">")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("UNLOCK by another user = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	h.UserPrincipal = testUserPrincipal("/users/alice/")
+	if w := do("PROPFIND", "/a.txt", "", propfind); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), token) {
+		t.Errorf("PROPFIND by lock owner = %v: %v", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPut, "/a.txt", "(<"+token+">)", "b"); w.Code != http.StatusCreated {
+		t.Errorf("PUT with token = %v: %v", w.Code, w.Body.String())
+	}
+}
+
+func TestClient_createWithChecksum(t *testing.T) {
+	h := &Handler{FileSystem: &MemFileSystem{}}
+	reported := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.Header().Set("OC-Checksum", reported)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := &Checksum{Algorithm: "SHA256", New: sha256.New, Header: "OC-Checksum"}
+	upload := func() error {
+		wc, err := c.CreateWithChecksum(context.Background(), "/a.txt", checksum)
+		if err != nil {
+			return err
+		}
+		io.WriteString(wc, "hello")
+		return wc.Close()
+	}
+
+	sum := sha256.Sum256([]byte("hello"))
+	reported = "SHA256:" + hex.EncodeToString(sum[:])
+	if err := upload(); err != nil {
+		t.Errorf("upload with matching checksum = %v", err)
+	}
+
+	reported = "SHA256:" + strings.Repeat("00", sha256.Size)
+	var mismatch *ChecksumMismatchError
+	if err := upload(); !errors.As(err, &mismatch) {
+		t.Errorf("upload with mismatching checksum = %v, want ChecksumMismatchError", err)
+	} else if mismatch.Local != hex.EncodeToString(sum[:]) {
+		t.Errorf("ChecksumMismatchError.Local = %v", mismatch.Local)
+	}
+}
+
+type syncFileSystem struct {
+	*MemFileSystem
+}
+
+func (fs syncFileSystem) SyncToken(ctx context.Context, name string) (string, error) {
+	return "http://example.org/sync/2", nil
+}
+
+func (fs syncFileSystem) Changes(ctx context.Context, name, syncToken string, recursive bool) (*SyncChanges, error) {
+	if syncToken != "http://example.org/sync/1" {
+		return nil, ErrInvalidSyncToken
+	}
+	return &SyncChanges{
+		SyncToken: "http://example.org/sync/2",
+		Added:     []string{"/a.txt"},
+		Deleted:   []string{"/b.txt"},
+	}, nil
+}
+
+func TestHandler_syncCollection(t *testing.T) {
+	h := Handler{FileSystem: syncFileSystem{newTestFileSystem(t, map[string]string{"/a.txt": "a"})}}
+
+	report := func(token string) *httptest.ResponseRecorder {
+		body := `<?xml version="1.0" encoding="utf-8"?>
+<D:sync-collection xmlns:D="DAV:">
+	<D:sync-token>` + token + `</D:sync-token>
+	<D:sync-level>1</D:sync-level>
+	<D:prop><D:getcontentlength/></D:prop>
+</D:sync-collection>`
+		req := httptest.NewRequest("REPORT", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/xml")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := report("http://example.org/sync/1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("REPORT = %v: %v", w.Code, w.Body.String())
+	}
+	var ms internal.MultiStatus
+	if err := xml.NewDecoder(w.Body).Decode(&ms); err != nil {
+		t.Fatal(err)
+	}
+	if ms.SyncToken != "http://example.org/sync/2" || len(ms.Responses) != 2 {
+		t.Fatalf("REPORT returned sync token %q and %v responses", ms.SyncToken, len(ms.Responses))
+	}
+	if p, err := ms.Responses[0].Path(); p != "/a.txt" || err != nil {
+		t.Errorf("first response = %q, %v, want %q", p, err, "/a.txt")
+	}
+	if _, err := ms.Responses[1].Path(); !internal.IsNotFound(err) {
+		t.Errorf("deleted member response error = %v, want 404", err)
+	}
+
+	if w := report("http://example.org/sync/0"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "valid-sync-token") {
+		t.Errorf("REPORT with invalid token = %v: %v", w.Code, w.Body.String())
+	}
+
+	// Members which can't be read are reported as removed
+	h.PrivilegeChecker = privilegeCheckerFunc(func(ctx context.Context, name string) ([]Privilege, error) {
+		if name == "/a.txt" {
+			return nil, nil
+		}
+		return []Privilege{PrivilegeAll}, nil
+	})
+	w = report("http://example.org/sync/1")
+	ms = internal.MultiStatus{}
+	if err := xml.NewDecoder(w.Body).Decode(&ms); err != nil {
+		t.Fatal(err)
+	}
+	for _, resp := range ms.Responses {
+		if p, err := resp.Path(); p == "/a.txt" && err == nil {
+			t.Errorf("REPORT returned unreadable member %q", p)
+		}
+	}
+}
+
+type privilegeCheckerFunc func(ctx context.Context, name string) ([]Privilege, error)
+
+func (f privilegeCheckerFunc) CurrentUserPrivileges(ctx context.Context, name string) ([]Privilege, error) {
+	return f(ctx, name)
+}
+
+func TestClient_readDirChunked(t *testing.T) {
+	h := &Handler{FileSystem: newTestFileSystem(t, map[string]string{
+		"/a/1.txt":   "1",
+		"/a/b/2.txt": "2",
+	})}
+
+	// The server rejects infinite depth and truncates large listings, unless
+	// a minimal response is requested
+	var minimal int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" && r.Header.Get("Depth") == "infinity" {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<?xml version="1.0"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+			return
+		}
+		if r.Method == "PROPFIND" && r.Header.Get("Depth") == "1" {
+			if r.Header.Get("Prefer") == "return=minimal" {
+				minimal++
+			} else {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes()[:rec.Body.Len()/2])
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.ReadDir(context.Background(), "/a/", true)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	got := make(map[string]int64)
+	for _, fi := range l {
+		got[strings.TrimSuffix(fi.Path, "/")] = fi.Size
+	}
+	want := map[string]int64{"/a": 0, "/a/1.txt": 1, "/a/b": 0, "/a/b/2.txt": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() = %v, want %v", got, want)
+	}
+	if minimal != 2 {
+		t.Errorf("%v minimal listings, want 2", minimal)
+	}
+}
+
+func TestClient_readDirPaged(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/a/1.txt":   "x",
+		"/a/2.txt":   "x",
+		"/a/3.txt":   "x",
+		"/a/b/4.txt": "x",
+	})
+	h := &Handler{FileSystem: fs, PropFindPageSize: 2}
+
+	var pages int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			pages++
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		recursive bool
+		want      []string
+		pages     int
+	}{
+		{false, []string{"/a", "/a/1.txt", "/a/2.txt", "/a/3.txt", "/a/b"}, 2},
+		{true, []string{"/a", "/a/1.txt", "/a/2.txt", "/a/3.txt", "/a/b", "/a/b/4.txt"}, 3},
+	} {
+		pages = 0
+		l, err := c.ReadDir(context.Background(), "/a/", tc.recursive)
+		if err != nil {
+			t.Fatalf("ReadDir(recursive=%v) = %v", tc.recursive, err)
+		}
+		var got []string
+		for _, fi := range l {
+			got = append(got, strings.TrimSuffix(fi.Path, "/"))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ReadDir(recursive=%v) = %v, want %v", tc.recursive, got, tc.want)
+		}
+		if pages != tc.pages {
+			t.Errorf("ReadDir(recursive=%v) requested %v pages, want %v", tc.recursive, pages, tc.pages)
+		}
+	}
+
+	// Members added before the cursor don't shift the following pages
+	pages = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			if pages++; pages == 2 {
+				writeTestFile(t, fs, "/a/0.txt", "x")
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+	l, err := c.ReadDir(context.Background(), "/a/", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	var got []string
+	for _, fi := range l {
+		got = append(got, strings.TrimSuffix(fi.Path, "/"))
+	}
+	if want := []string{"/a", "/a/1.txt", "/a/2.txt", "/a/3.txt", "/a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() with concurrent insert = %v, want %v", got, want)
+	}
+
+	// A server returning the same token over and over isn't followed forever
+	pages = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Page-Token") != "" {
+			pages++
+			r.Header.Del("Page-Token")
+		}
+		h.ServeHTTP(w, r)
+	})
+	c.ReadDir(context.Background(), "/a/", false)
+	if pages != 1 {
+		t.Errorf("ReadDir() with a token which doesn't advance requested %v pages, want 1", pages)
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/a/", nil)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Page-Token", "invalid")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PROPFIND with invalid page token = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLocalFileSystem_rootPath(t *testing.T) {
+	fs := LocalFileSystem(t.TempDir())
+	ctx := context.Background()
+
+	fi, err := fs.Stat(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	} else if fi.Path != "/" {
+		t.Errorf("Stat(\"/\").Path = %q, want %q", fi.Path, "/")
+	}
+	l, err := fs.ReadDir(ctx, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(l) != 1 || l[0].Path != "/" {
+		t.Errorf("ReadDir(\"/\") = %+v, want the root only", l)
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	w := httptest.NewRecorder()
+	(&Handler{FileSystem: fs}).ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "<href>/</href>") || strings.Contains(body, "<href>/.</href>") {
+		t.Errorf("PROPFIND / = %v, want href /", body)
+	}
+}
+
+func TestConditionalFileSystem(t *testing.T) {
+	for name, fs := range map[string]ConditionalFileSystem{
+		"local": LocalFileSystem(t.TempDir()),
+		"mem":   &MemFileSystem{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			create := func(opts *CreateOptions, data string) (io.WriteCloser, error) {
+				wc, err := fs.CreateWithOptions(ctx, "/file.txt", opts)
+				if err != nil {
+					return nil, err
+				}
+				_, err = io.WriteString(wc, data)
+				return wc, err
+			}
+			isPreconditionFailed := func(err error) bool {
+				httpErr, ok := err.(*internal.HTTPError)
+				return ok && httpErr.Code == http.StatusPreconditionFailed
+			}
+
+			// Preconditions are evaluated when the writer is closed
+			createOnly := &CreateOptions{IfNoneMatch: "*"}
+			first, err := create(createOnly, "first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := create(createOnly, "second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := first.Close(); err != nil {
+				t.Errorf("Close() = %v", err)
+			}
+			if err := second.Close(); !isPreconditionFailed(err) {
+				t.Errorf("Close() of a concurrent creation = %v, want HTTP 412", err)
+			}
+
+			fi, err := fs.Stat(ctx, "/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			} else if fi.Size != int64(len("first")) {
+				t.Errorf("file size = %v, want %v", fi.Size, len("first"))
+			}
+
+			stale, err := create(&CreateOptions{IfMatch: MatchETag("stale")}, "stale")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stale.Close(); !isPreconditionFailed(err) {
+				t.Errorf("Close() with stale If-Match = %v, want HTTP 412", err)
+			}
+			update, err := create(&CreateOptions{IfMatch: MatchETag(fi.ETag)}, "updated")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := update.Close(); err != nil {
+				t.Errorf("Close() with matching If-Match = %v", err)
+			}
+		})
+	}
+}
+
+func TestHandler_copyMove(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/src/a.txt":     "a",
+		"/src/sub/b.txt": "b",
+	})
+	h := Handler{FileSystem: fs}
+
+	do := func(method, p, dest string, header map[string]string) int {
+		req := httptest.NewRequest(method, p, nil)
+		req.Header.Set("Destination", dest)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("COPY", "/src/", "/copy/", nil); code != http.StatusCreated {
+		t.Errorf("recursive COPY = %v, want %v", code, http.StatusCreated)
+	}
+	if b := readTestFile(t, fs, "/copy/sub/b.txt"); b != "b" {
+		t.Errorf("copied copy/sub/b.txt = %q", b)
+	}
+	if code := do("COPY", "/src/", "/shallow/", map[string]string{"Depth": "0"}); code != http.StatusCreated {
+		t.Errorf("COPY with Depth: 0 = %v, want %v", code, http.StatusCreated)
+	}
+	if testFileExists(t, fs, "/shallow/a.txt") {
+		t.Errorf("COPY with Depth: 0 copied children")
+	}
+
+	if code := do("COPY", "/src/a.txt", "/copy/a.txt", map[string]string{"Overwrite": "F"}); code != http.StatusPreconditionFailed {
+		t.Errorf("COPY with Overwrite: F = %v, want %v", code, http.StatusPreconditionFailed)
+	}
+	if code := do("COPY", "/src/a.txt", "/copy/a.txt", nil); code != http.StatusNoContent {
+		t.Errorf("overwriting COPY = %v, want %v", code, http.StatusNoContent)
+	}
+	if code := do("COPY", "/src/a.txt", "/missing/a.txt", nil); code != http.StatusConflict {
+		t.Errorf("COPY to missing parent = %v, want %v", code, http.StatusConflict)
+	}
+	if code := do("COPY", "/src/", "/src/sub/src/", nil); code != http.StatusForbidden {
+		t.Errorf("COPY into itself = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := do("MOVE", "/src/a.txt", "/src/a.txt", nil); code != http.StatusForbidden {
+		t.Errorf("MOVE to same path = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := do("MOVE", "/src/sub/", "/src/", nil); code != http.StatusForbidden {
+		t.Errorf("MOVE onto an ancestor = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := do("COPY", "/src/sub/b.txt", "/src/", nil); code != http.StatusForbidden {
+		t.Errorf("COPY onto an ancestor = %v, want %v", code, http.StatusForbidden)
+	}
+	if !testFileExists(t, fs, "/src/sub/b.txt") {
+		t.Errorf("COPY or MOVE onto an ancestor removed the source")
+	}
+
+	if code := do("MOVE", "/copy/", "/moved/", nil); code != http.StatusCreated {
+		t.Errorf("MOVE = %v, want %v", code, http.StatusCreated)
+	}
+	if !testFileExists(t, fs, "/moved/sub/b.txt") {
+		t.Errorf("MOVE didn't move children")
+	}
+}
+
+type versionedFileSystem struct {
+	*MemFileSystem
+	// tokens contains the sync token of each collection
+	tokens map[string]string
+}
+
+func (fs versionedFileSystem) SyncToken(ctx context.Context, name string) (string, error) {
+	return fs.tokens[path.Clean(name)], nil
+}
+
+func (fs versionedFileSystem) Changes(ctx context.Context, name, syncToken string, recursive bool) (*SyncChanges, error) {
+	return nil, ErrInvalidSyncToken
+}
+
+func TestCollectionCache(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/a.txt": "a",
+		"/sub/":  "",
+	})
+	tokens := map[string]string{"/": "1", "/sub": "1"}
+	h := &Handler{FileSystem: versionedFileSystem{fs, tokens}}
+	var listings int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" && r.Header.Get("Depth") == "1" {
+			listings++
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := DirCacheStore(t.TempDir())
+	readDirRecursive := func(recursive bool) []FileInfo {
+		// Use a new cache each time, as a restarted application would
+		cc := CollectionCache{Client: c, Store: store}
+		l, err := cc.ReadDir(context.Background(), "/", recursive)
+		if err != nil {
+			t.Fatalf("ReadDir() = %v", err)
+		}
+		return l
+	}
+	readDir := func() []FileInfo {
+		return readDirRecursive(false)
+	}
+
+	first := readDir()
+	second := readDir()
+	if listings != 1 {
+		t.Errorf("%v listings after two ReadDir calls, want 1", listings)
+	}
+	if !reflect.DeepEqual(fileInfoPaths(first), fileInfoPaths(second)) {
+		t.Errorf("cached ReadDir() = %v, want %v", fileInfoPaths(second), fileInfoPaths(first))
+	}
+
+	writeTestFile(t, fs, "/b.txt", "b")
+	tokens["/"] = "2"
+	if l := readDir(); listings != 2 || len(l) != len(first)+1 {
+		t.Errorf("ReadDir() after change = %v with %v listings", fileInfoPaths(l), listings)
+	}
+
+	// Changes in sub-collections are picked up by recursive listings, even
+	// if the version of the root collection is unchanged
+	recursive := readDirRecursive(true)
+	writeTestFile(t, fs, "/sub/c.txt", "c")
+	tokens["/sub"] = "2"
+	if l := readDirRecursive(true); len(l) != len(recursive)+1 {
+		t.Errorf("recursive ReadDir() after change = %v, want %v plus /sub/c.txt", fileInfoPaths(l), fileInfoPaths(recursive))
+	}
+}
+
+func TestClient_copyMultiStatus(t *testing.T) {
+	var destination, overwrite string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		destination, overwrite = r.Header.Get("Destination"), r.Header.Get("Overwrite")
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/dest/locked.txt</d:href>
+    <d:status>HTTP/1.1 423 Locked</d:status>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Copy(context.Background(), "/src/", "/dest/", &CopyOptions{NoOverwrite: true})
+	var msErr *MultiStatusError
+	if !errors.As(err, &msErr) {
+		t.Fatalf("Copy() = %v, want MultiStatusError", err)
+	}
+	if len(msErr.Errors) != 1 || msErr.Errors[0].Path != "/dest/locked.txt" || msErr.Errors[0].StatusCode != http.StatusLocked {
+		t.Errorf("MultiStatusError = %+v", msErr.Errors)
+	}
+	if destination != ts.URL+"/dest/" || overwrite != "F" {
+		t.Errorf("Destination = %q, Overwrite = %q", destination, overwrite)
+	}
+}
+
+type redirectFileSystem struct {
+	*MemFileSystem
+}
+
+func (fs redirectFileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	fi, err := fs.MemFileSystem.Stat(ctx, name)
+	if err == nil && fi.Path == "/link" {
+		fi.RedirectTarget = "/dir/a.txt"
+	}
+	return fi, err
+}
+
+func (fs redirectFileSystem) ReadDir(ctx context.Context, name string, recursive bool) ([]FileInfo, error) {
+	l, err := fs.MemFileSystem.ReadDir(ctx, name, recursive)
+	for i := range l {
+		if l[i].Path == "/link" {
+			l[i].RedirectTarget = "/dir/a.txt"
+		}
+	}
+	return l, err
+}
+
+func TestHandler_redirectRef(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/dir/a.txt": "a",
+		"/link":      "",
+	})
+	h := Handler{FileSystem: redirectFileSystem{fs}}
+
+	for _, method := range []string{http.MethodGet, "PROPFIND"} {
+		req := httptest.NewRequest(method, "/link", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("%v: expected status 302, got %v", method, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "/dir/a.txt" {
+			t.Errorf("%v: Location = %q, want %q", method, loc, "/dir/a.txt")
+		}
+		if ref := w.Header().Get("Redirect-Ref"); ref != "/dir/a.txt" {
+			t.Errorf("%v: Redirect-Ref = %q, want %q", method, ref, "/dir/a.txt")
+		}
+	}
+
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fi, err := c.Stat(ctx, "/link")
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	if fi.RedirectTarget != "/dir/a.txt" {
+		t.Errorf("Stat().RedirectTarget = %q, want %q", fi.RedirectTarget, "/dir/a.txt")
+	}
+
+	l, err := c.ReadDir(ctx, "/", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	found := false
+	for _, fi := range l {
+		if fi.Path == "/link" {
+			found = fi.RedirectTarget == "/dir/a.txt"
+		}
+	}
+	if !found {
+		t.Errorf("ReadDir() didn't report the redirect reference: %v", l)
+	}
+
+	r, err := c.Open(ctx, "/link")
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "a" {
+		t.Errorf("Open() = %q, %v, want target contents", b, err)
+	}
+}
+
+func TestHandler_posixMetadata(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(p, []byte("a"), 0644)
+	h := Handler{FileSystem: LocalFileSystem(dir)}
+
+	// POSIX metadata is opt-in
+	req := httptest.NewRequest("PROPFIND", "/a.txt", nil)
+	req.Header.Set("Depth", "0")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), PosixNamespace) {
+		t.Errorf("PROPFIND: LocalFileSystem exposes POSIX metadata: %v", w.Body.String())
+	}
+	h.FileSystem = PosixLocalFileSystem{LocalFileSystem(dir)}
+
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:P="` + PosixNamespace + `">
+	<D:prop><P:mode/></D:prop>
+</D:propfind>`
+	req = httptest.NewRequest("PROPFIND", "/a.txt", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: expected status 207, got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), ">0644<") {
+		t.Errorf("PROPFIND: mode missing from response: %v", w.Body.String())
+	}
+
+	proppatch := func() *httptest.ResponseRecorder {
+		body := `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:P="` + PosixNamespace + `">
+	<D:set><D:prop><P:mode>0600</P:mode></D:prop></D:set>
+</D:propertyupdate>`
+		req := httptest.NewRequest("PROPPATCH", "/a.txt", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/xml")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := proppatch(); w.Code != http.StatusForbidden {
+		t.Errorf("unauthorized PROPPATCH: expected status 403, got %v", w.Code)
+	}
+
+	h.AuthorizePosix = func(r *http.Request) error { return nil }
+	if w := proppatch(); w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPPATCH: expected status 207, got %v", w.Code)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("mode = %v, want %v", mode, os.FileMode(0600))
+	}
+}
+
+type deadPropFileSystem struct {
+	*MemFileSystem
+	props map[string]map[xml.Name]string
+}
+
+func (fs *deadPropFileSystem) GetDeadProperties(ctx context.Context, name string) (map[xml.Name]string, error) {
+	return fs.props[name], nil
+}
+
+func (fs *deadPropFileSystem) SetDeadProperties(ctx context.Context, name string, props map[xml.Name]string) error {
+	if fs.props[name] == nil {
+		fs.props[name] = make(map[xml.Name]string)
+	}
+	for k, v := range props {
+		fs.props[name][k] = v
+	}
+	return nil
+}
+
+func (fs *deadPropFileSystem) RemoveDeadProperties(ctx context.Context, name string, names []xml.Name) error {
+	for _, k := range names {
+		delete(fs.props[name], k)
+	}
+	return nil
+}
+
+func TestHandler_deadProperties(t *testing.T) {
+	fs := &deadPropFileSystem{
+		newTestFileSystem(t, map[string]string{"/a.txt": "a"}),
+		make(map[string]map[xml.Name]string),
+	}
+	h := Handler{FileSystem: fs}
+
+	proppatch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PROPPATCH", "/a.txt", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:T="urn:test">`+body+`</D:propertyupdate>`))
+		req.Header.Set("Content-Type", "application/xml")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := proppatch(`<D:set><D:prop><T:color>red</T:color><D:getetag>x</D:getetag></D:prop></D:set>`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPPATCH: expected status 207, got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "403") || !strings.Contains(w.Body.String(), "424") {
+		t.Errorf("PROPPATCH with a live property: expected 403 and 424 statuses, got %v", w.Body.String())
+	}
+	if len(fs.props["/a.txt"]) != 0 {
+		t.Errorf("failed PROPPATCH modified properties: %v", fs.props)
+	}
+
+	w = proppatch(`<D:set><D:prop><T:color>red</T:color></D:prop></D:set>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH: unexpected response %v: %v", w.Code, w.Body.String())
+	}
+	if v := fs.props["/a.txt"][xml.Name{"urn:test", "color"}]; v != "red" {
+		t.Errorf("stored property = %q, want %q", v, "red")
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/a.txt", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `<color xmlns="urn:test">red</color>`) {
+		t.Errorf("PROPFIND: dead property missing from response: %v", w.Body.String())
+	}
+
+	proppatch(`<D:remove><D:prop><T:color/></D:prop></D:remove>`)
+	if len(fs.props["/a.txt"]) != 0 {
+		t.Errorf("property wasn't removed: %v", fs.props)
+	}
+}
+
+func TestCaseInsensitiveFileSystem(t *testing.T) {
+	mem := newTestFileSystem(t, map[string]string{"/Docs/Report.txt": "a"})
+	fs := &CaseInsensitiveFileSystem{FileSystem: mem}
+	ctx := context.Background()
+
+	fi, err := fs.Stat(ctx, "/docs/REPORT.TXT")
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	if fi.Path != "/docs/REPORT.TXT" || fi.Size != 1 {
+		t.Errorf("Stat() = %+v", fi)
+	}
+
+	l, err := fs.ReadDir(ctx, "/DOCS", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	if paths := fileInfoPaths(l); !reflect.DeepEqual(paths, []string{"/DOCS", "/DOCS/Report.txt"}) {
+		t.Errorf("ReadDir() = %v", paths)
+	}
+
+	w, err := fs.Create(ctx, "/docs/new.txt")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	w.Close()
+	if !testFileExists(t, mem, "/Docs/new.txt") {
+		t.Errorf("Create() didn't write to the existing directory")
+	}
+
+	if _, err := fs.Move(ctx, "/docs/new.txt", "/docs/NEW.txt", nil); err != nil {
+		t.Fatalf("Move() = %v", err)
+	}
+	if !testFileExists(t, mem, "/Docs/NEW.txt") {
+		t.Errorf("Move() didn't rename the file")
+	}
+
+	writeTestFile(t, mem, "/Docs/report.TXT", "b")
+	if _, err := fs.Stat(ctx, "/docs/REPORT.txt"); err == nil || !isHTTPErrorCode(err, http.StatusConflict) {
+		t.Errorf("Stat() with conflicting names = %v, want 409", err)
+	}
+	fs.Conflict = CaseConflictFirst
+	if fi, err := fs.Stat(ctx, "/docs/REPORT.txt"); err != nil || fi.Size != 1 {
+		t.Errorf("Stat() with CaseConflictFirst = %+v, %v", fi, err)
+	}
+}
+
+func TestHandler_infiniteDepthLimits(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{"/a/b/c.txt": "c"})
+	h := Handler{FileSystem: fs}
+
+	propfind := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.Header.Set("Depth", "infinity")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := propfind(); w.Code != http.StatusMultiStatus {
+		t.Errorf("unlimited: expected status 207, got %v", w.Code)
+	}
+
+	for _, limits := range []InfiniteDepthLimits{
+		{Disabled: true},
+		{MaxResources: 3},
+		{MaxDepth: 2},
+	} {
+		h.InfiniteDepth = limits
+		w := propfind()
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "propfind-finite-depth") {
+			t.Errorf("%+v: expected propfind-finite-depth error, got %v: %v", limits, w.Code, w.Body.String())
+		}
+	}
+
+	h.InfiniteDepth = InfiniteDepthLimits{MaxResources: 4, MaxDepth: 3}
+	if w := propfind(); w.Code != http.StatusMultiStatus {
+		t.Errorf("within limits: expected status 207, got %v", w.Code)
+	}
+
+	// The walk stops as soon as a limit is exceeded
+	for i := 0; i < 20; i++ {
+		writeTestFile(t, fs, "/"+strconv.Itoa(i)+".txt", "x")
+	}
+	walked := 0
+	h.FileSystem = countingWalkFileSystem{fs, &walked}
+	h.InfiniteDepth = InfiniteDepthLimits{MaxResources: 4}
+	if w := propfind(); w.Code != http.StatusForbidden {
+		t.Errorf("walk: expected status 403, got %v", w.Code)
+	}
+	if walked != 5 {
+		t.Errorf("walk: listed %v files, want 5", walked)
+	}
+	h.FileSystem = fs
+
+	// The client falls back to "Depth: 1" requests
+	h.InfiniteDepth = InfiniteDepthLimits{Disabled: true}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.ReadDir(context.Background(), "/", true)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	if len(l) != 24 {
+		t.Errorf("ReadDir() = %v, want 24 entries", fileInfoPaths(l))
+	}
+}
+
+// walkTestFileSystem implements WalkFileSystem.WalkDir on top of ReadDir.
+func walkTestFileSystem(ctx context.Context, fs *MemFileSystem, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	l, err := fs.ReadDir(ctx, name, recursive)
+	if err != nil {
+		return err
+	}
+	for i := range l {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWalkFileSystem counts the files listed by WalkDir.
+type countingWalkFileSystem struct {
+	*MemFileSystem
+	n *int
+}
+
+func (fs countingWalkFileSystem) WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	return walkTestFileSystem(ctx, fs.MemFileSystem, name, recursive, func(fi *FileInfo) error {
+		*fs.n++
+		return fn(fi)
+	})
+}
+
+// failingWalkFileSystem fails after listing a few files.
+type failingWalkFileSystem struct {
+	*MemFileSystem
+}
+
+func (fs failingWalkFileSystem) WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	n := 0
+	return walkTestFileSystem(ctx, fs.MemFileSystem, name, recursive, func(fi *FileInfo) error {
+		if n == 10 {
+			return errors.New("walk failed")
+		}
+		n++
+		return fn(fi)
+	})
+}
+
+func TestHandler_streamPropFind(t *testing.T) {
+	fs := &MemFileSystem{}
+	for i := 0; i < 250; i++ {
+		writeTestFile(t, fs, "/"+strconv.Itoa(i)+".txt", "x")
+	}
+	h := Handler{FileSystem: fs}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.ReadDir(context.Background(), "/", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	if len(l) != 251 {
+		t.Errorf("ReadDir() returned %v entries, want 251", len(l))
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/xml") {
+		t.Errorf("PROPFIND = %v %q, want 207 with XML", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Errors after the response has started truncate it
+	h.FileSystem = failingWalkFileSystem{fs}
+	h.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if _, err := c.ReadDir(context.Background(), "/", false); err == nil {
+		t.Errorf("ReadDir() with failing walk succeeded")
+	}
+}
+
+func TestWindowsNameFileSystem(t *testing.T) {
+	mem := &MemFileSystem{}
+	fs := &WindowsNameFileSystem{FileSystem: mem}
+	ctx := context.Background()
+
+	for _, name := range []string{"/CON", "/con.txt", "/a:b.txt", "/a.", "/a ", "/dir?/a.txt"} {
+		if _, err := fs.Create(ctx, name); err == nil || !isHTTPErrorCode(err, http.StatusForbidden) {
+			t.Errorf("Create(%q) = %v, want 403", name, err)
+		}
+	}
+	if err := fs.Mkdir(ctx, "/LPT1"); err == nil || !isHTTPErrorCode(err, http.StatusForbidden) {
+		t.Errorf("Mkdir() = %v, want 403", err)
+	}
+	if w, err := fs.Create(ctx, "/console.txt"); err != nil {
+		t.Errorf("Create() with a valid name = %v", err)
+	} else {
+		w.Close()
+	}
+
+	writeTestFile(t, mem, "/a:b.", "a")
+	fs.Translate = true
+	translated := "/a\uf03ab\uf02e"
+	fi, err := fs.Stat(ctx, translated)
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	if fi.Path != translated {
+		t.Errorf("Stat().Path = %q, want %q", fi.Path, translated)
+	}
+	l, err := fs.ReadDir(ctx, "/", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	if paths := fileInfoPaths(l); !reflect.DeepEqual(paths, []string{"/", translated, "/console.txt"}) {
+		t.Errorf("ReadDir() = %q", paths)
+	}
+	if _, err := fs.Create(ctx, "/CON"); err == nil {
+		t.Errorf("Create() with a reserved name succeeded in translate mode")
+	}
+}
+
+type testACLStore struct {
+	acls map[string][]ACE
+}
+
+func (s *testACLStore) CurrentUserPrivileges(ctx context.Context, name string) ([]Privilege, error) {
+	if name == "/shared" || strings.HasPrefix(name, "/shared/") || name == "/readonly.txt" {
+		return []Privilege{PrivilegeRead, PrivilegeReadCurrentUserPrivilegeSet}, nil
+	}
+	return []Privilege{PrivilegeAll}, nil
+}
+
+func (s *testACLStore) Owner(ctx context.Context, name string) (string, error) {
+	return "/principals/alice", nil
+}
+
+func (s *testACLStore) ACL(ctx context.Context, name string) ([]ACE, error) {
+	return s.acls[name], nil
+}
+
+func (s *testACLStore) SetACL(ctx context.Context, name string, aces []ACE) error {
+	s.acls[name] = aces
+	return nil
+}
+
+func (s *testACLStore) PrincipalCollectionSet(ctx context.Context) ([]string, error) {
+	return []string{"/principals/"}, nil
+}
+
+func TestHandler_acl(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/shared/a.txt": "a",
+		"/readonly.txt": "readonly",
+	})
+	store := &testACLStore{acls: make(map[string][]ACE)}
+	h := Handler{FileSystem: fs, PrivilegeChecker: store}
+
+	do := func(method, p, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/xml")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/shared/a.txt", ""); w.Code != http.StatusOK {
+		t.Errorf("GET in read-only collection: expected status 200, got %v", w.Code)
+	}
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPut, "/shared/a.txt"},
+		{http.MethodPut, "/shared/b.txt"},
+		{http.MethodDelete, "/shared/a.txt"},
+		{"MKCOL", "/shared/dir"},
+	} {
+		w := do(req.method, req.path, "")
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "need-privileges") {
+			t.Errorf("%v %v: expected need-privileges error, got %v: %v", req.method, req.path, w.Code, w.Body.String())
+		}
+	}
+	if w := do(http.MethodPut, "/b.txt", ""); w.Code/100 != 2 {
+		t.Errorf("PUT with all privileges: expected success, got %v", w.Code)
+	}
+	for _, method := range []string{"COPY", "MOVE"} {
+		req := httptest.NewRequest(method, "/b.txt", nil)
+		req.Header.Set("Destination", "/readonly.txt")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "need-privileges") {
+			t.Errorf("%v onto a read-only destination: expected need-privileges error, got %v: %v", method, w.Code, w.Body.String())
+		}
+	}
+	if b := readTestFile(t, fs, "/readonly.txt"); b != "readonly" {
+		t.Errorf("read-only destination was overwritten: %q", b)
+	}
+
+	w := do("PROPFIND", "/shared", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:current-user-privilege-set/><D:owner/></D:prop></D:propfind>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<read") || strings.Contains(w.Body.String(), "<all") || !strings.Contains(w.Body.String(), "/principals/alice") {
+		t.Errorf("PROPFIND: unexpected response %v: %v", w.Code, w.Body.String())
+	}
+
+	w = do("ACL", "/b.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:acl xmlns:D="DAV:">
+	<D:ace>
+		<D:principal><D:href>/principals/bob</D:href></D:principal>
+		<D:grant><D:privilege><D:read/></D:privilege></D:grant>
+	</D:ace>
+</D:acl>`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ACL: expected status 200, got %v: %v", w.Code, w.Body.String())
+	}
+	want := []ACE{{Principal: "/principals/bob", Privileges: []Privilege{PrivilegeRead}}}
+	if !reflect.DeepEqual(store.acls["/b.txt"], want) {
+		t.Errorf("ACL stored %+v, want %+v", store.acls["/b.txt"], want)
+	}
+	if w := do("ACL", "/shared/a.txt", `<D:acl xmlns:D="DAV:"/>`); w.Code != http.StatusForbidden {
+		t.Errorf("ACL without write-acl: expected status 403, got %v", w.Code)
+	}
+}
+
+func TestHandler_windowsCompat(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/dir/":  "",
+		"/a.txt": "a",
+	})
+	h := Handler{FileSystem: fs, WindowsCompat: true}
+
+	do := func(method, p, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/xml")
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodOptions, "/", "")
+	if w.Header().Get("MS-Author-Via") != "DAV" || !strings.Contains(w.Header().Get("DAV"), "2") {
+		t.Errorf("OPTIONS: unexpected headers %v", w.Header())
+	}
+
+	w = do("PROPFIND", "/", "")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND with an empty body: expected status 207, got %v: %v", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<href>/</href>") || !strings.Contains(body, "<href>/dir/</href>") {
+		t.Errorf("PROPFIND: collection paths don't end with a slash: %v", body)
+	}
+
+	w = do("LOCK", "/a.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	if w.Code != http.StatusOK || w.Header().Get("Lock-Token") == "" {
+		t.Errorf("LOCK: expected status 200 with a lock token, got %v", w.Code)
+	}
+
+	w = do("PROPPATCH", "/dir", `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+	<D:set><D:prop><Z:Win32FileAttributes>00000010</Z:Win32FileAttributes></D:prop></D:set>
+</D:propertyupdate>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Errorf("PROPPATCH with Win32 properties: unexpected response %v: %v", w.Code, w.Body.String())
+	}
+}
+
+type quotaFileSystem struct {
+	*MemFileSystem
+	available int64
+}
+
+func (fs quotaFileSystem) Quota(ctx context.Context, name string) (*Quota, error) {
+	return &Quota{Available: fs.available, Used: 1}, nil
+}
+
+func TestHandler_quota(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{"/a.txt": "a"})
+	h := Handler{FileSystem: quotaFileSystem{fs, 4}}
+
+	req := httptest.NewRequest("PROPFIND", "/", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Depth", "0")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "<quota-available-bytes xmlns=\"DAV:\">4<") || !strings.Contains(body, "<quota-used-bytes xmlns=\"DAV:\">1<") {
+		t.Errorf("PROPFIND: quota missing from response: %v", body)
+	}
+
+	put := func(p, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, p, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := put("/b.txt", "hello"); w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), "quota-not-exceeded") {
+		t.Errorf("PUT exceeding quota: expected quota-not-exceeded error, got %v: %v", w.Code, w.Body.String())
+	}
+	// Replacing a file frees its size
+	if w := put("/a.txt", "hello"); w.Code/100 != 2 {
+		t.Errorf("PUT within quota: expected success, got %v: %v", w.Code, w.Body.String())
+	}
+
+	// Bodies of unknown size are checked while they're read
+	putChunked := func(p, body, expected string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, p, ioutil.NopCloser(strings.NewReader(body)))
+		req.ContentLength = -1
+		if expected != "" {
+			req.Header.Set("X-Expected-Entity-Length", expected)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := putChunked("/c.txt", "hello", ""); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("chunked PUT exceeding quota: expected 507, got %v: %v", w.Code, w.Body.String())
+	}
+	if w := putChunked("/d.txt", "hello", "1"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("chunked PUT exceeding X-Expected-Entity-Length: expected 507, got %v: %v", w.Code, w.Body.String())
+	}
+	if w := putChunked("/e.txt", "abcd", ""); w.Code/100 != 2 {
+		t.Errorf("chunked PUT within quota: expected success, got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+func TestClient_expectContinue(t *testing.T) {
+	fs := &MemFileSystem{}
+	h := &Handler{FileSystem: quotaFileSystem{fs, 8}}
+	var expect string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect = r.Header.Get("Expect")
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	hc := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	c, err := NewClient(HTTPClientWithExpectContinue(hc, 4), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := c.Put(ctx, "/small.txt", strings.NewReader("abc"), nil); err != nil {
+		t.Fatalf("Put() = %v", err)
+	} else if expect != "" {
+		t.Errorf("Put() below the threshold sent Expect: %q", expect)
+	}
+
+	_, err = c.Put(ctx, "/large.txt", strings.NewReader("hello world"), nil)
+	if err == nil || !isHTTPErrorCode(err, http.StatusInsufficientStorage) {
+		t.Errorf("Put() exceeding quota = %v, want 507", err)
+	}
+	if expect != "100-continue" {
+		t.Errorf("Put() above the threshold sent Expect: %q, want 100-continue", expect)
+	}
+	if testFileExists(t, fs, "/large.txt") {
+		t.Errorf("rejected file has been created")
+	}
+}
+
+func TestHandler_finder(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/sub/":  "",
+		"/._old": "metadata",
+	})
+	h := Handler{
+		FileSystem: quotaFileSystem{fs, 100},
+		Finder:     &FinderOptions{AppleDouble: AppleDoubleDiscard},
+	}
+
+	do := func(method, p, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("LOCK", "/._a.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`, map[string]string{"Content-Type": "application/xml"})
+	if w.Code != http.StatusCreated {
+		t.Errorf("LOCK: expected 201, got %v: %v", w.Code, w.Body.String())
+	}
+	token := w.Header().Get("Lock-Token")
+	ifHeader := map[string]string{"If": "(" + token + ")"}
+	if w := do(http.MethodPut, "/._a.txt", "metadata", ifHeader); w.Code/100 != 2 {
+		t.Errorf("PUT: expected success, got %v: %v", w.Code, w.Body.String())
+	}
+	if testFileExists(t, fs, "/._a.txt") {
+		t.Errorf("AppleDouble file was stored")
+	}
+	if w := do(http.MethodDelete, "/._a.txt", "", ifHeader); w.Code/100 != 2 {
+		t.Errorf("DELETE: expected success, got %v: %v", w.Code, w.Body.String())
+	}
+	if w := do("UNLOCK", "/._a.txt", "", map[string]string{"Lock-Token": token}); w.Code != http.StatusNoContent {
+		t.Errorf("UNLOCK with released token: expected 204, got %v: %v", w.Code, w.Body.String())
+	}
+
+	w = do("PROPFIND", "/", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:quota-available-bytes/></D:prop></D:propfind>`, map[string]string{
+		"Content-Type": "application/xml",
+		"Depth":        "1",
+	})
+	body := w.Body.String()
+	if strings.Contains(body, "._old") {
+		t.Errorf("PROPFIND: AppleDouble file listed: %v", body)
+	}
+	if n := strings.Count(body, "<quota-available-bytes xmlns=\"DAV:\">100<"); n != 1 {
+		t.Errorf("PROPFIND: expected quota for requested collection only, got %v: %v", n, body)
+	}
+
+	if w := do("MOVE", "/sub", "", map[string]string{"Destination": "/._sub"}); w.Code != http.StatusForbidden {
+		t.Errorf("MOVE to AppleDouble name: expected 403, got %v: %v", w.Code, w.Body.String())
+	}
+
+	h.Finder.AppleDouble = AppleDoubleReject
+	if w := do(http.MethodPut, "/.DS_Store", "metadata", nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT with reject policy: expected 403, got %v: %v", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/big.txt", strings.NewReader(strings.Repeat("a", 200)))
+	req.ContentLength = -1
+	req.Header.Set("X-Expected-Entity-Length", "200")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("chunked PUT exceeding quota: expected 507, got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_complianceReport(t *testing.T) {
+	var buf bytes.Buffer
+	h := Handler{
+		// Hide the DeadPropertyStore implemented by MemFileSystem
+		FileSystem:  struct{ FileSystem }{&MemFileSystem{}},
+		ErrorLog:    log.New(&buf, "", 0),
+		Diagnostics: true,
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodOptions, "/", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodOptions, "/", nil))
+	if n := strings.Count(buf.String(), "litmus suite locks:"); n != 1 {
+		t.Errorf("expected locks issue to be logged once, got %v: %v", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "litmus suite props (") {
+		t.Errorf("expected props issue to be logged: %v", buf.String())
+	}
+
+	h = Handler{FileSystem: &MemFileSystem{}, LockSystem: &MemLockSystem{}}
+	for _, issue := range h.ComplianceReport() {
+		if issue.Suite == "locks" && len(issue.Tests) == 0 {
+			t.Errorf("unexpected issue with LockSystem set: %v", &issue)
+		}
+	}
+}
+
+func TestHandler_capabilities(t *testing.T) {
+	h := Handler{
+		FileSystem:       &MemFileSystem{},
+		LockSystem:       &MemLockSystem{},
+		PropFindPageSize: 100,
+	}
+	caps := h.Capabilities()
+	if !reflect.DeepEqual(caps.Compliance, []string{"1", "3", "2"}) {
+		t.Errorf("Compliance = %v", caps.Compliance)
+	}
+	for _, feature := range []string{"locking", "sync-collection", "append", "propfind-paging"} {
+		found := false
+		for _, f := range caps.Features {
+			found = found || f == feature
+		}
+		if !found {
+			t.Errorf("Features = %v, want %q", caps.Features, feature)
+		}
+	}
+	if caps.Limits["propfind-page-size"] != 100 {
+		t.Errorf("Limits = %v", caps.Limits)
+	}
+	want := []CapabilityBackend{
+		{Role: "FileSystem", Type: "*webdav.MemFileSystem"},
+		{Role: "LockSystem", Type: "*webdav.MemLockSystem"},
+	}
+	if !reflect.DeepEqual(caps.Backends, want) {
+		t.Errorf("Backends = %+v, want %+v", caps.Backends, want)
+	}
+	if _, err := json.Marshal(caps); err != nil {
+		t.Errorf("failed to encode capabilities: %v", err)
+	}
+}
+
+func TestEncryptedFileSystem(t *testing.T) {
+	mem := &MemFileSystem{}
+	keys := StaticKey(bytes.Repeat([]byte{42}, 32))
+	fs := NewEncryptedFileSystem(mem, keys, nil)
+	ts := httptest.NewServer(&Handler{FileSystem: fs})
+	defer ts.Close()
+
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	const data = "top secret contents"
+	if _, err := c.Put(ctx, "/secret.txt", strings.NewReader(data), nil); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if b := readTestFile(t, mem, "/secret.txt"); strings.Contains(b, "secret") {
+		t.Errorf("stored file isn't encrypted: %q", b)
+	}
+
+	fi, err := c.Stat(ctx, "/secret.txt")
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	} else if fi.Size != int64(len(data)) {
+		t.Errorf("Stat() size = %v, want %v", fi.Size, len(data))
+	}
+
+	p := make([]byte, 6)
+	if _, err := c.ReadRange(ctx, "/secret.txt", p, 4); err != nil || string(p) != "secret" {
+		t.Errorf("ReadRange() = %q, %v, want %q", p, err, "secret")
+	}
+
+	// Contents are bound to the file path, but can be copied and moved
+	if err := c.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Copy(ctx, "/secret.txt", "/dir/copy.txt", nil); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	if err := c.Move(ctx, "/dir/", "/moved/", nil); err != nil {
+		t.Fatalf("Move() = %v", err)
+	}
+	for _, name := range []string{"/secret.txt", "/moved/copy.txt"} {
+		if rc, err := fs.Open(ctx, name); err != nil {
+			t.Errorf("Open(%q) = %v", name, err)
+		} else if b, _ := ioutil.ReadAll(rc); string(b) != data {
+			t.Errorf("Open(%q) = %q, want %q", name, b, data)
+		}
+	}
+	writeTestFile(t, mem, "/swapped.txt", readTestFile(t, mem, "/secret.txt"))
+	if _, err := fs.Open(ctx, "/swapped.txt"); err == nil {
+		t.Errorf("Open() of a file copied in storage = nil, want error")
+	}
+
+	writeTestFile(t, mem, "/plain.txt", data)
+	if _, err := fs.Open(ctx, "/plain.txt"); err != nil {
+		t.Errorf("Open() of a plaintext file = %v", err)
+	}
+	strict := NewEncryptedFileSystem(mem, keys, &EncryptionOptions{RejectPlaintext: true})
+	if _, err := strict.Open(ctx, "/plain.txt"); err == nil {
+		t.Errorf("Open() of a plaintext file with RejectPlaintext = nil, want error")
+	}
+}
+
+func TestEncryptedFileSystem_optionalInterfaces(t *testing.T) {
+	keys := StaticKey(bytes.Repeat([]byte{42}, 32))
+	h := &Handler{FileSystem: NewEncryptedFileSystem(&MemFileSystem{}, keys, nil)}
+	caps := h.Capabilities()
+	for _, feature := range []string{"dead-properties", "sync-collection", "streaming-propfind"} {
+		found := false
+		for _, f := range caps.Features {
+			found = found || f == feature
+		}
+		if !found {
+			t.Errorf("Features = %v, want %q", caps.Features, feature)
+		}
+	}
+	for _, f := range caps.Features {
+		if f == "append" {
+			t.Errorf("Features = %v, want no %q", caps.Features, f)
+		}
+	}
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	const data = "top secret contents"
+	fi, err := c.Put(ctx, "/secret.txt", strings.NewReader(data), &PutOptions{IfNoneMatch: "*"})
+	if err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if _, err := c.Put(ctx, "/secret.txt", strings.NewReader(data), &PutOptions{IfMatch: MatchETag("stale")}); !isHTTPErrorCode(err, http.StatusPreconditionFailed) {
+		t.Errorf("Put() with stale If-Match = %v, want %v", err, http.StatusPreconditionFailed)
+	}
+	if _, err := c.Put(ctx, "/secret.txt", strings.NewReader(data), &PutOptions{IfMatch: MatchETag(fi.ETag)}); err != nil {
+		t.Errorf("Put() with matching If-Match = %v", err)
+	}
+
+	l, err := c.ReadDir(ctx, "/", false)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	for _, fi := range l {
+		if !fi.IsDir && fi.Size != int64(len(data)) {
+			t.Errorf("ReadDir() size of %q = %v, want %v", fi.Path, fi.Size, len(data))
+		}
+	}
+}
+
+func TestClient_digestAuthInt(t *testing.T) {
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, credentials := internal.ParseAuthorization(r.Header.Get("Authorization"))
+		params, _ := internal.ParseAuthParams(credentials)
+		body, _ := ioutil.ReadAll(r.Body)
+
+		h := func(s string) string { return internal.DigestHash("MD5", s) }
+		ha1 := h("alice:DAV:secret")
+		ha2 := h(r.Method + ":" + r.RequestURI + ":" + h(string(body)))
+		want := h(strings.Join([]string{ha1, nonce, params["nc"], params["cnonce"], "auth-int", ha2}, ":"))
+		if scheme != "Digest" || params["qop"] != "auth-int" || params["response"] != want {
+			w.Header().Set("WWW-Authenticate", `Digest realm="DAV", qop="auth-int", nonce="`+nonce+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(HTTPClientWithDigestAuth(nil, "alice", "secret"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, err := c.Create(context.Background(), "/file.txt")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := wc.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
+
+type testTokenSource struct {
+	tokens []string
+}
+
+func (ts *testTokenSource) Token(ctx context.Context, refresh bool) (string, error) {
+	if refresh {
+		ts.tokens = ts.tokens[1:]
+	}
+	return ts.tokens[0], nil
+}
+
+func TestClient_bearerToken(t *testing.T) {
+	h := &Handler{FileSystem: &MemFileSystem{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	tokens := &testTokenSource{tokens: []string{"expired", "fresh"}}
+	c, err := NewClient(HTTPClientWithBearerToken(nil, tokens), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := c.Put(ctx, "/file.txt", strings.NewReader("hello"), nil); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if len(tokens.tokens) != 1 {
+		t.Errorf("token refreshed %v times, want once", 2-len(tokens.tokens))
+	}
+	if _, err := c.Stat(ctx, "/file.txt"); err != nil {
+		t.Errorf("Stat() = %v", err)
+	}
+}
+
+type reverseWalkFileSystem struct {
+	*MemFileSystem
+}
+
+func (fs reverseWalkFileSystem) WalkDir(ctx context.Context, name string, recursive bool, fn func(fi *FileInfo) error) error {
+	l, err := fs.MemFileSystem.ReadDir(ctx, name, recursive)
+	if err != nil {
+		return err
+	}
+	for i := len(l) - 1; i >= 0; i-- {
+		if err := fn(&l[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHandler_sortResponses(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{
+		"/a.txt": "x",
+		"/b.txt": "x",
+		"/c.txt": "x",
+	})
+	h := Handler{FileSystem: reverseWalkFileSystem{fs}, SortResponses: true}
+
+	propfind := func() []string {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var ms internal.MultiStatus
+		if err := xml.Unmarshal(w.Body.Bytes(), &ms); err != nil {
+			t.Fatalf("failed to decode PROPFIND response: %v", err)
+		}
+		var hrefs []string
+		for _, resp := range ms.Responses {
+			hrefs = append(hrefs, resp.Hrefs[0].String())
+		}
+		return hrefs
+	}
+
+	want := []string{"/", "/a.txt", "/b.txt", "/c.txt"}
+	if hrefs := propfind(); !reflect.DeepEqual(hrefs, want) {
+		t.Errorf("PROPFIND hrefs = %v, want %v", hrefs, want)
+	}
+	h.SortResponses = false
+	if hrefs := propfind(); reflect.DeepEqual(hrefs, want) {
+		t.Errorf("PROPFIND hrefs = %v, want FileSystem order", hrefs)
+	}
+}
+
+func TestMemFileSystem(t *testing.T) {
+	fs := &MemFileSystem{}
+	ts := httptest.NewServer(&Handler{FileSystem: fs})
+	defer ts.Close()
+
+	ctx := context.Background()
+	c, err := NewClient(nil, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(name, data string) {
+		wc, err := c.Create(ctx, name)
+		if err != nil {
+			t.Fatalf("Create(%q) = %v", name, err)
+		}
+		io.WriteString(wc, data)
+		if err := wc.Close(); err != nil {
+			t.Fatalf("Create(%q) = %v", name, err)
+		}
+	}
+
+	if err := c.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatalf("Mkdir() = %v", err)
+	}
+	put("/dir/a.txt", "hello")
+	if err := c.Copy(ctx, "/dir", "/copy", nil); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	if err := c.Move(ctx, "/dir/a.txt", "/b.txt", nil); err != nil {
+		t.Fatalf("Move() = %v", err)
+	}
+	if err := c.Mkdir(ctx, "/missing/dir"); !isHTTPErrorCode(err, http.StatusConflict) {
+		t.Errorf("Mkdir() with missing parent = %v, want 409", err)
+	}
+
+	files, err := c.ReadDir(ctx, "/", true)
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	var paths []string
+	for _, fi := range files {
+		paths = append(paths, fi.Path)
+	}
+	want := []string{"/", "/b.txt", "/copy", "/copy/a.txt", "/dir"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("ReadDir() = %v, want %v", paths, want)
+	}
+
+	rc, err := c.Open(ctx, "/copy/a.txt")
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "hello" {
+		t.Errorf("Open() = %q, want %q", b, "hello")
+	}
+
+	token, err := fs.SyncToken(ctx, "/")
+	if err != nil {
+		t.Fatalf("SyncToken() = %v", err)
+	}
+	fi, err := c.Stat(ctx, "/b.txt")
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	put("/b.txt", "world")
+	if err := c.RemoveAll(ctx, "/copy"); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+	if newFI, err := c.Stat(ctx, "/b.txt"); err != nil || newFI.ETag == fi.ETag {
+		t.Errorf("ETag unchanged after PUT: %v, %v", fi.ETag, err)
+	}
+
+	changes, err := fs.Changes(ctx, "/", token, true)
+	if err != nil {
+		t.Fatalf("Changes() = %v", err)
+	}
+	if len(changes.Added) != 0 || !reflect.DeepEqual(changes.Modified, []string{"/b.txt"}) || !reflect.DeepEqual(changes.Deleted, []string{"/copy", "/copy/a.txt"}) {
+		t.Errorf("Changes() = %+v", changes)
+	}
+	if changes.SyncToken == token {
+		t.Errorf("sync token unchanged: %v", token)
+	}
+	if _, err := fs.Changes(ctx, "/", changes.SyncToken+"0", true); err != ErrInvalidSyncToken {
+		t.Errorf("Changes() with future token = %v, want ErrInvalidSyncToken", err)
+	}
+}
@@ -0,0 +1,264 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// LocalStore is the local side of a two-way sync performed by Sync. Objects
+// are identified by slash-separated names relative to the synchronized
+// collection.
+type LocalStore interface {
+	// List returns the versions of all local objects, keyed by name. A
+	// version is an opaque string which changes whenever the object is
+	// modified, e.g. a hash or a modification time.
+	List(ctx context.Context) (map[string]string, error)
+	Read(ctx context.Context, name string) (io.ReadCloser, error)
+	// Write creates or replaces an object and returns its new version.
+	Write(ctx context.Context, name string, r io.Reader) (version string, err error)
+	Remove(ctx context.Context, name string) error
+}
+
+// SyncEntry records the state of an object as of the last sync.
+type SyncEntry struct {
+	ETag    string `json:"etag"`
+	Version string `json:"version"`
+}
+
+// SyncState records the state of all objects as of the last sync. Objects
+// present in the state but missing from one side have been deleted there.
+type SyncState struct {
+	Entries map[string]SyncEntry `json:"entries"`
+}
+
+// ConflictPolicy specifies how Sync handles objects modified on both sides.
+type ConflictPolicy int
+
+const (
+	// ConflictRemoteWins overwrites local changes with remote ones.
+	ConflictRemoteWins ConflictPolicy = iota
+	// ConflictLocalWins overwrites remote changes with local ones.
+	ConflictLocalWins
+	// ConflictSkip leaves both sides untouched. The conflict is reported
+	// again by the next Sync call until it's resolved.
+	ConflictSkip
+)
+
+// SyncOptions contains options for Sync.
+type SyncOptions struct {
+	// Path is the remote collection to synchronize. It defaults to "/".
+	Path string
+	// State is updated in place after each object is synchronized and
+	// should be persisted between calls. If Sync fails, persisting the
+	// state allows a later call to resume where it left off.
+	State *SyncState
+	// Conflict is the policy used for objects modified on both sides.
+	Conflict ConflictPolicy
+}
+
+// SyncResult lists the names of objects changed by Sync.
+type SyncResult struct {
+	Pulled, Pushed              []string
+	DeletedLocal, DeletedRemote []string
+	Conflicts                   []string
+}
+
+// Sync performs a two-way synchronization between a remote collection and a
+// local store. Changes are detected by comparing remote ETags and local
+// versions with the sync state. Uploads are conditional: objects modified
+// remotely after being listed are reported as conflicts and left untouched.
+func Sync(ctx context.Context, c *Client, local LocalStore, opts *SyncOptions) (*SyncResult, error) {
+	if opts == nil || opts.State == nil {
+		return nil, fmt.Errorf("webdav: missing sync state")
+	}
+	state := opts.State
+	if state.Entries == nil {
+		state.Entries = make(map[string]SyncEntry)
+	}
+
+	remote, err := readDirRel(ctx, c, opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: failed to list remote collection: %w", err)
+	}
+	root := remote[""].Path
+	files := make(map[string]*FileInfo, len(remote))
+	for name, fi := range remote {
+		if !fi.IsDir {
+			files[name] = fi
+		}
+	}
+
+	localVersions, err := local.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: failed to list local store: %w", err)
+	}
+
+	nameSet := make(map[string]bool)
+	for name := range files {
+		nameSet[name] = true
+	}
+	for name := range localVersions {
+		nameSet[name] = true
+	}
+	for name := range state.Entries {
+		nameSet[name] = true
+	}
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := syncer{
+		c:       c,
+		local:   local,
+		state:   state,
+		root:    root,
+		remote:  remote,
+		results: new(SyncResult),
+	}
+	for _, name := range names {
+		fi, remoteExists := files[name]
+		version, localExists := localVersions[name]
+		entry, synced := state.Entries[name]
+
+		remoteChanged := remoteExists != synced || (remoteExists && fi.ETag != entry.ETag)
+		localChanged := localExists != synced || (localExists && version != entry.Version)
+
+		pull := remoteChanged
+		if remoteChanged && localChanged {
+			switch {
+			case !remoteExists && !localExists:
+				delete(state.Entries, name)
+				continue
+			case opts.Conflict == ConflictSkip:
+				s.results.Conflicts = append(s.results.Conflicts, name)
+				continue
+			}
+			pull = opts.Conflict == ConflictRemoteWins
+		} else if !remoteChanged && !localChanged {
+			continue
+		}
+
+		if pull {
+			err = s.pull(ctx, name, fi, remoteExists)
+		} else {
+			err = s.push(ctx, name, version, localExists, fi)
+		}
+		if err != nil {
+			return s.results, err
+		}
+	}
+
+	return s.results, nil
+}
+
+type syncer struct {
+	c       *Client
+	local   LocalStore
+	state   *SyncState
+	root    string
+	remote  map[string]*FileInfo
+	results *SyncResult
+}
+
+func (s *syncer) pull(ctx context.Context, name string, fi *FileInfo, exists bool) error {
+	if !exists {
+		if err := s.local.Remove(ctx, name); err != nil {
+			return err
+		}
+		delete(s.state.Entries, name)
+		s.results.DeletedLocal = append(s.results.DeletedLocal, name)
+		return nil
+	}
+
+	r, err := s.c.Open(ctx, fi.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	version, err := s.local.Write(ctx, name, r)
+	if err != nil {
+		return err
+	}
+	s.state.Entries[name] = SyncEntry{ETag: fi.ETag, Version: version}
+	s.results.Pulled = append(s.results.Pulled, name)
+	return nil
+}
+
+// push uploads a local object. remote is the remote object as listed, or nil
+// if it didn't exist: the upload fails if it has changed since, and the object
+// is reported as a conflict.
+func (s *syncer) push(ctx context.Context, name, version string, exists bool, remote *FileInfo) error {
+	p := path.Join(s.root, name)
+
+	if !exists {
+		if err := s.c.RemoveAll(ctx, p); err != nil {
+			return err
+		}
+		delete(s.state.Entries, name)
+		s.results.DeletedRemote = append(s.results.DeletedRemote, name)
+		return nil
+	}
+
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+
+	r, err := s.local.Read(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var options PutOptions
+	if remote != nil && remote.ETag != "" {
+		options.IfMatch = ConditionalMatch(internal.ETag(remote.ETag).String())
+	} else if remote == nil {
+		options.IfNoneMatch = "*"
+	}
+	fi, err := s.c.Put(ctx, p, r, &options)
+	var httpErr *internal.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Code == http.StatusPreconditionFailed {
+		s.results.Conflicts = append(s.results.Conflicts, name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.ETag == "" {
+		if fi, err = s.c.Stat(ctx, p); err != nil {
+			return err
+		}
+	}
+	s.state.Entries[name] = SyncEntry{ETag: fi.ETag, Version: version}
+	s.results.Pushed = append(s.results.Pushed, name)
+	return nil
+}
+
+// mkdirAll creates missing remote parent collections.
+func (s *syncer) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if fi, ok := s.remote[dir]; ok && fi.IsDir {
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := s.c.Mkdir(ctx, path.Join(s.root, dir)+"/"); err != nil {
+		return err
+	}
+	s.remote[dir] = &FileInfo{Path: path.Join(s.root, strings.Trim(dir, "/")), IsDir: true}
+	return nil
+}
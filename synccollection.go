@@ -0,0 +1,100 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// ErrInvalidSyncToken is returned by backends when a sync token is unknown or
+// has expired. Clients then fall back to a full synchronization.
+var ErrInvalidSyncToken = internal.ErrInvalidSyncToken
+
+// SyncChanges describes the changes to a collection since a sync token, as
+// defined in RFC 6578.
+type SyncChanges struct {
+	// SyncToken is the current sync token of the collection.
+	SyncToken string
+	// Added, Modified and Deleted contain the paths of the members of the
+	// collection which have been added, modified and removed since the sync
+	// token.
+	Added    []string
+	Modified []string
+	Deleted  []string
+}
+
+// SyncFileSystem is an optional interface which can be implemented by a
+// FileSystem to support collection synchronization (RFC 6578) via the
+// sync-collection REPORT.
+type SyncFileSystem interface {
+	// SyncToken returns the current sync token of a directory.
+	SyncToken(ctx context.Context, name string) (string, error)
+	// Changes returns the changes to a directory since a sync token. An empty
+	// sync token requests an initial synchronization: all members are
+	// reported as added. If recursive is true, all descendants are included
+	// instead of the direct members only. ErrInvalidSyncToken is returned if
+	// the sync token isn't valid anymore.
+	Changes(ctx context.Context, name, syncToken string, recursive bool) (*SyncChanges, error)
+}
+
+func (b *backend) handleSyncCollection(w http.ResponseWriter, r *http.Request, fs SyncFileSystem) error {
+	var query internal.SyncCollectionQuery
+	if err := internal.DecodeXMLRequest(r, &query); err != nil {
+		return err
+	}
+	recursive, err := query.IsRecursive()
+	if err != nil {
+		return err
+	}
+
+	if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return &internal.HTTPError{Code: http.StatusNotFound}
+	}
+	fi, err := b.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil {
+		return err
+	} else if !fi.IsDir {
+		return internal.HTTPErrorf(http.StatusForbidden, "webdav: sync-collection REPORT is only supported on collections")
+	}
+
+	page, err := query.Page(func(syncToken string) (string, []string, []string, error) {
+		changes, err := fs.Changes(r.Context(), r.URL.Path, syncToken, recursive)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return changes.SyncToken, append(changes.Added, changes.Modified...), changes.Deleted, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	propfind := internal.PropFind{Prop: query.Prop}
+	if propfind.Prop == nil {
+		propfind.Prop = &internal.Prop{}
+	}
+	var resps []internal.Response
+	deleted := page.Deleted
+	for _, p := range page.Updated {
+		// Members the current user can't read are reported as removed,
+		// as in PROPFIND listings
+		if !b.Visibility.IsVisible(r.Context(), p) || !b.canRead(r.Context(), p) {
+			deleted = append(deleted, p)
+			continue
+		}
+		fi, err := b.FileSystem.Stat(r.Context(), p)
+		if internal.IsNotFound(err) {
+			deleted = append(deleted, p)
+			continue
+		} else if err != nil {
+			return err
+		}
+		resp, err := b.propFindFile(r.Context(), &propfind, fi, true)
+		if err != nil {
+			return err
+		}
+		resps = append(resps, *resp)
+	}
+
+	return internal.ServeSyncCollection(w, r.URL.Path, page, resps, deleted, b.SortResponses)
+}
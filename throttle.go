@@ -0,0 +1,180 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bandwidth of transfers with a token bucket. A Throttle
+// can be shared between transfers to apply a common limit, e.g. to all
+// requests of a user.
+type Throttle struct {
+	rate int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewThrottle creates a new throttle limiting transfers to bytesPerSec bytes
+// per second. Bursts of up to one second worth of data are allowed.
+func NewThrottle(bytesPerSec int64) *Throttle {
+	if bytesPerSec <= 0 {
+		panic("webdav: invalid throttle rate")
+	}
+	return &Throttle{rate: bytesPerSec}
+}
+
+// reserve takes n tokens from the bucket and returns the delay to wait
+// before transferring n bytes.
+func (t *Throttle) reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.last.IsZero() {
+		t.tokens = float64(t.rate)
+	} else {
+		t.tokens += now.Sub(t.last).Seconds() * float64(t.rate)
+		if t.tokens > float64(t.rate) {
+			t.tokens = float64(t.rate)
+		}
+	}
+	t.last = now
+
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / float64(t.rate) * float64(time.Second))
+}
+
+func (t *Throttle) wait(ctx context.Context, n int) error {
+	delay := t.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunkSize returns the size of the chunks transfers are split into, so that
+// a single large read or write doesn't exceed the burst size.
+func (t *Throttle) chunkSize(n int) int {
+	if int64(n) > t.rate {
+		return int(t.rate)
+	}
+	return n
+}
+
+type throttledReader struct {
+	ctx context.Context
+	t   *Throttle
+	r   io.Reader
+}
+
+func (tr *throttledReader) Read(b []byte) (int, error) {
+	n, err := tr.r.Read(b[:tr.t.chunkSize(len(b))])
+	if n > 0 {
+		if waitErr := tr.t.wait(tr.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// Reader returns a reader limited by the throttle. Waiting is interrupted
+// when the context is cancelled.
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &throttledReader{ctx, t, r}
+}
+
+type throttledWriter struct {
+	ctx context.Context
+	t   *Throttle
+	w   io.Writer
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:tw.t.chunkSize(len(b))]
+		if err := tw.t.wait(tw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Writer returns a writer limited by the throttle. Waiting is interrupted
+// when the context is cancelled.
+func (t *Throttle) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &throttledWriter{ctx, t, w}
+}
+
+type throttledBody struct {
+	io.Reader
+	io.Closer
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (rw *throttledResponseWriter) Write(b []byte) (int, error) {
+	return rw.w.Write(b)
+}
+
+// throttle limits the bandwidth of the request and response bodies of GET,
+// HEAD and PUT requests.
+func throttle(t *Throttle, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w = &throttledResponseWriter{w, t.Writer(r.Context(), w)}
+	case http.MethodPut:
+		r.Body = throttledBody{t.Reader(r.Context(), r.Body), r.Body}
+	}
+	return w, r
+}
+
+type throttledHTTPClient struct {
+	c HTTPClient
+	t *Throttle
+}
+
+func (c *throttledHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body = throttledBody{c.t.Reader(req.Context(), req.Body), req.Body}
+	}
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = throttledBody{c.t.Reader(req.Context(), resp.Body), resp.Body}
+	return resp, nil
+}
+
+// HTTPClientWithThrottle returns an HTTP client that limits the bandwidth of
+// request and response bodies. If c is nil, http.DefaultClient is used.
+func HTTPClientWithThrottle(c HTTPClient, t *Throttle) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &throttledHTTPClient{c, t}
+}
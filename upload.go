@@ -0,0 +1,295 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-webdav/internal"
+)
+
+// AppendFileSystem is an optional interface which can be implemented by a
+// FileSystem to support resumable uploads. Large files can then be uploaded
+// in chunks: the first chunk is sent with PUT, and the following ones are
+// appended with PATCH requests carrying a Content-Range header. See
+// Client.ResumableUpload.
+type AppendFileSystem interface {
+	FileSystem
+	// AppendFile opens an existing file for appending. An HTTP 404 error is
+	// returned if the file doesn't exist.
+	AppendFile(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// parseContentRange parses a Content-Range header with a byte range, e.g.
+// "bytes 0-499/1234". The complete length is -1 if unknown.
+func parseContentRange(s string) (start, end, total int64, err error) {
+	spec := strings.TrimPrefix(s, "bytes ")
+	if spec == s {
+		return 0, 0, 0, fmt.Errorf("webdav: unsupported Content-Range unit in %q", s)
+	}
+	i := strings.IndexByte(spec, '/')
+	j := strings.IndexByte(spec, '-')
+	if i < 0 || j < 0 || j > i {
+		return 0, 0, 0, fmt.Errorf("webdav: malformed Content-Range %q", s)
+	}
+
+	if start, err = strconv.ParseInt(spec[:j], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("webdav: malformed Content-Range %q", s)
+	}
+	if end, err = strconv.ParseInt(spec[j+1:i], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("webdav: malformed Content-Range %q", s)
+	}
+	total = -1
+	if spec[i+1:] != "*" {
+		if total, err = strconv.ParseInt(spec[i+1:], 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("webdav: malformed Content-Range %q", s)
+		}
+	}
+
+	if start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("webdav: invalid Content-Range %q", s)
+	}
+	return start, end, total, nil
+}
+
+// pathLocks serializes operations on the same path.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks a path, and returns a function unlocking it.
+func (l *pathLocks) lock(p string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*pathLock)
+	}
+	pl := l.locks[p]
+	if pl == nil {
+		pl = new(pathLock)
+		l.locks[p] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, p)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Patch appends the chunk of a resumable upload to a file. Chunks must start
+// at the end of the file. Otherwise, the request fails with HTTP 416 and the
+// current size of the file is sent in the Content-Range header.
+func (b *backend) Patch(w http.ResponseWriter, r *http.Request) (*internal.PutResult, error) {
+	fs, ok := b.FileSystem.(AppendFileSystem)
+	if !ok {
+		return nil, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: unsupported method")
+	}
+
+	start, end, _, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, &internal.HTTPError{Code: http.StatusBadRequest, Err: err}
+	}
+	length := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: Content-Length doesn't match Content-Range")
+	}
+
+	if err := b.checkLocks(r, r.URL.Path, false); err != nil {
+		return nil, err
+	}
+	if err := b.Finder.checkCreate(r.URL.Path); err != nil {
+		return nil, err
+	}
+	if b.Finder.discards(r.URL.Path) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		return nil, err
+	}
+	if !b.Visibility.IsVisible(r.Context(), r.URL.Path) {
+		return nil, &internal.HTTPError{Code: http.StatusNotFound}
+	}
+
+	// Concurrent chunks must not be appended at the same offset
+	unlock := b.uploads.lock(r.URL.Path)
+	defer unlock()
+
+	fi, err := fs.Stat(r.Context(), r.URL.Path)
+	if err != nil {
+		return nil, err
+	} else if fi.IsDir {
+		return nil, internal.HTTPErrorf(http.StatusMethodNotAllowed, "webdav: PATCH isn't supported on collections")
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !internal.MatchETag(ifMatch, fi.ETag, false) {
+		return nil, internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: If-Match precondition failed")
+	}
+	if start != fi.Size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+		return nil, internal.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "webdav: chunk doesn't start at the end of the file (%d bytes)", fi.Size)
+	}
+	if qp, ok := optionalFileSystem(b.FileSystem).(QuotaProvider); ok {
+		quota, err := qp.Quota(r.Context(), r.URL.Path)
+		if err != nil {
+			return nil, err
+		} else if quota.Available >= 0 && length > quota.Available {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	wc, err := fs.AppendFile(r.Context(), r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer wc.Close()
+
+	// Data received before a failure is kept, so that the client can resume
+	// from there
+	if _, err := io.CopyN(wc, r.Body, length); err == io.EOF {
+		return nil, internal.HTTPErrorf(http.StatusBadRequest, "webdav: request body is shorter than Content-Range")
+	} else if err != nil {
+		return nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+
+	res := &internal.PutResult{}
+	if fi, err := fs.Stat(r.Context(), r.URL.Path); err == nil {
+		res.ETag = fi.ETag
+	}
+	return res, nil
+}
+
+// ResumableUploadOptions holds options for Client.ResumableUpload.
+type ResumableUploadOptions struct {
+	// ChunkSize is the size of the chunks. Defaults to 8 MiB.
+	ChunkSize int64
+	// MaxRetries is the number of times a chunk is retried after a failure.
+	// Defaults to 3. Negative values disable retries.
+	MaxRetries int
+	// Resume continues the upload to an existing file, which must contain
+	// the beginning of the data, instead of overwriting it.
+	Resume bool
+}
+
+const defaultChunkSize = 8 << 20
+
+// ResumableUpload uploads size bytes read from r to a file in chunks, on
+// servers supporting resumable uploads (see AppendFileSystem). Failed chunks
+// are retried from the current size of the file on the server.
+func (c *Client) ResumableUpload(ctx context.Context, name string, r io.ReaderAt, size int64, options *ResumableUploadOptions) (*FileInfo, error) {
+	var opts ResumableUploadOptions
+	if options != nil {
+		opts = *options
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+
+	var offset int64
+	created := false
+	if opts.Resume {
+		fi, err := c.Stat(ctx, name)
+		if err == nil {
+			offset, created = fi.Size, true
+		} else if !internal.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	retries := 0
+	for {
+		if offset > size {
+			return nil, fmt.Errorf("webdav: %q is larger than the uploaded data", name)
+		} else if offset == size && created {
+			break
+		}
+
+		n := size - offset
+		if n > opts.ChunkSize {
+			n = opts.ChunkSize
+		}
+		chunk := io.NewSectionReader(r, offset, n)
+
+		var err error
+		if created {
+			err = c.appendChunk(ctx, name, chunk, offset, size)
+		} else {
+			_, err = c.Put(ctx, name, chunk, nil)
+		}
+		if err == nil {
+			offset += n
+			created = true
+			retries = 0
+			continue
+		}
+
+		if ctx.Err() != nil || !isRetryableUploadError(err) || retries >= opts.MaxRetries {
+			return nil, err
+		}
+		retries++
+
+		// Find out how much data the server has received
+		fi, statErr := c.Stat(ctx, name)
+		if internal.IsNotFound(statErr) {
+			offset, created = 0, false
+		} else if statErr != nil {
+			return nil, err
+		} else {
+			offset, created = fi.Size, true
+		}
+	}
+
+	return c.Stat(ctx, name)
+}
+
+func (c *Client) appendChunk(ctx context.Context, name string, chunk *io.SectionReader, offset, size int64) error {
+	req, err := c.ic.NewRequest(ctx, http.MethodPatch, name, chunk)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = chunk.Size()
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+chunk.Size()-1, size))
+
+	resp, err := c.ic.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// isRetryableUploadError reports whether retrying a chunk may succeed after
+// an error.
+func isRetryableUploadError(err error) bool {
+	var httpErr *internal.HTTPError
+	if !errors.As(err, &httpErr) {
+		// Network error
+		return true
+	}
+	switch httpErr.Code {
+	case http.StatusRequestTimeout, http.StatusRequestedRangeNotSatisfiable, http.StatusTooManyRequests:
+		return true
+	}
+	return httpErr.Code/100 == 5 && httpErr.Code != http.StatusNotImplemented
+}
@@ -0,0 +1,179 @@
+package webdav
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ErrDataLimitExceeded is returned by HTTP clients created with
+// HTTPClientWithDataUsage once the data usage limit has been reached.
+var ErrDataLimitExceeded = errors.New("webdav: data usage limit exceeded")
+
+// OperationUsage is the data transferred by the requests of an HTTP method.
+type OperationUsage struct {
+	Requests      int64
+	RequestBytes  int64
+	ResponseBytes int64
+}
+
+// DataUsage accounts for the data transferred by an HTTP client, e.g. to
+// report sync data usage on metered connections. Only request and response
+// bodies are counted. It's safe for concurrent use.
+type DataUsage struct {
+	// Limit, if non-zero, is the maximum number of bytes transferred. Once
+	// it's reached, new requests and reads of bodies in flight fail with
+	// ErrDataLimitExceeded. Concurrent requests may exceed it slightly. It
+	// must not be changed while requests are in flight.
+	Limit int64
+
+	mu  sync.Mutex
+	ops map[string]OperationUsage
+}
+
+// Operations returns the data transferred so far, indexed by HTTP method.
+func (u *DataUsage) Operations() map[string]OperationUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	m := make(map[string]OperationUsage, len(u.ops))
+	for method, op := range u.ops {
+		m[method] = op
+	}
+	return m
+}
+
+// Total returns the number of bytes transferred so far.
+func (u *DataUsage) Total() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.total()
+}
+
+func (u *DataUsage) total() int64 {
+	var n int64
+	for _, op := range u.ops {
+		n += op.RequestBytes + op.ResponseBytes
+	}
+	return n
+}
+
+// Reset clears the counters, e.g. at the start of a billing period.
+func (u *DataUsage) Reset() {
+	u.mu.Lock()
+	u.ops = nil
+	u.mu.Unlock()
+}
+
+func (u *DataUsage) add(method string, f func(op *OperationUsage)) {
+	u.mu.Lock()
+	if u.ops == nil {
+		u.ops = make(map[string]OperationUsage)
+	}
+	op := u.ops[method]
+	f(&op)
+	u.ops[method] = op
+	u.mu.Unlock()
+}
+
+// remaining returns the number of bytes left before the limit is reached, or
+// -1 if there is no limit.
+func (u *DataUsage) remaining() int64 {
+	if u.Limit <= 0 {
+		return -1
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if n := u.Limit - u.total(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (u *DataUsage) start(method string) error {
+	if u.remaining() == 0 {
+		return ErrDataLimitExceeded
+	}
+	u.add(method, func(op *OperationUsage) {
+		op.Requests++
+	})
+	return nil
+}
+
+// countingReadCloser records the bytes read from a body, and stops reading
+// once the limit is reached.
+type countingReadCloser struct {
+	io.ReadCloser
+	usage  *DataUsage
+	count  func(op *OperationUsage, n int64)
+	method string
+}
+
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	remaining := rc.usage.remaining()
+	if remaining == 0 {
+		return 0, ErrDataLimitExceeded
+	} else if remaining > 0 && int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := rc.ReadCloser.Read(p)
+	if n > 0 {
+		rc.usage.add(rc.method, func(op *OperationUsage) {
+			rc.count(op, int64(n))
+		})
+	}
+	return n, err
+}
+
+func countRequestBytes(op *OperationUsage, n int64) {
+	op.RequestBytes += n
+}
+
+func countResponseBytes(op *OperationUsage, n int64) {
+	op.ResponseBytes += n
+}
+
+type dataUsageHTTPClient struct {
+	c     HTTPClient
+	usage *DataUsage
+}
+
+func (c *dataUsageHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if err := c.usage.start(req.Method); err != nil {
+		return nil, err
+	}
+
+	// Don't modify the caller's request
+	req = req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingReadCloser{req.Body, c.usage, countRequestBytes, req.Method}
+	}
+	if getBody := req.GetBody; getBody != nil {
+		// Bodies sent again, e.g. on redirects, are counted as well
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil || body == http.NoBody {
+				return body, err
+			}
+			return &countingReadCloser{body, c.usage, countRequestBytes, req.Method}, nil
+		}
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingReadCloser{resp.Body, c.usage, countResponseBytes, req.Method}
+	return resp, nil
+}
+
+// HTTPClientWithDataUsage returns an HTTP client that records the data
+// transferred by all outgoing requests in usage. If c is nil,
+// http.DefaultClient is used.
+func HTTPClientWithDataUsage(c HTTPClient, usage *DataUsage) HTTPClient {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &dataUsageHTTPClient{c, usage}
+}
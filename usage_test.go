@@ -0,0 +1,111 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClient_dataUsage(t *testing.T) {
+	h := &Handler{FileSystem: &MemFileSystem{}}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	var usage DataUsage
+	c, err := NewClient(HTTPClientWithDataUsage(nil, &usage), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	data := strings.Repeat("x", 1000)
+	wc, err := c.Create(ctx, "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(wc, data)
+	if err := wc.Close(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	rc, err := c.Open(ctx, "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rc)
+	rc.Close()
+
+	ops := usage.Operations()
+	if op := ops[http.MethodPut]; op.Requests != 1 || op.RequestBytes != 1000 {
+		t.Errorf("PUT usage = %+v, want 1 request with 1000 bytes", op)
+	}
+	if op := ops[http.MethodGet]; op.Requests != 1 || op.ResponseBytes != 1000 {
+		t.Errorf("GET usage = %+v, want 1 response with 1000 bytes", op)
+	}
+	if total := usage.Total(); total != 2000 {
+		t.Errorf("Total() = %v, want 2000", total)
+	}
+
+	usage.Limit = 2000
+	if _, err := c.Stat(ctx, "/file.txt"); !errors.Is(err, ErrDataLimitExceeded) {
+		t.Errorf("Stat() over the limit = %v, want ErrDataLimitExceeded", err)
+	}
+	usage.Reset()
+	if _, err := c.Stat(ctx, "/file.txt"); err != nil {
+		t.Errorf("Stat() after Reset() = %v", err)
+	}
+}
+
+func TestClient_dataUsageLimit(t *testing.T) {
+	fs := newTestFileSystem(t, map[string]string{"/large.txt": strings.Repeat("x", 1000)})
+	ts := httptest.NewServer(&Handler{FileSystem: fs})
+	defer ts.Close()
+
+	usage := DataUsage{Limit: 100}
+	hc := HTTPClientWithDataUsage(nil, &usage)
+	c, err := NewClient(hc, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := c.Open(context.Background(), "/large.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if !errors.Is(err, ErrDataLimitExceeded) {
+		t.Errorf("reading a body over the limit = %v, want ErrDataLimitExceeded", err)
+	}
+	if len(b) != 100 || usage.Total() != 100 {
+		t.Errorf("read %v bytes with a total of %v, want 100", len(b), usage.Total())
+	}
+
+	// The caller's request is left untouched
+	usage.Reset()
+	body := strings.NewReader("hello")
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/small.txt", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getBody := req.GetBody
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := req.Body.(*countingReadCloser); ok {
+		t.Errorf("Do() replaced the request body")
+	}
+	if reflect.ValueOf(req.GetBody).Pointer() != reflect.ValueOf(getBody).Pointer() {
+		t.Errorf("Do() replaced the request GetBody")
+	}
+	if op := usage.Operations()[http.MethodPut]; op.RequestBytes != 5 {
+		t.Errorf("PUT usage = %+v, want 5 request bytes", op)
+	}
+}
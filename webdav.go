@@ -4,6 +4,9 @@
 package webdav
 
 import (
+	"context"
+	"encoding/xml"
+	"net/http"
 	"time"
 
 	"github.com/emersion/go-webdav/internal"
@@ -17,6 +20,29 @@ type FileInfo struct {
 	IsDir    bool
 	MIMEType string
 	ETag     string
+
+	// DownloadName is an optional file name suggested to user agents
+	// downloading the file, sent in the Content-Disposition header. This is
+	// useful when paths aren't meaningful to users.
+	DownloadName string
+
+	// RedirectTarget, if set, makes the file a redirect reference resource
+	// (RFC 4437) pointing to the specified path or URL. This can be used to
+	// expose symbolic links.
+	RedirectTarget string
+}
+
+// DeadPropertyStore stores arbitrary properties set by clients via PROPPATCH,
+// e.g. display names or tags. FileSystems, CalDAV backends and CardDAV
+// backends can implement it to support PROPPATCH.
+//
+// Property values are stored as inner XML. Implementations are responsible
+// for moving, copying and deleting properties along with resources.
+type DeadPropertyStore interface {
+	// GetDeadProperties returns the properties of a resource, keyed by name.
+	GetDeadProperties(ctx context.Context, name string) (map[xml.Name]string, error)
+	SetDeadProperties(ctx context.Context, name string, props map[xml.Name]string) error
+	RemoveDeadProperties(ctx context.Context, name string, names []xml.Name) error
 }
 
 type CopyOptions struct {
@@ -28,6 +54,37 @@ type MoveOptions struct {
 	NoOverwrite bool
 }
 
+// CreateOptions contains options for ConditionalFileSystem.CreateWithOptions.
+type CreateOptions struct {
+	// IfMatch only writes the file if its current ETag matches.
+	IfMatch ConditionalMatch
+	// IfNoneMatch only writes the file if its current ETag doesn't match.
+	// "*" only creates the file if it doesn't exist yet.
+	IfNoneMatch ConditionalMatch
+}
+
+// check checks the preconditions against the ETag of the current file, if
+// any.
+func (opts *CreateOptions) check(etag string, exists bool) error {
+	if opts.IfMatch.IsSet() && (!exists || !internal.MatchETag(string(opts.IfMatch), etag, false)) {
+		return internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: If-Match precondition failed")
+	}
+	if opts.IfNoneMatch.IsSet() && exists && internal.MatchETag(string(opts.IfNoneMatch), etag, true) {
+		return internal.HTTPErrorf(http.StatusPreconditionFailed, "webdav: If-None-Match precondition failed")
+	}
+	return nil
+}
+
+// PutOptions contains options for Client.Put.
+type PutOptions struct {
+	// IfMatch only writes the file if its current ETag matches, e.g. to
+	// prevent overwriting concurrent updates.
+	IfMatch ConditionalMatch
+	// IfNoneMatch only writes the file if its current ETag doesn't match.
+	// "*" only creates the file if it doesn't exist yet.
+	IfNoneMatch ConditionalMatch
+}
+
 // ConditionalMatch represents the value of a conditional header
 // according to RFC 2068 section 14.25 and RFC 2068 section 14.26
 // The (optional) value can either be a wildcard or an ETag.
@@ -48,3 +105,8 @@ func (val ConditionalMatch) ETag() (string, error) {
 	}
 	return string(e), nil
 }
+
+// MatchETag returns a ConditionalMatch matching a single ETag.
+func MatchETag(etag string) ConditionalMatch {
+	return ConditionalMatch(internal.ETag(etag).String())
+}
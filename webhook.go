@@ -0,0 +1,263 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebhookPayload is the JSON body POSTed by a Webhook.
+type WebhookPayload struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Principal   string    `json:"principal,omitempty"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	ETagBefore  string    `json:"etag_before,omitempty"`
+	ETagAfter   string    `json:"etag_after,omitempty"`
+}
+
+// Webhook is an AuditSink which POSTs a WebhookPayload to a list of URLs for
+// each change, e.g. to notify a chat or an automation service.
+//
+// Deliveries are queued and sent in the background by a fixed number of
+// workers. They are retried with an exponential backoff on network errors,
+// 429 and 5xx responses. Audit never blocks: deliveries are dropped and
+// logged when the queue is full.
+//
+// Each event has a unique ID, sent in the Webhook-Id header, which receivers
+// can use to ignore duplicate deliveries. The Unix time of each attempt is
+// sent in the Webhook-Timestamp header. If Secret is set,
+// "<id>.<timestamp>.<payload>" is signed with HMAC-SHA256 and the hex-encoded
+// signature is sent in the Webhook-Signature header as "sha256=<signature>".
+// Receivers should reject deliveries with an old timestamp, so that captured
+// requests can't be replayed.
+type Webhook struct {
+	URLs   []string
+	Secret []byte
+
+	// HTTPClient is used to send requests. If nil, http.DefaultClient is
+	// used.
+	HTTPClient HTTPClient
+	// MaxAttempts is the maximum number of delivery attempts per URL. Zero
+	// means 5.
+	MaxAttempts int
+	// RetryDelay is the delay before the first retry, doubled after each
+	// attempt. Zero means 1 second.
+	RetryDelay time.Duration
+	// QueueSize is the maximum number of pending deliveries. Zero means 100.
+	QueueSize int
+	// Workers is the number of deliveries sent concurrently. Zero means 4.
+	Workers int
+	// ErrorLog specifies an optional logger for failed deliveries. If nil,
+	// logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	once   sync.Once
+	queue  chan webhookDelivery
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // pending deliveries
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type webhookDelivery struct {
+	url  string
+	id   string
+	body []byte
+}
+
+var _ AuditSink = (*Webhook)(nil)
+
+func (wh *Webhook) init() {
+	wh.once.Do(func() {
+		queueSize := wh.QueueSize
+		if queueSize <= 0 {
+			queueSize = 100
+		}
+		workers := wh.Workers
+		if workers <= 0 {
+			workers = 4
+		}
+
+		wh.queue = make(chan webhookDelivery, queueSize)
+		wh.ctx, wh.cancel = context.WithCancel(context.Background())
+		for i := 0; i < workers; i++ {
+			go wh.work()
+		}
+	})
+}
+
+// Audit implements AuditSink.
+func (wh *Webhook) Audit(ctx context.Context, event *AuditEvent) {
+	body, err := json.Marshal(&WebhookPayload{
+		Time:        time.Now().UTC(),
+		Method:      event.Method,
+		Principal:   event.Principal,
+		Path:        event.Path,
+		Destination: event.Destination,
+		ETagBefore:  event.ETagBefore,
+		ETagAfter:   event.ETagAfter,
+	})
+	if err != nil {
+		wh.logf("webdav: failed to marshal webhook payload: %v", err)
+		return
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		wh.logf("webdav: failed to generate webhook ID: %v", err)
+		return
+	}
+	id := hex.EncodeToString(b[:])
+
+	wh.init()
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.closed {
+		return
+	}
+	for _, u := range wh.URLs {
+		wh.wg.Add(1)
+		select {
+		case wh.queue <- webhookDelivery{u, id, body}:
+		default:
+			wh.wg.Done()
+			wh.logf("webdav: dropping webhook delivery to %v: queue is full", u)
+		}
+	}
+}
+
+// Wait blocks until all pending deliveries are done, e.g. before shutting
+// down. Use Close to abandon them instead.
+func (wh *Webhook) Wait() {
+	wh.wg.Wait()
+}
+
+// Close stops the workers. Pending deliveries are abandoned, including
+// retries waiting for their backoff delay, and later events are ignored.
+func (wh *Webhook) Close() {
+	wh.init()
+	wh.mu.Lock()
+	wh.closed = true
+	wh.mu.Unlock()
+	wh.cancel()
+}
+
+func (wh *Webhook) work() {
+	for {
+		select {
+		case d := <-wh.queue:
+			wh.deliver(&d)
+			wh.wg.Done()
+		case <-wh.ctx.Done():
+			// No delivery can be queued anymore, drop the remaining ones
+			for {
+				select {
+				case <-wh.queue:
+					wh.wg.Done()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (wh *Webhook) deliver(d *webhookDelivery) {
+	maxAttempts := wh.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	delay := wh.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-wh.ctx.Done():
+				t.Stop()
+				return
+			}
+			delay *= 2
+		}
+
+		var retry bool
+		retry, err = wh.post(d)
+		if err == nil || !retry || wh.ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil && wh.ctx.Err() == nil {
+		wh.logf("webdav: failed to deliver webhook to %v: %v", d.url, err)
+	}
+}
+
+func (wh *Webhook) post(d *webhookDelivery) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(wh.ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", d.id)
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	if wh.Secret != nil {
+		req.Header.Set("Webhook-Signature", "sha256="+wh.sign(d.id, timestamp, d.body))
+	}
+
+	c := wh.HTTPClient
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("HTTP %v", resp.Status)
+	default:
+		return false, fmt.Errorf("HTTP %v", resp.Status)
+	}
+}
+
+// sign returns the hex-encoded signature of a delivery.
+func (wh *Webhook) sign(id, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, wh.Secret)
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhook) logf(format string, v ...interface{}) {
+	if wh.ErrorLog != nil {
+		wh.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}